@@ -8,15 +8,33 @@
 package api
 
 import (
+	"context"
 	"fmt"
 	"math/rand"
 	"net/http"
-
+	"strings"
+
+	"github.com/baas-project/baas/control_server/multicast"
+	"github.com/baas-project/baas/control_server/nbd"
+	"github.com/baas-project/baas/control_server/progress"
+	"github.com/baas-project/baas/control_server/tracker"
+	"github.com/baas-project/baas/control_server/transcode"
+	api_pkg "github.com/baas-project/baas/pkg/api"
 	"github.com/baas-project/baas/pkg/database"
+	"github.com/baas-project/baas/pkg/model/images"
+	machinemodel "github.com/baas-project/baas/pkg/model/machine"
+	"github.com/baas-project/baas/pkg/storage"
+	"github.com/baas-project/baas/pkg/util"
 	"github.com/gorilla/mux"
 	"github.com/gorilla/sessions"
+	log "github.com/sirupsen/logrus"
 )
 
+type contextKey int
+
+// machineKey is the key under which an authenticated machine is stored in the request context
+const machineKey contextKey = iota
+
 /*func NewAPI(store database.Store, diskpath path) *API {
 	fmt.Println(a ...interface{})
 }
@@ -26,14 +44,28 @@ import (
 // from either the management OS, or the end user (through some kind of interface).
 // This struct holds state necessary for the request handlers.
 type API struct {
-	store    database.Store
-	diskpath string
-	session  *sessions.CookieStore
-	Routes   []Route
+	store      database.Store
+	files      storage.ImageFiles
+	session    *sessions.CookieStore
+	transcoder *transcode.Transcoder
+	tracker    *tracker.Tracker
+	progress   *progress.Hub
+	// discoveries are the credentials of the machines which boot in discovery mode
+	discoveries *discoveries
+	Routes      []Route
+
+	// DefaultCompression is applied to new versions which are uploaded uncompressed, if it is set
+	DefaultCompression transcode.Target
+	// Multicast sends the versions to many machines at once, it is nil when multicast is disabled
+	Multicast *multicast.Manager
+	// NBD serves the disks of the machines which boot over the network, it is nil when NBD boots are disabled
+	NBD *nbd.Manager
+	// Discovery boots unknown machines into the management OS to register themselves, they are refused otherwise
+	Discovery bool
 }
 
-// NewAPI creates a new API struct.
-func NewAPI(store database.Store, diskpath string) *API {
+// NewAPI creates a new API struct, the files of the images are kept in the given backend.
+func NewAPI(store database.Store, files storage.ImageFiles) *API {
 	session := sessions.NewCookieStore([]byte(fmt.Sprint(rand.Intn(2_000_000))))
 	session.Options = &sessions.Options{
 		Path:     "/",
@@ -42,9 +74,14 @@ func NewAPI(store database.Store, diskpath string) *API {
 	}
 
 	return &API{
-		store:    store,
-		diskpath: diskpath,
-		session:  session,
+		store:      store,
+		files:      files,
+		session:    session,
+		transcoder: transcode.NewTranscoder(store, files),
+		tracker:    tracker.NewTracker(),
+		progress:   progress.NewHub(),
+
+		discoveries: newDiscoveries(),
 	}
 }
 
@@ -52,15 +89,25 @@ func NewAPI(store database.Store, diskpath string) *API {
 // lint:
 func (api_ *API) CheckRole(route Route, next http.HandlerFunc) http.HandlerFunc { // nolint
 	return func(w http.ResponseWriter, r *http.Request) {
-		// TODO: dear god, security here needs to be done beter.
-		if r.Header.Get("type") == "system" {
-			next.ServeHTTP(w, r)
+		// Requests from the management OS are authenticated with the credential of their machine
+		if mac := r.Header.Get(api_pkg.MachineHeader); mac != "" {
+			machine, ok := api_.checkMachine(route, mac, r.Header.Get(api_pkg.MachineTokenHeader), r)
+			if !ok {
+				http.Error(w, "Machine not permitted to access this resource.", http.StatusForbidden)
+				return
+			}
+
+			next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), machineKey, machine)))
 			return
 		}
-		// else if !route.UserAllowed {
-		// 	http.Error(w, "Users are not allowed to access this endpoint", http.StatusBadRequest)
-		// 	return
-		// }
+
+		// Scripts authenticate with a personal access token instead of the session cookie
+		if header := r.Header.Get("Authorization"); strings.HasPrefix(header, bearerPrefix) {
+			if !api_.authenticateToken(r, strings.TrimPrefix(header, bearerPrefix)) {
+				http.Error(w, "Invalid or expired access token.", http.StatusUnauthorized)
+				return
+			}
+		}
 
 		session, _ := api_.session.Get(r, "session-name")
 		role, ok := session.Values["Role"].(string)
@@ -112,3 +159,65 @@ func checkSameUser(route Route, _ http.ResponseWriter, r *http.Request, api *API
 
 	return username == name
 }
+
+// checkMachine verifies the credential of a machine and checks whether it may access this route.
+// Machines are limited to the routes of their own MAC address and to the images in their current boot setup.
+func (api_ *API) checkMachine(route Route, mac string, token string, r *http.Request) (*machinemodel.MachineModel, bool) {
+	if !route.MachineAllowed {
+		return nil, false
+	}
+
+	machine, err := api_.store.GetMachineByMac(util.MacAddress{Address: mac})
+	if err != nil {
+		log.Warnf("Request from unknown machine %s: %v", mac, err)
+		return nil, false
+	}
+
+	if !util.CheckToken(token, machine.TokenHash) {
+		log.Warnf("Request from machine %s with an invalid token", mac)
+		return nil, false
+	}
+
+	vars := mux.Vars(r)
+	if target, ok := vars["mac"]; ok && target != machine.MacAddress.Address {
+		return nil, false
+	}
+
+	if target, ok := vars["uuid"]; ok && !api_.machineMayAccessImage(machine, images.ImageUUID(target)) {
+		log.Warnf("Machine %s tried to access image %s outside of its boot setup", mac, target)
+		return nil, false
+	}
+
+	return machine, true
+}
+
+// machineMayAccessImage checks whether the image is the machine image or part of the current boot setup
+func (api_ *API) machineMayAccessImage(machine *machinemodel.MachineModel, uuid images.ImageUUID) bool {
+	machineImage, err := api_.store.GetMachineImageByMac(machine.MacAddress)
+	if err == nil && machineImage.UUID == uuid {
+		return true
+	}
+
+	if machine.CurrentSetupUUID == "" {
+		return false
+	}
+
+	setup, err := api_.store.GetImageSetup(machine.CurrentSetupUUID)
+	if err != nil {
+		return false
+	}
+
+	for _, image := range setup.Images {
+		if image.UUIDImage == uuid {
+			return true
+		}
+	}
+
+	return false
+}
+
+// requestMachine returns the machine which sent the request, or nil if it was not sent by a machine
+func requestMachine(r *http.Request) *machinemodel.MachineModel {
+	machine, _ := r.Context().Value(machineKey).(*machinemodel.MachineModel)
+	return machine
+}
@@ -0,0 +1,139 @@
+// Copyright (c) 2020-2022 TU Delft & Valentijn van de Beek <v.d.vandebeek@student.tudelft.nl> All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package api
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	api_pkg "github.com/baas-project/baas/pkg/api"
+	"github.com/baas-project/baas/pkg/database"
+	"github.com/baas-project/baas/pkg/database/sqlite"
+	"github.com/baas-project/baas/pkg/model/images"
+	machinemodel "github.com/baas-project/baas/pkg/model/machine"
+	"github.com/baas-project/baas/pkg/model/user"
+	"github.com/baas-project/baas/pkg/storage"
+	"github.com/baas-project/baas/pkg/util"
+	"github.com/stretchr/testify/assert"
+)
+
+// loginAs adds a session cookie to the request as if the user had logged in
+func loginAs(t *testing.T, api_ *API, r *http.Request, username string, role user.UserRole) {
+	session, _ := api_.session.Get(r, "session-name")
+	session.Values["Username"] = username
+	session.Values["Role"] = string(role)
+
+	w := httptest.NewRecorder()
+	err := session.Save(r, w)
+	assert.NoError(t, err)
+
+	for _, cookie := range w.Result().Cookies() {
+		r.AddCookie(cookie)
+	}
+}
+
+// machineRequest creates a request which is authenticated with the credentials of a machine
+func machineRequest(method string, uri string, mac string, token string) *http.Request {
+	req := httptest.NewRequest(method, uri, strings.NewReader(`{"Level": "info", "Message": "test"}`))
+	req.Header.Add("origin", "http://localhost:9090")
+	req.Header.Add(api_pkg.MachineHeader, mac)
+	req.Header.Add(api_pkg.MachineTokenHeader, token)
+
+	return req
+}
+
+func setupMachineStore(t *testing.T) (database.Store, string) {
+	store, err := sqlite.NewSqliteStore(sqlite.InMemoryPath)
+	assert.NoError(t, err)
+
+	for _, mac := range []string{"abc", "cba"} {
+		err = store.UpdateMachine(&machinemodel.MachineModel{
+			MacAddress:   util.MacAddress{Address: mac},
+			Name:         mac,
+			Architecture: machinemodel.X86_64,
+		})
+		assert.NoError(t, err)
+	}
+
+	token, err := util.GenerateToken()
+	assert.NoError(t, err)
+
+	err = store.SetMachineToken(util.MacAddress{Address: "abc"}, util.HashToken(token))
+	assert.NoError(t, err)
+
+	return store, token
+}
+
+func TestApi_MachineCredentials(t *testing.T) {
+	store, token := setupMachineStore(t)
+	handler := getHandler(store, storage.NewMemory(), "")
+
+	resp := httptest.NewRecorder()
+	handler.ServeHTTP(resp, machineRequest(http.MethodPost, "/log", "abc", token))
+	assert.Equal(t, http.StatusOK, resp.Code)
+
+	// The token of one machine cannot be used for another
+	resp = httptest.NewRecorder()
+	handler.ServeHTTP(resp, machineRequest(http.MethodPost, "/log", "cba", token))
+	assert.Equal(t, http.StatusForbidden, resp.Code)
+
+	resp = httptest.NewRecorder()
+	handler.ServeHTTP(resp, machineRequest(http.MethodPost, "/log", "abc", "wrong"))
+	assert.Equal(t, http.StatusForbidden, resp.Code)
+
+	// The old header bypass is gone
+	resp = httptest.NewRecorder()
+	req := httptest.NewRequest(http.MethodGet, "/machines", nil)
+	req.Header.Add("type", "system")
+	handler.ServeHTTP(resp, req)
+	assert.NotEqual(t, http.StatusOK, resp.Code)
+}
+
+func TestApi_MachineCredentialsScope(t *testing.T) {
+	store, token := setupMachineStore(t)
+	handler := getHandler(store, storage.NewMemory(), "")
+
+	err := store.CreateUser(&user.UserModel{Username: "test", Name: "Test", Email: "test@example.com", Role: user.User})
+	assert.NoError(t, err)
+
+	store.CreateImage(&images.ImageModel{Name: "abc", UUID: "def", Username: "test"})
+
+	// Routes which are not meant for machines are refused
+	resp := httptest.NewRecorder()
+	handler.ServeHTTP(resp, machineRequest(http.MethodGet, "/machines", "abc", token))
+	assert.Equal(t, http.StatusForbidden, resp.Code)
+
+	// Machines are limited to their own MAC address
+	resp = httptest.NewRecorder()
+	handler.ServeHTTP(resp, machineRequest(http.MethodGet, "/machine/cba/boot", "abc", token))
+	assert.Equal(t, http.StatusForbidden, resp.Code)
+
+	// And to the images in their current boot setup
+	resp = httptest.NewRecorder()
+	handler.ServeHTTP(resp, machineRequest(http.MethodGet, "/image/def/1", "abc", token))
+	assert.Equal(t, http.StatusForbidden, resp.Code)
+
+	err = store.CreateImageSetup("test", &images.ImageSetup{Name: "setup", Username: "test", UUID: "setup"})
+	assert.NoError(t, err)
+
+	setup, err := store.GetImageSetup("setup")
+	assert.NoError(t, err)
+
+	image, err := store.GetImageByUUID("def")
+	assert.NoError(t, err)
+
+	store.AddImageToImageSetup(&setup, image, images.Version{Version: 1, ImageModelUUID: "def"}, false)
+
+	err = store.SetMachineBootSetup(util.MacAddress{Address: "abc"}, "setup")
+	assert.NoError(t, err)
+
+	api := NewAPI(store, storage.NewMemory())
+	machine, err := store.GetMachineByMac(util.MacAddress{Address: "abc"})
+	assert.NoError(t, err)
+	assert.True(t, api.machineMayAccessImage(machine, "def"))
+	assert.False(t, api.machineMayAccessImage(machine, "other"))
+}
@@ -0,0 +1,198 @@
+// Copyright (c) 2020-2022 TU Delft & Valentijn van de Beek <v.d.vandebeek@student.tudelft.nl> All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package api
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+
+	"github.com/baas-project/baas/pkg/blockmap"
+	"github.com/baas-project/baas/pkg/compression"
+	"github.com/baas-project/baas/pkg/diskimage"
+	"github.com/baas-project/baas/pkg/model/images"
+	"github.com/baas-project/baas/pkg/storage"
+	"github.com/google/uuid"
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+)
+
+var (
+	// errInvalidBlockMap is returned when an upload which should be a block map cannot be read as one
+	errInvalidBlockMap = errors.New("the upload is not a valid block map")
+	// errBaseMismatch is returned when the version a block map was made against is not there anymore
+	errBaseMismatch = errors.New("the base version of the block map does not exist or has changed")
+)
+
+// blockMapFile is where a block map is kept while the disk is rebuilt from it
+func blockMapFile(upload string) string {
+	return "upload-" + upload + ".bmap"
+}
+
+// commitBlockMap rebuilds the disk from the block map in the upload and stores it as the file of the version.
+// The block map keeps its compression. The digest is the one of the uploaded block map, the rebuilt disk is
+// checked against the digest in the block map itself. Once the block map is taken out of the staging area the
+// upload cannot be committed again, so it is removed when the disk cannot be rebuilt.
+func (api_ *API) commitBlockMap(image *images.ImageModel, upload *images.UploadModel, digest string,
+	version uint64) error {
+	name := blockMapFile(upload.UUID)
+	if err := api_.files.Commit(upload.UUID, image.UUID, name, digest); err != nil {
+		return err
+	}
+
+	defer func() {
+		if err := api_.files.Remove(image.UUID, name); err != nil {
+			log.Warnf("Cannot remove block map %s of image %s: %v", name, image.UUID, err)
+		}
+	}()
+
+	staged, sum, err := api_.applyBlockMap(image, name)
+	if err != nil {
+		if deleteErr := api_.store.DeleteUpload(upload); deleteErr != nil {
+			log.Warnf("Cannot remove the failed upload %s: %v", upload.UUID, deleteErr)
+		}
+
+		return err
+	}
+
+	if err = api_.files.Commit(staged, image.UUID, storage.VersionFile(version), sum); err != nil {
+		_ = api_.files.Discard(staged)
+		return errors.Wrap(err, "store rebuilt version")
+	}
+
+	return nil
+}
+
+// applyBlockMap stages the disk rebuilt from the block map and its base, it returns the staged upload and
+// the SHA-256 of the staged file
+func (api_ *API) applyBlockMap(image *images.ImageModel, name string) (string, string, error) {
+	f, err := api_.files.Open(image.UUID, name)
+	if err != nil {
+		return "", "", errors.Wrap(err, "open block map")
+	}
+
+	defer f.Close()
+
+	r, strategy, err := compression.DecompressDetected(f)
+	if err != nil {
+		return "", "", errors.Wrap(errInvalidBlockMap, err.Error())
+	}
+
+	defer r.Close()
+
+	header, err := blockmap.ReadHeader(r)
+	if err != nil {
+		return "", "", errors.Wrap(errInvalidBlockMap, err.Error())
+	}
+
+	var base io.Reader
+	if header.HasBase() {
+		closer, err := api_.openBase(image, header)
+		if err != nil {
+			return "", "", err
+		}
+
+		defer closer.Close()
+		base = closer
+	}
+
+	// The disk is written into one end of the pipe while the other end is compressed and staged
+	pr, pw := io.Pipe()
+	applied := make(chan error, 1)
+
+	go func() {
+		err := blockmap.Apply(pw, header, r, base)
+		_ = pw.CloseWithError(err)
+		applied <- err
+	}()
+
+	compressed, err := compression.Compress(pr, strategy)
+	if err != nil {
+		_ = pr.Close()
+		<-applied
+		return "", "", errors.Wrap(err, "compress rebuilt version")
+	}
+
+	defer compressed.Close()
+
+	staged := uuid.New().String()
+	file := sha256.New()
+
+	_, err = api_.files.Append(staged, 0, io.TeeReader(compressed, file))
+	_ = pr.Close()
+
+	if applyErr := <-applied; applyErr != nil {
+		err = applyErr
+	}
+
+	if err != nil {
+		_ = api_.files.Discard(staged)
+		return "", "", errors.Wrap(err, "rebuild version")
+	}
+
+	log.Infof("Rebuilt a disk of %d bytes of image %s from a block map with %d bytes of data", header.Size,
+		image.UUID, header.DataSize())
+
+	return staged, hex.EncodeToString(file.Sum(nil)), nil
+}
+
+// baseDisk is the expanded disk of a version, it closes the files it is read from
+type baseDisk struct {
+	io.Reader
+	closers []io.Closer
+}
+
+func (b *baseDisk) Close() error {
+	for i := len(b.closers) - 1; i >= 0; i-- {
+		_ = b.closers[i].Close()
+	}
+
+	return nil
+}
+
+// openBase opens the disk of the version the block map was made against, its digest has to be the same
+func (api_ *API) openBase(image *images.ImageModel, header *blockmap.Header) (*baseDisk, error) {
+	found := false
+	for _, version := range image.Versions {
+		if version.Version == header.BaseVersion && version.Digest == header.BaseDigest {
+			found = true
+			break
+		}
+	}
+
+	if !found {
+		return nil, errBaseMismatch
+	}
+
+	base, err := api_.openDisk(image.UUID, header.BaseVersion)
+	return base, errors.Wrap(err, "open base version")
+}
+
+// openDisk opens the expanded disk of the version, whatever the compression and type of disk image of its file
+func (api_ *API) openDisk(image images.ImageUUID, version uint64) (*baseDisk, error) {
+	f, err := api_.files.Open(image, storage.VersionFile(version))
+	if err != nil {
+		return nil, err
+	}
+
+	base := &baseDisk{closers: []io.Closer{f}}
+
+	r, _, err := compression.DecompressDetected(f)
+	if err != nil {
+		_ = base.Close()
+		return nil, errors.Wrap(err, "decompress version")
+	}
+
+	base.closers = append(base.closers, r)
+
+	_, disk, err := diskimage.Open(r)
+	if err != nil {
+		_ = base.Close()
+		return nil, errors.Wrap(err, "read version")
+	}
+
+	base.Reader = diskimage.NewReader(disk)
+	return base, nil
+}
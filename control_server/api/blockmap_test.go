@@ -0,0 +1,136 @@
+// Copyright (c) 2020-2022 TU Delft & Valentijn van de Beek <v.d.vandebeek@student.tudelft.nl> All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package api
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/baas-project/baas/pkg/blockmap"
+	"github.com/baas-project/baas/pkg/compression"
+	"github.com/baas-project/baas/pkg/database/memory"
+	"github.com/baas-project/baas/pkg/model/images"
+	"github.com/baas-project/baas/pkg/model/user"
+	"github.com/baas-project/baas/pkg/storage"
+	"github.com/stretchr/testify/assert"
+)
+
+// blockMapOf plans the disk against the base and returns the block map compressed with gzip
+func blockMapOf(t *testing.T, disk []byte, base *blockmap.Hashes) ([]byte, *blockmap.Hashes) {
+	header, hashes, err := blockmap.Plan(bytes.NewReader(disk), 4096, base)
+	assert.NoError(t, err)
+
+	var raw bytes.Buffer
+	assert.NoError(t, blockmap.Write(&raw, header, bytes.NewReader(disk)))
+
+	r, err := compression.Compress(&raw, images.DiskCompressionStrategyGZip)
+	assert.NoError(t, err)
+
+	data, err := ioutil.ReadAll(r)
+	assert.NoError(t, err)
+
+	return data, hashes
+}
+
+// uploadBlockMap sends the block map as a new version and commits it
+func uploadBlockMap(t *testing.T, api *API, handler http.Handler, data []byte) *httptest.ResponseRecorder {
+	body, _ := json.Marshal(images.UploadModel{NewVersion: true, BlockMap: true})
+	resp := uploadRequest(t, api, handler, http.MethodPost, "/image/fedora/uploads", bytes.NewReader(body), "")
+	assert.Equal(t, http.StatusCreated, resp.Code)
+
+	var upload images.UploadModel
+	assert.NoError(t, json.NewDecoder(resp.Body).Decode(&upload))
+	uri := "/image/fedora/uploads/" + upload.UUID
+
+	resp = uploadRequest(t, api, handler, http.MethodPatch, uri, bytes.NewReader(data), "0")
+	assert.Equal(t, http.StatusOK, resp.Code)
+
+	hash := sha256.Sum256(data)
+	return uploadRequest(t, api, handler, http.MethodPost, uri,
+		strings.NewReader(`{"Digest": "`+hex.EncodeToString(hash[:])+`"}`), "")
+}
+
+func TestApi_BlockMapUpload(t *testing.T) {
+	store := memory.NewStore()
+	files := storage.NewMemory()
+
+	err := store.CreateUser(&user.UserModel{Username: "test", Name: "Test", Role: user.User})
+	assert.NoError(t, err)
+	store.CreateImage(&images.ImageModel{Name: "Fedora", UUID: "fedora", Username: "test",
+		DiskCompressionStrategy: images.DiskCompressionStrategyGZip})
+
+	api := NewAPI(store, files)
+	handler := api.handler("")
+
+	// Without a base the zero blocks are left out of the block map
+	first := make([]byte, 1024*1024)
+	copy(first[8192:], bytes.Repeat([]byte("baas"), 2048))
+
+	data, hashes := blockMapOf(t, first, nil)
+	resp := uploadBlockMap(t, api, handler, data)
+	assert.Equal(t, http.StatusCreated, resp.Code, resp.Body.String())
+
+	var version images.Version
+	assert.NoError(t, json.NewDecoder(resp.Body).Decode(&version))
+
+	hash := sha256.Sum256(first)
+	assert.Equal(t, hex.EncodeToString(hash[:]), version.Digest)
+	assert.Equal(t, int64(len(first)), version.Size)
+
+	// The next one only holds the blocks which changed
+	hashes.Version = version.Version
+	hashes.Digest = version.Digest
+
+	second := append([]byte{}, first...)
+	copy(second[500000:], "hello world")
+
+	data, _ = blockMapOf(t, second, hashes)
+	resp = uploadBlockMap(t, api, handler, data)
+	assert.Equal(t, http.StatusCreated, resp.Code, resp.Body.String())
+	assert.NoError(t, json.NewDecoder(resp.Body).Decode(&version))
+
+	hash = sha256.Sum256(second)
+	assert.Equal(t, hex.EncodeToString(hash[:]), version.Digest)
+
+	// The version is stored as a whole disk, with the compression of the block map
+	f, err := files.Open("fedora", storage.VersionFile(version.Version))
+	assert.NoError(t, err)
+
+	r, strategy, err := compression.DecompressDetected(f)
+	assert.NoError(t, err)
+	assert.Equal(t, images.DiskCompressionStrategy(images.DiskCompressionStrategyGZip), strategy)
+
+	disk, err := ioutil.ReadAll(r)
+	assert.NoError(t, err)
+	assert.True(t, bytes.Equal(second, disk))
+
+	// A block map against a version which does not match cannot be rebuilt
+	hashes.Digest = strings.Repeat("0", 63) + "1"
+	data, _ = blockMapOf(t, second, hashes)
+	resp = uploadBlockMap(t, api, handler, data)
+	assert.Equal(t, http.StatusConflict, resp.Code)
+
+	// Neither can a block map whose disk comes out different, here because the hashes are not those of the base
+	hashes.Version = version.Version
+	hashes.Digest = version.Digest
+	data, _ = blockMapOf(t, first, hashes)
+	resp = uploadBlockMap(t, api, handler, data)
+	assert.Equal(t, http.StatusUnprocessableEntity, resp.Code)
+
+	image, err := store.GetImageByUUID("fedora")
+	assert.NoError(t, err)
+	assert.Len(t, image.Versions, 3)
+
+	// Data which is not a block map is refused
+	resp = uploadBlockMap(t, api, handler, []byte("not a block map"))
+	assert.Equal(t, http.StatusBadRequest, resp.Code)
+}
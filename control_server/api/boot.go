@@ -6,15 +6,18 @@ package api
 
 import (
 	"encoding/json"
+	"fmt"
 	"net"
 	"net/http"
 	"strings"
 
+	api_pkg "github.com/baas-project/baas/pkg/api"
 	"github.com/baas-project/baas/pkg/model/machine"
 
 	"github.com/baas-project/baas/pkg/util"
 
 	log "github.com/sirupsen/logrus"
+	"gorm.io/gorm"
 
 	"github.com/gorilla/mux"
 )
@@ -70,8 +73,18 @@ func (api_ *API) ServeBootConfigurations(w http.ResponseWriter, r *http.Request)
 
 	log.Infof("Serving boot config for %v at ip: %v", mac, addr)
 
+	// The boot configuration carries the machine credential, so it may only be handed to the embedded pixiecore.
+	if ip := net.ParseIP(addr); ip == nil || !ip.IsLoopback() {
+		log.Warnf("Refusing to serve boot config for %v to non-local address %v", mac, addr)
+		http.Error(w, "Cannot serve the boot configuration", http.StatusForbidden)
+		return
+	}
+
 	m, err := api_.store.GetMachineByMac(util.MacAddress{Address: mac})
-	if err != nil {
+	if (err == gorm.ErrRecordNotFound && api_.Discovery) || (err == nil && api_.awaitingApproval(m)) {
+		api_.serveDiscoveryBootConfig(w, mac)
+		return
+	} else if err != nil {
 		log.Errorf("Couldn't find machine in store: %v", err)
 		http.Error(w, "Cannot serve the boot configuration", http.StatusNotFound)
 		return
@@ -84,8 +97,39 @@ func (api_ *API) ServeBootConfigurations(w http.ResponseWriter, r *http.Request)
 		return
 	}
 
-	log.Debugf("Sending boot config %v", resp)
+	// Every boot of the management OS gets a fresh credential, which invalidates the previous one.
+	token, err := util.GenerateToken()
+	if err != nil {
+		log.Errorf("Couldn't generate a machine token: %v", err)
+		http.Error(w, "Cannot serve the boot configuration", http.StatusInternalServerError)
+		return
+	}
+
+	if err = api_.store.SetMachineToken(m.MacAddress, util.HashToken(token)); err != nil {
+		log.Errorf("Couldn't store the machine token: %v", err)
+		http.Error(w, "Cannot serve the boot configuration", http.StatusInternalServerError)
+		return
+	}
+
+	resp.Cmdline += fmt.Sprintf(" %s=%s", api_pkg.TokenCmdlineParameter, token)
+	log.Debugf("Sending boot config for %v", mac)
+
+	if err := json.NewEncoder(w).Encode(&resp); err != nil {
+		log.Errorf("Couldn't write bootconfig to network: %v", err)
+		http.Error(w, "Cannot serve the boot configuration", http.StatusInternalServerError)
+	}
+}
+
+// serveDiscoveryBootConfig boots the machine into the management OS in discovery mode, so it registers itself
+func (api_ *API) serveDiscoveryBootConfig(w http.ResponseWriter, mac string) {
+	resp, err := api_.discoveryBootConfig(mac)
+	if err != nil {
+		log.Errorf("Couldn't generate a discovery token: %v", err)
+		http.Error(w, "Cannot serve the boot configuration", http.StatusInternalServerError)
+		return
+	}
 
+	log.Infof("Sending discovery boot config for %v", mac)
 	if err := json.NewEncoder(w).Encode(&resp); err != nil {
 		log.Errorf("Couldn't write bootconfig to network: %v", err)
 		http.Error(w, "Cannot serve the boot configuration", http.StatusInternalServerError)
@@ -0,0 +1,109 @@
+// Copyright (c) 2020-2022 TU Delft & Valentijn van de Beek <v.d.vandebeek@student.tudelft.nl> All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package api
+
+import (
+	"strings"
+
+	"github.com/baas-project/baas/control_server/transcode"
+	"github.com/baas-project/baas/pkg/compression"
+	"github.com/baas-project/baas/pkg/diskimage"
+	"github.com/baas-project/baas/pkg/model/images"
+	"github.com/baas-project/baas/pkg/storage"
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+)
+
+// versionContents describes what is in the file of a version
+type versionContents struct {
+	// Digest is the SHA-256 and Size the size of the decompressed version. This is what ends up on the
+	// disk of the machine, so the management OS can check what it has written against it.
+	Digest string
+	Size   int64
+
+	// Compression is the compression of the file and Type the type of disk image in it, both are detected from
+	// their first bytes
+	Compression images.DiskCompressionStrategy
+	Type        images.DiskType
+}
+
+// inspectVersion decompresses the file of a version and expands the disk image in it to find out what is in it
+func inspectVersion(files storage.ImageFiles, uuid images.ImageUUID, version uint64) (*versionContents, error) {
+	f, err := files.Open(uuid, storage.VersionFile(version))
+	if err != nil {
+		return nil, errors.Wrap(err, "open version file")
+	}
+
+	defer f.Close()
+
+	reader, strategy, err := compression.DecompressDetected(f)
+	if err != nil {
+		return nil, errors.Wrap(err, "decompress version file")
+	}
+
+	defer reader.Close()
+
+	digest, size, diskType, err := diskimage.Digest(reader)
+	if err != nil {
+		return nil, errors.Wrap(err, "read version file")
+	}
+
+	return &versionContents{Digest: digest, Size: size, Compression: strategy, Type: diskType}, nil
+}
+
+// setDigest fills in the digest, the size, the compression and the type of the version from its file. A version
+// without a digest can still be used, the management OS just cannot verify it, so a failure is only logged. The
+// compression and the type are kept with the version, uploads do not have to use those of the image.
+func (api_ *API) setDigest(image *images.ImageModel, version *images.Version) {
+	contents, err := inspectVersion(api_.files, image.UUID, version.Version)
+
+	// The management OS expands the image while it downloads it, which needs the tables before the data
+	if errors.Cause(err) == diskimage.ErrNotStreamable {
+		log.Infof("Rewriting version %d of image %s so it can be expanded while it is downloaded", version.Version,
+			image.UUID)
+
+		if err = transcode.Normalize(api_.files, image.UUID, version.Version); err == nil {
+			contents, err = inspectVersion(api_.files, image.UUID, version.Version)
+		}
+	}
+
+	if err != nil {
+		log.Warnf("Cannot compute the digest of version %d of image %s: %v", version.Version, image.UUID, err)
+		return
+	}
+
+	version.Digest = contents.Digest
+	version.Size = contents.Size
+	version.Compression = contents.Compression
+	version.Type = contents.Type
+
+	if image.ImageFileType != contents.Type {
+		log.Infof("Version %d of image %s is a %s image instead of %s", version.Version, image.UUID, contents.Type,
+			image.ImageFileType)
+	}
+
+	if !strings.EqualFold(string(image.DiskCompressionStrategy), string(contents.Compression)) {
+		log.Infof("Version %d of image %s is compressed with %s instead of %s", version.Version, image.UUID,
+			contents.Compression, image.DiskCompressionStrategy)
+	}
+}
+
+// storeVersion records the digest of the file of the version, which is stored before its file is written.
+// Uncompressed versions are compressed afterwards when there is a default.
+func (api_ *API) storeVersion(image *images.ImageModel, version *images.Version) error {
+	api_.setDigest(image, version)
+
+	if err := api_.store.SetVersionDigest(*version); err != nil {
+		return err
+	}
+
+	if api_.DefaultCompression.IsSet() {
+		if err := api_.transcoder.CompressRaw(image.UUID, api_.DefaultCompression); err != nil {
+			log.Warnf("Cannot compress version %d of image %s: %v", version.Version, image.UUID, err)
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,111 @@
+// Copyright (c) 2020-2022 TU Delft & Valentijn van de Beek <v.d.vandebeek@student.tudelft.nl> All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package api
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/baas-project/baas/pkg/database/memory"
+	"github.com/baas-project/baas/pkg/diskimage"
+	"github.com/baas-project/baas/pkg/model/images"
+	"github.com/baas-project/baas/pkg/model/user"
+	"github.com/baas-project/baas/pkg/storage"
+	gzip "github.com/klauspost/pgzip"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestInspectVersion(t *testing.T) {
+	files := storage.NewMemory()
+
+	w, err := files.Write("fedora", storage.VersionFile(1))
+	assert.NoError(t, err)
+
+	gz := gzip.NewWriter(w)
+	_, err = gz.Write([]byte("hello world"))
+	assert.NoError(t, err)
+	assert.NoError(t, gz.Close())
+	assert.NoError(t, w.Close())
+
+	// The digest is the one of the decompressed image, which is what ends up on the disk
+	contents, err := inspectVersion(files, "fedora", 1)
+	assert.NoError(t, err)
+	assert.Equal(t, helloWorldDigest, contents.Digest)
+	assert.Equal(t, int64(11), contents.Size)
+	assert.Equal(t, images.DiskCompressionStrategy(images.DiskCompressionStrategyGZip), contents.Compression)
+
+	_, err = inspectVersion(files, "fedora", 2)
+	assert.Error(t, err)
+}
+
+func TestApi_DetectCompression(t *testing.T) {
+	store := memory.NewStore()
+	files := storage.NewMemory()
+
+	err := store.CreateUser(&user.UserModel{Username: "test", Name: "Test", Role: user.User})
+	assert.NoError(t, err)
+	store.CreateImage(&images.ImageModel{Name: "Fedora", UUID: "fedora", Username: "test",
+		DiskCompressionStrategy: images.DiskCompressionStrategyZSTD})
+
+	w, err := files.Write("fedora", storage.VersionFile(1))
+	assert.NoError(t, err)
+
+	gz := gzip.NewWriter(w)
+	_, err = gz.Write([]byte("hello world"))
+	assert.NoError(t, err)
+	assert.NoError(t, gz.Close())
+	assert.NoError(t, w.Close())
+
+	api := NewAPI(store, files)
+	image, err := store.GetImageByUUID("fedora")
+	assert.NoError(t, err)
+
+	// The image said zstd, but the upload is gzip
+	version, err := store.CreateNextImageVersion(image.UUID)
+	assert.NoError(t, err)
+	assert.NoError(t, api.storeVersion(image, version))
+
+	// The version knows, the image and its other versions are left alone
+	image, err = store.GetImageByUUID("fedora")
+	assert.NoError(t, err)
+	assert.Equal(t, images.DiskCompressionStrategy(images.DiskCompressionStrategyZSTD), image.DiskCompressionStrategy)
+	assert.Len(t, image.Versions, 2)
+	assert.Equal(t, helloWorldDigest, image.Versions[1].Digest)
+	assert.Equal(t, images.DiskCompressionStrategy(images.DiskCompressionStrategyGZip), image.Versions[1].Compression)
+	assert.Empty(t, image.Versions[0].Compression)
+}
+
+func TestApi_DetectDiskType(t *testing.T) {
+	store := memory.NewStore()
+	files := storage.NewMemory()
+
+	store.CreateImage(&images.ImageModel{Name: "Fedora", UUID: "fedora", Username: "test",
+		DiskCompressionStrategy: images.DiskCompressionStrategyNone})
+
+	w, err := files.Write("fedora", storage.VersionFile(1))
+	assert.NoError(t, err)
+
+	err = diskimage.WriteQCow2(w, func() (diskimage.Image, error) {
+		return diskimage.NewRawReader(strings.NewReader("hello world")), nil
+	})
+	assert.NoError(t, err)
+	assert.NoError(t, w.Close())
+
+	api := NewAPI(store, files)
+	image, err := store.GetImageByUUID("fedora")
+	assert.NoError(t, err)
+
+	// The digest is the one of the disk in the qcow2 image
+	version, err := store.CreateNextImageVersion(image.UUID)
+	assert.NoError(t, err)
+	assert.NoError(t, api.storeVersion(image, version))
+
+	image, err = store.GetImageByUUID("fedora")
+	assert.NoError(t, err)
+	assert.Equal(t, images.DiskTypeRaw, image.ImageFileType)
+	assert.Equal(t, images.DiskTypeQCow2, image.Versions[1].Type)
+	assert.Equal(t, helloWorldDigest, image.Versions[1].Digest)
+	assert.Equal(t, int64(11), image.Versions[1].Size)
+}
@@ -0,0 +1,313 @@
+// Copyright (c) 2020-2022 TU Delft & Valentijn van de Beek <v.d.vandebeek@student.tudelft.nl> All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package api
+
+import (
+	"encoding/json"
+	"net/http"
+	"sync"
+	"time"
+
+	api_pkg "github.com/baas-project/baas/pkg/api"
+	machinemodel "github.com/baas-project/baas/pkg/model/machine"
+	"github.com/baas-project/baas/pkg/model/user"
+	"github.com/baas-project/baas/pkg/util"
+	"gorm.io/gorm"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// discoveryTimeout is how long the credential of a machine which boots in discovery mode stays valid
+const discoveryTimeout = time.Hour
+
+// discoveries holds the credentials handed to the machines which boot in discovery mode. Unknown machines have no
+// row to store it in until they registered, so they are kept in memory.
+type discoveries struct {
+	mutex  sync.Mutex
+	tokens map[string]pendingDiscovery
+}
+
+// pendingDiscovery is the hash of the credential of a machine and when it expires
+type pendingDiscovery struct {
+	hash    string
+	expires time.Time
+}
+
+func newDiscoveries() *discoveries {
+	return &discoveries{tokens: map[string]pendingDiscovery{}}
+}
+
+// issue generates the credential of a machine which boots in discovery mode, it replaces the previous one
+func (d *discoveries) issue(mac string) (string, error) {
+	token, err := util.GenerateToken()
+	if err != nil {
+		return "", err
+	}
+
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	now := time.Now()
+	for other, pending := range d.tokens {
+		if now.After(pending.expires) {
+			delete(d.tokens, other)
+		}
+	}
+
+	d.tokens[mac] = pendingDiscovery{hash: util.HashToken(token), expires: now.Add(discoveryTimeout)}
+	return token, nil
+}
+
+// check verifies the credential of a machine which boots in discovery mode
+func (d *discoveries) check(mac string, token string) bool {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	pending, ok := d.tokens[mac]
+	return ok && time.Now().Before(pending.expires) && util.CheckToken(token, pending.hash)
+}
+
+// finish revokes the credential of the machine once its inventory is in
+func (d *discoveries) finish(mac string) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	delete(d.tokens, mac)
+}
+
+// awaitingApproval checks whether the machine registered itself and has not been approved by an admin yet
+func (api_ *API) awaitingApproval(m *machinemodel.MachineModel) bool {
+	if m.Managed {
+		return false
+	}
+
+	inventory, err := api_.store.GetMachineInventory(m.MacAddress.Address)
+	return err == nil && !inventory.Approved
+}
+
+// discoveryBootConfig creates the boot configuration which starts the management OS in discovery mode
+func (api_ *API) discoveryBootConfig(mac string) (*bootConfigResponse, error) {
+	token, err := api_.discoveries.issue(mac)
+	if err != nil {
+		return nil, err
+	}
+
+	// The architecture is not known yet, the x86 management OS is the only one there is
+	resp := getBootConfig(machinemodel.X86_64)
+	resp.Message = "Booting into X86 management kernel to discover the machine."
+	resp.Cmdline += " " + api_pkg.DiscoveryCmdlineParameter + " " + api_pkg.TokenCmdlineParameter + "=" + token
+	return resp, nil
+}
+
+// RegisterDiscoveredMachine stores the hardware which the management OS found on a machine it booted in discovery
+// mode. An unknown machine is created unmanaged, it is not provisioned until an admin approves it. The machine
+// authenticates with the credential it got on its kernel command line.
+// Example request: POST /discover/52:54:00:d9:71:93
+// Example body: {"CPUModel": "AMD EPYC 7302P 16-Core Processor", "CPUCores": 16, "CPUThreads": 32,
+//                "Memory": 68719476736, "Disks": [{"Name": "nvme0n1", "Model": "Samsung SSD 970 EVO",
+//                "Size": 500107862016, "Rotational": false}], "NICs": [{"Name": "eno1",
+//                "MacAddress": "52:54:00:d9:71:93", "Driver": "igb", "Speed": 1000}], "Firmware": "uefi",
+//                "Architecture": "x86_64"}
+// Example response: Inventory received
+func (api_ *API) RegisterDiscoveredMachine(w http.ResponseWriter, r *http.Request) {
+	mac, err := GetTag("mac", w, r)
+	if err != nil {
+		return
+	}
+
+	if r.Header.Get(api_pkg.MachineHeader) != mac ||
+		!api_.discoveries.check(mac, r.Header.Get(api_pkg.MachineTokenHeader)) {
+		log.Warnf("Discovery request from machine %s without a valid token", mac)
+		http.Error(w, "Machine not permitted to access this resource.", http.StatusForbidden)
+		return
+	}
+
+	var inventory machinemodel.InventoryModel
+	if err = json.NewDecoder(r.Body).Decode(&inventory); err != nil {
+		http.Error(w, "Invalid inventory given", http.StatusBadRequest)
+		log.Errorf("Invalid inventory given: %v", err)
+		return
+	}
+
+	m, err := api_.store.GetMachineByMac(util.MacAddress{Address: mac})
+	if err == gorm.ErrRecordNotFound {
+		m = &machinemodel.MachineModel{
+			Name:         mac,
+			Architecture: inventory.Architecture,
+			Managed:      false,
+			MacAddress:   util.MacAddress{Address: mac},
+		}
+
+		if err = api_.store.CreateMachine(m); err != nil {
+			http.Error(w, "Cannot register the machine", http.StatusInternalServerError)
+			log.Errorf("create machine: %v", err)
+			return
+		}
+
+		log.Infof("Registered machine %s, it waits for approval", mac)
+	} else if err != nil {
+		http.Error(w, "Cannot find the machine", http.StatusInternalServerError)
+		log.Errorf("get machine by mac: %v", err)
+		return
+	} else if m.Managed {
+		http.Error(w, "Machine is already managed", http.StatusConflict)
+		return
+	}
+
+	inventory.MachineMAC = mac
+	inventory.Approved = false
+	inventory.Time = time.Now()
+	if err = api_.store.SetMachineInventory(&inventory); err != nil {
+		http.Error(w, "Cannot store the inventory", http.StatusInternalServerError)
+		log.Errorf("Store inventory: %v", err)
+		return
+	}
+
+	api_.discoveries.finish(mac)
+	http.Error(w, "Inventory received", http.StatusOK)
+}
+
+// GetMachineInventory returns the hardware of the machine, as found by the management OS in discovery mode
+// Example request: GET /machine/52:54:00:d9:71:93/inventory
+// Example response: {"CPUModel": "AMD EPYC 7302P 16-Core Processor", "CPUCores": 16, "CPUThreads": 32,
+//                    "Memory": 68719476736, "Disks": [...], "NICs": [...], "Firmware": "uefi",
+//                    "Architecture": "x86_64", "Approved": false, "Time": "2022-06-01T12:03:11Z"}
+func (api_ *API) GetMachineInventory(w http.ResponseWriter, r *http.Request) {
+	mac, err := GetTag("mac", w, r)
+	if err != nil {
+		return
+	}
+
+	inventory, err := api_.store.GetMachineInventory(mac)
+	if err == gorm.ErrRecordNotFound {
+		http.Error(w, "Inventory not found", http.StatusNotFound)
+		return
+	} else if err != nil {
+		http.Error(w, "Cannot get the inventory", http.StatusInternalServerError)
+		log.Errorf("get machine inventory: %v", err)
+		return
+	}
+
+	_ = json.NewEncoder(w).Encode(inventory)
+}
+
+// discoveredMachine is a machine which registered itself together with its hardware
+type discoveredMachine struct {
+	Machine   machinemodel.MachineModel
+	Inventory machinemodel.InventoryModel
+}
+
+// GetDiscoveredMachines returns the machines which registered themselves and wait for an admin to approve them
+// Example request: GET /machines/discovered
+// Example response: [{"Machine": {"Name": "52:54:00:d9:71:93", "Architecture": "x86_64", "Managed": false, ...},
+//                     "Inventory": {"CPUModel": "AMD EPYC 7302P 16-Core Processor", ...}}]
+func (api_ *API) GetDiscoveredMachines(w http.ResponseWriter, _ *http.Request) {
+	inventories, err := api_.store.GetMachineInventories()
+	if err != nil {
+		http.Error(w, "Cannot get the inventories", http.StatusInternalServerError)
+		log.Errorf("get machine inventories: %v", err)
+		return
+	}
+
+	discovered := []discoveredMachine{}
+	for _, inventory := range inventories {
+		if inventory.Approved {
+			continue
+		}
+
+		m, err := api_.store.GetMachineByMac(util.MacAddress{Address: inventory.MachineMAC})
+		if err != nil {
+			log.Warnf("Inventory of unknown machine %s: %v", inventory.MachineMAC, err)
+			continue
+		}
+
+		discovered = append(discovered, discoveredMachine{Machine: *m, Inventory: inventory})
+	}
+
+	_ = json.NewEncoder(w).Encode(discovered)
+}
+
+// ApproveMachine lets BAAS manage a machine which registered itself, it is provisioned from its next boot on
+// Example request: POST /machine/52:54:00:d9:71:93/approve
+// Example response: Machine approved
+func (api_ *API) ApproveMachine(w http.ResponseWriter, r *http.Request) {
+	mac, err := GetTag("mac", w, r)
+	if err != nil {
+		return
+	}
+
+	m, err := api_.store.GetMachineByMac(util.MacAddress{Address: mac})
+	if err == gorm.ErrRecordNotFound {
+		http.Error(w, "Machine not found", http.StatusNotFound)
+		return
+	} else if err != nil {
+		http.Error(w, "Cannot find the machine", http.StatusInternalServerError)
+		log.Errorf("get machine by mac: %v", err)
+		return
+	}
+
+	inventory, err := api_.store.GetMachineInventory(mac)
+	if err == gorm.ErrRecordNotFound {
+		http.Error(w, "Machine has not been discovered", http.StatusNotFound)
+		return
+	} else if err != nil {
+		http.Error(w, "Cannot get the inventory", http.StatusInternalServerError)
+		log.Errorf("get machine inventory: %v", err)
+		return
+	}
+
+	m.Managed = true
+	if m.Architecture == "" || m.Architecture == machinemodel.Unknown {
+		m.Architecture = inventory.Architecture
+	}
+
+	if err = api_.store.UpdateMachine(m); err != nil {
+		http.Error(w, "Cannot approve the machine", http.StatusInternalServerError)
+		log.Errorf("update machine: %v", err)
+		return
+	}
+
+	inventory.Approved = true
+	if err = api_.store.SetMachineInventory(inventory); err != nil {
+		http.Error(w, "Cannot approve the machine", http.StatusInternalServerError)
+		log.Errorf("Store inventory: %v", err)
+		return
+	}
+
+	log.Infof("Machine %s has been approved", mac)
+	http.Error(w, "Machine approved", http.StatusOK)
+}
+
+// RegisterDiscoveryHandlers sets the metadata for each of the routes and registers them to the global handler.
+// The route through which machines register themselves is not among them, as those machines have no credential
+// in the database yet.
+func (api_ *API) RegisterDiscoveryHandlers() {
+	api_.Routes = append(api_.Routes, Route{
+		URI:         "/machine/{mac}/inventory",
+		Permissions: []user.UserRole{user.User, user.Moderator, user.Admin},
+		UserAllowed: true,
+		Handler:     api_.GetMachineInventory,
+		Method:      http.MethodGet,
+		Description: "Gets the hardware of a machine",
+	})
+
+	api_.Routes = append(api_.Routes, Route{
+		URI:         "/machines/discovered",
+		Permissions: []user.UserRole{user.Admin},
+		UserAllowed: false,
+		Handler:     api_.GetDiscoveredMachines,
+		Method:      http.MethodGet,
+		Description: "Gets the machines which registered themselves and wait for approval",
+	})
+
+	api_.Routes = append(api_.Routes, Route{
+		URI:         "/machine/{mac}/approve",
+		Permissions: []user.UserRole{user.Admin},
+		UserAllowed: false,
+		Handler:     api_.ApproveMachine,
+		Method:      http.MethodPost,
+		Description: "Approves a machine which registered itself, so BAAS manages it",
+	})
+}
@@ -0,0 +1,146 @@
+// Copyright (c) 2020-2022 TU Delft & Valentijn van de Beek <v.d.vandebeek@student.tudelft.nl> All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package api
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	api_pkg "github.com/baas-project/baas/pkg/api"
+	machinemodel "github.com/baas-project/baas/pkg/model/machine"
+	"github.com/baas-project/baas/pkg/model/user"
+	"github.com/baas-project/baas/pkg/storage"
+	"github.com/baas-project/baas/pkg/util"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestApi_Discovery(t *testing.T) {
+	store, _ := setupMachineStore(t)
+	api := NewAPI(store, storage.NewMemory())
+	handler := api.handler("")
+
+	boot := func(mac string) (int, bootConfigResponse) {
+		resp := httptest.NewRecorder()
+		req := httptest.NewRequest(http.MethodGet, "/v1/boot/"+mac, nil)
+		req.RemoteAddr = "127.0.0.1:4242"
+		handler.ServeHTTP(resp, req)
+
+		var config bootConfigResponse
+		if resp.Code == http.StatusOK {
+			assert.NoError(t, json.NewDecoder(resp.Body).Decode(&config))
+		}
+
+		return resp.Code, config
+	}
+
+	// The token of the discovery mode is the last parameter on the command line
+	tokenOf := func(config bootConfigResponse) string {
+		fields := strings.Fields(config.Cmdline)
+		return strings.TrimPrefix(fields[len(fields)-1], api_pkg.TokenCmdlineParameter+"=")
+	}
+
+	register := func(mac string, token string, body string) int {
+		resp := httptest.NewRecorder()
+		req := httptest.NewRequest(http.MethodPost, "/discover/"+mac, strings.NewReader(body))
+		req.Header.Add(api_pkg.MachineHeader, mac)
+		req.Header.Add(api_pkg.MachineTokenHeader, token)
+		handler.ServeHTTP(resp, req)
+		return resp.Code
+	}
+
+	admin := func(method string, uri string) *httptest.ResponseRecorder {
+		resp := httptest.NewRecorder()
+		req := httptest.NewRequest(method, uri, nil)
+		loginAs(t, api, req, "admin", user.Admin)
+		handler.ServeHTTP(resp, req)
+		return resp
+	}
+
+	inventory := `{"CPUModel": "AMD EPYC 7302P 16-Core Processor", "CPUCores": 16, "CPUThreads": 32,
+		"Memory": 68719476736, "Disks": [{"Name": "nvme0n1", "Model": "Samsung SSD 970 EVO", "Size": 500107862016}],
+		"NICs": [{"Name": "eno1", "MacAddress": "new", "Driver": "igb", "Speed": 1000}], "Firmware": "uefi",
+		"Architecture": "x86_64", "Approved": true}`
+
+	// Unknown machines are refused unless discovery is enabled
+	code, _ := boot("new")
+	assert.Equal(t, http.StatusNotFound, code)
+
+	api.Discovery = true
+	code, config := boot("new")
+	assert.Equal(t, http.StatusOK, code)
+	assert.Contains(t, strings.Fields(config.Cmdline), api_pkg.DiscoveryCmdlineParameter)
+	token := tokenOf(config)
+
+	// Known machines boot as usual
+	code, config = boot("abc")
+	assert.Equal(t, http.StatusOK, code)
+	assert.NotContains(t, strings.Fields(config.Cmdline), api_pkg.DiscoveryCmdlineParameter)
+
+	// Only the machine which got the token may register with it
+	assert.Equal(t, http.StatusForbidden, register("new", "wrong", inventory))
+	assert.Equal(t, http.StatusForbidden, register("other", token, inventory))
+	assert.Equal(t, http.StatusBadRequest, register("new", token, `{"CPUModel": `))
+	assert.Equal(t, http.StatusOK, register("new", token, inventory))
+
+	// The token is used up once the inventory is in
+	assert.Equal(t, http.StatusForbidden, register("new", token, inventory))
+
+	m, err := store.GetMachineByMac(util.MacAddress{Address: "new"})
+	assert.NoError(t, err)
+	assert.False(t, m.Managed)
+	assert.Equal(t, machinemodel.X86_64, m.Architecture)
+
+	resp := admin(http.MethodGet, "/machine/new/inventory")
+	assert.Equal(t, http.StatusOK, resp.Code)
+
+	var stored machinemodel.InventoryModel
+	assert.NoError(t, json.NewDecoder(resp.Body).Decode(&stored))
+	assert.Equal(t, 16, stored.CPUCores)
+	assert.Equal(t, uint64(68719476736), stored.Memory)
+	assert.Len(t, stored.Disks, 1)
+	assert.Equal(t, "igb", stored.NICs[0].Driver)
+	assert.Equal(t, machinemodel.UEFI, stored.Firmware)
+	assert.False(t, stored.Approved)
+
+	resp = admin(http.MethodGet, "/machines/discovered")
+	assert.Equal(t, http.StatusOK, resp.Code)
+
+	var discovered []discoveredMachine
+	assert.NoError(t, json.NewDecoder(resp.Body).Decode(&discovered))
+	assert.Len(t, discovered, 1)
+	assert.Equal(t, "new", discovered[0].Machine.MacAddress.Address)
+	assert.Equal(t, 32, discovered[0].Inventory.CPUThreads)
+
+	// Until it is approved the machine is discovered again on every boot
+	code, config = boot("new")
+	assert.Equal(t, http.StatusOK, code)
+	assert.Contains(t, strings.Fields(config.Cmdline), api_pkg.DiscoveryCmdlineParameter)
+	assert.Equal(t, http.StatusOK, register("new", tokenOf(config), inventory))
+
+	assert.Equal(t, http.StatusNotFound, admin(http.MethodPost, "/machine/cba/approve").Code)
+	assert.Equal(t, http.StatusOK, admin(http.MethodPost, "/machine/new/approve").Code)
+
+	m, err = store.GetMachineByMac(util.MacAddress{Address: "new"})
+	assert.NoError(t, err)
+	assert.True(t, m.Managed)
+
+	resp = admin(http.MethodGet, "/machines/discovered")
+	assert.NoError(t, json.NewDecoder(resp.Body).Decode(&discovered))
+	assert.Empty(t, discovered)
+
+	code, config = boot("new")
+	assert.Equal(t, http.StatusOK, code)
+	assert.NotContains(t, strings.Fields(config.Cmdline), api_pkg.DiscoveryCmdlineParameter)
+
+	// Users may look at the hardware, but not approve machines
+	resp = httptest.NewRecorder()
+	req := httptest.NewRequest(http.MethodPost, "/machine/new/approve", nil)
+	loginAs(t, api, req, "alice", user.User)
+	handler.ServeHTTP(resp, req)
+	assert.Equal(t, http.StatusForbidden, resp.Code)
+}
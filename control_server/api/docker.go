@@ -5,16 +5,18 @@
 package api
 
 import (
-	"fmt"
 	"io"
+	"io/ioutil"
 	"mime/multipart"
 	"net/http"
 	"os"
 	"os/exec"
+	"path/filepath"
 	"strconv"
 
 	"github.com/baas-project/baas/pkg/model/images"
 	"github.com/baas-project/baas/pkg/model/user"
+	"github.com/baas-project/baas/pkg/storage"
 
 	"github.com/baas-project/baas/pkg/fs"
 	log "github.com/sirupsen/logrus"
@@ -59,16 +61,37 @@ func runDockerCommand(dir string) error {
 	return nil
 }
 
-func renameFiles(dir string, diskpath string, filepathfmt string, uniqueID string, version uint64) error {
-	if err := os.Rename(dir+"/"+"image.img",
-		fmt.Sprintf(diskpath+filepathfmt, uniqueID, version)); err != nil {
-		log.Errorf("Failed to move image file: %v", err)
+// storeFile copies a file from the build directory into the storage backend
+func storeFile(files storage.ImageFiles, src string, uuid images.ImageUUID, name string) error {
+	f, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+
+	defer f.Close()
+
+	dest, err := files.Write(uuid, name)
+	if err != nil {
+		return err
+	}
+
+	if err = fs.CopyStream(f, dest); err != nil {
+		_ = dest.Abort()
+		return err
+	}
+
+	return dest.Close()
+}
+
+func storeFiles(dir string, files storage.ImageFiles, uniqueID string, version uint64) error {
+	uuid := images.ImageUUID(uniqueID)
+	if err := storeFile(files, filepath.Join(dir, "image.img"), uuid, storage.VersionFile(version)); err != nil {
+		log.Errorf("Failed to store image file: %v", err)
 		return err
 	}
 
-	newPath := fmt.Sprintf(diskpath+"/%s/Dockerfile-%d", uniqueID, version)
-	if err := os.Rename(dir+"/"+"Dockerfile", newPath); err != nil {
-		log.Errorf("Failed to move dockerfile: %v", err)
+	if err := storeFile(files, filepath.Join(dir, "Dockerfile"), uuid, storage.DockerfileFile(version)); err != nil {
+		log.Errorf("Failed to store dockerfile: %v", err)
 		return err
 	}
 
@@ -103,10 +126,15 @@ func (api_ *API) RunDocker(w http.ResponseWriter, r *http.Request) {
 		}
 	}()
 
-	dir := api_.diskpath + "/" + uniqueID
+	// The image is built in a scratch directory and then handed to the storage backend
+	dir, err := ioutil.TempDir("", "baas-docker-")
+	if err != nil {
+		http.Error(w, "Cannot compile docker image", http.StatusInternalServerError)
+		log.Errorf("Cannot create build directory: %v", err)
+		return
+	}
 
-	// Delete the directory at the end of the program
-	// defer os.RemoveAll(dir)
+	defer os.RemoveAll(dir)
 
 	// Write the docker file to the directory
 	f, err := os.OpenFile(dir+"/Dockerfile", os.O_RDWR|os.O_CREATE, 0755)
@@ -132,11 +160,20 @@ func (api_ *API) RunDocker(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	if renameFiles(dir, api_.diskpath, images.FilePathFmt, uniqueID, version.Version) != nil {
+	if storeFiles(dir, api_.files, uniqueID, version.Version) != nil {
 		http.Error(w, "cannot compile docker image", http.StatusInternalServerError)
 		return
 	}
 
+	image, err := api_.store.GetImageByUUID(images.ImageUUID(uniqueID))
+	if err == nil {
+		err = api_.storeVersion(image, &version)
+	}
+
+	if err != nil {
+		log.Warnf("Cannot store the digest of the docker image: %v", err)
+	}
+
 	http.Error(w, "Successfully uploaded image: "+strconv.FormatUint(version.Version, 10), http.StatusOK)
 }
 
@@ -10,17 +10,48 @@ import (
 	"fmt"
 	"io"
 	"net/http"
-	"os"
 	"strconv"
+	"time"
 
+	api_pkg "github.com/baas-project/baas/pkg/api"
 	"github.com/baas-project/baas/pkg/model/images"
 	"github.com/baas-project/baas/pkg/model/user"
+	"github.com/baas-project/baas/pkg/storage"
 
+	"github.com/baas-project/baas/pkg/diskimage"
 	"github.com/baas-project/baas/pkg/fs"
 	"github.com/google/uuid"
+	"github.com/gorilla/mux"
 	log "github.com/sirupsen/logrus"
 )
 
+// imageFileSize is the size in bytes of the empty first version of a new image
+const imageFileSize = 512 * int64(images.SizeMegabyte)
+
+// createEmptyVersion stores the empty first version of a new image with the type of disk image the image has.
+// Raw images become a sparse file, the other types only hold their tables.
+func createEmptyVersion(files storage.ImageFiles, image *images.ImageModel) error {
+	if image.ImageFileType == images.DiskTypeRaw {
+		return files.Create(image.UUID, storage.VersionFile(0), imageFileSize)
+	}
+
+	w, err := files.Write(image.UUID, storage.VersionFile(0))
+	if err != nil {
+		return err
+	}
+
+	err = diskimage.Write(w, image.ImageFileType, func() (diskimage.Image, error) {
+		return diskimage.Zero(imageFileSize), nil
+	})
+
+	if err != nil {
+		_ = w.Abort()
+		return err
+	}
+
+	return w.Close()
+}
+
 func (api_ *API) checkUserImage(w http.ResponseWriter, r *http.Request) (*images.ImageModel, error) {
 	uniqueID, err := GetTag("uuid", w, r)
 	if err != nil {
@@ -36,14 +67,14 @@ func (api_ *API) checkUserImage(w http.ResponseWriter, r *http.Request) (*images
 		return nil, errors.New("failed to get image")
 	}
 
-	session, _ := api_.session.Get(r, "session-name")
-	username, ok := session.Values["Username"].(string)
-
-	// TODO: Hardcoded nonesense
-	if r.Header.Get("type") == "system" {
+	// CheckRole has already verified that the image belongs to the boot setup of the machine
+	if requestMachine(r) != nil {
 		return image, nil
 	}
 
+	session, _ := api_.session.Get(r, "session-name")
+	username, ok := session.Values["Username"].(string)
+
 	if !ok || username != image.Username {
 		http.Error(w, "user does not own this image", http.StatusForbidden)
 		log.Errorf("access denied: %v", ok)
@@ -53,6 +84,30 @@ func (api_ *API) checkUserImage(w http.ResponseWriter, r *http.Request) (*images
 	return image, nil
 }
 
+// checkUserVersion finds the version in the URI of an image the user or machine may access
+func (api_ *API) checkUserVersion(w http.ResponseWriter, r *http.Request) (*images.ImageModel, *images.Version,
+	error) {
+	image, err := api_.checkUserImage(w, r)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	number, err := strconv.ParseUint(mux.Vars(r)["version"], 10, 64)
+	if err != nil {
+		http.Error(w, "Invalid version given", http.StatusBadRequest)
+		return nil, nil, err
+	}
+
+	for i := range image.Versions {
+		if image.Versions[i].Version == number {
+			return image, &image.Versions[i], nil
+		}
+	}
+
+	http.Error(w, "Cannot find the version", http.StatusNotFound)
+	return nil, nil, errors.New("version not found")
+}
+
 // CreateImage creates an image based on a name
 // Example request: POST user/Jan/image
 // Example body: {"DiskUUID": "30DF-844C", "Name": "Fedora"}
@@ -98,9 +153,11 @@ func (api_ *API) CreateImage(w http.ResponseWriter, r *http.Request) {
 
 	api_.store.CreateImage(&image)
 
+	// The first version is an empty disk which a user may or may not use
+	err = createEmptyVersion(api_.files, &image)
 	if err != nil {
-		http.Error(w, "couldn't create image model", http.StatusInternalServerError)
-		log.Errorf("decode create model: %v", err)
+		http.Error(w, "couldn't create image file", http.StatusInternalServerError)
+		log.Errorf("create image file: %v", err)
 		return
 	}
 
@@ -158,17 +215,25 @@ func (api_ *API) DeleteImage(w http.ResponseWriter, r *http.Request) {
 	}
 
 	// Delete the images and versions from the database
-	if api_.store.DeleteImage(image) != nil {
+	if err = api_.store.DeleteImage(image); err != nil {
 		http.Error(w, "couldn't delete image", http.StatusInternalServerError)
 		log.Errorf("delete image: %v", err)
 		return
 	}
 
+	if err = api_.files.Delete(image.UUID); err != nil {
+		http.Error(w, "couldn't delete image files", http.StatusInternalServerError)
+		log.Errorf("delete image files: %v", err)
+		return
+	}
+
 	http.Error(w, "Successfully deleted image", http.StatusOK)
 }
 
-// DownloadImageFile gets the specified version of the image off the disk and offers it to the client
-func DownloadImageFile(image *images.ImageModel, version string, w http.ResponseWriter) {
+// DownloadImageFile gets the specified version of the image from the backend and offers it to the client.
+// The transcoder does not replace the file while it is being downloaded.
+func (api_ *API) DownloadImageFile(image *images.ImageModel, version string, w http.ResponseWriter,
+	r *http.Request) {
 	val, err := strconv.ParseUint(version, 10, 64)
 	if err != nil {
 		http.Error(w, "Cannot download the image", http.StatusNotFound)
@@ -176,32 +241,50 @@ func DownloadImageFile(image *images.ImageModel, version string, w http.Response
 		return
 	}
 
-	f, err := image.OpenImageFile(val)
+	done := api_.transcoder.Download(image.UUID, val)
+	defer done()
+
+	serveImageFile(api_.files, image.UUID, storage.VersionFile(val), w, r)
+}
+
+// serveImageFile sends the file together with its digest. Range requests are supported, so an interrupted
+// download can be resumed. The digest doubles as the ETag, which lets the client check with If-Range that
+// the file did not change in between.
+func serveImageFile(files storage.ImageFiles, uuid images.ImageUUID, name string, w http.ResponseWriter,
+	r *http.Request) {
+	sum, err := files.Digest(uuid, name)
+	if err != nil {
+		http.Error(w, "Cannot download the image", http.StatusNotFound)
+		log.Errorf("Download image: %v", err)
+		return
+	}
+
+	digest, err := api_pkg.FormatDigest(sum)
+	if err != nil {
+		http.Error(w, "Cannot download the image", http.StatusInternalServerError)
+		log.Errorf("Download image: %v", err)
+		return
+	}
+
+	f, err := files.Open(uuid, name)
 	if err != nil {
 		http.Error(w, "Cannot download the image", http.StatusNotFound)
 		log.Errorf("Download image: %v", err)
 		return
 	}
 
-	// Defer closing the file until the end of the program
 	defer func() {
-		err = f.Close()
-		if err != nil {
-			http.Error(w, "Cannot close image file", http.StatusInternalServerError)
+		if err := f.Close(); err != nil {
 			log.Errorf("Cannot close image file: %v", err)
 		}
 	}()
 
-	// We set the Content-Type to disk/raw as a placeholder, but it does not actually exist. It might be nice to change
-	// this at some later date some more common value.
-	w.Header().Set("Content-Type", "disk/raw")
-	_, err = io.Copy(w, f)
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Header().Set("ETag", strconv.Quote(sum))
+	w.Header().Set(api_pkg.DigestHeader, digest)
 
-	if err != nil {
-		http.Error(w, "Cannot serve image", http.StatusInternalServerError)
-		log.Errorf("Cannot serve image: %v", err)
-		return
-	}
+	// ServeContent handles the Range, If-Range and If-None-Match headers and sets the Content-Length
+	http.ServeContent(w, r, name, time.Time{}, f)
 }
 
 // DownloadImage offers the requested image to the respective client
@@ -221,7 +304,7 @@ func (api_ *API) DownloadImage(w http.ResponseWriter, r *http.Request) {
 
 	w.Header().Add("Content-Disposition", fmt.Sprintf("filename=%s-%s.img", image.UUID, version))
 
-	DownloadImageFile(image, version, w)
+	api_.DownloadImageFile(image, version, w, r)
 }
 
 // DownloadLatestImage offers the latest version
@@ -236,38 +319,34 @@ func (api_ *API) DownloadLatestImage(w http.ResponseWriter, r *http.Request) {
 	version := strconv.FormatUint(versionTxt.Version, 10)
 
 	w.Header().Add("Content-Disposition", fmt.Sprintf("filename=%s-%s.img", image.UUID, version))
-	DownloadImageFile(image, version, w)
+	api_.DownloadImageFile(image, version, w, r)
 }
 
-func createNewVersion(api *API, uniqueID string) (*images.Version, error) {
-	v, err := CreateNewVersion(uniqueID, api.store)
-	return &v, err
-}
-
-func updateVersion(api *API, uniqueID string) (*images.Version, error) {
-	image, err := api.store.GetImageByUUID(images.ImageUUID(uniqueID))
-	if err != nil {
-		return nil, err
+// manageVersion tells whether the upload is written to a new version or to the latest one
+func manageVersion(newVersion string) (isNew bool, _ error) {
+	switch newVersion {
+	case "true":
+		return true, nil
+	case "false":
+		return false, nil
+	default:
+		return false, errors.New("Invalid option for X-BAAS-NewVersion: " + newVersion)
 	}
-
-	// Update the latest version
-	return &image.Versions[len(image.Versions)-1], nil
 }
 
-func manageVersion(api *API, newVersion string, uniqueID string) (*images.Version, error) {
-	if newVersion != "true" && newVersion != "false" {
-		return nil, errors.New("Invalid option for X-BAAS-NewVersion: " + newVersion)
+// writeVersionFile writes the uploaded file as the file of the version
+func writeVersionFile(files storage.ImageFiles, r io.Reader, uuid images.ImageUUID, version uint64) error {
+	dest, err := files.Write(uuid, storage.VersionFile(version))
+	if err != nil {
+		return err
 	}
 
-	var version *images.Version
-	var err error
-	if newVersion == "true" {
-		version, err = createNewVersion(api, uniqueID)
-	} else {
-		version, err = updateVersion(api, uniqueID)
+	if err = fs.CopyStream(r, dest); err != nil {
+		_ = dest.Abort()
+		return err
 	}
 
-	return version, err
+	return dest.Close()
 }
 
 // UploadImage takes the uploaded file and stores as a new version of the image
@@ -290,10 +369,10 @@ func (api_ *API) UploadImage(w http.ResponseWriter, r *http.Request) {
 	// Get the parameters for this update
 	// TODO: Bad design. Write a new endpoint or use a header for this.
 
-	version, err := manageVersion(api_, r.Header.Get("X-BAAS-NewVersion"), string(image.UUID))
+	isNew, err := manageVersion(r.Header.Get("X-BAAS-NewVersion"))
 	if err != nil {
-		http.Error(w, "cannot fetch the image from the database", http.StatusNotFound)
-		log.Errorf("cannot fetch image from database: %v", err)
+		http.Error(w, "Invalid X-BAAS-NewVersion header", http.StatusBadRequest)
+		log.Errorf("Upload image: %v", err)
 		return
 	}
 
@@ -310,24 +389,35 @@ func (api_ *API) UploadImage(w http.ResponseWriter, r *http.Request) {
 		}
 	}()
 
-	// Write the file onto the disk
-	dest, err := os.OpenFile(fmt.Sprintf(api_.diskpath+images.FilePathFmt, image.UUID, version.Version),
-		os.O_WRONLY|os.O_CREATE, 0644)
-	if ErrorWrite(w, err, "Cannot open destination file") != nil {
-		return
+	// The number of a new version is taken before the file is written, so another new version cannot overwrite
+	// it. It is removed again when the upload fails, so a failed upload does not leave an empty version behind.
+	version := image.Versions[len(image.Versions)-1]
+	if isNew {
+		reserved, reserveErr := api_.store.CreateNextImageVersion(image.UUID)
+		if ErrorWrite(w, reserveErr, "Cannot create the version") != nil {
+			return
+		}
+
+		version = *reserved
 	}
 
-	err = fs.CopyStream(p, dest)
+	// Write the file to the backend, it only replaces the old version once it is closed
+	if err = writeVersionFile(api_.files, p, image.UUID, version.Version); err != nil {
+		if isNew {
+			api_.releaseVersion(&version)
+		}
 
-	if ErrorWrite(w, err, "Cannot copy over the contents of the file") != nil {
+		http.Error(w, "Cannot store the uploaded file", http.StatusInternalServerError)
+		log.Errorf("Upload image: %v", err)
+		return
+	}
+
+	if err = api_.storeVersion(image, &version); err != nil {
+		http.Error(w, "Cannot store the version of the image", http.StatusInternalServerError)
+		log.Errorf("Upload image: %v", err)
 		return
 	}
 
-	defer func() {
-		if err := dest.Close(); err != nil {
-			log.Errorf("Cannot close upload file: %v", err)
-		}
-	}()
 	http.Error(w, "Successfully uploaded image: "+strconv.FormatUint(version.Version, 10), http.StatusOK)
 }
 
@@ -379,20 +469,22 @@ func (api_ *API) RegisterImageHandlers() {
 	})
 
 	api_.Routes = append(api_.Routes, Route{
-		URI:         "/image/{uuid}/{version}",
-		Permissions: []user.UserRole{user.User, user.Moderator, user.Admin},
-		UserAllowed: true,
-		Handler:     api_.DownloadImage,
-		Method:      http.MethodGet,
-		Description: "Requests a particular version of the image",
+		URI:            "/image/{uuid}/{version}",
+		Permissions:    []user.UserRole{user.User, user.Moderator, user.Admin},
+		UserAllowed:    true,
+		Handler:        api_.DownloadImage,
+		Method:         http.MethodGet,
+		Description:    "Requests a particular version of the image",
+		MachineAllowed: true,
 	})
 
 	api_.Routes = append(api_.Routes, Route{
-		URI:         "/image/{uuid}",
-		Permissions: []user.UserRole{user.User, user.Moderator, user.Admin},
-		UserAllowed: true,
-		Handler:     api_.UploadImage,
-		Method:      http.MethodPost,
-		Description: "Uploads a new version of the image",
+		URI:            "/image/{uuid}",
+		Permissions:    []user.UserRole{user.User, user.Moderator, user.Admin},
+		UserAllowed:    true,
+		Handler:        api_.UploadImage,
+		Method:         http.MethodPost,
+		Description:    "Uploads a new version of the image",
+		MachineAllowed: true,
 	})
 }
@@ -70,6 +70,11 @@ func (api_ *API) createImageSetup(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	if !imageSetup.SignaturePolicy.Valid() {
+		http.Error(w, "Unknown signature policy", http.StatusBadRequest)
+		return
+	}
+
 	err = api_.store.CreateImageSetup(username, &imageSetup)
 	if err != nil {
 		http.Error(w, "Failed to create image setup", http.StatusBadRequest)
@@ -286,6 +291,11 @@ func (api_ *API) modifyImageSetup(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	if !newSetup.SignaturePolicy.Valid() {
+		http.Error(w, "Unknown signature policy", http.StatusBadRequest)
+		return
+	}
+
 	// Allows for easier objects to be sent over and ensures you
 	// cannot secretly modify a different setup.
 	newSetup.UUID = oldSetup.UUID
@@ -7,28 +7,31 @@ package api
 import (
 	"bytes"
 	"encoding/json"
+	"io"
+	"mime/multipart"
 	"net/http"
 	"net/http/httptest"
-	"os"
+	"strings"
 	"testing"
 
+	api_pkg "github.com/baas-project/baas/pkg/api"
 	"github.com/baas-project/baas/pkg/model/images"
 	"github.com/baas-project/baas/pkg/model/user"
 
-	"github.com/baas-project/baas/pkg/database/sqlite"
+	"github.com/baas-project/baas/pkg/database/memory"
+	"github.com/baas-project/baas/pkg/storage"
 	"github.com/stretchr/testify/assert"
 )
 
 func TestApi_CreateImage(t *testing.T) {
-	store, err := sqlite.NewSqliteStore(sqlite.InMemoryPath)
-	assert.NoError(t, err)
+	store := memory.NewStore()
 
 	userVar := user.UserModel{
 		Username: "test",
 		Role:     "userVar",
 	}
 
-	err = store.CreateUser(&userVar)
+	err := store.CreateUser(&userVar)
 	assert.NoError(t, err)
 
 	image := images.ImageModel{
@@ -41,9 +44,10 @@ func TestApi_CreateImage(t *testing.T) {
 	assert.NoError(t, err)
 
 	resp := httptest.NewRecorder()
-	handler := getHandler(store, "", "/tmp")
+	api := NewAPI(store, storage.NewMemory())
+	handler := api.handler("")
 	request := httptest.NewRequest(http.MethodPost, "/user/test/image", &mi)
-	request.Header.Add("type", "system")
+	loginAs(t, api, request, "test", user.User)
 	request.Header.Add("origin", "http://localhost:9090")
 
 	handler.ServeHTTP(resp, request)
@@ -61,20 +65,54 @@ func TestApi_CreateImage(t *testing.T) {
 
 	assert.Equal(t, decoded.UUID, res.UUID)
 	assert.Equal(t, image.Name, res.Name)
-	os.RemoveAll("/tmp/" + string(decoded.UUID))
 }
 
-func TestApi_GetImage(t *testing.T) {
-	store, err := sqlite.NewSqliteStore(sqlite.InMemoryPath)
+func TestApi_CreateImageQCow2(t *testing.T) {
+	store := memory.NewStore()
+	files := storage.NewMemory()
+
+	err := store.CreateUser(&user.UserModel{Username: "test", Role: user.User})
+	assert.NoError(t, err)
+
+	api := NewAPI(store, files)
+	handler := api.handler("")
+
+	resp := httptest.NewRecorder()
+	request := httptest.NewRequest(http.MethodPost, "/user/test/image",
+		strings.NewReader(`{"Name": "yeet", "Username": "test", "ImageFileType": "qcow2"}`))
+	loginAs(t, api, request, "test", user.User)
+
+	handler.ServeHTTP(resp, request)
+	assert.Equal(t, http.StatusCreated, resp.Code)
+
+	decoded := images.ImageModel{}
+	err = json.NewDecoder(resp.Body).Decode(&decoded)
 	assert.NoError(t, err)
 
+	// The empty first version only holds the tables of the qcow2 image
+	contents, err := inspectVersion(files, decoded.UUID, 0)
+	assert.NoError(t, err)
+	assert.Equal(t, images.DiskTypeQCow2, contents.Type)
+	assert.Equal(t, imageFileSize, contents.Size)
+
+	f, err := files.Open(decoded.UUID, storage.VersionFile(0))
+	assert.NoError(t, err)
+
+	size, err := f.Seek(0, io.SeekEnd)
+	assert.NoError(t, err)
+	assert.Less(t, size, int64(images.SizeMegabyte))
+}
+
+func TestApi_GetImage(t *testing.T) {
+	store := memory.NewStore()
+
 	userVar := user.UserModel{
 		Username: "test",
 		Name:     "Test System",
 		Role:     "User",
 	}
 
-	err = store.CreateUser(&userVar)
+	err := store.CreateUser(&userVar)
 	assert.NoError(t, err)
 
 	image := images.ImageModel{
@@ -86,9 +124,10 @@ func TestApi_GetImage(t *testing.T) {
 	store.CreateImage(&image)
 
 	resp := httptest.NewRecorder()
-	handler := getHandler(store, "", "/tmp")
+	api := NewAPI(store, storage.NewMemory())
+	handler := api.handler("")
 	request := httptest.NewRequest(http.MethodGet, "/image/def", nil)
-	request.Header.Add("type", "system")
+	loginAs(t, api, request, "test", user.User)
 	request.Header.Add("origin", "http://localhost:9090")
 
 	handler.ServeHTTP(resp, request)
@@ -101,3 +140,112 @@ func TestApi_GetImage(t *testing.T) {
 	assert.Equal(t, image.UUID, decoded.UUID)
 	assert.Equal(t, image.Name, decoded.Name)
 }
+
+func TestApi_UploadDownloadImage(t *testing.T) {
+	store := memory.NewStore()
+	files := storage.NewMemory()
+
+	err := store.CreateUser(&user.UserModel{Username: "test", Name: "Test", Role: user.User})
+	assert.NoError(t, err)
+
+	api := NewAPI(store, files)
+	handler := api.handler("")
+
+	var body bytes.Buffer
+	err = json.NewEncoder(&body).Encode(images.ImageModel{Name: "Fedora", Username: "test"})
+	assert.NoError(t, err)
+
+	resp := httptest.NewRecorder()
+	req := httptest.NewRequest(http.MethodPost, "/user/test/image", &body)
+	loginAs(t, api, req, "test", user.User)
+	handler.ServeHTTP(resp, req)
+	assert.Equal(t, http.StatusCreated, resp.Code)
+
+	var image images.ImageModel
+	err = json.NewDecoder(resp.Body).Decode(&image)
+	assert.NoError(t, err)
+
+	// The empty first version is created in the backend
+	_, err = files.Open(image.UUID, storage.VersionFile(0))
+	assert.NoError(t, err)
+
+	body.Reset()
+	mw := multipart.NewWriter(&body)
+	part, err := mw.CreateFormFile("file", "disk.img")
+	assert.NoError(t, err)
+	_, err = part.Write([]byte("disk contents"))
+	assert.NoError(t, err)
+	assert.NoError(t, mw.Close())
+
+	resp = httptest.NewRecorder()
+	req = httptest.NewRequest(http.MethodPost, "/image/"+string(image.UUID), &body)
+	req.Header.Set("Content-Type", mw.FormDataContentType())
+	req.Header.Set("X-BAAS-NewVersion", "true")
+	loginAs(t, api, req, "test", user.User)
+	handler.ServeHTTP(resp, req)
+	assert.Equal(t, http.StatusOK, resp.Code)
+
+	resp = httptest.NewRecorder()
+	req = httptest.NewRequest(http.MethodGet, "/image/"+string(image.UUID)+"/1", nil)
+	loginAs(t, api, req, "test", user.User)
+	handler.ServeHTTP(resp, req)
+	assert.Equal(t, http.StatusOK, resp.Code)
+	assert.Equal(t, "disk contents", resp.Body.String())
+
+	resp = httptest.NewRecorder()
+	req = httptest.NewRequest(http.MethodDelete, "/image/"+string(image.UUID), nil)
+	loginAs(t, api, req, "test", user.User)
+	handler.ServeHTTP(resp, req)
+	assert.Equal(t, http.StatusOK, resp.Code)
+
+	_, err = files.Open(image.UUID, storage.VersionFile(1))
+	assert.Equal(t, storage.ErrNotFound, err)
+}
+
+func TestApi_DownloadImageRange(t *testing.T) {
+	store := memory.NewStore()
+	files := storage.NewMemory()
+
+	err := store.CreateUser(&user.UserModel{Username: "test", Name: "Test", Role: user.User})
+	assert.NoError(t, err)
+
+	store.CreateImage(&images.ImageModel{Name: "Fedora", UUID: "fedora", Username: "test"})
+	w, err := files.Write("fedora", storage.VersionFile(0))
+	assert.NoError(t, err)
+	_, err = w.Write([]byte("hello world"))
+	assert.NoError(t, err)
+	assert.NoError(t, w.Close())
+
+	api := NewAPI(store, files)
+	handler := api.handler("")
+
+	resp := httptest.NewRecorder()
+	req := httptest.NewRequest(http.MethodGet, "/image/fedora/0", nil)
+	loginAs(t, api, req, "test", user.User)
+	handler.ServeHTTP(resp, req)
+	assert.Equal(t, http.StatusOK, resp.Code)
+	assert.Equal(t, "11", resp.Header().Get("Content-Length"))
+	assert.Equal(t, "sha-256=uU0nuZNNPgilLlLX2n2r+sSE7+N6U4DukIj3rOLvzek=", resp.Header().Get(api_pkg.DigestHeader))
+
+	etag := resp.Header().Get("ETag")
+	assert.NotEmpty(t, etag)
+
+	// The rest of the file is sent as long as it did not change
+	resp = httptest.NewRecorder()
+	req = httptest.NewRequest(http.MethodGet, "/image/fedora/0", nil)
+	req.Header.Set("Range", "bytes=6-")
+	req.Header.Set("If-Range", etag)
+	loginAs(t, api, req, "test", user.User)
+	handler.ServeHTTP(resp, req)
+	assert.Equal(t, http.StatusPartialContent, resp.Code)
+	assert.Equal(t, "world", resp.Body.String())
+
+	resp = httptest.NewRecorder()
+	req = httptest.NewRequest(http.MethodGet, "/image/fedora/0", nil)
+	req.Header.Set("Range", "bytes=6-")
+	req.Header.Set("If-Range", `"outdated"`)
+	loginAs(t, api, req, "test", user.User)
+	handler.ServeHTTP(resp, req)
+	assert.Equal(t, http.StatusOK, resp.Code)
+	assert.Equal(t, "hello world", resp.Body.String())
+}
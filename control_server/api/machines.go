@@ -8,11 +8,14 @@ import (
 	"encoding/json"
 	"fmt"
 	"net/http"
-	"os"
+	"strings"
 
+	"github.com/baas-project/baas/control_server/placement"
+	api_pkg "github.com/baas-project/baas/pkg/api"
 	"github.com/baas-project/baas/pkg/model/images"
 	machinemodel "github.com/baas-project/baas/pkg/model/machine"
 	"github.com/baas-project/baas/pkg/model/user"
+	"github.com/baas-project/baas/pkg/storage"
 
 	"github.com/baas-project/baas/pkg/util"
 	"gorm.io/gorm"
@@ -99,7 +102,7 @@ func (api_ *API) DeleteMachine(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	err = os.RemoveAll(fmt.Sprintf(api_.diskpath+"/%s", image.UUID))
+	err = api_.files.Delete(image.UUID)
 	if err != nil {
 		http.Error(w, "Failed to delete machine", http.StatusInternalServerError)
 		log.Errorf("Machine %s deletion failed with error code: %v", mac, err)
@@ -172,9 +175,16 @@ func (api_ *API) CreateMachine(w http.ResponseWriter, r *http.Request) {
 	// api_.store.CreateImage(&machineImage.ImageModel)
 	api_.store.CreateMachineImage(machineImage)
 
+	// The machine image starts as an empty filesystem
+	file := storage.VersionFile(0)
+	err = api_.files.Create(machineImage.UUID, file, int64(machineImage.Size*images.SizeMegabyte))
+	if err == nil {
+		err = api_.files.Format(machineImage.UUID, file, machineImage.Filesystem)
+	}
+
 	if err != nil {
-		http.Error(w, "couldn't create image model", http.StatusInternalServerError)
-		log.Errorf("decode create model: %v", err)
+		http.Error(w, "couldn't create machine image", http.StatusInternalServerError)
+		log.Errorf("create machine image: %v", err)
 		return
 	}
 
@@ -199,10 +209,7 @@ func (api_ *API) UploadDiskImage(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	path := fmt.Sprintf("%s/%s", api_.diskpath, id)
-	temppath := fmt.Sprintf("%s.%s.tmp", path, uuid.New().String())
-
-	f, err := os.OpenFile(temppath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0o666)
+	f, err := api_.files.Write(images.ImageUUID(id), storage.VersionFile(0))
 	if err != nil {
 		http.NotFound(w, r)
 		log.Errorf("failed to open/create disk image (%v)", err)
@@ -211,12 +218,13 @@ func (api_ *API) UploadDiskImage(w http.ResponseWriter, r *http.Request) {
 
 	err = fs.CopyStream(r.Body, f)
 	if err != nil {
+		_ = f.Abort()
 		http.Error(w, "failed to write file", http.StatusInternalServerError)
 		log.Errorf("failed to write file (%v)", err)
 		return
 	}
 
-	err = os.Rename(temppath, path)
+	err = f.Close()
 	if err != nil {
 		http.Error(w, "failed to move file", http.StatusInternalServerError)
 		log.Errorf("failed to move file (%v)", err)
@@ -243,24 +251,11 @@ func (api_ *API) DownloadDiskImage(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	f, err := image.OpenImageFile(0)
-	if err != nil {
-		http.NotFound(w, r)
-		log.Errorf("failed to read disk image (%v)", err)
-		return
-	}
-
-	r.Header.Set("Content-Type", "application/octet-stream")
-
-	err = fs.CopyStream(f, w)
-	if err != nil {
-		http.Error(w, "failed to write file", http.StatusInternalServerError)
-		log.Errorf("failed to write file (%v)", err)
-		return
-	}
+	serveImageFile(api_.files, image.UUID, storage.VersionFile(0), w, r)
 }
 
-// BootInform handles all incoming boot inform requests
+// BootInform handles all incoming boot inform requests. The boot setup stays queued until the response is built,
+// so a request which fails can be repeated and gets the same boot setup.
 func (api_ *API) BootInform(w http.ResponseWriter, r *http.Request) {
 	// First we fetch the id associated of the
 	vars := mux.Vars(r)
@@ -282,8 +277,13 @@ func (api_ *API) BootInform(w http.ResponseWriter, r *http.Request) {
 
 	log.Debug("Received BootInform request, serving Reprovisioning information")
 
+	// What the machine wrote to the disks it booted over NBD last time is gone once it boots again
+	if api_.NBD != nil {
+		api_.NBD.DropMachine(machine.MacAddress.Address)
+	}
+
 	// Get the next boot configuration based on a FIFO queue.
-	bootInfo, err := api_.store.GetNextBootSetup(machine.MacAddress.Address)
+	bootInfo, err := api_.store.PeekBootSetup(machine.MacAddress.Address)
 
 	if err == gorm.ErrRecordNotFound {
 		http.Error(w, "No boot setup found", http.StatusNotFound)
@@ -319,11 +319,52 @@ func (api_ *API) BootInform(w http.ResponseWriter, r *http.Request) {
 		resp.Images[i].Version = *version
 	}
 
+	// The setup is not handed out when its versions lack the signatures its policy asks for. It is taken off
+	// the queue, otherwise the machine would never get to the setups after it.
+	if err = api_.checkSignaturePolicy(&resp); err != nil {
+		http.Error(w, "The image setup is not signed as its signature policy requires", http.StatusForbidden)
+		log.Errorf("Refused to boot %s into image setup %s: %v", mac, resp.UUID, err)
+
+		if err = api_.store.DeleteBootSetup(bootInfo); err != nil {
+			log.Errorf("Failed to remove the refused boot setup from the queue: %v", err)
+		}
+
+		return
+	}
+
+	// The machine credential gives access to the images in this setup from now on
+	err = api_.store.SetMachineBootSetup(machine.MacAddress, bootInfo.SetupUUID)
+	if err != nil {
+		http.Error(w, "Failed to get the next boot setup", http.StatusInternalServerError)
+		log.Errorf("Failed to record the boot setup: %v", err)
+		return
+	}
+
+	// The machine image is always on the disk of the machine, only the images of the setup are served over NBD.
+	// The exports are dropped again when the setup is not handed out after all.
+	exported := false
+	if bootInfo.NBD && api_.NBD == nil {
+		log.Warnf("NBD boots are not enabled, %s flashes image setup %s instead", mac, resp.UUID)
+	} else if bootInfo.NBD {
+		if err = api_.exportSetup(machine.MacAddress.Address, &resp); err != nil {
+			http.Error(w, "Failed to export the image setup over NBD", http.StatusInternalServerError)
+			log.Errorf("Failed to export image setup %s to %s: %v", resp.UUID, mac, err)
+			return
+		}
+
+		exported = true
+	}
+
 	image, err := api_.store.GetMachineImageByMac(util.MacAddress{Address: mac})
 
 	if err != nil {
 		http.Error(w, "Failed to get the next boot setup", http.StatusBadRequest)
 		log.Errorf("Failed to get the machine image: %v", err)
+
+		if exported {
+			api_.NBD.DropMachine(machine.MacAddress.Address)
+		}
+
 		return
 	}
 
@@ -341,6 +382,18 @@ func (api_ *API) BootInform(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	// Only now that nothing can go wrong any more the boot setup is taken off the queue
+	if err = api_.store.DeleteBootSetup(bootInfo); err != nil {
+		http.Error(w, "Failed to get the next boot setup", http.StatusInternalServerError)
+		log.Errorf("Failed to remove the boot setup from the queue: %v", err)
+
+		if exported {
+			api_.NBD.DropMachine(machine.MacAddress.Address)
+		}
+
+		return
+	}
+
 	if err := json.NewEncoder(w).Encode(&resp); err != nil {
 		log.Errorf("Error while serialising json: %v", err)
 		http.Error(w, "Error while serialising response json", http.StatusInternalServerError)
@@ -350,14 +403,17 @@ func (api_ *API) BootInform(w http.ResponseWriter, r *http.Request) {
 	r.Header.Set("content-type", "application/json")
 }
 
-// SetBootSetup adds an image to the schedule to be flashed onto the machine
+// SetBootSetup adds an image to the schedule to be flashed onto the machine.
+// With PowerCycle set, the machine is restarted from the network through its power controller afterwards.
 // Example request: POST machine/52:54:00:d9:71:93/boot
-// Example body: {"Version": 1636116090, "ImageUUID": "74368cec-7903-4233-87b7-564195619dce", "update": true}
+// Example body: {"Version": 1636116090, "ImageUUID": "74368cec-7903-4233-87b7-564195619dce", "update": true,
+//                "PowerCycle": true}
 // Example response: {
 //   "MachineModelID": 1,
 //   "Version": 1636116090,
 //   "ImageUUID": "74368cec-7903-4233-87b7-564195619dce",
-//   "Update": true}
+//   "Update": true,
+//   "PowerCycle": true}
 func (api_ *API) SetBootSetup(w http.ResponseWriter, r *http.Request) {
 	// First we fetch the id associated of the
 	vars := mux.Vars(r)
@@ -387,6 +443,11 @@ func (api_ *API) SetBootSetup(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	if bootSetup.NBD && api_.NBD == nil {
+		http.Error(w, "NBD boots are not enabled on this control server", http.StatusNotImplemented)
+		return
+	}
+
 	bootSetup.MachineMAC = machine.MacAddress.Address
 	err = api_.store.AddBootSetupToMachine(&bootSetup)
 
@@ -396,10 +457,147 @@ func (api_ *API) SetBootSetup(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	if bootSetup.PowerCycle {
+		if err = api_.rebootFromNetwork(mac); err != nil {
+			http.Error(w, "The boot setup is queued, but the machine cannot be restarted: "+err.Error(),
+				http.StatusBadGateway)
+			log.Errorf("Power cycle %s: %v", mac, err)
+			return
+		}
+
+		log.Infof("Restarted machine %s from the network for its boot setup", mac)
+	}
+
 	e := json.NewEncoder(w)
 	_ = e.Encode(bootSetup)
 }
 
+// IssueMachineToken creates a new credential for a machine, invalidating the previous one. This is only needed
+// for machines which do not receive their credential through the PXE boot configuration.
+// Example request: POST /machine/52:54:00:d9:71:93/token
+// Example response: {"Token": "4d9c0b6c..."}
+func (api_ *API) IssueMachineToken(w http.ResponseWriter, r *http.Request) {
+	mac, err := GetTag("mac", w, r)
+	if err != nil {
+		return
+	}
+
+	machine, err := api_.store.GetMachineByMac(util.MacAddress{Address: mac})
+	if err != nil {
+		http.Error(w, "Cannot find the machine in the database", http.StatusNotFound)
+		log.Errorf("Machine not found: %v", err)
+		return
+	}
+
+	token, err := util.GenerateToken()
+	if err != nil {
+		http.Error(w, "Cannot generate a token", http.StatusInternalServerError)
+		log.Errorf("Generate machine token: %v", err)
+		return
+	}
+
+	if err = api_.store.SetMachineToken(machine.MacAddress, util.HashToken(token)); err != nil {
+		http.Error(w, "Cannot store the token", http.StatusInternalServerError)
+		log.Errorf("Store machine token: %v", err)
+		return
+	}
+
+	_ = json.NewEncoder(w).Encode(struct{ Token string }{token})
+}
+
+// SetMachineLabels replaces the labels of a machine, which reservations can ask for in their constraints
+// Example request: PUT /machine/52:54:00:d9:71:93/labels
+// Example body: {"numa": "2", "rack": "b4"}
+// Example response: {"numa": "2", "rack": "b4"}
+func (api_ *API) SetMachineLabels(w http.ResponseWriter, r *http.Request) {
+	mac, err := GetTag("mac", w, r)
+	if err != nil {
+		return
+	}
+
+	var labels machinemodel.Labels
+	if err = json.NewDecoder(r.Body).Decode(&labels); err != nil {
+		http.Error(w, "Invalid labels given", http.StatusBadRequest)
+		log.Errorf("Invalid labels given: %v", err)
+		return
+	}
+
+	for key := range labels {
+		if key == "" || strings.ContainsAny(key, "=<>!,") {
+			http.Error(w, fmt.Sprintf("Invalid label %q given", key), http.StatusBadRequest)
+			return
+		}
+	}
+
+	m, err := api_.store.GetMachineByMac(util.MacAddress{Address: mac})
+	if err != nil {
+		http.Error(w, "Cannot find the machine in the database", http.StatusNotFound)
+		log.Errorf("Machine not found: %v", err)
+		return
+	}
+
+	if err = api_.store.SetMachineLabels(m.MacAddress, labels); err != nil {
+		http.Error(w, "Cannot store the labels", http.StatusInternalServerError)
+		log.Errorf("Store machine labels: %v", err)
+		return
+	}
+
+	_ = json.NewEncoder(w).Encode(labels)
+}
+
+// FindMachines returns the managed machines which satisfy the constraints, whether they are reserved or not
+// Example request: GET /machines/match?constraints=arch=x86_64,mem>=64G,label:numa=2
+// Example response: [{"Name": "node-12", "Architecture": "x86_64", "Managed": true, ...}]
+func (api_ *API) FindMachines(w http.ResponseWriter, r *http.Request) {
+	constraints, err := placement.Parse(r.URL.Query().Get("constraints"))
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Invalid constraints given: %v", err), http.StatusBadRequest)
+		return
+	}
+
+	machines, err := placement.Candidates(api_.store, constraints)
+	if err != nil {
+		http.Error(w, "Cannot find the machines", http.StatusInternalServerError)
+		log.Errorf("Find machines for constraints %q: %v", constraints, err)
+		return
+	}
+
+	if machines == nil {
+		machines = []machinemodel.MachineModel{}
+	}
+
+	_ = json.NewEncoder(w).Encode(machines)
+}
+
+// ReportProvisioning receives the report of a machine which could not put an image on its disk, for
+// instance because the digest of what it has written does not match the digest of the version.
+// Example request: POST /machine/52:54:00:d9:71:93/report
+// Example body: {"Image": "87f58936-9540-4dad-aba6-253f06142166", "Version": 5,
+//                "Error": "digest mismatch: expected b94d27b9..., got 5eb63bbb..."}
+// Example response: Report received
+func (api_ *API) ReportProvisioning(w http.ResponseWriter, r *http.Request) {
+	mac, err := GetTag("mac", w, r)
+	if err != nil {
+		return
+	}
+
+	var report api_pkg.ProvisioningReport
+	if err = json.NewDecoder(r.Body).Decode(&report); err != nil {
+		http.Error(w, "Invalid report given", http.StatusBadRequest)
+		log.Errorf("Invalid report given: %v", err)
+		return
+	}
+
+	if report.Image == "" {
+		log.Errorf("Machine %s failed to provision its setup: %s", mac, report.Error)
+	} else {
+		log.Errorf("Machine %s failed to provision version %d of image %s: %s", mac, report.Version, report.Image,
+			report.Error)
+	}
+
+	http.Error(w, "Report received", http.StatusOK)
+}
+
 // RegisterMachineHandlers sets the metadata for each of the routes and registers them to the global handler
 func (api_ *API) RegisterMachineHandlers() {
 	api_.Routes = append(api_.Routes, Route{
@@ -448,30 +646,33 @@ func (api_ *API) RegisterMachineHandlers() {
 	})
 
 	api_.Routes = append(api_.Routes, Route{
-		URI:         "/machine/{mac}/disk/{uuid}",
-		Permissions: []user.UserRole{user.Moderator, user.Admin},
-		UserAllowed: true,
-		Handler:     api_.UploadDiskImage,
-		Method:      http.MethodPost,
-		Description: "Uploads the image",
+		URI:            "/machine/{mac}/disk/{uuid}",
+		Permissions:    []user.UserRole{user.Moderator, user.Admin},
+		UserAllowed:    true,
+		Handler:        api_.UploadDiskImage,
+		Method:         http.MethodPost,
+		Description:    "Uploads the image",
+		MachineAllowed: true,
 	})
 
 	api_.Routes = append(api_.Routes, Route{
-		URI:         "/machine/{mac}/image",
-		Permissions: []user.UserRole{user.Moderator, user.Admin},
-		UserAllowed: true,
-		Handler:     api_.DownloadDiskImage,
-		Method:      http.MethodGet,
-		Description: "Downloads the disk image",
+		URI:            "/machine/{mac}/image",
+		Permissions:    []user.UserRole{user.Moderator, user.Admin},
+		UserAllowed:    true,
+		Handler:        api_.DownloadDiskImage,
+		Method:         http.MethodGet,
+		Description:    "Downloads the disk image",
+		MachineAllowed: true,
 	})
 
 	api_.Routes = append(api_.Routes, Route{
-		URI:         "/machine/{mac}/boot",
-		Permissions: []user.UserRole{user.Moderator, user.Admin},
-		UserAllowed: false,
-		Handler:     api_.BootInform,
-		Method:      http.MethodGet,
-		Description: "Gets the next configuration a machine is going to boot into",
+		URI:            "/machine/{mac}/boot",
+		Permissions:    []user.UserRole{user.Moderator, user.Admin},
+		UserAllowed:    false,
+		Handler:        api_.BootInform,
+		Method:         http.MethodGet,
+		Description:    "Gets the next configuration a machine is going to boot into",
+		MachineAllowed: true,
 	})
 
 	api_.Routes = append(api_.Routes, Route{
@@ -482,4 +683,41 @@ func (api_ *API) RegisterMachineHandlers() {
 		Method:      http.MethodPost,
 		Description: "Adds a boot configuration to the queue",
 	})
+
+	api_.Routes = append(api_.Routes, Route{
+		URI:         "/machine/{mac}/token",
+		Permissions: []user.UserRole{user.Admin},
+		UserAllowed: false,
+		Handler:     api_.IssueMachineToken,
+		Method:      http.MethodPost,
+		Description: "Creates a new credential for the machine",
+	})
+
+	api_.Routes = append(api_.Routes, Route{
+		URI:         "/machine/{mac}/labels",
+		Permissions: []user.UserRole{user.Admin},
+		UserAllowed: false,
+		Handler:     api_.SetMachineLabels,
+		Method:      http.MethodPut,
+		Description: "Replaces the labels of the machine",
+	})
+
+	api_.Routes = append(api_.Routes, Route{
+		URI:         "/machines/match",
+		Permissions: []user.UserRole{user.User, user.Moderator, user.Admin},
+		UserAllowed: true,
+		Handler:     api_.FindMachines,
+		Method:      http.MethodGet,
+		Description: "Finds the machines which satisfy constraints",
+	})
+
+	api_.Routes = append(api_.Routes, Route{
+		URI:            "/machine/{mac}/report",
+		Permissions:    []user.UserRole{user.Admin},
+		UserAllowed:    false,
+		Handler:        api_.ReportProvisioning,
+		Method:         http.MethodPost,
+		Description:    "Reports that a machine could not provision an image",
+		MachineAllowed: true,
+	})
 }
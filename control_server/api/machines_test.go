@@ -13,15 +13,16 @@ import (
 	"testing"
 
 	machinemodel "github.com/baas-project/baas/pkg/model/machine"
+	"github.com/baas-project/baas/pkg/model/user"
 
-	"github.com/baas-project/baas/pkg/database/sqlite"
+	"github.com/baas-project/baas/pkg/database/memory"
+	"github.com/baas-project/baas/pkg/storage"
 	"github.com/baas-project/baas/pkg/util"
 	"github.com/stretchr/testify/assert"
 )
 
 func TestApi_UpdateMachine(t *testing.T) {
-	store, err := sqlite.NewSqliteStore(sqlite.InMemoryPath)
-	assert.NoError(t, err)
+	store := memory.NewStore()
 
 	machine := machinemodel.MachineModel{
 		MacAddress:   util.MacAddress{Address: "abc"},
@@ -31,13 +32,14 @@ func TestApi_UpdateMachine(t *testing.T) {
 	}
 
 	var mj bytes.Buffer
-	err = json.NewEncoder(&mj).Encode(machine)
+	err := json.NewEncoder(&mj).Encode(machine)
 	assert.NoError(t, err)
 
 	resp := httptest.NewRecorder()
-	handler := getHandler(store, "", "")
+	api := NewAPI(store, storage.NewMemory())
+	handler := api.handler("")
 	req := httptest.NewRequest(http.MethodPut, "/machine", &mj)
-	req.Header.Add("type", "system")
+	loginAs(t, api, req, "admin", user.Admin)
 	req.Header.Add("origin", "http://localhost:9090")
 	handler.ServeHTTP(resp, req)
 
@@ -53,8 +55,7 @@ func TestApi_UpdateMachine(t *testing.T) {
 }
 
 func TestApi_UpdateMachineExists(t *testing.T) {
-	store, err := sqlite.NewSqliteStore(sqlite.InMemoryPath)
-	assert.NoError(t, err)
+	store := memory.NewStore()
 
 	machine := machinemodel.MachineModel{
 		MacAddress:   util.MacAddress{Address: "abc"},
@@ -64,13 +65,14 @@ func TestApi_UpdateMachineExists(t *testing.T) {
 	}
 
 	var mj bytes.Buffer
-	err = json.NewEncoder(&mj).Encode(machine)
+	err := json.NewEncoder(&mj).Encode(machine)
 	assert.NoError(t, err)
 
 	resp := httptest.NewRecorder()
-	handler := getHandler(store, "", "")
+	api := NewAPI(store, storage.NewMemory())
+	handler := api.handler("")
 	req := httptest.NewRequest(http.MethodPut, "/machine", &mj)
-	req.Header.Add("type", "system")
+	loginAs(t, api, req, "admin", user.Admin)
 	req.Header.Add("origin", "http://localhost:9090")
 	handler.ServeHTTP(resp, req)
 
@@ -91,7 +93,7 @@ func TestApi_UpdateMachineExists(t *testing.T) {
 
 	resp = httptest.NewRecorder()
 	req = httptest.NewRequest(http.MethodPut, "/machine", &mj)
-	req.Header.Add("type", "system")
+	loginAs(t, api, req, "admin", user.Admin)
 	req.Header.Add("origin", "http://localhost:9090")
 	handler.ServeHTTP(resp, req)
 
@@ -106,8 +108,7 @@ func TestApi_UpdateMachineExists(t *testing.T) {
 }
 
 func TestApi_GetMachine(t *testing.T) {
-	store, err := sqlite.NewSqliteStore(sqlite.InMemoryPath)
-	assert.NoError(t, err)
+	store := memory.NewStore()
 
 	machine := machinemodel.MachineModel{
 		MacAddress:   util.MacAddress{Address: "abc"},
@@ -116,15 +117,16 @@ func TestApi_GetMachine(t *testing.T) {
 		Managed:      false,
 	}
 
-	err = store.UpdateMachine(&machine)
+	err := store.UpdateMachine(&machine)
 	assert.NoError(t, err)
 
+	api := NewAPI(store, storage.NewMemory())
+	handler := api.handler("")
+
 	resp := httptest.NewRecorder()
 	req := httptest.NewRequest(http.MethodGet, "/machine/"+machine.MacAddress.Address, nil)
-	req.Header.Add("type", "system")
+	loginAs(t, api, req, "admin", user.Admin)
 	req.Header.Add("origin", "http://localhost:9090")
-
-	handler := getHandler(store, "", "")
 	handler.ServeHTTP(resp, req)
 
 	assert.NoError(t, err)
@@ -142,8 +144,7 @@ func TestApi_GetMachine(t *testing.T) {
 }
 
 func TestApi_GetMachines(t *testing.T) {
-	store, err := sqlite.NewSqliteStore(sqlite.InMemoryPath)
-	assert.NoError(t, err)
+	store := memory.NewStore()
 
 	machine1 := machinemodel.MachineModel{
 		MacAddress:   util.MacAddress{Address: "abc"},
@@ -159,17 +160,18 @@ func TestApi_GetMachines(t *testing.T) {
 		Managed:      false,
 	}
 
-	err = store.UpdateMachine(&machine1)
+	err := store.UpdateMachine(&machine1)
 	assert.NoError(t, err)
 	err = store.UpdateMachine(&machine2)
 	assert.NoError(t, err)
 
+	api := NewAPI(store, storage.NewMemory())
+	handler := api.handler("")
+
 	resp := httptest.NewRecorder()
 	req := httptest.NewRequest(http.MethodGet, "/machines", nil)
-	req.Header.Add("type", "system")
+	loginAs(t, api, req, "admin", user.Admin)
 	req.Header.Add("origin", "http://localhost:9090")
-
-	handler := getHandler(store, "", "")
 	handler.ServeHTTP(resp, req)
 
 	assert.NoError(t, err)
@@ -199,3 +201,17 @@ func TestApi_GetMachines(t *testing.T) {
 	assert.Equal(t, dm2.Architecture, machine2.Architecture)
 	assert.Equal(t, dm2.MacAddress, machine2.MacAddress)
 }
+
+func TestApi_ReportProvisioning(t *testing.T) {
+	store, token := setupMachineStore(t)
+	handler := getHandler(store, storage.NewMemory(), "")
+
+	resp := httptest.NewRecorder()
+	handler.ServeHTTP(resp, machineRequest(http.MethodPost, "/machine/abc/report", "abc", token))
+	assert.Equal(t, http.StatusOK, resp.Code)
+
+	// A machine can only report about itself
+	resp = httptest.NewRecorder()
+	handler.ServeHTTP(resp, machineRequest(http.MethodPost, "/machine/cba/report", "abc", token))
+	assert.Equal(t, http.StatusForbidden, resp.Code)
+}
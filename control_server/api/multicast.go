@@ -0,0 +1,57 @@
+// Copyright (c) 2020-2022 TU Delft & Valentijn van de Beek <v.d.vandebeek@student.tudelft.nl> All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package api
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/baas-project/baas/pkg/model/user"
+	"github.com/baas-project/baas/pkg/storage"
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+)
+
+// JoinMulticast returns the multicast session sending a version of the image, a session is started when none is
+// running. The machines asking for the same version at around the same time share the session.
+// Example request: POST /image/87f58936-9540-4dad-aba6-253f06142166/3/multicast
+// Example response: {"Session": 2981, "Group": "239.255.66.1:50037", "Port": 43122, "Size": 402653184,
+//                    "Digest": "9f86d081884c7d659a2feaa0c55ad015a3bf4f1b2b0b822cd15d6c15b0f00a08"}
+func (api_ *API) JoinMulticast(w http.ResponseWriter, r *http.Request) {
+	if api_.Multicast == nil {
+		http.Error(w, "Multicast is not enabled on this control server", http.StatusNotImplemented)
+		return
+	}
+
+	image, version, err := api_.checkUserVersion(w, r)
+	if err != nil {
+		return
+	}
+
+	session, err := api_.Multicast.Join(image.UUID, version.Version)
+	if errors.Cause(err) == storage.ErrNotFound {
+		http.Error(w, "The version does not have a file", http.StatusNotFound)
+		return
+	} else if err != nil {
+		http.Error(w, "Cannot start the multicast session", http.StatusInternalServerError)
+		log.Errorf("Multicast version %d of image %s: %v", version.Version, image.UUID, err)
+		return
+	}
+
+	_ = json.NewEncoder(w).Encode(session)
+}
+
+// RegisterMulticastHandlers sets the metadata for each of the routes and registers them to the global handler
+func (api_ *API) RegisterMulticastHandlers() {
+	api_.Routes = append(api_.Routes, Route{
+		URI:            "/image/{uuid}/{version}/multicast",
+		Permissions:    []user.UserRole{user.User, user.Moderator, user.Admin},
+		UserAllowed:    true,
+		Handler:        api_.JoinMulticast,
+		Method:         http.MethodPost,
+		Description:    "Joins the multicast session sending a version of an image",
+		MachineAllowed: true,
+	})
+}
@@ -0,0 +1,75 @@
+// Copyright (c) 2020-2022 TU Delft & Valentijn van de Beek <v.d.vandebeek@student.tudelft.nl> All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package api
+
+import (
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/baas-project/baas/control_server/multicast"
+	api_pkg "github.com/baas-project/baas/pkg/api"
+	"github.com/baas-project/baas/pkg/database/memory"
+	"github.com/baas-project/baas/pkg/model/images"
+	"github.com/baas-project/baas/pkg/model/user"
+	"github.com/baas-project/baas/pkg/storage"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestApi_JoinMulticast(t *testing.T) {
+	store := memory.NewStore()
+	files := storage.NewMemory()
+
+	err := store.CreateUser(&user.UserModel{Username: "test", Role: user.User})
+	assert.NoError(t, err)
+	store.CreateImage(&images.ImageModel{Name: "Fedora", UUID: "fedora", Username: "test"})
+	store.CreateNewImageVersion(images.Version{Version: 1, ImageModelUUID: "fedora"})
+	store.CreateNewImageVersion(images.Version{Version: 2, ImageModelUUID: "fedora"})
+	assert.NoError(t, files.Create("fedora", storage.VersionFile(1), 1024))
+
+	api := NewAPI(store, files)
+	handler := api.handler("")
+
+	join := func(uri string, username string) *httptest.ResponseRecorder {
+		resp := httptest.NewRecorder()
+		req := httptest.NewRequest(http.MethodPost, uri, nil)
+		loginAs(t, api, req, username, user.User)
+		handler.ServeHTTP(resp, req)
+		return resp
+	}
+
+	// Multicast is off unless the control server has a group to send to
+	assert.Equal(t, http.StatusNotImplemented, join("/image/fedora/1/multicast", "test").Code)
+
+	group := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 45000}
+	api.Multicast = multicast.NewManager(files, multicast.Config{Group: group, Wait: time.Minute})
+
+	assert.Equal(t, http.StatusForbidden, join("/image/fedora/1/multicast", "other").Code)
+	assert.Equal(t, http.StatusBadRequest, join("/image/fedora/one/multicast", "test").Code)
+	assert.Equal(t, http.StatusNotFound, join("/image/fedora/3/multicast", "test").Code)
+	assert.Equal(t, http.StatusNotFound, join("/image/fedora/2/multicast", "test").Code)
+
+	resp := join("/image/fedora/1/multicast", "test")
+	assert.Equal(t, http.StatusOK, resp.Code)
+
+	var session api_pkg.MulticastSession
+	err = json.NewDecoder(resp.Body).Decode(&session)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(1024), session.Size)
+	assert.NotZero(t, session.Port)
+
+	digest, err := files.Digest("fedora", storage.VersionFile(1))
+	assert.NoError(t, err)
+	assert.Equal(t, digest, session.Digest)
+
+	// The second machine joins the same session
+	var second api_pkg.MulticastSession
+	err = json.NewDecoder(join("/image/fedora/1/multicast", "test").Body).Decode(&second)
+	assert.NoError(t, err)
+	assert.Equal(t, session, second)
+}
@@ -0,0 +1,213 @@
+// Copyright (c) 2020-2022 TU Delft & Valentijn van de Beek <v.d.vandebeek@student.tudelft.nl> All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package api
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+
+	"github.com/baas-project/baas/control_server/nbd"
+	"github.com/baas-project/baas/pkg/compression"
+	"github.com/baas-project/baas/pkg/model/images"
+	"github.com/baas-project/baas/pkg/model/user"
+	"github.com/baas-project/baas/pkg/storage"
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+)
+
+// exportSetup exports the images of the setup to the machine over NBD, the name of the export of every image is
+// set in the setup. The exports of the previous boot of the machine have been dropped already.
+func (api_ *API) exportSetup(mac string, setup *images.ImageSetup) error {
+	for i := range setup.Images {
+		frozen := &setup.Images[i]
+		image, version := frozen.UUIDImage, frozen.Version.Version
+		if image == "" {
+			image = frozen.Image.UUID
+		}
+
+		export, err := api_.NBD.Export(mac, image, version, func() (io.ReadCloser, error) {
+			disk, err := api_.openDisk(image, version)
+			if err != nil {
+				return nil, err
+			}
+
+			return disk, nil
+		})
+
+		if err != nil {
+			api_.NBD.DropMachine(mac)
+			return errors.Wrapf(err, "export version %d of image %s", version, image)
+		}
+
+		frozen.Export = export.Name
+	}
+
+	return nil
+}
+
+// GetNBDExports returns the disks the control server serves to the machine over NBD
+// Example request: GET /machine/52:54:00:d9:71:93/nbd
+// Example response: [{"Name": "4d9c0b6c...", "Image": "87f58936-9540-4dad-aba6-253f06142166", "Version": 3,
+//                     "Size": 1073741824, "Written": 20480}]
+func (api_ *API) GetNBDExports(w http.ResponseWriter, r *http.Request) {
+	if api_.NBD == nil {
+		http.Error(w, "NBD boots are not enabled on this control server", http.StatusNotImplemented)
+		return
+	}
+
+	mac, err := GetTag("mac", w, r)
+	if err != nil {
+		return
+	}
+
+	_ = json.NewEncoder(w).Encode(api_.NBD.Exports(mac))
+}
+
+// CommitNBDExport stores the disk of an export with the writes of the machine as a new version of its image,
+// compressed like the other versions of the image. The machine should disconnect from the export first.
+// Example request: POST /machine/52:54:00:d9:71:93/nbd/4d9c0b6c.../commit
+// Example response: {"Version": 4, "ImageModelUUID": "87f58936-9540-4dad-aba6-253f06142166",
+//                    "Digest": "9f86d0...", "Size": 1073741824}
+func (api_ *API) CommitNBDExport(w http.ResponseWriter, r *http.Request) {
+	if api_.NBD == nil {
+		http.Error(w, "NBD boots are not enabled on this control server", http.StatusNotImplemented)
+		return
+	}
+
+	mac, err := GetTag("mac", w, r)
+	if err != nil {
+		return
+	}
+
+	name, err := GetTag("export", w, r)
+	if err != nil {
+		return
+	}
+
+	disk, export, err := api_.NBD.Open(mac, name)
+	if err != nil {
+		http.Error(w, "The machine does not have this export", http.StatusNotFound)
+		return
+	}
+
+	image, err := api_.store.GetImageByUUID(export.Image)
+	if err != nil {
+		http.Error(w, "Cannot find the image of the export", http.StatusNotFound)
+		log.Errorf("Commit export of image %s: %v", export.Image, err)
+		return
+	}
+
+	strategy := image.DiskCompressionStrategy
+	if strategy == "" {
+		strategy = images.DiskCompressionStrategyNone
+	}
+
+	compressed, err := compression.Compress(disk, strategy)
+	if err != nil {
+		http.Error(w, "Cannot compress the disk", http.StatusInternalServerError)
+		log.Errorf("Commit export of image %s: %v", image.UUID, err)
+		return
+	}
+
+	defer compressed.Close()
+
+	// The number is taken before the file is written, so another new version cannot overwrite it
+	version, err := api_.store.CreateNextImageVersion(image.UUID)
+	if ErrorWrite(w, err, "Cannot create the version") != nil {
+		return
+	}
+
+	dest, err := api_.files.Write(image.UUID, storage.VersionFile(version.Version))
+	if ErrorWrite(w, err, "Cannot open destination file") != nil {
+		api_.releaseVersion(version)
+		return
+	}
+
+	if _, err = io.Copy(dest, compressed); err != nil {
+		_ = dest.Abort()
+		api_.releaseVersion(version)
+		http.Error(w, "Cannot store the disk", http.StatusInternalServerError)
+		log.Errorf("Commit export of image %s: %v", image.UUID, err)
+		return
+	}
+
+	if ErrorWrite(w, dest.Close(), "Cannot store the disk") != nil {
+		api_.releaseVersion(version)
+		return
+	}
+
+	if err = api_.storeVersion(image, version); err != nil {
+		http.Error(w, "Cannot store the version of the image", http.StatusInternalServerError)
+		log.Errorf("Commit export of image %s: %v", image.UUID, err)
+		return
+	}
+
+	log.Infof("Committed the NBD overlay of %s as version %d of image %s, %d bytes were written", mac,
+		version.Version, image.UUID, export.Written)
+
+	w.WriteHeader(http.StatusCreated)
+	_ = json.NewEncoder(w).Encode(version)
+}
+
+// DropNBDExport stops serving an export to the machine and throws away what the machine wrote to it
+// Example request: DELETE /machine/52:54:00:d9:71:93/nbd/4d9c0b6c...
+// Example response: Export dropped
+func (api_ *API) DropNBDExport(w http.ResponseWriter, r *http.Request) {
+	if api_.NBD == nil {
+		http.Error(w, "NBD boots are not enabled on this control server", http.StatusNotImplemented)
+		return
+	}
+
+	mac, err := GetTag("mac", w, r)
+	if err != nil {
+		return
+	}
+
+	name, err := GetTag("export", w, r)
+	if err != nil {
+		return
+	}
+
+	if err = api_.NBD.Drop(mac, name); err == nbd.ErrUnknownExport {
+		http.Error(w, "The machine does not have this export", http.StatusNotFound)
+		return
+	}
+
+	http.Error(w, "Export dropped", http.StatusOK)
+}
+
+// RegisterNBDHandlers sets the metadata for each of the routes and registers them to the global handler
+func (api_ *API) RegisterNBDHandlers() {
+	api_.Routes = append(api_.Routes, Route{
+		URI:            "/machine/{mac}/nbd",
+		Permissions:    []user.UserRole{user.Admin},
+		UserAllowed:    false,
+		Handler:        api_.GetNBDExports,
+		Method:         http.MethodGet,
+		Description:    "Gets the disks served to a machine over NBD",
+		MachineAllowed: true,
+	})
+
+	api_.Routes = append(api_.Routes, Route{
+		URI:            "/machine/{mac}/nbd/{export}/commit",
+		Permissions:    []user.UserRole{user.Admin},
+		UserAllowed:    false,
+		Handler:        api_.CommitNBDExport,
+		Method:         http.MethodPost,
+		Description:    "Stores the disk a machine booted over NBD as a new version of its image",
+		MachineAllowed: true,
+	})
+
+	api_.Routes = append(api_.Routes, Route{
+		URI:            "/machine/{mac}/nbd/{export}",
+		Permissions:    []user.UserRole{user.Admin},
+		UserAllowed:    false,
+		Handler:        api_.DropNBDExport,
+		Method:         http.MethodDelete,
+		Description:    "Throws away a disk served to a machine over NBD",
+		MachineAllowed: true,
+	})
+}
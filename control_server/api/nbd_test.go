@@ -0,0 +1,140 @@
+// Copyright (c) 2020-2022 TU Delft & Valentijn van de Beek <v.d.vandebeek@student.tudelft.nl> All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package api
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+
+	"github.com/baas-project/baas/control_server/nbd"
+	api_pkg "github.com/baas-project/baas/pkg/api"
+	"github.com/baas-project/baas/pkg/model/images"
+	"github.com/baas-project/baas/pkg/model/user"
+	"github.com/baas-project/baas/pkg/storage"
+	"github.com/baas-project/baas/pkg/util"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestApi_NBD(t *testing.T) {
+	store, token := setupMachineStore(t)
+	files := storage.NewMemory()
+
+	contents := make([]byte, 200*1024+3)
+	rand.New(rand.NewSource(1)).Read(contents)
+	hash := sha256.Sum256(contents)
+
+	err := store.CreateUser(&user.UserModel{Username: "test", Role: user.User})
+	assert.NoError(t, err)
+
+	machineImage, err := images.CreateMachineImageModel(util.MacAddress{Address: "abc"})
+	assert.NoError(t, err)
+	store.CreateMachineImage(machineImage)
+
+	store.CreateImage(&images.ImageModel{Name: "Fedora", UUID: "fedora", Username: "test"})
+	store.CreateNewImageVersion(images.Version{Version: 1, ImageModelUUID: "fedora"})
+
+	w, err := files.Write("fedora", storage.VersionFile(1))
+	assert.NoError(t, err)
+	_, err = io.Copy(w, bytes.NewReader(contents))
+	assert.NoError(t, err)
+	assert.NoError(t, w.Close())
+
+	image, err := store.GetImageByUUID("fedora")
+	assert.NoError(t, err)
+
+	err = store.CreateImageSetup("test", &images.ImageSetup{Name: "setup", Username: "test", UUID: "setup"})
+	assert.NoError(t, err)
+	setup, err := store.GetImageSetup("setup")
+	assert.NoError(t, err)
+	store.AddImageToImageSetup(&setup, image, image.Versions[1], true)
+
+	api := NewAPI(store, files)
+	handler := api.handler("")
+
+	request := func(method string, uri string, mac string) *httptest.ResponseRecorder {
+		resp := httptest.NewRecorder()
+		req := httptest.NewRequest(method, uri, nil)
+		req.Header.Add(api_pkg.MachineHeader, mac)
+		req.Header.Add(api_pkg.MachineTokenHeader, token)
+		handler.ServeHTTP(resp, req)
+		return resp
+	}
+
+	boot := func() images.ImageSetup {
+		err := store.AddBootSetupToMachine(&images.BootSetup{MachineMAC: "abc", SetupUUID: "setup", NBD: true})
+		assert.NoError(t, err)
+
+		resp := request(http.MethodGet, "/machine/abc/boot", "abc")
+		assert.Equal(t, http.StatusOK, resp.Code)
+
+		var booted images.ImageSetup
+		assert.NoError(t, json.NewDecoder(resp.Body).Decode(&booted))
+		return booted
+	}
+
+	// Without NBD the machine flashes the setup like it always did
+	assert.Equal(t, http.StatusNotImplemented, request(http.MethodGet, "/machine/abc/nbd", "abc").Code)
+	booted := boot()
+	assert.Len(t, booted.Images, 2)
+	assert.Empty(t, booted.Images[0].Export)
+
+	dir, err := ioutil.TempDir("", "nbd")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	api.NBD, err = nbd.NewManager(dir)
+	assert.NoError(t, err)
+
+	booted = boot()
+	assert.NotEmpty(t, booted.Images[0].Export)
+
+	// The machine image stays on the disk of the machine
+	assert.Empty(t, booted.Images[1].Export)
+
+	resp := request(http.MethodGet, "/machine/abc/nbd", "abc")
+	assert.Equal(t, http.StatusOK, resp.Code)
+
+	var exports []api_pkg.NBDExport
+	assert.NoError(t, json.NewDecoder(resp.Body).Decode(&exports))
+	assert.Len(t, exports, 1)
+	assert.Equal(t, booted.Images[0].Export, exports[0].Name)
+	assert.Equal(t, int64(len(contents)), exports[0].Size)
+
+	// Booting again throws away the exports of the previous boot
+	booted = boot()
+	exports = api.NBD.Exports("abc")
+	assert.Len(t, exports, 1)
+	assert.Equal(t, booted.Images[0].Export, exports[0].Name)
+
+	// The exports of a machine are its own
+	export := "/machine/abc/nbd/" + exports[0].Name
+	assert.Equal(t, http.StatusForbidden, request(http.MethodPost, export+"/commit", "cba").Code)
+	assert.Equal(t, http.StatusNotFound, request(http.MethodPost, "/machine/abc/nbd/unknown/commit", "abc").Code)
+
+	resp = request(http.MethodPost, export+"/commit", "abc")
+	assert.Equal(t, http.StatusCreated, resp.Code)
+
+	var version images.Version
+	assert.NoError(t, json.NewDecoder(resp.Body).Decode(&version))
+	assert.Equal(t, uint64(2), version.Version)
+	assert.Equal(t, hex.EncodeToString(hash[:]), version.Digest)
+
+	image, err = store.GetImageByUUID("fedora")
+	assert.NoError(t, err)
+	assert.Len(t, image.Versions, 3)
+
+	assert.Equal(t, http.StatusOK, request(http.MethodDelete, export, "abc").Code)
+	assert.Equal(t, http.StatusNotFound, request(http.MethodDelete, export, "abc").Code)
+	assert.Empty(t, api.NBD.Exports("abc"))
+}
@@ -0,0 +1,235 @@
+// Copyright (c) 2020-2022 TU Delft & Valentijn van de Beek <v.d.vandebeek@student.tudelft.nl> All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package api
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+
+	api_pkg "github.com/baas-project/baas/pkg/api"
+	"github.com/baas-project/baas/pkg/model/user"
+	"github.com/baas-project/baas/pkg/storage"
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+)
+
+// AnnouncePeer records which versions the management OS of the machine serves to other machines, until it leaves
+// or stops announcing itself. The host of the address has to be that of the machine, it may be left out. The
+// response holds the tokens of the versions, the peers which ask for their blocks present them.
+// Example request: POST /machine/00:11:22:33:44:55/peer
+// Example body: {"Address": ":4849", "Versions": [{"Image": "87f58936-9540-4dad-aba6-253f06142166", "Version": 3}]}
+// Example response: [{"Image": "87f58936-9540-4dad-aba6-253f06142166", "Version": 3, "Token": "5d41402a..."}]
+func (api_ *API) AnnouncePeer(w http.ResponseWriter, r *http.Request) {
+	mac, err := GetTag("mac", w, r)
+	if err != nil {
+		return
+	}
+
+	var announcement api_pkg.PeerAnnouncement
+	if err = json.NewDecoder(r.Body).Decode(&announcement); err != nil {
+		http.Error(w, "Invalid announcement given", http.StatusBadRequest)
+		log.Errorf("Invalid announcement given: %v", err)
+		return
+	}
+
+	host, port, err := net.SplitHostPort(announcement.Address)
+	if err != nil {
+		http.Error(w, "Invalid address given", http.StatusBadRequest)
+		return
+	}
+
+	// A machine could otherwise send the machines which are provisioned to any host it likes
+	remote, _, _ := net.SplitHostPort(r.RemoteAddr)
+	if host != "" && host != remote {
+		http.Error(w, "The host of the address is not that of the machine", http.StatusBadRequest)
+		return
+	}
+
+	tokens := make([]api_pkg.PeerToken, 0, len(announcement.Versions))
+	for _, version := range announcement.Versions {
+		token, tokenErr := api_.tracker.Token(version)
+		if tokenErr != nil {
+			http.Error(w, "Cannot create the token of a version", http.StatusInternalServerError)
+			log.Errorf("Create the peer token of version %d of image %s: %v", version.Version, version.Image, tokenErr)
+			return
+		}
+
+		tokens = append(tokens, api_pkg.PeerToken{PeerVersion: version, Token: token})
+	}
+
+	api_.tracker.Announce(mac, net.JoinHostPort(remote, port), announcement.Versions)
+	_ = json.NewEncoder(w).Encode(tokens)
+}
+
+// LeavePeer tells the tracker that the management OS of the machine no longer serves anything
+// Example request: DELETE /machine/00:11:22:33:44:55/peer
+func (api_ *API) LeavePeer(w http.ResponseWriter, r *http.Request) {
+	mac, err := GetTag("mac", w, r)
+	if err != nil {
+		return
+	}
+
+	api_.tracker.Leave(mac)
+	http.Error(w, "Left", http.StatusOK)
+}
+
+// GetPeerSources returns the peers which serve a version of the image and the hashes of the blocks of its disk,
+// which the blocks received from the peers are checked against. The hashes are computed on the first request.
+// The token is what the peers want to see before they send a block.
+// Example request: GET /image/87f58936-9540-4dad-aba6-253f06142166/3/peers
+// Example response: {"Blocks": {"Version": 3, "Digest": "9f86d0...", "BlockSize": 262144, "Size": 1073741824,
+//                               "Blocks": ["n4bQgYhMfWWaL+qgxVrQFaO/TxsrC4Is0V1sFbDwCgg=", ...]},
+//                    "Peers": ["10.0.0.12:4849", "10.0.0.17:4849"], "Token": "5d41402a..."}
+func (api_ *API) GetPeerSources(w http.ResponseWriter, r *http.Request) {
+	image, version, err := api_.checkUserVersion(w, r)
+	if err != nil {
+		return
+	}
+
+	if version.Digest == "" {
+		http.Error(w, "The version has no digest to check its blocks against", http.StatusNotFound)
+		return
+	}
+
+	hashes, err := api_.tracker.Blocks(image.UUID, *version, func() (io.ReadCloser, error) {
+		return api_.openDisk(image.UUID, version.Version)
+	})
+
+	if errors.Cause(err) == storage.ErrNotFound {
+		http.Error(w, "The version does not have a file", http.StatusNotFound)
+		return
+	} else if err != nil {
+		http.Error(w, "Cannot hash the blocks of the version", http.StatusInternalServerError)
+		log.Errorf("Hash the blocks of version %d of image %s: %v", version.Version, image.UUID, err)
+		return
+	}
+
+	var except string
+	if machine := requestMachine(r); machine != nil {
+		except = machine.MacAddress.Address
+	}
+
+	token, err := api_.tracker.Token(api_pkg.PeerVersion{Image: image.UUID, Version: version.Version})
+	if err != nil {
+		http.Error(w, "Cannot create the token of the version", http.StatusInternalServerError)
+		log.Errorf("Create the peer token of version %d of image %s: %v", version.Version, image.UUID, err)
+		return
+	}
+
+	sources := api_pkg.PeerSources{
+		Blocks: hashes,
+		Peers:  api_.tracker.Peers(image.UUID, version.Version, except),
+		Token:  token,
+	}
+	_ = json.NewEncoder(w).Encode(sources)
+}
+
+// parseRangeStart returns the offset of a range of the form bytes=<offset>-, other ranges are not supported
+func parseRangeStart(header string) (int64, bool) {
+	if !strings.HasPrefix(header, "bytes=") || !strings.HasSuffix(header, "-") {
+		return 0, false
+	}
+
+	offset, err := strconv.ParseInt(strings.TrimSuffix(strings.TrimPrefix(header, "bytes="), "-"), 10, 64)
+	return offset, err == nil && offset >= 0
+}
+
+// DownloadRawDisk sends the disk of a version expanded, without compression and as a raw disk image. A range
+// of the form bytes=<offset>- starts at the offset, this is how blocks the peers did not have are fetched.
+// Example request: GET /image/87f58936-9540-4dad-aba6-253f06142166/3/raw
+func (api_ *API) DownloadRawDisk(w http.ResponseWriter, r *http.Request) {
+	image, version, err := api_.checkUserVersion(w, r)
+	if err != nil {
+		return
+	}
+
+	disk, err := api_.openDisk(image.UUID, version.Version)
+	if errors.Cause(err) == storage.ErrNotFound {
+		http.Error(w, "The version does not have a file", http.StatusNotFound)
+		return
+	} else if err != nil {
+		http.Error(w, "Cannot open the version", http.StatusInternalServerError)
+		log.Errorf("Open version %d of image %s: %v", version.Version, image.UUID, err)
+		return
+	}
+
+	defer disk.Close()
+
+	status := http.StatusOK
+	offset, ranged := parseRangeStart(r.Header.Get("Range"))
+	if ranged {
+		// The disk has to be expanded up to the offset, there is no way to seek in a compressed file
+		skipped, skipErr := io.CopyN(ioutil.Discard, disk, offset)
+		if skipErr != nil || (version.Size > 0 && offset >= version.Size) {
+			w.Header().Set("Content-Range", fmt.Sprintf("bytes */%d", skipped))
+			http.Error(w, "The range starts after the end of the disk", http.StatusRequestedRangeNotSatisfiable)
+			return
+		}
+
+		status = http.StatusPartialContent
+	}
+
+	w.Header().Set("Content-Type", "application/octet-stream")
+	if version.Size > 0 {
+		w.Header().Set("Content-Length", strconv.FormatInt(version.Size-offset, 10))
+		if ranged {
+			w.Header().Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", offset, version.Size-1, version.Size))
+		}
+	}
+
+	w.WriteHeader(status)
+	if _, err = io.Copy(w, disk); err != nil {
+		log.Warnf("Send version %d of image %s: %v", version.Version, image.UUID, err)
+	}
+}
+
+// RegisterPeerHandlers sets the metadata for each of the routes and registers them to the global handler
+func (api_ *API) RegisterPeerHandlers() {
+	api_.Routes = append(api_.Routes, Route{
+		URI:            "/machine/{mac}/peer",
+		Permissions:    []user.UserRole{user.Admin},
+		UserAllowed:    false,
+		Handler:        api_.AnnouncePeer,
+		Method:         http.MethodPost,
+		Description:    "Announces the versions a machine serves to other machines",
+		MachineAllowed: true,
+	})
+
+	api_.Routes = append(api_.Routes, Route{
+		URI:            "/machine/{mac}/peer",
+		Permissions:    []user.UserRole{user.Admin},
+		UserAllowed:    false,
+		Handler:        api_.LeavePeer,
+		Method:         http.MethodDelete,
+		Description:    "Stops serving the versions of a machine to other machines",
+		MachineAllowed: true,
+	})
+
+	api_.Routes = append(api_.Routes, Route{
+		URI:            "/image/{uuid}/{version}/peers",
+		Permissions:    []user.UserRole{user.User, user.Moderator, user.Admin},
+		UserAllowed:    true,
+		Handler:        api_.GetPeerSources,
+		Method:         http.MethodGet,
+		Description:    "Gets the peers serving a version of an image and the hashes of its blocks",
+		MachineAllowed: true,
+	})
+
+	api_.Routes = append(api_.Routes, Route{
+		URI:            "/image/{uuid}/{version}/raw",
+		Permissions:    []user.UserRole{user.User, user.Moderator, user.Admin},
+		UserAllowed:    true,
+		Handler:        api_.DownloadRawDisk,
+		Method:         http.MethodGet,
+		Description:    "Downloads the expanded disk of a version of an image",
+		MachineAllowed: true,
+	})
+}
@@ -0,0 +1,133 @@
+// Copyright (c) 2020-2022 TU Delft & Valentijn van de Beek <v.d.vandebeek@student.tudelft.nl> All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package api
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	api_pkg "github.com/baas-project/baas/pkg/api"
+	"github.com/baas-project/baas/pkg/blockmap"
+	"github.com/baas-project/baas/pkg/model/images"
+	"github.com/baas-project/baas/pkg/model/user"
+	"github.com/baas-project/baas/pkg/storage"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestApi_Peers(t *testing.T) {
+	store, token := setupMachineStore(t)
+	files := storage.NewMemory()
+
+	contents := make([]byte, 3*blockmap.DefaultBlockSize+100)
+	rand.New(rand.NewSource(1)).Read(contents)
+	hash := sha256.Sum256(contents)
+
+	err := store.CreateUser(&user.UserModel{Username: "test", Role: user.User})
+	assert.NoError(t, err)
+	store.CreateImage(&images.ImageModel{Name: "Fedora", UUID: "fedora", Username: "test"})
+	store.CreateNewImageVersion(images.Version{Version: 1, ImageModelUUID: "fedora",
+		Digest: hex.EncodeToString(hash[:]), Size: int64(len(contents))})
+	store.CreateNewImageVersion(images.Version{Version: 2, ImageModelUUID: "fedora"})
+
+	w, err := files.Write("fedora", storage.VersionFile(1))
+	assert.NoError(t, err)
+	_, err = io.Copy(w, bytes.NewReader(contents))
+	assert.NoError(t, err)
+	assert.NoError(t, w.Close())
+
+	api := NewAPI(store, files)
+	handler := api.handler("")
+
+	announce := func(method string, mac string, body string) *httptest.ResponseRecorder {
+		resp := httptest.NewRecorder()
+		req := httptest.NewRequest(method, "/machine/"+mac+"/peer", strings.NewReader(body))
+		req.Header.Add(api_pkg.MachineHeader, "abc")
+		req.Header.Add(api_pkg.MachineTokenHeader, token)
+		handler.ServeHTTP(resp, req)
+		return resp
+	}
+
+	peer := func(method string, mac string, body string) int {
+		return announce(method, mac, body).Code
+	}
+
+	get := func(uri string, rangeHeader string) *httptest.ResponseRecorder {
+		resp := httptest.NewRecorder()
+		req := httptest.NewRequest(http.MethodGet, uri, nil)
+		if rangeHeader != "" {
+			req.Header.Set("Range", rangeHeader)
+		}
+
+		loginAs(t, api, req, "test", user.User)
+		handler.ServeHTTP(resp, req)
+		return resp
+	}
+
+	announcement := `{"Address": ":4849", "Versions": [{"Image": "fedora", "Version": 1}]}`
+	resp := announce(http.MethodPost, "abc", announcement)
+	assert.Equal(t, http.StatusOK, resp.Code)
+
+	var tokens []api_pkg.PeerToken
+	err = json.NewDecoder(resp.Body).Decode(&tokens)
+	assert.NoError(t, err)
+	assert.Len(t, tokens, 1)
+	assert.Equal(t, api_pkg.PeerVersion{Image: "fedora", Version: 1}, tokens[0].PeerVersion)
+	assert.NotEmpty(t, tokens[0].Token)
+
+	assert.Equal(t, http.StatusBadRequest, peer(http.MethodPost, "abc", `{"Address": "nowhere"}`))
+
+	// The machines which are provisioned cannot be sent to another host
+	assert.Equal(t, http.StatusBadRequest, peer(http.MethodPost, "abc", `{"Address": "203.0.113.7:4849"}`))
+	assert.Equal(t, http.StatusOK, peer(http.MethodPost, "abc", `{"Address": "192.0.2.1:4849"}`))
+	assert.Equal(t, http.StatusOK, peer(http.MethodPost, "abc", announcement))
+	assert.Equal(t, http.StatusBadRequest, peer(http.MethodPost, "abc", `{`))
+
+	// A machine can only announce itself
+	assert.Equal(t, http.StatusForbidden, peer(http.MethodPost, "cba", announcement))
+
+	resp = get("/image/fedora/1/peers", "")
+	assert.Equal(t, http.StatusOK, resp.Code)
+
+	var sources api_pkg.PeerSources
+	err = json.NewDecoder(resp.Body).Decode(&sources)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"192.0.2.1:4849"}, sources.Peers)
+	assert.Equal(t, tokens[0].Token, sources.Token)
+	assert.Equal(t, hex.EncodeToString(hash[:]), sources.Blocks.Digest)
+	assert.Len(t, sources.Blocks.Blocks, 4)
+	assert.True(t, sources.Blocks.Check(3, contents[3*blockmap.DefaultBlockSize:]))
+
+	// Without a digest the blocks cannot be checked
+	assert.Equal(t, http.StatusNotFound, get("/image/fedora/2/peers", "").Code)
+	assert.Equal(t, http.StatusNotFound, get("/image/fedora/3/peers", "").Code)
+
+	assert.Equal(t, http.StatusOK, peer(http.MethodDelete, "abc", ""))
+
+	resp = get("/image/fedora/1/peers", "")
+	err = json.NewDecoder(resp.Body).Decode(&sources)
+	assert.NoError(t, err)
+	assert.Empty(t, sources.Peers)
+
+	// The expanded disk can be fetched from any offset
+	resp = get("/image/fedora/1/raw", "")
+	assert.Equal(t, http.StatusOK, resp.Code)
+	assert.True(t, bytes.Equal(contents, resp.Body.Bytes()))
+
+	resp = get("/image/fedora/1/raw", "bytes=262144-")
+	assert.Equal(t, http.StatusPartialContent, resp.Code)
+	assert.Equal(t, "bytes 262144-786531/786532", resp.Header().Get("Content-Range"))
+	assert.True(t, bytes.Equal(contents[262144:], resp.Body.Bytes()))
+
+	resp = get("/image/fedora/1/raw", "bytes=786532-")
+	assert.Equal(t, http.StatusRequestedRangeNotSatisfiable, resp.Code)
+}
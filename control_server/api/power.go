@@ -0,0 +1,231 @@
+// Copyright (c) 2020-2022 TU Delft & Valentijn van de Beek <v.d.vandebeek@student.tudelft.nl> All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package api
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/baas-project/baas/control_server/power"
+	machinemodel "github.com/baas-project/baas/pkg/model/machine"
+	"github.com/baas-project/baas/pkg/model/user"
+	"github.com/baas-project/baas/pkg/util"
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+	"gorm.io/gorm"
+)
+
+// powerStatus is the power controller of a machine together with the state it reports
+type powerStatus struct {
+	machinemodel.PowerModel
+	State power.State
+}
+
+// powerController creates the controller of a machine, it writes the error to the response if there is none
+func (api_ *API) powerController(w http.ResponseWriter, mac string) (*machinemodel.PowerModel, power.Controller, bool) {
+	config, err := api_.store.GetMachinePower(mac)
+	if err == gorm.ErrRecordNotFound {
+		http.Error(w, "The machine has no power controller", http.StatusNotFound)
+		return nil, nil, false
+	} else if err != nil {
+		http.Error(w, "Cannot get the power controller", http.StatusInternalServerError)
+		log.Errorf("get machine power: %v", err)
+		return nil, nil, false
+	}
+
+	c, err := power.New(*config)
+	if err != nil {
+		http.Error(w, "Cannot create the power controller", http.StatusInternalServerError)
+		log.Errorf("create power controller of %s: %v", mac, err)
+		return nil, nil, false
+	}
+
+	return config, c, true
+}
+
+// SetMachinePower sets how the control server reaches the baseboard management controller of the machine
+// Example request: PUT /machine/52:54:00:d9:71:93/power
+// Example body: {"Driver": "redfish", "Address": "10.0.0.5", "Username": "admin", "Password": "secret",
+//                "Insecure": true}
+// Example response: Power controller set
+func (api_ *API) SetMachinePower(w http.ResponseWriter, r *http.Request) {
+	mac, err := GetTag("mac", w, r)
+	if err != nil {
+		return
+	}
+
+	if _, err = api_.store.GetMachineByMac(util.MacAddress{Address: mac}); err == gorm.ErrRecordNotFound {
+		http.Error(w, "Machine not found", http.StatusNotFound)
+		return
+	} else if err != nil {
+		http.Error(w, "Cannot find the machine", http.StatusInternalServerError)
+		log.Errorf("get machine by mac: %v", err)
+		return
+	}
+
+	var config machinemodel.PowerModel
+	if err = json.NewDecoder(r.Body).Decode(&config); err != nil {
+		http.Error(w, "Invalid power controller given", http.StatusBadRequest)
+		log.Errorf("Invalid power controller given: %v", err)
+		return
+	}
+
+	if _, err = power.New(config); err != nil {
+		http.Error(w, "Invalid power controller: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	config.MachineMAC = mac
+	if err = api_.store.SetMachinePower(&config); err != nil {
+		http.Error(w, "Cannot store the power controller", http.StatusInternalServerError)
+		log.Errorf("Store power controller: %v", err)
+		return
+	}
+
+	http.Error(w, "Power controller set", http.StatusOK)
+}
+
+// GetMachinePower returns the power controller of the machine, without its password, and the state it reports
+// Example request: GET /machine/52:54:00:d9:71:93/power
+// Example response: {"Driver": "redfish", "Address": "10.0.0.5", "Username": "admin", "Insecure": true,
+//                    "State": "on"}
+func (api_ *API) GetMachinePower(w http.ResponseWriter, r *http.Request) {
+	mac, err := GetTag("mac", w, r)
+	if err != nil {
+		return
+	}
+
+	config, c, ok := api_.powerController(w, mac)
+	if !ok {
+		return
+	}
+
+	state, err := c.Status()
+	if err != nil {
+		http.Error(w, "Cannot reach the power controller", http.StatusBadGateway)
+		log.Errorf("power status of %s: %v", mac, err)
+		return
+	}
+
+	config.Password = ""
+	_ = json.NewEncoder(w).Encode(powerStatus{PowerModel: *config, State: state})
+}
+
+// PowerMachine switches the machine on or off, power cycles it or restarts it from the network once
+// Example request: POST /machine/52:54:00:d9:71:93/power/cycle
+// Example response: Power action cycle done
+func (api_ *API) PowerMachine(w http.ResponseWriter, r *http.Request) {
+	mac, err := GetTag("mac", w, r)
+	if err != nil {
+		return
+	}
+
+	action, err := GetTag("action", w, r)
+	if err != nil {
+		return
+	}
+
+	_, c, ok := api_.powerController(w, mac)
+	if !ok {
+		return
+	}
+
+	switch action {
+	case "on":
+		err = c.On()
+	case "off":
+		err = c.Off()
+	case "cycle":
+		err = c.Cycle()
+	case "pxe":
+		err = power.RebootFromNetwork(c)
+	default:
+		http.Error(w, "Unknown power action, use on, off, cycle or pxe", http.StatusBadRequest)
+		return
+	}
+
+	if err != nil {
+		http.Error(w, "The power controller failed", http.StatusBadGateway)
+		log.Errorf("power %s of %s: %v", action, mac, err)
+		return
+	}
+
+	log.Infof("Power action %s done on machine %s", action, mac)
+	http.Error(w, "Power action "+action+" done", http.StatusOK)
+}
+
+// DeleteMachinePower removes the power controller of the machine, the machine itself is left as it is
+// Example request: DELETE /machine/52:54:00:d9:71:93/power
+// Example response: Power controller deleted
+func (api_ *API) DeleteMachinePower(w http.ResponseWriter, r *http.Request) {
+	mac, err := GetTag("mac", w, r)
+	if err != nil {
+		return
+	}
+
+	if err = api_.store.DeleteMachinePower(mac); err != nil {
+		http.Error(w, "Cannot delete the power controller", http.StatusInternalServerError)
+		log.Errorf("delete machine power: %v", err)
+		return
+	}
+
+	http.Error(w, "Power controller deleted", http.StatusOK)
+}
+
+// rebootFromNetwork restarts the machine from the network through its power controller
+func (api_ *API) rebootFromNetwork(mac string) error {
+	config, err := api_.store.GetMachinePower(mac)
+	if err == gorm.ErrRecordNotFound {
+		return errors.New("the machine has no power controller")
+	} else if err != nil {
+		return errors.Wrap(err, "get power controller")
+	}
+
+	c, err := power.New(*config)
+	if err != nil {
+		return err
+	}
+
+	return power.RebootFromNetwork(c)
+}
+
+// RegisterPowerHandlers sets the metadata for each of the routes and registers them to the global handler
+func (api_ *API) RegisterPowerHandlers() {
+	api_.Routes = append(api_.Routes, Route{
+		URI:         "/machine/{mac}/power",
+		Permissions: []user.UserRole{user.Admin},
+		UserAllowed: false,
+		Handler:     api_.SetMachinePower,
+		Method:      http.MethodPut,
+		Description: "Sets the power controller of a machine",
+	})
+
+	api_.Routes = append(api_.Routes, Route{
+		URI:         "/machine/{mac}/power",
+		Permissions: []user.UserRole{user.User, user.Moderator, user.Admin},
+		UserAllowed: true,
+		Handler:     api_.GetMachinePower,
+		Method:      http.MethodGet,
+		Description: "Gets the power controller and power state of a machine",
+	})
+
+	api_.Routes = append(api_.Routes, Route{
+		URI:         "/machine/{mac}/power",
+		Permissions: []user.UserRole{user.Admin},
+		UserAllowed: false,
+		Handler:     api_.DeleteMachinePower,
+		Method:      http.MethodDelete,
+		Description: "Removes the power controller of a machine",
+	})
+
+	api_.Routes = append(api_.Routes, Route{
+		URI:         "/machine/{mac}/power/{action}",
+		Permissions: []user.UserRole{user.Moderator, user.Admin},
+		UserAllowed: false,
+		Handler:     api_.PowerMachine,
+		Method:      http.MethodPost,
+		Description: "Switches a machine on or off, power cycles it or restarts it from the network",
+	})
+}
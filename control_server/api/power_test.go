@@ -0,0 +1,119 @@
+// Copyright (c) 2020-2022 TU Delft & Valentijn van de Beek <v.d.vandebeek@student.tudelft.nl> All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package api
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/baas-project/baas/control_server/power"
+	"github.com/baas-project/baas/control_server/power/redfishtest"
+	"github.com/baas-project/baas/pkg/model/images"
+	"github.com/baas-project/baas/pkg/model/user"
+	"github.com/baas-project/baas/pkg/storage"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestApi_Power(t *testing.T) {
+	store, _ := setupMachineStore(t)
+	assert.NoError(t, store.CreateUser(&user.UserModel{Username: "test", Role: user.User}))
+	assert.NoError(t, store.CreateImageSetup("test", &images.ImageSetup{Name: "setup", Username: "test",
+		UUID: "setup"}))
+
+	api := NewAPI(store, storage.NewMemory())
+	handler := api.handler("")
+
+	server := redfishtest.NewServer("admin", "secret")
+	defer server.Close()
+
+	request := func(method string, uri string, body string, role user.UserRole) *httptest.ResponseRecorder {
+		resp := httptest.NewRecorder()
+		req := httptest.NewRequest(method, uri, strings.NewReader(body))
+		loginAs(t, api, req, "test", role)
+		handler.ServeHTTP(resp, req)
+		return resp
+	}
+
+	// Without a power controller nothing can be done
+	resp := request(http.MethodPost, "/machine/abc/power/on", "", user.Admin)
+	assert.Equal(t, http.StatusNotFound, resp.Code)
+
+	resp = request(http.MethodPut, "/machine/abc/power", `{"Driver": "serial", "Address": "10.0.0.5"}`,
+		user.Admin)
+	assert.Equal(t, http.StatusBadRequest, resp.Code)
+
+	resp = request(http.MethodPut, "/machine/unknown/power", `{"Driver": "redfish", "Address": "10.0.0.5"}`,
+		user.Admin)
+	assert.Equal(t, http.StatusNotFound, resp.Code)
+
+	config := `{"Driver": "redfish", "Address": "` + server.URL + `", "Username": "admin", "Password": "secret"}`
+	resp = request(http.MethodPut, "/machine/abc/power", config, user.Moderator)
+	assert.Equal(t, http.StatusForbidden, resp.Code)
+
+	resp = request(http.MethodPut, "/machine/abc/power", config, user.Admin)
+	assert.Equal(t, http.StatusOK, resp.Code)
+
+	// The password is never sent back
+	resp = request(http.MethodGet, "/machine/abc/power", "", user.User)
+	assert.Equal(t, http.StatusOK, resp.Code)
+	assert.NotContains(t, resp.Body.String(), "secret")
+
+	var status powerStatus
+	assert.NoError(t, json.NewDecoder(resp.Body).Decode(&status))
+	assert.Equal(t, "redfish", status.Driver)
+	assert.Equal(t, power.Off, status.State)
+
+	resp = request(http.MethodPost, "/machine/abc/power/on", "", user.User)
+	assert.Equal(t, http.StatusForbidden, resp.Code)
+
+	resp = request(http.MethodPost, "/machine/abc/power/on", "", user.Moderator)
+	assert.Equal(t, http.StatusOK, resp.Code)
+	assert.Equal(t, "On", server.PowerState())
+
+	resp = request(http.MethodPost, "/machine/abc/power/reset", "", user.Admin)
+	assert.Equal(t, http.StatusBadRequest, resp.Code)
+
+	resp = request(http.MethodPost, "/machine/abc/power/pxe", "", user.Admin)
+	assert.Equal(t, http.StatusOK, resp.Code)
+	assert.Equal(t, 1, server.NetworkBoots())
+
+	// Queueing a boot setup restarts the machine from the network when asked to
+	resp = request(http.MethodPost, "/machine/abc/boot", `{"SetupUUID": "setup"}`, user.Admin)
+	assert.Equal(t, http.StatusOK, resp.Code)
+	assert.Equal(t, 1, server.NetworkBoots())
+
+	resp = request(http.MethodPost, "/machine/abc/boot", `{"SetupUUID": "setup", "PowerCycle": true}`, user.Admin)
+	assert.Equal(t, http.StatusOK, resp.Code)
+	assert.Equal(t, 2, server.NetworkBoots())
+	assert.Equal(t, []string{"On", "ForceRestart", "ForceRestart"}, server.Resets())
+
+	resp = request(http.MethodPost, "/machine/abc/power/off", "", user.Admin)
+	assert.Equal(t, http.StatusOK, resp.Code)
+	assert.Equal(t, "Off", server.PowerState())
+
+	// An unreachable controller is a bad gateway, the boot setup is queued regardless
+	server.Close()
+	resp = request(http.MethodGet, "/machine/abc/power", "", user.User)
+	assert.Equal(t, http.StatusBadGateway, resp.Code)
+
+	resp = request(http.MethodPost, "/machine/abc/boot", `{"SetupUUID": "setup", "PowerCycle": true}`, user.Admin)
+	assert.Equal(t, http.StatusBadGateway, resp.Code)
+
+	_, err := store.GetNextBootSetup("abc")
+	assert.NoError(t, err)
+
+	resp = request(http.MethodDelete, "/machine/abc/power", "", user.Admin)
+	assert.Equal(t, http.StatusOK, resp.Code)
+
+	resp = request(http.MethodGet, "/machine/abc/power", "", user.User)
+	assert.Equal(t, http.StatusNotFound, resp.Code)
+
+	// Without a power controller the setup cannot restart the machine
+	resp = request(http.MethodPost, "/machine/cba/boot", `{"SetupUUID": "setup", "PowerCycle": true}`, user.Admin)
+	assert.Equal(t, http.StatusBadGateway, resp.Code)
+}
@@ -0,0 +1,159 @@
+// Copyright (c) 2020-2022 TU Delft & Valentijn van de Beek <v.d.vandebeek@student.tudelft.nl> All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package api
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	api_pkg "github.com/baas-project/baas/pkg/api"
+	"github.com/baas-project/baas/pkg/model/user"
+	log "github.com/sirupsen/logrus"
+)
+
+// progressKeepAlive is the time after which a comment is sent to a follower when there was no progress, so proxies
+// do not close the connection
+const progressKeepAlive = 15 * time.Second
+
+// ReportProgress passes the progress of a transfer of the management OS on to the clients which follow the machine
+// Example request: POST /machine/52:54:00:d9:71:93/progress
+// Example body: {"Image": "87f58936-9540-4dad-aba6-253f06142166", "Version": 5, "Stage": "write",
+//                "Done": 1073741824, "Total": 4294967296, "Throughput": 104857600, "ETA": 30.7}
+// Example response: Progress received
+func (api_ *API) ReportProgress(w http.ResponseWriter, r *http.Request) {
+	mac, err := GetTag("mac", w, r)
+	if err != nil {
+		return
+	}
+
+	var progress api_pkg.TransferProgress
+	if err = json.NewDecoder(r.Body).Decode(&progress); err != nil {
+		http.Error(w, "Invalid progress given", http.StatusBadRequest)
+		log.Errorf("Invalid progress given: %v", err)
+		return
+	}
+
+	progress.Time = time.Now()
+	api_.progress.Publish(mac, progress)
+	http.Error(w, "Progress received", http.StatusOK)
+}
+
+// GetProgress returns the latest progress of every stage of the images of the machine
+// Example request: GET /machine/52:54:00:d9:71:93/progress
+// Example response: [{"Image": "87f58936-9540-4dad-aba6-253f06142166", "Version": 5, "Stage": "download",
+//                     "Done": 1073741824, "Total": 4294967296, "Throughput": 104857600, "ETA": 30.7,
+//                     "Finished": false, "Time": "2022-06-01T12:03:11Z"}]
+func (api_ *API) GetProgress(w http.ResponseWriter, r *http.Request) {
+	mac, err := GetTag("mac", w, r)
+	if err != nil {
+		return
+	}
+
+	progress := api_.progress.Latest(mac)
+	if progress == nil {
+		progress = []api_pkg.TransferProgress{}
+	}
+
+	_ = json.NewEncoder(w).Encode(progress)
+}
+
+// FollowProgress streams the progress of the machine as Server-Sent Events. The latest progress of every stage is
+// sent first, followed by every update until the client disconnects. Each event is a progress event whose data is
+// the JSON of the progress.
+// Example request: GET /machine/52:54:00:d9:71:93/progress/events
+// Example response: event: progress
+//                   data: {"Image": "87f58936-9540-4dad-aba6-253f06142166", "Stage": "write", "Done": 1073741824, ...}
+func (api_ *API) FollowProgress(w http.ResponseWriter, r *http.Request) {
+	mac, err := GetTag("mac", w, r)
+	if err != nil {
+		return
+	}
+
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "Streaming is not supported", http.StatusInternalServerError)
+		log.Error("The response writer cannot flush")
+		return
+	}
+
+	latest, updates, stop := api_.progress.Subscribe(mac)
+	defer stop()
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	w.WriteHeader(http.StatusOK)
+
+	for _, progress := range latest {
+		if err = writeProgressEvent(w, progress); err != nil {
+			return
+		}
+	}
+	flusher.Flush()
+
+	keepAlive := time.NewTicker(progressKeepAlive)
+	defer keepAlive.Stop()
+
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case progress := <-updates:
+			err = writeProgressEvent(w, progress)
+		case <-keepAlive.C:
+			_, err = fmt.Fprint(w, ": keep-alive\n\n")
+		}
+
+		if err != nil {
+			log.Debugf("Stopped following the progress of %s: %v", mac, err)
+			return
+		}
+		flusher.Flush()
+	}
+}
+
+// writeProgressEvent writes the progress as a Server-Sent Event
+func writeProgressEvent(w http.ResponseWriter, progress api_pkg.TransferProgress) error {
+	data, err := json.Marshal(progress)
+	if err != nil {
+		return err
+	}
+
+	_, err = fmt.Fprintf(w, "event: progress\ndata: %s\n\n", data)
+	return err
+}
+
+// RegisterProgressHandlers sets the metadata for each of the routes and registers them to the global handler
+func (api_ *API) RegisterProgressHandlers() {
+	api_.Routes = append(api_.Routes, Route{
+		URI:            "/machine/{mac}/progress",
+		Permissions:    []user.UserRole{user.Admin},
+		UserAllowed:    false,
+		Handler:        api_.ReportProgress,
+		Method:         http.MethodPost,
+		Description:    "Reports the progress of a transfer of a machine",
+		MachineAllowed: true,
+	})
+
+	api_.Routes = append(api_.Routes, Route{
+		URI:         "/machine/{mac}/progress",
+		Permissions: []user.UserRole{user.User, user.Moderator, user.Admin},
+		UserAllowed: true,
+		Handler:     api_.GetProgress,
+		Method:      http.MethodGet,
+		Description: "Gets the latest progress of the transfers of a machine",
+	})
+
+	api_.Routes = append(api_.Routes, Route{
+		URI:         "/machine/{mac}/progress/events",
+		Permissions: []user.UserRole{user.User, user.Moderator, user.Admin},
+		UserAllowed: true,
+		Handler:     api_.FollowProgress,
+		Method:      http.MethodGet,
+		Description: "Follows the progress of the transfers of a machine as Server-Sent Events",
+	})
+}
@@ -0,0 +1,109 @@
+// Copyright (c) 2020-2022 TU Delft & Valentijn van de Beek <v.d.vandebeek@student.tudelft.nl> All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package api
+
+import (
+	"bufio"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	api_pkg "github.com/baas-project/baas/pkg/api"
+	"github.com/baas-project/baas/pkg/model/user"
+	"github.com/baas-project/baas/pkg/storage"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestApi_Progress(t *testing.T) {
+	store, token := setupMachineStore(t)
+	api := NewAPI(store, storage.NewMemory())
+	server := httptest.NewServer(api.handler(""))
+	defer server.Close()
+
+	report := func(mac string, body string) int {
+		req, err := http.NewRequest(http.MethodPost, server.URL+"/machine/"+mac+"/progress", strings.NewReader(body))
+		assert.NoError(t, err)
+		req.Header.Add(api_pkg.MachineHeader, "abc")
+		req.Header.Add(api_pkg.MachineTokenHeader, token)
+
+		resp, err := http.DefaultClient.Do(req)
+		assert.NoError(t, err)
+		_ = resp.Body.Close()
+		return resp.StatusCode
+	}
+
+	follow := func(uri string) *http.Response {
+		req, err := http.NewRequest(http.MethodGet, server.URL+uri, nil)
+		assert.NoError(t, err)
+		loginAs(t, api, req, "alice", user.User)
+
+		resp, err := http.DefaultClient.Do(req)
+		assert.NoError(t, err)
+		return resp
+	}
+
+	assert.Equal(t, http.StatusOK, report("abc", `{"Image": "fedora", "Stage": "download", "Done": 10, "Total": 100}`))
+	assert.Equal(t, http.StatusForbidden, report("cba", `{"Image": "fedora", "Stage": "download"}`))
+	assert.Equal(t, http.StatusBadRequest, report("abc", `{"Image": `))
+
+	resp := follow("/machine/abc/progress/events")
+	defer resp.Body.Close()
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, "text/event-stream", resp.Header.Get("Content-Type"))
+
+	events := bufio.NewReader(resp.Body)
+	next := func() api_pkg.TransferProgress {
+		line, err := events.ReadString('\n')
+		assert.NoError(t, err)
+		assert.Equal(t, "event: progress\n", line)
+
+		line, err = events.ReadString('\n')
+		assert.NoError(t, err)
+		assert.True(t, strings.HasPrefix(line, "data: "))
+
+		var progress api_pkg.TransferProgress
+		assert.NoError(t, json.Unmarshal([]byte(strings.TrimPrefix(line, "data: ")), &progress))
+
+		line, err = events.ReadString('\n')
+		assert.NoError(t, err)
+		assert.Equal(t, "\n", line)
+		return progress
+	}
+
+	// The latest progress comes first, the updates follow
+	progress := next()
+	assert.Equal(t, api_pkg.StageDownload, progress.Stage)
+	assert.Equal(t, int64(10), progress.Done)
+	assert.False(t, progress.Time.IsZero())
+
+	assert.Equal(t, http.StatusOK, report("abc", `{"Image": "fedora", "Stage": "write", "Done": 50, "Total": 100}`))
+	progress = next()
+	assert.Equal(t, api_pkg.StageWrite, progress.Stage)
+	assert.Equal(t, int64(50), progress.Done)
+
+	listing := follow("/machine/abc/progress")
+	defer listing.Body.Close()
+
+	var latest []api_pkg.TransferProgress
+	assert.NoError(t, json.NewDecoder(listing.Body).Decode(&latest))
+	assert.Len(t, latest, 2)
+	assert.Equal(t, api_pkg.StageDownload, latest[0].Stage)
+	assert.Equal(t, api_pkg.StageWrite, latest[1].Stage)
+
+	// A new boot starts without the progress of the previous one
+	req, err := http.NewRequest(http.MethodPost, server.URL+"/machine/abc/status",
+		strings.NewReader(`{"Phase": "initializing"}`))
+	assert.NoError(t, err)
+	req.Header.Add(api_pkg.MachineHeader, "abc")
+	req.Header.Add(api_pkg.MachineTokenHeader, token)
+
+	status, err := http.DefaultClient.Do(req)
+	assert.NoError(t, err)
+	_ = status.Body.Close()
+	assert.Equal(t, http.StatusOK, status.StatusCode)
+	assert.Empty(t, api.progress.Latest("abc"))
+}
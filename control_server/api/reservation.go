@@ -0,0 +1,309 @@
+// Copyright (c) 2020-2022 TU Delft & Valentijn van de Beek <v.d.vandebeek@student.tudelft.nl> All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package api
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/baas-project/baas/control_server/placement"
+	"github.com/baas-project/baas/pkg/database"
+	machinemodel "github.com/baas-project/baas/pkg/model/machine"
+	"github.com/baas-project/baas/pkg/model/reservation"
+	"github.com/baas-project/baas/pkg/model/user"
+	"github.com/baas-project/baas/pkg/util"
+	"github.com/google/uuid"
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+)
+
+// getReservation fetches the reservation in the URI and checks whether the requesting user may change it.
+func (api_ *API) getReservation(w http.ResponseWriter, r *http.Request) (*reservation.ReservationModel, error) {
+	reservationUUID, err := GetTag("uuid", w, r)
+	if err != nil {
+		return nil, err
+	}
+
+	res, err := api_.store.GetReservationByUUID(reservationUUID)
+	if err != nil {
+		http.Error(w, "Cannot find the reservation", http.StatusNotFound)
+		log.Errorf("Cannot find reservation %s: %v", reservationUUID, err)
+		return nil, err
+	}
+
+	session, _ := api_.session.Get(r, "session-name")
+	username, _ := session.Values["Username"].(string)
+	role, _ := session.Values["Role"].(string)
+
+	if username != res.Username && role != user.Admin {
+		http.Error(w, "Reservation not owned by this user", http.StatusForbidden)
+		return nil, errors.New("reservation not owned by user")
+	}
+
+	return res, nil
+}
+
+// CreateReservation books a machine for a time slot. Instead of a machine the reservation can give constraints, then
+// the first free machine which satisfies them is booked.
+// Example request: POST /reservation
+// Example body: {"MachineMAC": "52:54:00:d9:71:93",
+//                "SetupUUID": "2b59ff94-7fb6-4239-b2e6-82f1e30f4355",
+//                "Start": "2022-06-01T09:00:00+02:00",
+//                "End": "2022-06-01T17:00:00+02:00"}
+// Example body: {"Constraints": "arch=x86_64, mem>=64G, label:numa=2",
+//                "SetupUUID": "2b59ff94-7fb6-4239-b2e6-82f1e30f4355",
+//                "Start": "2022-06-01T09:00:00+02:00",
+//                "End": "2022-06-01T17:00:00+02:00"}
+// Example response: the reservation including its UUID, machine and status
+func (api_ *API) CreateReservation(w http.ResponseWriter, r *http.Request) {
+	var res reservation.ReservationModel
+	if err := json.NewDecoder(r.Body).Decode(&res); err != nil {
+		http.Error(w, "Invalid reservation given", http.StatusBadRequest)
+		log.Errorf("Invalid reservation given: %v", err)
+		return
+	}
+
+	// The user is taken from the session, so users cannot book on behalf of someone else.
+	session, _ := api_.session.Get(r, "session-name")
+	res.Username, _ = session.Values["Username"].(string)
+
+	if res.Username == "" {
+		http.Error(w, "No user given for the reservation", http.StatusBadRequest)
+		return
+	}
+
+	if !res.Start.Before(res.End) {
+		http.Error(w, "The reservation should start before it ends", http.StatusBadRequest)
+		return
+	}
+
+	if !res.End.After(time.Now()) {
+		http.Error(w, "The reservation should end in the future", http.StatusBadRequest)
+		return
+	}
+
+	constraints, err := placement.Parse(res.Constraints)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Invalid constraints given: %v", err), http.StatusBadRequest)
+		return
+	}
+
+	// A machine which is named is only checked against the constraints, otherwise any machine may be picked
+	named := res.MachineMAC != ""
+	var candidates []machinemodel.MachineModel
+	if named {
+		m, err := api_.store.GetMachineByMac(util.MacAddress{Address: res.MachineMAC})
+		if err != nil {
+			http.Error(w, "Cannot find the machine in the database", http.StatusBadRequest)
+			log.Errorf("Reservation for unknown machine %s: %v", res.MachineMAC, err)
+			return
+		}
+
+		candidates, err = placement.Filter(api_.store, []machinemodel.MachineModel{*m}, constraints)
+	} else {
+		candidates, err = placement.Candidates(api_.store, constraints)
+	}
+
+	if err != nil {
+		http.Error(w, "Cannot find a machine", http.StatusInternalServerError)
+		log.Errorf("Find machines for constraints %q: %v", res.Constraints, err)
+		return
+	}
+
+	if len(candidates) == 0 {
+		http.Error(w, "No machine satisfies the constraints", http.StatusConflict)
+		return
+	}
+
+	setup, err := api_.store.GetImageSetup(string(res.SetupUUID))
+	if err != nil {
+		http.Error(w, "Cannot find the image setup", http.StatusBadRequest)
+		log.Errorf("Reservation for unknown setup %s: %v", res.SetupUUID, err)
+		return
+	}
+
+	if setup.Username != res.Username {
+		http.Error(w, "Image setup not owned by this user", http.StatusForbidden)
+		return
+	}
+
+	res.UUID = uuid.New().String()
+	res.Status = reservation.Scheduled
+	res.Constraints = constraints.String()
+
+	// The candidates are tried in turn, the store refuses those which are taken during the slot
+	for _, m := range candidates {
+		res.MachineMAC = m.MacAddress.Address
+		if err = api_.store.CreateReservation(&res); err != database.ErrReservationConflict {
+			break
+		}
+	}
+
+	if err == database.ErrReservationConflict && named {
+		http.Error(w, "The machine is already reserved during this time", http.StatusConflict)
+		return
+	} else if err == database.ErrReservationConflict {
+		http.Error(w, "No machine which satisfies the constraints is free during this time", http.StatusConflict)
+		return
+	}
+
+	if err != nil {
+		http.Error(w, "Cannot create the reservation", http.StatusInternalServerError)
+		log.Errorf("Create reservation: %v", err)
+		return
+	}
+
+	w.WriteHeader(http.StatusCreated)
+	_ = json.NewEncoder(w).Encode(res)
+}
+
+// GetReservations returns all the reservations so users can see when machines are available
+// Example request: GET /reservations
+// Example response: a list of reservations
+func (api_ *API) GetReservations(w http.ResponseWriter, _ *http.Request) {
+	reservations, err := api_.store.GetReservations()
+	if err != nil {
+		http.Error(w, "Cannot get the reservations", http.StatusInternalServerError)
+		log.Errorf("Get reservations: %v", err)
+		return
+	}
+
+	_ = json.NewEncoder(w).Encode(reservations)
+}
+
+// GetReservation returns a single reservation
+// Example request: GET /reservation/[uuid]
+func (api_ *API) GetReservation(w http.ResponseWriter, r *http.Request) {
+	res, err := api_.getReservation(w, r)
+	if err != nil {
+		return
+	}
+
+	_ = json.NewEncoder(w).Encode(res)
+}
+
+// CancelReservation withdraws a reservation. Reservations which are already active are cut short,
+// the scheduler then puts the machine back on the baseline setup.
+// Example request: DELETE /reservation/[uuid]
+// Example response: Successfully cancelled the reservation
+func (api_ *API) CancelReservation(w http.ResponseWriter, r *http.Request) {
+	res, err := api_.getReservation(w, r)
+	if err != nil {
+		return
+	}
+
+	switch res.Status {
+	case reservation.Scheduled:
+		res.Status = reservation.Cancelled
+	case reservation.Active:
+		res.End = time.Now()
+	default:
+		http.Error(w, "The reservation has already ended", http.StatusBadRequest)
+		return
+	}
+
+	if err = api_.store.UpdateReservation(res); err != nil {
+		http.Error(w, "Cannot cancel the reservation", http.StatusInternalServerError)
+		log.Errorf("Cancel reservation: %v", err)
+		return
+	}
+
+	http.Error(w, "Successfully cancelled the reservation", http.StatusOK)
+}
+
+// GetReservationsByUser returns the reservations made by a user
+// Example request: GET /user/[name]/reservations
+func (api_ *API) GetReservationsByUser(w http.ResponseWriter, r *http.Request) {
+	name, err := GetName(w, r)
+	if err != nil {
+		return
+	}
+
+	reservations, err := api_.store.GetReservationsByUsername(name)
+	if err != nil {
+		http.Error(w, "Cannot get the reservations", http.StatusInternalServerError)
+		log.Errorf("Get reservations by user: %v", err)
+		return
+	}
+
+	_ = json.NewEncoder(w).Encode(reservations)
+}
+
+// GetReservationsByMachine returns the reservations made on a machine
+// Example request: GET /machine/[mac]/reservations
+func (api_ *API) GetReservationsByMachine(w http.ResponseWriter, r *http.Request) {
+	mac, err := GetTag("mac", w, r)
+	if err != nil {
+		return
+	}
+
+	reservations, err := api_.store.GetReservationsByMachine(mac)
+	if err != nil {
+		http.Error(w, "Cannot get the reservations", http.StatusInternalServerError)
+		log.Errorf("Get reservations by machine: %v", err)
+		return
+	}
+
+	_ = json.NewEncoder(w).Encode(reservations)
+}
+
+// RegisterReservationHandlers sets the metadata for each of the routes and registers them to the global handler
+func (api_ *API) RegisterReservationHandlers() {
+	api_.Routes = append(api_.Routes, Route{
+		URI:         "/reservation",
+		Permissions: []user.UserRole{user.User, user.Moderator, user.Admin},
+		UserAllowed: true,
+		Handler:     api_.CreateReservation,
+		Method:      http.MethodPost,
+		Description: "Reserves a machine for a time slot",
+	})
+
+	api_.Routes = append(api_.Routes, Route{
+		URI:         "/reservations",
+		Permissions: []user.UserRole{user.User, user.Moderator, user.Admin},
+		UserAllowed: true,
+		Handler:     api_.GetReservations,
+		Method:      http.MethodGet,
+		Description: "Gets all the reservations",
+	})
+
+	api_.Routes = append(api_.Routes, Route{
+		URI:         "/reservation/{uuid}",
+		Permissions: []user.UserRole{user.User, user.Moderator, user.Admin},
+		UserAllowed: true,
+		Handler:     api_.GetReservation,
+		Method:      http.MethodGet,
+		Description: "Gets a reservation",
+	})
+
+	api_.Routes = append(api_.Routes, Route{
+		URI:         "/reservation/{uuid}",
+		Permissions: []user.UserRole{user.User, user.Moderator, user.Admin},
+		UserAllowed: true,
+		Handler:     api_.CancelReservation,
+		Method:      http.MethodDelete,
+		Description: "Cancels a reservation",
+	})
+
+	api_.Routes = append(api_.Routes, Route{
+		URI:         "/user/{name}/reservations",
+		Permissions: []user.UserRole{user.Moderator, user.Admin},
+		UserAllowed: true,
+		Handler:     api_.GetReservationsByUser,
+		Method:      http.MethodGet,
+		Description: "Gets the reservations made by a user",
+	})
+
+	api_.Routes = append(api_.Routes, Route{
+		URI:         "/machine/{mac}/reservations",
+		Permissions: []user.UserRole{user.User, user.Moderator, user.Admin},
+		UserAllowed: true,
+		Handler:     api_.GetReservationsByMachine,
+		Method:      http.MethodGet,
+		Description: "Gets the reservations made on a machine",
+	})
+}
@@ -0,0 +1,216 @@
+// Copyright (c) 2020-2022 TU Delft & Valentijn van de Beek <v.d.vandebeek@student.tudelft.nl> All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package api
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/baas-project/baas/pkg/database"
+	"github.com/baas-project/baas/pkg/database/sqlite"
+	"github.com/baas-project/baas/pkg/model/images"
+	machinemodel "github.com/baas-project/baas/pkg/model/machine"
+	"github.com/baas-project/baas/pkg/model/reservation"
+	"github.com/baas-project/baas/pkg/model/user"
+	"github.com/baas-project/baas/pkg/storage"
+	"github.com/baas-project/baas/pkg/util"
+	"github.com/stretchr/testify/assert"
+)
+
+func setupReservationStore(t *testing.T) database.Store {
+	store, err := sqlite.NewSqliteStore(sqlite.InMemoryPath)
+	assert.NoError(t, err)
+
+	err = store.CreateUser(&user.UserModel{Username: "test", Name: "Test", Email: "test@example.com", Role: user.User})
+	assert.NoError(t, err)
+
+	err = store.UpdateMachine(&machinemodel.MachineModel{
+		MacAddress:   util.MacAddress{Address: "abc"},
+		Name:         "bca",
+		Architecture: machinemodel.X86_64,
+	})
+	assert.NoError(t, err)
+
+	err = store.CreateImageSetup("test", &images.ImageSetup{Name: "setup", Username: "test", UUID: "setup"})
+	assert.NoError(t, err)
+
+	return store
+}
+
+func postReservation(t *testing.T, api *API, handler http.Handler, res reservation.ReservationModel) *httptest.ResponseRecorder {
+	var body bytes.Buffer
+	_ = json.NewEncoder(&body).Encode(res)
+
+	resp := httptest.NewRecorder()
+	req := httptest.NewRequest(http.MethodPost, "/reservation", &body)
+	loginAs(t, api, req, "test", user.User)
+	req.Header.Add("origin", "http://localhost:9090")
+	handler.ServeHTTP(resp, req)
+
+	return resp
+}
+
+func TestApi_CreateReservation(t *testing.T) {
+	store := setupReservationStore(t)
+	api := NewAPI(store, storage.NewMemory())
+	handler := api.handler("")
+
+	start := time.Now().Add(time.Hour)
+	resp := postReservation(t, api, handler, reservation.ReservationModel{
+		Username:   "test",
+		MachineMAC: "abc",
+		SetupUUID:  "setup",
+		Start:      start,
+		End:        start.Add(time.Hour),
+	})
+	assert.Equal(t, http.StatusCreated, resp.Code)
+
+	var decoded reservation.ReservationModel
+	err := json.NewDecoder(resp.Body).Decode(&decoded)
+	assert.NoError(t, err)
+	assert.NotEmpty(t, decoded.UUID)
+	assert.Equal(t, reservation.Scheduled, decoded.Status)
+
+	stored, err := store.GetReservationByUUID(decoded.UUID)
+	assert.NoError(t, err)
+	assert.Equal(t, "abc", stored.MachineMAC)
+}
+
+func TestApi_CreateReservationConflict(t *testing.T) {
+	store := setupReservationStore(t)
+	api := NewAPI(store, storage.NewMemory())
+	handler := api.handler("")
+
+	start := time.Now().Add(time.Hour)
+	resp := postReservation(t, api, handler, reservation.ReservationModel{
+		Username:   "test",
+		MachineMAC: "abc",
+		SetupUUID:  "setup",
+		Start:      start,
+		End:        start.Add(2 * time.Hour),
+	})
+	assert.Equal(t, http.StatusCreated, resp.Code)
+
+	// Overlaps with the second hour of the first reservation
+	resp = postReservation(t, api, handler, reservation.ReservationModel{
+		Username:   "test",
+		MachineMAC: "abc",
+		SetupUUID:  "setup",
+		Start:      start.Add(time.Hour),
+		End:        start.Add(3 * time.Hour),
+	})
+	assert.Equal(t, http.StatusConflict, resp.Code)
+
+	// Directly adjacent slots do not conflict
+	resp = postReservation(t, api, handler, reservation.ReservationModel{
+		Username:   "test",
+		MachineMAC: "abc",
+		SetupUUID:  "setup",
+		Start:      start.Add(2 * time.Hour),
+		End:        start.Add(3 * time.Hour),
+	})
+	assert.Equal(t, http.StatusCreated, resp.Code)
+}
+
+func TestApi_CreateReservationInvalidWindow(t *testing.T) {
+	store := setupReservationStore(t)
+	api := NewAPI(store, storage.NewMemory())
+	handler := api.handler("")
+
+	start := time.Now().Add(time.Hour)
+	resp := postReservation(t, api, handler, reservation.ReservationModel{
+		Username:   "test",
+		MachineMAC: "abc",
+		SetupUUID:  "setup",
+		Start:      start,
+		End:        start.Add(-time.Minute),
+	})
+	assert.Equal(t, http.StatusBadRequest, resp.Code)
+}
+
+func TestApi_CreateReservationConstraints(t *testing.T) {
+	store := setupReservationStore(t)
+	api := NewAPI(store, storage.NewMemory())
+	handler := api.handler("")
+
+	for _, m := range []machinemodel.MachineModel{
+		{MacAddress: util.MacAddress{Address: "big-1"}, Name: "big-1", Architecture: machinemodel.X86_64, Managed: true},
+		{MacAddress: util.MacAddress{Address: "big-2"}, Name: "big-2", Architecture: machinemodel.X86_64, Managed: true},
+		{MacAddress: util.MacAddress{Address: "small"}, Name: "small", Architecture: machinemodel.X86_64, Managed: true},
+	} {
+		m := m
+		assert.NoError(t, store.CreateMachine(&m))
+
+		memory := uint64(128 << 30)
+		if m.Name == "small" {
+			memory = 8 << 30
+		}
+
+		err := store.SetMachineInventory(&machinemodel.InventoryModel{
+			MachineMAC: m.MacAddress.Address,
+			Memory:     memory,
+			Time:       time.Now(),
+		})
+		assert.NoError(t, err)
+	}
+
+	// The labels are set by an admin
+	resp := httptest.NewRecorder()
+	req := httptest.NewRequest(http.MethodPut, "/machine/big-2/labels", bytes.NewBufferString(`{"numa": "2"}`))
+	loginAs(t, api, req, "admin", user.Admin)
+	handler.ServeHTTP(resp, req)
+	assert.Equal(t, http.StatusOK, resp.Code)
+
+	reserve := func(constraints string, mac string) *httptest.ResponseRecorder {
+		start := time.Now().Add(time.Hour)
+		return postReservation(t, api, handler, reservation.ReservationModel{
+			MachineMAC:  mac,
+			Constraints: constraints,
+			SetupUUID:   "setup",
+			Start:       start,
+			End:         start.Add(time.Hour),
+		})
+	}
+
+	machineOf := func(resp *httptest.ResponseRecorder) string {
+		var decoded reservation.ReservationModel
+		assert.NoError(t, json.NewDecoder(resp.Body).Decode(&decoded))
+		return decoded.MachineMAC
+	}
+
+	resp = reserve("arch=x86_64, mem>=64G, label:numa=2", "")
+	assert.Equal(t, http.StatusCreated, resp.Code)
+	assert.Equal(t, "big-2", machineOf(resp))
+
+	// The first free machine which matches is taken
+	resp = reserve("mem>=64G", "")
+	assert.Equal(t, http.StatusCreated, resp.Code)
+	assert.Equal(t, "big-1", machineOf(resp))
+
+	assert.Equal(t, http.StatusConflict, reserve("mem>=64G", "").Code)
+	assert.Equal(t, http.StatusConflict, reserve("mem>=1T", "").Code)
+	assert.Equal(t, http.StatusBadRequest, reserve("colour=red", "").Code)
+
+	// A machine which is named has to satisfy the constraints as well
+	assert.Equal(t, http.StatusConflict, reserve("mem>=64G", "small").Code)
+	resp = reserve("mem<64G", "small")
+	assert.Equal(t, http.StatusCreated, resp.Code)
+	assert.Equal(t, "small", machineOf(resp))
+
+	resp = httptest.NewRecorder()
+	req = httptest.NewRequest(http.MethodGet, "/machines/match?constraints=mem%3E%3D64G", nil)
+	loginAs(t, api, req, "test", user.User)
+	handler.ServeHTTP(resp, req)
+	assert.Equal(t, http.StatusOK, resp.Code)
+
+	var machines []machinemodel.MachineModel
+	assert.NoError(t, json.NewDecoder(resp.Body).Decode(&machines))
+	assert.Len(t, machines, 2)
+	assert.Equal(t, machinemodel.Labels{"numa": "2"}, machines[1].Labels)
+}
@@ -0,0 +1,150 @@
+// Copyright (c) 2020-2022 TU Delft & Valentijn van de Beek <v.d.vandebeek@student.tudelft.nl> All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package api
+
+import (
+	"encoding/json"
+	"net/http"
+	"time"
+
+	"github.com/baas-project/baas/control_server/retention"
+	"github.com/baas-project/baas/pkg/model/images"
+	"github.com/baas-project/baas/pkg/model/user"
+	log "github.com/sirupsen/logrus"
+)
+
+func decodeRetentionPolicy(w http.ResponseWriter, r *http.Request) (*images.RetentionPolicy, bool) {
+	var policy images.RetentionPolicy
+	if err := json.NewDecoder(r.Body).Decode(&policy); err != nil {
+		http.Error(w, "Invalid retention policy given", http.StatusBadRequest)
+		log.Errorf("Invalid retention policy given: %v", err)
+		return nil, false
+	}
+
+	return &policy, true
+}
+
+// SetImageRetention sets the retention policy of an image, an empty policy falls back to the policy of the owner
+// Example request: PUT /image/87f58936-9540-4dad-aba6-253f06142166/retention
+// Example body: {"KeepLast": 5, "KeepDays": 30}
+// Example response: {"KeepLast": 5, "KeepDays": 30}
+func (api_ *API) SetImageRetention(w http.ResponseWriter, r *http.Request) {
+	image, err := api_.checkUserImage(w, r)
+	if err != nil {
+		return
+	}
+
+	policy, ok := decodeRetentionPolicy(w, r)
+	if !ok {
+		return
+	}
+
+	if err = api_.store.SetImageRetention(image.UUID, *policy); err != nil {
+		http.Error(w, "Cannot set the retention policy", http.StatusInternalServerError)
+		log.Errorf("Set retention policy of image %s: %v", image.UUID, err)
+		return
+	}
+
+	_ = json.NewEncoder(w).Encode(policy)
+}
+
+// SetUserRetention sets the retention policy for the images of a user which do not have their own
+// Example request: PUT /user/Jan/retention
+// Example body: {"KeepLast": 3, "KeepDays": 0}
+// Example response: {"KeepLast": 3, "KeepDays": 0}
+func (api_ *API) SetUserRetention(w http.ResponseWriter, r *http.Request) {
+	name, err := GetName(w, r)
+	if err != nil {
+		return
+	}
+
+	if _, err = api_.store.GetUserByUsername(name); err != nil {
+		http.Error(w, "Cannot find the user", http.StatusNotFound)
+		log.Errorf("Set retention policy of unknown user %s: %v", name, err)
+		return
+	}
+
+	policy, ok := decodeRetentionPolicy(w, r)
+	if !ok {
+		return
+	}
+
+	if err = api_.store.SetUserRetention(name, *policy); err != nil {
+		http.Error(w, "Cannot set the retention policy", http.StatusInternalServerError)
+		log.Errorf("Set retention policy of user %s: %v", name, err)
+		return
+	}
+
+	_ = json.NewEncoder(w).Encode(policy)
+}
+
+// PlanRetention reports which versions the retention policies would remove, without removing them
+// Example request: GET /retention
+// Example response: {"Versions": [{"Image": "87f58936-9540-4dad-aba6-253f06142166", "Username": "Jan",
+//                                  "Version": 2, "Created": "2022-01-01T12:00:00+01:00", "Size": 536870912}],
+//                    "Bytes": 536870912}
+func (api_ *API) PlanRetention(w http.ResponseWriter, _ *http.Request) {
+	report, err := retention.NewCollector(api_.store, api_.files, 0).Plan(time.Now())
+	if err != nil {
+		http.Error(w, "Cannot plan the retention", http.StatusInternalServerError)
+		log.Errorf("Plan retention: %v", err)
+		return
+	}
+
+	_ = json.NewEncoder(w).Encode(report)
+}
+
+// RunRetention removes the versions which the retention policies do not keep right away
+// Example request: POST /retention
+// Example response: the removed versions, in the same format as GET /retention
+func (api_ *API) RunRetention(w http.ResponseWriter, _ *http.Request) {
+	report, err := retention.NewCollector(api_.store, api_.files, 0).Collect(time.Now())
+	if err != nil {
+		http.Error(w, "Cannot remove the old versions", http.StatusInternalServerError)
+		log.Errorf("Run retention: %v", err)
+		return
+	}
+
+	_ = json.NewEncoder(w).Encode(report)
+}
+
+// RegisterRetentionHandlers sets the metadata for each of the routes and registers them to the global handler
+func (api_ *API) RegisterRetentionHandlers() {
+	api_.Routes = append(api_.Routes, Route{
+		URI:         "/image/{uuid}/retention",
+		Permissions: []user.UserRole{user.User, user.Moderator, user.Admin},
+		UserAllowed: true,
+		Handler:     api_.SetImageRetention,
+		Method:      http.MethodPut,
+		Description: "Sets the retention policy of an image",
+	})
+
+	api_.Routes = append(api_.Routes, Route{
+		URI:         "/user/{name}/retention",
+		Permissions: []user.UserRole{user.Admin},
+		UserAllowed: true,
+		Handler:     api_.SetUserRetention,
+		Method:      http.MethodPut,
+		Description: "Sets the retention policy for the images of a user",
+	})
+
+	api_.Routes = append(api_.Routes, Route{
+		URI:         "/retention",
+		Permissions: []user.UserRole{user.Admin},
+		UserAllowed: false,
+		Handler:     api_.PlanRetention,
+		Method:      http.MethodGet,
+		Description: "Reports which versions the retention policies would remove",
+	})
+
+	api_.Routes = append(api_.Routes, Route{
+		URI:         "/retention",
+		Permissions: []user.UserRole{user.Admin},
+		UserAllowed: false,
+		Handler:     api_.RunRetention,
+		Method:      http.MethodPost,
+		Description: "Removes the versions which the retention policies do not keep",
+	})
+}
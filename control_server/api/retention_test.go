@@ -0,0 +1,82 @@
+// Copyright (c) 2020-2022 TU Delft & Valentijn van de Beek <v.d.vandebeek@student.tudelft.nl> All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package api
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/baas-project/baas/control_server/retention"
+	"github.com/baas-project/baas/pkg/database/memory"
+	"github.com/baas-project/baas/pkg/model/images"
+	"github.com/baas-project/baas/pkg/model/user"
+	"github.com/baas-project/baas/pkg/storage"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestApi_Retention(t *testing.T) {
+	store := memory.NewStore()
+	files := storage.NewMemory()
+
+	err := store.CreateUser(&user.UserModel{Username: "test", Role: user.User})
+	assert.NoError(t, err)
+
+	store.CreateImage(&images.ImageModel{Name: "fedora", UUID: "fedora", Username: "test"})
+	for v := uint64(0); v <= 2; v++ {
+		if v > 0 {
+			store.CreateNewImageVersion(images.Version{Version: v, ImageModelUUID: "fedora"})
+		}
+		assert.NoError(t, files.Create("fedora", storage.VersionFile(v), 10))
+	}
+
+	api := NewAPI(store, files)
+	handler := api.handler("")
+
+	// The owner sets the policy of the image
+	body, _ := json.Marshal(images.RetentionPolicy{KeepLast: 1})
+	resp := httptest.NewRecorder()
+	req := httptest.NewRequest(http.MethodPut, "/image/fedora/retention", bytes.NewReader(body))
+	loginAs(t, api, req, "test", user.User)
+	handler.ServeHTTP(resp, req)
+	assert.Equal(t, http.StatusOK, resp.Code)
+
+	// Only admins may look at the plan
+	resp = httptest.NewRecorder()
+	req = httptest.NewRequest(http.MethodGet, "/retention", nil)
+	loginAs(t, api, req, "test", user.User)
+	handler.ServeHTTP(resp, req)
+	assert.Equal(t, http.StatusForbidden, resp.Code)
+
+	resp = httptest.NewRecorder()
+	req = httptest.NewRequest(http.MethodGet, "/retention", nil)
+	loginAs(t, api, req, "root", user.Admin)
+	handler.ServeHTTP(resp, req)
+	assert.Equal(t, http.StatusOK, resp.Code)
+
+	var report retention.Report
+	err = json.NewDecoder(resp.Body).Decode(&report)
+	assert.NoError(t, err)
+	assert.Len(t, report.Versions, 2)
+	assert.Equal(t, int64(20), report.Bytes)
+
+	// A dry run does not remove anything
+	image, err := store.GetImageByUUID("fedora")
+	assert.NoError(t, err)
+	assert.Len(t, image.Versions, 3)
+
+	resp = httptest.NewRecorder()
+	req = httptest.NewRequest(http.MethodPost, "/retention", nil)
+	loginAs(t, api, req, "root", user.Admin)
+	handler.ServeHTTP(resp, req)
+	assert.Equal(t, http.StatusOK, resp.Code)
+
+	image, err = store.GetImageByUUID("fedora")
+	assert.NoError(t, err)
+	assert.Len(t, image.Versions, 1)
+	assert.Equal(t, uint64(2), image.Versions[0].Version)
+}
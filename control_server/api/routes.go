@@ -8,10 +8,15 @@ import (
 	"fmt"
 	"net/http"
 
+	"github.com/baas-project/baas/control_server/multicast"
+	"github.com/baas-project/baas/control_server/nbd"
+	"github.com/baas-project/baas/control_server/transcode"
 	"github.com/baas-project/baas/pkg/model/user"
 
+	api_pkg "github.com/baas-project/baas/pkg/api"
 	"github.com/baas-project/baas/pkg/database"
 	"github.com/baas-project/baas/pkg/httplog"
+	"github.com/baas-project/baas/pkg/storage"
 	"github.com/gorilla/mux"
 	"github.com/rs/cors"
 	log "github.com/sirupsen/logrus"
@@ -25,46 +30,77 @@ type Route struct {
 	Handler     func(w http.ResponseWriter, r *http.Request)
 	Method      string
 
+	// MachineAllowed indicates that the management OS may use this route with its machine credential
+	MachineAllowed bool
+
 	// Cute little feature
 	Description string
 }
 
-func getHandler(machineStore database.Store, staticDir string, diskpath string) http.Handler {
+func getHandler(machineStore database.Store, files storage.ImageFiles, staticDir string) http.Handler {
 	// API for communicating with the management os
-	api := NewAPI(machineStore, diskpath)
+	return NewAPI(machineStore, files).handler(staticDir)
+}
 
+// handler registers all the routes of the API and returns the resulting handler.
+func (api_ *API) handler(staticDir string) http.Handler {
 	r := mux.NewRouter()
 
 	r.StrictSlash(true)
 	r.Use(logging)
 
 	// Applications (in particular, the management OS) can send logs here to be logged on the control server.
-	r.HandleFunc("/log", httplog.CreateLogHandler(log.StandardLogger()))
+	api_.Routes = append(api_.Routes, Route{
+		URI:            "/log",
+		Permissions:    []user.UserRole{user.Admin},
+		UserAllowed:    false,
+		Handler:        httplog.CreateLogHandler(log.StandardLogger()),
+		Method:         http.MethodPost,
+		Description:    "Logs a message on the control server",
+		MachineAllowed: true,
+	})
 
 	// TODO: we may want to split this up, especially the disk images part
 	// TODO: isn't this already the case?
 	// Serve static files (kernel, initramfs, disk images)
 	r.PathPrefix("/static/").Handler(http.StripPrefix("/static/", http.FileServer(http.Dir(staticDir))))
 
-	api.RegisterMachineHandlers()
-	api.RegisterUserHandlers()
-	api.RegisterImagePackageHandlers()
-
-	for _, route := range api.Routes {
-		r.HandleFunc(route.URI, api.CheckRole(route, route.Handler)).Methods(route.Method)
+	api_.RegisterMachineHandlers()
+	api_.RegisterStatusHandlers()
+	api_.RegisterProgressHandlers()
+	api_.RegisterDiscoveryHandlers()
+	api_.RegisterPowerHandlers()
+	api_.RegisterReservationHandlers()
+	api_.RegisterUserHandlers()
+	api_.RegisterAccessTokenHandlers()
+	// Registered before the images, otherwise GET /image/{uuid}/transcode is taken for a version
+	api_.RegisterTranscodeHandlers()
+	api_.RegisterMulticastHandlers()
+	api_.RegisterPeerHandlers()
+	api_.RegisterNBDHandlers()
+	api_.RegisterImagePackageHandlers()
+	api_.RegisterRetentionHandlers()
+	api_.RegisterSigningHandlers()
+
+	for _, route := range api_.Routes {
+		r.HandleFunc(route.URI, api_.CheckRole(route, route.Handler)).Methods(route.Method)
 	}
 
 	// OAuth login handlers, we deal with these separately since they should always be available.
-	r.HandleFunc("/user/login/github", api.LoginGithub).Methods(http.MethodGet)
-	r.HandleFunc("/user/login/github/callback", api.LoginGithubCallback).Methods(http.MethodGet)
+	r.HandleFunc("/user/login/github", api_.LoginGithub).Methods(http.MethodGet)
+	r.HandleFunc("/user/login/github/callback", api_.LoginGithubCallback).Methods(http.MethodGet)
 
 	// Serve boot configurations to pixiecore (this url is hardcoded in pixiecore)
-	r.HandleFunc("/v1/boot/{mac}", api.ServeBootConfigurations)
+	r.HandleFunc("/v1/boot/{mac}", api_.ServeBootConfigurations)
+
+	// Machines in discovery mode authenticate with a credential which is not in the database yet
+	r.HandleFunc("/discover/{mac}", api_.RegisterDiscoveredMachine).Methods(http.MethodPost)
 
 	c := cors.New(cors.Options{
 		AllowedOrigins:   []string{"http://localhost:9090"},
-		AllowedHeaders:   []string{"Authorization", "Set-Cookie"},
-		AllowedMethods:   []string{"GET", "POST", "PUT", "DELETE"},
+		AllowedHeaders:   []string{"Authorization", "Set-Cookie", api_pkg.UploadOffsetHeader},
+		AllowedMethods:   []string{"GET", "POST", "PUT", "PATCH", "DELETE"},
+		ExposedHeaders:   []string{api_pkg.UploadOffsetHeader},
 		AllowCredentials: true,
 		Debug:            true,
 	})
@@ -73,9 +109,19 @@ func getHandler(machineStore database.Store, staticDir string, diskpath string)
 }
 
 // StartServer defines all routes and then starts listening for HTTP requests.
-func StartServer(machineStore database.Store, staticDir string, diskPath string, address string, port int) {
+// New versions which are uploaded uncompressed are compressed as given by compression.
+// Versions are sent over multicast by the manager, if it is set. Unknown machines are booted into discovery mode if
+// discovery is set.
+func StartServer(machineStore database.Store, files storage.ImageFiles, compression transcode.Target,
+	manager *multicast.Manager, exports *nbd.Manager, discovery bool, staticDir string, address string, port int) {
+	api_ := NewAPI(machineStore, files)
+	api_.DefaultCompression = compression
+	api_.Multicast = manager
+	api_.NBD = exports
+	api_.Discovery = discovery
+
 	srv := http.Server{
-		Handler: getHandler(machineStore, staticDir, diskPath),
+		Handler: api_.handler(staticDir),
 		Addr:    fmt.Sprintf("%s:%d", address, port),
 	}
 	log.Fatal(srv.ListenAndServe())
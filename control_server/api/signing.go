@@ -0,0 +1,382 @@
+// Copyright (c) 2020-2022 TU Delft & Valentijn van de Beek <v.d.vandebeek@student.tudelft.nl> All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package api
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/json"
+	"net/http"
+	"strconv"
+
+	"github.com/baas-project/baas/pkg/model/images"
+	usermodel "github.com/baas-project/baas/pkg/model/user"
+	"github.com/google/uuid"
+	"github.com/gorilla/mux"
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+)
+
+// signRequest asks to sign a version with a key. The signature is left out for keys managed by the
+// control server, which then signs the version itself.
+type signRequest struct {
+	Key       string
+	Signature []byte
+}
+
+// CreateSigningKey creates a signing key for a user. Without a public key the control server generates the
+// key and keeps the private key, otherwise the public key of a key kept by the user is registered. Both raw
+// ed25519 keys and minisign public keys are accepted, base64 encoded.
+// Example request: POST /user/Jan/keys
+// Example body: {"Name": "release key", "PublicKey": "RWQf6LRCGA9i53mlYecO4IzT51TGPpvWucNSCh1CBM0QTaLn73Y7GFO3"}
+// Example response: {"UUID": "0f7e7d0a-4c4e-4b8e-9a57-8b3b0e8e6f8c", "Username": "Jan", "Name": "release key",
+//                    "PublicKey": "3mlYecO4IzT51TGPpvWucNSCh1CBM0QTaLn73Y7GFO0=", "Managed": false}
+func (api_ *API) CreateSigningKey(w http.ResponseWriter, r *http.Request) {
+	name, err := GetName(w, r)
+	if err != nil {
+		return
+	}
+
+	owner, err := api_.store.GetUserByUsername(name)
+	if err != nil {
+		http.Error(w, "Cannot find the user", http.StatusNotFound)
+		log.Errorf("Create signing key for unknown user %s: %v", name, err)
+		return
+	}
+
+	var key usermodel.SigningKeyModel
+	if err = json.NewDecoder(r.Body).Decode(&key); err != nil {
+		http.Error(w, "Invalid signing key given", http.StatusBadRequest)
+		log.Errorf("Invalid signing key given: %v", err)
+		return
+	}
+
+	if len(key.PublicKey) == 0 {
+		public, private, err := ed25519.GenerateKey(rand.Reader)
+		if err != nil {
+			http.Error(w, "Cannot generate the signing key", http.StatusInternalServerError)
+			log.Errorf("Generate signing key: %v", err)
+			return
+		}
+
+		key.PublicKey = public
+		key.PrivateKey = private
+		key.Managed = true
+	} else {
+		public, err := usermodel.ParsePublicKey(key.PublicKey)
+		if err != nil {
+			http.Error(w, "Invalid public key given: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		key.PublicKey = public
+		key.PrivateKey = nil
+		key.Managed = false
+	}
+
+	key.UUID = uuid.New().String()
+	key.Username = owner.Username
+
+	if err = api_.store.CreateSigningKey(&key); err != nil {
+		http.Error(w, "Cannot create the signing key", http.StatusInternalServerError)
+		log.Errorf("Create signing key: %v", err)
+		return
+	}
+
+	w.WriteHeader(http.StatusCreated)
+	_ = json.NewEncoder(w).Encode(key)
+}
+
+// GetSigningKeys lists the signing keys of a user, without their private keys
+// Example request: GET /user/Jan/keys
+// Example response: [{"UUID": "0f7e7d0a-4c4e-4b8e-9a57-8b3b0e8e6f8c", "Username": "Jan", "Name": "release key",
+//                     "PublicKey": "3mlYecO4IzT51TGPpvWucNSCh1CBM0QTaLn73Y7GFO0=", "Managed": false}]
+func (api_ *API) GetSigningKeys(w http.ResponseWriter, r *http.Request) {
+	name, err := GetName(w, r)
+	if err != nil {
+		return
+	}
+
+	keys, err := api_.store.GetSigningKeysByUsername(name)
+	if err != nil {
+		http.Error(w, "Cannot get the signing keys", http.StatusInternalServerError)
+		log.Errorf("Get signing keys: %v", err)
+		return
+	}
+
+	_ = json.NewEncoder(w).Encode(keys)
+}
+
+// DeleteSigningKey deletes a signing key, the signatures made with it no longer count
+// Example request: DELETE /user/Jan/keys/0f7e7d0a-4c4e-4b8e-9a57-8b3b0e8e6f8c
+// Example response: Successfully deleted the signing key
+func (api_ *API) DeleteSigningKey(w http.ResponseWriter, r *http.Request) {
+	name, err := GetName(w, r)
+	if err != nil {
+		return
+	}
+
+	keyUUID, err := GetTag("uuid", w, r)
+	if err != nil {
+		return
+	}
+
+	key, err := api_.store.GetSigningKey(keyUUID)
+	if err != nil || key.Username != name {
+		http.Error(w, "Cannot find the signing key", http.StatusNotFound)
+		return
+	}
+
+	if err = api_.store.DeleteSigningKey(key); err != nil {
+		http.Error(w, "Cannot delete the signing key", http.StatusInternalServerError)
+		log.Errorf("Delete signing key: %v", err)
+		return
+	}
+
+	http.Error(w, "Successfully deleted the signing key", http.StatusOK)
+}
+
+// getSignedVersion finds the version in the URI. Besides the owner of the image, moderators and
+// administrators may sign it and see its signatures, so they can vouch for images they have checked.
+func (api_ *API) getSignedVersion(w http.ResponseWriter, r *http.Request) (*images.ImageModel, *images.Version,
+	error) {
+	uniqueID, err := GetTag("uuid", w, r)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	image, err := api_.store.GetImageByUUID(images.ImageUUID(uniqueID))
+	if err != nil {
+		http.Error(w, "Cannot find the image", http.StatusNotFound)
+		log.Errorf("Get image: %v", err)
+		return nil, nil, err
+	}
+
+	session, _ := api_.session.Get(r, "session-name")
+	username, _ := session.Values["Username"].(string)
+	role, _ := session.Values["Role"].(string)
+
+	if username != image.Username && !usermodel.UserRole(role).Includes(usermodel.Moderator) {
+		http.Error(w, "user does not own this image", http.StatusForbidden)
+		return nil, nil, errors.New("access denied")
+	}
+
+	number, err := strconv.ParseUint(mux.Vars(r)["version"], 10, 64)
+	if err != nil {
+		http.Error(w, "Invalid version given", http.StatusBadRequest)
+		return nil, nil, err
+	}
+
+	for i := range image.Versions {
+		if image.Versions[i].Version == number {
+			return image, &image.Versions[i], nil
+		}
+	}
+
+	http.Error(w, "Cannot find the version", http.StatusNotFound)
+	return nil, nil, errors.New("version not found")
+}
+
+// SignVersion signs a version of an image with a key of the requesting user. What is signed is the
+// images.SignedMessage of the version, which includes its digest. The control server signs with the keys
+// it manages, for other keys the signature is sent along and checked. Both raw ed25519 signatures and
+// legacy (minisign -l) minisign signatures are accepted, base64 encoded.
+// Example request: POST /image/87f58936-9540-4dad-aba6-253f06142166/5/signatures
+// Example body: {"Key": "0f7e7d0a-4c4e-4b8e-9a57-8b3b0e8e6f8c"}
+// Example response: {"KeyUUID": "0f7e7d0a-4c4e-4b8e-9a57-8b3b0e8e6f8c", "Signature": "kW5b0mJ1..."}
+func (api_ *API) SignVersion(w http.ResponseWriter, r *http.Request) {
+	_, version, err := api_.getSignedVersion(w, r)
+	if err != nil {
+		return
+	}
+
+	var request signRequest
+	if err = json.NewDecoder(r.Body).Decode(&request); err != nil {
+		http.Error(w, "Invalid signature given", http.StatusBadRequest)
+		log.Errorf("Invalid signature given: %v", err)
+		return
+	}
+
+	session, _ := api_.session.Get(r, "session-name")
+	username, _ := session.Values["Username"].(string)
+
+	key, err := api_.store.GetSigningKey(request.Key)
+	if err != nil || key.Username != username {
+		http.Error(w, "Cannot find the signing key", http.StatusNotFound)
+		return
+	}
+
+	if version.Digest == "" {
+		http.Error(w, "The version has no digest to sign", http.StatusConflict)
+		return
+	}
+
+	message := images.SignedMessage(version)
+	signature := request.Signature
+
+	switch {
+	case len(signature) == 0 && key.Managed:
+		signature = ed25519.Sign(key.PrivateKey, message)
+	case len(signature) == 0:
+		http.Error(w, "The control server does not have this key, send the signature along",
+			http.StatusBadRequest)
+		return
+	default:
+		signature, err = usermodel.ParseSignature(signature)
+		if err != nil {
+			http.Error(w, "Invalid signature given: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		if !key.Verify(message, signature) {
+			http.Error(w, "The signature does not match the version", http.StatusUnprocessableEntity)
+			return
+		}
+	}
+
+	stored := images.VersionSignature{VersionID: version.ID, KeyUUID: key.UUID, Signature: signature}
+	if err = api_.store.AddVersionSignature(&stored); err != nil {
+		http.Error(w, "Cannot store the signature", http.StatusInternalServerError)
+		log.Errorf("Store signature: %v", err)
+		return
+	}
+
+	w.WriteHeader(http.StatusCreated)
+	_ = json.NewEncoder(w).Encode(stored)
+}
+
+// GetVersionSignatures lists the signatures of a version of an image
+// Example request: GET /image/87f58936-9540-4dad-aba6-253f06142166/5/signatures
+// Example response: [{"KeyUUID": "0f7e7d0a-4c4e-4b8e-9a57-8b3b0e8e6f8c", "Signature": "kW5b0mJ1..."}]
+func (api_ *API) GetVersionSignatures(w http.ResponseWriter, r *http.Request) {
+	_, version, err := api_.getSignedVersion(w, r)
+	if err != nil {
+		return
+	}
+
+	signatures, err := api_.store.GetVersionSignatures(version.ID)
+	if err != nil {
+		http.Error(w, "Cannot get the signatures", http.StatusInternalServerError)
+		log.Errorf("Get signatures: %v", err)
+		return
+	}
+
+	_ = json.NewEncoder(w).Encode(signatures)
+}
+
+// checkSignaturePolicy checks that every version in the setup has a valid signature which counts under the
+// policy of the setup. The keys and roles of the signers are looked up again, so the signatures of deleted
+// keys and demoted moderators no longer count.
+func (api_ *API) checkSignaturePolicy(setup *images.ImageSetup) error {
+	if setup.SignaturePolicy == "" || setup.SignaturePolicy == images.SignaturePolicyNone {
+		return nil
+	}
+
+	for i := range setup.Images {
+		image := &setup.Images[i].Image
+		version := &setup.Images[i].Version
+
+		signed, err := api_.versionSigned(setup.SignaturePolicy, image, version)
+		if err != nil {
+			return err
+		}
+
+		if !signed {
+			return errors.Errorf("version %d of image %s is not signed as required by the %s policy",
+				version.Version, image.UUID, setup.SignaturePolicy)
+		}
+	}
+
+	return nil
+}
+
+// versionSigned checks whether one of the signatures of the version counts under the policy
+func (api_ *API) versionSigned(policy images.SignaturePolicy, image *images.ImageModel,
+	version *images.Version) (bool, error) {
+	if version.Digest == "" {
+		return false, nil
+	}
+
+	signatures, err := api_.store.GetVersionSignatures(version.ID)
+	if err != nil {
+		return false, errors.Wrap(err, "get signatures")
+	}
+
+	message := images.SignedMessage(version)
+	for _, signature := range signatures {
+		key, err := api_.store.GetSigningKey(signature.KeyUUID)
+		if err != nil {
+			continue
+		}
+
+		if api_.signerCounts(policy, image, key) && key.Verify(message, signature.Signature) {
+			return true, nil
+		}
+	}
+
+	return false, nil
+}
+
+// signerCounts checks whether the owner of the key is trusted to sign the image under the policy
+func (api_ *API) signerCounts(policy images.SignaturePolicy, image *images.ImageModel,
+	key *usermodel.SigningKeyModel) bool {
+	switch policy {
+	case images.SignaturePolicyOwner:
+		return key.Username == image.Username
+	case images.SignaturePolicyModerator:
+		signer, err := api_.store.GetUserByUsername(key.Username)
+		return err == nil && signer.Role.Includes(usermodel.Moderator)
+	default:
+		return false
+	}
+}
+
+// RegisterSigningHandlers sets the metadata for each of the routes and registers them to the global handler
+func (api_ *API) RegisterSigningHandlers() {
+	api_.Routes = append(api_.Routes, Route{
+		URI:         "/user/{name}/keys",
+		Permissions: []usermodel.UserRole{usermodel.Admin},
+		UserAllowed: true,
+		Handler:     api_.CreateSigningKey,
+		Method:      http.MethodPost,
+		Description: "Creates or registers a signing key",
+	})
+
+	api_.Routes = append(api_.Routes, Route{
+		URI:         "/user/{name}/keys",
+		Permissions: []usermodel.UserRole{usermodel.Admin},
+		UserAllowed: true,
+		Handler:     api_.GetSigningKeys,
+		Method:      http.MethodGet,
+		Description: "Gets the signing keys of a user",
+	})
+
+	api_.Routes = append(api_.Routes, Route{
+		URI:         "/user/{name}/keys/{uuid}",
+		Permissions: []usermodel.UserRole{usermodel.Admin},
+		UserAllowed: true,
+		Handler:     api_.DeleteSigningKey,
+		Method:      http.MethodDelete,
+		Description: "Deletes a signing key",
+	})
+
+	api_.Routes = append(api_.Routes, Route{
+		URI:         "/image/{uuid}/{version}/signatures",
+		Permissions: []usermodel.UserRole{usermodel.User, usermodel.Moderator, usermodel.Admin},
+		UserAllowed: true,
+		Handler:     api_.SignVersion,
+		Method:      http.MethodPost,
+		Description: "Signs a version of an image",
+	})
+
+	api_.Routes = append(api_.Routes, Route{
+		URI:         "/image/{uuid}/{version}/signatures",
+		Permissions: []usermodel.UserRole{usermodel.User, usermodel.Moderator, usermodel.Admin},
+		UserAllowed: true,
+		Handler:     api_.GetVersionSignatures,
+		Method:      http.MethodGet,
+		Description: "Gets the signatures of a version of an image",
+	})
+}
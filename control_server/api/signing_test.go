@@ -0,0 +1,227 @@
+// Copyright (c) 2020-2022 TU Delft & Valentijn van de Beek <v.d.vandebeek@student.tudelft.nl> All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package api
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/baas-project/baas/pkg/database"
+	"github.com/baas-project/baas/pkg/database/memory"
+	"github.com/baas-project/baas/pkg/model/images"
+	machinemodel "github.com/baas-project/baas/pkg/model/machine"
+	"github.com/baas-project/baas/pkg/model/user"
+	"github.com/baas-project/baas/pkg/storage"
+	"github.com/baas-project/baas/pkg/util"
+	"github.com/stretchr/testify/assert"
+)
+
+func signingRequest(t *testing.T, api *API, handler http.Handler, method string, uri string, body interface{},
+	username string, role user.UserRole) *httptest.ResponseRecorder {
+	var data []byte
+	if body != nil {
+		data, _ = json.Marshal(body)
+	}
+
+	resp := httptest.NewRecorder()
+	req := httptest.NewRequest(method, uri, bytes.NewReader(data))
+	loginAs(t, api, req, username, role)
+	handler.ServeHTTP(resp, req)
+
+	return resp
+}
+
+func setupSigningStore(t *testing.T) (database.Store, string) {
+	store := memory.NewStore()
+
+	for name, role := range map[string]user.UserRole{"test": user.User, "mod": user.Moderator, "other": user.User} {
+		err := store.CreateUser(&user.UserModel{Username: name, Name: name, Role: role})
+		assert.NoError(t, err)
+	}
+
+	mac := util.MacAddress{Address: "abc"}
+	err := store.UpdateMachine(&machinemodel.MachineModel{MacAddress: mac, Name: "abc", Architecture: machinemodel.X86_64})
+	assert.NoError(t, err)
+
+	token, err := util.GenerateToken()
+	assert.NoError(t, err)
+	assert.NoError(t, store.SetMachineToken(mac, util.HashToken(token)))
+
+	machineImage, err := images.CreateMachineImageModel(mac)
+	assert.NoError(t, err)
+	store.CreateMachineImage(machineImage)
+
+	store.CreateImage(&images.ImageModel{Name: "Fedora", UUID: "fedora", Username: "test"})
+	store.CreateNewImageVersion(images.Version{Version: 1, ImageModelUUID: "fedora", Digest: helloWorldDigest, Size: 11})
+
+	return store, token
+}
+
+func TestApi_SignVersion(t *testing.T) {
+	store, _ := setupSigningStore(t)
+	api := NewAPI(store, storage.NewMemory())
+	handler := api.handler("")
+
+	// A key generated by the control server signs on request
+	resp := signingRequest(t, api, handler, http.MethodPost, "/user/test/keys", user.SigningKeyModel{Name: "ci"},
+		"test", user.User)
+	assert.Equal(t, http.StatusCreated, resp.Code)
+
+	var managed user.SigningKeyModel
+	assert.NoError(t, json.NewDecoder(resp.Body).Decode(&managed))
+	assert.True(t, managed.Managed)
+	assert.Len(t, managed.PublicKey, ed25519.PublicKeySize)
+	assert.Empty(t, managed.PrivateKey)
+
+	resp = signingRequest(t, api, handler, http.MethodPost, "/image/fedora/1/signatures",
+		signRequest{Key: managed.UUID}, "test", user.User)
+	assert.Equal(t, http.StatusCreated, resp.Code)
+
+	// Versions without a digest cannot be signed
+	resp = signingRequest(t, api, handler, http.MethodPost, "/image/fedora/0/signatures",
+		signRequest{Key: managed.UUID}, "test", user.User)
+	assert.Equal(t, http.StatusConflict, resp.Code)
+
+	// Users cannot register keys for someone else
+	resp = signingRequest(t, api, handler, http.MethodPost, "/user/mod/keys", user.SigningKeyModel{}, "test",
+		user.User)
+	assert.Equal(t, http.StatusForbidden, resp.Code)
+
+	// The moderator keeps their own key and sends the signature
+	public, private, err := ed25519.GenerateKey(nil)
+	assert.NoError(t, err)
+
+	resp = signingRequest(t, api, handler, http.MethodPost, "/user/mod/keys",
+		user.SigningKeyModel{Name: "laptop", PublicKey: public}, "mod", user.Moderator)
+	assert.Equal(t, http.StatusCreated, resp.Code)
+
+	var own user.SigningKeyModel
+	assert.NoError(t, json.NewDecoder(resp.Body).Decode(&own))
+	assert.False(t, own.Managed)
+
+	image, err := store.GetImageByUUID("fedora")
+	assert.NoError(t, err)
+	message := images.SignedMessage(&image.Versions[1])
+
+	resp = signingRequest(t, api, handler, http.MethodPost, "/image/fedora/1/signatures",
+		signRequest{Key: own.UUID}, "mod", user.Moderator)
+	assert.Equal(t, http.StatusBadRequest, resp.Code)
+
+	resp = signingRequest(t, api, handler, http.MethodPost, "/image/fedora/1/signatures",
+		signRequest{Key: own.UUID, Signature: ed25519.Sign(private, []byte("something else"))}, "mod", user.Moderator)
+	assert.Equal(t, http.StatusUnprocessableEntity, resp.Code)
+
+	resp = signingRequest(t, api, handler, http.MethodPost, "/image/fedora/1/signatures",
+		signRequest{Key: own.UUID, Signature: ed25519.Sign(private, message)}, "mod", user.Moderator)
+	assert.Equal(t, http.StatusCreated, resp.Code)
+
+	// Keys can only be used by their owner
+	resp = signingRequest(t, api, handler, http.MethodPost, "/image/fedora/1/signatures",
+		signRequest{Key: own.UUID, Signature: ed25519.Sign(private, message)}, "test", user.User)
+	assert.Equal(t, http.StatusNotFound, resp.Code)
+
+	// Other users cannot sign the image
+	resp = signingRequest(t, api, handler, http.MethodGet, "/image/fedora/1/signatures", nil, "other", user.User)
+	assert.Equal(t, http.StatusForbidden, resp.Code)
+
+	resp = signingRequest(t, api, handler, http.MethodGet, "/image/fedora/1/signatures", nil, "test", user.User)
+	assert.Equal(t, http.StatusOK, resp.Code)
+
+	var signatures []images.VersionSignature
+	assert.NoError(t, json.NewDecoder(resp.Body).Decode(&signatures))
+	assert.Len(t, signatures, 2)
+}
+
+func TestApi_SignaturePolicy(t *testing.T) {
+	store, token := setupSigningStore(t)
+	api := NewAPI(store, storage.NewMemory())
+	handler := api.handler("")
+
+	image, err := store.GetImageByUUID("fedora")
+	assert.NoError(t, err)
+
+	err = store.CreateImageSetup("test", &images.ImageSetup{Name: "setup", Username: "test", UUID: "setup",
+		SignaturePolicy: images.SignaturePolicyOwner})
+	assert.NoError(t, err)
+
+	setup, err := store.GetImageSetup("setup")
+	assert.NoError(t, err)
+	store.AddImageToImageSetup(&setup, image, image.Versions[1], false)
+
+	inform := func() int {
+		resp := httptest.NewRecorder()
+		handler.ServeHTTP(resp, machineRequest(http.MethodGet, "/machine/abc/boot", "abc", token))
+		return resp.Code
+	}
+
+	boot := func() int {
+		err := store.AddBootSetupToMachine(&images.BootSetup{MachineMAC: "abc", SetupUUID: "setup"})
+		assert.NoError(t, err)
+		return inform()
+	}
+
+	assert.Equal(t, http.StatusForbidden, boot())
+
+	// A boot setup which is refused is taken off the queue as well
+	_, err = store.PeekBootSetup("abc")
+	assert.Error(t, err)
+
+	// A signature of someone else does not count for the owner policy
+	public, private, err := ed25519.GenerateKey(nil)
+	assert.NoError(t, err)
+
+	key := user.SigningKeyModel{UUID: "mod-key", Username: "mod", PublicKey: public}
+	assert.NoError(t, store.CreateSigningKey(&key))
+
+	err = store.AddVersionSignature(&images.VersionSignature{VersionID: image.Versions[1].ID, KeyUUID: key.UUID,
+		Signature: ed25519.Sign(private, images.SignedMessage(&image.Versions[1]))})
+	assert.NoError(t, err)
+
+	assert.Equal(t, http.StatusForbidden, boot())
+
+	// It does for the moderator policy
+	resp := signingRequest(t, api, handler, http.MethodPut, "/user/test/image_setup/setup",
+		images.ImageSetup{SignaturePolicy: images.SignaturePolicyModerator}, "test", user.User)
+	assert.Equal(t, http.StatusOK, resp.Code)
+	assert.Equal(t, http.StatusOK, boot())
+
+	// The boot setup is taken off the queue once it is handed out
+	_, err = store.PeekBootSetup("abc")
+	assert.Error(t, err)
+
+	// Until the key is deleted
+	assert.NoError(t, store.DeleteSigningKey(&key))
+	assert.Equal(t, http.StatusForbidden, boot())
+
+	resp = signingRequest(t, api, handler, http.MethodPut, "/user/test/image_setup/setup",
+		images.ImageSetup{SignaturePolicy: "anyone"}, "test", user.User)
+	assert.Equal(t, http.StatusBadRequest, resp.Code)
+
+	resp = signingRequest(t, api, handler, http.MethodPut, "/user/test/image_setup/setup",
+		images.ImageSetup{SignaturePolicy: images.SignaturePolicyNone}, "test", user.User)
+	assert.Equal(t, http.StatusOK, resp.Code)
+	assert.Equal(t, http.StatusOK, boot())
+
+	// The setup queued after a refused one still boots
+	resp = signingRequest(t, api, handler, http.MethodPut, "/user/test/image_setup/setup",
+		images.ImageSetup{SignaturePolicy: images.SignaturePolicyOwner}, "test", user.User)
+	assert.Equal(t, http.StatusOK, resp.Code)
+
+	err = store.CreateImageSetup("test", &images.ImageSetup{Name: "baseline", Username: "test", UUID: "baseline"})
+	assert.NoError(t, err)
+
+	assert.NoError(t, store.AddBootSetupToMachine(&images.BootSetup{MachineMAC: "abc", SetupUUID: "setup"}))
+	assert.NoError(t, store.AddBootSetupToMachine(&images.BootSetup{MachineMAC: "abc", SetupUUID: "baseline"}))
+
+	assert.Equal(t, http.StatusForbidden, inform())
+	assert.Equal(t, http.StatusOK, inform())
+
+	_, err = store.PeekBootSetup("abc")
+	assert.Error(t, err)
+}
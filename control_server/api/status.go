@@ -0,0 +1,149 @@
+// Copyright (c) 2020-2022 TU Delft & Valentijn van de Beek <v.d.vandebeek@student.tudelft.nl> All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package api
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"time"
+
+	machinemodel "github.com/baas-project/baas/pkg/model/machine"
+	"github.com/baas-project/baas/pkg/model/user"
+	"github.com/baas-project/baas/pkg/util"
+	"gorm.io/gorm"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// statusHistory is the number of statuses which are returned when the request does not ask for a number
+const statusHistory = 50
+
+// ReportStatus stores a status the management OS of a machine reports whenever it goes to another phase, or
+// finishes an image within one.
+// Example request: POST /machine/52:54:00:d9:71:93/status
+// Example body: {"Phase": "writing", "SetupUUID": "bd1e3f3c-8c4c-4a3e-a1b0-0e2ba1b1ee2f",
+//                "Image": "87f58936-9540-4dad-aba6-253f06142166", "Version": 5, "Completed": 1, "Total": 2,
+//                "Attempt": 1}
+// Example response: Status received
+func (api_ *API) ReportStatus(w http.ResponseWriter, r *http.Request) {
+	mac, err := GetTag("mac", w, r)
+	if err != nil {
+		return
+	}
+
+	var status machinemodel.StatusModel
+	if err = json.NewDecoder(r.Body).Decode(&status); err != nil {
+		http.Error(w, "Invalid status given", http.StatusBadRequest)
+		log.Errorf("Invalid status given: %v", err)
+		return
+	}
+
+	if !status.Phase.Valid() {
+		http.Error(w, "Unknown phase given", http.StatusBadRequest)
+		log.Errorf("Unknown phase given: %s", status.Phase)
+		return
+	}
+
+	if _, err = api_.store.GetMachineByMac(util.MacAddress{Address: mac}); err == gorm.ErrRecordNotFound {
+		http.Error(w, "Machine not found", http.StatusNotFound)
+		return
+	} else if err != nil {
+		http.Error(w, "Cannot find the machine", http.StatusInternalServerError)
+		log.Errorf("get machine by mac: %v", err)
+		return
+	}
+
+	status.MachineMAC = mac
+	status.Time = time.Now()
+	if err = api_.store.AddMachineStatus(&status); err != nil {
+		http.Error(w, "Cannot store the status", http.StatusInternalServerError)
+		log.Errorf("Store status: %v", err)
+		return
+	}
+
+	// A new boot starts over, the transfers of the previous one are done
+	if status.Phase == machinemodel.PhaseInitializing {
+		api_.progress.Reset(mac)
+	}
+
+	if status.Phase == machinemodel.PhaseFailed {
+		log.Errorf("Machine %s failed to provision setup %s: %s", mac, status.SetupUUID, status.Error)
+	} else {
+		log.Infof("Machine %s is %s", mac, status.Phase)
+	}
+
+	http.Error(w, "Status received", http.StatusOK)
+}
+
+// GetMachineStatus returns the latest status of the machine together with the statuses before it, so it shows
+// whether the last setup landed on the machine. The number of statuses can be set with limit, 50 by default.
+// Example request: GET /machine/52:54:00:d9:71:93/status?limit=2
+// Example response: {"Latest": {"Phase": "done", "SetupUUID": "bd1e3f3c-...", "Time": "2022-06-01T12:03:11Z"},
+//                    "History": [{"Phase": "finishing", ...}, {"Phase": "done", ...}]}
+func (api_ *API) GetMachineStatus(w http.ResponseWriter, r *http.Request) {
+	mac, err := GetTag("mac", w, r)
+	if err != nil {
+		return
+	}
+
+	limit := statusHistory
+	if value := r.URL.Query().Get("limit"); value != "" {
+		limit, err = strconv.Atoi(value)
+		if err != nil || limit < 1 {
+			http.Error(w, "Invalid limit given", http.StatusBadRequest)
+			return
+		}
+	}
+
+	if _, err = api_.store.GetMachineByMac(util.MacAddress{Address: mac}); err == gorm.ErrRecordNotFound {
+		http.Error(w, "Machine not found", http.StatusNotFound)
+		return
+	} else if err != nil {
+		http.Error(w, "Cannot find the machine", http.StatusInternalServerError)
+		log.Errorf("get machine by mac: %v", err)
+		return
+	}
+
+	statuses, err := api_.store.GetMachineStatuses(mac, limit)
+	if err != nil {
+		http.Error(w, "Cannot get the statuses", http.StatusInternalServerError)
+		log.Errorf("get machine statuses: %v", err)
+		return
+	}
+
+	status := machinemodel.MachineStatus{History: statuses}
+	if len(statuses) > 0 {
+		status.Latest = &statuses[len(statuses)-1]
+	}
+
+	if status.History == nil {
+		status.History = []machinemodel.StatusModel{}
+	}
+
+	_ = json.NewEncoder(w).Encode(status)
+}
+
+// RegisterStatusHandlers sets the metadata for each of the routes and registers them to the global handler
+func (api_ *API) RegisterStatusHandlers() {
+	api_.Routes = append(api_.Routes, Route{
+		URI:            "/machine/{mac}/status",
+		Permissions:    []user.UserRole{user.Admin},
+		UserAllowed:    false,
+		Handler:        api_.ReportStatus,
+		Method:         http.MethodPost,
+		Description:    "Reports the provisioning status of a machine",
+		MachineAllowed: true,
+	})
+
+	api_.Routes = append(api_.Routes, Route{
+		URI:         "/machine/{mac}/status",
+		Permissions: []user.UserRole{user.User, user.Moderator, user.Admin},
+		UserAllowed: true,
+		Handler:     api_.GetMachineStatus,
+		Method:      http.MethodGet,
+		Description: "Gets the provisioning status of a machine and its history",
+	})
+}
@@ -0,0 +1,84 @@
+// Copyright (c) 2020-2022 TU Delft & Valentijn van de Beek <v.d.vandebeek@student.tudelft.nl> All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package api
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	api_pkg "github.com/baas-project/baas/pkg/api"
+	machinemodel "github.com/baas-project/baas/pkg/model/machine"
+	"github.com/baas-project/baas/pkg/model/user"
+	"github.com/baas-project/baas/pkg/storage"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestApi_MachineStatus(t *testing.T) {
+	store, token := setupMachineStore(t)
+	api := NewAPI(store, storage.NewMemory())
+	handler := api.handler("")
+
+	report := func(mac string, body string) int {
+		resp := httptest.NewRecorder()
+		req := httptest.NewRequest(http.MethodPost, "/machine/"+mac+"/status", strings.NewReader(body))
+		req.Header.Add(api_pkg.MachineHeader, "abc")
+		req.Header.Add(api_pkg.MachineTokenHeader, token)
+		handler.ServeHTTP(resp, req)
+		return resp.Code
+	}
+
+	get := func(uri string) (int, machinemodel.MachineStatus) {
+		resp := httptest.NewRecorder()
+		req := httptest.NewRequest(http.MethodGet, uri, nil)
+		loginAs(t, api, req, "alice", user.User)
+		handler.ServeHTTP(resp, req)
+
+		var status machinemodel.MachineStatus
+		if resp.Code == http.StatusOK {
+			assert.NoError(t, json.NewDecoder(resp.Body).Decode(&status))
+		}
+
+		return resp.Code, status
+	}
+
+	code, status := get("/machine/abc/status")
+	assert.Equal(t, http.StatusOK, code)
+	assert.Nil(t, status.Latest)
+	assert.Empty(t, status.History)
+
+	assert.Equal(t, http.StatusOK, report("abc", `{"Phase": "initializing", "Attempt": 1}`))
+	assert.Equal(t, http.StatusOK, report("abc", `{"Phase": "writing", "SetupUUID": "setup", "Image": "fedora",
+		"Version": 3, "Completed": 0, "Total": 2, "Attempt": 1}`))
+	assert.Equal(t, http.StatusOK, report("abc", `{"Phase": "failed", "SetupUUID": "setup", "Error": "no room"}`))
+
+	// A machine only reports about itself, and only with the phases which exist
+	assert.Equal(t, http.StatusForbidden, report("cba", `{"Phase": "done"}`))
+	assert.Equal(t, http.StatusBadRequest, report("abc", `{"Phase": "sleeping"}`))
+	assert.Equal(t, http.StatusBadRequest, report("abc", `{"Phase": `))
+
+	code, status = get("/machine/abc/status")
+	assert.Equal(t, http.StatusOK, code)
+	assert.Len(t, status.History, 3)
+	assert.Equal(t, machinemodel.PhaseInitializing, status.History[0].Phase)
+	assert.Equal(t, "fedora", status.History[1].Image)
+	assert.Equal(t, 2, status.History[1].Total)
+	assert.Equal(t, machinemodel.PhaseFailed, status.Latest.Phase)
+	assert.Equal(t, "no room", status.Latest.Error)
+	assert.False(t, status.Latest.Time.IsZero())
+
+	code, status = get("/machine/abc/status?limit=1")
+	assert.Equal(t, http.StatusOK, code)
+	assert.Len(t, status.History, 1)
+	assert.Equal(t, machinemodel.PhaseFailed, status.History[0].Phase)
+
+	code, _ = get("/machine/abc/status?limit=none")
+	assert.Equal(t, http.StatusBadRequest, code)
+
+	code, _ = get("/machine/unknown/status")
+	assert.Equal(t, http.StatusNotFound, code)
+}
@@ -0,0 +1,240 @@
+// Copyright (c) 2020-2022 TU Delft & Valentijn van de Beek <v.d.vandebeek@student.tudelft.nl> All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package api
+
+import (
+	"encoding/json"
+	"net/http"
+	"time"
+
+	"github.com/baas-project/baas/pkg/database"
+	usermodel "github.com/baas-project/baas/pkg/model/user"
+	"github.com/baas-project/baas/pkg/util"
+	"github.com/google/uuid"
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// bearerPrefix precedes the personal access token in the Authorization header
+	bearerPrefix = "Bearer "
+	// accessTokenPrefix makes personal access tokens easy to recognise, for example by secret scanners
+	accessTokenPrefix = "baas_"
+	// defaultTokenLifetime is used when no expiry is given for a new personal access token
+	defaultTokenLifetime = 30 * 24 * time.Hour
+)
+
+// accessTokenResponse is sent when a token is created, this is the only time the token itself is shown.
+type accessTokenResponse struct {
+	usermodel.AccessTokenModel
+	Token string
+}
+
+// authenticateToken checks the personal access token and, if it is valid, logs in the request as its owner.
+// The session is not saved, so no cookie is handed out for it.
+func (api_ *API) authenticateToken(r *http.Request, secret string) bool {
+	token, err := api_.store.GetAccessTokenByHash(util.HashToken(secret))
+	if err != nil {
+		return false
+	}
+
+	now := time.Now()
+	if token.Expired(now) {
+		return false
+	}
+
+	owner, err := api_.store.GetUserByUsername(token.Username)
+	if err != nil {
+		return false
+	}
+
+	// The owner may have been demoted since the token was created
+	role := token.Role
+	if !owner.Role.Includes(role) {
+		role = owner.Role
+	}
+
+	if err = api_.store.TouchAccessToken(token, now); err != nil {
+		log.Warnf("Cannot update the last use of access token %s: %v", token.UUID, err)
+	}
+
+	session, _ := api_.session.Get(r, "session-name")
+	session.Values["Username"] = owner.Username
+	session.Values["Role"] = string(role)
+
+	return true
+}
+
+// IssueAccessToken generates the secret of the token and stores the token, the secret is returned
+// because only its hash is kept. The caller is responsible for checking the role and expiry.
+func IssueAccessToken(store database.Store, token *usermodel.AccessTokenModel) (string, error) {
+	secret, err := util.GenerateToken()
+	if err != nil {
+		return "", errors.Wrap(err, "generate access token")
+	}
+	secret = accessTokenPrefix + secret
+
+	token.UUID = uuid.New().String()
+	token.TokenHash = util.HashToken(secret)
+	token.LastUsed = nil
+
+	return secret, store.CreateAccessToken(token)
+}
+
+// CreateAccessToken creates a personal access token for scripted use of the API.
+// The role of the token defaults to that of the user and may not exceed it.
+// Example request: POST /user/Jan/tokens
+// Example body: {"Name": "CI pipeline", "Role": "user", "ExpiresAt": "2022-12-31T00:00:00+01:00"}
+// Example response: {"UUID": "5e0a4a5c-2f6e-4d02-9f4b-c4e1b4f9e4a1", "Username": "Jan", "Name": "CI pipeline",
+//                    "Role": "user", "ExpiresAt": "2022-12-31T00:00:00+01:00", "LastUsed": null,
+//                    "Token": "baas_4d9c0b6c..."}
+func (api_ *API) CreateAccessToken(w http.ResponseWriter, r *http.Request) {
+	name, err := GetName(w, r)
+	if err != nil {
+		return
+	}
+
+	owner, err := api_.store.GetUserByUsername(name)
+	if err != nil {
+		http.Error(w, "Cannot find the user", http.StatusNotFound)
+		log.Errorf("Create access token for unknown user %s: %v", name, err)
+		return
+	}
+
+	var token usermodel.AccessTokenModel
+	if err = json.NewDecoder(r.Body).Decode(&token); err != nil {
+		http.Error(w, "Invalid access token given", http.StatusBadRequest)
+		log.Errorf("Invalid access token given: %v", err)
+		return
+	}
+
+	session, _ := api_.session.Get(r, "session-name")
+	requester, _ := session.Values["Role"].(string)
+	requesterRole := usermodel.UserRole(requester)
+
+	if token.Role == "" {
+		token.Role = owner.Role
+		if !requesterRole.Includes(token.Role) {
+			token.Role = requesterRole
+		}
+	}
+
+	// Neither the owner nor the one creating the token may gain permissions this way
+	if !owner.Role.Includes(token.Role) || !requesterRole.Includes(token.Role) {
+		http.Error(w, "The token cannot have more permissions than its user", http.StatusForbidden)
+		return
+	}
+
+	now := time.Now()
+	if token.ExpiresAt.IsZero() {
+		token.ExpiresAt = now.Add(defaultTokenLifetime)
+	}
+
+	if token.Expired(now) {
+		http.Error(w, "The token should expire in the future", http.StatusBadRequest)
+		return
+	}
+
+	token.Username = owner.Username
+	secret, err := IssueAccessToken(api_.store, &token)
+	if err != nil {
+		http.Error(w, "Cannot create the access token", http.StatusInternalServerError)
+		log.Errorf("Create access token: %v", err)
+		return
+	}
+
+	w.WriteHeader(http.StatusCreated)
+	_ = json.NewEncoder(w).Encode(accessTokenResponse{token, secret})
+}
+
+// GetAccessTokens lists the personal access tokens of a user, without the tokens themselves
+// Example request: GET /user/Jan/tokens
+// Example response: [{"UUID": "5e0a4a5c-2f6e-4d02-9f4b-c4e1b4f9e4a1", "Username": "Jan", "Name": "CI pipeline",
+//                     "Role": "user", "ExpiresAt": "2022-12-31T00:00:00+01:00",
+//                     "LastUsed": "2022-06-01T09:00:00+02:00"}]
+func (api_ *API) GetAccessTokens(w http.ResponseWriter, r *http.Request) {
+	name, err := GetName(w, r)
+	if err != nil {
+		return
+	}
+
+	tokens, err := api_.store.GetAccessTokensByUsername(name)
+	if err != nil {
+		http.Error(w, "Cannot get the access tokens", http.StatusInternalServerError)
+		log.Errorf("Get access tokens: %v", err)
+		return
+	}
+
+	_ = json.NewEncoder(w).Encode(tokens)
+}
+
+// RevokeAccessToken deletes a personal access token so it can no longer be used
+// Example request: DELETE /user/Jan/tokens/5e0a4a5c-2f6e-4d02-9f4b-c4e1b4f9e4a1
+// Example response: Successfully revoked the access token
+func (api_ *API) RevokeAccessToken(w http.ResponseWriter, r *http.Request) {
+	name, err := GetName(w, r)
+	if err != nil {
+		return
+	}
+
+	tokenUUID, err := GetTag("uuid", w, r)
+	if err != nil {
+		return
+	}
+
+	tokens, err := api_.store.GetAccessTokensByUsername(name)
+	if err != nil {
+		http.Error(w, "Cannot get the access tokens", http.StatusInternalServerError)
+		log.Errorf("Get access tokens: %v", err)
+		return
+	}
+
+	for i := range tokens {
+		if tokens[i].UUID != tokenUUID {
+			continue
+		}
+
+		if err = api_.store.DeleteAccessToken(&tokens[i]); err != nil {
+			http.Error(w, "Cannot revoke the access token", http.StatusInternalServerError)
+			log.Errorf("Revoke access token: %v", err)
+			return
+		}
+
+		http.Error(w, "Successfully revoked the access token", http.StatusOK)
+		return
+	}
+
+	http.Error(w, "Cannot find the access token", http.StatusNotFound)
+}
+
+// RegisterAccessTokenHandlers sets the metadata for each of the routes and registers them to the global handler
+func (api_ *API) RegisterAccessTokenHandlers() {
+	api_.Routes = append(api_.Routes, Route{
+		URI:         "/user/{name}/tokens",
+		Permissions: []usermodel.UserRole{usermodel.Admin},
+		UserAllowed: true,
+		Handler:     api_.CreateAccessToken,
+		Method:      http.MethodPost,
+		Description: "Creates a personal access token",
+	})
+
+	api_.Routes = append(api_.Routes, Route{
+		URI:         "/user/{name}/tokens",
+		Permissions: []usermodel.UserRole{usermodel.Admin},
+		UserAllowed: true,
+		Handler:     api_.GetAccessTokens,
+		Method:      http.MethodGet,
+		Description: "Gets the personal access tokens of a user",
+	})
+
+	api_.Routes = append(api_.Routes, Route{
+		URI:         "/user/{name}/tokens/{uuid}",
+		Permissions: []usermodel.UserRole{usermodel.Admin},
+		UserAllowed: true,
+		Handler:     api_.RevokeAccessToken,
+		Method:      http.MethodDelete,
+		Description: "Revokes a personal access token",
+	})
+}
@@ -0,0 +1,133 @@
+// Copyright (c) 2020-2022 TU Delft & Valentijn van de Beek <v.d.vandebeek@student.tudelft.nl> All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package api
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/baas-project/baas/pkg/database/sqlite"
+	"github.com/baas-project/baas/pkg/model/user"
+	"github.com/baas-project/baas/pkg/storage"
+	"github.com/stretchr/testify/assert"
+)
+
+func createAccessToken(t *testing.T, api *API, handler http.Handler, token user.AccessTokenModel) *httptest.ResponseRecorder {
+	var body bytes.Buffer
+	_ = json.NewEncoder(&body).Encode(token)
+
+	resp := httptest.NewRecorder()
+	req := httptest.NewRequest(http.MethodPost, "/user/test/tokens", &body)
+	loginAs(t, api, req, "test", user.User)
+	req.Header.Add("origin", "http://localhost:9090")
+	handler.ServeHTTP(resp, req)
+
+	return resp
+}
+
+func bearerRequest(method string, uri string, token string) *http.Request {
+	req := httptest.NewRequest(method, uri, nil)
+	req.Header.Add("origin", "http://localhost:9090")
+	req.Header.Add("Authorization", "Bearer "+token)
+
+	return req
+}
+
+func TestApi_AccessToken(t *testing.T) {
+	store, err := sqlite.NewSqliteStore(sqlite.InMemoryPath)
+	assert.NoError(t, err)
+
+	err = store.CreateUser(&user.UserModel{Username: "test", Name: "Test", Email: "test@example.com", Role: user.User})
+	assert.NoError(t, err)
+
+	api := NewAPI(store, storage.NewMemory())
+	handler := api.handler("")
+
+	resp := createAccessToken(t, api, handler, user.AccessTokenModel{Name: "ci"})
+	assert.Equal(t, http.StatusCreated, resp.Code)
+
+	var created accessTokenResponse
+	err = json.NewDecoder(resp.Body).Decode(&created)
+	assert.NoError(t, err)
+	assert.NotEmpty(t, created.Token)
+	assert.Equal(t, user.User, created.Role)
+	assert.True(t, created.ExpiresAt.After(time.Now()))
+
+	// The token logs the request in as its owner
+	resp = httptest.NewRecorder()
+	handler.ServeHTTP(resp, bearerRequest(http.MethodGet, "/user/me", created.Token))
+	assert.Equal(t, http.StatusOK, resp.Code)
+
+	var me user.UserModel
+	err = json.NewDecoder(resp.Body).Decode(&me)
+	assert.NoError(t, err)
+	assert.Equal(t, "test", me.Username)
+
+	tokens, err := store.GetAccessTokensByUsername("test")
+	assert.NoError(t, err)
+	assert.Len(t, tokens, 1)
+	assert.NotNil(t, tokens[0].LastUsed)
+
+	// But only as long as it is not revoked
+	resp = httptest.NewRecorder()
+	handler.ServeHTTP(resp, bearerRequest(http.MethodDelete, "/user/test/tokens/"+created.UUID, created.Token))
+	assert.Equal(t, http.StatusOK, resp.Code)
+
+	resp = httptest.NewRecorder()
+	handler.ServeHTTP(resp, bearerRequest(http.MethodGet, "/user/me", created.Token))
+	assert.Equal(t, http.StatusUnauthorized, resp.Code)
+}
+
+func TestApi_AccessTokenLimits(t *testing.T) {
+	store, err := sqlite.NewSqliteStore(sqlite.InMemoryPath)
+	assert.NoError(t, err)
+
+	err = store.CreateUser(&user.UserModel{Username: "test", Name: "Test", Email: "test@example.com", Role: user.User})
+	assert.NoError(t, err)
+
+	api := NewAPI(store, storage.NewMemory())
+	handler := api.handler("")
+
+	// Users cannot give themselves more permissions with a token
+	resp := createAccessToken(t, api, handler, user.AccessTokenModel{Name: "ci", Role: user.Admin})
+	assert.Equal(t, http.StatusForbidden, resp.Code)
+
+	resp = createAccessToken(t, api, handler, user.AccessTokenModel{Name: "ci", ExpiresAt: time.Now().Add(-time.Hour)})
+	assert.Equal(t, http.StatusBadRequest, resp.Code)
+
+	// Expired tokens are refused
+	resp = createAccessToken(t, api, handler, user.AccessTokenModel{Name: "ci", ExpiresAt: time.Now().Add(time.Hour)})
+	assert.Equal(t, http.StatusCreated, resp.Code)
+
+	var created accessTokenResponse
+	err = json.NewDecoder(resp.Body).Decode(&created)
+	assert.NoError(t, err)
+
+	tokens, err := store.GetAccessTokensByUsername("test")
+	assert.NoError(t, err)
+	assert.Len(t, tokens, 1)
+
+	// Recreate the token with an expiry in the past
+	err = store.DeleteAccessToken(&tokens[0])
+	assert.NoError(t, err)
+
+	tokens[0].ID = 0
+	tokens[0].ExpiresAt = time.Now().Add(-time.Minute)
+	err = store.CreateAccessToken(&tokens[0])
+	assert.NoError(t, err)
+
+	resp = httptest.NewRecorder()
+	handler.ServeHTTP(resp, bearerRequest(http.MethodGet, "/user/me", created.Token))
+	assert.Equal(t, http.StatusUnauthorized, resp.Code)
+
+	// As are tokens which were never issued
+	resp = httptest.NewRecorder()
+	handler.ServeHTTP(resp, bearerRequest(http.MethodGet, "/users", "baas_invalid"))
+	assert.Equal(t, http.StatusUnauthorized, resp.Code)
+}
@@ -0,0 +1,174 @@
+// Copyright (c) 2020-2022 TU Delft & Valentijn van de Beek <v.d.vandebeek@student.tudelft.nl> All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package api
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+
+	"github.com/baas-project/baas/control_server/transcode"
+	"github.com/baas-project/baas/pkg/model/images"
+	"github.com/baas-project/baas/pkg/model/user"
+	"github.com/baas-project/baas/pkg/storage"
+	"github.com/gorilla/mux"
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+)
+
+// TranscodeImage re-encodes every version of the image with another compression strategy or level in the
+// background. The compression of the image is changed once all versions are done.
+// Example request: POST /image/87f58936-9540-4dad-aba6-253f06142166/transcode
+// Example body: {"Strategy": "zstd", "Level": 19}
+// Example response: {"Image": "87f58936-9540-4dad-aba6-253f06142166", "Target": {"Strategy": "zstd", "Level": 19},
+//                    "RawOnly": false, "State": "running", "Versions": 3, "Transcoded": 0, "Skipped": 0,
+//                    "BytesBefore": 0, "BytesAfter": 0, "Started": "2022-01-01T12:00:00+01:00"}
+func (api_ *API) TranscodeImage(w http.ResponseWriter, r *http.Request) {
+	image, err := api_.checkUserImage(w, r)
+	if err != nil {
+		return
+	}
+
+	var target transcode.Target
+	if err = json.NewDecoder(r.Body).Decode(&target); err != nil {
+		http.Error(w, "Invalid compression given", http.StatusBadRequest)
+		log.Errorf("Invalid compression given: %v", err)
+		return
+	}
+
+	if err = target.Check(); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		log.Errorf("Invalid compression given: %v", err)
+		return
+	}
+
+	job, err := api_.transcoder.Start(image.UUID, target, false)
+	if err == transcode.ErrBusy {
+		http.Error(w, "The image is already being transcoded", http.StatusConflict)
+		return
+	} else if err != nil {
+		http.Error(w, "Cannot transcode the image", http.StatusInternalServerError)
+		log.Errorf("Transcode image %s: %v", image.UUID, err)
+		return
+	}
+
+	w.WriteHeader(http.StatusAccepted)
+	_ = json.NewEncoder(w).Encode(job.Status())
+}
+
+// GetTranscodeStatus reports how far the last transcoding of the image has come
+// Example request: GET /image/87f58936-9540-4dad-aba6-253f06142166/transcode
+// Example response: {"Image": "87f58936-9540-4dad-aba6-253f06142166", "Target": {"Strategy": "zstd", "Level": 19},
+//                    "RawOnly": false, "State": "done", "Versions": 3, "Transcoded": 3, "Skipped": 0,
+//                    "BytesBefore": 1610612736, "BytesAfter": 402653184, "Started": "2022-01-01T12:00:00+01:00",
+//                    "Finished": "2022-01-01T12:03:00+01:00"}
+func (api_ *API) GetTranscodeStatus(w http.ResponseWriter, r *http.Request) {
+	image, err := api_.checkUserImage(w, r)
+	if err != nil {
+		return
+	}
+
+	job := api_.transcoder.Job(image.UUID)
+	if job == nil {
+		http.Error(w, "The image has not been transcoded", http.StatusNotFound)
+		return
+	}
+
+	_ = json.NewEncoder(w).Encode(job.Status())
+}
+
+// convertRequest is the type of disk image a version is converted to
+type convertRequest struct {
+	Type string
+}
+
+// ConvertVersion rewrites a version of the image as another type of disk image: raw, qcow2 or sparse. The disk
+// in the version and therefore its digest stay the same, the file keeps its compression.
+// Example request: POST /image/87f58936-9540-4dad-aba6-253f06142166/3/convert
+// Example body: {"Type": "qcow2"}
+// Example response: {"Image": "87f58936-9540-4dad-aba6-253f06142166", "Version": 3, "From": "raw", "To": "qcow2",
+//                    "Compression": "zstd", "BytesBefore": 402653184, "BytesAfter": 398458880}
+func (api_ *API) ConvertVersion(w http.ResponseWriter, r *http.Request) {
+	image, err := api_.checkUserImage(w, r)
+	if err != nil {
+		return
+	}
+
+	number, err := strconv.ParseUint(mux.Vars(r)["version"], 10, 64)
+	if err != nil {
+		http.Error(w, "Invalid version given", http.StatusBadRequest)
+		return
+	}
+
+	var request convertRequest
+	if err = json.NewDecoder(r.Body).Decode(&request); err != nil {
+		http.Error(w, "Invalid disk type given", http.StatusBadRequest)
+		log.Errorf("Invalid disk type given: %v", err)
+		return
+	}
+
+	diskType, err := images.ParseDiskType(request.Type)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	var version *images.Version
+	for i := range image.Versions {
+		if image.Versions[i].Version == number {
+			version = &image.Versions[i]
+		}
+	}
+
+	if version == nil {
+		http.Error(w, "Cannot find the version", http.StatusNotFound)
+		return
+	}
+
+	conversion, err := api_.transcoder.Convert(image.UUID, *version, diskType)
+	if err == transcode.ErrBusy {
+		http.Error(w, "The image is being transcoded", http.StatusConflict)
+		return
+	} else if errors.Cause(err) == storage.ErrNotFound {
+		http.Error(w, "The version does not have a file", http.StatusNotFound)
+		return
+	} else if err != nil {
+		http.Error(w, "Cannot convert the version", http.StatusInternalServerError)
+		log.Errorf("Convert version %d of image %s: %v", number, image.UUID, err)
+		return
+	}
+
+	_ = json.NewEncoder(w).Encode(conversion)
+}
+
+// RegisterTranscodeHandlers sets the metadata for each of the routes and registers them to the global handler
+func (api_ *API) RegisterTranscodeHandlers() {
+	api_.Routes = append(api_.Routes, Route{
+		URI:         "/image/{uuid}/transcode",
+		Permissions: []user.UserRole{user.User, user.Moderator, user.Admin},
+		UserAllowed: true,
+		Handler:     api_.TranscodeImage,
+		Method:      http.MethodPost,
+		Description: "Re-encodes the versions of an image with another compression",
+	})
+
+	api_.Routes = append(api_.Routes, Route{
+		URI:         "/image/{uuid}/transcode",
+		Permissions: []user.UserRole{user.User, user.Moderator, user.Admin},
+		UserAllowed: true,
+		Handler:     api_.GetTranscodeStatus,
+		Method:      http.MethodGet,
+		Description: "Reports how far the transcoding of an image has come",
+	})
+
+	api_.Routes = append(api_.Routes, Route{
+		URI:         "/image/{uuid}/{version}/convert",
+		Permissions: []user.UserRole{user.User, user.Moderator, user.Admin},
+		UserAllowed: true,
+		Handler:     api_.ConvertVersion,
+		Method:      http.MethodPost,
+		Description: "Converts a version of an image to another type of disk image",
+	})
+}
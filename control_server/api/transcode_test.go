@@ -0,0 +1,202 @@
+// Copyright (c) 2020-2022 TU Delft & Valentijn van de Beek <v.d.vandebeek@student.tudelft.nl> All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package api
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/baas-project/baas/control_server/transcode"
+	"github.com/baas-project/baas/pkg/database/memory"
+	"github.com/baas-project/baas/pkg/model/images"
+	"github.com/baas-project/baas/pkg/model/user"
+	"github.com/baas-project/baas/pkg/storage"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestApi_Transcode(t *testing.T) {
+	store := memory.NewStore()
+	files := storage.NewMemory()
+
+	err := store.CreateUser(&user.UserModel{Username: "test", Role: user.User})
+	assert.NoError(t, err)
+	store.CreateImage(&images.ImageModel{Name: "Fedora", UUID: "fedora", Username: "test",
+		DiskCompressionStrategy: images.DiskCompressionStrategyNone})
+	assert.NoError(t, files.Create("fedora", storage.VersionFile(0), 1024))
+
+	api := NewAPI(store, files)
+	handler := api.handler("")
+
+	// Nothing to report before the first job
+	resp := httptest.NewRecorder()
+	req := httptest.NewRequest(http.MethodGet, "/image/fedora/transcode", nil)
+	loginAs(t, api, req, "test", user.User)
+	handler.ServeHTTP(resp, req)
+	assert.Equal(t, http.StatusNotFound, resp.Code)
+
+	for _, body := range []string{`{"Strategy": "bzip2"}`, `{"Strategy": "gzip", "Level": 12}`, `{`} {
+		resp = httptest.NewRecorder()
+		req = httptest.NewRequest(http.MethodPost, "/image/fedora/transcode", strings.NewReader(body))
+		loginAs(t, api, req, "test", user.User)
+		handler.ServeHTTP(resp, req)
+		assert.Equal(t, http.StatusBadRequest, resp.Code, body)
+	}
+
+	// Only the owner may transcode the image
+	resp = httptest.NewRecorder()
+	req = httptest.NewRequest(http.MethodPost, "/image/fedora/transcode", strings.NewReader(`{"Strategy": "zstd"}`))
+	loginAs(t, api, req, "other", user.User)
+	handler.ServeHTTP(resp, req)
+	assert.Equal(t, http.StatusForbidden, resp.Code)
+
+	resp = httptest.NewRecorder()
+	req = httptest.NewRequest(http.MethodPost, "/image/fedora/transcode",
+		strings.NewReader(`{"Strategy": "zstd", "Level": 19}`))
+	loginAs(t, api, req, "test", user.User)
+	handler.ServeHTTP(resp, req)
+	assert.Equal(t, http.StatusAccepted, resp.Code)
+
+	var status transcode.Status
+	err = json.NewDecoder(resp.Body).Decode(&status)
+	assert.NoError(t, err)
+	assert.Equal(t, transcode.Target{Strategy: images.DiskCompressionStrategyZSTD, Level: 19}, status.Target)
+
+	api.transcoder.Job("fedora").Wait()
+
+	resp = httptest.NewRecorder()
+	req = httptest.NewRequest(http.MethodGet, "/image/fedora/transcode", nil)
+	loginAs(t, api, req, "test", user.User)
+	handler.ServeHTTP(resp, req)
+	assert.Equal(t, http.StatusOK, resp.Code)
+
+	err = json.NewDecoder(resp.Body).Decode(&status)
+	assert.NoError(t, err)
+	assert.Equal(t, transcode.Done, status.State)
+	assert.Equal(t, 1, status.Transcoded)
+	assert.Equal(t, int64(1024), status.BytesBefore)
+
+	image, err := store.GetImageByUUID("fedora")
+	assert.NoError(t, err)
+	assert.Equal(t, images.DiskCompressionStrategy(images.DiskCompressionStrategyZSTD), image.DiskCompressionStrategy)
+}
+
+func TestApi_ConvertVersion(t *testing.T) {
+	store := memory.NewStore()
+	files := storage.NewMemory()
+
+	err := store.CreateUser(&user.UserModel{Username: "test", Role: user.User})
+	assert.NoError(t, err)
+	store.CreateImage(&images.ImageModel{Name: "Fedora", UUID: "fedora", Username: "test",
+		DiskCompressionStrategy: images.DiskCompressionStrategyNone})
+
+	w, err := files.Write("fedora", storage.VersionFile(1))
+	assert.NoError(t, err)
+	_, err = w.Write([]byte("hello world"))
+	assert.NoError(t, err)
+	assert.NoError(t, w.Close())
+
+	api := NewAPI(store, files)
+	handler := api.handler("")
+
+	image, err := store.GetImageByUUID("fedora")
+	assert.NoError(t, err)
+
+	version, err := store.CreateNextImageVersion(image.UUID)
+	assert.NoError(t, err)
+	assert.NoError(t, api.storeVersion(image, version))
+
+	for uri, code := range map[string]int{
+		"/image/fedora/1/convert": http.StatusBadRequest,
+		"/image/fedora/2/convert": http.StatusNotFound,
+		"/image/fedora/x/convert": http.StatusBadRequest,
+	} {
+		body := `{"Type": "vmdk"}`
+		if code != http.StatusBadRequest {
+			body = `{"Type": "qcow2"}`
+		}
+
+		resp := httptest.NewRecorder()
+		req := httptest.NewRequest(http.MethodPost, uri, strings.NewReader(body))
+		loginAs(t, api, req, "test", user.User)
+		handler.ServeHTTP(resp, req)
+		assert.Equal(t, code, resp.Code, uri)
+	}
+
+	resp := httptest.NewRecorder()
+	req := httptest.NewRequest(http.MethodPost, "/image/fedora/1/convert", strings.NewReader(`{"Type": "qcow2"}`))
+	loginAs(t, api, req, "other", user.User)
+	handler.ServeHTTP(resp, req)
+	assert.Equal(t, http.StatusForbidden, resp.Code)
+
+	resp = httptest.NewRecorder()
+	req = httptest.NewRequest(http.MethodPost, "/image/fedora/1/convert", strings.NewReader(`{"Type": "qcow2"}`))
+	loginAs(t, api, req, "test", user.User)
+	handler.ServeHTTP(resp, req)
+	assert.Equal(t, http.StatusOK, resp.Code)
+
+	var conversion transcode.Conversion
+	err = json.NewDecoder(resp.Body).Decode(&conversion)
+	assert.NoError(t, err)
+	assert.Equal(t, images.DiskTypeRaw, conversion.From)
+	assert.Equal(t, images.DiskTypeQCow2, conversion.To)
+
+	contents, err := inspectVersion(files, "fedora", 1)
+	assert.NoError(t, err)
+	assert.Equal(t, images.DiskTypeQCow2, contents.Type)
+	assert.Equal(t, helloWorldDigest, contents.Digest)
+
+	image, err = store.GetImageByUUID("fedora")
+	assert.NoError(t, err)
+	assert.Equal(t, images.DiskTypeQCow2, image.ImageFileType)
+
+	// Eleven bytes are not a whole sector
+	resp = httptest.NewRecorder()
+	req = httptest.NewRequest(http.MethodPost, "/image/fedora/1/convert", strings.NewReader(`{"Type": "sparse"}`))
+	loginAs(t, api, req, "test", user.User)
+	handler.ServeHTTP(resp, req)
+	assert.Equal(t, http.StatusInternalServerError, resp.Code)
+}
+
+func TestApi_DefaultCompression(t *testing.T) {
+	store := memory.NewStore()
+	files := storage.NewMemory()
+
+	store.CreateImage(&images.ImageModel{Name: "Fedora", UUID: "fedora", Username: "test",
+		DiskCompressionStrategy: images.DiskCompressionStrategyNone})
+
+	w, err := files.Write("fedora", storage.VersionFile(1))
+	assert.NoError(t, err)
+	_, err = w.Write([]byte("hello world"))
+	assert.NoError(t, err)
+	assert.NoError(t, w.Close())
+
+	api := NewAPI(store, files)
+	api.DefaultCompression = transcode.Target{Strategy: images.DiskCompressionStrategyZSTD}
+
+	image, err := store.GetImageByUUID("fedora")
+	assert.NoError(t, err)
+
+	version, err := store.CreateNextImageVersion(image.UUID)
+	assert.NoError(t, err)
+	assert.NoError(t, api.storeVersion(image, version))
+
+	status := api.transcoder.Job("fedora").Wait()
+	assert.Equal(t, transcode.Done, status.State)
+
+	// The raw upload is compressed, its digest is still the one of what ends up on the disk
+	contents, err := inspectVersion(files, "fedora", 1)
+	assert.NoError(t, err)
+	assert.Equal(t, helloWorldDigest, contents.Digest)
+	assert.Equal(t, images.DiskCompressionStrategy(images.DiskCompressionStrategyZSTD), contents.Compression)
+
+	// The image keeps the compression it was given, the uploads still get it
+	image, err = store.GetImageByUUID("fedora")
+	assert.NoError(t, err)
+	assert.Equal(t, images.DiskCompressionStrategy(images.DiskCompressionStrategyNone), image.DiskCompressionStrategy)
+	assert.Equal(t, helloWorldDigest, image.Versions[1].Digest)
+}
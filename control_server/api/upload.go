@@ -0,0 +1,351 @@
+// Copyright (c) 2020-2022 TU Delft & Valentijn van de Beek <v.d.vandebeek@student.tudelft.nl> All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package api
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+
+	api_pkg "github.com/baas-project/baas/pkg/api"
+	"github.com/baas-project/baas/pkg/blockmap"
+	"github.com/baas-project/baas/pkg/model/images"
+	"github.com/baas-project/baas/pkg/model/user"
+	"github.com/baas-project/baas/pkg/storage"
+	"github.com/google/uuid"
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+)
+
+// commitRequest is the optional body of a commit, the digest may also be given when the upload is created
+type commitRequest struct {
+	Digest string
+}
+
+// validDigest checks whether the digest is a hex encoded SHA-256, an empty digest is allowed
+func validDigest(digest string) bool {
+	raw, err := hex.DecodeString(digest)
+	return err == nil && (len(raw) == 0 || len(raw) == 32)
+}
+
+// getUpload fetches the upload in the URI and checks that it belongs to the image
+func (api_ *API) getUpload(w http.ResponseWriter, r *http.Request, image *images.ImageModel) (*images.UploadModel, error) {
+	id, err := GetTag("upload", w, r)
+	if err != nil {
+		return nil, err
+	}
+
+	upload, err := api_.store.GetUpload(id)
+	if err != nil || upload.ImageModelUUID != image.UUID {
+		http.Error(w, "Cannot find the upload", http.StatusNotFound)
+		return nil, errors.New("upload not found")
+	}
+
+	upload.Offset, err = api_.files.Staged(upload.UUID)
+	if err != nil {
+		http.Error(w, "Cannot get the upload", http.StatusInternalServerError)
+		log.Errorf("Get staged upload %s: %v", upload.UUID, err)
+		return nil, err
+	}
+
+	return upload, nil
+}
+
+// writeUpload sends the state of the upload, the offset is also sent as a header
+func writeUpload(w http.ResponseWriter, upload *images.UploadModel, status int) {
+	w.Header().Set(api_pkg.UploadOffsetHeader, strconv.FormatInt(upload.Offset, 10))
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(upload)
+}
+
+// CreateUpload starts an upload of a new version of the image which is sent in parts.
+// The parts are appended with PATCH and the upload is turned into a version with a POST.
+// Example request: POST /image/87f58936-9540-4dad-aba6-253f06142166/uploads
+// Example body: {"NewVersion": true, "Size": 536870912,
+//                "Digest": "b94d27b9934d3e08a52e52d7da7dabfac484efe37a5380ee9088f7ace2efcde9"}
+// Example response: {"UUID": "5e0a4a5c-2f6e-4d02-9f4b-c4e1b4f9e4a1",
+//                    "ImageModelUUID": "87f58936-9540-4dad-aba6-253f06142166", "NewVersion": true,
+//                    "Size": 536870912, "Digest": "b94d27b9...", "Offset": 0}
+func (api_ *API) CreateUpload(w http.ResponseWriter, r *http.Request) {
+	image, err := api_.checkUserImage(w, r)
+	if err != nil {
+		return
+	}
+
+	var upload images.UploadModel
+	if err = json.NewDecoder(r.Body).Decode(&upload); err != nil {
+		http.Error(w, "Invalid upload given", http.StatusBadRequest)
+		log.Errorf("Invalid upload given: %v", err)
+		return
+	}
+
+	if upload.Size < 0 || !validDigest(upload.Digest) {
+		http.Error(w, "The size or digest of the upload is invalid", http.StatusBadRequest)
+		return
+	}
+
+	upload.UUID = uuid.New().String()
+	upload.ImageModelUUID = image.UUID
+	upload.Offset = 0
+
+	if err = api_.store.CreateUpload(&upload); err != nil {
+		http.Error(w, "Cannot create the upload", http.StatusInternalServerError)
+		log.Errorf("Create upload: %v", err)
+		return
+	}
+
+	w.Header().Set("Location", fmt.Sprintf("/image/%s/uploads/%s", image.UUID, upload.UUID))
+	writeUpload(w, &upload, http.StatusCreated)
+}
+
+// GetUpload returns how much of the upload has been received, an interrupted upload continues from there
+// Example request: GET /image/87f58936-9540-4dad-aba6-253f06142166/uploads/5e0a4a5c-2f6e-4d02-9f4b-c4e1b4f9e4a1
+// Example response: {"UUID": "5e0a4a5c-2f6e-4d02-9f4b-c4e1b4f9e4a1",
+//                    "ImageModelUUID": "87f58936-9540-4dad-aba6-253f06142166", "NewVersion": true,
+//                    "Size": 536870912, "Digest": "b94d27b9...", "Offset": 16777216}
+func (api_ *API) GetUpload(w http.ResponseWriter, r *http.Request) {
+	image, err := api_.checkUserImage(w, r)
+	if err != nil {
+		return
+	}
+
+	upload, err := api_.getUpload(w, r, image)
+	if err != nil {
+		return
+	}
+
+	writeUpload(w, upload, http.StatusOK)
+}
+
+// AppendUpload appends the body to the upload. The Upload-Offset header has to match the amount of bytes
+// received so far, otherwise the request is refused and the header in the response holds the right offset.
+// Example request: PATCH /image/87f58936-9540-4dad-aba6-253f06142166/uploads/5e0a4a5c-2f6e-4d02-9f4b-c4e1b4f9e4a1
+//                  -H "Upload-Offset: 16777216" --data-binary @part.img
+// Example response: the upload as for GET, with the new offset
+func (api_ *API) AppendUpload(w http.ResponseWriter, r *http.Request) {
+	image, err := api_.checkUserImage(w, r)
+	if err != nil {
+		return
+	}
+
+	upload, err := api_.getUpload(w, r, image)
+	if err != nil {
+		return
+	}
+
+	offset, err := strconv.ParseInt(r.Header.Get(api_pkg.UploadOffsetHeader), 10, 64)
+	if err != nil || offset < 0 {
+		http.Error(w, "Invalid or missing Upload-Offset header", http.StatusBadRequest)
+		return
+	}
+
+	var body io.Reader = r.Body
+	if upload.Size > 0 {
+		if r.ContentLength > upload.Size-offset {
+			http.Error(w, "The upload is larger than its size", http.StatusRequestEntityTooLarge)
+			return
+		}
+
+		body = io.LimitReader(r.Body, upload.Size-offset)
+	}
+
+	upload.Offset, err = api_.files.Append(upload.UUID, offset, body)
+	if err == storage.ErrOffsetMismatch {
+		w.Header().Set(api_pkg.UploadOffsetHeader, strconv.FormatInt(upload.Offset, 10))
+		http.Error(w, "The offset does not match the received data", http.StatusConflict)
+		return
+	} else if err != nil {
+		// The data which did arrive is kept, the client continues from the offset in the header
+		w.Header().Set(api_pkg.UploadOffsetHeader, strconv.FormatInt(upload.Offset, 10))
+		http.Error(w, "Cannot store the uploaded data", http.StatusInternalServerError)
+		log.Errorf("Append to upload %s: %v", upload.UUID, err)
+		return
+	}
+
+	writeUpload(w, upload, http.StatusOK)
+}
+
+// CommitUpload checks the digest of the upload and stores it as a version of the image, either a new one
+// or the latest one. The version is only created once the file is in place. An upload of a block map is
+// rebuilt into the whole disk first, the block map may leave out the blocks of the version it was made against.
+// Example request: POST /image/87f58936-9540-4dad-aba6-253f06142166/uploads/5e0a4a5c-2f6e-4d02-9f4b-c4e1b4f9e4a1
+// Example body: {"Digest": "b94d27b9934d3e08a52e52d7da7dabfac484efe37a5380ee9088f7ace2efcde9"}
+// Example response: {"Version": 5, "ImageModelUUID": "87f58936-9540-4dad-aba6-253f06142166",
+//                    "Digest": "b94d27b9934d3e08a52e52d7da7dabfac484efe37a5380ee9088f7ace2efcde9", "Size": 11}
+func (api_ *API) CommitUpload(w http.ResponseWriter, r *http.Request) {
+	image, err := api_.checkUserImage(w, r)
+	if err != nil {
+		return
+	}
+
+	upload, err := api_.getUpload(w, r, image)
+	if err != nil {
+		return
+	}
+
+	var commit commitRequest
+	if err = json.NewDecoder(r.Body).Decode(&commit); err != nil && err != io.EOF {
+		http.Error(w, "Invalid commit given", http.StatusBadRequest)
+		log.Errorf("Invalid commit given: %v", err)
+		return
+	}
+
+	digest := upload.Digest
+	if commit.Digest != "" {
+		digest = commit.Digest
+	}
+
+	if digest == "" || !validDigest(digest) {
+		http.Error(w, "The SHA-256 digest of the upload is needed to commit it", http.StatusBadRequest)
+		return
+	}
+
+	if upload.Size > 0 && upload.Offset != upload.Size {
+		w.Header().Set(api_pkg.UploadOffsetHeader, strconv.FormatInt(upload.Offset, 10))
+		http.Error(w, "The upload is not complete", http.StatusConflict)
+		return
+	}
+
+	version := image.Versions[len(image.Versions)-1]
+	if upload.NewVersion {
+		// The number is taken before the file is written, so another new version cannot overwrite it
+		reserved, reserveErr := api_.store.CreateNextImageVersion(image.UUID)
+		if reserveErr != nil {
+			http.Error(w, "Cannot create the version", http.StatusInternalServerError)
+			log.Errorf("Commit upload %s: %v", upload.UUID, reserveErr)
+			return
+		}
+
+		version = *reserved
+	}
+
+	if upload.BlockMap {
+		err = api_.commitBlockMap(image, upload, digest, version.Version)
+	} else {
+		err = api_.files.Commit(upload.UUID, image.UUID, storage.VersionFile(version.Version), digest)
+	}
+
+	if err != nil && upload.NewVersion {
+		api_.releaseVersion(&version)
+	}
+
+	switch errors.Cause(err) {
+	case nil:
+	case storage.ErrDigestMismatch:
+		http.Error(w, "The digest does not match the uploaded data", http.StatusUnprocessableEntity)
+		return
+	case blockmap.ErrDigestMismatch:
+		http.Error(w, "The disk rebuilt from the block map does not match its digest", http.StatusUnprocessableEntity)
+		return
+	case errInvalidBlockMap:
+		http.Error(w, "The upload is not a valid block map", http.StatusBadRequest)
+		log.Errorf("Commit upload %s: %v", upload.UUID, err)
+		return
+	case errBaseMismatch:
+		http.Error(w, "The block map is made against a version which does not exist or has changed",
+			http.StatusConflict)
+		return
+	default:
+		http.Error(w, "Cannot store the upload", http.StatusInternalServerError)
+		log.Errorf("Commit upload %s: %v", upload.UUID, err)
+		return
+	}
+
+	if err = api_.storeVersion(image, &version); err != nil {
+		http.Error(w, "Cannot store the version of the image", http.StatusInternalServerError)
+		log.Errorf("Commit upload %s: %v", upload.UUID, err)
+		return
+	}
+
+	if err = api_.store.DeleteUpload(upload); err != nil {
+		log.Warnf("Cannot remove the committed upload %s: %v", upload.UUID, err)
+	}
+
+	w.WriteHeader(http.StatusCreated)
+	_ = json.NewEncoder(w).Encode(version)
+}
+
+// AbortUpload throws away the upload and the data received for it
+// Example request: DELETE /image/87f58936-9540-4dad-aba6-253f06142166/uploads/5e0a4a5c-2f6e-4d02-9f4b-c4e1b4f9e4a1
+// Example response: Successfully aborted the upload
+func (api_ *API) AbortUpload(w http.ResponseWriter, r *http.Request) {
+	image, err := api_.checkUserImage(w, r)
+	if err != nil {
+		return
+	}
+
+	upload, err := api_.getUpload(w, r, image)
+	if err != nil {
+		return
+	}
+
+	if err = api_.store.DeleteUpload(upload); err != nil {
+		http.Error(w, "Cannot abort the upload", http.StatusInternalServerError)
+		log.Errorf("Abort upload %s: %v", upload.UUID, err)
+		return
+	}
+
+	if err = api_.files.Discard(upload.UUID); err != nil {
+		log.Warnf("Cannot remove the data of upload %s: %v", upload.UUID, err)
+	}
+
+	http.Error(w, "Successfully aborted the upload", http.StatusOK)
+}
+
+// RegisterUploadHandlers sets the metadata for each of the routes and registers them to the global handler
+func (api_ *API) RegisterUploadHandlers() {
+	api_.Routes = append(api_.Routes, Route{
+		URI:            "/image/{uuid}/uploads",
+		Permissions:    []user.UserRole{user.User, user.Moderator, user.Admin},
+		UserAllowed:    true,
+		Handler:        api_.CreateUpload,
+		Method:         http.MethodPost,
+		Description:    "Starts a resumable upload of a version of an image",
+		MachineAllowed: true,
+	})
+
+	api_.Routes = append(api_.Routes, Route{
+		URI:            "/image/{uuid}/uploads/{upload}",
+		Permissions:    []user.UserRole{user.User, user.Moderator, user.Admin},
+		UserAllowed:    true,
+		Handler:        api_.GetUpload,
+		Method:         http.MethodGet,
+		Description:    "Gets how much of an upload has been received",
+		MachineAllowed: true,
+	})
+
+	api_.Routes = append(api_.Routes, Route{
+		URI:            "/image/{uuid}/uploads/{upload}",
+		Permissions:    []user.UserRole{user.User, user.Moderator, user.Admin},
+		UserAllowed:    true,
+		Handler:        api_.AppendUpload,
+		Method:         http.MethodPatch,
+		Description:    "Appends data to an upload",
+		MachineAllowed: true,
+	})
+
+	api_.Routes = append(api_.Routes, Route{
+		URI:            "/image/{uuid}/uploads/{upload}",
+		Permissions:    []user.UserRole{user.User, user.Moderator, user.Admin},
+		UserAllowed:    true,
+		Handler:        api_.CommitUpload,
+		Method:         http.MethodPost,
+		Description:    "Stores an upload as a version of the image",
+		MachineAllowed: true,
+	})
+
+	api_.Routes = append(api_.Routes, Route{
+		URI:            "/image/{uuid}/uploads/{upload}",
+		Permissions:    []user.UserRole{user.User, user.Moderator, user.Admin},
+		UserAllowed:    true,
+		Handler:        api_.AbortUpload,
+		Method:         http.MethodDelete,
+		Description:    "Throws away an upload",
+		MachineAllowed: true,
+	})
+}
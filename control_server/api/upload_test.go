@@ -0,0 +1,112 @@
+// Copyright (c) 2020-2022 TU Delft & Valentijn van de Beek <v.d.vandebeek@student.tudelft.nl> All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package api
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	api_pkg "github.com/baas-project/baas/pkg/api"
+	"github.com/baas-project/baas/pkg/database/memory"
+	"github.com/baas-project/baas/pkg/model/images"
+	"github.com/baas-project/baas/pkg/model/user"
+	"github.com/baas-project/baas/pkg/storage"
+	"github.com/stretchr/testify/assert"
+)
+
+// helloWorldDigest is the SHA-256 of "hello world"
+const helloWorldDigest = "b94d27b9934d3e08a52e52d7da7dabfac484efe37a5380ee9088f7ace2efcde9"
+
+func uploadRequest(t *testing.T, api *API, handler http.Handler, method string, uri string, body io.Reader,
+	offset string) *httptest.ResponseRecorder {
+	resp := httptest.NewRecorder()
+	req := httptest.NewRequest(method, uri, body)
+	if offset != "" {
+		req.Header.Set(api_pkg.UploadOffsetHeader, offset)
+	}
+
+	loginAs(t, api, req, "test", user.User)
+	handler.ServeHTTP(resp, req)
+
+	return resp
+}
+
+func TestApi_ResumableUpload(t *testing.T) {
+	store := memory.NewStore()
+	files := storage.NewMemory()
+
+	err := store.CreateUser(&user.UserModel{Username: "test", Name: "Test", Role: user.User})
+	assert.NoError(t, err)
+	store.CreateImage(&images.ImageModel{Name: "Fedora", UUID: "fedora", Username: "test",
+		DiskCompressionStrategy: images.DiskCompressionStrategyNone})
+
+	api := NewAPI(store, files)
+	handler := api.handler("")
+
+	body, _ := json.Marshal(images.UploadModel{NewVersion: true, Size: 11})
+	resp := uploadRequest(t, api, handler, http.MethodPost, "/image/fedora/uploads", bytes.NewReader(body), "")
+	assert.Equal(t, http.StatusCreated, resp.Code)
+
+	var upload images.UploadModel
+	err = json.NewDecoder(resp.Body).Decode(&upload)
+	assert.NoError(t, err)
+	assert.NotEmpty(t, upload.UUID)
+	uri := "/image/fedora/uploads/" + upload.UUID
+
+	resp = uploadRequest(t, api, handler, http.MethodPatch, uri, strings.NewReader("hello "), "0")
+	assert.Equal(t, http.StatusOK, resp.Code)
+	assert.Equal(t, "6", resp.Header().Get(api_pkg.UploadOffsetHeader))
+
+	// A part which was already received is refused, the client learns where to continue
+	resp = uploadRequest(t, api, handler, http.MethodPatch, uri, strings.NewReader("hello "), "0")
+	assert.Equal(t, http.StatusConflict, resp.Code)
+	assert.Equal(t, "6", resp.Header().Get(api_pkg.UploadOffsetHeader))
+
+	resp = uploadRequest(t, api, handler, http.MethodGet, uri, nil, "")
+	assert.Equal(t, http.StatusOK, resp.Code)
+	assert.Equal(t, "6", resp.Header().Get(api_pkg.UploadOffsetHeader))
+
+	// The upload cannot be committed before it is complete
+	resp = uploadRequest(t, api, handler, http.MethodPost, uri, strings.NewReader(`{"Digest": "`+helloWorldDigest+`"}`), "")
+	assert.Equal(t, http.StatusConflict, resp.Code)
+
+	resp = uploadRequest(t, api, handler, http.MethodPatch, uri, strings.NewReader("world"), "6")
+	assert.Equal(t, http.StatusOK, resp.Code)
+
+	// Nor with the wrong digest, which does not create a version
+	resp = uploadRequest(t, api, handler, http.MethodPost, uri, strings.NewReader(`{"Digest": "`+strings.Repeat("0", 64)+`"}`), "")
+	assert.Equal(t, http.StatusUnprocessableEntity, resp.Code)
+
+	image, err := store.GetImageByUUID("fedora")
+	assert.NoError(t, err)
+	assert.Len(t, image.Versions, 1)
+
+	resp = uploadRequest(t, api, handler, http.MethodPost, uri, strings.NewReader(`{"Digest": "`+helloWorldDigest+`"}`), "")
+	assert.Equal(t, http.StatusCreated, resp.Code)
+
+	image, err = store.GetImageByUUID("fedora")
+	assert.NoError(t, err)
+	assert.Len(t, image.Versions, 2)
+
+	// The version knows its digest, so the management OS can check the disk it writes
+	assert.Equal(t, helloWorldDigest, image.Versions[1].Digest)
+	assert.Equal(t, int64(11), image.Versions[1].Size)
+
+	f, err := files.Open("fedora", storage.VersionFile(1))
+	assert.NoError(t, err)
+	data, err := ioutil.ReadAll(f)
+	assert.NoError(t, err)
+	assert.Equal(t, "hello world", string(data))
+
+	// The upload is gone once it is committed
+	resp = uploadRequest(t, api, handler, http.MethodGet, uri, nil, "")
+	assert.Equal(t, http.StatusNotFound, resp.Code)
+}
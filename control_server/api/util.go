@@ -35,21 +35,26 @@ func GetName(w http.ResponseWriter, r *http.Request) (string, error) {
 	return GetTag("name", w, r)
 }
 
-// CreateNewVersion creates a new version for a specified image
+// CreateNewVersion creates a new version for a specified image, its file is written afterwards
 func CreateNewVersion(uuid string, store database.Store) (images.Version, error) {
-	// First fetch the image from the database, so we can get the id using the unique id.
-	// Do not ask me why this is needed, revamp of the database might be needed.
-	image, err := store.GetImageByUUID(images.ImageUUID(uuid))
+	if _, err := store.GetImageByUUID(images.ImageUUID(uuid)); err != nil {
+		return images.Version{}, errors.New("cannot fetch image from database")
+	}
 
+	version, err := store.CreateNextImageVersion(images.ImageUUID(uuid))
 	if err != nil {
-		return images.Version{}, errors.New("cannot fetch image from database")
+		return images.Version{}, err
 	}
 
-	version := images.Version{Version: image.Versions[len(image.Versions)-1].Version + 1,
-		ImageModelUUID: image.UUID}
+	return *version, nil
+}
 
-	store.CreateNewImageVersion(version)
-	return version, nil
+// releaseVersion removes a new version again when its file could not be stored
+func (api_ *API) releaseVersion(version *images.Version) {
+	if err := api_.store.DeleteVersion(version); err != nil {
+		log.Warnf("Cannot remove version %d of image %s, which has no file: %v", version.Version,
+			version.ImageModelUUID, err)
+	}
 }
 
 // ErrorWrite writes the same error message on the HTTP stream and log
@@ -66,5 +71,6 @@ func ErrorWrite(w http.ResponseWriter, err error, msg string) error {
 func (api_ *API) RegisterImagePackageHandlers() {
 	api_.RegisterImageDockerHandlers()
 	api_.RegisterImageHandlers()
+	api_.RegisterUploadHandlers()
 	api_.RegisterImageSetupHandlers()
 }
@@ -0,0 +1,96 @@
+// Copyright (c) 2020-2022 TU Delft & Valentijn van de Beek <v.d.vandebeek@student.tudelft.nl> All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"time"
+
+	"github.com/baas-project/baas/control_server/api"
+	"github.com/baas-project/baas/pkg/database"
+	"github.com/baas-project/baas/pkg/model/images"
+	"github.com/baas-project/baas/pkg/model/machine"
+	"github.com/baas-project/baas/pkg/model/user"
+	"github.com/baas-project/baas/pkg/storage"
+	"github.com/baas-project/baas/pkg/util"
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+)
+
+// demoImageSize is the size of the empty images created for the demo, they are kept in memory so it is small
+const demoImageSize = 64 * int64(images.SizeMegabyte)
+
+// seedDemo fills an empty store with some users, machines, images and a setup to try out the API with.
+// An access token for the administrator is logged, so requests can be made without logging in through GitHub.
+func seedDemo(store database.Store, files storage.ImageFiles) error {
+	users := []user.UserModel{
+		{Username: "admin", Name: "Demo Administrator", Email: "admin@example.com", Role: user.Admin},
+		{Username: "alice", Name: "Alice", Email: "alice@example.com", Role: user.Moderator},
+		{Username: "bob", Name: "Bob", Email: "bob@example.com", Role: user.User},
+	}
+
+	for i := range users {
+		if err := store.CreateUser(&users[i]); err != nil {
+			return errors.Wrap(err, "create user")
+		}
+	}
+
+	machines := []machine.MachineModel{
+		{Name: "node-1", Architecture: machine.X86_64, Managed: true, MacAddress: util.MacAddress{Address: "52:54:00:00:00:01"}},
+		{Name: "node-2", Architecture: machine.X86_64, Managed: true, MacAddress: util.MacAddress{Address: "52:54:00:00:00:02"}},
+		{Name: "pi", Architecture: machine.Arm64, Managed: false, MacAddress: util.MacAddress{Address: "52:54:00:00:00:03"}},
+	}
+
+	for i := range machines {
+		if err := store.CreateMachine(&machines[i]); err != nil {
+			return errors.Wrap(err, "create machine")
+		}
+
+		machineImage, err := images.CreateMachineImageModel(machines[i].MacAddress)
+		if err != nil {
+			return errors.Wrap(err, "create machine image")
+		}
+
+		store.CreateMachineImage(machineImage)
+		if err = files.Create(machineImage.UUID, storage.VersionFile(0), demoImageSize); err != nil {
+			return errors.Wrap(err, "create machine image file")
+		}
+	}
+
+	setup := images.ImageSetup{Name: "Workstation", Username: "bob", UUID: "demo-workstation"}
+	if err := store.CreateImageSetup("bob", &setup); err != nil {
+		return errors.Wrap(err, "create image setup")
+	}
+
+	for _, image := range []images.ImageModel{
+		{Name: "Fedora", UUID: "demo-fedora", Username: "bob", Type: "base", Filesystem: images.FileSystemTypeEXT4,
+			DiskCompressionStrategy: images.DiskCompressionStrategyNone},
+		{Name: "Scratch", UUID: "demo-scratch", Username: "bob", Type: "base", Filesystem: images.FileSystemTypeFAT32,
+			DiskCompressionStrategy: images.DiskCompressionStrategyNone},
+	} {
+		image := image
+		store.CreateImage(&image)
+		if err := files.Create(image.UUID, storage.VersionFile(0), demoImageSize); err != nil {
+			return errors.Wrap(err, "create image file")
+		}
+
+		store.AddImageToImageSetup(&setup, &image, image.Versions[0], false)
+	}
+
+	token := user.AccessTokenModel{
+		Username:  "admin",
+		Name:      "demo",
+		Role:      user.Admin,
+		ExpiresAt: time.Now().Add(24 * time.Hour),
+	}
+
+	secret, err := api.IssueAccessToken(store, &token)
+	if err != nil {
+		return errors.Wrap(err, "create access token")
+	}
+
+	log.Warn("Running in demo mode, nothing is stored and everything is lost when the control server stops")
+	log.Infof("Demo administrator token: %s", secret)
+	return nil
+}
@@ -7,23 +7,57 @@ package main
 import (
 	"flag"
 	"fmt"
+	"net"
 	"os"
 	"strconv"
+	"strings"
+	"time"
 
+	"github.com/baas-project/baas/pkg/database"
+	"github.com/baas-project/baas/pkg/database/memory"
+	"github.com/baas-project/baas/pkg/database/migrations"
+	"github.com/baas-project/baas/pkg/database/postgres"
 	"github.com/baas-project/baas/pkg/database/sqlite"
 
+	"github.com/pkg/errors"
 	log "github.com/sirupsen/logrus"
 
 	"github.com/baas-project/baas/control_server/api"
+	"github.com/baas-project/baas/control_server/multicast"
+	"github.com/baas-project/baas/control_server/nbd"
 	"github.com/baas-project/baas/control_server/pixieserver"
+	"github.com/baas-project/baas/control_server/retention"
+	"github.com/baas-project/baas/control_server/scheduler"
+	"github.com/baas-project/baas/control_server/transcode"
 	api_pkg "github.com/baas-project/baas/pkg/api"
+	"github.com/baas-project/baas/pkg/model/images"
+	multicast_pkg "github.com/baas-project/baas/pkg/multicast"
+	"github.com/baas-project/baas/pkg/storage"
 )
 
 var (
 	static   = flag.String("static", "control_server/static", "Static file dir to server under /static/.")
 	diskpath = flag.String("disks", "control_server/disks", "Location to store disk images.")
+	baseline = flag.String("baseline", "", "UUID of the image setup machines return to after a reservation.")
+	interval = flag.Duration("schedule-interval", time.Minute, "How often reservations are checked.")
+	dsn      = flag.String("db", "store.db", "Database to use, either an SQLite file or a postgres:// DSN.")
+	layout   = flag.String("storage", "chunked", "How image files are stored: chunked (deduplicated) or plain.")
+	gc       = flag.Duration("gc-interval", time.Hour, "How often unused chunks are removed from the chunked storage.")
+	keep     = flag.Duration("retention-interval", 6*time.Hour, "How often old image versions are removed.")
+	demo     = flag.Bool("demo", false, "Keep everything in memory and fill it with example data, nothing is saved.")
+	compress = flag.String("compression", "none", "Compression applied to new versions which are uploaded uncompressed.")
+	level    = flag.Int("compression-level", 0, "Level of the default compression, 0 uses the default of the strategy.")
+	group    = flag.String("multicast-group", "", "Address:port multicast sessions are sent to, empty disables multicast.")
+	rate     = flag.Int64("multicast-rate", multicast_pkg.DefaultRate, "Bytes per second sent in a multicast session.")
+	wait     = flag.Duration("multicast-wait", 5*time.Second, "How long a multicast session waits before it starts.")
+	nbdDir   = flag.String("nbd", "", "Directory for the disks of machines booting over NBD, empty disables NBD boots.")
+	discover = flag.Bool("discovery", false, "Boot unknown machines into discovery mode, so they register themselves.")
 )
 
+// chunkGrace is how long new chunks are kept before the garbage collector may remove them,
+// this leaves other control servers sharing the disks time to store the manifest using them.
+const chunkGrace = time.Hour
+
 func init() {
 	levelString := os.Getenv("LOG_LEVEL")
 
@@ -42,22 +76,125 @@ func init() {
 	}
 }
 
+// isPostgres reports whether the DSN points to a PostgreSQL database instead of an SQLite file
+func isPostgres(dsn string) bool {
+	return strings.HasPrefix(dsn, "postgres://") || strings.HasPrefix(dsn, "postgresql://")
+}
+
+// openFiles creates the backend for the image files, the chunked storage also gets its garbage collector started
+func openFiles(layout string, diskpath string) (storage.ImageFiles, error) {
+	switch layout {
+	case "plain":
+		return storage.NewDisk(diskpath), nil
+	case "chunked":
+		chunked := storage.NewChunked(diskpath)
+		go chunked.RunGC(*gc, chunkGrace)
+		return chunked, nil
+	default:
+		return nil, errors.Errorf("unknown storage %q, use chunked or plain", layout)
+	}
+}
+
+// openMulticast creates the manager of the multicast sessions, multicast is disabled when no group is given
+func openMulticast(files storage.ImageFiles, group string) (*multicast.Manager, error) {
+	if group == "" {
+		return nil, nil
+	}
+
+	addr, err := net.ResolveUDPAddr("udp4", group)
+	if err != nil {
+		return nil, errors.Wrap(err, "invalid multicast group")
+	}
+
+	return multicast.NewManager(files, multicast.Config{Group: addr, Rate: *rate, Wait: *wait}), nil
+}
+
+// openNBD creates the manager of the disks served over NBD and starts serving them, NBD boots are disabled when no
+// directory is given
+func openNBD(dir string) (*nbd.Manager, error) {
+	if dir == "" {
+		return nil, nil
+	}
+
+	manager, err := nbd.NewManager(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	l, err := net.Listen("tcp", fmt.Sprintf(":%d", api_pkg.NBDPort))
+	if err != nil {
+		return nil, errors.Wrap(err, "listen for NBD connections")
+	}
+
+	go func() {
+		log.Fatal(manager.Serve(l))
+	}()
+
+	return manager, nil
+}
+
+// openStore picks the database backend based on the DSN
+func openStore(dsn string) (database.Store, error) {
+	if isPostgres(dsn) {
+		return postgres.NewPostgresStore(dsn)
+	}
+
+	return sqlite.NewSqliteStore(strings.TrimPrefix(dsn, "sqlite://"))
+}
+
 func main() {
 	flag.Parse()
-	os.Setenv("BAAS_DISK_PATH", *diskpath)
+
+	if flag.Arg(0) == "migrate" {
+		if err := runMigrate(*dsn, flag.Args()[1:]); err != nil {
+			log.Fatal(err)
+		}
+
+		return
+	}
 
 	log.Info("Starting BAAS control server")
 
-	store, err := sqlite.NewSqliteStore("store.db")
+	var store database.Store
+	var files storage.ImageFiles
+	var err error
+
+	if *demo {
+		store = memory.NewStore()
+		files = storage.NewMemory()
+		err = seedDemo(store, files)
+	} else {
+		store, err = openStore(*dsn)
+		if err == nil {
+			files, err = openFiles(*layout, *diskpath)
+		}
+	}
+
+	if errors.Cause(err) == migrations.ErrSchemaTooNew {
+		log.Fatalf("Refusing to start: %v", err)
+	}
+
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	compression := transcode.Target{Strategy: images.DiskCompressionStrategy(*compress), Level: *level}
+	if err = compression.Check(); err != nil {
+		log.Fatalf("Invalid default compression: %v", err)
+	}
+
+	manager, err := openMulticast(files, *group)
 	if err != nil {
 		log.Fatal(err)
 	}
 
-	// mac
+	exports, err := openNBD(*nbdDir)
 	if err != nil {
 		log.Fatal(err)
 	}
 
+	go retention.NewCollector(store, files, *keep).Run()
+	go scheduler.NewScheduler(store, images.ImageUUID(*baseline), *interval).Run()
 	go pixieserver.StartPixiecore(fmt.Sprintf("http://localhost:%s", strconv.Itoa(api_pkg.Port)))
-	api.StartServer(store, *static, *diskpath, "0.0.0.0", api_pkg.Port)
+	api.StartServer(store, files, compression, manager, exports, *discover, *static, "0.0.0.0", api_pkg.Port)
 }
@@ -0,0 +1,97 @@
+// Copyright (c) 2020-2022 TU Delft & Valentijn van de Beek <v.d.vandebeek@student.tudelft.nl> All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/baas-project/baas/pkg/database/migrations"
+	"github.com/baas-project/baas/pkg/database/postgres"
+	"github.com/baas-project/baas/pkg/database/sqlite"
+	"github.com/pkg/errors"
+	"gorm.io/gorm"
+)
+
+const migrateUsage = "usage: control_server [-db dsn] migrate status|up [version]|down [version]"
+
+// openDB opens the database picked by the DSN without migrating it
+func openDB(dsn string) (*gorm.DB, error) {
+	if isPostgres(dsn) {
+		return postgres.OpenDB(dsn)
+	}
+
+	return sqlite.OpenDB(strings.TrimPrefix(dsn, "sqlite://"))
+}
+
+// runMigrate handles the migrate subcommand. Up without a version applies every pending migration,
+// down without a version reverts only the last applied one.
+func runMigrate(dsn string, args []string) error {
+	if len(args) < 1 || len(args) > 2 {
+		return errors.New(migrateUsage)
+	}
+
+	db, err := openDB(dsn)
+	if err != nil {
+		return err
+	}
+
+	current, err := migrations.Current(db)
+	if err != nil {
+		return err
+	}
+
+	// Without a version up applies everything, and down reverts the last migration
+	target := migrations.LatestTarget
+	if len(args) == 2 {
+		target, err = strconv.Atoi(args[1])
+		if err != nil || target < 0 {
+			return errors.Errorf("invalid version %q", args[1])
+		}
+
+		if target > migrations.Latest() {
+			return errors.Errorf("version %d is newer than version %d, the latest this binary supports",
+				target, migrations.Latest())
+		}
+	}
+
+	switch args[0] {
+	case "status":
+		lines, err := migrations.Status(db)
+		if err != nil {
+			return err
+		}
+
+		fmt.Printf("Database is at version %d, this binary supports up to version %d\n", current, migrations.Latest())
+		for _, line := range lines {
+			fmt.Println(line)
+		}
+
+		return nil
+	case "up":
+		if target == migrations.LatestTarget {
+			target = migrations.Latest()
+		}
+
+		if target < current {
+			return errors.Errorf("database is already at version %d, use down to revert it", current)
+		}
+
+		return migrations.Up(db, target)
+	case "down":
+		if target == migrations.LatestTarget {
+			target = current - 1
+		}
+
+		if target < 0 || target > current {
+			return errors.Errorf("cannot revert database at version %d to version %d", current, target)
+		}
+
+		return migrations.Down(db, target)
+	default:
+		return errors.New(migrateUsage)
+	}
+}
@@ -0,0 +1,198 @@
+// Copyright (c) 2020-2022 TU Delft & Valentijn van de Beek <v.d.vandebeek@student.tudelft.nl> All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package multicast runs the multicast sessions of the control server. There is at most one session per version
+// of an image: the machines which want the version while it is being sent join the running session, so the
+// file is only sent once for all of them.
+package multicast
+
+import (
+	"io"
+	"math/rand"
+	"net"
+	"sync"
+	"time"
+
+	api_pkg "github.com/baas-project/baas/pkg/api"
+	"github.com/baas-project/baas/pkg/model/images"
+	multicast_pkg "github.com/baas-project/baas/pkg/multicast"
+	"github.com/baas-project/baas/pkg/storage"
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+)
+
+// ports is the amount of ports after the port of the group the sessions are spread over, so a machine does
+// not receive the packets of sessions it is not in
+const ports = 64
+
+// Config describes how the sessions are sent
+type Config struct {
+	// Group is the multicast or broadcast address, the sessions use the ports starting at its port
+	Group *net.UDPAddr
+	// Rate is the amount of bytes per second sent in a session
+	Rate int64
+	// Wait is how long a new session waits before it starts, so the machines booting around the same time
+	// all get the first pass
+	Wait time.Duration
+}
+
+// key identifies the file which is sent in a session
+type key struct {
+	image   images.ImageUUID
+	version uint64
+}
+
+type session struct {
+	info   api_pkg.MulticastSession
+	sender *multicast_pkg.Sender
+}
+
+// Manager starts the sessions and keeps track of those which are running
+type Manager struct {
+	files  storage.ImageFiles
+	config Config
+
+	mutex    sync.Mutex
+	sessions map[key]*session
+	next     uint32
+}
+
+// NewManager creates a Manager which sends the files of the versions as configured
+func NewManager(files storage.ImageFiles, config Config) *Manager {
+	return &Manager{
+		files:    files,
+		config:   config,
+		sessions: make(map[key]*session),
+		next:     rand.Uint32(),
+	}
+}
+
+// Join returns the session which sends the version, a session is started when none is running
+func (m *Manager) Join(image images.ImageUUID, version uint64) (*api_pkg.MulticastSession, error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	k := key{image: image, version: version}
+	if s, ok := m.sessions[k]; ok && s.sender.Touch() {
+		info := s.info
+		return &info, nil
+	}
+
+	s, err := m.start(k)
+	if err != nil {
+		return nil, err
+	}
+
+	m.sessions[k] = s
+	info := s.info
+	return &info, nil
+}
+
+// Sessions returns the sessions which are running
+func (m *Manager) Sessions() []api_pkg.MulticastSession {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	sessions := make([]api_pkg.MulticastSession, 0, len(m.sessions))
+	for _, s := range m.sessions {
+		sessions = append(sessions, s.info)
+	}
+
+	return sessions
+}
+
+// start opens the file of the version and starts sending it after the configured wait
+func (m *Manager) start(k key) (*session, error) {
+	name := storage.VersionFile(k.version)
+	digest, err := m.files.Digest(k.image, name)
+	if err != nil {
+		return nil, errors.Wrap(err, "get digest of version file")
+	}
+
+	f, err := m.files.Open(k.image, name)
+	if err != nil {
+		return nil, errors.Wrap(err, "open version file")
+	}
+
+	size, err := f.Seek(0, io.SeekEnd)
+	if err != nil {
+		_ = f.Close()
+		return nil, errors.Wrap(err, "seek version file")
+	}
+
+	// The receivers send their requests to this socket, the packets to the group are sent from it as well
+	conn, err := net.ListenUDP("udp4", &net.UDPAddr{})
+	if err != nil {
+		_ = f.Close()
+		return nil, errors.Wrap(err, "open multicast socket")
+	}
+
+	m.next++
+	id := m.next
+	group := &net.UDPAddr{IP: m.config.Group.IP, Port: m.config.Group.Port + int(id%ports), Zone: m.config.Group.Zone}
+
+	sender := multicast_pkg.NewSender(conn, group, id, &readerAt{f: f}, size)
+	sender.Rate = m.config.Rate
+
+	s := &session{
+		info: api_pkg.MulticastSession{
+			Session: id,
+			Group:   group.String(),
+			Port:    conn.LocalAddr().(*net.UDPAddr).Port,
+			Size:    size,
+			Digest:  digest,
+		},
+		sender: sender,
+	}
+
+	go m.run(k, s, conn, f)
+
+	log.Infof("Started multicast session %d of version %d of image %s on %s", id, k.version, k.image, group)
+	return s, nil
+}
+
+// run sends the file and removes the session once it is done
+func (m *Manager) run(k key, s *session, conn *net.UDPConn, f storage.File) {
+	time.Sleep(m.config.Wait)
+
+	if err := s.sender.Run(); err != nil {
+		log.Errorf("Multicast session %d of version %d of image %s failed: %v", s.info.Session, k.version, k.image,
+			err)
+	}
+
+	joined, done := s.sender.Receivers()
+	log.Infof("Multicast session %d of version %d of image %s finished, %d of %d machines received it",
+		s.info.Session, k.version, k.image, done, joined)
+
+	m.mutex.Lock()
+	if m.sessions[k] == s {
+		delete(m.sessions, k)
+	}
+	m.mutex.Unlock()
+
+	_ = conn.Close()
+	_ = f.Close()
+}
+
+// readerAt reads the file at an offset by seeking to it, the sender only reads one packet at a time
+type readerAt struct {
+	mutex sync.Mutex
+	f     storage.File
+}
+
+func (r *readerAt) ReadAt(p []byte, offset int64) (int, error) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	if _, err := r.f.Seek(offset, io.SeekStart); err != nil {
+		return 0, err
+	}
+
+	n, err := io.ReadFull(r.f, p)
+	if err == io.ErrUnexpectedEOF {
+		err = io.EOF
+	}
+
+	return n, err
+}
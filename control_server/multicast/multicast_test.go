@@ -0,0 +1,76 @@
+// Copyright (c) 2020-2022 TU Delft & Valentijn van de Beek <v.d.vandebeek@student.tudelft.nl> All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package multicast
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"net"
+	"testing"
+	"time"
+
+	multicast_pkg "github.com/baas-project/baas/pkg/multicast"
+	"github.com/baas-project/baas/pkg/storage"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestManager(t *testing.T) {
+	files := storage.NewMemory()
+	contents := make([]byte, 300*1024+7)
+	rand.New(rand.NewSource(1)).Read(contents)
+
+	w, err := files.Write("fedora", storage.VersionFile(1))
+	assert.NoError(t, err)
+	_, err = io.Copy(w, bytes.NewReader(contents))
+	assert.NoError(t, err)
+	assert.NoError(t, w.Close())
+
+	// The group is a unicast address here, the manager does not care where the packets go
+	group := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 40000 + rand.Intn(10000)}
+	manager := NewManager(files, Config{Group: group, Rate: 10 * 1024 * 1024, Wait: 200 * time.Millisecond})
+
+	_, err = manager.Join("fedora", 2)
+	assert.Equal(t, storage.ErrNotFound, errors.Cause(err))
+
+	session, err := manager.Join("fedora", 1)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(len(contents)), session.Size)
+
+	digest, err := files.Digest("fedora", storage.VersionFile(1))
+	assert.NoError(t, err)
+	assert.Equal(t, digest, session.Digest)
+
+	// A machine which asks for the same version joins the session which is running
+	same, err := manager.Join("fedora", 1)
+	assert.NoError(t, err)
+	assert.Equal(t, session, same)
+	assert.Len(t, manager.Sessions(), 1)
+
+	addr, err := net.ResolveUDPAddr("udp4", session.Group)
+	assert.NoError(t, err)
+	conn, err := net.ListenUDP("udp4", addr)
+	assert.NoError(t, err)
+	defer conn.Close()
+
+	control := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: session.Port}
+	r, err := multicast_pkg.NewReceiver(conn, control, session.Session, session.Size, session.Digest)
+	assert.NoError(t, err)
+
+	data, err := ioutil.ReadAll(r)
+	assert.NoError(t, err)
+	assert.True(t, bytes.Equal(contents, data))
+
+	// The session ends once its only receiver is done
+	assert.Eventually(t, func() bool {
+		return len(manager.Sessions()) == 0
+	}, 10*time.Second, 100*time.Millisecond)
+
+	next, err := manager.Join("fedora", 1)
+	assert.NoError(t, err)
+	assert.NotEqual(t, session.Session, next.Session)
+}
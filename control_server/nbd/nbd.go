@@ -0,0 +1,340 @@
+// Copyright (c) 2020-2022 TU Delft & Valentijn van de Beek <v.d.vandebeek@student.tudelft.nl> All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package nbd keeps the disks which the control server serves to the machines booting over NBD. The version of an
+// image is expanded once into a raw disk which all machines booting it share, every machine writes to an overlay
+// of its own which is thrown away when the machine boots again, unless it is committed as a new version first.
+package nbd
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+
+	api_pkg "github.com/baas-project/baas/pkg/api"
+	"github.com/baas-project/baas/pkg/model/images"
+	nbd_pkg "github.com/baas-project/baas/pkg/nbd"
+	"github.com/baas-project/baas/pkg/util"
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+)
+
+// ErrUnknownExport is returned for an export which does not exist or belongs to another machine
+var ErrUnknownExport = errors.New("unknown export")
+
+const (
+	basePrefix    = "base-"
+	overlayPrefix = "overlay-"
+
+	// chunkSize is the granularity at which runs of zeroes are left out of the expanded disks
+	chunkSize = 64 * 1024
+)
+
+// key identifies the version a base disk is expanded from
+type key struct {
+	image   images.ImageUUID
+	version uint64
+}
+
+// base is the expanded disk of a version, it is removed once no export uses it
+type base struct {
+	once sync.Once
+	file *os.File
+	size int64
+	err  error
+	refs int
+}
+
+type export struct {
+	info    api_pkg.NBDExport
+	mac     string
+	key     key
+	base    *base
+	overlay *nbd_pkg.Overlay
+	path    string
+}
+
+// Manager creates the exports of the machines and serves them over NBD
+type Manager struct {
+	dir    string
+	server *nbd_pkg.Server
+
+	mutex   sync.Mutex
+	bases   map[key]*base
+	exports map[string]*export
+}
+
+// NewManager creates a Manager which keeps the disks and overlays in dir. What is left in it from a previous run
+// is removed, the machines which used it have to boot again anyway.
+func NewManager(dir string) (*Manager, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, errors.Wrap(err, "create NBD directory")
+	}
+
+	for _, prefix := range []string{basePrefix, overlayPrefix} {
+		leftover, err := filepath.Glob(filepath.Join(dir, prefix+"*"))
+		if err != nil {
+			return nil, errors.Wrap(err, "list NBD directory")
+		}
+
+		for _, path := range leftover {
+			if err = os.Remove(path); err != nil {
+				return nil, errors.Wrap(err, "remove leftover disk")
+			}
+		}
+	}
+
+	m := &Manager{
+		dir:     dir,
+		bases:   make(map[key]*base),
+		exports: make(map[string]*export),
+	}
+
+	m.server = nbd_pkg.NewServer(m.lookup)
+	return m, nil
+}
+
+// Serve serves the exports to the machines connecting to the listener, until it is closed
+func (m *Manager) Serve(l net.Listener) error {
+	return m.server.Serve(l)
+}
+
+func (m *Manager) lookup(name string) (*nbd_pkg.Export, bool) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	e, ok := m.exports[name]
+	if !ok {
+		return nil, false
+	}
+
+	return &nbd_pkg.Export{Device: e.overlay}, true
+}
+
+// Export creates an export of the version for the machine, open is called to read the raw disk of the version
+// when it is not expanded yet
+func (m *Manager) Export(mac string, image images.ImageUUID, version uint64,
+	open func() (io.ReadCloser, error)) (*api_pkg.NBDExport, error) {
+	k := key{image: image, version: version}
+
+	m.mutex.Lock()
+	b, ok := m.bases[k]
+	if !ok {
+		b = &base{}
+		m.bases[k] = b
+	}
+	b.refs++
+	m.mutex.Unlock()
+
+	b.once.Do(func() {
+		b.file, b.size, b.err = m.expand(k, open)
+	})
+
+	if b.err != nil {
+		m.release(k, b)
+		return nil, b.err
+	}
+
+	name, err := util.GenerateToken()
+	if err != nil {
+		m.release(k, b)
+		return nil, errors.Wrap(err, "generate export name")
+	}
+
+	path := filepath.Join(m.dir, overlayPrefix+name)
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		m.release(k, b)
+		return nil, errors.Wrap(err, "create overlay")
+	}
+
+	overlay, err := nbd_pkg.NewOverlay(b.file, b.size, f)
+	if err != nil {
+		_ = f.Close()
+		_ = os.Remove(path)
+		m.release(k, b)
+		return nil, err
+	}
+
+	e := &export{
+		info:    api_pkg.NBDExport{Name: name, Image: image, Version: version, Size: b.size},
+		mac:     mac,
+		key:     k,
+		base:    b,
+		overlay: overlay,
+		path:    path,
+	}
+
+	m.mutex.Lock()
+	m.exports[name] = e
+	m.mutex.Unlock()
+
+	log.Infof("Exporting version %d of image %s to %s over NBD", version, image, mac)
+	info := e.info
+	return &info, nil
+}
+
+// expand writes the raw disk of the version to a sparse file
+func (m *Manager) expand(k key, open func() (io.ReadCloser, error)) (*os.File, int64, error) {
+	r, err := open()
+	if err != nil {
+		return nil, 0, err
+	}
+
+	defer r.Close()
+
+	image := strings.ReplaceAll(string(k.image), string(filepath.Separator), "_")
+	f, err := ioutil.TempFile(m.dir, fmt.Sprintf("%s%s-%d-*", basePrefix, image, k.version))
+	if err != nil {
+		return nil, 0, errors.Wrap(err, "create base disk")
+	}
+
+	size, err := copySparse(f, r)
+	if err != nil {
+		_ = f.Close()
+		_ = os.Remove(f.Name())
+		return nil, 0, errors.Wrap(err, "expand base disk")
+	}
+
+	return f, size, nil
+}
+
+// copySparse copies r to f without writing the chunks which only hold zeroes, it returns the amount of bytes read
+func copySparse(f *os.File, r io.Reader) (int64, error) {
+	buf := make([]byte, chunkSize)
+
+	var size int64
+	for {
+		n, err := io.ReadFull(r, buf)
+		if n > 0 && !isZero(buf[:n]) {
+			if _, werr := f.WriteAt(buf[:n], size); werr != nil {
+				return size, werr
+			}
+		}
+
+		size += int64(n)
+
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return size, f.Truncate(size)
+		} else if err != nil {
+			return size, err
+		}
+	}
+}
+
+func isZero(data []byte) bool {
+	for _, b := range data {
+		if b != 0 {
+			return false
+		}
+	}
+
+	return true
+}
+
+// release drops a reference to the base disk, which is removed once it has none left. A base which could not be
+// expanded is forgotten right away so the next export tries again.
+func (m *Manager) release(k key, b *base) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	b.refs--
+	if (b.refs == 0 || b.err != nil) && m.bases[k] == b {
+		delete(m.bases, k)
+	}
+
+	if b.refs == 0 && b.file != nil {
+		_ = b.file.Close()
+		_ = os.Remove(b.file.Name())
+	}
+}
+
+// Exports returns the exports of the machine
+func (m *Manager) Exports(mac string) []api_pkg.NBDExport {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	exports := []api_pkg.NBDExport{}
+	for _, e := range m.exports {
+		if e.mac != mac {
+			continue
+		}
+
+		info := e.info
+		info.Written = e.overlay.Written()
+		exports = append(exports, info)
+	}
+
+	sort.Slice(exports, func(i, j int) bool {
+		return exports[i].Name < exports[j].Name
+	})
+
+	return exports
+}
+
+// Open returns the disk of an export of the machine with the writes of the machine applied to it, which is
+// what is committed as a new version. The machine should have disconnected so the disk does not change meanwhile.
+func (m *Manager) Open(mac string, name string) (io.Reader, *api_pkg.NBDExport, error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	e, ok := m.exports[name]
+	if !ok || e.mac != mac {
+		return nil, nil, ErrUnknownExport
+	}
+
+	info := e.info
+	info.Written = e.overlay.Written()
+	return io.NewSectionReader(e.overlay, 0, e.info.Size), &info, nil
+}
+
+// Drop removes an export of the machine together with the writes to it
+func (m *Manager) Drop(mac string, name string) error {
+	m.mutex.Lock()
+	e, ok := m.exports[name]
+	if !ok || e.mac != mac {
+		m.mutex.Unlock()
+		return ErrUnknownExport
+	}
+
+	delete(m.exports, name)
+	m.mutex.Unlock()
+
+	m.remove(e)
+	return nil
+}
+
+// DropMachine removes all exports of the machine, which happens when it boots again
+func (m *Manager) DropMachine(mac string) {
+	m.mutex.Lock()
+	var dropped []*export
+	for name, e := range m.exports {
+		if e.mac == mac {
+			dropped = append(dropped, e)
+			delete(m.exports, name)
+		}
+	}
+	m.mutex.Unlock()
+
+	for _, e := range dropped {
+		m.remove(e)
+	}
+}
+
+func (m *Manager) remove(e *export) {
+	if err := e.overlay.Close(); err != nil {
+		log.Warnf("Close overlay of version %d of image %s: %v", e.key.version, e.key.image, err)
+	}
+
+	_ = os.Remove(e.path)
+	m.release(e.key, e.base)
+
+	log.Infof("Stopped exporting version %d of image %s to %s", e.key.version, e.key.image, e.mac)
+}
@@ -0,0 +1,98 @@
+// Copyright (c) 2020-2022 TU Delft & Valentijn van de Beek <v.d.vandebeek@student.tudelft.nl> All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package nbd
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestManager(t *testing.T) {
+	dir, err := ioutil.TempDir("", "nbd")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	// Leftovers of a previous run are removed, other files are not
+	assert.NoError(t, ioutil.WriteFile(filepath.Join(dir, overlayPrefix+"old"), []byte{1}, 0600))
+	assert.NoError(t, ioutil.WriteFile(filepath.Join(dir, "other"), []byte{1}, 0600))
+
+	manager, err := NewManager(dir)
+	assert.NoError(t, err)
+
+	files, _ := filepath.Glob(filepath.Join(dir, "*"))
+	assert.Equal(t, []string{filepath.Join(dir, "other")}, files)
+
+	contents := make([]byte, 5*chunkSize+100)
+	rand.New(rand.NewSource(1)).Read(contents[2*chunkSize:])
+
+	opened := 0
+	open := func() (io.ReadCloser, error) {
+		opened++
+		return ioutil.NopCloser(bytes.NewReader(contents)), nil
+	}
+
+	_, err = manager.Export("abc", "fedora", 1, func() (io.ReadCloser, error) {
+		return nil, errors.New("broken")
+	})
+	assert.Error(t, err)
+
+	first, err := manager.Export("abc", "fedora", 1, open)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(len(contents)), first.Size)
+
+	second, err := manager.Export("def", "fedora", 1, open)
+	assert.NoError(t, err)
+	assert.NotEqual(t, first.Name, second.Name)
+
+	// The version is only expanded once for all machines
+	assert.Equal(t, 1, opened)
+
+	export, ok := manager.lookup(first.Name)
+	assert.True(t, ok)
+	_, err = export.Device.WriteAt([]byte("written"), 10)
+	assert.NoError(t, err)
+
+	_, ok = manager.lookup("unknown")
+	assert.False(t, ok)
+
+	// Only the machine of the export can use it
+	_, _, err = manager.Open("def", first.Name)
+	assert.Equal(t, ErrUnknownExport, err)
+
+	r, info, err := manager.Open("abc", first.Name)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(4096), info.Written)
+
+	expected := append([]byte(nil), contents...)
+	copy(expected[10:], "written")
+	committed, err := ioutil.ReadAll(r)
+	assert.NoError(t, err)
+	assert.Equal(t, expected, committed)
+
+	// The writes of one machine are not seen by another
+	r, _, err = manager.Open("def", second.Name)
+	assert.NoError(t, err)
+	committed, err = ioutil.ReadAll(r)
+	assert.NoError(t, err)
+	assert.Equal(t, contents, committed)
+
+	assert.Len(t, manager.Exports("abc"), 1)
+	assert.Equal(t, ErrUnknownExport, manager.Drop("def", first.Name))
+	assert.NoError(t, manager.Drop("abc", first.Name))
+	assert.Empty(t, manager.Exports("abc"))
+
+	// The base disk is removed with the last export using it
+	manager.DropMachine("def")
+	files, _ = filepath.Glob(filepath.Join(dir, "*"))
+	assert.Equal(t, []string{filepath.Join(dir, "other")}, files)
+}
@@ -0,0 +1,360 @@
+// Copyright (c) 2020-2022 TU Delft & Valentijn van de Beek <v.d.vandebeek@student.tudelft.nl> All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package placement picks the machines which satisfy constraints like "arch=x86_64, mem>=64G, label:numa=2". The
+// constraints are checked against the architecture, name and labels of a machine and against its hardware
+// inventory.
+package placement
+
+import (
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/baas-project/baas/pkg/database"
+	"github.com/baas-project/baas/pkg/model/machine"
+	"github.com/pkg/errors"
+	"gorm.io/gorm"
+)
+
+// labelPrefix starts the key of a constraint on a label of the machine
+const labelPrefix = "label:"
+
+// Operator compares the value of a machine with the value of a constraint
+type Operator string
+
+const (
+	// Equal is satisfied when the values are the same, strings are compared without case
+	Equal Operator = "="
+	// NotEqual is satisfied when the values differ
+	NotEqual Operator = "!="
+	// AtLeast is satisfied when the value of the machine is the same or higher
+	AtLeast Operator = ">="
+	// AtMost is satisfied when the value of the machine is the same or lower
+	AtMost Operator = "<="
+	// Above is satisfied when the value of the machine is higher
+	Above Operator = ">"
+	// Below is satisfied when the value of the machine is lower
+	Below Operator = "<"
+	// Present is satisfied when the machine has the label, whatever its value
+	Present Operator = ""
+)
+
+// operators found at the same position are tried in this order, so ">=" is not read as ">" followed by "="
+var operators = []Operator{NotEqual, AtLeast, AtMost, Equal, Above, Below}
+
+// kind is how the value of a property is compared
+type kind int
+
+const (
+	text kind = iota
+	count
+	bytes
+	speed
+)
+
+// property is something of a machine a constraint can be about
+type property struct {
+	kind kind
+	// value returns the value of the machine, false when it is not known
+	value func(m *machine.MachineModel, inventory *machine.InventoryModel) (string, uint64, bool)
+}
+
+// properties are the keys which can be used in constraints, besides the labels
+var properties = map[string]property{
+	"arch": {text, func(m *machine.MachineModel, inventory *machine.InventoryModel) (string, uint64, bool) {
+		if m.Architecture == "" || m.Architecture == machine.Unknown {
+			if inventory == nil {
+				return "", 0, false
+			}
+
+			return string(inventory.Architecture), 0, true
+		}
+
+		return string(m.Architecture), 0, true
+	}},
+	"name": {text, func(m *machine.MachineModel, _ *machine.InventoryModel) (string, uint64, bool) {
+		return m.Name, 0, true
+	}},
+	"firmware": {text, fromInventory(func(inventory *machine.InventoryModel) (string, uint64) {
+		return string(inventory.Firmware), 0
+	})},
+	"cores": {count, fromInventory(func(inventory *machine.InventoryModel) (string, uint64) {
+		return "", uint64(inventory.CPUCores)
+	})},
+	"threads": {count, fromInventory(func(inventory *machine.InventoryModel) (string, uint64) {
+		return "", uint64(inventory.CPUThreads)
+	})},
+	"mem": {bytes, fromInventory(func(inventory *machine.InventoryModel) (string, uint64) {
+		return "", inventory.Memory
+	})},
+	// disk is the size of the largest disk, which is the one BAAS writes the images to
+	"disk": {bytes, fromInventory(func(inventory *machine.InventoryModel) (string, uint64) {
+		var largest uint64
+		for _, disk := range inventory.Disks {
+			if disk.Size > largest {
+				largest = disk.Size
+			}
+		}
+
+		return "", largest
+	})},
+	"gpus": {count, fromInventory(func(inventory *machine.InventoryModel) (string, uint64) {
+		return "", uint64(inventory.GPUs)
+	})},
+	// nic is the speed of the fastest network interface in Mbit/s
+	"nic": {speed, fromInventory(func(inventory *machine.InventoryModel) (string, uint64) {
+		var fastest uint64
+		for _, nic := range inventory.NICs {
+			if uint64(nic.Speed) > fastest {
+				fastest = uint64(nic.Speed)
+			}
+		}
+
+		return "", fastest
+	})},
+}
+
+// fromInventory creates the value function of a property of the hardware, which is not known without an inventory
+func fromInventory(value func(inventory *machine.InventoryModel) (string, uint64)) func(
+	*machine.MachineModel, *machine.InventoryModel) (string, uint64, bool) {
+	return func(_ *machine.MachineModel, inventory *machine.InventoryModel) (string, uint64, bool) {
+		if inventory == nil {
+			return "", 0, false
+		}
+
+		s, n := value(inventory)
+		return s, n, true
+	}
+}
+
+// Constraint is a requirement a machine has to satisfy
+type Constraint struct {
+	Key      string
+	Operator Operator
+	Value    string
+
+	// amount is the value as a number, for the properties which are compared as numbers
+	amount uint64
+}
+
+// Constraints are satisfied when each of them is
+type Constraints []Constraint
+
+// Parse reads constraints separated by commas, like "arch=x86_64, mem>=64G, label:numa=2". Sizes take the binary
+// suffixes K, M, G and T, speeds are in Mbit/s and take M and G. A label without an operator only has to exist.
+func Parse(s string) (Constraints, error) {
+	var constraints Constraints
+	for _, part := range strings.Split(s, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+
+		c, err := parseConstraint(part)
+		if err != nil {
+			return nil, err
+		}
+
+		constraints = append(constraints, c)
+	}
+
+	return constraints, nil
+}
+
+func parseConstraint(s string) (Constraint, error) {
+	// The constraint is split at the first operator, the value may hold operators itself
+	c := Constraint{Key: s, Operator: Present}
+	at := -1
+	for _, op := range operators {
+		if i := strings.Index(s, string(op)); i >= 0 && (at < 0 || i < at) {
+			at = i
+			c = Constraint{
+				Key:      strings.TrimSpace(s[:i]),
+				Operator: op,
+				Value:    strings.TrimSpace(s[i+len(op):]),
+			}
+		}
+	}
+
+	if strings.HasPrefix(c.Key, labelPrefix) {
+		if strings.TrimPrefix(c.Key, labelPrefix) == "" {
+			return c, errors.Errorf("constraint %q has no label", s)
+		}
+
+		if c.Operator != Present && c.Operator != Equal && c.Operator != NotEqual {
+			return c, errors.Errorf("labels can only be compared with = and !=, not %s", c.Operator)
+		}
+
+		return c, nil
+	}
+
+	p, ok := properties[strings.ToLower(c.Key)]
+	if !ok {
+		return c, errors.Errorf("unknown key %q in constraint %q", c.Key, s)
+	}
+	c.Key = strings.ToLower(c.Key)
+
+	if c.Operator == Present {
+		return c, errors.Errorf("constraint %q has no operator", s)
+	}
+
+	if p.kind == text {
+		if c.Operator != Equal && c.Operator != NotEqual {
+			return c, errors.Errorf("%s can only be compared with = and !=, not %s", c.Key, c.Operator)
+		}
+
+		return c, nil
+	}
+
+	var err error
+	c.amount, err = parseAmount(c.Value, p.kind)
+	if err != nil {
+		return c, errors.Wrapf(err, "constraint %q", s)
+	}
+
+	return c, nil
+}
+
+// parseAmount reads a number with the suffixes of its kind
+func parseAmount(s string, k kind) (uint64, error) {
+	multipliers := map[string]uint64{}
+	switch k {
+	case bytes:
+		multipliers = map[string]uint64{"K": 1 << 10, "M": 1 << 20, "G": 1 << 30, "T": 1 << 40}
+	case speed:
+		multipliers = map[string]uint64{"M": 1, "G": 1000}
+	}
+
+	number := strings.ToUpper(s)
+	multiplier := uint64(1)
+	for suffix, m := range multipliers {
+		if strings.HasSuffix(number, suffix) || strings.HasSuffix(number, suffix+"B") {
+			number = strings.TrimSuffix(strings.TrimSuffix(number, "B"), suffix)
+			multiplier = m
+			break
+		}
+	}
+
+	n, err := strconv.ParseUint(strings.TrimSpace(number), 10, 64)
+	if err != nil {
+		return 0, errors.Errorf("invalid amount %q", s)
+	}
+
+	if n > math.MaxUint64/multiplier {
+		return 0, errors.Errorf("amount %q is too large", s)
+	}
+
+	return n * multiplier, nil
+}
+
+// Matches checks whether the machine satisfies the constraint. The inventory may be nil, then only the constraints
+// which do not need it can be satisfied.
+func (c Constraint) Matches(m *machine.MachineModel, inventory *machine.InventoryModel) bool {
+	if strings.HasPrefix(c.Key, labelPrefix) {
+		value, ok := m.Labels[strings.TrimPrefix(c.Key, labelPrefix)]
+		switch c.Operator {
+		case Present:
+			return ok
+		case Equal:
+			return ok && value == c.Value
+		default:
+			return !ok || value != c.Value
+		}
+	}
+
+	p := properties[c.Key]
+	s, n, ok := p.value(m, inventory)
+	if !ok {
+		return false
+	}
+
+	if p.kind == text {
+		return strings.EqualFold(s, c.Value) == (c.Operator == Equal)
+	}
+
+	switch c.Operator {
+	case Equal:
+		return n == c.amount
+	case NotEqual:
+		return n != c.amount
+	case AtLeast:
+		return n >= c.amount
+	case AtMost:
+		return n <= c.amount
+	case Above:
+		return n > c.amount
+	case Below:
+		return n < c.amount
+	}
+
+	return false
+}
+
+// Matches checks whether the machine satisfies all of the constraints
+func (constraints Constraints) Matches(m *machine.MachineModel, inventory *machine.InventoryModel) bool {
+	for _, c := range constraints {
+		if !c.Matches(m, inventory) {
+			return false
+		}
+	}
+
+	return true
+}
+
+// String writes the constraints the way they are parsed
+func (constraints Constraints) String() string {
+	parts := make([]string, 0, len(constraints))
+	for _, c := range constraints {
+		parts = append(parts, c.Key+string(c.Operator)+c.Value)
+	}
+
+	return strings.Join(parts, ", ")
+}
+
+// Candidates returns the managed machines which satisfy the constraints, ordered by name. Whether they are free is
+// up to the caller, who tries them in this order.
+func Candidates(store database.Store, constraints Constraints) ([]machine.MachineModel, error) {
+	machines, err := store.GetMachines()
+	if err != nil {
+		return nil, errors.Wrap(err, "get machines")
+	}
+
+	var managed []machine.MachineModel
+	for _, m := range machines {
+		if m.Managed {
+			managed = append(managed, m)
+		}
+	}
+
+	candidates, err := Filter(store, managed, constraints)
+	if err != nil {
+		return nil, err
+	}
+
+	sort.Slice(candidates, func(i, j int) bool { return candidates[i].Name < candidates[j].Name })
+	return candidates, nil
+}
+
+// Filter returns the machines which satisfy the constraints, their inventories are taken from the store
+func Filter(store database.Store, machines []machine.MachineModel,
+	constraints Constraints) ([]machine.MachineModel, error) {
+	var matching []machine.MachineModel
+	for i := range machines {
+		m := &machines[i]
+		inventory, err := store.GetMachineInventory(m.MacAddress.Address)
+		if err == gorm.ErrRecordNotFound {
+			inventory = nil
+		} else if err != nil {
+			return nil, errors.Wrap(err, "get machine inventory")
+		}
+
+		if constraints.Matches(m, inventory) {
+			matching = append(matching, *m)
+		}
+	}
+
+	return matching, nil
+}
@@ -0,0 +1,124 @@
+// Copyright (c) 2020-2022 TU Delft & Valentijn van de Beek <v.d.vandebeek@student.tudelft.nl> All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package placement
+
+import (
+	"testing"
+	"time"
+
+	"github.com/baas-project/baas/pkg/database/memory"
+	"github.com/baas-project/baas/pkg/model/machine"
+	"github.com/baas-project/baas/pkg/util"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParse(t *testing.T) {
+	constraints, err := Parse("arch=x86_64, mem>=64G, label:numa=2, label:gpu, nic>=10G, disk>512GB, cores!=4")
+	assert.NoError(t, err)
+	assert.Len(t, constraints, 7)
+
+	assert.Equal(t, Constraint{Key: "arch", Operator: Equal, Value: "x86_64"}, constraints[0])
+	assert.Equal(t, AtLeast, constraints[1].Operator)
+	assert.Equal(t, uint64(64<<30), constraints[1].amount)
+	assert.Equal(t, Constraint{Key: "label:numa", Operator: Equal, Value: "2"}, constraints[2])
+	assert.Equal(t, Present, constraints[3].Operator)
+	assert.Equal(t, uint64(10000), constraints[4].amount)
+	assert.Equal(t, Above, constraints[5].Operator)
+	assert.Equal(t, uint64(512<<30), constraints[5].amount)
+	assert.Equal(t, NotEqual, constraints[6].Operator)
+
+	assert.Equal(t, "arch=x86_64, mem>=64G, label:numa=2, label:gpu, nic>=10G, disk>512GB, cores!=4",
+		constraints.String())
+
+	// Only the first operator splits the constraint
+	constraints, err = Parse("label:rack=a>=b")
+	assert.NoError(t, err)
+	assert.Equal(t, Constraint{Key: "label:rack", Operator: Equal, Value: "a>=b"}, constraints[0])
+
+	constraints, err = Parse("")
+	assert.NoError(t, err)
+	assert.Empty(t, constraints)
+
+	for _, invalid := range []string{"colour=red", "mem>=lots", "arch>=x86_64", "cores", "label:=2",
+		"label:numa>2", "mem>=16777216T"} {
+		_, err = Parse(invalid)
+		assert.Error(t, err, invalid)
+	}
+}
+
+func TestMatches(t *testing.T) {
+	m := &machine.MachineModel{
+		Name:         "node-1",
+		Architecture: machine.X86_64,
+		Labels:       machine.Labels{"numa": "2"},
+	}
+
+	inventory := &machine.InventoryModel{
+		CPUCores: 16,
+		Memory:   64 << 30,
+		Disks:    machine.Disks{{Name: "sda", Size: 256 << 30}, {Name: "nvme0n1", Size: 1 << 40}},
+		NICs:     machine.NICs{{Name: "eno1", Speed: 1000}, {Name: "ens1f0", Speed: 25000}},
+		GPUs:     1,
+		Firmware: machine.UEFI,
+	}
+
+	matches := func(s string, inventory *machine.InventoryModel) bool {
+		constraints, err := Parse(s)
+		assert.NoError(t, err)
+		return constraints.Matches(m, inventory)
+	}
+
+	assert.True(t, matches("arch=X86_64, mem>=64G, label:numa=2", inventory))
+	assert.True(t, matches("disk>=1T, nic>=10G, gpus>0, firmware=uefi, name!=node-2", inventory))
+	assert.True(t, matches("label:rack!=b4, cores<32", inventory))
+	assert.False(t, matches("mem>64G", inventory))
+	assert.False(t, matches("label:numa=4", inventory))
+	assert.False(t, matches("label:rack", inventory))
+	assert.False(t, matches("arch=arm64", inventory))
+
+	// Without an inventory nothing is known about the hardware
+	assert.True(t, matches("arch=x86_64, label:numa", nil))
+	assert.False(t, matches("cores>=1", nil))
+	assert.False(t, matches("gpus=0", nil))
+}
+
+func TestCandidates(t *testing.T) {
+	store := memory.NewStore()
+	for _, m := range []machine.MachineModel{
+		{Name: "small", MacAddress: util.MacAddress{Address: "a"}, Managed: true, Architecture: machine.X86_64},
+		{Name: "large", MacAddress: util.MacAddress{Address: "b"}, Managed: true, Architecture: machine.X86_64},
+		{Name: "discovered", MacAddress: util.MacAddress{Address: "c"}, Architecture: machine.X86_64},
+		{Name: "arm", MacAddress: util.MacAddress{Address: "d"}, Managed: true, Architecture: machine.Arm64},
+	} {
+		m := m
+		assert.NoError(t, store.CreateMachine(&m))
+	}
+
+	for mac, memory := range map[string]uint64{"a": 8 << 30, "b": 128 << 30, "c": 256 << 30} {
+		err := store.SetMachineInventory(&machine.InventoryModel{MachineMAC: mac, Memory: memory, Time: time.Now()})
+		assert.NoError(t, err)
+	}
+
+	names := func(s string) []string {
+		constraints, err := Parse(s)
+		assert.NoError(t, err)
+
+		candidates, err := Candidates(store, constraints)
+		assert.NoError(t, err)
+
+		var names []string
+		for _, m := range candidates {
+			names = append(names, m.Name)
+		}
+
+		return names
+	}
+
+	// Machines which are not managed are never picked
+	assert.Equal(t, []string{"large"}, names("mem>=64G"))
+	assert.Equal(t, []string{"large", "small"}, names("arch=x86_64"))
+	assert.Equal(t, []string{"arm", "large", "small"}, names(""))
+	assert.Empty(t, names("mem>=1T"))
+}
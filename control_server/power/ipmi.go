@@ -0,0 +1,114 @@
+// Copyright (c) 2020-2022 TU Delft & Valentijn van de Beek <v.d.vandebeek@student.tudelft.nl> All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package power
+
+import (
+	"net"
+	"os"
+	"os/exec"
+	"strings"
+
+	"github.com/baas-project/baas/pkg/model/machine"
+	"github.com/pkg/errors"
+)
+
+// ipmi controls a machine with IPMI over LAN through ipmitool, which has to be installed on the control server
+type ipmi struct {
+	config machine.PowerModel
+
+	// run runs ipmitool with the arguments and returns its output, tests replace it
+	run func(args ...string) ([]byte, error)
+}
+
+func newIPMI(config machine.PowerModel) (Controller, error) {
+	i := &ipmi{config: config}
+	i.run = i.ipmitool
+	return i, nil
+}
+
+// ipmitool runs the command against the controller. The password is passed in the environment, so it does not
+// show up in the list of processes.
+func (i *ipmi) ipmitool(args ...string) ([]byte, error) {
+	cmd := exec.Command("ipmitool", args...)
+	cmd.Env = append(os.Environ(), "IPMI_PASSWORD="+i.config.Password)
+
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		return out, errors.Wrapf(err, "ipmitool %s: %s", strings.Join(args, " "), strings.TrimSpace(string(out)))
+	}
+
+	return out, nil
+}
+
+// command runs an ipmitool command over the lanplus interface
+func (i *ipmi) command(command ...string) (string, error) {
+	args := []string{"-I", "lanplus"}
+
+	host, port, err := net.SplitHostPort(i.config.Address)
+	if err != nil {
+		host = i.config.Address
+	}
+
+	args = append(args, "-H", host)
+	if port != "" {
+		args = append(args, "-p", port)
+	}
+
+	if i.config.Username != "" {
+		args = append(args, "-U", i.config.Username)
+	}
+
+	args = append(args, "-E")
+	out, err := i.run(append(args, command...)...)
+	return string(out), err
+}
+
+func (i *ipmi) On() error {
+	_, err := i.command("chassis", "power", "on")
+	return err
+}
+
+func (i *ipmi) Off() error {
+	_, err := i.command("chassis", "power", "off")
+	return err
+}
+
+// Cycle switches a machine which is off on, a power cycle is refused by most controllers when it is off
+func (i *ipmi) Cycle() error {
+	state, err := i.Status()
+	if err != nil {
+		return err
+	}
+
+	if state == Off {
+		return i.On()
+	}
+
+	_, err = i.command("chassis", "power", "cycle")
+	return err
+}
+
+// Status reads the state from the output of ipmitool, which is "Chassis Power is on" or "Chassis Power is off"
+func (i *ipmi) Status() (State, error) {
+	out, err := i.command("chassis", "power", "status")
+	if err != nil {
+		return Unknown, err
+	}
+
+	switch strings.TrimSpace(strings.TrimPrefix(strings.TrimSpace(out), "Chassis Power is")) {
+	case "on":
+		return On, nil
+	case "off":
+		return Off, nil
+	default:
+		return Unknown, nil
+	}
+}
+
+// NetworkBootOnce sets the boot device to PXE, without the persistent option this only holds for the next boot
+func (i *ipmi) NetworkBootOnce() error {
+	_, err := i.command("chassis", "bootdev", "pxe")
+	return err
+}
@@ -0,0 +1,104 @@
+// Copyright (c) 2020-2022 TU Delft & Valentijn van de Beek <v.d.vandebeek@student.tudelft.nl> All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package power switches machines on and off through their baseboard management controller, so a machine can be
+// reprovisioned without anyone at the machine. Every protocol is a driver, IPMI over LAN and Redfish are built in.
+package power
+
+import (
+	"sort"
+	"sync"
+
+	"github.com/baas-project/baas/pkg/model/machine"
+	"github.com/pkg/errors"
+)
+
+// ErrUnknownDriver is returned when the power controller of a machine uses a driver which is not registered
+var ErrUnknownDriver = errors.New("unknown power driver")
+
+// State is whether a machine is powered on
+type State string
+
+const (
+	// On means the machine is running
+	On State = "on"
+	// Off means the machine is switched off
+	Off State = "off"
+	// Unknown is a state the controller reported which does not map to on or off
+	Unknown State = "unknown"
+)
+
+// Controller controls the power of a single machine
+type Controller interface {
+	// On switches the machine on, nothing happens if it is on already
+	On() error
+	// Off switches the machine off right away, without shutting down its operating system
+	Off() error
+	// Cycle restarts the machine, a machine which is off is switched on
+	Cycle() error
+	// Status returns whether the machine is on
+	Status() (State, error)
+	// NetworkBootOnce makes the machine boot from the network the next time it starts, after that it boots as usual
+	NetworkBootOnce() error
+}
+
+// Driver creates the controller of a machine from its settings
+type Driver func(config machine.PowerModel) (Controller, error)
+
+var (
+	driversMutex sync.RWMutex
+	drivers      = map[string]Driver{
+		"ipmi":    newIPMI,
+		"redfish": newRedfish,
+	}
+)
+
+// Register adds a driver, or replaces the driver with the same name
+func Register(name string, driver Driver) {
+	driversMutex.Lock()
+	defer driversMutex.Unlock()
+
+	drivers[name] = driver
+}
+
+// Drivers returns the names of the registered drivers
+func Drivers() []string {
+	driversMutex.RLock()
+	defer driversMutex.RUnlock()
+
+	names := make([]string, 0, len(drivers))
+	for name := range drivers {
+		names = append(names, name)
+	}
+
+	sort.Strings(names)
+	return names
+}
+
+// New creates the controller of a machine with the driver given in its settings
+func New(config machine.PowerModel) (Controller, error) {
+	driversMutex.RLock()
+	driver, ok := drivers[config.Driver]
+	driversMutex.RUnlock()
+
+	if !ok {
+		return nil, errors.Wrapf(ErrUnknownDriver, "driver %q", config.Driver)
+	}
+
+	if config.Address == "" {
+		return nil, errors.New("no address given for the power controller")
+	}
+
+	return driver(config)
+}
+
+// RebootFromNetwork makes the machine boot from the network once and restarts it, so it boots into the management
+// OS and picks up the setup which was queued for it
+func RebootFromNetwork(c Controller) error {
+	if err := c.NetworkBootOnce(); err != nil {
+		return errors.Wrap(err, "set network boot")
+	}
+
+	return errors.Wrap(c.Cycle(), "power cycle")
+}
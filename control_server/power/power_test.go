@@ -0,0 +1,146 @@
+// Copyright (c) 2020-2022 TU Delft & Valentijn van de Beek <v.d.vandebeek@student.tudelft.nl> All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package power
+
+import (
+	"testing"
+
+	"github.com/baas-project/baas/control_server/power/redfishtest"
+	"github.com/baas-project/baas/pkg/model/machine"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNew(t *testing.T) {
+	_, err := New(machine.PowerModel{Driver: "serial", Address: "10.0.0.5"})
+	assert.Equal(t, ErrUnknownDriver, errors.Cause(err))
+
+	_, err = New(machine.PowerModel{Driver: "ipmi"})
+	assert.Error(t, err)
+
+	c, err := New(machine.PowerModel{Driver: "ipmi", Address: "10.0.0.5"})
+	assert.NoError(t, err)
+	assert.IsType(t, &ipmi{}, c)
+
+	assert.Equal(t, []string{"ipmi", "redfish"}, Drivers())
+}
+
+func TestRegister(t *testing.T) {
+	Register("fake", func(config machine.PowerModel) (Controller, error) {
+		return nil, errors.New("fake driver")
+	})
+	defer func() {
+		driversMutex.Lock()
+		delete(drivers, "fake")
+		driversMutex.Unlock()
+	}()
+
+	assert.Contains(t, Drivers(), "fake")
+
+	_, err := New(machine.PowerModel{Driver: "fake", Address: "10.0.0.5"})
+	assert.EqualError(t, err, "fake driver")
+}
+
+func TestIPMI(t *testing.T) {
+	var calls [][]string
+	status := "Chassis Power is off\n"
+
+	c, err := newIPMI(machine.PowerModel{Driver: "ipmi", Address: "10.0.0.5:6230", Username: "admin"})
+	assert.NoError(t, err)
+
+	i := c.(*ipmi)
+	i.run = func(args ...string) ([]byte, error) {
+		calls = append(calls, args)
+		if args[len(args)-1] == "status" {
+			return []byte(status), nil
+		}
+
+		return []byte{}, nil
+	}
+
+	state, err := c.Status()
+	assert.NoError(t, err)
+	assert.Equal(t, Off, state)
+	assert.Equal(t, []string{"-I", "lanplus", "-H", "10.0.0.5", "-p", "6230", "-U", "admin", "-E",
+		"chassis", "power", "status"}, calls[0])
+
+	// A machine which is off is switched on instead of power cycled
+	calls = nil
+	assert.NoError(t, RebootFromNetwork(c))
+	assert.Len(t, calls, 3)
+	assert.Equal(t, []string{"chassis", "bootdev", "pxe"}, calls[0][9:])
+	assert.Equal(t, []string{"chassis", "power", "on"}, calls[2][9:])
+
+	calls = nil
+	status = "Chassis Power is on\n"
+	assert.NoError(t, c.Cycle())
+	assert.Equal(t, []string{"chassis", "power", "cycle"}, calls[1][9:])
+
+	calls = nil
+	assert.NoError(t, c.Off())
+	assert.Equal(t, []string{"chassis", "power", "off"}, calls[0][9:])
+
+	status = "Error: Unable to establish IPMI v2 / RMCP+ session"
+	state, err = c.Status()
+	assert.NoError(t, err)
+	assert.Equal(t, Unknown, state)
+
+	// Without a port or username, ipmitool uses its defaults
+	i.config = machine.PowerModel{Driver: "ipmi", Address: "bmc.example.com"}
+	calls = nil
+	assert.NoError(t, c.On())
+	assert.Equal(t, []string{"-I", "lanplus", "-H", "bmc.example.com", "-E", "chassis", "power", "on"}, calls[0])
+}
+
+func TestRedfish(t *testing.T) {
+	server := redfishtest.NewServer("admin", "secret")
+	defer server.Close()
+
+	c, err := New(machine.PowerModel{Driver: "redfish", Address: server.URL, Username: "admin",
+		Password: "secret"})
+	assert.NoError(t, err)
+
+	state, err := c.Status()
+	assert.NoError(t, err)
+	assert.Equal(t, Off, state)
+
+	// A machine which is off is switched on, and boots from the network once
+	assert.NoError(t, RebootFromNetwork(c))
+	assert.Equal(t, "On", server.PowerState())
+	assert.Equal(t, 1, server.NetworkBoots())
+	enabled, _ := server.BootOverride()
+	assert.Equal(t, "Disabled", enabled)
+
+	// The next restart boots as usual
+	assert.NoError(t, c.Cycle())
+	assert.Equal(t, 1, server.NetworkBoots())
+	assert.Equal(t, []string{"On", "ForceRestart"}, server.Resets())
+
+	assert.NoError(t, RebootFromNetwork(c))
+	assert.Equal(t, 2, server.NetworkBoots())
+
+	assert.NoError(t, c.Off())
+	state, err = c.Status()
+	assert.NoError(t, err)
+	assert.Equal(t, Off, state)
+
+	// The system can be given explicitly
+	c, err = New(machine.PowerModel{Driver: "redfish", Address: server.URL, Username: "admin",
+		Password: "secret", SystemID: "1"})
+	assert.NoError(t, err)
+	assert.NoError(t, c.On())
+	assert.Equal(t, "On", server.PowerState())
+
+	c, err = New(machine.PowerModel{Driver: "redfish", Address: server.URL, Username: "admin",
+		Password: "wrong"})
+	assert.NoError(t, err)
+	_, err = c.Status()
+	assert.Error(t, err)
+
+	c, err = New(machine.PowerModel{Driver: "redfish", Address: server.URL, Username: "admin",
+		Password: "secret", SystemID: "2"})
+	assert.NoError(t, err)
+	assert.Error(t, c.On())
+}
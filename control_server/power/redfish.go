@@ -0,0 +1,209 @@
+// Copyright (c) 2020-2022 TU Delft & Valentijn van de Beek <v.d.vandebeek@student.tudelft.nl> All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package power
+
+import (
+	"bytes"
+	"crypto/tls"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/baas-project/baas/pkg/model/machine"
+	"github.com/pkg/errors"
+)
+
+// redfishTimeout is how long a request to a Redfish controller may take, they tend to be slow
+const redfishTimeout = 30 * time.Second
+
+// redfishSystems is the collection of the systems a Redfish controller manages
+const redfishSystems = "/redfish/v1/Systems"
+
+// redfish controls a machine through the Redfish REST API of its controller
+type redfish struct {
+	config machine.PowerModel
+	client *http.Client
+	// base is the scheme and host of the controller
+	base string
+}
+
+// redfishSystem is the part of a ComputerSystem resource the driver uses
+type redfishSystem struct {
+	PowerState string
+	Actions    struct {
+		Reset struct {
+			Target string `json:"target"`
+		} `json:"#ComputerSystem.Reset"`
+	}
+}
+
+func newRedfish(config machine.PowerModel) (Controller, error) {
+	base := strings.TrimSuffix(config.Address, "/")
+	if !strings.Contains(base, "://") {
+		base = "https://" + base
+	}
+
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.TLSClientConfig = &tls.Config{InsecureSkipVerify: config.Insecure} // nolint: gosec
+
+	return &redfish{
+		config: config,
+		client: &http.Client{Transport: transport, Timeout: redfishTimeout},
+		base:   base,
+	}, nil
+}
+
+// do sends a request to the controller and decodes the JSON of the response into out, if it is not nil
+func (r *redfish) do(method string, path string, body interface{}, out interface{}) error {
+	var reader io.Reader
+	if body != nil {
+		data, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+
+		reader = bytes.NewReader(data)
+	}
+
+	req, err := http.NewRequest(method, r.base+path, reader)
+	if err != nil {
+		return err
+	}
+
+	req.SetBasicAuth(r.config.Username, r.config.Password)
+	req.Header.Set("Accept", "application/json")
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+
+	resp, err := r.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		message, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 1024))
+		return errors.Errorf("%s %s: %s: %s", method, path, resp.Status, strings.TrimSpace(string(message)))
+	}
+
+	if out == nil {
+		return nil
+	}
+
+	return errors.Wrap(json.NewDecoder(resp.Body).Decode(out), "decode response")
+}
+
+// system returns the path of the system of the machine, the first one of the controller if none is configured
+func (r *redfish) system() (string, error) {
+	if r.config.SystemID != "" {
+		return redfishSystems + "/" + r.config.SystemID, nil
+	}
+
+	var systems struct {
+		Members []struct {
+			ID string `json:"@odata.id"`
+		}
+	}
+
+	if err := r.do(http.MethodGet, redfishSystems, nil, &systems); err != nil {
+		return "", errors.Wrap(err, "list systems")
+	}
+
+	if len(systems.Members) == 0 {
+		return "", errors.New("the controller manages no systems")
+	}
+
+	return systems.Members[0].ID, nil
+}
+
+// getSystem fetches the system of the machine and returns it with its path
+func (r *redfish) getSystem() (string, *redfishSystem, error) {
+	path, err := r.system()
+	if err != nil {
+		return "", nil, err
+	}
+
+	var system redfishSystem
+	if err = r.do(http.MethodGet, path, nil, &system); err != nil {
+		return "", nil, errors.Wrap(err, "get system")
+	}
+
+	return path, &system, nil
+}
+
+// reset performs the reset action of the system with the given type, like On or ForceOff
+func (r *redfish) reset(resetType string) error {
+	path, system, err := r.getSystem()
+	if err != nil {
+		return err
+	}
+
+	target := system.Actions.Reset.Target
+	if target == "" {
+		target = path + "/Actions/ComputerSystem.Reset"
+	}
+
+	return r.do(http.MethodPost, target, map[string]string{"ResetType": resetType}, nil)
+}
+
+func (r *redfish) On() error {
+	return r.reset("On")
+}
+
+func (r *redfish) Off() error {
+	return r.reset("ForceOff")
+}
+
+// Cycle restarts a machine which is on and switches on a machine which is off, which a restart does not do
+func (r *redfish) Cycle() error {
+	state, err := r.Status()
+	if err != nil {
+		return err
+	}
+
+	if state == Off {
+		return r.On()
+	}
+
+	return r.reset("ForceRestart")
+}
+
+// Status maps the power state of the system, the transitions count as the state they go to
+func (r *redfish) Status() (State, error) {
+	_, system, err := r.getSystem()
+	if err != nil {
+		return Unknown, err
+	}
+
+	switch system.PowerState {
+	case "On", "PoweringOn":
+		return On, nil
+	case "Off", "PoweringOff":
+		return Off, nil
+	default:
+		return Unknown, nil
+	}
+}
+
+// NetworkBootOnce overrides the boot source with PXE for the next boot only
+func (r *redfish) NetworkBootOnce() error {
+	path, err := r.system()
+	if err != nil {
+		return err
+	}
+
+	body := map[string]interface{}{
+		"Boot": map[string]string{
+			"BootSourceOverrideEnabled": "Once",
+			"BootSourceOverrideTarget":  "Pxe",
+		},
+	}
+
+	return errors.Wrap(r.do(http.MethodPatch, path, body, nil), "set boot override")
+}
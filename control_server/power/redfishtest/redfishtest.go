@@ -0,0 +1,220 @@
+// Copyright (c) 2020-2022 TU Delft & Valentijn van de Beek <v.d.vandebeek@student.tudelft.nl> All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package redfishtest runs a local Redfish controller with a single system, so the power drivers and whatever uses
+// them can be tested without hardware. It only implements what the Redfish driver uses: listing the systems,
+// reading a system, resetting it and overriding its boot source.
+package redfishtest
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+)
+
+// SystemPath is the path of the only system of the controller
+const SystemPath = "/redfish/v1/Systems/1"
+
+// Server is a Redfish controller which keeps the state of its system in memory
+type Server struct {
+	*httptest.Server
+
+	username string
+	password string
+
+	mutex        sync.Mutex
+	powerState   string
+	bootEnabled  string
+	bootTarget   string
+	resets       []string
+	networkBoots int
+}
+
+// NewServer starts a controller whose system is off. Requests have to authenticate with the username and password.
+// The server has to be closed when the test is done.
+func NewServer(username string, password string) *Server {
+	s := &Server{
+		username:    username,
+		password:    password,
+		powerState:  "Off",
+		bootEnabled: "Disabled",
+		bootTarget:  "None",
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/redfish/v1/Systems", s.systems)
+	mux.HandleFunc(SystemPath, s.system)
+	mux.HandleFunc(SystemPath+"/Actions/ComputerSystem.Reset", s.reset)
+
+	s.Server = httptest.NewServer(s.authenticate(mux))
+	return s
+}
+
+// PowerState returns the power state of the system, On or Off
+func (s *Server) PowerState() string {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	return s.powerState
+}
+
+// Resets returns the reset types the system received, in order
+func (s *Server) Resets() []string {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	return append([]string(nil), s.resets...)
+}
+
+// NetworkBoots returns how often the system started from the network
+func (s *Server) NetworkBoots() int {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	return s.networkBoots
+}
+
+// BootOverride returns whether the boot source is overridden and with what
+func (s *Server) BootOverride() (enabled string, target string) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	return s.bootEnabled, s.bootTarget
+}
+
+func (s *Server) authenticate(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		username, password, ok := r.BasicAuth()
+		if !ok || username != s.username || password != s.password {
+			http.Error(w, `{"error": "unauthorized"}`, http.StatusUnauthorized)
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+func (s *Server) systems(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	writeJSON(w, map[string]interface{}{
+		"@odata.id":           "/redfish/v1/Systems",
+		"Members@odata.count": 1,
+		"Members":             []map[string]string{{"@odata.id": SystemPath}},
+	})
+}
+
+func (s *Server) system(w http.ResponseWriter, r *http.Request) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	switch r.Method {
+	case http.MethodGet:
+		writeJSON(w, map[string]interface{}{
+			"@odata.id":  SystemPath,
+			"Id":         "1",
+			"PowerState": s.powerState,
+			"Boot": map[string]string{
+				"BootSourceOverrideEnabled": s.bootEnabled,
+				"BootSourceOverrideTarget":  s.bootTarget,
+			},
+			"Actions": map[string]interface{}{
+				"#ComputerSystem.Reset": map[string]interface{}{
+					"target": SystemPath + "/Actions/ComputerSystem.Reset",
+					"ResetType@Redfish.AllowableValues": []string{
+						"On", "ForceOff", "GracefulShutdown", "ForceRestart", "GracefulRestart",
+					},
+				},
+			},
+		})
+	case http.MethodPatch:
+		var body struct {
+			Boot struct {
+				BootSourceOverrideEnabled string
+				BootSourceOverrideTarget  string
+			}
+		}
+
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			http.Error(w, "invalid body", http.StatusBadRequest)
+			return
+		}
+
+		if body.Boot.BootSourceOverrideEnabled != "" {
+			s.bootEnabled = body.Boot.BootSourceOverrideEnabled
+		}
+
+		if body.Boot.BootSourceOverrideTarget != "" {
+			s.bootTarget = body.Boot.BootSourceOverrideTarget
+		}
+
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+func (s *Server) reset(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var body struct{ ResetType string }
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		http.Error(w, "invalid body", http.StatusBadRequest)
+		return
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	switch body.ResetType {
+	case "On":
+		if s.powerState == "Off" {
+			s.start()
+		}
+	case "ForceOff", "GracefulShutdown":
+		s.powerState = "Off"
+	case "ForceRestart", "GracefulRestart":
+		if s.powerState == "Off" {
+			http.Error(w, "the system is off", http.StatusConflict)
+			return
+		}
+
+		s.start()
+	default:
+		http.Error(w, "unsupported reset type", http.StatusBadRequest)
+		return
+	}
+
+	s.resets = append(s.resets, body.ResetType)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// start boots the system, which uses up an override of the boot source for one boot. The lock has to be held.
+func (s *Server) start() {
+	s.powerState = "On"
+	if s.bootEnabled == "Disabled" {
+		return
+	}
+
+	if s.bootTarget == "Pxe" {
+		s.networkBoots++
+	}
+
+	if s.bootEnabled == "Once" {
+		s.bootEnabled = "Disabled"
+		s.bootTarget = "None"
+	}
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(v)
+}
@@ -0,0 +1,137 @@
+// Copyright (c) 2020-2022 TU Delft & Valentijn van de Beek <v.d.vandebeek@student.tudelft.nl> All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package progress passes the progress which the management OS reports about its transfers on to the clients which
+// follow the machine. Only the latest progress of every stage of an image is kept, and only in memory.
+package progress
+
+import (
+	"sync"
+
+	api_pkg "github.com/baas-project/baas/pkg/api"
+	"github.com/baas-project/baas/pkg/model/images"
+)
+
+// subscriberBuffer is the amount of updates a subscriber may fall behind, further updates are dropped for it
+const subscriberBuffer = 64
+
+// key identifies a stage of an image
+type key struct {
+	image images.ImageUUID
+	stage api_pkg.TransferStage
+}
+
+// machine is the progress of a machine and the clients following it
+type machine struct {
+	latest      map[key]api_pkg.TransferProgress
+	order       []key
+	subscribers map[chan api_pkg.TransferProgress]bool
+}
+
+// Hub keeps the latest progress of every machine and hands the updates to the subscribers of the machine
+type Hub struct {
+	mutex    sync.Mutex
+	machines map[string]*machine
+}
+
+// NewHub creates a hub without any progress
+func NewHub() *Hub {
+	return &Hub{machines: map[string]*machine{}}
+}
+
+// get returns the machine, the caller has to hold the lock
+func (h *Hub) get(mac string) *machine {
+	m, ok := h.machines[mac]
+	if !ok {
+		m = &machine{
+			latest:      map[key]api_pkg.TransferProgress{},
+			subscribers: map[chan api_pkg.TransferProgress]bool{},
+		}
+		h.machines[mac] = m
+	}
+
+	return m
+}
+
+// snapshot returns the latest progress of every stage, in the order the stages started
+func (m *machine) snapshot() []api_pkg.TransferProgress {
+	latest := make([]api_pkg.TransferProgress, 0, len(m.order))
+	for _, k := range m.order {
+		latest = append(latest, m.latest[k])
+	}
+
+	return latest
+}
+
+// Publish stores the progress of the machine and sends it to its subscribers. A subscriber which does not keep up
+// misses the update, the next one tells it how far the transfer is anyway.
+func (h *Hub) Publish(mac string, progress api_pkg.TransferProgress) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	m := h.get(mac)
+	k := key{progress.Image, progress.Stage}
+	if _, ok := m.latest[k]; !ok {
+		m.order = append(m.order, k)
+	}
+	m.latest[k] = progress
+
+	for subscriber := range m.subscribers {
+		select {
+		case subscriber <- progress:
+		default:
+		}
+	}
+}
+
+// Latest returns the latest progress of every stage of the machine, in the order the stages started
+func (h *Hub) Latest(mac string) []api_pkg.TransferProgress {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	m, ok := h.machines[mac]
+	if !ok {
+		return nil
+	}
+
+	return m.snapshot()
+}
+
+// Reset forgets the progress of the machine, its subscribers stay
+func (h *Hub) Reset(mac string) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	m, ok := h.machines[mac]
+	if !ok {
+		return
+	}
+
+	m.latest = map[key]api_pkg.TransferProgress{}
+	m.order = nil
+}
+
+// Subscribe returns the latest progress of the machine and a channel which receives the updates after it. The
+// channel is closed by the function which is returned, which has to be called once the updates are not needed.
+func (h *Hub) Subscribe(mac string) ([]api_pkg.TransferProgress, <-chan api_pkg.TransferProgress, func()) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	m := h.get(mac)
+	latest := m.snapshot()
+
+	updates := make(chan api_pkg.TransferProgress, subscriberBuffer)
+	m.subscribers[updates] = true
+
+	var once sync.Once
+	return latest, updates, func() {
+		once.Do(func() {
+			h.mutex.Lock()
+			defer h.mutex.Unlock()
+
+			delete(m.subscribers, updates)
+			close(updates)
+		})
+	}
+}
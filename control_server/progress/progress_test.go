@@ -0,0 +1,51 @@
+// Copyright (c) 2020-2022 TU Delft & Valentijn van de Beek <v.d.vandebeek@student.tudelft.nl> All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package progress
+
+import (
+	"testing"
+
+	api_pkg "github.com/baas-project/baas/pkg/api"
+	"github.com/baas-project/baas/pkg/model/images"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestHub(t *testing.T) {
+	hub := NewHub()
+	assert.Empty(t, hub.Latest("abc"))
+
+	hub.Publish("abc", api_pkg.TransferProgress{Image: "fedora", Stage: api_pkg.StageDownload, Done: 1})
+	hub.Publish("abc", api_pkg.TransferProgress{Image: "fedora", Stage: api_pkg.StageWrite, Done: 1})
+	hub.Publish("abc", api_pkg.TransferProgress{Image: "fedora", Stage: api_pkg.StageDownload, Done: 2})
+
+	// Only the latest progress of a stage is kept, in the order the stages started
+	latest, updates, stop := hub.Subscribe("abc")
+	assert.Len(t, latest, 2)
+	assert.Equal(t, api_pkg.StageDownload, latest[0].Stage)
+	assert.Equal(t, int64(2), latest[0].Done)
+	assert.Equal(t, api_pkg.StageWrite, latest[1].Stage)
+
+	// The subscribers only get the updates of their machine
+	hub.Publish("cba", api_pkg.TransferProgress{Image: "ubuntu", Stage: api_pkg.StageUpload})
+	hub.Publish("abc", api_pkg.TransferProgress{Image: "fedora", Stage: api_pkg.StageWrite, Done: 2})
+
+	update := <-updates
+	assert.Equal(t, images.ImageUUID("fedora"), update.Image)
+	assert.Equal(t, int64(2), update.Done)
+
+	// A subscriber which falls behind misses updates instead of holding up the machine
+	for i := 0; i < 2*subscriberBuffer; i++ {
+		hub.Publish("abc", api_pkg.TransferProgress{Image: "fedora", Stage: api_pkg.StageWrite, Done: int64(i)})
+	}
+	assert.Len(t, updates, subscriberBuffer)
+
+	stop()
+	stop()
+	hub.Publish("abc", api_pkg.TransferProgress{Image: "fedora", Stage: api_pkg.StageWrite})
+
+	hub.Reset("abc")
+	assert.Empty(t, hub.Latest("abc"))
+	assert.Len(t, hub.Latest("cba"), 1)
+}
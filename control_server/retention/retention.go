@@ -0,0 +1,232 @@
+// Copyright (c) 2020-2022 TU Delft & Valentijn van de Beek <v.d.vandebeek@student.tudelft.nl> All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package retention removes the old versions of images according to the retention policies of the images
+// and their owners. The latest version of an image and the versions used by an image setup are always kept.
+package retention
+
+import (
+	"io"
+	"sort"
+	"time"
+
+	"github.com/baas-project/baas/pkg/database"
+	"github.com/baas-project/baas/pkg/model/images"
+	"github.com/baas-project/baas/pkg/storage"
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+)
+
+// UploadLifetime is how long an upload may take before it is thrown away together with its data
+const UploadLifetime = 24 * time.Hour
+
+// Candidate is a version which the retention policy no longer keeps
+type Candidate struct {
+	Image    images.ImageUUID
+	Username string
+	Version  uint64
+	Created  time.Time
+	// Size is the size of the version file, with the chunked storage less may be freed as chunks are shared
+	Size int64
+
+	version images.Version
+}
+
+// Report lists the versions which are (or would be) removed
+type Report struct {
+	Versions []Candidate
+	Bytes    int64
+}
+
+// Collector periodically removes the versions which are not kept by the retention policies
+type Collector struct {
+	store    database.Store
+	files    storage.ImageFiles
+	interval time.Duration
+}
+
+// NewCollector creates a collector which removes versions from the store and their files from the backend
+func NewCollector(store database.Store, files storage.ImageFiles, interval time.Duration) *Collector {
+	return &Collector{
+		store:    store,
+		files:    files,
+		interval: interval,
+	}
+}
+
+// Run collects the old versions every interval, this function never returns.
+func (c *Collector) Run() {
+	log.Infof("Starting the image retention collector, collecting every %v", c.interval)
+
+	ticker := time.NewTicker(c.interval)
+	defer ticker.Stop()
+
+	for now := range ticker.C {
+		report, err := c.Collect(now)
+		if err != nil {
+			log.Errorf("Image retention collector: %v", err)
+		}
+
+		if report != nil && len(report.Versions) > 0 {
+			log.Infof("Image retention collector removed %d versions taking up %d bytes",
+				len(report.Versions), report.Bytes)
+		}
+
+		expired, err := c.ExpireUploads(now)
+		if err != nil {
+			log.Errorf("Image retention collector: %v", err)
+		}
+
+		if expired > 0 {
+			log.Infof("Image retention collector removed %d abandoned uploads", expired)
+		}
+	}
+}
+
+// ExpireUploads removes the uploads which were started more than UploadLifetime ago and returns how many
+func (c *Collector) ExpireUploads(now time.Time) (int, error) {
+	uploads, err := c.store.GetUploads()
+	if err != nil {
+		return 0, errors.Wrap(err, "get uploads")
+	}
+
+	expired := 0
+	for i := range uploads {
+		if uploads[i].CreatedAt.After(now.Add(-UploadLifetime)) {
+			continue
+		}
+
+		if err = c.store.DeleteUpload(&uploads[i]); err != nil {
+			return expired, errors.Wrapf(err, "delete upload %s", uploads[i].UUID)
+		}
+
+		if err = c.files.Discard(uploads[i].UUID); err != nil {
+			return expired, errors.Wrapf(err, "discard upload %s", uploads[i].UUID)
+		}
+
+		expired++
+	}
+
+	return expired, nil
+}
+
+// Plan reports which versions would be removed at the given time without removing them
+func (c *Collector) Plan(now time.Time) (*Report, error) {
+	allImages, err := c.store.GetImages()
+	if err != nil {
+		return nil, errors.Wrap(err, "get images")
+	}
+
+	pinnedIDs, err := c.store.GetPinnedVersions()
+	if err != nil {
+		return nil, errors.Wrap(err, "get pinned versions")
+	}
+
+	pinned := make(map[uint64]bool, len(pinnedIDs))
+	for _, id := range pinnedIDs {
+		pinned[id] = true
+	}
+
+	report := &Report{}
+	owners := make(map[string]images.RetentionPolicy)
+
+	for _, image := range allImages {
+		policy := image.Retention
+		if !policy.IsSet() {
+			policy = c.ownerPolicy(owners, image.Username)
+		}
+
+		if !policy.IsSet() {
+			continue
+		}
+
+		versions := image.Versions
+		sort.Slice(versions, func(i, j int) bool {
+			return versions[i].Version > versions[j].Version
+		})
+
+		// The newest version is skipped, new versions are based on it
+		for position := 1; position < len(versions); position++ {
+			version := versions[position]
+			if pinned[uint64(version.ID)] || policy.Keeps(position, version.CreatedAt, now) {
+				continue
+			}
+
+			candidate := Candidate{
+				Image:    image.UUID,
+				Username: image.Username,
+				Version:  version.Version,
+				Created:  version.CreatedAt,
+				Size:     c.size(image.UUID, version.Version),
+				version:  version,
+			}
+
+			report.Versions = append(report.Versions, candidate)
+			report.Bytes += candidate.Size
+		}
+	}
+
+	return report, nil
+}
+
+// Collect removes the versions which are not kept at the given time, both from the store and the backend
+func (c *Collector) Collect(now time.Time) (*Report, error) {
+	plan, err := c.Plan(now)
+	if err != nil {
+		return nil, err
+	}
+
+	report := &Report{}
+	for _, candidate := range plan.Versions {
+		// The version is removed first, so it is never offered without its file
+		if err = c.store.DeleteVersion(&candidate.version); err != nil {
+			return report, errors.Wrapf(err, "delete version %d of image %s", candidate.Version, candidate.Image)
+		}
+
+		for _, name := range []string{storage.VersionFile(candidate.Version), storage.DockerfileFile(candidate.Version)} {
+			if err = c.files.Remove(candidate.Image, name); err != nil {
+				return report, errors.Wrapf(err, "remove %s of image %s", name, candidate.Image)
+			}
+		}
+
+		report.Versions = append(report.Versions, candidate)
+		report.Bytes += candidate.Size
+	}
+
+	return report, nil
+}
+
+// ownerPolicy returns the policy of the user, the policies are cached in owners
+func (c *Collector) ownerPolicy(owners map[string]images.RetentionPolicy, username string) images.RetentionPolicy {
+	if policy, ok := owners[username]; ok {
+		return policy
+	}
+
+	// Images without a known owner only follow their own policy
+	owner, err := c.store.GetUserByUsername(username)
+	if err == nil {
+		owners[username] = owner.Retention
+	} else {
+		owners[username] = images.RetentionPolicy{}
+	}
+
+	return owners[username]
+}
+
+// size returns the size of the version file, 0 if it does not exist
+func (c *Collector) size(uuid images.ImageUUID, version uint64) int64 {
+	f, err := c.files.Open(uuid, storage.VersionFile(version))
+	if err != nil {
+		return 0
+	}
+
+	defer f.Close()
+
+	size, err := f.Seek(0, io.SeekEnd)
+	if err != nil {
+		return 0
+	}
+
+	return size
+}
@@ -0,0 +1,144 @@
+// Copyright (c) 2020-2022 TU Delft & Valentijn van de Beek <v.d.vandebeek@student.tudelft.nl> All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package retention
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/baas-project/baas/pkg/database"
+	"github.com/baas-project/baas/pkg/database/memory"
+	"github.com/baas-project/baas/pkg/model/images"
+	"github.com/baas-project/baas/pkg/model/user"
+	"github.com/baas-project/baas/pkg/storage"
+	"github.com/stretchr/testify/assert"
+)
+
+// setupImage creates an image with versions 0 up to and including the given version, each with a file
+func setupImage(t *testing.T, store database.Store, files storage.ImageFiles, uuid images.ImageUUID, last uint64) {
+	store.CreateImage(&images.ImageModel{Name: string(uuid), UUID: uuid, Username: "alice"})
+	assert.NoError(t, files.Create(uuid, storage.VersionFile(0), 10))
+
+	for v := uint64(1); v <= last; v++ {
+		store.CreateNewImageVersion(images.Version{Version: v, ImageModelUUID: uuid})
+		assert.NoError(t, files.Create(uuid, storage.VersionFile(v), 10))
+	}
+}
+
+func versionsOf(t *testing.T, store database.Store, uuid images.ImageUUID) []uint64 {
+	image, err := store.GetImageByUUID(uuid)
+	assert.NoError(t, err)
+
+	var versions []uint64
+	for _, v := range image.Versions {
+		versions = append(versions, v.Version)
+	}
+
+	return versions
+}
+
+func TestCollector_KeepLast(t *testing.T) {
+	store := memory.NewStore()
+	files := storage.NewMemory()
+
+	err := store.CreateUser(&user.UserModel{Username: "alice", Role: user.User})
+	assert.NoError(t, err)
+
+	setupImage(t, store, files, "fedora", 4)
+	setupImage(t, store, files, "arch", 4)
+
+	// Without a policy nothing is removed
+	collector := NewCollector(store, files, time.Hour)
+	report, err := collector.Plan(time.Now())
+	assert.NoError(t, err)
+	assert.Len(t, report.Versions, 0)
+
+	// The policy of the user applies to the images without their own
+	err = store.SetUserRetention("alice", images.RetentionPolicy{KeepLast: 2})
+	assert.NoError(t, err)
+	err = store.SetImageRetention("arch", images.RetentionPolicy{KeepLast: 4})
+	assert.NoError(t, err)
+
+	// Version 1 of fedora is used by a setup
+	err = store.CreateImageSetup("alice", &images.ImageSetup{Name: "setup", Username: "alice", UUID: "setup"})
+	assert.NoError(t, err)
+	setup, err := store.GetImageSetup("setup")
+	assert.NoError(t, err)
+	fedora, err := store.GetImageByUUID("fedora")
+	assert.NoError(t, err)
+	store.AddImageToImageSetup(&setup, fedora, fedora.Versions[1], false)
+
+	report, err = collector.Plan(time.Now())
+	assert.NoError(t, err)
+	assert.Len(t, report.Versions, 3)
+	assert.Equal(t, int64(30), report.Bytes)
+
+	// A dry run changes nothing
+	assert.Equal(t, []uint64{0, 1, 2, 3, 4}, versionsOf(t, store, "fedora"))
+
+	report, err = collector.Collect(time.Now())
+	assert.NoError(t, err)
+	assert.Len(t, report.Versions, 3)
+
+	assert.Equal(t, []uint64{1, 3, 4}, versionsOf(t, store, "fedora"))
+	assert.Equal(t, []uint64{1, 2, 3, 4}, versionsOf(t, store, "arch"))
+
+	_, err = files.Open("fedora", storage.VersionFile(2))
+	assert.Equal(t, storage.ErrNotFound, err)
+	_, err = files.Open("fedora", storage.VersionFile(3))
+	assert.NoError(t, err)
+}
+
+func TestCollector_KeepDays(t *testing.T) {
+	store := memory.NewStore()
+	files := storage.NewMemory()
+
+	err := store.CreateUser(&user.UserModel{Username: "alice", Role: user.User})
+	assert.NoError(t, err)
+
+	setupImage(t, store, files, "fedora", 2)
+	err = store.SetImageRetention("fedora", images.RetentionPolicy{KeepDays: 7})
+	assert.NoError(t, err)
+
+	collector := NewCollector(store, files, time.Hour)
+
+	report, err := collector.Plan(time.Now().Add(6 * 24 * time.Hour))
+	assert.NoError(t, err)
+	assert.Len(t, report.Versions, 0)
+
+	// Once they are old enough only the latest version is left
+	report, err = collector.Collect(time.Now().Add(8 * 24 * time.Hour))
+	assert.NoError(t, err)
+	assert.Len(t, report.Versions, 2)
+	assert.Equal(t, []uint64{2}, versionsOf(t, store, "fedora"))
+}
+
+func TestCollector_ExpireUploads(t *testing.T) {
+	store := memory.NewStore()
+	files := storage.NewMemory()
+
+	setupImage(t, store, files, "fedora", 0)
+	err := store.CreateUpload(&images.UploadModel{UUID: "upload", ImageModelUUID: "fedora"})
+	assert.NoError(t, err)
+	_, err = files.Append("upload", 0, strings.NewReader("partial"))
+	assert.NoError(t, err)
+
+	collector := NewCollector(store, files, time.Hour)
+	expired, err := collector.ExpireUploads(time.Now())
+	assert.NoError(t, err)
+	assert.Equal(t, 0, expired)
+
+	expired, err = collector.ExpireUploads(time.Now().Add(UploadLifetime + time.Minute))
+	assert.NoError(t, err)
+	assert.Equal(t, 1, expired)
+
+	_, err = store.GetUpload("upload")
+	assert.Error(t, err)
+
+	size, err := files.Staged("upload")
+	assert.NoError(t, err)
+	assert.Equal(t, int64(0), size)
+}
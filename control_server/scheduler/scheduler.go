@@ -0,0 +1,124 @@
+// Copyright (c) 2020-2022 TU Delft & Valentijn van de Beek <v.d.vandebeek@student.tudelft.nl> All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package scheduler turns machine reservations into boot setups. When a reservation slot starts
+// the setup of the user is enqueued on the machine and when it ends the machine is put back on
+// the baseline setup.
+package scheduler
+
+import (
+	"time"
+
+	"github.com/baas-project/baas/pkg/database"
+	"github.com/baas-project/baas/pkg/model/images"
+	"github.com/baas-project/baas/pkg/model/reservation"
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+)
+
+// Scheduler periodically checks the reservations in the store and acts on those that are due.
+type Scheduler struct {
+	store database.Store
+
+	// baseline is the image setup a machine returns to after a reservation ends, empty if there is none.
+	baseline images.ImageUUID
+	interval time.Duration
+}
+
+// NewScheduler creates a scheduler which checks the store every interval.
+func NewScheduler(store database.Store, baseline images.ImageUUID, interval time.Duration) *Scheduler {
+	return &Scheduler{
+		store:    store,
+		baseline: baseline,
+		interval: interval,
+	}
+}
+
+// Run checks the reservations every interval, this function never returns.
+func (s *Scheduler) Run() {
+	log.Infof("Starting the reservation scheduler, checking every %v", s.interval)
+
+	ticker := time.NewTicker(s.interval)
+	defer ticker.Stop()
+
+	for now := range ticker.C {
+		if err := s.Tick(now); err != nil {
+			log.Errorf("Reservation scheduler: %v", err)
+		}
+	}
+}
+
+// Tick starts and ends all reservations which are due at the given time.
+func (s *Scheduler) Tick(now time.Time) error {
+	due, err := s.store.GetDueReservations(now)
+	if err != nil {
+		return errors.Wrap(err, "get due reservations")
+	}
+
+	for i := range due {
+		r := &due[i]
+		switch r.Status {
+		case reservation.Scheduled:
+			err = s.start(r, now)
+		case reservation.Active:
+			err = s.end(r)
+		}
+
+		if err != nil {
+			log.Errorf("Cannot process reservation %s: %v", r.UUID, err)
+		}
+	}
+
+	return nil
+}
+
+// start enqueues the setup of the reservation on the machine. Every control server runs a scheduler, only
+// the one which advances the reservation enqueues the setup.
+func (s *Scheduler) start(r *reservation.ReservationModel, now time.Time) error {
+	// The server might have been offline during the entire slot, there is no use in booting it anymore.
+	if !r.End.After(now) {
+		_, err := s.store.AdvanceReservation(r, reservation.Finished, nil, false)
+		return errors.Wrap(err, "finish reservation")
+	}
+
+	started, err := s.store.AdvanceReservation(r, reservation.Active, &images.BootSetup{
+		MachineMAC: r.MachineMAC,
+		SetupUUID:  r.SetupUUID,
+		Update:     r.Update,
+	}, false)
+
+	if err != nil {
+		return errors.Wrap(err, "start reservation")
+	}
+
+	if started {
+		log.Infof("Reservation %s of %s started on %s", r.UUID, r.Username, r.MachineMAC)
+	}
+
+	return nil
+}
+
+// end puts the machine back on the baseline setup. The setups which are still queued on the machine are
+// removed, the machine would otherwise boot the setup of the user after the reservation.
+func (s *Scheduler) end(r *reservation.ReservationModel) error {
+	var baseline *images.BootSetup
+	if s.baseline != "" {
+		baseline = &images.BootSetup{
+			MachineMAC: r.MachineMAC,
+			SetupUUID:  s.baseline,
+			Update:     false,
+		}
+	}
+
+	ended, err := s.store.AdvanceReservation(r, reservation.Finished, baseline, true)
+	if err != nil {
+		return errors.Wrap(err, "end reservation")
+	}
+
+	if ended {
+		log.Infof("Reservation %s of %s ended on %s", r.UUID, r.Username, r.MachineMAC)
+	}
+
+	return nil
+}
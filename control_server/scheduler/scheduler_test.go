@@ -0,0 +1,138 @@
+// Copyright (c) 2020-2022 TU Delft & Valentijn van de Beek <v.d.vandebeek@student.tudelft.nl> All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package scheduler
+
+import (
+	"testing"
+	"time"
+
+	"github.com/baas-project/baas/pkg/database"
+	"github.com/baas-project/baas/pkg/database/sqlite"
+	"github.com/baas-project/baas/pkg/model/images"
+	machinemodel "github.com/baas-project/baas/pkg/model/machine"
+	"github.com/baas-project/baas/pkg/model/reservation"
+	"github.com/baas-project/baas/pkg/model/user"
+	"github.com/baas-project/baas/pkg/util"
+	"github.com/stretchr/testify/assert"
+)
+
+// newStore creates a store with the user, the machine and the setups the reservations use
+func newStore(t *testing.T) database.Store {
+	store, err := sqlite.NewSqliteStore(sqlite.InMemoryPath)
+	assert.NoError(t, err)
+
+	err = store.CreateUser(&user.UserModel{Username: "test", Name: "Test", Email: "test@example.com", Role: user.User})
+	assert.NoError(t, err)
+
+	err = store.UpdateMachine(&machinemodel.MachineModel{MacAddress: util.MacAddress{Address: "abc"}, Name: "abc"})
+	assert.NoError(t, err)
+
+	for _, uuid := range []images.ImageUUID{"setup", "baseline"} {
+		err = store.CreateImageSetup("test", &images.ImageSetup{Name: string(uuid), Username: "test", UUID: uuid})
+		assert.NoError(t, err)
+	}
+
+	return store
+}
+
+func TestScheduler_Tick(t *testing.T) {
+	store := newStore(t)
+
+	start := time.Now()
+	res := reservation.ReservationModel{
+		UUID:       "res",
+		Username:   "test",
+		MachineMAC: "abc",
+		SetupUUID:  "setup",
+		Start:      start,
+		End:        start.Add(time.Hour),
+		Status:     reservation.Scheduled,
+	}
+	err := store.CreateReservation(&res)
+	assert.NoError(t, err)
+
+	s := NewScheduler(store, "baseline", time.Minute)
+
+	// Nothing happens before the slot starts
+	err = s.Tick(start.Add(-time.Minute))
+	assert.NoError(t, err)
+	_, err = store.GetNextBootSetup("abc")
+	assert.Error(t, err)
+
+	// The setup of the user is enqueued when the slot starts
+	err = s.Tick(start.Add(time.Minute))
+	assert.NoError(t, err)
+
+	stored, err := store.GetReservationByUUID("res")
+	assert.NoError(t, err)
+	assert.Equal(t, reservation.Active, stored.Status)
+
+	setup, err := store.GetNextBootSetup("abc")
+	assert.NoError(t, err)
+	assert.Equal(t, images.ImageUUID("setup"), setup.SetupUUID)
+
+	// And the machine goes back to the baseline when it ends
+	err = s.Tick(start.Add(time.Hour))
+	assert.NoError(t, err)
+
+	stored, err = store.GetReservationByUUID("res")
+	assert.NoError(t, err)
+	assert.Equal(t, reservation.Finished, stored.Status)
+
+	setup, err = store.GetNextBootSetup("abc")
+	assert.NoError(t, err)
+	assert.Equal(t, images.ImageUUID("baseline"), setup.SetupUUID)
+}
+
+func TestScheduler_Replicas(t *testing.T) {
+	store := newStore(t)
+
+	start := time.Now()
+	res := reservation.ReservationModel{
+		UUID:       "res",
+		Username:   "test",
+		MachineMAC: "abc",
+		SetupUUID:  "setup",
+		Start:      start,
+		End:        start.Add(time.Hour),
+		Status:     reservation.Scheduled,
+	}
+	assert.NoError(t, store.CreateReservation(&res))
+
+	// Two control servers see the same due reservation, only one of them queues its setup
+	first, second := NewScheduler(store, "baseline", time.Minute), NewScheduler(store, "baseline", time.Minute)
+	due, err := store.GetDueReservations(start.Add(time.Minute))
+	assert.NoError(t, err)
+	assert.Len(t, due, 1)
+
+	stale := due[0]
+	assert.NoError(t, first.start(&due[0], start.Add(time.Minute)))
+	assert.NoError(t, second.start(&stale, start.Add(time.Minute)))
+
+	setup, err := store.GetNextBootSetup("abc")
+	assert.NoError(t, err)
+	assert.Equal(t, images.ImageUUID("setup"), setup.SetupUUID)
+
+	_, err = store.PeekBootSetup("abc")
+	assert.Error(t, err)
+
+	// A setup which was not booted during the slot is dropped when it ends, the baseline is queued once
+	assert.NoError(t, store.AddBootSetupToMachine(&images.BootSetup{MachineMAC: "abc", SetupUUID: "setup"}))
+
+	due, err = store.GetDueReservations(start.Add(time.Hour))
+	assert.NoError(t, err)
+	assert.Len(t, due, 1)
+
+	stale = due[0]
+	assert.NoError(t, first.end(&due[0]))
+	assert.NoError(t, second.end(&stale))
+
+	setup, err = store.GetNextBootSetup("abc")
+	assert.NoError(t, err)
+	assert.Equal(t, images.ImageUUID("baseline"), setup.SetupUUID)
+
+	_, err = store.PeekBootSetup("abc")
+	assert.Error(t, err)
+}
@@ -0,0 +1,224 @@
+// Copyright (c) 2020-2022 TU Delft & Valentijn van de Beek <v.d.vandebeek@student.tudelft.nl> All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package tracker keeps track of the management OS instances which serve the versions on their disks to other
+// machines. A machine which is provisioned with a version gets the peers holding it from the tracker, together
+// with the hashes of the blocks of the disk so it does not have to trust the peers. A peer only sends the blocks
+// of a version to whoever presents the token of the version, which the tracker hands out.
+package tracker
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"math/rand"
+	"sync"
+	"time"
+
+	api_pkg "github.com/baas-project/baas/pkg/api"
+	"github.com/baas-project/baas/pkg/blockmap"
+	"github.com/baas-project/baas/pkg/model/images"
+	"github.com/baas-project/baas/pkg/util"
+	"github.com/pkg/errors"
+)
+
+const (
+	// DefaultTTL is how long a peer is tracked after it last announced itself
+	DefaultTTL = 10 * time.Minute
+	// MaxPeers is the largest amount of peers handed out for a version
+	MaxPeers = 8
+	// maxBlockLists is the amount of block lists which are kept, the least recently used one is dropped first
+	maxBlockLists = 64
+)
+
+// ErrDigestMismatch is returned when the disk of a version does not have the digest of the version
+var ErrDigestMismatch = errors.New("the disk does not match the digest of the version")
+
+// peer is a management OS which announced itself
+type peer struct {
+	address  string
+	versions map[api_pkg.PeerVersion]bool
+	seen     time.Time
+}
+
+// blockList is the hashes of the blocks of a version, computed once
+type blockList struct {
+	once   sync.Once
+	hashes *blockmap.Hashes
+	err    error
+	used   time.Time
+}
+
+// key identifies the disk of a version, the digest changes when the disk does
+type key struct {
+	image   images.ImageUUID
+	version uint64
+	digest  string
+}
+
+// Tracker knows which peers hold which versions and the block lists of the versions
+type Tracker struct {
+	// TTL is how long a peer is handed out after its last announcement
+	TTL time.Duration
+
+	mutex  sync.Mutex
+	peers  map[string]*peer
+	blocks map[key]*blockList
+	tokens map[api_pkg.PeerVersion]string
+}
+
+// NewTracker creates a Tracker without any peers
+func NewTracker() *Tracker {
+	return &Tracker{
+		TTL:    DefaultTTL,
+		peers:  make(map[string]*peer),
+		blocks: make(map[key]*blockList),
+		tokens: make(map[api_pkg.PeerVersion]string),
+	}
+}
+
+// Announce records the versions the machine serves at the address, it replaces the previous announcement
+func (t *Tracker) Announce(mac string, address string, versions []api_pkg.PeerVersion) {
+	p := &peer{address: address, versions: make(map[api_pkg.PeerVersion]bool), seen: time.Now()}
+	for _, version := range versions {
+		p.versions[version] = true
+	}
+
+	t.mutex.Lock()
+	t.peers[mac] = p
+	t.mutex.Unlock()
+}
+
+// Leave forgets the machine, it no longer serves anything
+func (t *Tracker) Leave(mac string) {
+	t.mutex.Lock()
+	delete(t.peers, mac)
+	t.mutex.Unlock()
+}
+
+// Peers returns the addresses of at most MaxPeers peers which hold the version, in random order so the load is
+// spread. The machine asking is left out.
+func (t *Tracker) Peers(image images.ImageUUID, version uint64, except string) []string {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	wanted := api_pkg.PeerVersion{Image: image, Version: version}
+	addresses := []string{}
+
+	for mac, p := range t.peers {
+		if time.Since(p.seen) > t.TTL {
+			delete(t.peers, mac)
+			continue
+		}
+
+		if mac != except && p.versions[wanted] {
+			addresses = append(addresses, p.address)
+		}
+	}
+
+	rand.Shuffle(len(addresses), func(i, j int) {
+		addresses[i], addresses[j] = addresses[j], addresses[i]
+	})
+
+	if len(addresses) > MaxPeers {
+		addresses = addresses[:MaxPeers]
+	}
+
+	return addresses
+}
+
+// Token returns the token which gives access to the blocks of the version at the peers, it is generated the
+// first time it is asked for. Only the peers holding the version and the machines which may read it get it.
+func (t *Tracker) Token(version api_pkg.PeerVersion) (string, error) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	if token, ok := t.tokens[version]; ok {
+		return token, nil
+	}
+
+	token, err := util.GenerateToken()
+	if err != nil {
+		return "", errors.Wrap(err, "generate peer token")
+	}
+
+	t.tokens[version] = token
+	return token, nil
+}
+
+// Blocks returns the hashes of the blocks of the disk of the version. They are computed from the disk open
+// returns the first time and checked against the digest of the version.
+func (t *Tracker) Blocks(image images.ImageUUID, version images.Version,
+	open func() (io.ReadCloser, error)) (*blockmap.Hashes, error) {
+	k := key{image: image, version: version.Version, digest: version.Digest}
+
+	t.mutex.Lock()
+	list, ok := t.blocks[k]
+	if ok {
+		list.used = time.Now()
+	} else {
+		list = &blockList{used: time.Now()}
+		t.blocks[k] = list
+		t.evict()
+	}
+	t.mutex.Unlock()
+
+	list.once.Do(func() {
+		list.hashes, list.err = hashDisk(version, open)
+	})
+
+	// A failure may be temporary, the next request tries again
+	if list.err != nil {
+		t.mutex.Lock()
+		if t.blocks[k] == list {
+			delete(t.blocks, k)
+		}
+		t.mutex.Unlock()
+	}
+
+	return list.hashes, list.err
+}
+
+// evict drops the least recently used block list when there are too many, the mutex has to be held
+func (t *Tracker) evict() {
+	if len(t.blocks) <= maxBlockLists {
+		return
+	}
+
+	var oldest key
+	var used time.Time
+	for k, list := range t.blocks {
+		if used.IsZero() || list.used.Before(used) {
+			oldest, used = k, list.used
+		}
+	}
+
+	delete(t.blocks, oldest)
+}
+
+// hashDisk hashes the blocks of the disk of the version
+func hashDisk(version images.Version, open func() (io.ReadCloser, error)) (*blockmap.Hashes, error) {
+	disk, err := open()
+	if err != nil {
+		return nil, err
+	}
+
+	defer disk.Close()
+
+	hasher := blockmap.NewHasher(blockmap.DefaultBlockSize)
+	digest := sha256.New()
+	if _, err = io.Copy(io.MultiWriter(hasher, digest), disk); err != nil {
+		return nil, errors.Wrap(err, "read disk")
+	}
+
+	hashes := hasher.Hashes()
+	hashes.Version = version.Version
+	hashes.Digest = hex.EncodeToString(digest.Sum(nil))
+
+	if hashes.Digest != version.Digest {
+		return nil, errors.Wrapf(ErrDigestMismatch, "got %s, expected %s", hashes.Digest, version.Digest)
+	}
+
+	return hashes, nil
+}
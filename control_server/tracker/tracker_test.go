@@ -0,0 +1,120 @@
+// Copyright (c) 2020-2022 TU Delft & Valentijn van de Beek <v.d.vandebeek@student.tudelft.nl> All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package tracker
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"io/ioutil"
+	"testing"
+	"time"
+
+	api_pkg "github.com/baas-project/baas/pkg/api"
+	"github.com/baas-project/baas/pkg/blockmap"
+	"github.com/baas-project/baas/pkg/model/images"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTracker_Peers(t *testing.T) {
+	tracker := NewTracker()
+
+	fedora1 := api_pkg.PeerVersion{Image: "fedora", Version: 1}
+	fedora2 := api_pkg.PeerVersion{Image: "fedora", Version: 2}
+
+	tracker.Announce("a", "10.0.0.1:4849", []api_pkg.PeerVersion{fedora1})
+	tracker.Announce("b", "10.0.0.2:4849", []api_pkg.PeerVersion{fedora1, fedora2})
+	tracker.Announce("c", "10.0.0.3:4849", nil)
+
+	assert.ElementsMatch(t, []string{"10.0.0.1:4849", "10.0.0.2:4849"}, tracker.Peers("fedora", 1, "c"))
+	assert.Equal(t, []string{"10.0.0.2:4849"}, tracker.Peers("fedora", 2, "c"))
+
+	// A machine is not its own peer
+	assert.Equal(t, []string{"10.0.0.1:4849"}, tracker.Peers("fedora", 1, "b"))
+
+	// An announcement replaces the previous one
+	tracker.Announce("b", "10.0.0.2:4849", []api_pkg.PeerVersion{fedora2})
+	assert.Equal(t, []string{"10.0.0.1:4849"}, tracker.Peers("fedora", 1, "c"))
+
+	tracker.Leave("a")
+	assert.Empty(t, tracker.Peers("fedora", 1, "c"))
+
+	// Peers which stopped announcing themselves are forgotten
+	tracker.TTL = time.Millisecond
+	time.Sleep(5 * time.Millisecond)
+	assert.Empty(t, tracker.Peers("fedora", 2, "c"))
+
+	tracker.TTL = DefaultTTL
+	for i := 0; i < 2*MaxPeers; i++ {
+		tracker.Announce(string(rune('a'+i)), "peer", []api_pkg.PeerVersion{fedora1})
+	}
+
+	assert.Len(t, tracker.Peers("fedora", 1, ""), MaxPeers)
+}
+
+func TestTracker_Token(t *testing.T) {
+	tracker := NewTracker()
+
+	fedora1, err := tracker.Token(api_pkg.PeerVersion{Image: "fedora", Version: 1})
+	assert.NoError(t, err)
+	assert.NotEmpty(t, fedora1)
+
+	fedora2, err := tracker.Token(api_pkg.PeerVersion{Image: "fedora", Version: 2})
+	assert.NoError(t, err)
+	assert.NotEqual(t, fedora1, fedora2)
+
+	// The token of a version stays the same
+	again, err := tracker.Token(api_pkg.PeerVersion{Image: "fedora", Version: 1})
+	assert.NoError(t, err)
+	assert.Equal(t, fedora1, again)
+}
+
+func TestTracker_Blocks(t *testing.T) {
+	tracker := NewTracker()
+	disk := bytes.Repeat([]byte("block"), blockmap.DefaultBlockSize)
+
+	hash := sha256.Sum256(disk)
+	version := images.Version{Version: 3, Digest: hex.EncodeToString(hash[:]), Size: int64(len(disk))}
+
+	opened := 0
+	open := func() (io.ReadCloser, error) {
+		opened++
+		return ioutil.NopCloser(bytes.NewReader(disk)), nil
+	}
+
+	hashes, err := tracker.Blocks("fedora", version, open)
+	assert.NoError(t, err)
+	assert.Equal(t, uint64(3), hashes.Version)
+	assert.Equal(t, version.Digest, hashes.Digest)
+	assert.Len(t, hashes.Blocks, 5)
+	assert.True(t, hashes.Check(4, disk[4*blockmap.DefaultBlockSize:]))
+
+	// The hashes are only computed once
+	again, err := tracker.Blocks("fedora", version, open)
+	assert.NoError(t, err)
+	assert.Equal(t, hashes, again)
+	assert.Equal(t, 1, opened)
+
+	// A disk which does not match its version is refused, and tried again the next time
+	version.Version = 4
+	version.Digest = hex.EncodeToString(make([]byte, sha256.Size))
+	_, err = tracker.Blocks("fedora", version, open)
+	assert.Equal(t, ErrDigestMismatch, errors.Cause(err))
+
+	_, err = tracker.Blocks("fedora", version, open)
+	assert.Equal(t, ErrDigestMismatch, errors.Cause(err))
+	assert.Equal(t, 3, opened)
+
+	// Only the most recently used lists are kept
+	for i := 0; i < maxBlockLists+10; i++ {
+		version := images.Version{Version: uint64(10 + i), Digest: hex.EncodeToString(hash[:])}
+		_, err = tracker.Blocks("fedora", version, open)
+		assert.NoError(t, err)
+	}
+
+	assert.Len(t, tracker.blocks, maxBlockLists)
+}
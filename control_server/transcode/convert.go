@@ -0,0 +1,292 @@
+// Copyright (c) 2020-2022 TU Delft & Valentijn van de Beek <v.d.vandebeek@student.tudelft.nl> All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package transcode
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+
+	"github.com/baas-project/baas/pkg/compression"
+	"github.com/baas-project/baas/pkg/diskimage"
+	"github.com/baas-project/baas/pkg/model/images"
+	"github.com/baas-project/baas/pkg/storage"
+	"github.com/google/uuid"
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+)
+
+// Conversion describes a version which was written out as another type of disk image, the sizes are those of
+// the stored file before and after
+type Conversion struct {
+	Image       images.ImageUUID
+	Version     uint64
+	From        images.DiskType
+	To          images.DiskType
+	Compression images.DiskCompressionStrategy
+	BytesBefore int64
+	BytesAfter  int64
+}
+
+// Convert rewrites the file of a version as another type of disk image, the file keeps its compression. The
+// disk in the image stays the same, which is checked against the digest of the version before the file is
+// replaced. Converting the latest version changes the type of the image. ErrBusy is returned while the
+// image is being transcoded.
+func (t *Transcoder) Convert(image images.ImageUUID, version images.Version,
+	diskType images.DiskType) (*Conversion, error) {
+	if job := t.Job(image); job != nil && job.Status().State == Running {
+		return nil, ErrBusy
+	}
+
+	replace := func(digest string, commit func() error) error {
+		return t.downloads.replace(image, version.Version, func() error {
+			if err := t.check(image, version, digest); err != nil {
+				return err
+			}
+
+			return commit()
+		})
+	}
+
+	conversion, err := convert(t.files, image, version, diskType, replace)
+	if err != nil {
+		return nil, err
+	}
+
+	version.Compression = conversion.Compression
+	version.Type = conversion.To
+	if err = t.store.SetVersionDigest(version); err != nil {
+		return nil, errors.Wrap(err, "update version")
+	}
+
+	model, err := t.store.GetImageByUUID(image)
+	if err != nil {
+		return nil, errors.Wrap(err, "get image")
+	}
+
+	// The type of the image is the one of its latest version
+	n := len(model.Versions)
+	if n > 0 && model.Versions[n-1].Version == version.Version && model.ImageFileType != diskType {
+		if err = t.store.SetImageFileType(image, diskType); err != nil {
+			return nil, errors.Wrap(err, "set image file type")
+		}
+	}
+
+	log.Infof("Converted version %d of image %s from %s to %s, %d bytes became %d bytes", version.Version, image,
+		conversion.From, conversion.To, conversion.BytesBefore, conversion.BytesAfter)
+
+	return conversion, nil
+}
+
+// Normalize rewrites a qcow2 version whose tables come after its data in the layout of diskimage.WriteQCow2,
+// so the management OS can expand it while it downloads it. The version does not have to be stored yet.
+func Normalize(files storage.ImageFiles, image images.ImageUUID, version uint64) error {
+	_, err := convert(files, image, images.Version{Version: version}, images.DiskTypeQCow2, nil)
+	return err
+}
+
+// convert stages the version as the disk type and commits it. The commit is handed to replace together with
+// the digest of the disk, which runs it once it accepts the digest.
+func convert(files storage.ImageFiles, image images.ImageUUID, version images.Version, diskType images.DiskType,
+	replace func(digest string, commit func() error) error) (*Conversion, error) {
+	name := storage.VersionFile(version.Version)
+
+	src, err := openSource(files, image, name)
+	if err != nil {
+		return nil, err
+	}
+
+	defer src.close()
+
+	conversion := &Conversion{
+		Image:       image,
+		Version:     version.Version,
+		From:        src.diskType,
+		To:          diskType,
+		Compression: src.strategy,
+		BytesBefore: src.size,
+	}
+
+	// The image is written into one end of the pipe while the other end is compressed and staged
+	r, w := io.Pipe()
+	written := make(chan struct{})
+
+	go func() {
+		defer close(written)
+		_ = w.CloseWithError(diskimage.Write(w, diskType, src.open))
+	}()
+
+	defer func() {
+		_ = r.Close()
+		<-written
+	}()
+
+	contents := newDiskDigest()
+	defer contents.Close()
+
+	compressed, err := compression.CompressLevel(io.TeeReader(r, contents), src.strategy, 0)
+	if err != nil {
+		return nil, errors.Wrap(err, "compress version file")
+	}
+
+	defer compressed.Close()
+
+	upload := uuid.New().String()
+	file := sha256.New()
+
+	conversion.BytesAfter, err = files.Append(upload, 0, io.TeeReader(compressed, file))
+	if err != nil {
+		_ = files.Discard(upload)
+		return nil, errors.Wrap(err, "stage version file")
+	}
+
+	digest, _, err := contents.Sum()
+	if err != nil {
+		_ = files.Discard(upload)
+		return nil, errors.Wrap(err, "read converted image")
+	}
+
+	commit := func() error {
+		err := files.Commit(upload, image, name, hex.EncodeToString(file.Sum(nil)))
+		return errors.Wrap(err, "replace version file")
+	}
+
+	if replace != nil {
+		err = replace(digest, commit)
+	} else {
+		err = commit()
+	}
+
+	if err != nil {
+		_ = files.Discard(upload)
+		return nil, err
+	}
+
+	return conversion, nil
+}
+
+// source is the file of a version, which diskimage.Write opens twice
+type source struct {
+	files    storage.ImageFiles
+	image    images.ImageUUID
+	name     string
+	diskType images.DiskType
+	strategy images.DiskCompressionStrategy
+	size     int64
+
+	// expanded is the decompressed copy of a compressed qcow2 image, those have to be read out of order
+	expanded string
+	closers  []io.Closer
+}
+
+// openSource finds out what the file holds, a compressed qcow2 image is decompressed into a temporary file
+func openSource(files storage.ImageFiles, image images.ImageUUID, name string) (*source, error) {
+	f, err := files.Open(image, name)
+	if err != nil {
+		return nil, errors.Wrap(err, "open version file")
+	}
+
+	defer f.Close()
+
+	size, err := f.Seek(0, io.SeekEnd)
+	if err == nil {
+		_, err = f.Seek(0, io.SeekStart)
+	}
+
+	if err != nil {
+		return nil, errors.Wrap(err, "seek version file")
+	}
+
+	decompressed, strategy, err := compression.DecompressDetected(f)
+	if err != nil {
+		return nil, errors.Wrap(err, "decompress version file")
+	}
+
+	defer decompressed.Close()
+
+	diskType, contents, err := diskimage.Detect(decompressed)
+	if err != nil {
+		return nil, errors.Wrap(err, "read version file")
+	}
+
+	src := &source{files: files, image: image, name: name, diskType: diskType, strategy: strategy, size: size}
+	if diskType != images.DiskTypeQCow2 || strategy == images.DiskCompressionStrategyNone {
+		return src, nil
+	}
+
+	src.expanded = name + ".expanded"
+
+	w, err := files.Write(image, src.expanded)
+	if err != nil {
+		return nil, errors.Wrap(err, "create expanded copy")
+	}
+
+	if _, err = io.Copy(w, contents); err != nil {
+		_ = w.Abort()
+		return nil, errors.Wrap(err, "write expanded copy")
+	}
+
+	return src, errors.Wrap(w.Close(), "write expanded copy")
+}
+
+// open reads the disk in the file from the start, qcow2 images are read by looking up their clusters
+func (s *source) open() (diskimage.Image, error) {
+	name := s.name
+	if s.expanded != "" {
+		name = s.expanded
+	}
+
+	f, err := s.files.Open(s.image, name)
+	if err != nil {
+		return nil, errors.Wrap(err, "open version file")
+	}
+
+	s.closers = append(s.closers, f)
+
+	if s.diskType == images.DiskTypeQCow2 {
+		return diskimage.OpenQCow2(readerAt{f})
+	}
+
+	decompressed, _, err := compression.DecompressDetected(f)
+	if err != nil {
+		return nil, errors.Wrap(err, "decompress version file")
+	}
+
+	s.closers = append(s.closers, decompressed)
+
+	_, image, err := diskimage.Open(decompressed)
+	return image, err
+}
+
+// close closes every file which was opened and removes the expanded copy
+func (s *source) close() {
+	for i := len(s.closers) - 1; i >= 0; i-- {
+		_ = s.closers[i].Close()
+	}
+
+	if s.expanded != "" {
+		if err := s.files.Remove(s.image, s.expanded); err != nil {
+			log.Warnf("Cannot remove %s of image %s: %v", s.expanded, s.image, err)
+		}
+	}
+}
+
+// readerAt reads a file at an offset by seeking to it
+type readerAt struct {
+	f storage.File
+}
+
+func (r readerAt) ReadAt(p []byte, offset int64) (int, error) {
+	if _, err := r.f.Seek(offset, io.SeekStart); err != nil {
+		return 0, err
+	}
+
+	n, err := io.ReadFull(r.f, p)
+	if err == io.ErrUnexpectedEOF {
+		err = io.EOF
+	}
+
+	return n, err
+}
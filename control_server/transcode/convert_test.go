@@ -0,0 +1,165 @@
+// Copyright (c) 2020-2022 TU Delft & Valentijn van de Beek <v.d.vandebeek@student.tudelft.nl> All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package transcode
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"io"
+	"testing"
+
+	"github.com/baas-project/baas/pkg/compression"
+	"github.com/baas-project/baas/pkg/diskimage"
+	"github.com/baas-project/baas/pkg/model/images"
+	"github.com/baas-project/baas/pkg/storage"
+	"github.com/stretchr/testify/assert"
+)
+
+// diskOf detects the compression and the type of the file of the version and returns the digest of its disk
+func diskOf(t *testing.T, files storage.ImageFiles, version uint64) (string, images.DiskType,
+	images.DiskCompressionStrategy) {
+	f, err := files.Open("fedora", storage.VersionFile(version))
+	assert.NoError(t, err)
+
+	defer f.Close()
+
+	r, strategy, err := compression.DecompressDetected(f)
+	assert.NoError(t, err)
+
+	digest, _, diskType, err := diskimage.Digest(r)
+	assert.NoError(t, err)
+
+	return digest, diskType, strategy
+}
+
+func TestTranscoder_Convert(t *testing.T) {
+	store, files := setup(t)
+	transcoder := NewTranscoder(store, files)
+
+	hash := sha256.Sum256(contents)
+	digest := hex.EncodeToString(hash[:])
+
+	image, err := store.GetImageByUUID("fedora")
+	assert.NoError(t, err)
+
+	// Converting a version which is not the latest leaves the type of the image alone
+	conversion, err := transcoder.Convert("fedora", image.Versions[1], images.DiskTypeQCow2)
+	assert.NoError(t, err)
+	assert.Equal(t, images.DiskTypeRaw, conversion.From)
+	assert.Equal(t, images.DiskTypeQCow2, conversion.To)
+	assert.Equal(t, images.DiskCompressionStrategy(images.DiskCompressionStrategyGZip), conversion.Compression)
+
+	image, err = store.GetImageByUUID("fedora")
+	assert.NoError(t, err)
+	assert.Equal(t, images.DiskTypeRaw, image.ImageFileType)
+
+	_, err = transcoder.Convert("fedora", image.Versions[2], images.DiskTypeQCow2)
+	assert.NoError(t, err)
+
+	image, err = store.GetImageByUUID("fedora")
+	assert.NoError(t, err)
+	assert.Equal(t, images.DiskTypeQCow2, image.ImageFileType)
+
+	// The disk stays the same and so does the compression
+	for version, strategy := range map[uint64]images.DiskCompressionStrategy{
+		1: images.DiskCompressionStrategyGZip,
+		2: images.DiskCompressionStrategyZSTD,
+	} {
+		versionDigest, diskType, detected := diskOf(t, files, version)
+		assert.Equal(t, digest, versionDigest)
+		assert.Equal(t, images.DiskTypeQCow2, diskType)
+		assert.Equal(t, strategy, detected)
+	}
+
+	// Transcoding checks the disk in the qcow2 images against the digests
+	job, err := transcoder.Start("fedora", Target{Strategy: images.DiskCompressionStrategyLZ4}, false)
+	assert.NoError(t, err)
+
+	status := job.Wait()
+	assert.Equal(t, Done, status.State, status.Error)
+	assert.Equal(t, 3, status.Transcoded)
+
+	image, err = store.GetImageByUUID("fedora")
+	assert.NoError(t, err)
+
+	_, err = transcoder.Convert("fedora", image.Versions[2], images.DiskTypeRaw)
+	assert.NoError(t, err)
+	assert.Equal(t, images.DiskCompressionStrategy(images.DiskCompressionStrategyLZ4), strategyOf(t, files, 2))
+
+	image, err = store.GetImageByUUID("fedora")
+	assert.NoError(t, err)
+	assert.Equal(t, images.DiskTypeRaw, image.ImageFileType)
+
+	// The contents are not a whole number of sectors, so they do not fit in a sparse image
+	_, err = transcoder.Convert("fedora", image.Versions[2], images.DiskTypeSparse)
+	assert.Error(t, err)
+	assert.Equal(t, images.DiskCompressionStrategy(images.DiskCompressionStrategyLZ4), strategyOf(t, files, 2))
+}
+
+func TestTranscoder_ConvertDigestMismatch(t *testing.T) {
+	store, files := setup(t)
+	transcoder := NewTranscoder(store, files)
+
+	image, err := store.GetImageByUUID("fedora")
+	assert.NoError(t, err)
+
+	version := image.Versions[1]
+	version.Digest = "0000"
+
+	_, err = transcoder.Convert("fedora", version, images.DiskTypeQCow2)
+	assert.Error(t, err)
+
+	_, diskType, _ := diskOf(t, files, 1)
+	assert.Equal(t, images.DiskTypeRaw, diskType)
+}
+
+// unstreamableQCow2 is a qcow2 image of two clusters of 512 bytes, the second of which holds data. Its data comes
+// before the tables which point to it.
+func unstreamableQCow2() []byte {
+	image := make([]byte, 2048)
+	copy(image, []byte{'Q', 'F', 'I', 0xfb})
+	binary.BigEndian.PutUint32(image[4:], 3)
+	binary.BigEndian.PutUint32(image[20:], 9)
+	binary.BigEndian.PutUint64(image[24:], 1024)
+	binary.BigEndian.PutUint32(image[36:], 1)
+	binary.BigEndian.PutUint64(image[40:], 1024)
+	binary.BigEndian.PutUint32(image[100:], 104)
+
+	copy(image[512:1024], bytes.Repeat([]byte("a"), 512))
+	binary.BigEndian.PutUint64(image[1024:], 1536)
+	binary.BigEndian.PutUint64(image[1536+8:], 512|1<<63)
+
+	return image
+}
+
+func TestNormalize(t *testing.T) {
+	files := storage.NewMemory()
+
+	r, err := compression.Compress(bytes.NewReader(unstreamableQCow2()), images.DiskCompressionStrategyGZip)
+	assert.NoError(t, err)
+
+	w, err := files.Write("fedora", storage.VersionFile(1))
+	assert.NoError(t, err)
+
+	_, err = io.Copy(w, r)
+	assert.NoError(t, err)
+	assert.NoError(t, w.Close())
+
+	assert.NoError(t, Normalize(files, "fedora", 1))
+
+	disk := append(make([]byte, 512), bytes.Repeat([]byte("a"), 512)...)
+	hash := sha256.Sum256(disk)
+
+	digest, diskType, strategy := diskOf(t, files, 1)
+	assert.Equal(t, hex.EncodeToString(hash[:]), digest)
+	assert.Equal(t, images.DiskTypeQCow2, diskType)
+	assert.Equal(t, images.DiskCompressionStrategy(images.DiskCompressionStrategyGZip), strategy)
+
+	// The decompressed copy it was read from is gone
+	_, err = files.Open("fedora", storage.VersionFile(1)+".expanded")
+	assert.Equal(t, storage.ErrNotFound, err)
+}
@@ -0,0 +1,118 @@
+// Copyright (c) 2020-2022 TU Delft & Valentijn van de Beek <v.d.vandebeek@student.tudelft.nl> All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package transcode
+
+import (
+	"sync"
+	"time"
+
+	"github.com/baas-project/baas/pkg/model/images"
+)
+
+// DownloadLinger is how long a version still counts as downloaded after a download ended. The management OS
+// resumes an interrupted download within about a minute with the ETag it got first, which only works as long
+// as the file was not replaced in the meantime.
+const DownloadLinger = 2 * time.Minute
+
+type downloadKey struct {
+	image   images.ImageUUID
+	version uint64
+}
+
+type downloadState struct {
+	open      int
+	ended     time.Time
+	replacing bool
+}
+
+// downloads keeps track of the versions which are being downloaded, their files are only replaced once
+// nobody is downloading them anymore
+type downloads struct {
+	mu      sync.Mutex
+	changed *sync.Cond
+	linger  time.Duration
+	states  map[downloadKey]*downloadState
+}
+
+func newDownloads(linger time.Duration) *downloads {
+	d := &downloads{linger: linger, states: make(map[downloadKey]*downloadState)}
+	d.changed = sync.NewCond(&d.mu)
+
+	return d
+}
+
+func (d *downloads) state(key downloadKey) *downloadState {
+	state, ok := d.states[key]
+	if !ok {
+		state = &downloadState{}
+		d.states[key] = state
+	}
+
+	return state
+}
+
+// Download marks the version as being downloaded until done is called. While the file of the version is being
+// replaced it waits until that is done, so the digest and the file a download gets belong together.
+func (t *Transcoder) Download(image images.ImageUUID, version uint64) (done func()) {
+	d := t.downloads
+	key := downloadKey{image, version}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	for d.state(key).replacing {
+		d.changed.Wait()
+	}
+
+	d.state(key).open++
+
+	return func() {
+		d.mu.Lock()
+		defer d.mu.Unlock()
+
+		state := d.state(key)
+		state.open--
+		state.ended = time.Now()
+		d.changed.Broadcast()
+	}
+}
+
+// replace runs commit once the version is not downloaded anymore and no download of it ended within the
+// linger period. Downloads which start in the meantime wait for it.
+func (d *downloads) replace(image images.ImageUUID, version uint64, commit func() error) error {
+	key := downloadKey{image, version}
+
+	d.mu.Lock()
+	for {
+		state := d.state(key)
+		if state.open > 0 || state.replacing {
+			d.changed.Wait()
+			continue
+		}
+
+		wait := d.linger - time.Since(state.ended)
+		if wait <= 0 {
+			break
+		}
+
+		d.mu.Unlock()
+		time.Sleep(wait)
+		d.mu.Lock()
+	}
+
+	d.state(key).replacing = true
+	d.mu.Unlock()
+
+	err := commit()
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	// The new file has another ETag, so the downloads of the old one no longer matter
+	delete(d.states, key)
+	d.changed.Broadcast()
+
+	return err
+}
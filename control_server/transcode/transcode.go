@@ -0,0 +1,440 @@
+// Copyright (c) 2020-2022 TU Delft & Valentijn van de Beek <v.d.vandebeek@student.tudelft.nl> All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package transcode re-encodes the stored versions of an image with another compression strategy or level,
+// or as another type of disk image. Every version is encoded into a staged upload and checked against its
+// digest before it replaces the old file, which waits until nobody is downloading it. The compression of the
+// image is only changed once all of its versions are done.
+package transcode
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"io/ioutil"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/baas-project/baas/pkg/compression"
+	"github.com/baas-project/baas/pkg/database"
+	"github.com/baas-project/baas/pkg/diskimage"
+	"github.com/baas-project/baas/pkg/model/images"
+	"github.com/baas-project/baas/pkg/storage"
+	"github.com/google/uuid"
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+)
+
+var (
+	// ErrBusy is returned when the image is already being transcoded
+	ErrBusy = errors.New("image is already being transcoded")
+
+	// errChanged means the version was replaced or removed while it was re-encoded, so it is left alone
+	errChanged = errors.New("version changed while it was re-encoded")
+)
+
+// Target is the compression the versions are re-encoded to, level 0 is the default level of the strategy
+type Target struct {
+	Strategy images.DiskCompressionStrategy
+	Level    int
+}
+
+// Check returns an error if the versions cannot be compressed this way
+func (t Target) Check() error {
+	return compression.CheckLevel(t.Strategy, t.Level)
+}
+
+// IsSet reports whether the target compresses at all, the zero target and none leave the files as they are
+func (t Target) IsSet() bool {
+	return t.Strategy != "" && t.Strategy != images.DiskCompressionStrategyNone
+}
+
+// State is how far a job has come
+type State string
+
+const (
+	// Running jobs are still re-encoding versions
+	Running State = "running"
+	// Done jobs have re-encoded every version and updated the image
+	Done State = "done"
+	// Failed jobs stopped at an error, the versions before it are re-encoded but the image is left as it was
+	Failed State = "failed"
+)
+
+// Status describes a job, the sizes are those of the stored files before and after re-encoding
+type Status struct {
+	Image   images.ImageUUID
+	Target  Target
+	RawOnly bool
+	State   State
+	Error   string `json:",omitempty"`
+
+	// Versions is how many versions the image had when the job started, Transcoded are re-encoded
+	// and Skipped already had the target compression or were removed in the meantime.
+	Versions    int
+	Transcoded  int
+	Skipped     int
+	BytesBefore int64
+	BytesAfter  int64
+
+	Started  time.Time
+	Finished *time.Time `json:",omitempty"`
+}
+
+// Job re-encodes the versions of one image in the background
+type Job struct {
+	mu     sync.Mutex
+	status Status
+	done   chan struct{}
+}
+
+// Status returns the current status of the job
+func (j *Job) Status() Status {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	return j.status
+}
+
+// Wait blocks until the job is finished and returns its final status
+func (j *Job) Wait() Status {
+	<-j.done
+	return j.Status()
+}
+
+func (j *Job) update(f func(status *Status)) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	f(&j.status)
+}
+
+// Transcoder runs the jobs, at most one per image at a time
+type Transcoder struct {
+	store     database.Store
+	files     storage.ImageFiles
+	downloads *downloads
+
+	mu     sync.Mutex
+	jobs   map[images.ImageUUID]*Job
+	queued map[images.ImageUUID]Target
+}
+
+// NewTranscoder creates a transcoder which re-encodes the files in the backend and updates the images in the store
+func NewTranscoder(store database.Store, files storage.ImageFiles) *Transcoder {
+	return &Transcoder{
+		store:     store,
+		files:     files,
+		downloads: newDownloads(DownloadLinger),
+		jobs:      make(map[images.ImageUUID]*Job),
+		queued:    make(map[images.ImageUUID]Target),
+	}
+}
+
+// Job returns the last job of the image, nil if it has not been transcoded since the server started
+func (t *Transcoder) Job(uuid images.ImageUUID) *Job {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	return t.jobs[uuid]
+}
+
+// Start re-encodes the versions of the image in the background. With rawOnly only the uncompressed versions
+// are re-encoded, otherwise every version unless it already has the target strategy and the default level.
+func (t *Transcoder) Start(uuid images.ImageUUID, target Target, rawOnly bool) (*Job, error) {
+	return t.start(uuid, target, rawOnly, false)
+}
+
+// CompressRaw compresses the uncompressed versions of the image in the background. While the image is being
+// transcoded the job is queued instead and started once the running one is done, so a version which was
+// stored in the meantime is compressed as well.
+func (t *Transcoder) CompressRaw(uuid images.ImageUUID, target Target) error {
+	_, err := t.start(uuid, target, true, true)
+	return err
+}
+
+// start creates the job and runs it, queue means a busy image gets a raw only job after the running one
+func (t *Transcoder) start(uuid images.ImageUUID, target Target, rawOnly bool, queue bool) (*Job, error) {
+	if err := target.Check(); err != nil {
+		return nil, err
+	}
+
+	// The strategy is stored as the images have it, whatever case it was given in
+	target.Strategy = images.DiskCompressionStrategy(strings.ToLower(string(target.Strategy)))
+
+	image, err := t.store.GetImageByUUID(uuid)
+	if err != nil {
+		return nil, errors.Wrap(err, "get image")
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if job, ok := t.jobs[uuid]; ok && job.Status().State == Running {
+		if !queue {
+			return nil, ErrBusy
+		}
+
+		t.queued[uuid] = target
+		return nil, nil
+	}
+
+	job := &Job{
+		status: Status{
+			Image:    uuid,
+			Target:   target,
+			RawOnly:  rawOnly,
+			State:    Running,
+			Versions: len(image.Versions),
+			Started:  time.Now(),
+		},
+		done: make(chan struct{}),
+	}
+
+	t.jobs[uuid] = job
+	go t.run(job, image)
+
+	return job, nil
+}
+
+// run re-encodes the versions and finishes the job
+func (t *Transcoder) run(job *Job, image *images.ImageModel) {
+	defer close(job.done)
+	defer t.next(image.UUID)
+
+	err := t.transcode(job, image)
+
+	job.update(func(status *Status) {
+		now := time.Now()
+		status.Finished = &now
+		status.State = Done
+
+		if err != nil {
+			status.State = Failed
+			status.Error = err.Error()
+		}
+	})
+
+	status := job.Status()
+	if err != nil {
+		log.Errorf("Transcoding image %s to %s: %v", image.UUID, status.Target.Strategy, err)
+		return
+	}
+
+	log.Infof("Transcoded %d versions of image %s to %s, %d bytes became %d bytes", status.Transcoded,
+		image.UUID, status.Target.Strategy, status.BytesBefore, status.BytesAfter)
+}
+
+// next starts the raw only job which was queued while the last job of the image ran
+func (t *Transcoder) next(uuid images.ImageUUID) {
+	t.mu.Lock()
+	target, ok := t.queued[uuid]
+	delete(t.queued, uuid)
+	t.mu.Unlock()
+
+	if !ok {
+		return
+	}
+
+	if err := t.CompressRaw(uuid, target); err != nil {
+		log.Errorf("Compressing the raw versions of image %s: %v", uuid, err)
+	}
+}
+
+func (t *Transcoder) transcode(job *Job, image *images.ImageModel) error {
+	target := job.Status().Target
+	rawOnly := job.Status().RawOnly
+
+	for _, version := range image.Versions {
+		transcoded, before, after, err := t.version(image.UUID, version, target, rawOnly)
+		if err != nil {
+			return errors.Wrapf(err, "version %d", version.Version)
+		}
+
+		job.update(func(status *Status) {
+			if !transcoded {
+				status.Skipped++
+				return
+			}
+
+			status.Transcoded++
+			status.BytesBefore += before
+			status.BytesAfter += after
+		})
+	}
+
+	// Only the raw versions were looked at, the image keeps the compression it has
+	if rawOnly {
+		return nil
+	}
+
+	return errors.Wrap(t.store.SetImageCompression(image.UUID, target.Strategy), "set image compression")
+}
+
+// version re-encodes the file of a single version, it returns whether it did and the sizes of the files
+func (t *Transcoder) version(image images.ImageUUID, version images.Version, target Target,
+	rawOnly bool) (bool, int64, int64, error) {
+	f, err := t.files.Open(image, storage.VersionFile(version.Version))
+	if err == storage.ErrNotFound {
+		return false, 0, 0, nil
+	} else if err != nil {
+		return false, 0, 0, errors.Wrap(err, "open version file")
+	}
+
+	defer f.Close()
+
+	before, err := f.Seek(0, io.SeekEnd)
+	if err == nil {
+		_, err = f.Seek(0, io.SeekStart)
+	}
+
+	if err != nil {
+		return false, 0, 0, errors.Wrap(err, "seek version file")
+	}
+
+	decompressed, strategy, err := compression.DecompressDetected(f)
+	if err != nil {
+		return false, 0, 0, errors.Wrap(err, "decompress version file")
+	}
+
+	defer decompressed.Close()
+
+	if skip(strategy, target, rawOnly) {
+		return false, 0, 0, nil
+	}
+
+	// The contents are hashed on the way in to check them against the version, and the new file on the way
+	// out because committing the upload checks that nothing was lost on the disk.
+	contents := newDiskDigest()
+	defer contents.Close()
+
+	compressed, err := compression.CompressLevel(io.TeeReader(decompressed, contents), target.Strategy, target.Level)
+	if err != nil {
+		return false, 0, 0, errors.Wrap(err, "compress version file")
+	}
+
+	defer compressed.Close()
+
+	upload := uuid.New().String()
+	file := sha256.New()
+
+	after, err := t.files.Append(upload, 0, io.TeeReader(compressed, file))
+	if err != nil {
+		_ = t.files.Discard(upload)
+		return false, 0, 0, errors.Wrap(err, "stage version file")
+	}
+
+	digest, diskType, err := contents.Sum()
+	if err != nil {
+		_ = t.files.Discard(upload)
+		return false, 0, 0, errors.Wrap(err, "read re-encoded contents")
+	}
+
+	// The file is replaced once nobody downloads it, a download which is resumed later must get the same file
+	err = t.downloads.replace(image, version.Version, func() error {
+		if err := t.check(image, version, digest); err != nil {
+			return err
+		}
+
+		err := t.files.Commit(upload, image, storage.VersionFile(version.Version), hex.EncodeToString(file.Sum(nil)))
+		return errors.Wrap(err, "replace version file")
+	})
+
+	if err != nil {
+		_ = t.files.Discard(upload)
+
+		if err == errChanged {
+			return false, 0, 0, nil
+		}
+
+		return false, 0, 0, err
+	}
+
+	// The version keeps track of what its file holds now
+	version.Compression = target.Strategy
+	version.Type = diskType
+	if err = t.store.SetVersionDigest(version); err != nil {
+		return false, 0, 0, errors.Wrap(err, "update version")
+	}
+
+	return true, before, after, nil
+}
+
+// check makes sure the re-encoded contents are still what the version holds. It returns errChanged for a
+// version which got a new file or was removed in the meantime, versions without a digest cannot be checked.
+func (t *Transcoder) check(uuid images.ImageUUID, version images.Version, digest string) error {
+	if version.Digest != "" && version.Digest != digest {
+		return errors.Errorf("re-encoded contents have digest %s instead of %s", digest, version.Digest)
+	}
+
+	image, err := t.store.GetImageByUUID(uuid)
+	if err != nil {
+		return errors.Wrap(err, "get image")
+	}
+
+	for _, current := range image.Versions {
+		if current.Version == version.Version && current.Digest == version.Digest {
+			return nil
+		}
+	}
+
+	return errChanged
+}
+
+// skip reports whether a file compressed with the strategy is left alone
+func skip(strategy images.DiskCompressionStrategy, target Target, rawOnly bool) bool {
+	if rawOnly {
+		return strategy != images.DiskCompressionStrategyNone
+	}
+
+	// A level can only be changed by re-encoding, without one there is nothing to gain
+	return strategy == target.Strategy && target.Level == 0
+}
+
+// diskDigest computes the digest of the disk in the image which is written to it, like the digest of a
+// version. Qcow2 and sparse images are expanded while they are written.
+type diskDigest struct {
+	w      *io.PipeWriter
+	result chan digestResult
+}
+
+type digestResult struct {
+	digest   string
+	diskType images.DiskType
+	err      error
+}
+
+func newDiskDigest() *diskDigest {
+	r, w := io.Pipe()
+	d := &diskDigest{w: w, result: make(chan digestResult, 1)}
+
+	go func() {
+		digest, _, diskType, err := diskimage.Digest(r)
+
+		// Anything after the disk is read as well, so writing to the digest never blocks
+		_, _ = io.Copy(ioutil.Discard, r)
+		d.result <- digestResult{digest: digest, diskType: diskType, err: err}
+	}()
+
+	return d
+}
+
+func (d *diskDigest) Write(p []byte) (int, error) {
+	return d.w.Write(p)
+}
+
+// Sum waits until the whole image has been read and returns the hex encoded digest of the disk in it and the
+// type of the image
+func (d *diskDigest) Sum() (string, images.DiskType, error) {
+	_ = d.w.Close()
+
+	result := <-d.result
+	return result.digest, result.diskType, result.err
+}
+
+// Close stops the digest, whatever was not written yet is treated as missing
+func (d *diskDigest) Close() error {
+	return d.w.CloseWithError(io.ErrUnexpectedEOF)
+}
@@ -0,0 +1,290 @@
+// Copyright (c) 2020-2022 TU Delft & Valentijn van de Beek <v.d.vandebeek@student.tudelft.nl> All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package transcode
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"io/ioutil"
+	"testing"
+	"time"
+
+	"github.com/baas-project/baas/pkg/compression"
+	"github.com/baas-project/baas/pkg/database"
+	"github.com/baas-project/baas/pkg/database/memory"
+	"github.com/baas-project/baas/pkg/model/images"
+	"github.com/baas-project/baas/pkg/storage"
+	"github.com/stretchr/testify/assert"
+)
+
+var contents = bytes.Repeat([]byte("hello world "), 1000)
+
+// storeVersion writes the contents as the file of the version, compressed with the strategy
+func storeVersion(t *testing.T, store database.Store, files storage.ImageFiles, version uint64,
+	strategy images.DiskCompressionStrategy) {
+	if version > 0 {
+		hash := sha256.Sum256(contents)
+		store.CreateNewImageVersion(images.Version{Version: version, ImageModelUUID: "fedora",
+			Digest: hex.EncodeToString(hash[:])})
+	}
+
+	r, err := compression.Compress(bytes.NewReader(contents), strategy)
+	assert.NoError(t, err)
+
+	w, err := files.Write("fedora", storage.VersionFile(version))
+	assert.NoError(t, err)
+
+	_, err = io.Copy(w, r)
+	assert.NoError(t, err)
+	assert.NoError(t, w.Close())
+}
+
+// strategyOf detects the compression of the file of the version and checks that the contents are unchanged
+func strategyOf(t *testing.T, files storage.ImageFiles, version uint64) images.DiskCompressionStrategy {
+	f, err := files.Open("fedora", storage.VersionFile(version))
+	assert.NoError(t, err)
+
+	defer f.Close()
+
+	r, strategy, err := compression.DecompressDetected(f)
+	assert.NoError(t, err)
+
+	data, err := ioutil.ReadAll(r)
+	assert.NoError(t, err)
+	assert.Equal(t, contents, data)
+
+	return strategy
+}
+
+func setup(t *testing.T) (database.Store, storage.ImageFiles) {
+	store := memory.NewStore()
+	files := storage.NewMemory()
+
+	store.CreateImage(&images.ImageModel{Name: "Fedora", UUID: "fedora", Username: "alice",
+		DiskCompressionStrategy: images.DiskCompressionStrategyNone})
+
+	storeVersion(t, store, files, 0, images.DiskCompressionStrategyNone)
+	storeVersion(t, store, files, 1, images.DiskCompressionStrategyGZip)
+	storeVersion(t, store, files, 2, images.DiskCompressionStrategyZSTD)
+
+	return store, files
+}
+
+func TestTranscoder_Start(t *testing.T) {
+	store, files := setup(t)
+	transcoder := NewTranscoder(store, files)
+
+	assert.Nil(t, transcoder.Job("fedora"))
+
+	job, err := transcoder.Start("fedora", Target{Strategy: "ZSTD"}, false)
+	assert.NoError(t, err)
+
+	// The version which already is zstd is left alone
+	status := job.Wait()
+	assert.Equal(t, Done, status.State)
+	assert.Equal(t, 3, status.Versions)
+	assert.Equal(t, 2, status.Transcoded)
+	assert.Equal(t, 1, status.Skipped)
+	assert.NotNil(t, status.Finished)
+	assert.Equal(t, job, transcoder.Job("fedora"))
+
+	for v := uint64(0); v <= 2; v++ {
+		assert.Equal(t, images.DiskCompressionStrategy(images.DiskCompressionStrategyZSTD), strategyOf(t, files, v))
+	}
+
+	image, err := store.GetImageByUUID("fedora")
+	assert.NoError(t, err)
+	assert.Equal(t, images.DiskCompressionStrategy(images.DiskCompressionStrategyZSTD), image.DiskCompressionStrategy)
+	assert.Equal(t, images.DiskCompressionStrategy(images.DiskCompressionStrategyZSTD), image.Versions[1].Compression)
+
+	// With a level every version is re-encoded
+	job, err = transcoder.Start("fedora", Target{Strategy: images.DiskCompressionStrategyGZip, Level: 9}, false)
+	assert.NoError(t, err)
+
+	status = job.Wait()
+	assert.Equal(t, Done, status.State)
+	assert.Equal(t, 3, status.Transcoded)
+
+	image, err = store.GetImageByUUID("fedora")
+	assert.NoError(t, err)
+	assert.Equal(t, images.DiskCompressionStrategy(images.DiskCompressionStrategyGZip), image.DiskCompressionStrategy)
+}
+
+func TestTranscoder_RawOnly(t *testing.T) {
+	store, files := setup(t)
+	transcoder := NewTranscoder(store, files)
+
+	job, err := transcoder.Start("fedora", Target{Strategy: images.DiskCompressionStrategyXZ}, true)
+	assert.NoError(t, err)
+
+	status := job.Wait()
+	assert.Equal(t, Done, status.State)
+	assert.Equal(t, 1, status.Transcoded)
+	assert.Equal(t, 2, status.Skipped)
+
+	assert.Equal(t, images.DiskCompressionStrategy(images.DiskCompressionStrategyXZ), strategyOf(t, files, 0))
+	assert.Equal(t, images.DiskCompressionStrategy(images.DiskCompressionStrategyGZip), strategyOf(t, files, 1))
+	assert.Equal(t, images.DiskCompressionStrategy(images.DiskCompressionStrategyZSTD), strategyOf(t, files, 2))
+
+	// Only the versions are compressed, the image keeps its compression
+	image, err := store.GetImageByUUID("fedora")
+	assert.NoError(t, err)
+	assert.Equal(t, images.DiskCompressionStrategy(images.DiskCompressionStrategyNone), image.DiskCompressionStrategy)
+
+	job, err = transcoder.Start("fedora", Target{Strategy: images.DiskCompressionStrategyLZ4}, true)
+	assert.NoError(t, err)
+
+	status = job.Wait()
+	assert.Equal(t, Done, status.State)
+	assert.Equal(t, 0, status.Transcoded)
+
+	image, err = store.GetImageByUUID("fedora")
+	assert.NoError(t, err)
+	assert.Equal(t, images.DiskCompressionStrategy(images.DiskCompressionStrategyNone), image.DiskCompressionStrategy)
+}
+
+// blockingFiles holds back opening the files until it is released
+type blockingFiles struct {
+	storage.ImageFiles
+	release chan struct{}
+}
+
+func (f blockingFiles) Open(image images.ImageUUID, name string) (storage.File, error) {
+	<-f.release
+	return f.ImageFiles.Open(image, name)
+}
+
+func TestTranscoder_CompressRaw(t *testing.T) {
+	store, files := setup(t)
+	blocking := blockingFiles{ImageFiles: files, release: make(chan struct{})}
+	transcoder := NewTranscoder(store, blocking)
+
+	running, err := transcoder.Start("fedora", Target{Strategy: images.DiskCompressionStrategyGZip}, false)
+	assert.NoError(t, err)
+
+	// A version stored while the image is transcoded is compressed once the job is done
+	storeVersion(t, store, files, 3, images.DiskCompressionStrategyNone)
+	assert.NoError(t, transcoder.CompressRaw("fedora", Target{Strategy: images.DiskCompressionStrategyZSTD}))
+
+	_, err = transcoder.Start("fedora", Target{Strategy: images.DiskCompressionStrategyZSTD}, true)
+	assert.Equal(t, ErrBusy, err)
+
+	close(blocking.release)
+	assert.Equal(t, Done, running.Wait().State)
+
+	queued := transcoder.Job("fedora")
+	assert.True(t, running != queued)
+
+	status := queued.Wait()
+	assert.Equal(t, Done, status.State)
+	assert.True(t, status.RawOnly)
+	assert.Equal(t, 1, status.Transcoded)
+	assert.Equal(t, images.DiskCompressionStrategy(images.DiskCompressionStrategyZSTD), strategyOf(t, files, 3))
+
+	// The raw only job leaves the compression the first job gave the image
+	image, err := store.GetImageByUUID("fedora")
+	assert.NoError(t, err)
+	assert.Equal(t, images.DiskCompressionStrategy(images.DiskCompressionStrategyGZip), image.DiskCompressionStrategy)
+}
+
+func TestTranscoder_Downloads(t *testing.T) {
+	store, files := setup(t)
+	transcoder := NewTranscoder(store, files)
+	transcoder.downloads.linger = 50 * time.Millisecond
+
+	done := transcoder.Download("fedora", 1)
+
+	job, err := transcoder.Start("fedora", Target{Strategy: images.DiskCompressionStrategyZSTD}, false)
+	assert.NoError(t, err)
+
+	// Version 0 is transcoded, version 1 waits until it is no longer downloaded
+	assert.Eventually(t, func() bool {
+		return job.Status().Transcoded == 1
+	}, time.Second, time.Millisecond)
+
+	time.Sleep(100 * time.Millisecond)
+	assert.Equal(t, Running, job.Status().State)
+	assert.Equal(t, images.DiskCompressionStrategy(images.DiskCompressionStrategyGZip), strategyOf(t, files, 1))
+
+	// And until an interrupted download had the time to resume
+	ended := time.Now()
+	done()
+
+	status := job.Wait()
+	assert.Equal(t, Done, status.State)
+	assert.Equal(t, 2, status.Transcoded)
+	assert.True(t, time.Since(ended) >= transcoder.downloads.linger)
+	assert.Equal(t, images.DiskCompressionStrategy(images.DiskCompressionStrategyZSTD), strategyOf(t, files, 1))
+
+	// Downloads which start while the file is replaced wait for the new file
+	replacing := make(chan struct{})
+	replaced := make(chan struct{})
+	go func() {
+		_ = transcoder.downloads.replace("fedora", 2, func() error {
+			close(replacing)
+			time.Sleep(50 * time.Millisecond)
+			close(replaced)
+			return nil
+		})
+	}()
+
+	<-replacing
+	done = transcoder.Download("fedora", 2)
+	defer done()
+
+	select {
+	case <-replaced:
+	default:
+		t.Error("download started while the file was replaced")
+	}
+}
+
+func TestTranscoder_DigestMismatch(t *testing.T) {
+	store, files := setup(t)
+
+	// The file of version 1 no longer holds what the version says
+	r, err := compression.Compress(bytes.NewReader([]byte("corrupt")), images.DiskCompressionStrategyGZip)
+	assert.NoError(t, err)
+
+	w, err := files.Write("fedora", storage.VersionFile(1))
+	assert.NoError(t, err)
+	_, err = io.Copy(w, r)
+	assert.NoError(t, err)
+	assert.NoError(t, w.Close())
+
+	job, err := NewTranscoder(store, files).Start("fedora", Target{Strategy: images.DiskCompressionStrategyZSTD}, false)
+	assert.NoError(t, err)
+
+	// The corrupt file is kept and the image still has its old compression
+	status := job.Wait()
+	assert.Equal(t, Failed, status.State)
+	assert.Contains(t, status.Error, "version 1")
+
+	f, err := files.Open("fedora", storage.VersionFile(1))
+	assert.NoError(t, err)
+	_, strategy, err := compression.DecompressDetected(f)
+	assert.NoError(t, err)
+	assert.Equal(t, images.DiskCompressionStrategy(images.DiskCompressionStrategyGZip), strategy)
+
+	image, err := store.GetImageByUUID("fedora")
+	assert.NoError(t, err)
+	assert.Equal(t, images.DiskCompressionStrategy(images.DiskCompressionStrategyNone), image.DiskCompressionStrategy)
+}
+
+func TestTranscoder_Invalid(t *testing.T) {
+	store, files := setup(t)
+	transcoder := NewTranscoder(store, files)
+
+	_, err := transcoder.Start("fedora", Target{Strategy: "bzip2"}, false)
+	assert.Error(t, err)
+
+	_, err = transcoder.Start("fedora", Target{Strategy: images.DiskCompressionStrategyLZ4, Level: 3}, false)
+	assert.Error(t, err)
+
+	_, err = transcoder.Start("arch", Target{Strategy: images.DiskCompressionStrategyZSTD}, false)
+	assert.Error(t, err)
+}
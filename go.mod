@@ -3,7 +3,6 @@ module github.com/baas-project/baas
 go 1.15
 
 require (
-	github.com/codingsince1985/checksum v1.2.4
 	github.com/diskfs/go-diskfs v1.2.0
 	github.com/frankban/quicktest v1.14.1 // indirect
 	github.com/google/uuid v1.1.2
@@ -12,14 +11,17 @@ require (
 	github.com/klauspost/compress v1.13.6 // indirect
 	github.com/klauspost/pgzip v1.2.5
 	github.com/pelletier/go-toml/v2 v2.0.0-beta.3
-	github.com/pkg/errors v0.8.0
-	github.com/rs/cors v1.8.2 // indirect
+	github.com/pierrec/lz4 v2.3.0+incompatible
+	github.com/pkg/errors v0.8.1
+	github.com/rs/cors v1.8.2
 	github.com/sirupsen/logrus v1.8.1
 	github.com/stretchr/testify v1.7.1-0.20210427113832-6241f9ab9942
+	github.com/ulikunitz/xz v0.5.6
 	github.com/valyala/gozstd v1.8.3
 	go.universe.tf/netboot v0.0.0-20200920222120-66e5fba6f663
 	golang.org/x/oauth2 v0.0.0-20211104180415-d3ed0bb246c8
 	golang.org/x/sys v0.0.0-20210927094055-39ccf1dd6fa6 // indirect
+	gorm.io/driver/postgres v1.1.2
 	gorm.io/driver/sqlite v1.1.6
 	gorm.io/gorm v1.21.16
 )
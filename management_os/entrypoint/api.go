@@ -5,12 +5,16 @@
 package main
 
 import (
+	"bytes"
+	"crypto/sha256"
 	"encoding/json"
 	"fmt"
 	"io"
 	"io/ioutil"
 
+	"github.com/baas-project/baas/pkg/api"
 	"github.com/baas-project/baas/pkg/model/images"
+	"github.com/baas-project/baas/pkg/model/machine"
 
 	"net/http"
 	"strings"
@@ -24,13 +28,34 @@ import (
 // APIClient is the client for all communication with the server
 type APIClient struct {
 	baseURL string
+
+	// mac and token are the credentials of this machine
+	mac   string
+	token string
 }
 
 // NewAPIClient creates a new APIClient struct
-func NewAPIClient(baseURL string) *APIClient {
+func NewAPIClient(baseURL string, mac string, token string) *APIClient {
 	return &APIClient{
 		baseURL: baseURL,
+		mac:     mac,
+		token:   token,
+	}
+}
+
+// newRequest creates a request to the control server which is authenticated with the machine credentials
+func (a *APIClient) newRequest(method string, url string, body io.Reader) (*http.Request, error) {
+	req, err := http.NewRequest(method, url, body)
+	if err != nil {
+		return nil, err
+	}
+
+	req.Header.Set("Origin", "http://localhost:9090")
+	for key, values := range machineHeader(a.mac, a.token) {
+		req.Header[key] = values
 	}
+
+	return req, nil
 }
 
 // BootInform informs the server that we have booted
@@ -38,13 +63,11 @@ func (a *APIClient) BootInform(mac string) (*images.ImageSetup, error) {
 	url := fmt.Sprintf("%s/machine/%s/boot", a.baseURL, mac)
 	log.Debugf("Sending boot inform request to %s", url)
 
-	req, err := http.NewRequest("GET", url, nil)
+	req, err := a.newRequest("GET", url, nil)
 	if err != nil {
-		log.Errorf("Cannot create request: %v", err)
+		return nil, errors.Wrap(err, "cannot create request")
 	}
 
-	req.Header.Set("type", "system")
-	req.Header.Set("Origin", "http://localhost:9090")
 	client := &http.Client{}
 	resp, err := client.Do(req)
 	if err != nil {
@@ -70,84 +93,124 @@ func (a *APIClient) BootInform(mac string) (*images.ImageSetup, error) {
 	return &info, nil
 }
 
-// DownloadDiskHTTP Downloads a disk image from the control_server over HTTP
+// DownloadDiskHTTP Downloads a disk image from the control_server over HTTP. Interrupted transfers are resumed
+// where they stopped and the digest sent by the server is checked once everything has been read.
 func (a *APIClient) DownloadDiskHTTP(uuid images.ImageUUID, version uint64) (io.ReadCloser, error) {
 	url := fmt.Sprintf("%s/image/%s/%d", a.baseURL, uuid, version)
 	log.Infof("downloading disk %v over http from %s", uuid, url)
 
+	d := &resumableDownload{api: a, url: url, hash: sha256.New()}
+	if err := d.request(); err != nil {
+		return nil, err
+	}
+
+	return d, nil
+}
+
+// requestRange requests the file from the given offset on, the request only succeeds if the file still has the etag
+func (a *APIClient) requestRange(url string, offset int64, etag string) (*http.Response, error) {
 	//nolint we are returning a readcloser so the body will be closed later
-	req, err := http.NewRequest("GET", url, nil)
+	req, err := a.newRequest("GET", url, nil)
 	if err != nil {
-		log.Errorf("Cannot create request: %v", err)
+		return nil, errors.Wrap(err, "cannot create request")
+	}
+
+	if offset > 0 {
+		req.Header.Set("Range", fmt.Sprintf("bytes=%d-", offset))
+		req.Header.Set("If-Range", etag)
 	}
 
-	req.Header.Set("type", "system")
-	req.Header.Set("Origin", "http://localhost:9090")
-	log.Warn(req.Header)
 	client := &http.Client{}
 	resp, err := client.Do(req)
 	if err != nil {
 		return nil, errors.Wrap(err, "error dl disk")
 	}
 
-	if resp.StatusCode != http.StatusOK {
+	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusPartialContent {
 		b, _ := ioutil.ReadAll(resp.Body)
+		_ = resp.Body.Close()
 
 		return nil, errors.Errorf("http error while downloading disk (%s)", strings.TrimSpace(string(b)))
 	}
 
-	log.Debugf("done downloading disk %v over http", uuid)
-
-	return resp.Body, nil
+	return resp, nil
 }
 
-// UploadDiskHTTP uploads a disk image given the http strategy
-func (a *APIClient) UploadDiskHTTP(r io.Reader, uuid string) error {
-	url := fmt.Sprintf("%s/image/%s", a.baseURL, uuid)
+// UploadDiskHTTP uploads a disk image as a new version over HTTP. The image is sent in parts, a part which is
+// interrupted is continued from the last byte the server received. The server only creates the version once
+// everything has arrived and the digest matches. A block map is rebuilt into the whole disk by the server.
+func (a *APIClient) UploadDiskHTTP(r io.Reader, uuid string, blockMap bool) (*images.Version, error) {
+	url := fmt.Sprintf("%s/image/%s/uploads", a.baseURL, uuid)
 	log.Debugf("uploading disk %v over http to %s", uuid, url)
 
-	// Create a pipe, so we only pass around the streams, if we try to
-	// write the actual file or program will be reaped.
-	// Dammit Calli, leave my processes alone.
-	boundary := "ProfessorDrIngJanRellermeyer"
-	fileName := "image.img"
-	fileHeader := "Content-Type: application/octet-stream"
-	fileFormat := "--%s\r\nContent-Disposition: form-data; name=\"file\"; filename=\"%s\"\r\n%s\r\n\r\n"
-	filePart := fmt.Sprintf(fileFormat, boundary, fileName, fileHeader)
-
-	end := fmt.Sprintf("\r\n--%s\r\n", boundary)
-
-	body := io.MultiReader(strings.NewReader(filePart), r, strings.NewReader(end))
+	var upload images.UploadModel
+	if err := a.doJSON("POST", url, images.UploadModel{NewVersion: true, BlockMap: blockMap}, &upload); err != nil {
+		return nil, errors.Wrap(err, "start upload")
+	}
 
-	client := &http.Client{}
-	req, err := http.NewRequest("POST", url, body)
+	u := &resumableUpload{api: a, url: fmt.Sprintf("%s/%s", url, upload.UUID)}
+	version, err := u.send(r)
 	if err != nil {
-		return errors.Wrap(err, "error dl disk")
+		u.abort()
+		return nil, errors.Wrap(err, "upload disk")
 	}
 
-	req.Header.Set("Content-Type", fmt.Sprintf("multipart/form-data; boundary=%s", boundary))
-	req.Header.Set("Origin", "http://localhost:9090")
-	req.Header.Set("type", "system")
-	req.Header.Set("X-BAAS-NewVersion", "true")
-	resp, err := client.Do(req)
+	log.Debugf("done uploading disk %v over http, it is version %d", uuid, version.Version)
+
+	return version, nil
+}
+
+// ReportProvisioning tells the control server that an image could not be put on the disk
+func (a *APIClient) ReportProvisioning(mac string, report api.ProvisioningReport) error {
+	url := fmt.Sprintf("%s/machine/%s/report", a.baseURL, mac)
+	return a.doJSON("POST", url, report, nil)
+}
+
+// ReportStatus tells the control server which phase of the provisioning the machine is in
+func (a *APIClient) ReportStatus(mac string, status machine.StatusModel) error {
+	url := fmt.Sprintf("%s/machine/%s/status", a.baseURL, mac)
+	return a.doJSON("POST", url, status, nil)
+}
+
+// doJSON sends the value as JSON and decodes the response into result, if it is not nil
+func (a *APIClient) doJSON(method string, url string, value interface{}, result interface{}) error {
+	var body io.Reader
+	if value != nil {
+		data, err := json.Marshal(value)
+		if err != nil {
+			return err
+		}
+
+		body = bytes.NewReader(data)
+	}
 
+	req, err := a.newRequest(method, url, body)
 	if err != nil {
-		return errors.Wrap(err, "upload disk")
+		return errors.Wrap(err, "cannot create request")
 	}
 
-	if resp.StatusCode != http.StatusOK {
-		b, _ := ioutil.ReadAll(resp.Body)
+	req.Header.Set("Content-Type", "application/json")
 
-		return errors.Errorf("upload disk http (%s) to %s", strings.TrimSpace(string(b)), url)
+	client := &http.Client{}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
 	}
 
 	defer func() {
 		if err := resp.Body.Close(); err != nil {
-			log.Errorf("Failed to close reader (%v)", err)
+			log.Errorf("Failed to close body (%v)", err)
 		}
 	}()
 
-	log.Debugf("done uploading disk %v over http", uuid)
+	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusCreated {
+		msg, _ := ioutil.ReadAll(resp.Body)
+		return errors.Errorf("%s %s failed (%s)", method, url, strings.TrimSpace(string(msg)))
+	}
+
+	if result == nil {
+		return nil
+	}
 
-	return nil
+	return json.NewDecoder(resp.Body).Decode(result)
 }
@@ -6,9 +6,13 @@ package main
 
 import (
 	"io"
+	"io/ioutil"
+	"net/http"
 	"os"
+	"strings"
 	"sync"
 
+	"github.com/baas-project/baas/pkg/api"
 	"github.com/pelletier/go-toml/v2"
 	log "github.com/sirupsen/logrus"
 )
@@ -18,6 +22,17 @@ type Config struct {
 	UploadDisk        bool
 	RebootAfterFinish bool
 	SetNextBoot       bool
+	// Multicast downloads the images from the multicast sessions of the control server, HTTP is used when that fails
+	Multicast bool
+	// Peers serves the versions on the disk to other machines and gets the versions from them where possible
+	Peers bool
+
+	// Disk is the disk the images are written to, its first partition holds the data of the machine. It
+	// defaults to /dev/sda.
+	Disk string
+
+	// Token is the machine credential, only used when the kernel command line does not contain one
+	Token string
 }
 
 var conf *Config
@@ -51,3 +66,51 @@ func getConfig() *Config {
 
 	return conf
 }
+
+// getCmdlineParameter looks for the parameter on the kernel command line. The value is empty for a parameter
+// without one.
+func getCmdlineParameter(name string) (string, bool) {
+	cmdline, err := ioutil.ReadFile("/proc/cmdline")
+	if err != nil {
+		log.Warnf("Cannot read the kernel command line: %v", err)
+	}
+
+	for _, param := range strings.Fields(string(cmdline)) {
+		if param == name {
+			return "", true
+		}
+
+		if strings.HasPrefix(param, name+"=") {
+			return strings.TrimPrefix(param, name+"="), true
+		}
+	}
+
+	return "", false
+}
+
+// getMachineToken returns the credential which the control server issued to this machine.
+// It is passed on the kernel command line when the machine is booted over PXE.
+func getMachineToken() string {
+	if token, ok := getCmdlineParameter(api.TokenCmdlineParameter); ok {
+		return token
+	}
+
+	log.Warn("No machine token on the kernel command line, falling back to the configuration file")
+	return getConfig().Token
+}
+
+// inDiscoveryMode checks whether the control server booted the machine to collect its hardware, which it does for
+// machines it does not know yet
+func inDiscoveryMode() bool {
+	_, ok := getCmdlineParameter(api.DiscoveryCmdlineParameter)
+	return ok
+}
+
+// machineHeader creates the headers which authenticate this machine with the control server
+func machineHeader(mac string, token string) http.Header {
+	header := http.Header{}
+	header.Set(api.MachineHeader, mac)
+	header.Set(api.MachineTokenHeader, token)
+
+	return header
+}
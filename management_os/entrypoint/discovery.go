@@ -0,0 +1,280 @@
+// Copyright (c) 2020-2022 TU Delft & Valentijn van de Beek <v.d.vandebeek@student.tudelft.nl> All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+
+	"github.com/baas-project/baas/pkg/model/machine"
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+)
+
+// sectorSize is the unit in which /sys/block reports the size of a disk
+const sectorSize = 512
+
+// ignoredDisks are the prefixes of block devices which are not disks of the machine
+var ignoredDisks = []string{"loop", "ram", "zram", "dm-", "nbd", "sr", "fd"}
+
+// collectInventory finds the hardware of the machine in /proc and /sys
+func collectInventory() machine.InventoryModel {
+	inventory := machine.InventoryModel{
+		Firmware:     firmwareType(),
+		Architecture: architecture(),
+	}
+
+	var err error
+	if inventory.CPUModel, inventory.CPUCores, inventory.CPUThreads, err = readCPUInfo(); err != nil {
+		log.Warnf("Cannot read the CPUs: %v", err)
+	}
+
+	if inventory.Memory, err = readMemory(); err != nil {
+		log.Warnf("Cannot read the memory: %v", err)
+	}
+
+	if inventory.Disks, err = readDisks(); err != nil {
+		log.Warnf("Cannot read the disks: %v", err)
+	}
+
+	if inventory.NICs, err = readNICs(); err != nil {
+		log.Warnf("Cannot read the network interfaces: %v", err)
+	}
+
+	if inventory.GPUs, err = countGPUs(); err != nil {
+		log.Warnf("Cannot read the PCI devices: %v", err)
+	}
+
+	return inventory
+}
+
+// readCPUInfo returns the model of the CPU, the number of physical cores and the number of logical processors
+func readCPUInfo() (string, int, int, error) {
+	f, err := os.Open("/proc/cpuinfo")
+	if err != nil {
+		return "", 0, 0, err
+	}
+	defer f.Close()
+
+	var model, physical string
+	threads := 0
+	cores := map[string]bool{}
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		key, value, ok := splitField(scanner.Text(), ":")
+		if !ok {
+			continue
+		}
+
+		switch key {
+		case "processor":
+			threads++
+		case "model name":
+			if model == "" {
+				model = value
+			}
+		case "physical id":
+			physical = value
+		case "core id":
+			cores[physical+"/"+value] = true
+		}
+	}
+
+	// Without the topology, which some virtual machines lack, every processor counts as a core
+	if len(cores) == 0 {
+		return model, threads, threads, scanner.Err()
+	}
+
+	return model, len(cores), threads, scanner.Err()
+}
+
+// readMemory returns the amount of RAM in bytes
+func readMemory() (uint64, error) {
+	f, err := os.Open("/proc/meminfo")
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		key, value, ok := splitField(scanner.Text(), ":")
+		if !ok || key != "MemTotal" {
+			continue
+		}
+
+		kilobytes, err := strconv.ParseUint(strings.TrimSuffix(value, " kB"), 10, 64)
+		if err != nil {
+			return 0, err
+		}
+
+		return kilobytes * 1024, nil
+	}
+
+	if err = scanner.Err(); err != nil {
+		return 0, err
+	}
+
+	return 0, errors.New("no MemTotal in /proc/meminfo")
+}
+
+// readDisks returns the disks of the machine, the virtual block devices are left out
+func readDisks() (machine.Disks, error) {
+	entries, err := ioutil.ReadDir("/sys/block")
+	if err != nil {
+		return nil, err
+	}
+
+	var disks machine.Disks
+	for _, entry := range entries {
+		name := entry.Name()
+		if hasAnyPrefix(name, ignoredDisks) {
+			continue
+		}
+
+		dir := filepath.Join("/sys/block", name)
+		sectors, err := strconv.ParseUint(readSysfs(filepath.Join(dir, "size")), 10, 64)
+		if err != nil || sectors == 0 {
+			continue
+		}
+
+		disks = append(disks, machine.Disk{
+			Name:       name,
+			Model:      readSysfs(filepath.Join(dir, "device", "model")),
+			Size:       sectors * sectorSize,
+			Rotational: readSysfs(filepath.Join(dir, "queue", "rotational")) == "1",
+		})
+	}
+
+	return disks, nil
+}
+
+// readNICs returns the physical network interfaces of the machine
+func readNICs() (machine.NICs, error) {
+	entries, err := ioutil.ReadDir("/sys/class/net")
+	if err != nil {
+		return nil, err
+	}
+
+	var nics machine.NICs
+	for _, entry := range entries {
+		dir := filepath.Join("/sys/class/net", entry.Name())
+
+		// Virtual interfaces, like the loopback and bridges, have no device
+		if _, err := os.Stat(filepath.Join(dir, "device")); err != nil {
+			continue
+		}
+
+		nic := machine.NIC{
+			Name:       entry.Name(),
+			MacAddress: readSysfs(filepath.Join(dir, "address")),
+		}
+
+		if driver, err := os.Readlink(filepath.Join(dir, "device", "driver")); err == nil {
+			nic.Driver = filepath.Base(driver)
+		}
+
+		// The speed is -1, or cannot be read at all, when the link is down
+		if speed, err := strconv.Atoi(readSysfs(filepath.Join(dir, "speed"))); err == nil && speed > 0 {
+			nic.Speed = speed
+		}
+
+		nics = append(nics, nic)
+	}
+
+	return nics, nil
+}
+
+// countGPUs counts the display controllers on the PCI bus, whose class starts with 0x03
+func countGPUs() (int, error) {
+	entries, err := ioutil.ReadDir("/sys/bus/pci/devices")
+	if err != nil {
+		return 0, err
+	}
+
+	gpus := 0
+	for _, entry := range entries {
+		if strings.HasPrefix(readSysfs(filepath.Join("/sys/bus/pci/devices", entry.Name(), "class")), "0x03") {
+			gpus++
+		}
+	}
+
+	return gpus, nil
+}
+
+// firmwareType checks whether the machine booted with UEFI, which exposes its variables in /sys/firmware/efi
+func firmwareType() machine.FirmwareType {
+	if _, err := os.Stat("/sys/firmware/efi"); err == nil {
+		return machine.UEFI
+	}
+
+	return machine.BIOS
+}
+
+// architecture returns the architecture the management OS runs on
+func architecture() machine.SystemArchitecture {
+	switch runtime.GOARCH {
+	case "amd64":
+		return machine.X86_64
+	case "arm64":
+		return machine.Arm64
+	default:
+		return machine.Unknown
+	}
+}
+
+// readSysfs returns the trimmed contents of an attribute in /sys, empty if it cannot be read
+func readSysfs(path string) string {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return ""
+	}
+
+	return strings.TrimSpace(string(data))
+}
+
+// splitField splits a line of the form "key: value" and trims both sides
+func splitField(line string, sep string) (string, string, bool) {
+	i := strings.Index(line, sep)
+	if i < 0 {
+		return "", "", false
+	}
+
+	return strings.TrimSpace(line[:i]), strings.TrimSpace(line[i+len(sep):]), true
+}
+
+func hasAnyPrefix(s string, prefixes []string) bool {
+	for _, prefix := range prefixes {
+		if strings.HasPrefix(s, prefix) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// discover sends the hardware of the machine to the control server, which registers the machine for an admin to
+// approve
+func discover(a *APIClient, mac string) error {
+	inventory := collectInventory()
+	log.Infof("Found %s with %d cores, %d bytes of memory, %d disks, %d network interfaces and %d GPUs (%s)",
+		inventory.CPUModel, inventory.CPUCores, inventory.Memory, len(inventory.Disks), len(inventory.NICs),
+		inventory.GPUs, inventory.Firmware)
+
+	return a.RegisterInventory(mac, inventory)
+}
+
+// RegisterInventory sends the hardware of the machine to the control server
+func (a *APIClient) RegisterInventory(mac string, inventory machine.InventoryModel) error {
+	url := fmt.Sprintf("%s/discover/%s", a.baseURL, mac)
+	return a.doJSON("POST", url, inventory, nil)
+}
@@ -6,54 +6,107 @@ package main
 
 import (
 	"io"
+	"io/ioutil"
+	"strings"
 
+	api_pkg "github.com/baas-project/baas/pkg/api"
+	"github.com/baas-project/baas/pkg/blockmap"
 	"github.com/baas-project/baas/pkg/compression"
+	"github.com/baas-project/baas/pkg/diskimage"
 	"github.com/baas-project/baas/pkg/model/images"
 	"github.com/baas-project/baas/pkg/util"
-	gzip "github.com/klauspost/pgzip"
 	"github.com/pkg/errors"
 	log "github.com/sirupsen/logrus"
 )
 
-func setupDisk(api *APIClient, mac string, image *images.ImageModel, version uint64) error {
+// setupDisk puts the version on the partition of the image. When shared is set the disk may come from the peers
+// or a multicast session as configured, otherwise it is downloaded from the control server.
+func setupDisk(api *APIClient, mac string, image *images.ImageModel, version images.Version, shared bool) error {
 	log.Debugf("writing disk: %v", mac)
 
-	reader, err := DownloadDisk(api, image, version)
+	partition := getPartition(image.UUID)
+	if partition == nil {
+		return errors.Errorf("no partition was planned for image %s", image.UUID)
+	}
+
+	if holdsVersion(partition, version) {
+		log.Infof("Version %d of image %s is already on disk", version.Version, image.UUID)
+		return nil
+	}
+
+	// The partition is about to be overwritten, peers cannot get the version it held anymore
+	peers.withdraw(partition.DeviceFile)
+
+	// Peers send the expanded disk, there is nothing to decompress
+	if shared && peers != nil {
+		disk, err := api.DownloadDiskPeers(image.UUID, version.Version)
+		if err != nil {
+			log.Warnf("Cannot download image %s from peers: %v", image.UUID, err)
+		} else if disk != nil {
+			defer disk.Close()
+			downloaded := newProgress(api, disk, image, version.Version, api_pkg.StageDownload, version.Size)
+			defer downloaded.Finish()
+			return writeVersion(api, partition, downloaded, image, version)
+		}
+	}
+
+	reader, err := DownloadDisk(api, image, version.Version, shared && getConfig().Multicast)
 	if err != nil {
 		return errors.Wrap(err, "error downloading disk")
 	}
 
-	// Kind of a dirty hack which I am not super proud of. However, GZip's reader has an extra close method that
-	// we need to deal with. This can only be done after writing everything, which means we need to keep the type
-	// somehow. Casting it upwards is not allowed, hence this is the only solution I could find. Maybe there
-	// is a neater way out there. Feel free to change this.
-	var dec io.Reader
-	if image.DiskCompressionStrategy == images.DiskCompressionStrategyGZip {
-		r, err2 := gzip.NewReader(reader)
+	downloaded := newProgress(api, reader, image, version.Version, api_pkg.StageDownload, downloadSize(reader))
+	defer downloaded.Finish()
 
-		if err2 != nil {
-			return errors.Wrap(err, "Opening GZip stream")
-		}
+	// The compression is detected from the stream, the image may have been uploaded in another format
+	dec, strategy, err := compression.DecompressDetected(downloaded)
+	if err != nil {
+		_ = reader.Close()
+		return errors.Wrap(err, "error decompressing disk")
+	}
 
-		defer func() {
-			err = r.Close()
-			if err != nil {
-				log.Warnf("Cannot close GZip stream: '%s'", err)
-			}
-		}()
-
-		// Cast down to common Reader
-		dec = r // nolint: ineffassign
-	} else {
-		dec, err = compression.Decompress(reader, image.DiskCompressionStrategy)
-		if err != nil {
-			return errors.Wrap(err, "error decompressing disk")
+	defer func() {
+		if err := dec.Close(); err != nil {
+			log.Warnf("Cannot close the decompression stream: %v", err)
 		}
+	}()
+
+	// The version knows what its file holds, versions from before it did are made like the image says
+	expected, expectedType := version.Compression, version.Type
+	if expected == "" {
+		expected, expectedType = image.DiskCompressionStrategy, image.ImageFileType
+	}
+
+	if !strings.EqualFold(string(strategy), string(expected)) {
+		log.Infof("Image %s is compressed with %s instead of %s", image.UUID, strategy, expected)
 	}
 
-	err = WriteDisk(dec, image)
+	// Only a raw image is as large as the disk in it
+	var decompressedSize int64
+	if expectedType == images.DiskTypeRaw {
+		decompressedSize = version.Size
+	}
+
+	decompressed := newProgress(api, dec, image, version.Version, api_pkg.StageDecompress, decompressedSize)
+	defer decompressed.Finish()
+
+	// Qcow2 and sparse images leave out the blocks which are zero, they are filled in here instead of being sent
+	diskType, disk, err := diskimage.Open(decompressed)
 	if err != nil {
-		return errors.Wrap(err, "error writing disk")
+		return errors.Wrap(err, "error reading disk image")
+	}
+
+	if diskType != expectedType {
+		log.Infof("Image %s is a %s image instead of %s", image.UUID, diskType, expectedType)
+	}
+
+	if err = writeVersion(api, partition, diskimage.NewReader(disk), image, version); err != nil {
+		return err
+	}
+
+	// Whatever follows the last cluster of a qcow2 image is still read, the download is only checked at its end
+	if _, err = io.Copy(ioutil.Discard, decompressed); err != nil {
+		return errors.Wrap(err, "error downloading disk")
 	}
 
 	err = reader.Close()
@@ -65,28 +118,127 @@ func setupDisk(api *APIClient, mac string, image *images.ImageModel, version uin
 	return nil
 }
 
+// writeVersion writes the expanded disk of the version to the partition and checks it. Once it is there, the
+// version is served to the peers.
+func writeVersion(api *APIClient, partition *Partition, disk io.Reader, image *images.ImageModel,
+	version images.Version) error {
+	progress := newProgress(api, disk, image, version.Version, api_pkg.StageWrite, version.Size)
+	defer progress.Finish()
+
+	// The digest is computed over what is written, so the disk is checked without reading it back. The blocks
+	// are hashed as well, so the next upload of the partition only has to send the blocks which changed.
+	partition.Blocks = nil
+	hasher := blockmap.NewHasher(blockmap.DefaultBlockSize)
+	written := newDigestReader(io.TeeReader(progress, hasher))
+	if err := WriteDisk(written, image); err != nil {
+		return errors.Wrap(err, "error writing disk")
+	}
+
+	if err := written.verify(version); err != nil {
+		if err2 := invalidatePartition(partition); err2 != nil {
+			log.Errorf("Cannot invalidate the corrupt partition: %v", err2)
+		}
+
+		return err
+	}
+
+	// Without a digest the server cannot tell whether the version is still the same when it gets the upload
+	if version.Digest != "" {
+		partition.Blocks = hasher.Hashes()
+		partition.Blocks.Version = version.Version
+		partition.Blocks.Digest = version.Digest
+
+		peers.offer(partition)
+		peers.announce()
+	}
+
+	return nil
+}
+
 // WriteOutDisks Downloads, Decompresses and finally Writes a disk image to disk
 func WriteOutDisks(api *APIClient, mac string, setup *images.ImageSetup) error {
 	log.Info("Downloading and writing disks")
 
-	for _, image := range setup.Images {
+	if err := checkDigests(setup); err != nil {
+		reportFailure(api, mac, api_pkg.ProvisioningReport{Error: err.Error()})
+		return err
+	}
+
+	// The partitions are laid out before anything is written, a setup which does not fit leaves the disk alone
+	if err := planPartitions(setup); err != nil {
+		reportFailure(api, mac, api_pkg.ProvisioningReport{Error: err.Error()})
+		return errors.Wrap(err, "couldn't lay out the partitions")
+	}
+
+	for i, image := range setup.Images {
 		log.Warnf("Image UUID: %s", image.Image.UUID)
+		provisioning.progress(&image, i, len(setup.Images))
 		// Yes, you could inline this function but this screws with the defers mechanism that Go has.
 		// By using a separate method call we ensure that the file are closed whenever they are no longer
 		// needed rather than waiting for the entire cycle.
 		util.PrettyPrintStruct(image)
-		err := setupDisk(api, mac, &image.Image, image.Version.Version)
+
+		var err error
+		if image.Export != "" {
+			// The control server serves the image over NBD, the disk of the machine is left alone
+			err = attachNBD(api, &image)
+		} else {
+			err = setupDisk(api, mac, &image.Image, image.Version, true)
+		}
+
+		if err != nil && image.Export == "" && (getConfig().Multicast || peers != nil) {
+			log.Warnf("Cannot set up image %s, trying again from the control server: %v", image.Image.UUID, err)
+			err = setupDisk(api, mac, &image.Image, image.Version, false)
+		}
 
 		if err != nil {
-			return errors.Wrap(err, "couldn't close download body")
+			report := api_pkg.ProvisioningReport{Image: image.Image.UUID, Version: image.Version.Version, Error: err.Error()}
+			reportFailure(api, mac, report)
+			return errors.Wrapf(err, "couldn't set up image %s", image.Image.UUID)
 		}
 	}
 
 	return nil
 }
 
-// DownloadDisk downloads a disk from the network using the image's DiskTransferStrategy
-func DownloadDisk(api *APIClient, image *images.ImageModel, version uint64) (reader io.ReadCloser, _ error) {
+// checkDigests refuses a setup with a signature policy in which a version has no digest. The versions are signed
+// over their digests, so what is written could not be checked against what was signed. The machine image is
+// sent without a version of its own and is not part of the policy.
+func checkDigests(setup *images.ImageSetup) error {
+	if setup.SignaturePolicy == "" || setup.SignaturePolicy == images.SignaturePolicyNone {
+		return nil
+	}
+
+	for _, image := range setup.Images {
+		if image.Version.ImageModelUUID != "" && image.Version.Digest == "" {
+			return errors.Errorf("version %d of image %s has no digest, which the %s policy of the setup requires",
+				image.Version.Version, image.Image.UUID, setup.SignaturePolicy)
+		}
+	}
+
+	return nil
+}
+
+// reportFailure tells the control server why the setup could not be put on the disk
+func reportFailure(api *APIClient, mac string, report api_pkg.ProvisioningReport) {
+	if err := api.ReportProvisioning(mac, report); err != nil {
+		log.Errorf("Cannot report the failure to the control server: %v", err)
+	}
+}
+
+// DownloadDisk downloads a disk from the network, over multicast if asked for. HTTP is used when the control
+// server has no multicast session to offer.
+func DownloadDisk(api *APIClient, image *images.ImageModel, version uint64, multicast bool) (io.ReadCloser, error) {
 	log.Debugf("Downloading image: %s", image.UUID)
+
+	if multicast {
+		reader, err := api.DownloadDiskMulticast(image.UUID, version)
+		if err == nil {
+			return reader, nil
+		}
+
+		log.Warnf("Cannot download image %s over multicast, using HTTP: %v", image.UUID, err)
+	}
+
 	return api.DownloadDiskHTTP(image.UUID, version)
 }
@@ -5,23 +5,32 @@
 package main
 
 import (
+	"crypto/sha256"
+	"encoding/hex"
+	"hash"
 	"io"
+	"io/ioutil"
 	"os"
 	"syscall"
 
 	"github.com/baas-project/baas/pkg/model/images"
 
-	"github.com/codingsince1985/checksum"
-
 	"github.com/pkg/errors"
 	"github.com/sirupsen/logrus"
 
 	"github.com/baas-project/baas/pkg/fs"
 )
 
-// ReadDisk reads a disk from a file and returns a stream
-func ReadDisk(image *images.ImageModel) (io.ReadCloser, error) {
+// wipeSize is how much of a partition is overwritten with zeros when the image written to it is corrupt
+const wipeSize = 1024 * 1024
+
+// ReadDisk opens the partition of the image for reading, it is read as a stream and at the blocks which are sent
+func ReadDisk(image *images.ImageModel) (*os.File, error) {
 	partition := getPartition(image.UUID)
+	if partition == nil {
+		return nil, errors.Errorf("image %s is not on the disk", image.UUID)
+	}
+
 	file, err := os.OpenFile(partition.DeviceFile, syscall.O_RDWR, os.ModePerm)
 	if err != nil {
 		return nil, errors.Wrapf(err, "error opening path %s", partition.DeviceFile)
@@ -34,17 +43,11 @@ func ReadDisk(image *images.ImageModel) (io.ReadCloser, error) {
 func WriteDisk(reader io.Reader, image *images.ImageModel) error {
 	partition := getPartition(image.UUID)
 	logrus.Debug("Writing to disk")
-	if partition != nil {
-		printPartition(*partition)
-	}
-	chk, err := checksum.CRC32(partition.DeviceFile)
-	if err != nil {
-		logrus.Errorf("Cannot get checksum: %v", err)
+	if partition == nil {
+		return errors.Errorf("no partition was planned for image %s", image.UUID)
 	}
 
-	if image.Checksum != "" && image.Checksum == chk {
-		return nil
-	}
+	printPartition(*partition)
 
 	file, err := os.OpenFile(partition.DeviceFile, syscall.O_RDWR, os.ModePerm)
 	if err != nil {
@@ -59,3 +62,77 @@ func WriteDisk(reader io.Reader, image *images.ImageModel) error {
 
 	return errors.Wrap(fs.CopyStream(reader, file), "Error compressing")
 }
+
+// digestReader computes the SHA-256 and the size of everything that is read through it
+type digestReader struct {
+	reader io.Reader
+	hash   hash.Hash
+	size   int64
+}
+
+func newDigestReader(reader io.Reader) *digestReader {
+	return &digestReader{reader: reader, hash: sha256.New()}
+}
+
+func (d *digestReader) Read(p []byte) (int, error) {
+	n, err := d.reader.Read(p)
+	d.hash.Write(p[:n])
+	d.size += int64(n)
+	return n, err
+}
+
+// verify checks what was read against the digest and size of the version. Versions without a digest pass, with
+// a warning because nothing checked them.
+func (d *digestReader) verify(version images.Version) error {
+	if version.Digest == "" {
+		logrus.Warnf("Version %d of image %s has no digest, it is written without being verified", version.Version,
+			version.ImageModelUUID)
+		return nil
+	}
+
+	sum := hex.EncodeToString(d.hash.Sum(nil))
+	if d.size != version.Size || sum != version.Digest {
+		return errors.Errorf("digest mismatch: expected %s (%d bytes), got %s (%d bytes)",
+			version.Digest, version.Size, sum, d.size)
+	}
+
+	return nil
+}
+
+// holdsVersion checks whether the partition already contains the version, in which case it does not
+// have to be downloaded again. Only the first Size bytes count, the partition may be larger than the image.
+func holdsVersion(partition *Partition, version images.Version) bool {
+	if partition == nil || version.Digest == "" {
+		return false
+	}
+
+	file, err := os.Open(partition.DeviceFile)
+	if err != nil {
+		logrus.Warnf("Cannot open %s to compute its digest: %v", partition.DeviceFile, err)
+		return false
+	}
+
+	defer file.Close()
+
+	d := newDigestReader(io.LimitReader(file, version.Size))
+	if _, err = io.Copy(ioutil.Discard, d); err != nil {
+		logrus.Warnf("Cannot compute the digest of %s: %v", partition.DeviceFile, err)
+		return false
+	}
+
+	return d.verify(version) == nil
+}
+
+// invalidatePartition wipes the start of a partition which holds a corrupt image, so its file system can
+// neither be booted nor mistaken for a good copy of the image.
+func invalidatePartition(partition *Partition) error {
+	file, err := os.OpenFile(partition.DeviceFile, syscall.O_RDWR, os.ModePerm)
+	if err != nil {
+		return errors.Wrapf(err, "error opening path %s", partition.DeviceFile)
+	}
+
+	defer file.Close()
+
+	_, err = file.Write(make([]byte, wipeSize))
+	return errors.Wrapf(err, "error wiping %s", partition.DeviceFile)
+}
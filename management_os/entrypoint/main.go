@@ -10,6 +10,7 @@ import (
 	syslog "log/syslog"
 	"os"
 	"os/exec"
+	"strings"
 
 	"github.com/baas-project/baas/pkg/model/images"
 
@@ -78,7 +79,13 @@ func init() {
 		})
 	}
 
-	log.AddHook(httplog.NewLogHook(fmt.Sprintf("%s/log", baseurl), "MMOS"))
+	// The logs are only accepted by the control server if we send our machine credentials along
+	mac, err := getMacAddr()
+	if err != nil {
+		log.Warnf("Cannot get the MAC address: %v", err)
+	}
+
+	log.AddHook(httplog.NewLogHook(fmt.Sprintf("%s/log", baseurl), "MMOS", machineHeader(mac, getMachineToken())))
 	hook, err := sysruslog.NewSyslogHook("", "", syslog.LOG_DEBUG, "")
 	if err != nil {
 		log.Warn("Cannot open syslog")
@@ -123,7 +130,7 @@ func getLastSetup(machine *MachineImage) images.ImageSetup {
 
 func initializeMachine() *images.ImageSetup {
 	var machine MachineImage
-	machine.Initialise("/dev/sda1", "/mnt/machine")
+	machine.Initialise(partitionDevice(getDisk(), machineDataPartition), "/mnt/machine")
 	machine.Mount()
 	defer machine.Unmount()
 
@@ -138,7 +145,7 @@ func initializeMachine() *images.ImageSetup {
 
 func teardownMachine(imageSetup *images.ImageSetup) {
 	var machine MachineImage
-	machine.Initialise("/dev/sda1", "/mnt/machine")
+	machine.Initialise(partitionDevice(getDisk(), machineDataPartition), "/mnt/machine")
 	machine.Mount()
 	defer machine.Unmount()
 
@@ -177,43 +184,38 @@ func teardownMachine(imageSetup *images.ImageSetup) {
 
 func main() {
 	conf := getConfig()
-	c := NewAPIClient(baseurl)
 	mac, err := getMacAddr()
 
 	if err != nil {
 		log.Fatal(err)
 	}
 
-	lastSetup := initializeMachine()
-	if conf.UploadDisk && lastSetup.UUID != "" {
-		if err = ReadInDisks(c, lastSetup); err != nil {
-			log.Fatalf("Failed to read the disks: %v", err)
+	c := NewAPIClient(baseurl, mac, getMachineToken())
+
+	// An unknown machine only registers itself, it is provisioned once an admin approved it
+	if inDiscoveryMode() {
+		if err = discover(c, mac); err != nil {
+			log.Fatalf("Discovery failed: %v", err)
 		}
-	} else {
-		log.Info("Uploading disks disabled in configuration file.")
-	}
 
-	imageSetup, err := c.BootInform(mac)
-	if err != nil {
-		log.Fatal(err)
-	}
+		log.Info("Registered the machine, it waits for approval")
+		if err = exec.Command("systemctl", "poweroff").Run(); err != nil {
+			log.Fatal(err)
+		}
 
-	if err = WriteOutDisks(c, mac, imageSetup); err != nil {
-		log.Fatal(err)
+		return
 	}
-	log.Info("reprovisioning done")
 
-	teardownMachine(imageSetup)
+	// Every phase reports to the control server, so it knows whether the setup landed even if the machine stops
+	provisioning = newProvisioner(c, mac)
+	if err = provisioning.run(); err != nil {
+		log.Fatalf("Provisioning failed: %v", err)
+	}
 
-	// This presumes that the second option is the hard disk
-	if conf.SetNextBoot {
-		log.Info("Setting the BootNext parameter")
-		cmd := exec.Command("efibootmgr", "-n", "1")
-		log.Info(cmd.String())
-		err = cmd.Run()
-		if err != nil {
-			log.Fatal(err)
-		}
+	// Rebooting would lose the disks, the machine has to be booted from them in the management OS
+	if len(attachedNBD) > 0 {
+		log.Infof("Not rebooting, the disks are attached over NBD at %s", strings.Join(attachedNBD, ", "))
+		return
 	}
 
 	if conf.RebootAfterFinish {
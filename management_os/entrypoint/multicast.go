@@ -0,0 +1,97 @@
+// Copyright (c) 2020-2022 TU Delft & Valentijn van de Beek <v.d.vandebeek@student.tudelft.nl> All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/url"
+
+	"github.com/baas-project/baas/pkg/api"
+	"github.com/baas-project/baas/pkg/model/images"
+	"github.com/baas-project/baas/pkg/multicast"
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+)
+
+// multicastDownload reads an image file from a multicast session of the control server
+type multicastDownload struct {
+	conn     *net.UDPConn
+	receiver *multicast.Receiver
+	err      error
+}
+
+func (d *multicastDownload) Read(p []byte) (int, error) {
+	n, err := d.receiver.Read(p)
+	if err != nil {
+		d.err = err
+	}
+
+	return n, err
+}
+
+// Close reads what is left of the file first, the control server keeps sending until it knows the file arrived
+func (d *multicastDownload) Close() error {
+	if d.err == nil {
+		if _, err := io.Copy(ioutil.Discard, d); err != nil {
+			log.Warnf("Cannot read the end of the multicast session: %v", err)
+		}
+	}
+
+	return d.conn.Close()
+}
+
+// listenGroup opens a socket receiving the packets sent to the group, which is a multicast or broadcast address
+func listenGroup(group *net.UDPAddr) (*net.UDPConn, error) {
+	if group.IP.IsMulticast() {
+		return net.ListenMulticastUDP("udp4", nil, group)
+	}
+
+	return net.ListenUDP("udp4", &net.UDPAddr{Port: group.Port})
+}
+
+// DownloadDiskMulticast joins the multicast session of the control server which sends the version. The machines
+// which are provisioned with the same version at the same time receive it together, the file is checked against
+// its digest once everything has been read.
+func (a *APIClient) DownloadDiskMulticast(uuid images.ImageUUID, version uint64) (io.ReadCloser, error) {
+	var session api.MulticastSession
+	if err := a.doJSON("POST", fmt.Sprintf("%s/image/%s/%d/multicast", a.baseURL, uuid, version), nil,
+		&session); err != nil {
+		return nil, errors.Wrap(err, "join multicast session")
+	}
+
+	base, err := url.Parse(a.baseURL)
+	if err != nil {
+		return nil, errors.Wrap(err, "invalid control server url")
+	}
+
+	// The missing packets are asked for at the control server itself
+	sender, err := net.ResolveUDPAddr("udp4", net.JoinHostPort(base.Hostname(), fmt.Sprint(session.Port)))
+	if err != nil {
+		return nil, errors.Wrap(err, "resolve control server")
+	}
+
+	group, err := net.ResolveUDPAddr("udp4", session.Group)
+	if err != nil {
+		return nil, errors.Wrap(err, "invalid multicast group")
+	}
+
+	conn, err := listenGroup(group)
+	if err != nil {
+		return nil, errors.Wrapf(err, "listen on multicast group %s", group)
+	}
+
+	log.Infof("downloading disk %v over multicast session %d on %s", uuid, session.Session, group)
+
+	receiver, err := multicast.NewReceiver(conn, sender, session.Session, session.Size, session.Digest)
+	if err != nil {
+		_ = conn.Close()
+		return nil, err
+	}
+
+	return &multicastDownload{conn: conn, receiver: receiver}, nil
+}
@@ -0,0 +1,61 @@
+// Copyright (c) 2020-2022 TU Delft & Valentijn van de Beek <v.d.vandebeek@student.tudelft.nl> All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"fmt"
+	"net/url"
+	"os/exec"
+	"strconv"
+	"strings"
+
+	"github.com/baas-project/baas/pkg/api"
+	"github.com/baas-project/baas/pkg/model/images"
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+)
+
+// attachedNBD are the NBD devices attached during this boot
+var attachedNBD []string
+
+// attachNBD connects the next NBD device to the export of the image on the control server, the disk is then used
+// from there instead of being written to the disk of the machine
+func attachNBD(a *APIClient, image *images.ImageFrozen) error {
+	base, err := url.Parse(a.baseURL)
+	if err != nil {
+		return errors.Wrap(err, "parse control server address")
+	}
+
+	if len(attachedNBD) == 0 {
+		// The driver may be built into the kernel, in which case there is no module to load
+		if out, err := exec.Command("modprobe", "nbd").CombinedOutput(); err != nil {
+			log.Debugf("Cannot load the nbd module: %v (%s)", err, strings.TrimSpace(string(out)))
+		}
+	}
+
+	device := fmt.Sprintf("/dev/nbd%d", len(attachedNBD))
+	cmd := exec.Command("nbd-client", "-N", image.Export, base.Hostname(), strconv.Itoa(api.NBDPort), device)
+	log.Info(cmd.String())
+
+	if out, err := cmd.CombinedOutput(); err != nil {
+		return errors.Wrapf(err, "attach %s (%s)", device, strings.TrimSpace(string(out)))
+	}
+
+	attachedNBD = append(attachedNBD, device)
+	log.Infof("Version %d of image %s is attached at %s", image.Version.Version, image.Image.UUID, device)
+	return nil
+}
+
+// CommitNBDExport asks the control server to store the disk of the export, with what the machine wrote to it
+// during its previous boot, as a new version of its image
+func (a *APIClient) CommitNBDExport(mac string, export string) (*images.Version, error) {
+	var version images.Version
+	err := a.doJSON("POST", fmt.Sprintf("%s/machine/%s/nbd/%s/commit", a.baseURL, mac, export), nil, &version)
+	if err != nil {
+		return nil, err
+	}
+
+	return &version, nil
+}
@@ -9,112 +9,178 @@ import (
 	"fmt"
 	"os"
 	"time"
+	"unicode"
 
+	"github.com/baas-project/baas/pkg/blockmap"
 	"github.com/baas-project/baas/pkg/model/images"
 
 	"github.com/diskfs/go-diskfs"
-	"github.com/diskfs/go-diskfs/partition/part"
+	"github.com/diskfs/go-diskfs/partition/gpt"
+	"github.com/pkg/errors"
 	log "github.com/sirupsen/logrus"
 )
 
 const path = "partitions_cache.json"
 
+// defaultDisk is the disk the images are written to when the configuration does not name one
+const defaultDisk = "/dev/sda"
+
+// machineDataPartition is the number of the partition which holds the data of the machine, such as the partition
+// cache. It is never used for an image.
+const machineDataPartition = 1
+
 var partitionList []Partition
 
 // Partition defines a structure which keeps track of what images are currently on the disk
 type Partition struct {
-	Partition       part.Partition
 	Number          uint32
 	AssociatedImage images.ImageUUID
 	LastUsedTime    int64
 	DeviceFile      string
+
+	// Start and End are the first and last sector of the partition
+	Start uint64
+	End   uint64
+
+	// Blocks are the hashes of the blocks of the version which was written to the partition, an upload only
+	// sends the blocks which differ from them. They are nil when the contents of the partition are unknown.
+	Blocks *blockmap.Hashes
+}
+
+// getDisk returns the device file of the disk the images are written to
+func getDisk() string {
+	if disk := getConfig().Disk; disk != "" {
+		return disk
+	}
+
+	return defaultDisk
+}
+
+// partitionDevice returns the device file of a partition of the disk, disks whose name ends in a digit such as
+// /dev/nvme0n1 put a p before the number of the partition
+func partitionDevice(disk string, number uint32) string {
+	if disk != "" && unicode.IsDigit(rune(disk[len(disk)-1])) {
+		return fmt.Sprintf("%sp%d", disk, number)
+	}
+
+	return fmt.Sprintf("%s%d", disk, number)
 }
 
-// getPartitions populates the partitionList by either generating the cache or loading from disk
+// getPartitions populates the partitionList from the partition table of the disk. What the cache on the machine
+// partition knows about the partitions, such as the image they hold, is kept for those which did not change.
 func getPartitions(machine *MachineImage) {
+	var cached []Partition
+
 	v, err := machine.Exists(path)
 	if err != nil {
 		log.Warnf("Cannot find existence of cache path: %v", err)
 	}
 
-	if !v {
-		f, err := machine.Create(path)
-		if err != nil {
-			log.Warnf("Cannot create partition cache file: %v", err)
-		}
-		partitionList = generatePartitionList()
-		writePartitionJSON(f)
-
-		err = f.Close()
-		if err != nil {
-			log.Warnf("Cannot close the partition cache file: %v", err)
-		}
-	} else {
+	if v {
 		log.Warn("Load cache from file")
 		f, err := machine.Open(path)
 		if err != nil {
-			log.Warnf("Cannot create the partition cache file: %v", err)
-		}
-		err = json.NewDecoder(f).Decode(&partitionList)
-		if err != nil {
-			log.Warnf("Cannot read the partition cache: %v", err)
-		}
-		err = f.Close()
-		if err != nil {
-			log.Warn("Cannot close the partition cache file")
+			log.Warnf("Cannot open the partition cache file: %v", err)
+		} else {
+			err = json.NewDecoder(f).Decode(&cached)
+			if err != nil {
+				log.Warnf("Cannot read the partition cache: %v", err)
+			}
+			err = f.Close()
+			if err != nil {
+				log.Warn("Cannot close the partition cache file")
+			}
 		}
 	}
+
+	partitionList, err = generatePartitionList(cached)
+	if err != nil {
+		log.Errorf("Cannot read the partitions, using the cache: %v", err)
+		partitionList = cached
+	}
 }
 
-// generatePartitionList generates a new instance of the cache
-func generatePartitionList() []Partition {
-	disk, err := diskfs.OpenWithMode("/dev/sda", diskfs.ReadOnly)
+// generatePartitionList generates a new instance of the cache from the partition table
+func generatePartitionList(cached []Partition) ([]Partition, error) {
+	disk, err := diskfs.OpenWithMode(getDisk(), diskfs.ReadOnly)
 	if err != nil {
-		fmt.Printf("%v\n", err)
+		return nil, errors.Wrapf(err, "open %s", getDisk())
 	}
-	table, err := disk.GetPartitionTable()
 
+	defer disk.File.Close()
+
+	table, err := readTable(disk.GetPartitionTable())
 	if err != nil {
-		fmt.Printf("%v\n", err)
+		return nil, err
 	}
 
+	return matchPartitions(table, getDisk(), cached), nil
+}
+
+// readTable checks that the partition table which was read is a GPT, which is the only kind that is managed
+func readTable(table interface{}, err error) (*gpt.Table, error) {
+	if err != nil {
+		return nil, errors.Wrap(err, "read partition table")
+	}
+
+	gptTable, ok := table.(*gpt.Table)
+	if !ok {
+		return nil, errors.New("the disk does not have a GPT")
+	}
+
+	return gptTable, nil
+}
+
+// isReserved tells whether a partition of the table is left alone: the partition of the machine data, the EFI
+// system partition and the empty entries
+func isReserved(number uint32, p *gpt.Partition) bool {
+	return number == machineDataPartition || p.Type == gpt.EFISystemPartition || p.Type == gpt.Unused || p.Start == 0
+}
+
+// matchPartitions lists the partitions of the table images can be written to. What is known about a partition
+// is taken from the cache when the partition is still the same, partitions which were moved or resized are
+// considered empty.
+func matchPartitions(table *gpt.Table, disk string, cached []Partition) []Partition {
 	var partitions []Partition
-	for i, partition := range table.GetPartitions() {
-		if partition.GetSize() != 512 && partition.GetStart() != 0 {
-			partitions = append(partitions, Partition{
-				Partition:       partition,
-				Number:          uint32(i + 1),
-				AssociatedImage: "",
-				LastUsedTime:    time.Now().Unix(),
-				DeviceFile:      fmt.Sprintf("/dev/sda%d", uint32(i+1)),
-			})
+	for i, p := range table.Partitions {
+		number := uint32(i + 1)
+		if isReserved(number, p) {
+			continue
 		}
+
+		partition := Partition{
+			Number:       number,
+			LastUsedTime: 0,
+			DeviceFile:   partitionDevice(disk, number),
+			Start:        p.Start,
+			End:          p.End,
+		}
+
+		for _, c := range cached {
+			if c.Number == number && c.Start == p.Start && c.End == p.End {
+				partition.AssociatedImage = c.AssociatedImage
+				partition.LastUsedTime = c.LastUsedTime
+				partition.Blocks = c.Blocks
+			}
+		}
+
+		partitions = append(partitions, partition)
 	}
 
 	return partitions
 }
 
-// getPartition finds a partition which can be used to store the image. It will either try to find where it was stored prior or use the least recently used partition.
+// getPartition finds the partition which holds the image, it returns nil when there is none. The partitions of
+// a setup are created by planPartitions before its images are written.
 func getPartition(image images.ImageUUID) *Partition {
-	chosenPartition := &partitionList[0]
-
 	for i := range partitionList {
 		if partitionList[i].AssociatedImage == image {
-			log.Info("Found a cached version on disk")
 			partitionList[i].LastUsedTime = time.Now().Unix()
-			chosenPartition = &partitionList[i]
-			break
-		}
-
-		if chosenPartition.LastUsedTime > partitionList[i].LastUsedTime {
-			chosenPartition = &partitionList[i]
+			return &partitionList[i]
 		}
 	}
 
-	// Set the partition metadata
-	chosenPartition.LastUsedTime = time.Now().Unix()
-	chosenPartition.AssociatedImage = image
-	return chosenPartition
+	return nil
 }
 
 // writePartitionJSON writes the partition cache to a file on disk.
@@ -0,0 +1,380 @@
+// Copyright (c) 2020-2022 TU Delft & Valentijn van de Beek <v.d.vandebeek@student.tudelft.nl> All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"os/exec"
+	"sort"
+	"strings"
+
+	"github.com/baas-project/baas/pkg/model/images"
+
+	"github.com/diskfs/go-diskfs"
+	"github.com/diskfs/go-diskfs/partition/gpt"
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+)
+
+// partitionAlignment is the boundary in bytes the partitions which are created start on
+const partitionAlignment = 1024 * 1024
+
+// defaultPartitionSize is the size of the partition of a version whose size the control server does not know
+const defaultPartitionSize = images.SizeGigabyte
+
+// ErrSetupTooLarge is returned when the images of a setup do not fit on the disk together
+var ErrSetupTooLarge = errors.New("the images of the setup do not fit on the disk")
+
+// partitionPlan decides which partition each image of a setup is written to. It works on a copy of the
+// partition table, nothing is written to the disk until the whole setup fits.
+type partitionPlan struct {
+	disk       string
+	table      *gpt.Table
+	sectorSize uint64
+
+	// first and last are the first and last sector partitions may use
+	first uint64
+	last  uint64
+
+	partitions []Partition
+	// used are the numbers of the partitions which are assigned to an image of the setup
+	used map[uint32]bool
+	// released are the device files of the partitions whose contents are lost
+	released []string
+	changed  bool
+}
+
+// neededImage is an image of the setup with the number of sectors its partition needs
+type neededImage struct {
+	uuid    images.ImageUUID
+	sectors uint64
+}
+
+// planPartitions makes sure that every image of the setup which is written to the disk has a partition that is
+// large enough for its version. Partitions are grown, reused, created or removed as needed; the partitions of the
+// machine data and the EFI system partition are never touched. If the setup does not fit, the disk is left alone.
+func planPartitions(setup *images.ImageSetup) error {
+	disk, err := diskfs.OpenWithMode(getDisk(), diskfs.ReadWriteExclusive)
+	if err != nil {
+		return errors.Wrapf(err, "open %s", getDisk())
+	}
+
+	table, err := readTable(disk.GetPartitionTable())
+	if err != nil {
+		_ = disk.File.Close()
+		return err
+	}
+
+	sectorSize := uint64(table.LogicalSectorSize)
+	if sectorSize == 0 {
+		sectorSize = uint64(disk.LogicalBlocksize)
+	}
+
+	// The backup GPT takes up the end of the disk, one aligned block is left for it
+	align := partitionAlignment / sectorSize
+	plan := &partitionPlan{
+		disk:       getDisk(),
+		table:      table,
+		sectorSize: sectorSize,
+		first:      align,
+		last:       uint64(disk.Size)/sectorSize/align*align - align - 1,
+		partitions: matchPartitions(table, getDisk(), partitionList),
+		used:       map[uint32]bool{},
+	}
+
+	if err = plan.fit(neededImages(setup, sectorSize)); err != nil {
+		_ = disk.File.Close()
+		return err
+	}
+
+	if plan.changed {
+		log.Info("Writing the new partition table")
+		err = disk.Partition(plan.table)
+	}
+
+	if err2 := disk.File.Close(); err2 != nil {
+		log.Warnf("Cannot close %s: %v", plan.disk, err2)
+	}
+
+	if err != nil {
+		return errors.Wrap(err, "write partition table")
+	}
+
+	for _, device := range plan.released {
+		peers.withdraw(device)
+	}
+
+	partitionList = plan.partitions
+	printPartitions()
+
+	if plan.changed {
+		// The kernel only creates the device files of the new partitions once it rereads the table
+		if out, err := exec.Command("partprobe", plan.disk).CombinedOutput(); err != nil {
+			return errors.Wrapf(err, "reread partition table (%s)", strings.TrimSpace(string(out)))
+		}
+	}
+
+	return nil
+}
+
+// neededImages lists the images of the setup which are written to the disk, largest first
+func neededImages(setup *images.ImageSetup, sectorSize uint64) []neededImage {
+	var needed []neededImage
+	seen := map[images.ImageUUID]bool{}
+
+	for _, image := range setup.Images {
+		// Images served over NBD are not written to the disk of the machine
+		if image.Export != "" || seen[image.Image.UUID] {
+			continue
+		}
+
+		seen[image.Image.UUID] = true
+		size := uint64(image.Version.Size)
+		if size == 0 {
+			log.Warnf("The size of version %d of image %s is unknown, assuming %d bytes", image.Version.Version,
+				image.Image.UUID, defaultPartitionSize)
+			size = defaultPartitionSize
+		}
+
+		needed = append(needed, neededImage{uuid: image.Image.UUID, sectors: (size + sectorSize - 1) / sectorSize})
+	}
+
+	sort.SliceStable(needed, func(i, j int) bool {
+		return needed[i].sectors > needed[j].sectors
+	})
+
+	return needed
+}
+
+// fit assigns a partition to each image, it fails without side effects when one of them does not fit
+func (p *partitionPlan) fit(needed []neededImage) error {
+	var unplaced []neededImage
+
+	// The partitions which already hold an image are kept when they are large enough or can grow
+	for _, image := range needed {
+		i := p.find(image.uuid)
+		if i < 0 {
+			unplaced = append(unplaced, image)
+			continue
+		}
+
+		if p.partitions[i].sectors() < image.sectors && !p.grow(i, image.sectors) {
+			log.Infof("Partition %d is too small for image %s", p.partitions[i].Number, image.uuid)
+			p.release(i)
+			unplaced = append(unplaced, image)
+			continue
+		}
+
+		p.used[p.partitions[i].Number] = true
+	}
+
+	for _, image := range unplaced {
+		if !p.place(image) {
+			return errors.Wrapf(ErrSetupTooLarge, "no room for image %s (%d bytes)", image.uuid,
+				image.sectors*p.sectorSize)
+		}
+	}
+
+	return nil
+}
+
+// place gives the image a partition: the smallest spare partition it fits on, a new partition in free space or,
+// when neither is available, a new partition in the space of the least recently used spare partitions
+func (p *partitionPlan) place(image neededImage) bool {
+	best := -1
+	for i := range p.partitions {
+		partition := &p.partitions[i]
+		if p.used[partition.Number] || partition.sectors() < image.sectors {
+			continue
+		}
+
+		if best < 0 || partition.sectors() < p.partitions[best].sectors() {
+			best = i
+		}
+	}
+
+	if best >= 0 {
+		p.assign(best, image.uuid)
+		return true
+	}
+
+	for {
+		if p.create(image) {
+			return true
+		}
+
+		if !p.evict() {
+			return false
+		}
+	}
+}
+
+// find returns the index of the partition which holds the image, -1 if there is none
+func (p *partitionPlan) find(image images.ImageUUID) int {
+	for i := range p.partitions {
+		if p.partitions[i].AssociatedImage == image {
+			return i
+		}
+	}
+
+	return -1
+}
+
+// assign associates the partition with the image, whatever it held before is lost
+func (p *partitionPlan) assign(i int, image images.ImageUUID) {
+	p.release(i)
+
+	partition := &p.partitions[i]
+	partition.AssociatedImage = image
+	p.used[partition.Number] = true
+
+	entry := p.table.Partitions[partition.Number-1]
+	if entry.Name != string(image) {
+		entry.Name = string(image)
+		p.changed = true
+	}
+}
+
+// release forgets what the partition holds
+func (p *partitionPlan) release(i int) {
+	partition := &p.partitions[i]
+	if partition.AssociatedImage != "" || partition.Blocks != nil {
+		p.released = append(p.released, partition.DeviceFile)
+	}
+
+	partition.AssociatedImage = ""
+	partition.Blocks = nil
+	partition.LastUsedTime = 0
+}
+
+// grow extends the partition into the free space behind it, if there is enough of it
+func (p *partitionPlan) grow(i int, sectors uint64) bool {
+	partition := &p.partitions[i]
+	end := partition.Start + p.alignUp(sectors) - 1
+	if end > p.last || !p.isFree(partition.End+1, end, partition.Number) {
+		return false
+	}
+
+	log.Infof("Growing partition %d to %d bytes", partition.Number, (end-partition.Start+1)*p.sectorSize)
+	partition.End = end
+	p.setBounds(p.table.Partitions[partition.Number-1], partition.Start, end)
+	return true
+}
+
+// create adds a partition for the image in the first free space which is large enough
+func (p *partitionPlan) create(image neededImage) bool {
+	sectors := p.alignUp(image.sectors)
+
+	for start := p.first; start+sectors-1 <= p.last; {
+		end := start + sectors - 1
+		blocking := p.overlapping(start, end, 0)
+		if blocking == nil {
+			return p.add(image.uuid, start, end)
+		}
+
+		start = p.alignUp(blocking.End + 1)
+	}
+
+	return false
+}
+
+// add puts a new partition in the table, in the first empty entry
+func (p *partitionPlan) add(image images.ImageUUID, start uint64, end uint64) bool {
+	index := -1
+	for i, entry := range p.table.Partitions {
+		if i+1 != machineDataPartition && (entry.Type == gpt.Unused || entry.Start == 0) {
+			index = i
+			break
+		}
+	}
+
+	if index < 0 {
+		index = len(p.table.Partitions)
+		p.table.Partitions = append(p.table.Partitions, &gpt.Partition{})
+	}
+
+	entry := p.table.Partitions[index]
+	entry.Type = gpt.LinuxFilesystem
+	entry.Name = string(image)
+	p.setBounds(entry, start, end)
+
+	number := uint32(index + 1)
+	log.Infof("Creating partition %d of %d bytes for image %s", number, (end-start+1)*p.sectorSize, image)
+
+	p.partitions = append(p.partitions, Partition{
+		Number:          number,
+		AssociatedImage: image,
+		DeviceFile:      partitionDevice(p.disk, number),
+		Start:           start,
+		End:             end,
+	})
+	p.used[number] = true
+	return true
+}
+
+// evict removes the least recently used partition which the setup does not need, to make room for a new one
+func (p *partitionPlan) evict() bool {
+	victim := -1
+	for i := range p.partitions {
+		if p.used[p.partitions[i].Number] {
+			continue
+		}
+
+		if victim < 0 || p.partitions[i].LastUsedTime < p.partitions[victim].LastUsedTime {
+			victim = i
+		}
+	}
+
+	if victim < 0 {
+		return false
+	}
+
+	partition := p.partitions[victim]
+	log.Infof("Removing partition %d which held image %s", partition.Number, partition.AssociatedImage)
+
+	p.release(victim)
+	p.table.Partitions[partition.Number-1] = &gpt.Partition{Type: gpt.Unused}
+	p.partitions = append(p.partitions[:victim], p.partitions[victim+1:]...)
+	p.changed = true
+	return true
+}
+
+// isFree tells whether no partition other than the one given uses any of the sectors from start to end
+func (p *partitionPlan) isFree(start uint64, end uint64, except uint32) bool {
+	return start > end || p.overlapping(start, end, except) == nil
+}
+
+// overlapping returns a partition of the table which uses one of the sectors from start to end
+func (p *partitionPlan) overlapping(start uint64, end uint64, except uint32) *gpt.Partition {
+	for i, entry := range p.table.Partitions {
+		if uint32(i+1) == except || entry.Type == gpt.Unused || entry.Start == 0 {
+			continue
+		}
+
+		if entry.Start <= end && entry.End >= start {
+			return entry
+		}
+	}
+
+	return nil
+}
+
+// setBounds moves the entry of the table to the sectors from start to end
+func (p *partitionPlan) setBounds(entry *gpt.Partition, start uint64, end uint64) {
+	entry.Start = start
+	entry.End = end
+	entry.Size = (end - start + 1) * p.sectorSize
+	p.changed = true
+}
+
+// alignUp rounds a sector or a number of sectors up to the alignment
+func (p *partitionPlan) alignUp(sector uint64) uint64 {
+	align := partitionAlignment / p.sectorSize
+	return (sector + align - 1) / align * align
+}
+
+// sectors is the number of sectors of the partition
+func (partition *Partition) sectors() uint64 {
+	return partition.End - partition.Start + 1
+}
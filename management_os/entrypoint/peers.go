@@ -0,0 +1,466 @@
+// Copyright (c) 2020-2022 TU Delft & Valentijn van de Beek <v.d.vandebeek@student.tudelft.nl> All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"crypto/subtle"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/baas-project/baas/pkg/api"
+	"github.com/baas-project/baas/pkg/blockmap"
+	"github.com/baas-project/baas/pkg/model/images"
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// announceInterval is how often the peer server tells the control server it is still there
+	announceInterval = 2 * time.Minute
+	// peerTimeout is how long a block may take to arrive from a peer
+	peerTimeout = 30 * time.Second
+	// maxPeerFailures is how often a peer may fail to send a good block before it is no longer asked
+	maxPeerFailures = 3
+)
+
+// peers serves the versions on the disk of this machine to other machines, it is nil when that is disabled
+var peers *peerServer
+
+// servedVersion is a version on a partition, the blocks are checked against the hashes before they are sent
+// because the partition may have been changed since the version was written to it. The token is handed out by
+// the control server when the version is announced, nothing is sent before that.
+type servedVersion struct {
+	device string
+	hashes *blockmap.Hashes
+	token  string
+}
+
+// peerServer serves the blocks of the versions on the partitions over HTTP at /blocks/<image>/<version>/<block>,
+// to whoever presents the token of the version
+type peerServer struct {
+	api      *APIClient
+	mac      string
+	listener net.Listener
+	done     chan struct{}
+
+	mutex    sync.Mutex
+	versions map[api.PeerVersion]servedVersion
+}
+
+// startPeerServer serves the versions on the partitions and announces them to the control server
+func startPeerServer(client *APIClient, mac string) (*peerServer, error) {
+	listener, err := net.Listen("tcp", fmt.Sprintf(":%d", api.PeerPort))
+	if err != nil {
+		return nil, errors.Wrap(err, "listen for peers")
+	}
+
+	s := &peerServer{
+		api:      client,
+		mac:      mac,
+		listener: listener,
+		done:     make(chan struct{}),
+		versions: make(map[api.PeerVersion]servedVersion),
+	}
+
+	for i := range partitionList {
+		s.offer(&partitionList[i])
+	}
+
+	go func() {
+		if err := http.Serve(listener, s); err != nil {
+			log.Debugf("Stopped serving peers: %v", err)
+		}
+	}()
+
+	go func() {
+		ticker := time.NewTicker(announceInterval)
+		defer ticker.Stop()
+
+		for {
+			s.announce()
+
+			select {
+			case <-ticker.C:
+			case <-s.done:
+				return
+			}
+		}
+	}()
+
+	return s, nil
+}
+
+// offer serves the version on the partition, if it is known which version that is
+func (s *peerServer) offer(partition *Partition) {
+	if s == nil || partition.Blocks == nil || partition.AssociatedImage == "" {
+		return
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	// The token of the version stays the same, it does not have to wait for the next announcement
+	key := api.PeerVersion{Image: partition.AssociatedImage, Version: partition.Blocks.Version}
+	s.versions[key] = servedVersion{device: partition.DeviceFile, hashes: partition.Blocks, token: s.versions[key].token}
+}
+
+// withdraw stops serving the partition, it is about to be overwritten
+func (s *peerServer) withdraw(device string) {
+	if s == nil {
+		return
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	for key, served := range s.versions {
+		if served.device == device {
+			delete(s.versions, key)
+		}
+	}
+}
+
+// announce tells the control server which versions are served
+func (s *peerServer) announce() {
+	if s == nil {
+		return
+	}
+
+	s.mutex.Lock()
+	announcement := api.PeerAnnouncement{Address: fmt.Sprintf(":%d", api.PeerPort)}
+	for key := range s.versions {
+		announcement.Versions = append(announcement.Versions, key)
+	}
+	s.mutex.Unlock()
+
+	tokens, err := s.api.AnnouncePeer(s.mac, announcement)
+	if err != nil {
+		log.Warnf("Cannot announce the versions served to peers: %v", err)
+		return
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	for _, token := range tokens {
+		if served, ok := s.versions[token.PeerVersion]; ok {
+			served.token = token.Token
+			s.versions[token.PeerVersion] = served
+		}
+	}
+}
+
+// stop stops serving and tells the control server
+func (s *peerServer) stop() {
+	if s == nil {
+		return
+	}
+
+	close(s.done)
+	_ = s.listener.Close()
+
+	if err := s.api.LeavePeer(s.mac); err != nil {
+		log.Warnf("Cannot tell the control server the peer server stopped: %v", err)
+	}
+}
+
+// ServeHTTP sends a block of a version which is served, if the partition still holds it
+func (s *peerServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	parts := strings.Split(strings.TrimPrefix(r.URL.Path, "/"), "/")
+	if r.Method != http.MethodGet || len(parts) != 4 || parts[0] != "blocks" {
+		http.NotFound(w, r)
+		return
+	}
+
+	version, err := strconv.ParseUint(parts[2], 10, 64)
+	if err != nil {
+		http.Error(w, "Invalid version given", http.StatusBadRequest)
+		return
+	}
+
+	n, err := strconv.ParseUint(parts[3], 10, 64)
+	if err != nil {
+		http.Error(w, "Invalid block given", http.StatusBadRequest)
+		return
+	}
+
+	s.mutex.Lock()
+	served, ok := s.versions[api.PeerVersion{Image: images.ImageUUID(parts[1]), Version: version}]
+	s.mutex.Unlock()
+
+	if !ok || n >= uint64(len(served.hashes.Blocks)) {
+		http.NotFound(w, r)
+		return
+	}
+
+	token := r.Header.Get(api.PeerTokenHeader)
+	if served.token == "" || subtle.ConstantTimeCompare([]byte(token), []byte(served.token)) != 1 {
+		http.Error(w, "Invalid peer token given", http.StatusForbidden)
+		return
+	}
+
+	block, err := readBlock(served.device, served.hashes, n)
+	if err != nil {
+		log.Warnf("Cannot read block %d of %s for a peer: %v", n, served.device, err)
+		http.Error(w, "Cannot read the block", http.StatusInternalServerError)
+		return
+	}
+
+	if !served.hashes.Check(n, block) {
+		http.Error(w, "The block changed since the version was written", http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Content-Length", strconv.Itoa(len(block)))
+	_, _ = w.Write(block)
+}
+
+// readBlock reads block n of the disk on the partition
+func readBlock(device string, hashes *blockmap.Hashes, n uint64) ([]byte, error) {
+	file, err := os.Open(device)
+	if err != nil {
+		return nil, err
+	}
+
+	defer file.Close()
+
+	offset, size := hashes.Block(n)
+	block := make([]byte, size)
+	if _, err = file.ReadAt(block, offset); err != nil {
+		return nil, err
+	}
+
+	return block, nil
+}
+
+// AnnouncePeer tells the control server which versions this machine serves to other machines and gets the tokens
+// the machines asking for their blocks present
+func (a *APIClient) AnnouncePeer(mac string, announcement api.PeerAnnouncement) ([]api.PeerToken, error) {
+	var tokens []api.PeerToken
+	err := a.doJSON("POST", fmt.Sprintf("%s/machine/%s/peer", a.baseURL, mac), announcement, &tokens)
+	if err != nil {
+		return nil, err
+	}
+
+	return tokens, nil
+}
+
+// LeavePeer tells the control server that this machine no longer serves anything
+func (a *APIClient) LeavePeer(mac string) error {
+	return a.doJSON("DELETE", fmt.Sprintf("%s/machine/%s/peer", a.baseURL, mac), nil, nil)
+}
+
+// GetPeerSources gets the peers serving the version and the hashes their blocks are checked against
+func (a *APIClient) GetPeerSources(uuid images.ImageUUID, version uint64) (*api.PeerSources, error) {
+	var sources api.PeerSources
+	err := a.doJSON("GET", fmt.Sprintf("%s/image/%s/%d/peers", a.baseURL, uuid, version), nil, &sources)
+	if err != nil {
+		return nil, err
+	}
+
+	return &sources, nil
+}
+
+// requestRawDisk requests the expanded disk of the version from the given offset on
+func (a *APIClient) requestRawDisk(uuid images.ImageUUID, version uint64, offset int64) (io.ReadCloser, error) {
+	url := fmt.Sprintf("%s/image/%s/%d/raw", a.baseURL, uuid, version)
+	req, err := a.newRequest("GET", url, nil)
+	if err != nil {
+		return nil, errors.Wrap(err, "cannot create request")
+	}
+
+	req.Header.Set("Range", fmt.Sprintf("bytes=%d-", offset))
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, errors.Wrap(err, "request disk")
+	}
+
+	if resp.StatusCode != http.StatusPartialContent {
+		msg, _ := ioutil.ReadAll(resp.Body)
+		_ = resp.Body.Close()
+		return nil, errors.Errorf("GET %s failed (%s)", url, strings.TrimSpace(string(msg)))
+	}
+
+	return resp.Body, nil
+}
+
+// peerDownload reads the disk of a version block by block from the peers which hold it. Every block is checked
+// against the hashes of the control server, a block no peer has is read from the control server instead.
+type peerDownload struct {
+	api     *APIClient
+	image   images.ImageUUID
+	version uint64
+	hashes  *blockmap.Hashes
+	token   string
+	client  *http.Client
+
+	peers    []string
+	failures map[string]int
+	turn     int
+
+	next    uint64
+	pending []byte
+
+	// server is the disk from the control server, it is at serverOffset
+	server       io.ReadCloser
+	serverOffset int64
+}
+
+// DownloadDiskPeers reads the disk of the version from the peers which hold it. It returns nil when there are
+// none, the expanded disk is read instead of the image file.
+func (a *APIClient) DownloadDiskPeers(uuid images.ImageUUID, version uint64) (io.ReadCloser, error) {
+	sources, err := a.GetPeerSources(uuid, version)
+	if err != nil {
+		return nil, errors.Wrap(err, "get peers")
+	}
+
+	if len(sources.Peers) == 0 || sources.Blocks == nil {
+		return nil, nil
+	}
+
+	log.Infof("downloading disk %v from %d peers", uuid, len(sources.Peers))
+
+	return &peerDownload{
+		api:      a,
+		image:    uuid,
+		version:  version,
+		hashes:   sources.Blocks,
+		token:    sources.Token,
+		client:   &http.Client{Timeout: peerTimeout},
+		peers:    sources.Peers,
+		failures: make(map[string]int),
+	}, nil
+}
+
+func (d *peerDownload) Read(p []byte) (int, error) {
+	if len(d.pending) == 0 {
+		if d.next == uint64(len(d.hashes.Blocks)) {
+			return 0, io.EOF
+		}
+
+		block, err := d.fetch(d.next)
+		if err != nil {
+			return 0, err
+		}
+
+		d.pending = block
+		d.next++
+	}
+
+	n := copy(p, d.pending)
+	d.pending = d.pending[n:]
+	return n, nil
+}
+
+// fetch gets a block from the peers in turn, or from the control server when none of them has it
+func (d *peerDownload) fetch(n uint64) ([]byte, error) {
+	for i := 0; i < len(d.peers); i++ {
+		peer := d.peers[(d.turn+i)%len(d.peers)]
+		if d.failures[peer] >= maxPeerFailures {
+			continue
+		}
+
+		block, err := d.fetchPeer(peer, n)
+		if err != nil {
+			log.Debugf("Cannot get block %d of image %s from peer %s: %v", n, d.image, peer, err)
+			d.failures[peer]++
+			continue
+		}
+
+		d.turn++
+		d.closeServer()
+		return block, nil
+	}
+
+	return d.fetchServer(n)
+}
+
+// fetchPeer gets a block from the peer and checks it
+func (d *peerDownload) fetchPeer(peer string, n uint64) ([]byte, error) {
+	_, size := d.hashes.Block(n)
+
+	url := fmt.Sprintf("http://%s/blocks/%s/%d/%d", peer, d.image, d.version, n)
+	req, err := http.NewRequest(http.MethodGet, url, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	req.Header.Set(api.PeerTokenHeader, d.token)
+
+	resp, err := d.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, errors.Errorf("peer responded with %s", resp.Status)
+	}
+
+	block, err := ioutil.ReadAll(io.LimitReader(resp.Body, int64(size)+1))
+	if err != nil {
+		return nil, err
+	}
+
+	if !d.hashes.Check(n, block) {
+		return nil, errors.New("the block does not match its hash")
+	}
+
+	return block, nil
+}
+
+// fetchServer reads a block from the disk sent by the control server, which is requested from the block on
+func (d *peerDownload) fetchServer(n uint64) ([]byte, error) {
+	offset, size := d.hashes.Block(n)
+
+	if d.server == nil || d.serverOffset != offset {
+		d.closeServer()
+
+		server, err := d.api.requestRawDisk(d.image, d.version, offset)
+		if err != nil {
+			return nil, errors.Wrapf(err, "get block %d from the control server", n)
+		}
+
+		d.server = server
+		d.serverOffset = offset
+	}
+
+	block := make([]byte, size)
+	if _, err := io.ReadFull(d.server, block); err != nil {
+		d.closeServer()
+		return nil, errors.Wrapf(err, "get block %d from the control server", n)
+	}
+
+	d.serverOffset += int64(size)
+
+	if !d.hashes.Check(n, block) {
+		return nil, errors.Errorf("block %d from the control server does not match its hash", n)
+	}
+
+	return block, nil
+}
+
+// closeServer stops reading the disk from the control server, it is behind once a peer sent a block
+func (d *peerDownload) closeServer() {
+	if d.server != nil {
+		_ = d.server.Close()
+		d.server = nil
+	}
+}
+
+func (d *peerDownload) Close() error {
+	d.closeServer()
+	return nil
+}
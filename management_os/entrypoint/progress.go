@@ -0,0 +1,95 @@
+// Copyright (c) 2020-2022 TU Delft & Valentijn van de Beek <v.d.vandebeek@student.tudelft.nl> All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/baas-project/baas/pkg/api"
+	"github.com/baas-project/baas/pkg/model/images"
+	"github.com/baas-project/baas/pkg/util"
+	log "github.com/sirupsen/logrus"
+)
+
+// newProgress creates the reporter of a stage of the image, which reads from r. The progress is sent to the control
+// server in the background, so a slow control server does not hold up the transfer; when it falls behind only the
+// latest progress is sent. The total is 0 when it is not known.
+func newProgress(a *APIClient, r io.Reader, image *images.ImageModel, version uint64, stage api.TransferStage,
+	total int64) *util.ProgressReporter {
+	updates := make(chan api.TransferProgress, 1)
+	go func() {
+		for progress := range updates {
+			if err := a.ReportProgress(a.mac, progress); err != nil {
+				log.Debugf("Cannot report the progress to the control server: %v", err)
+			}
+		}
+	}()
+
+	if total < 0 {
+		total = 0
+	}
+
+	return &util.ProgressReporter{
+		R:     r,
+		Total: total,
+		Report: func(p util.Progress) {
+			log.Debugf("%s of image %s: %d of %d bytes (%.0f B/s, %s left)", stage, image.UUID, p.Done, p.Total,
+				p.Throughput, p.ETA.Round(time.Second))
+
+			progress := api.TransferProgress{
+				Image:      image.UUID,
+				Version:    version,
+				Stage:      stage,
+				Done:       p.Done,
+				Total:      p.Total,
+				Throughput: p.Throughput,
+				ETA:        p.ETA.Seconds(),
+				Finished:   p.Finished,
+			}
+
+			// The reports come from one goroutine, so after taking out the unsent one there is room for this one
+			select {
+			case <-updates:
+			default:
+			}
+			updates <- progress
+
+			if p.Finished {
+				close(updates)
+			}
+		},
+	}
+}
+
+// downloadSize returns the size of the file which is downloaded, 0 if it is not known
+func downloadSize(r io.Reader) int64 {
+	if sized, ok := r.(interface{ Size() int64 }); ok {
+		return sized.Size()
+	}
+
+	return 0
+}
+
+// progressReaderAt counts the bytes which are read from a disk at any offset
+type progressReaderAt struct {
+	r        io.ReaderAt
+	progress *util.ProgressReporter
+}
+
+// ReadAt reads from the disk and adds what was read to the progress
+func (p progressReaderAt) ReadAt(b []byte, off int64) (int, error) {
+	n, err := p.r.ReadAt(b, off)
+	p.progress.Add(int64(n))
+	return n, err
+}
+
+// ReportProgress sends the progress of a transfer to the control server, which passes it on to whoever follows
+// the machine
+func (a *APIClient) ReportProgress(mac string, progress api.TransferProgress) error {
+	url := fmt.Sprintf("%s/machine/%s/progress", a.baseURL, mac)
+	return a.doJSON("POST", url, progress, nil)
+}
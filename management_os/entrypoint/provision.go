@@ -0,0 +1,212 @@
+// Copyright (c) 2020-2022 TU Delft & Valentijn van de Beek <v.d.vandebeek@student.tudelft.nl> All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"os/exec"
+	"strings"
+	"time"
+
+	"github.com/baas-project/baas/pkg/model/images"
+	"github.com/baas-project/baas/pkg/model/machine"
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+)
+
+// retryPolicy decides how often a phase is tried before the provisioning fails
+type retryPolicy struct {
+	attempts int
+	// delay is the time waited before the second attempt, it doubles with every attempt after that
+	delay time.Duration
+}
+
+// phase is a step of the provisioning
+type phase struct {
+	name  machine.ProvisioningPhase
+	retry retryPolicy
+	run   func(p *provisioner) error
+	// skip tells whether there is nothing to do in the phase, it is then not reported either
+	skip func(p *provisioner) bool
+}
+
+// phases are the steps of the provisioning in the order in which they are run. Uploads are not retried as a whole,
+// an image which was already uploaded would become a version twice; the transfers themselves are resumed instead.
+// Requesting the boot setup can be repeated, the control server keeps it queued until its response is built.
+var phases = []phase{
+	{name: machine.PhaseInitializing, retry: retryPolicy{attempts: 1}, run: (*provisioner).initialize},
+	{
+		name:  machine.PhaseUploading,
+		retry: retryPolicy{attempts: 1},
+		run:   (*provisioner).upload,
+		skip: func(p *provisioner) bool {
+			return !getConfig().UploadDisk || p.lastSetup.UUID == ""
+		},
+	},
+	{name: machine.PhaseRequesting, retry: retryPolicy{attempts: 5, delay: 5 * time.Second}, run: (*provisioner).request},
+	{name: machine.PhaseWriting, retry: retryPolicy{attempts: 2, delay: 10 * time.Second}, run: (*provisioner).write},
+	{name: machine.PhaseFinishing, retry: retryPolicy{attempts: 2, delay: time.Second}, run: (*provisioner).finish},
+}
+
+// provisioning is the provisioner of this boot, it is nil until it starts
+var provisioning *provisioner
+
+// provisioner walks through the phases which put the boot setup of the machine on its disk. Every transition is
+// reported to the control server, as is every image a phase starts on.
+type provisioner struct {
+	api *APIClient
+	mac string
+
+	lastSetup *images.ImageSetup
+	setup     *images.ImageSetup
+
+	phase   machine.ProvisioningPhase
+	attempt int
+}
+
+// newProvisioner creates the provisioner of the machine
+func newProvisioner(api *APIClient, mac string) *provisioner {
+	return &provisioner{api: api, mac: mac, lastSetup: &images.ImageSetup{}}
+}
+
+// run goes through the phases, it stops at the first phase which fails for good
+func (p *provisioner) run() error {
+	for _, step := range phases {
+		if step.skip != nil && step.skip(p) {
+			log.Infof("Skipping the %s phase", step.name)
+			continue
+		}
+
+		if err := p.runPhase(step); err != nil {
+			err = errors.Wrapf(err, "%s failed", step.name)
+			p.report(machine.StatusModel{Phase: machine.PhaseFailed, Error: err.Error()})
+			return err
+		}
+	}
+
+	p.phase = machine.PhaseDone
+	p.attempt = 0
+	p.report(machine.StatusModel{Phase: machine.PhaseDone})
+	return nil
+}
+
+// runPhase runs the phase until it succeeds or its retry policy gives up
+func (p *provisioner) runPhase(step phase) error {
+	delay := step.retry.delay
+	p.phase = step.name
+
+	for p.attempt = 1; ; p.attempt++ {
+		log.Infof("Starting the %s phase (attempt %d of %d)", step.name, p.attempt, step.retry.attempts)
+		p.report(machine.StatusModel{Phase: step.name})
+
+		err := step.run(p)
+		if err == nil {
+			return nil
+		}
+
+		// A setup which does not fit on the disk will not fit the next time either
+		if p.attempt >= step.retry.attempts || errors.Cause(err) == ErrSetupTooLarge {
+			return err
+		}
+
+		log.Warnf("The %s phase failed, trying again in %s: %v", step.name, delay, err)
+		time.Sleep(delay)
+		delay *= 2
+	}
+}
+
+// progress reports that the current phase starts on the image, after it completed the ones before it
+func (p *provisioner) progress(image *images.ImageFrozen, completed int, total int) {
+	if p == nil {
+		return
+	}
+
+	p.report(machine.StatusModel{
+		Phase:     p.phase,
+		Image:     string(image.Image.UUID),
+		Version:   image.Version.Version,
+		Completed: completed,
+		Total:     total,
+	})
+}
+
+// report sends the status to the control server. The provisioning does not depend on it, a status which cannot
+// be sent is only logged.
+func (p *provisioner) report(status machine.StatusModel) {
+	if p.setup != nil {
+		status.SetupUUID = string(p.setup.UUID)
+	}
+
+	if status.Phase != machine.PhaseDone && status.Phase != machine.PhaseFailed {
+		status.Attempt = p.attempt
+	}
+
+	if err := p.api.ReportStatus(p.mac, status); err != nil {
+		log.Warnf("Cannot report the %s status to the control server: %v", status.Phase, err)
+	}
+}
+
+// initialize reads the partitions and the setup of the previous boot from the disk
+func (p *provisioner) initialize() error {
+	p.lastSetup = initializeMachine()
+	return nil
+}
+
+// upload sends the images of the previous setup which are marked for update to the control server
+func (p *provisioner) upload() error {
+	return ReadInDisks(p.api, p.lastSetup)
+}
+
+// request asks the control server for the setup to boot, the peer server is started first so the other machines
+// can get the versions on the disk while this one waits for its own
+func (p *provisioner) request() error {
+	if getConfig().Peers && peers == nil {
+		var err error
+		if peers, err = startPeerServer(p.api, p.mac); err != nil {
+			log.Errorf("Cannot serve the disk to peers: %v", err)
+		}
+	}
+
+	setup, err := p.api.BootInform(p.mac)
+	if err != nil {
+		return err
+	}
+
+	p.setup = setup
+	return nil
+}
+
+// write puts the images of the setup on the disk, the images which are there already are skipped
+func (p *provisioner) write() error {
+	if err := WriteOutDisks(p.api, p.mac, p.setup); err != nil {
+		return err
+	}
+
+	log.Info("reprovisioning done")
+	return nil
+}
+
+// finish stores the setup and the partitions for the next boot and, if configured, makes the firmware boot the
+// disk next
+func (p *provisioner) finish() error {
+	peers.stop()
+	peers = nil
+
+	teardownMachine(p.setup)
+
+	// The disks attached over NBD are used from the management OS, the firmware does not boot them
+	if len(attachedNBD) > 0 || !getConfig().SetNextBoot {
+		return nil
+	}
+
+	// This presumes that the second option is the hard disk
+	log.Info("Setting the BootNext parameter")
+	cmd := exec.Command("efibootmgr", "-n", "1")
+	log.Info(cmd.String())
+	if out, err := cmd.CombinedOutput(); err != nil {
+		return errors.Wrapf(err, "set BootNext (%s)", strings.TrimSpace(string(out)))
+	}
+
+	return nil
+}
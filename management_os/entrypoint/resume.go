@@ -0,0 +1,279 @@
+// Copyright (c) 2020-2022 TU Delft & Valentijn van de Beek <v.d.vandebeek@student.tudelft.nl> All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"hash"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/baas-project/baas/pkg/api"
+	"github.com/baas-project/baas/pkg/model/images"
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// transferRetries is how often a transfer is resumed after the connection dropped before giving up
+	transferRetries = 5
+	// transferRetryDelay is the time waited before resuming, it doubles with every attempt
+	transferRetryDelay = 2 * time.Second
+	// uploadPartSize is the size of the parts of an upload, a part is kept in memory until the server has it
+	uploadPartSize = 16 * 1024 * 1024
+)
+
+// resumableDownload reads an image file from the control server. When the connection drops the file is requested
+// again from the first byte which was not read yet, so everything which has been written to the partition already
+// is not sent again. The file is hashed while it is read and checked against the digest of the server at the end.
+type resumableDownload struct {
+	api *APIClient
+	url string
+
+	body   io.ReadCloser
+	offset int64
+	size   int64
+	etag   string
+	digest []byte
+	hash   hash.Hash
+
+	retries int
+}
+
+// request (re)starts the transfer at the current offset
+func (d *resumableDownload) request() error {
+	resp, err := d.api.requestRange(d.url, d.offset, d.etag)
+	if err != nil {
+		return err
+	}
+
+	if d.offset == 0 {
+		digest, err := api.ParseDigest(resp.Header.Get(api.DigestHeader))
+		if err != nil {
+			_ = resp.Body.Close()
+			return errors.Wrap(err, "image download")
+		}
+
+		d.digest = digest
+		d.etag = resp.Header.Get("ETag")
+		d.size = resp.ContentLength
+	} else if resp.StatusCode != http.StatusPartialContent {
+		// The server ignores the range when the ETag does not match, the file changed in the meantime
+		_ = resp.Body.Close()
+		return errors.New("the image changed while it was being downloaded")
+	}
+
+	d.body = resp.Body
+	return nil
+}
+
+// resume waits a bit and continues the transfer, it gives up after transferRetries attempts in a row
+func (d *resumableDownload) resume(cause error) error {
+	_ = d.body.Close()
+
+	for {
+		if d.retries >= transferRetries {
+			return errors.Wrapf(cause, "download interrupted at byte %d, giving up after %d attempts",
+				d.offset, d.retries)
+		}
+
+		delay := transferRetryDelay << uint(d.retries)
+		d.retries++
+
+		log.Warnf("Download of %s interrupted at byte %d (%v), resuming in %v", d.url, d.offset, cause, delay)
+		time.Sleep(delay)
+
+		err := d.request()
+		if err == nil {
+			return nil
+		}
+
+		cause = err
+	}
+}
+
+func (d *resumableDownload) Read(p []byte) (int, error) {
+	for {
+		n, err := d.body.Read(p)
+		d.hash.Write(p[:n])
+		d.offset += int64(n)
+
+		if n > 0 {
+			// Progress was made, so a following interruption gets a fresh set of attempts
+			d.retries = 0
+		}
+
+		switch {
+		case err == nil:
+			return n, nil
+		case err == io.EOF && (d.size < 0 || d.offset >= d.size):
+			return n, d.verify()
+		case err == io.EOF:
+			err = io.ErrUnexpectedEOF
+		}
+
+		if rerr := d.resume(err); rerr != nil {
+			return n, rerr
+		}
+
+		if n > 0 {
+			return n, nil
+		}
+	}
+}
+
+// Size returns the size of the file, -1 if the server did not tell
+func (d *resumableDownload) Size() int64 {
+	return d.size
+}
+
+// verify compares the digest of everything that was read with the one the server sent
+func (d *resumableDownload) verify() error {
+	if sum := d.hash.Sum(nil); !bytes.Equal(sum, d.digest) {
+		return errors.Errorf("image digest mismatch: got %s, expected %s",
+			hex.EncodeToString(sum), hex.EncodeToString(d.digest))
+	}
+
+	log.Debugf("done downloading %s over http, digest verified", d.url)
+	return io.EOF
+}
+
+func (d *resumableDownload) Close() error {
+	return d.body.Close()
+}
+
+// resumableUpload sends an image to an upload on the control server, see UploadDiskHTTP
+type resumableUpload struct {
+	api *APIClient
+	url string
+
+	offset int64
+}
+
+// send uploads everything the reader returns and commits the upload, it returns the version which was created
+func (u *resumableUpload) send(r io.Reader) (*images.Version, error) {
+	hash := sha256.New()
+	part := make([]byte, uploadPartSize)
+
+	for {
+		n, err := io.ReadFull(r, part)
+		if n > 0 {
+			hash.Write(part[:n])
+			if err := u.sendPart(part[:n]); err != nil {
+				return nil, err
+			}
+		}
+
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			break
+		} else if err != nil {
+			return nil, errors.Wrap(err, "read disk")
+		}
+	}
+
+	var version images.Version
+	commit := struct{ Digest string }{hex.EncodeToString(hash.Sum(nil))}
+	if err := u.api.doJSON("POST", u.url, commit, &version); err != nil {
+		return nil, errors.Wrap(err, "commit upload")
+	}
+
+	return &version, nil
+}
+
+// sendPart sends the part, after an interruption only the bytes the server did not receive are sent again
+func (u *resumableUpload) sendPart(part []byte) error {
+	start := u.offset
+	end := start + int64(len(part))
+
+	for retries := 0; ; retries++ {
+		err := u.patch(part[u.offset-start:])
+		if err == nil {
+			return nil
+		}
+
+		if retries >= transferRetries {
+			return errors.Wrapf(err, "upload interrupted at byte %d, giving up after %d attempts", u.offset, retries)
+		}
+
+		delay := transferRetryDelay << uint(retries)
+		log.Warnf("Upload to %s interrupted at byte %d (%v), resuming in %v", u.url, u.offset, err, delay)
+		time.Sleep(delay)
+
+		// Ask the server how much it received, the response to the part may have been lost
+		received, err := u.received()
+		if err != nil {
+			continue
+		}
+
+		if received < start || received > end {
+			return errors.Errorf("the server has %d bytes, which is not within the part being sent", received)
+		}
+
+		u.offset = received
+		if u.offset == end {
+			return nil
+		}
+	}
+}
+
+// patch appends the data at the current offset
+func (u *resumableUpload) patch(data []byte) error {
+	req, err := u.api.newRequest("PATCH", u.url, bytes.NewReader(data))
+	if err != nil {
+		return errors.Wrap(err, "cannot create request")
+	}
+
+	req.Header.Set(api.UploadOffsetHeader, strconv.FormatInt(u.offset, 10))
+	req.Header.Set("Content-Type", "application/offset+octet-stream")
+
+	client := &http.Client{}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		msg, _ := ioutil.ReadAll(resp.Body)
+		return errors.Errorf("append to upload (%s)", strings.TrimSpace(string(msg)))
+	}
+
+	u.offset += int64(len(data))
+	return nil
+}
+
+// received asks the server how many bytes of the upload it has
+func (u *resumableUpload) received() (int64, error) {
+	var upload images.UploadModel
+	if err := u.api.doJSON("GET", u.url, nil, &upload); err != nil {
+		return 0, err
+	}
+
+	return upload.Offset, nil
+}
+
+// abort throws the upload away on the server, the server also removes it by itself after a day
+func (u *resumableUpload) abort() {
+	req, err := u.api.newRequest("DELETE", u.url, nil)
+	if err != nil {
+		return
+	}
+
+	client := &http.Client{}
+	resp, err := client.Do(req)
+	if err != nil {
+		log.Warnf("Cannot abort the upload %s: %v", u.url, err)
+		return
+	}
+
+	_ = resp.Body.Close()
+}
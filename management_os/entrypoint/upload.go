@@ -7,6 +7,8 @@ package main
 import (
 	"io"
 
+	api_pkg "github.com/baas-project/baas/pkg/api"
+	"github.com/baas-project/baas/pkg/blockmap"
 	"github.com/baas-project/baas/pkg/compression"
 	"github.com/baas-project/baas/pkg/model/images"
 	"github.com/baas-project/baas/pkg/util"
@@ -14,11 +16,12 @@ import (
 	log "github.com/sirupsen/logrus"
 )
 
-// ReadInDisks reads in all disks in the machine setup and uploads them to the control server.
+// ReadInDisks reads in all disks in the machine setup and uploads them to the control server. A disk is sent as a
+// block map, which leaves out the blocks that did not change since the version in the setup was written.
 func ReadInDisks(api *APIClient, setup *images.ImageSetup) error {
 	log.Info("Reading and uploading disks")
 
-	for _, image := range setup.Images {
+	for i, image := range setup.Images {
 		log.Debugf("reading disk: %v", image.Image.UUID)
 		util.PrettyPrintStruct(image)
 		if !image.Update {
@@ -26,27 +29,106 @@ func ReadInDisks(api *APIClient, setup *images.ImageSetup) error {
 			continue
 		}
 
-		r, err := ReadDisk(&image.Image)
-		if err != nil {
-			return errors.Wrapf(err, "read disk")
+		provisioning.progress(&image, i, len(setup.Images))
+
+		// The machine wrote to the disk on the control server, which only has to store it
+		if image.Export != "" {
+			version, err := api.CommitNBDExport(api.mac, image.Export)
+			if err != nil {
+				return errors.Wrapf(err, "committing the NBD disk of image %s", image.Image.UUID)
+			}
+
+			log.Infof("Stored the NBD disk of image %s as version %d", image.Image.UUID, version.Version)
+			continue
 		}
 
-		log.Debug("Compressing disk")
-		com, err := compression.Compress(r, image.Image.DiskCompressionStrategy)
-		if err != nil {
-			return errors.Wrapf(err, "compressing disk")
+		// The hashes are only of use when they belong to the version the server knows was written
+		partition := getPartition(image.Image.UUID)
+		if partition == nil {
+			log.Warnf("Image %s is not on the disk anymore, it is not uploaded", image.Image.UUID)
+			continue
+		}
+
+		base := partition.Blocks
+		if base != nil && (base.Version != image.Version.Version || base.Digest != image.Version.Digest) {
+			log.Infof("The partition of image %s does not hold version %d anymore", image.Image.UUID,
+				image.Version.Version)
+			base = nil
+		}
+
+		hashes, err := UploadDisk(api, &image.Image, base)
+
+		// The server refuses the changes when it does not have the base anymore, the whole disk is sent instead
+		if err != nil && base != nil {
+			log.Warnf("Cannot upload the changes to version %d of image %s, uploading all of it: %v",
+				base.Version, image.Image.UUID, err)
+			hashes, err = UploadDisk(api, &image.Image, nil)
 		}
 
-		log.Debug("Uploading image")
-		err = UploadDisk(api, com, &image.Image)
 		if err != nil {
+			partition.Blocks = nil
 			return errors.Wrapf(err, "uploading disk")
 		}
+
+		partition.Blocks = hashes
 	}
 	return nil
 }
 
-// UploadDisk uploads a disk to the control server given a transfer strategy.
-func UploadDisk(api *APIClient, reader io.Reader, uuid *images.ImageModel) error {
-	return api.UploadDiskHTTP(reader, string(uuid.UUID))
+// UploadDisk uploads the disk of the image as a block map, the blocks which are the same as in the base are left
+// out. It returns the hashes of the blocks of the disk, for the version which was created from it.
+func UploadDisk(api *APIClient, image *images.ImageModel, base *blockmap.Hashes) (*blockmap.Hashes, error) {
+	file, err := ReadDisk(image)
+	if err != nil {
+		return nil, errors.Wrapf(err, "read disk")
+	}
+
+	defer func() {
+		if err := file.Close(); err != nil {
+			log.Warnf("Cannot close the disk: %v", err)
+		}
+	}()
+
+	// The disk is read twice: once to find the blocks which have to be sent and once to send them
+	log.Debug("Finding the blocks to upload")
+	header, hashes, err := blockmap.Plan(file, blockmap.DefaultBlockSize, base)
+	if err != nil {
+		return nil, errors.Wrapf(err, "read disk")
+	}
+
+	log.Infof("Uploading %d of %d bytes of image %s", header.DataSize(), header.Size, image.UUID)
+
+	// Only the blocks which are sent are read, so they are what the progress is counted in
+	progress := newProgress(api, nil, image, 0, api_pkg.StageUpload, header.DataSize())
+
+	r, w := io.Pipe()
+	go func() {
+		defer progress.Finish()
+		_ = w.CloseWithError(blockmap.Write(w, header, progressReaderAt{file, progress}))
+	}()
+
+	com, err := compression.Compress(r, image.DiskCompressionStrategy)
+	if err != nil {
+		_ = r.Close()
+		return nil, errors.Wrapf(err, "compressing disk")
+	}
+
+	log.Debug("Uploading image")
+	version, err := api.UploadDiskHTTP(com, string(image.UUID), true)
+
+	// Closing the compression stream and the pipe stops them when the upload failed halfway
+	if cerr := com.Close(); cerr != nil {
+		log.Warnf("Cannot close the compression stream: %v", cerr)
+	}
+
+	_ = r.Close()
+
+	if err != nil {
+		return nil, err
+	}
+
+	hashes.Version = version.Version
+	hashes.Digest = version.Digest
+
+	return hashes, nil
 }
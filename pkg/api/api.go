@@ -5,9 +5,169 @@
 // Package api defines structures which are transferred over the network
 package api
 
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"strings"
+	"time"
+
+	"github.com/baas-project/baas/pkg/blockmap"
+	"github.com/baas-project/baas/pkg/model/images"
+	"github.com/pkg/errors"
+)
+
 // Port is the port on which the control server listens
 const Port int = 4848
 
+// PeerPort is the port on which the management OS serves the versions on its disk to other machines
+const PeerPort int = 4849
+
+// NBDPort is the port on which the control server serves the disks of machines which boot over NBD
+const NBDPort int = 10809
+
+// TokenCmdlineParameter is the kernel command line parameter through which the management OS receives its credential
+const TokenCmdlineParameter = "baas.token"
+
+// DiscoveryCmdlineParameter is on the kernel command line when the management OS has to collect the hardware of an
+// unknown machine instead of provisioning it
+const DiscoveryCmdlineParameter = "baas.discover"
+
+const (
+	// MachineHeader is the header in which the management OS sends the MAC address of its machine
+	MachineHeader = "X-BAAS-Machine"
+	// MachineTokenHeader is the header in which the management OS sends the credential of its machine
+	MachineTokenHeader = "X-BAAS-Machine-Token"
+)
+
+// DigestHeader is the header in which the control server sends the SHA-256 of a downloaded image file,
+// in the sha-256=<base64> form of RFC 3230
+const DigestHeader = "Digest"
+
+// FormatDigest turns a hex encoded SHA-256 into the value of the DigestHeader
+func FormatDigest(sum string) (string, error) {
+	raw, err := hex.DecodeString(sum)
+	if err != nil {
+		return "", errors.Wrap(err, "invalid digest")
+	}
+
+	return digestAlgorithm + base64.StdEncoding.EncodeToString(raw), nil
+}
+
+// ParseDigest returns the SHA-256 in the value of the DigestHeader, other algorithms are ignored
+func ParseDigest(header string) ([]byte, error) {
+	for _, value := range strings.Split(header, ",") {
+		value = strings.TrimSpace(value)
+		if !strings.HasPrefix(strings.ToLower(value), digestAlgorithm) {
+			continue
+		}
+
+		raw, err := base64.StdEncoding.DecodeString(value[len(digestAlgorithm):])
+		if err != nil || len(raw) != sha256.Size {
+			return nil, errors.Errorf("invalid digest %q", value)
+		}
+
+		return raw, nil
+	}
+
+	return nil, errors.New("no sha-256 digest given")
+}
+
+const digestAlgorithm = "sha-256="
+
+// UploadOffsetHeader holds the amount of bytes of a resumable upload the control server has received
+const UploadOffsetHeader = "Upload-Offset"
+
 // BootInformRequest is the data which the machine (client) sends to the control server on initial boot
 type BootInformRequest struct {
 }
+
+// ProvisioningReport is sent by the management OS when it could not put an image on the disk of its machine.
+// Image is empty when the setup as a whole was refused, for instance because its images do not fit on the disk.
+type ProvisioningReport struct {
+	Image   images.ImageUUID
+	Version uint64
+	Error   string
+}
+
+// MulticastSession tells the management OS how to receive an image file over multicast. The file is sent to
+// Group, missing packets are asked for at Port of the control server. Size and Digest are those of the file.
+type MulticastSession struct {
+	Session uint32
+	Group   string
+	Port    int
+	Size    int64
+	Digest  string
+}
+
+// PeerVersion is a version of an image which a peer holds on its disk
+type PeerVersion struct {
+	Image   images.ImageUUID
+	Version uint64
+}
+
+// PeerAnnouncement is sent by the management OS to tell the control server which versions it serves to other
+// machines. Address is the host:port of the peer, the host is always that of the request and may be left out.
+type PeerAnnouncement struct {
+	Address  string
+	Versions []PeerVersion
+}
+
+// PeerToken is the token of a version, a peer only sends the blocks of the version to whoever presents it in the
+// PeerTokenHeader. The control server returns the tokens of the versions in response to an announcement.
+type PeerToken struct {
+	PeerVersion
+	Token string
+}
+
+// PeerTokenHeader is the header a machine sends the token of a version in when it asks a peer for a block
+const PeerTokenHeader = "X-BAAS-Peer-Token"
+
+// PeerSources tells the management OS where it can get a version: the addresses of the peers which hold it, the
+// token they want to see and the hashes of the blocks of the disk, every block is checked against them
+type PeerSources struct {
+	Blocks *blockmap.Hashes
+	Peers  []string
+	Token  string
+}
+
+// NBDExport is a disk the control server serves over NBD to a machine. Name is the name of the export, which is
+// what gives access to it, Written is the amount of bytes in the overlay of the machine.
+type NBDExport struct {
+	Name    string
+	Image   images.ImageUUID
+	Version uint64
+	Size    int64
+	Written int64
+}
+
+// TransferStage is a step a disk goes through in the management OS
+type TransferStage string
+
+const (
+	// StageDownload receives the image file from the control server, the peers or a multicast session
+	StageDownload TransferStage = "download"
+	// StageDecompress expands the image file into the disk
+	StageDecompress TransferStage = "decompress"
+	// StageWrite writes the disk to its partition
+	StageWrite TransferStage = "write"
+	// StageUpload sends the disk of a partition to the control server
+	StageUpload TransferStage = "upload"
+)
+
+// TransferProgress is how far the management OS is with a stage of an image. Done and Total are in bytes, Total is
+// 0 if it is not known. Throughput is in bytes per second and ETA in seconds.
+type TransferProgress struct {
+	Image   images.ImageUUID
+	Version uint64
+	Stage   TransferStage
+
+	Done       int64
+	Total      int64
+	Throughput float64
+	ETA        float64
+	Finished   bool
+
+	// Time is when the control server received the progress
+	Time time.Time
+}
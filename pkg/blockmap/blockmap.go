@@ -0,0 +1,336 @@
+// Copyright (c) 2020-2022 TU Delft & Valentijn van de Beek <v.d.vandebeek@student.tudelft.nl> All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package blockmap is the format the management OS uploads disks in. A block map starts with a header which
+// lists the ranges of blocks that are sent, followed by the data of those blocks. The blocks which are not
+// listed come from the base version the disk was provisioned with, or are zero if there is no base. This way
+// neither the blocks which only hold zeros nor the blocks which did not change since the disk was written are
+// sent over the network, the control server rebuilds the whole disk from the base and the block map.
+package blockmap
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"io"
+	"io/ioutil"
+
+	"github.com/pkg/errors"
+)
+
+// DefaultBlockSize is the size of the blocks the management OS compares and sends
+const DefaultBlockSize = 256 * 1024
+
+// maxBlockSize keeps the buffer of a single block within reason
+const maxBlockSize = 64 * 1024 * 1024
+
+var magic = []byte("BAASBMAP")
+
+const (
+	formatVersion = 1
+	headerSize    = 8 + 4 + 4 + 8 + 8 + sha256.Size + sha256.Size + 4
+	rangeSize     = 8 + 8 + 1
+)
+
+var (
+	// ErrDigestMismatch is returned when the rebuilt disk does not have the digest given in the header
+	ErrDigestMismatch = errors.New("the rebuilt disk does not match the digest of the block map")
+	// ErrNotBlockMap is returned when the data does not start like a block map
+	ErrNotBlockMap = errors.New("not a block map")
+)
+
+// Kind is what a range of blocks holds
+type Kind uint8
+
+const (
+	// Data ranges are followed by their blocks in the data section
+	Data Kind = iota
+	// Zero ranges read as zeros, they are only needed when the blocks are not zero in the base
+	Zero
+)
+
+// Range is a series of consecutive blocks, Start is the index of the first block
+type Range struct {
+	Start uint64
+	Count uint64
+	Kind  Kind
+}
+
+// Header describes the disk in a block map
+type Header struct {
+	BlockSize uint32
+	// Size is the size of the disk in bytes, the last block is cut off at the end of the disk
+	Size int64
+
+	// BaseVersion and BaseDigest identify the version of the image the blocks which are not listed come from,
+	// without a base digest they are zero. Digest is the hex encoded SHA-256 of the whole disk.
+	BaseVersion uint64
+	BaseDigest  string
+	Digest      string
+
+	Ranges []Range
+}
+
+// HasBase reports whether the block map is a delta against a version
+func (h *Header) HasBase() bool {
+	return h.BaseDigest != ""
+}
+
+// Blocks returns the amount of blocks of the disk
+func (h *Header) Blocks() uint64 {
+	return uint64((h.Size + int64(h.BlockSize) - 1) / int64(h.BlockSize))
+}
+
+// block returns the length of the block, only the last one can be shorter than the block size
+func (h *Header) block(index uint64) int {
+	if rest := h.Size - int64(index)*int64(h.BlockSize); rest < int64(h.BlockSize) {
+		return int(rest)
+	}
+
+	return int(h.BlockSize)
+}
+
+// DataSize returns the amount of bytes in the data section
+func (h *Header) DataSize() int64 {
+	var size int64
+	for _, r := range h.Ranges {
+		if r.Kind != Data {
+			continue
+		}
+
+		for i := r.Start; i < r.Start+r.Count; i++ {
+			size += int64(h.block(i))
+		}
+	}
+
+	return size
+}
+
+// check makes sure the ranges are in order, do not overlap and lie within the disk
+func (h *Header) check() error {
+	if h.BlockSize == 0 || h.BlockSize > maxBlockSize || h.Size < 0 {
+		return errors.Errorf("invalid block size %d or disk size %d", h.BlockSize, h.Size)
+	}
+
+	var next uint64
+	for _, r := range h.Ranges {
+		if r.Count == 0 || r.Start < next || r.Start+r.Count > h.Blocks() || r.Start+r.Count < r.Start {
+			return errors.Errorf("invalid range of %d blocks at block %d", r.Count, r.Start)
+		}
+
+		if r.Kind != Data && r.Kind != Zero {
+			return errors.Errorf("invalid range kind %d", r.Kind)
+		}
+
+		next = r.Start + r.Count
+	}
+
+	return nil
+}
+
+// putDigest stores the hex encoded digest, an empty digest is stored as zeros
+func putDigest(buf []byte, digest string) error {
+	if digest == "" {
+		return nil
+	}
+
+	raw, err := hex.DecodeString(digest)
+	if err != nil || len(raw) != sha256.Size {
+		return errors.Errorf("invalid digest %q", digest)
+	}
+
+	copy(buf, raw)
+	return nil
+}
+
+// getDigest returns the hex encoded digest, a digest of zeros is empty
+func getDigest(buf []byte) string {
+	if bytes.Equal(buf, make([]byte, sha256.Size)) {
+		return ""
+	}
+
+	return hex.EncodeToString(buf)
+}
+
+// WriteHeader writes the header, the data of the ranges has to follow it
+func WriteHeader(w io.Writer, h *Header) error {
+	if err := h.check(); err != nil {
+		return err
+	}
+
+	buf := make([]byte, headerSize, headerSize+len(h.Ranges)*rangeSize)
+	copy(buf, magic)
+	binary.BigEndian.PutUint32(buf[8:], formatVersion)
+	binary.BigEndian.PutUint32(buf[12:], h.BlockSize)
+	binary.BigEndian.PutUint64(buf[16:], uint64(h.Size))
+	binary.BigEndian.PutUint64(buf[24:], h.BaseVersion)
+
+	if err := putDigest(buf[32:], h.BaseDigest); err != nil {
+		return err
+	}
+
+	if err := putDigest(buf[32+sha256.Size:], h.Digest); err != nil {
+		return err
+	}
+
+	binary.BigEndian.PutUint32(buf[32+2*sha256.Size:], uint32(len(h.Ranges)))
+
+	for _, r := range h.Ranges {
+		entry := make([]byte, rangeSize)
+		binary.BigEndian.PutUint64(entry, r.Start)
+		binary.BigEndian.PutUint64(entry[8:], r.Count)
+		entry[16] = byte(r.Kind)
+		buf = append(buf, entry...)
+	}
+
+	_, err := w.Write(buf)
+	return errors.Wrap(err, "write block map header")
+}
+
+// ReadHeader reads the header, the data of the ranges follows it in the reader
+func ReadHeader(r io.Reader) (*Header, error) {
+	buf := make([]byte, headerSize)
+	if _, err := io.ReadFull(r, buf); err != nil {
+		return nil, errors.Wrap(err, "read block map header")
+	}
+
+	if !bytes.Equal(buf[:8], magic) {
+		return nil, ErrNotBlockMap
+	}
+
+	if version := binary.BigEndian.Uint32(buf[8:]); version != formatVersion {
+		return nil, errors.Errorf("unsupported block map version %d", version)
+	}
+
+	h := &Header{
+		BlockSize:   binary.BigEndian.Uint32(buf[12:]),
+		Size:        int64(binary.BigEndian.Uint64(buf[16:])),
+		BaseVersion: binary.BigEndian.Uint64(buf[24:]),
+		BaseDigest:  getDigest(buf[32 : 32+sha256.Size]),
+		Digest:      getDigest(buf[32+sha256.Size : 32+2*sha256.Size]),
+	}
+
+	if h.BlockSize == 0 || h.Size < 0 {
+		return nil, errors.Errorf("invalid block size %d or disk size %d", h.BlockSize, h.Size)
+	}
+
+	// Every range holds at least one block, so a count beyond the number of blocks cannot be right
+	count := uint64(binary.BigEndian.Uint32(buf[32+2*sha256.Size:]))
+	if count > h.Blocks() {
+		return nil, errors.Errorf("block map has %d ranges for %d blocks", count, h.Blocks())
+	}
+
+	entry := make([]byte, rangeSize)
+	for i := uint64(0); i < count; i++ {
+		if _, err := io.ReadFull(r, entry); err != nil {
+			return nil, errors.Wrap(err, "read block map header")
+		}
+
+		h.Ranges = append(h.Ranges, Range{
+			Start: binary.BigEndian.Uint64(entry),
+			Count: binary.BigEndian.Uint64(entry[8:]),
+			Kind:  Kind(entry[16]),
+		})
+	}
+
+	return h, h.check()
+}
+
+// Write writes the block map of the disk: the header followed by the blocks of the data ranges
+func Write(w io.Writer, h *Header, disk io.ReaderAt) error {
+	if err := WriteHeader(w, h); err != nil {
+		return err
+	}
+
+	buf := make([]byte, h.BlockSize)
+	for _, r := range h.Ranges {
+		if r.Kind != Data {
+			continue
+		}
+
+		for i := r.Start; i < r.Start+r.Count; i++ {
+			data := buf[:h.block(i)]
+			if _, err := disk.ReadAt(data, int64(i)*int64(h.BlockSize)); err != nil && err != io.EOF {
+				return errors.Wrapf(err, "read block %d", i)
+			}
+
+			if _, err := w.Write(data); err != nil {
+				return errors.Wrap(err, "write block map")
+			}
+		}
+	}
+
+	return nil
+}
+
+// Apply reads the data of the block map which follows the header from r and writes the whole disk to w. The
+// blocks which are not listed are read from base, which is the disk of the base version. A nil base and the
+// part of the disk beyond the end of the base read as zeros. ErrDigestMismatch is returned if the disk which
+// was written does not have the digest in the header.
+func Apply(w io.Writer, h *Header, r io.Reader, base io.Reader) error {
+	hash := sha256.New()
+	out := io.MultiWriter(w, hash)
+	buf := make([]byte, h.BlockSize)
+
+	// offset is how far the base has been read, the blocks in the ranges are skipped in it
+	var offset int64
+	readBase := func(index uint64, data []byte) error {
+		start := int64(index) * int64(h.BlockSize)
+		if base == nil {
+			return nil
+		}
+
+		if _, err := io.CopyN(ioutil.Discard, base, start-offset); err == io.EOF {
+			base = nil
+			return nil
+		} else if err != nil {
+			return errors.Wrap(err, "read base")
+		}
+
+		n, err := io.ReadFull(base, data)
+		offset = start + int64(n)
+
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			base = nil
+		} else if err != nil {
+			return errors.Wrap(err, "read base")
+		}
+
+		return nil
+	}
+
+	ranges := h.Ranges
+	for i := uint64(0); i < h.Blocks(); i++ {
+		for len(ranges) > 0 && ranges[0].Start+ranges[0].Count <= i {
+			ranges = ranges[1:]
+		}
+
+		data := buf[:h.block(i)]
+		for j := range data {
+			data[j] = 0
+		}
+
+		switch {
+		case len(ranges) == 0 || ranges[0].Start > i:
+			if err := readBase(i, data); err != nil {
+				return err
+			}
+		case ranges[0].Kind == Data:
+			if _, err := io.ReadFull(r, data); err != nil {
+				return errors.Wrapf(err, "read block %d", i)
+			}
+		}
+
+		if _, err := out.Write(data); err != nil {
+			return errors.Wrap(err, "write disk")
+		}
+	}
+
+	if h.Digest != "" && hex.EncodeToString(hash.Sum(nil)) != h.Digest {
+		return ErrDigestMismatch
+	}
+
+	return nil
+}
@@ -0,0 +1,190 @@
+// Copyright (c) 2020-2022 TU Delft & Valentijn van de Beek <v.d.vandebeek@student.tudelft.nl> All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package blockmap
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+const testBlockSize = 4096
+
+// testDisk creates a disk which is zero apart from the given blocks
+func testDisk(size int, blocks ...int) []byte {
+	disk := make([]byte, size)
+	for _, block := range blocks {
+		copy(disk[block*testBlockSize:], bytes.Repeat([]byte{byte(block + 1)}, testBlockSize))
+	}
+
+	return disk
+}
+
+// roundTrip plans the disk against the base, writes the block map and applies it to the base disk
+func roundTrip(t *testing.T, disk []byte, base []byte, hashes *Hashes) (*Header, []byte, int) {
+	header, _, err := Plan(bytes.NewReader(disk), testBlockSize, hashes)
+	assert.NoError(t, err)
+
+	var blockMap bytes.Buffer
+	assert.NoError(t, Write(&blockMap, header, bytes.NewReader(disk)))
+	size := blockMap.Len()
+
+	read, err := ReadHeader(&blockMap)
+	assert.NoError(t, err)
+	assert.Equal(t, header, read)
+
+	var out bytes.Buffer
+	if base == nil {
+		assert.NoError(t, Apply(&out, read, &blockMap, nil))
+	} else {
+		assert.NoError(t, Apply(&out, read, &blockMap, bytes.NewReader(base)))
+	}
+
+	return header, out.Bytes(), size
+}
+
+func TestPlan(t *testing.T) {
+	disk := testDisk(100*testBlockSize, 1, 2, 50)
+
+	// Without a base only the blocks with data are sent
+	header, hashes, err := Plan(bytes.NewReader(disk), testBlockSize, nil)
+	assert.NoError(t, err)
+	assert.False(t, header.HasBase())
+	assert.Equal(t, []Range{{Start: 1, Count: 2, Kind: Data}, {Start: 50, Count: 1, Kind: Data}}, header.Ranges)
+	assert.Equal(t, int64(3*testBlockSize), header.DataSize())
+	assert.Len(t, hashes.Blocks, 100)
+
+	hash := sha256.Sum256(disk)
+	assert.Equal(t, hex.EncodeToString(hash[:]), header.Digest)
+
+	// The Hasher comes to the same hashes when the disk is written to it in odd pieces
+	hasher := NewHasher(testBlockSize)
+	for i := 0; i < len(disk); i += 1000 {
+		end := i + 1000
+		if end > len(disk) {
+			end = len(disk)
+		}
+
+		_, _ = hasher.Write(disk[i:end])
+	}
+
+	assert.Equal(t, hashes, hasher.Hashes())
+
+	// Against the base only the blocks which changed are sent, blocks which became zero are listed without data
+	hashes.Version = 3
+	hashes.Digest = header.Digest
+
+	changed := testDisk(100*testBlockSize, 1, 60)
+	header, _, err = Plan(bytes.NewReader(changed), testBlockSize, hashes)
+	assert.NoError(t, err)
+	assert.True(t, header.HasBase())
+	assert.Equal(t, uint64(3), header.BaseVersion)
+	assert.Equal(t, []Range{
+		{Start: 2, Count: 1, Kind: Zero},
+		{Start: 50, Count: 1, Kind: Zero},
+		{Start: 60, Count: 1, Kind: Data},
+	}, header.Ranges)
+
+	_, _, err = Plan(bytes.NewReader(changed), 2*testBlockSize, hashes)
+	assert.Error(t, err)
+}
+
+func TestHashesCheck(t *testing.T) {
+	disk := testDisk(10*testBlockSize+100, 1, 10)
+	_, hashes, err := Plan(bytes.NewReader(disk), testBlockSize, nil)
+	assert.NoError(t, err)
+
+	offset, size := hashes.Block(1)
+	assert.Equal(t, int64(testBlockSize), offset)
+	assert.Equal(t, testBlockSize, size)
+	assert.True(t, hashes.Check(1, disk[offset:offset+int64(size)]))
+	assert.False(t, hashes.Check(2, disk[offset:offset+int64(size)]))
+
+	// The last block is short
+	offset, size = hashes.Block(10)
+	assert.Equal(t, 100, size)
+	assert.True(t, hashes.Check(10, disk[offset:]))
+	assert.False(t, hashes.Check(11, nil))
+}
+
+func TestApply(t *testing.T) {
+	base := testDisk(100*testBlockSize, 1, 2, 50)
+	_, hashes, err := Plan(bytes.NewReader(base), testBlockSize, nil)
+	assert.NoError(t, err)
+
+	hash := sha256.Sum256(base)
+	hashes.Version = 1
+	hashes.Digest = hex.EncodeToString(hash[:])
+
+	// The size does not have to be a whole number of blocks, and may grow or shrink compared to the base
+	for _, disk := range [][]byte{
+		testDisk(100*testBlockSize, 1, 60),
+		testDisk(100*testBlockSize+100, 2, 99),
+		testDisk(200*testBlockSize, 1, 2, 50, 150),
+		testDisk(10*testBlockSize+1, 1),
+		testDisk(0),
+	} {
+		_, out, size := roundTrip(t, disk, base, hashes)
+		assert.True(t, bytes.Equal(disk, out), len(disk))
+		assert.Less(t, size, len(base)/2)
+
+		_, out, _ = roundTrip(t, disk, nil, nil)
+		assert.True(t, bytes.Equal(disk, out), len(disk))
+	}
+
+	// Applying the block map to another base does not come to the digest
+	disk := testDisk(100*testBlockSize, 1, 60)
+	header, _, err := Plan(bytes.NewReader(disk), testBlockSize, hashes)
+	assert.NoError(t, err)
+
+	var blockMap bytes.Buffer
+	assert.NoError(t, Write(&blockMap, header, bytes.NewReader(disk)))
+
+	read, err := ReadHeader(&blockMap)
+	assert.NoError(t, err)
+
+	err = Apply(&bytes.Buffer{}, read, &blockMap, bytes.NewReader(testDisk(100*testBlockSize, 3)))
+	assert.Equal(t, ErrDigestMismatch, err)
+}
+
+func TestReadHeader(t *testing.T) {
+	_, err := ReadHeader(bytes.NewReader(bytes.Repeat([]byte("not a block map"), 10)))
+	assert.Equal(t, ErrNotBlockMap, err)
+
+	_, err = ReadHeader(bytes.NewReader(nil))
+	assert.Error(t, err)
+
+	// Ranges have to be in order and within the disk
+	for _, ranges := range [][]Range{
+		{{Start: 5, Count: 1}, {Start: 2, Count: 1}},
+		{{Start: 2, Count: 2}, {Start: 3, Count: 1}},
+		{{Start: 9, Count: 2}},
+		{{Start: 1, Count: 0}},
+		{{Start: 1, Count: 1, Kind: 7}},
+	} {
+		header := &Header{BlockSize: testBlockSize, Size: 10 * testBlockSize, Ranges: ranges}
+		assert.Error(t, WriteHeader(&bytes.Buffer{}, header))
+
+		// Skip the checks of WriteHeader to see that ReadHeader catches it as well
+		var buf bytes.Buffer
+		valid := &Header{BlockSize: testBlockSize, Size: 10 * testBlockSize}
+		for range ranges {
+			valid.Ranges = append(valid.Ranges, Range{Start: uint64(len(valid.Ranges)), Count: 1})
+		}
+
+		assert.NoError(t, WriteHeader(&buf, valid))
+		data := buf.Bytes()
+		for i, r := range ranges {
+			entry := data[headerSize+i*rangeSize:]
+			copy(entry, []byte{0, 0, 0, 0, 0, 0, 0, byte(r.Start), 0, 0, 0, 0, 0, 0, 0, byte(r.Count), byte(r.Kind)})
+		}
+
+		_, err = ReadHeader(bytes.NewReader(data))
+		assert.Error(t, err)
+	}
+}
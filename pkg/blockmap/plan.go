@@ -0,0 +1,184 @@
+// Copyright (c) 2020-2022 TU Delft & Valentijn van de Beek <v.d.vandebeek@student.tudelft.nl> All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package blockmap
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"hash"
+	"io"
+
+	"github.com/pkg/errors"
+)
+
+// Hashes is the SHA-256 of every block of a disk, it is kept next to the disk so the blocks which changed can be
+// found without the disk it was written from. Version and Digest identify the version which was written.
+type Hashes struct {
+	Version   uint64
+	Digest    string
+	BlockSize uint32
+	Size      int64
+	Blocks    [][]byte
+}
+
+// Block returns where block n of the disk starts and how large it is, only the last block can be shorter
+func (h *Hashes) Block(n uint64) (offset int64, size int) {
+	offset = int64(n) * int64(h.BlockSize)
+	if rest := h.Size - offset; rest < int64(h.BlockSize) {
+		return offset, int(rest)
+	}
+
+	return offset, int(h.BlockSize)
+}
+
+// Check reports whether the data is block n of the disk
+func (h *Hashes) Check(n uint64, data []byte) bool {
+	if n >= uint64(len(h.Blocks)) {
+		return false
+	}
+
+	sum := sha256.Sum256(data)
+	return bytes.Equal(sum[:], h.Blocks[n])
+}
+
+// Hasher hashes the blocks of the disk written to it
+type Hasher struct {
+	blockSize int
+	size      int64
+	block     hash.Hash
+	fill      int
+	blocks    [][]byte
+}
+
+// NewHasher creates a Hasher for blocks of the given size
+func NewHasher(blockSize uint32) *Hasher {
+	return &Hasher{blockSize: int(blockSize), block: sha256.New()}
+}
+
+// Write hashes the data, which may cross the boundaries of blocks
+func (h *Hasher) Write(p []byte) (int, error) {
+	n := len(p)
+	h.size += int64(n)
+
+	for len(p) > 0 {
+		chunk := h.blockSize - h.fill
+		if chunk > len(p) {
+			chunk = len(p)
+		}
+
+		_, _ = h.block.Write(p[:chunk])
+		h.fill += chunk
+		p = p[chunk:]
+
+		if h.fill == h.blockSize {
+			h.blocks = append(h.blocks, h.block.Sum(nil))
+			h.block.Reset()
+			h.fill = 0
+		}
+	}
+
+	return n, nil
+}
+
+// Hashes returns the hashes of the blocks which were written, a short last block is hashed as it is
+func (h *Hasher) Hashes() *Hashes {
+	blocks := h.blocks
+	if h.fill > 0 {
+		blocks = append(blocks[:len(blocks):len(blocks)], h.block.Sum(nil))
+	}
+
+	return &Hashes{BlockSize: uint32(h.blockSize), Size: h.size, Blocks: blocks}
+}
+
+// isZero checks whether the block only holds zeros
+func isZero(data []byte) bool {
+	for len(data) > 0 {
+		n := len(data)
+		if n > len(zeros) {
+			n = len(zeros)
+		}
+
+		if !bytes.Equal(data[:n], zeros[:n]) {
+			return false
+		}
+
+		data = data[n:]
+	}
+
+	return true
+}
+
+var zeros = make([]byte, 4096)
+
+// Plan reads the disk and picks the blocks which have to be sent. Without a base the blocks which only hold
+// zeros are left out. With a base the blocks whose hash is the same as in the base are left out as well, and so
+// are the zero blocks beyond the end of the base. The blocks of the base have to have the given block size.
+// The hashes of the blocks of the disk are returned as well, they are the base of the next upload.
+func Plan(disk io.Reader, blockSize uint32, base *Hashes) (*Header, *Hashes, error) {
+	if base != nil && base.BlockSize != blockSize {
+		return nil, nil, errors.Errorf("the base has blocks of %d bytes instead of %d", base.BlockSize, blockSize)
+	}
+
+	header := &Header{BlockSize: blockSize}
+	if base != nil {
+		header.BaseVersion = base.Version
+		header.BaseDigest = base.Digest
+	}
+
+	hashes := &Hashes{BlockSize: blockSize}
+	digest := sha256.New()
+	buf := make([]byte, blockSize)
+
+	add := func(index uint64, kind Kind) {
+		if n := len(header.Ranges); n > 0 {
+			last := &header.Ranges[n-1]
+			if last.Kind == kind && last.Start+last.Count == index {
+				last.Count++
+				return
+			}
+		}
+
+		header.Ranges = append(header.Ranges, Range{Start: index, Count: 1, Kind: kind})
+	}
+
+	for index := uint64(0); ; index++ {
+		n, err := io.ReadFull(disk, buf)
+		if err == io.EOF {
+			break
+		} else if err != nil && err != io.ErrUnexpectedEOF {
+			return nil, nil, errors.Wrap(err, "read disk")
+		}
+
+		data := buf[:n]
+		sum := sha256.Sum256(data)
+		hashes.Blocks = append(hashes.Blocks, sum[:])
+		hashes.Size += int64(n)
+		_, _ = digest.Write(data)
+
+		zero := isZero(data)
+		switch {
+		case base != nil && index < uint64(len(base.Blocks)):
+			if !bytes.Equal(base.Blocks[index], sum[:]) {
+				if zero {
+					add(index, Zero)
+				} else {
+					add(index, Data)
+				}
+			}
+		case !zero:
+			add(index, Data)
+		}
+
+		if err == io.ErrUnexpectedEOF {
+			break
+		}
+	}
+
+	header.Size = hashes.Size
+	header.Digest = hex.EncodeToString(digest.Sum(nil))
+
+	return header, hashes, nil
+}
@@ -0,0 +1,149 @@
+// Copyright (c) 2020-2022 TU Delft & Valentijn van de Beek <v.d.vandebeek@student.tudelft.nl> All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package compression
+
+import (
+	"io"
+	"io/ioutil"
+
+	"github.com/baas-project/baas/pkg/model/images"
+
+	gzip "github.com/klauspost/pgzip"
+	"github.com/pierrec/lz4"
+	"github.com/ulikunitz/xz"
+	"github.com/valyala/gozstd"
+)
+
+func init() {
+	Register(images.DiskCompressionStrategyNone, noneCodec{})
+	Register(images.DiskCompressionStrategyGZip, gzipCodec{})
+	Register(images.DiskCompressionStrategyZSTD, zstdCodec{})
+	Register(images.DiskCompressionStrategyXZ, xzCodec{})
+	Register(images.DiskCompressionStrategyLZ4, lz4Codec{})
+}
+
+// nopWriteCloser adds a Close which does nothing to a writer
+type nopWriteCloser struct {
+	io.Writer
+}
+
+func (nopWriteCloser) Close() error {
+	return nil
+}
+
+// noneCodec passes the data through as it is
+type noneCodec struct{}
+
+func (noneCodec) NewWriter(w io.Writer) (io.WriteCloser, error) {
+	return nopWriteCloser{w}, nil
+}
+
+func (noneCodec) NewReader(r io.Reader) (io.ReadCloser, error) {
+	return ioutil.NopCloser(r), nil
+}
+
+func (noneCodec) Magic() []byte {
+	return nil
+}
+
+// gzipCodec uses pgzip, which compresses and decompresses blocks in parallel
+type gzipCodec struct{}
+
+func (gzipCodec) NewWriter(w io.Writer) (io.WriteCloser, error) {
+	return gzip.NewWriter(w), nil
+}
+
+func (gzipCodec) NewLevelWriter(w io.Writer, level int) (io.WriteCloser, error) {
+	return gzip.NewWriterLevel(w, level)
+}
+
+func (gzipCodec) Levels() (int, int) {
+	return gzip.BestSpeed, gzip.BestCompression
+}
+
+func (gzipCodec) NewReader(r io.Reader) (io.ReadCloser, error) {
+	return gzip.NewReader(r)
+}
+
+func (gzipCodec) Magic() []byte {
+	return []byte{0x1f, 0x8b}
+}
+
+// zstdReader releases the C resources of the zstd decoder when it is closed
+type zstdReader struct {
+	*gozstd.Reader
+}
+
+func (r zstdReader) Close() error {
+	r.Release()
+	return nil
+}
+
+// zstdWriter finishes the stream and releases the C resources of the zstd encoder when it is closed
+type zstdWriter struct {
+	*gozstd.Writer
+}
+
+func (w zstdWriter) Close() error {
+	defer w.Release()
+	return w.Writer.Close()
+}
+
+type zstdCodec struct{}
+
+func (zstdCodec) NewWriter(w io.Writer) (io.WriteCloser, error) {
+	return zstdWriter{gozstd.NewWriter(w)}, nil
+}
+
+func (zstdCodec) NewLevelWriter(w io.Writer, level int) (io.WriteCloser, error) {
+	return zstdWriter{gozstd.NewWriterLevel(w, level)}, nil
+}
+
+// Levels goes up to the highest level of the zstd library, the levels above 19 use a lot of memory
+func (zstdCodec) Levels() (int, int) {
+	return 1, 22
+}
+
+func (zstdCodec) NewReader(r io.Reader) (io.ReadCloser, error) {
+	return zstdReader{gozstd.NewReader(r)}, nil
+}
+
+func (zstdCodec) Magic() []byte {
+	return []byte{0x28, 0xb5, 0x2f, 0xfd}
+}
+
+type xzCodec struct{}
+
+func (xzCodec) NewWriter(w io.Writer) (io.WriteCloser, error) {
+	return xz.NewWriter(w)
+}
+
+// NewReader reads the header of the stream right away, so it fails on streams which are not xz
+func (xzCodec) NewReader(r io.Reader) (io.ReadCloser, error) {
+	reader, err := xz.NewReader(r)
+	if err != nil {
+		return nil, err
+	}
+
+	return ioutil.NopCloser(reader), nil
+}
+
+func (xzCodec) Magic() []byte {
+	return []byte{0xfd, '7', 'z', 'X', 'Z', 0x00}
+}
+
+type lz4Codec struct{}
+
+func (lz4Codec) NewWriter(w io.Writer) (io.WriteCloser, error) {
+	return lz4.NewWriter(w), nil
+}
+
+func (lz4Codec) NewReader(r io.Reader) (io.ReadCloser, error) {
+	return ioutil.NopCloser(lz4.NewReader(r)), nil
+}
+
+func (lz4Codec) Magic() []byte {
+	return []byte{0x04, 0x22, 0x4d, 0x18}
+}
@@ -2,21 +2,45 @@
 // Use of this source code is governed by a BSD-style
 // license that can be found in the LICENSE file.
 
-// Package compression defines the methods used to compress and decompress file streams.
+// Package compression defines the methods used to compress and decompress file streams. Every compression
+// strategy has a codec in a registry, the format of a stream can be detected from its first bytes.
 package compression
 
 import (
+	"bufio"
+	"bytes"
 	"io"
+	"sort"
 	"strings"
 
 	"github.com/baas-project/baas/pkg/model/images"
 
-	gzip "github.com/klauspost/pgzip"
 	"github.com/pkg/errors"
 	log "github.com/sirupsen/logrus"
-	"github.com/valyala/gozstd"
 )
 
+// Codec compresses and decompresses the streams of one compression strategy
+type Codec interface {
+	// NewWriter compresses everything written to it into w. Closing it finishes the stream, but does not close w.
+	NewWriter(w io.Writer) (io.WriteCloser, error)
+	// NewReader decompresses r. Closing it releases its resources, but does not close r.
+	NewReader(r io.Reader) (io.ReadCloser, error)
+	// Magic is how every stream of this codec starts, nil if its streams cannot be recognised
+	Magic() []byte
+}
+
+// LevelCodec is a codec whose compression level can be chosen, a higher level gives smaller streams
+type LevelCodec interface {
+	Codec
+	// NewLevelWriter is like NewWriter, but compresses at the given level
+	NewLevelWriter(w io.Writer, level int) (io.WriteCloser, error)
+	// Levels returns the lowest and the highest level which can be used
+	Levels() (int, int)
+}
+
+// codecs holds the registered codecs by strategy, they are only registered when the program starts
+var codecs = make(map[images.DiskCompressionStrategy]Codec)
+
 // browbeat forces the strategy to always conform to a lower case
 // version of the name. This is done since the JSON library can
 // flip to title case which breaks the program. Do not ask me
@@ -25,65 +49,146 @@ func browbeat(strategy images.DiskCompressionStrategy) images.DiskCompressionStr
 	return images.DiskCompressionStrategy(strings.ToLower(string(strategy)))
 }
 
-// Decompress is a decorator to decompress a disk image stream
-func Decompress(reader io.Reader, strategy images.DiskCompressionStrategy) (io.Reader, error) {
-	log.Infof("DiskUUID compression strategy: %v", strategy)
-	switch browbeat(strategy) {
-	case images.DiskCompressionStrategyNone:
-		return reader, nil
-	case images.DiskCompressionStrategyZSTD:
-		return gozstd.NewReader(reader), nil
-	default:
-		return nil, errors.New("unknown decompression strategy")
+// Register makes the codec available for the strategy, it replaces the codec which was registered before
+func Register(strategy images.DiskCompressionStrategy, codec Codec) {
+	codecs[browbeat(strategy)] = codec
+}
+
+// Lookup returns the codec of the strategy
+func Lookup(strategy images.DiskCompressionStrategy) (Codec, error) {
+	codec, ok := codecs[browbeat(strategy)]
+	if !ok {
+		return nil, errors.Errorf("unknown compression strategy %q", strategy)
+	}
+
+	return codec, nil
+}
+
+// Strategies returns the strategies which have a codec in alphabetical order
+func Strategies() []images.DiskCompressionStrategy {
+	strategies := make([]images.DiskCompressionStrategy, 0, len(codecs))
+	for strategy := range codecs {
+		strategies = append(strategies, strategy)
 	}
+
+	sort.Slice(strategies, func(i, j int) bool {
+		return strategies[i] < strategies[j]
+	})
+
+	return strategies
+}
+
+// CheckLevel returns an error if the strategy cannot compress at the level, level 0 is the default of every codec
+func CheckLevel(strategy images.DiskCompressionStrategy, level int) error {
+	codec, err := Lookup(strategy)
+	if err != nil || level == 0 {
+		return err
+	}
+
+	levels, ok := codec.(LevelCodec)
+	if !ok {
+		return errors.Errorf("compression strategy %q does not have levels", strategy)
+	}
+
+	if min, max := levels.Levels(); level < min || level > max {
+		return errors.Errorf("compression level of %q has to be between %d and %d", strategy, min, max)
+	}
+
+	return nil
 }
 
-// Compress is a decorator to compress a disk image stream
-func Compress(reader io.Reader, strategy images.DiskCompressionStrategy) (io.Reader, error) {
+// Decompress is a decorator to decompress a disk image stream, closing it does not close the reader
+func Decompress(reader io.Reader, strategy images.DiskCompressionStrategy) (io.ReadCloser, error) {
 	log.Infof("DiskUUID compression strategy: %v", strategy)
 
-	switch browbeat(strategy) {
-	case images.DiskCompressionStrategyNone:
-		return reader, nil
-	case images.DiskCompressionStrategyGZip:
-		pr, pw := io.Pipe()
-		log.Info("Compress the disk using gunzip")
-		go func() {
-			w := gzip.NewWriter(pw)
-			_, err := io.Copy(w, reader)
-			if err != nil {
-				log.Warn("Cannot compress data.")
-				return
-			}
-			err = w.Close()
-			if err != nil {
-				log.Warn("Cannot close gunzip header")
-				return
-			}
-			err = pw.Close()
-			if err != nil {
-				log.Warn("Close the writing pointer")
-				return
-			}
-		}()
-
-		return pr, nil
-	case images.DiskCompressionStrategyZSTD:
-		pr, pw := io.Pipe()
-		go func() {
-			err := gozstd.StreamCompress(pw, reader)
-			if err != nil {
-				log.Errorf("zstd compression failed")
-			}
-
-			err = pw.Close()
-			if err != nil {
-				log.Errorf("closing pipe failed")
-			}
-		}()
-
-		return pr, nil
-	default:
-		return nil, errors.New("unknown decompression strategy")
+	codec, err := Lookup(strategy)
+	if err != nil {
+		return nil, err
+	}
+
+	return codec.NewReader(reader)
+}
+
+// Compress is a decorator to compress a disk image stream. The data is compressed while it is read, closing
+// the stream before the end stops the compression. It does not close the reader.
+func Compress(reader io.Reader, strategy images.DiskCompressionStrategy) (io.ReadCloser, error) {
+	return CompressLevel(reader, strategy, 0)
+}
+
+// CompressLevel is like Compress, but compresses at the given level. Level 0 uses the default of the codec.
+func CompressLevel(reader io.Reader, strategy images.DiskCompressionStrategy, level int) (io.ReadCloser, error) {
+	log.Infof("DiskUUID compression strategy: %v (level %d)", strategy, level)
+
+	if err := CheckLevel(strategy, level); err != nil {
+		return nil, err
+	}
+
+	codec, _ := Lookup(strategy)
+	pr, pw := io.Pipe()
+
+	// The writer is created here as well, some codecs write their header right away which blocks until the
+	// stream is read
+	go func() {
+		var w io.WriteCloser
+		var err error
+		if level == 0 {
+			w, err = codec.NewWriter(pw)
+		} else {
+			w, err = codec.(LevelCodec).NewLevelWriter(pw, level)
+		}
+
+		if err != nil {
+			_ = pw.CloseWithError(err)
+			return
+		}
+
+		_, err = io.Copy(w, reader)
+		if closeErr := w.Close(); err == nil {
+			err = closeErr
+		}
+
+		// The reader sees the error, or the end of the stream when there is none
+		_ = pw.CloseWithError(err)
+	}()
+
+	return pr, nil
+}
+
+// Detect recognises the compression of the stream by its first bytes, streams which are not recognised are
+// taken to be uncompressed. The returned reader still yields the whole stream.
+func Detect(reader io.Reader) (images.DiskCompressionStrategy, io.Reader, error) {
+	longest := 0
+	for _, codec := range codecs {
+		if len(codec.Magic()) > longest {
+			longest = len(codec.Magic())
+		}
+	}
+
+	buffered := bufio.NewReader(reader)
+
+	// A stream shorter than the magic is still fine, it just cannot match
+	head, err := buffered.Peek(longest)
+	if err != nil && err != io.EOF && err != bufio.ErrBufferFull {
+		return "", nil, errors.Wrap(err, "read the start of the stream")
+	}
+
+	for _, strategy := range Strategies() {
+		magic := codecs[strategy].Magic()
+		if len(magic) > 0 && bytes.HasPrefix(head, magic) {
+			return strategy, buffered, nil
+		}
+	}
+
+	return images.DiskCompressionStrategyNone, buffered, nil
+}
+
+// DecompressDetected decompresses the stream in whichever format it turns out to be, which is returned as well
+func DecompressDetected(reader io.Reader) (io.ReadCloser, images.DiskCompressionStrategy, error) {
+	strategy, reader, err := Detect(reader)
+	if err != nil {
+		return nil, "", err
 	}
+
+	decompressed, err := Decompress(reader, strategy)
+	return decompressed, strategy, err
 }
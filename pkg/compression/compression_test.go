@@ -60,3 +60,90 @@ func TestCompressDecompressZSTD(t *testing.T) {
 
 	assert.Equal(t, b, res)
 }
+
+func TestCompressDecompressAll(t *testing.T) {
+	b := bytes.Repeat([]byte("Hello, world"), 1000)
+
+	for _, strategy := range Strategies() {
+		c, err := Compress(bytes.NewReader(b), strategy)
+		assert.NoError(t, err, strategy)
+
+		compressed, err := ioutil.ReadAll(c)
+		assert.NoError(t, err, strategy)
+		assert.NoError(t, c.Close(), strategy)
+
+		// The strategy is recognised from the compressed data
+		detected, r, err := Detect(bytes.NewReader(compressed))
+		assert.NoError(t, err, strategy)
+		assert.Equal(t, strategy, detected)
+
+		d, err := Decompress(r, detected)
+		assert.NoError(t, err, strategy)
+
+		res, err := ioutil.ReadAll(d)
+		assert.NoError(t, err, strategy)
+		assert.NoError(t, d.Close(), strategy)
+		assert.Equal(t, b, res, strategy)
+	}
+}
+
+func TestDetectUncompressed(t *testing.T) {
+	for _, data := range []string{"", "a", "Hello, world"} {
+		d, strategy, err := DecompressDetected(bytes.NewReader([]byte(data)))
+		assert.NoError(t, err)
+		assert.Equal(t, images.DiskCompressionStrategy(images.DiskCompressionStrategyNone), strategy)
+
+		res, err := ioutil.ReadAll(d)
+		assert.NoError(t, err)
+		assert.Equal(t, data, string(res))
+	}
+}
+
+func TestLookup(t *testing.T) {
+	for _, strategy := range []images.DiskCompressionStrategy{images.DiskCompressionStrategyNone,
+		images.DiskCompressionStrategyGZip, images.DiskCompressionStrategyZSTD, images.DiskCompressionStrategyXZ,
+		images.DiskCompressionStrategyLZ4, "ZSTD"} {
+		_, err := Lookup(strategy)
+		assert.NoError(t, err, strategy)
+	}
+
+	_, err := Lookup("bzip2")
+	assert.Error(t, err)
+
+	_, err = Decompress(bytes.NewReader(nil), "bzip2")
+	assert.Error(t, err)
+}
+
+func TestCompressLevel(t *testing.T) {
+	b := bytes.Repeat([]byte("Hello, world"), 1000)
+
+	for _, strategy := range []images.DiskCompressionStrategy{images.DiskCompressionStrategyGZip,
+		images.DiskCompressionStrategyZSTD} {
+		c, err := CompressLevel(bytes.NewReader(b), strategy, 9)
+		assert.NoError(t, err, strategy)
+
+		d, detected, err := DecompressDetected(c)
+		assert.NoError(t, err, strategy)
+		assert.Equal(t, strategy, detected)
+
+		res, err := ioutil.ReadAll(d)
+		assert.NoError(t, err, strategy)
+		assert.Equal(t, b, res, strategy)
+	}
+}
+
+func TestCheckLevel(t *testing.T) {
+	assert.NoError(t, CheckLevel(images.DiskCompressionStrategyXZ, 0))
+	assert.NoError(t, CheckLevel(images.DiskCompressionStrategyZSTD, 19))
+	assert.NoError(t, CheckLevel(images.DiskCompressionStrategyGZip, 1))
+
+	// Out of range, or a codec without levels
+	assert.Error(t, CheckLevel(images.DiskCompressionStrategyGZip, 10))
+	assert.Error(t, CheckLevel(images.DiskCompressionStrategyZSTD, 23))
+	assert.Error(t, CheckLevel(images.DiskCompressionStrategyXZ, 6))
+	assert.Error(t, CheckLevel(images.DiskCompressionStrategyNone, 1))
+	assert.Error(t, CheckLevel("bzip2", 0))
+
+	_, err := CompressLevel(bytes.NewReader(nil), images.DiskCompressionStrategyLZ4, 3)
+	assert.Error(t, err)
+}
@@ -2,7 +2,7 @@
 // Use of this source code is governed by a BSD-style
 // license that can be found in the LICENSE file.
 
-package sqlite
+package gormstore
 
 import (
 	"github.com/baas-project/baas/pkg/model/images"
@@ -15,18 +15,34 @@ func (s Store) AddBootSetupToMachine(bootSetup *images.BootSetup) error {
 
 // GetNextBootSetup fetches the first machine from the database.
 func (s Store) GetNextBootSetup(machineMAC string) (*images.BootSetup, error) {
+	bootSetup, err := s.PeekBootSetup(machineMAC)
+	if err != nil {
+		return nil, err
+	}
+
+	return bootSetup, s.DeleteBootSetup(bootSetup)
+}
+
+// PeekBootSetup fetches the oldest boot setup of the machine, which stays in the queue
+func (s Store) PeekBootSetup(machineMAC string) (*images.BootSetup, error) {
 	var bootSetup images.BootSetup
 
 	res := s.Table("boot_setups").
 		Where("machine_mac = ?", machineMAC).
+		Order("created_at").
 		First(&bootSetup)
 
 	if res.Error != nil {
 		return nil, res.Error
 	}
 
-	// ORMs are so dumb
-	s.Exec("DELETE FROM `boot_setups` WHERE `id` = ?", bootSetup.ID)
+	return &bootSetup, nil
+}
 
-	return &bootSetup, res.Error
+// DeleteBootSetup removes the boot setup from the queue of the machine
+func (s Store) DeleteBootSetup(bootSetup *images.BootSetup) error {
+	// The composite primary key means the ID is never filled in, so it cannot be used to delete the entry.
+	return s.Unscoped().
+		Where("machine_mac = ? AND setup_uuid = ?", bootSetup.MachineMAC, bootSetup.SetupUUID).
+		Delete(&images.BootSetup{}).Error
 }
@@ -0,0 +1,16 @@
+// Copyright (c) 2020-2022 TU Delft & Valentijn van de Beek <v.d.vandebeek@student.tudelft.nl> All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package gormstore implements the store with GORM queries which work on every SQL database BAAS supports.
+// The SQLite and PostgreSQL stores embed it, so it does not depend on any database driver itself.
+package gormstore
+
+import (
+	"gorm.io/gorm"
+)
+
+// Store is the database structure, the database it is opened on decides which SQL dialect is spoken
+type Store struct {
+	*gorm.DB
+}
@@ -0,0 +1,176 @@
+// Copyright (c) 2020-2022 TU Delft & Valentijn van de Beek <v.d.vandebeek@student.tudelft.nl> All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package gormstore
+
+import (
+	"github.com/baas-project/baas/pkg/model/images"
+	"gorm.io/gorm"
+)
+
+// versionAttempts is how often picking the next version number is tried, a request which picks the same number
+// at the same time makes the other one fail on the unique index of the versions
+const versionAttempts = 5
+
+// CreateImage creates the image entity in the database and adds the first version to it.
+func (s Store) CreateImage(image *images.ImageModel) {
+	image.Versions = append(image.Versions, images.Version{Version: 0, ImageModelUUID: image.UUID})
+	s.DB.Create(image)
+}
+
+// GetImageByUUID fetches the image with the versions using their UUID as a key
+func (s Store) GetImageByUUID(uuid images.ImageUUID) (*images.ImageModel, error) {
+	image := images.ImageModel{UUID: uuid}
+	err := s.Where("UUID = ?", uuid).
+		Preload("Versions").
+		First(&image).Error
+
+	if err == gorm.ErrRecordNotFound {
+		var machine *images.MachineImageModel
+		machine, err = s.GetMachineImageByUUID(uuid)
+		image = machine.ImageModel
+	}
+
+	return &image, err
+}
+
+// GetImagesByUsername fetches all the images associated to a user.
+func (s Store) GetImagesByUsername(username string) ([]images.ImageModel, error) {
+	var userImages []images.ImageModel
+
+	res := s.Table("image_models").
+		Preload("Versions").
+		Joins("join user_models on user_models.username = image_models.username").
+		Where("user_models.username = ?", username).
+		Find(&userImages)
+
+	return userImages, res.Error
+}
+
+// CreateNewImageVersion creates a new version in the database
+func (s Store) CreateNewImageVersion(version images.Version) {
+	s.Create(&version)
+}
+
+// CreateNextImageVersion stores the version which follows the latest version of the image
+func (s Store) CreateNextImageVersion(uuid images.ImageUUID) (*images.Version, error) {
+	var version images.Version
+	var err error
+
+	for attempt := 0; attempt < versionAttempts; attempt++ {
+		err = s.Transaction(func(tx *gorm.DB) error {
+			var latest uint64
+			err := tx.Model(&images.Version{}).
+				Unscoped().
+				Select("COALESCE(MAX(version), 0)").
+				Where("image_model_uuid = ?", uuid).
+				Scan(&latest).Error
+
+			if err != nil {
+				return err
+			}
+
+			version = images.Version{Version: latest + 1, ImageModelUUID: uuid}
+			return tx.Create(&version).Error
+		})
+
+		if err == nil {
+			return &version, nil
+		}
+	}
+
+	return nil, err
+}
+
+// GetVersionByID gets the version associated with a specific ID
+func (s Store) GetVersionByID(versionID uint64) (*images.Version, error) {
+	var version images.Version
+	err := s.Table("versions").Where("id = ?", versionID).First(&version).Error
+	return &version, err
+}
+
+// GetImagesByNameAndUsername gets all the images associated with a user which have the same human-readable name.
+// This theoretically possible, but it is unsure whether this actually holds in any real-world scenario.
+func (s Store) GetImagesByNameAndUsername(name string, username string) ([]images.ImageModel, error) {
+	var userImages []images.ImageModel
+	res := s.Table("image_models").
+		Preload("Versions").
+		Joins("join user_models on user_models.username = image_models.username").
+		Where("image_models.name = ?", name).
+		Find(&userImages)
+	return userImages, res.Error
+}
+
+// GetImages returns every image with its versions, ordered from old to new
+func (s Store) GetImages() ([]images.ImageModel, error) {
+	var allImages []images.ImageModel
+	res := s.Preload("Versions", func(db *gorm.DB) *gorm.DB {
+		return db.Order("versions.version")
+	}).Find(&allImages)
+	return allImages, res.Error
+}
+
+// DeleteVersion removes a version of an image together with its signatures
+func (s Store) DeleteVersion(version *images.Version) error {
+	return s.Transaction(func(tx *gorm.DB) error {
+		err := tx.Unscoped().Where("version_id = ?", version.ID).Delete(&images.VersionSignature{}).Error
+		if err != nil {
+			return err
+		}
+
+		return tx.Unscoped().Delete(version).Error
+	})
+}
+
+// GetPinnedVersions returns the ids of the versions which are part of an image setup
+func (s Store) GetPinnedVersions() (versions []uint64, _ error) {
+	res := s.Model(&images.ImageFrozen{}).Distinct().Pluck("version_id", &versions)
+	return versions, res.Error
+}
+
+// SetVersionDigest stores the digest, the size, the compression and the type of a version
+func (s Store) SetVersionDigest(version images.Version) error {
+	return s.Model(&images.Version{}).
+		Where("image_model_uuid = ? AND version = ?", version.ImageModelUUID, version.Version).
+		Updates(map[string]interface{}{
+			"digest":      version.Digest,
+			"size":        version.Size,
+			"compression": version.Compression,
+			"type":        version.Type,
+		}).Error
+}
+
+// SetImageRetention sets the retention policy of an image
+func (s Store) SetImageRetention(uuid images.ImageUUID, policy images.RetentionPolicy) error {
+	return s.Model(&images.ImageModel{}).
+		Where("uuid = ?", uuid).
+		Updates(map[string]interface{}{
+			"retention_keep_last": policy.KeepLast,
+			"retention_keep_days": policy.KeepDays,
+		}).Error
+}
+
+// SetImageCompression sets the compression strategy of an image
+func (s Store) SetImageCompression(uuid images.ImageUUID, strategy images.DiskCompressionStrategy) error {
+	return s.Model(&images.ImageModel{}).
+		Where("uuid = ?", uuid).
+		Update("disk_compression_strategy", strategy).Error
+}
+
+// SetImageFileType sets the type of disk image of an image
+func (s Store) SetImageFileType(uuid images.ImageUUID, diskType images.DiskType) error {
+	return s.Model(&images.ImageModel{}).
+		Where("uuid = ?", uuid).
+		Update("image_file_type", diskType).Error
+}
+
+// DeleteImage removes an image from the database
+func (s Store) DeleteImage(image *images.ImageModel) error {
+	return s.Unscoped().Delete(image).Error
+}
+
+// UpdateImage updates an image in the database
+func (s Store) UpdateImage(image *images.ImageModel) error {
+	return s.Updates(image).Error
+}
@@ -2,7 +2,7 @@
 // Use of this source code is governed by a BSD-style
 // license that can be found in the LICENSE file.
 
-package sqlite
+package gormstore
 
 import (
 	"github.com/baas-project/baas/pkg/model/images"
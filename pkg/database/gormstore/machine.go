@@ -0,0 +1,170 @@
+// Copyright (c) 2020-2022 TU Delft & Valentijn van de Beek <v.d.vandebeek@student.tudelft.nl> All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package gormstore
+
+import (
+	errors2 "errors"
+
+	"github.com/baas-project/baas/pkg/model/images"
+	"github.com/baas-project/baas/pkg/model/machine"
+
+	"github.com/baas-project/baas/pkg/util"
+	"github.com/pkg/errors"
+	"gorm.io/gorm"
+)
+
+// GetMachineByMac gets any machine with the associated MAC addresses from the database
+func (s Store) GetMachineByMac(mac util.MacAddress) (*machine.MachineModel, error) {
+	machineModel := machine.MachineModel{}
+	res := s.Table("machine_models").
+		Where("address = ?", mac.Address).
+		First(&machineModel)
+
+	return &machineModel, res.Error
+}
+
+// GetMachines returns the values in the machine_models database.
+// TODO: Fetch foreign relations.
+func (s Store) GetMachines() (machines []machine.MachineModel, _ error) {
+	res := s.Find(&machines)
+	return machines, res.Error
+}
+
+// UpdateMachine updates the information about the machine or creates a machine where one does not yet exist.
+func (s Store) UpdateMachine(machine *machine.MachineModel) error {
+	m, err := s.GetMachineByMac(machine.MacAddress)
+
+	if errors2.Is(err, gorm.ErrRecordNotFound) {
+		return s.Save(machine).Error
+	} else if err != nil {
+		return errors.Wrap(err, "get machine")
+	}
+
+	m.Architecture = machine.Architecture
+	m.Managed = machine.Managed
+	m.Name = machine.Name
+
+	s.Save(&m)
+	return nil
+}
+
+// CreateMachine creates the machine in the database
+func (s Store) CreateMachine(machine *machine.MachineModel) error {
+	return s.Create(machine).Error
+}
+
+// DeleteMachine removes a machine with its statuses, inventory and power controller from the database
+func (s Store) DeleteMachine(m *machine.MachineModel) error {
+	res := s.Unscoped().Where("machine_mac = ?", m.MacAddress.Address).Delete(&machine.StatusModel{})
+	if res.Error != nil {
+		return errors.Wrap(res.Error, "delete statuses")
+	}
+
+	res = s.Unscoped().Where("machine_mac = ?", m.MacAddress.Address).Delete(&machine.InventoryModel{})
+	if res.Error != nil {
+		return errors.Wrap(res.Error, "delete inventory")
+	}
+
+	if err := s.DeleteMachinePower(m.MacAddress.Address); err != nil {
+		return errors.Wrap(err, "delete power controller")
+	}
+
+	return s.Unscoped().Delete(m).Error
+}
+
+// SetMachineToken stores the hash of the credential issued to a machine
+func (s Store) SetMachineToken(mac util.MacAddress, tokenHash string) error {
+	return s.Model(&machine.MachineModel{}).
+		Where("address = ?", mac.Address).
+		Update("token_hash", tokenHash).Error
+}
+
+// SetMachineLabels replaces the labels of a machine
+func (s Store) SetMachineLabels(mac util.MacAddress, labels machine.Labels) error {
+	return s.Model(&machine.MachineModel{}).
+		Where("address = ?", mac.Address).
+		Update("labels", labels).Error
+}
+
+// SetMachineBootSetup records which image setup was handed to the machine
+func (s Store) SetMachineBootSetup(mac util.MacAddress, setup images.ImageUUID) error {
+	return s.Model(&machine.MachineModel{}).
+		Where("address = ?", mac.Address).
+		Update("current_setup_uuid", string(setup)).Error
+}
+
+// AddMachineStatus stores a status which the management OS of a machine reported
+func (s Store) AddMachineStatus(status *machine.StatusModel) error {
+	return s.Create(status).Error
+}
+
+// GetMachineStatuses returns the last statuses of a machine, oldest first. All of them are returned if limit is 0.
+func (s Store) GetMachineStatuses(mac string, limit int) (statuses []machine.StatusModel, _ error) {
+	query := s.Where("machine_mac = ?", mac).Order("id desc")
+	if limit > 0 {
+		query = query.Limit(limit)
+	}
+
+	if res := query.Find(&statuses); res.Error != nil {
+		return nil, res.Error
+	}
+
+	for i, j := 0, len(statuses)-1; i < j; i, j = i+1, j-1 {
+		statuses[i], statuses[j] = statuses[j], statuses[i]
+	}
+
+	return statuses, nil
+}
+
+// SetMachineInventory stores the hardware of a machine, replacing the inventory it had
+func (s Store) SetMachineInventory(inventory *machine.InventoryModel) error {
+	var stored machine.InventoryModel
+	res := s.Where("machine_mac = ?", inventory.MachineMAC).First(&stored)
+	if res.Error == nil {
+		inventory.Model = stored.Model
+	} else if res.Error != gorm.ErrRecordNotFound {
+		return errors.Wrap(res.Error, "get inventory")
+	}
+
+	return s.Save(inventory).Error
+}
+
+// GetMachineInventory returns the hardware of a machine
+func (s Store) GetMachineInventory(mac string) (*machine.InventoryModel, error) {
+	var inventory machine.InventoryModel
+	res := s.Where("machine_mac = ?", mac).First(&inventory)
+	return &inventory, res.Error
+}
+
+// GetMachineInventories returns the inventory of every machine which has one
+func (s Store) GetMachineInventories() (inventories []machine.InventoryModel, _ error) {
+	res := s.Order("id").Find(&inventories)
+	return inventories, res.Error
+}
+
+// SetMachinePower stores how the power of a machine is controlled, replacing what it had
+func (s Store) SetMachinePower(power *machine.PowerModel) error {
+	var stored machine.PowerModel
+	res := s.Where("machine_mac = ?", power.MachineMAC).First(&stored)
+	if res.Error == nil {
+		power.Model = stored.Model
+	} else if res.Error != gorm.ErrRecordNotFound {
+		return errors.Wrap(res.Error, "get power controller")
+	}
+
+	return s.Save(power).Error
+}
+
+// GetMachinePower returns how the power of a machine is controlled
+func (s Store) GetMachinePower(mac string) (*machine.PowerModel, error) {
+	var power machine.PowerModel
+	res := s.Where("machine_mac = ?", mac).First(&power)
+	return &power, res.Error
+}
+
+// DeleteMachinePower forgets how the power of a machine is controlled
+func (s Store) DeleteMachinePower(mac string) error {
+	return s.Unscoped().Where("machine_mac = ?", mac).Delete(&machine.PowerModel{}).Error
+}
@@ -0,0 +1,128 @@
+// Copyright (c) 2020-2022 TU Delft & Valentijn van de Beek <v.d.vandebeek@student.tudelft.nl> All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package gormstore
+
+import (
+	"time"
+
+	"github.com/baas-project/baas/pkg/database"
+	"github.com/baas-project/baas/pkg/model/images"
+	"github.com/baas-project/baas/pkg/model/reservation"
+	"gorm.io/gorm"
+)
+
+// blockingStatuses are the statuses of reservations which still claim their machine
+var blockingStatuses = []reservation.ReservationStatus{reservation.Scheduled, reservation.Active}
+
+// CreateReservation stores the reservation unless it overlaps with another reservation on the same machine.
+// The times are stored in UTC, SQLite compares them as text so they all need the same zone.
+func (s Store) CreateReservation(r *reservation.ReservationModel) error {
+	r.Start = r.Start.UTC()
+	r.End = r.End.UTC()
+
+	return s.Transaction(func(tx *gorm.DB) error {
+		var conflicts int64
+		err := tx.Model(&reservation.ReservationModel{}).
+			Where("machine_mac = ?", r.MachineMAC).
+			Where("status IN ?", blockingStatuses).
+			Where("start_time < ? AND end_time > ?", r.End, r.Start).
+			Count(&conflicts).Error
+
+		if err != nil {
+			return err
+		}
+
+		if conflicts > 0 {
+			return database.ErrReservationConflict
+		}
+
+		return tx.Create(r).Error
+	})
+}
+
+// GetReservationByUUID fetches a reservation using its UUID as key
+func (s Store) GetReservationByUUID(uuid string) (*reservation.ReservationModel, error) {
+	var r reservation.ReservationModel
+	res := s.Where("uuid = ?", uuid).First(&r)
+	return &r, res.Error
+}
+
+// GetReservations returns every reservation ordered by their start time
+func (s Store) GetReservations() (reservations []reservation.ReservationModel, _ error) {
+	res := s.Order("start_time").Find(&reservations)
+	return reservations, res.Error
+}
+
+// GetReservationsByUsername returns all the reservations made by a user
+func (s Store) GetReservationsByUsername(username string) (reservations []reservation.ReservationModel, _ error) {
+	res := s.Where("username = ?", username).Order("start_time").Find(&reservations)
+	return reservations, res.Error
+}
+
+// GetReservationsByMachine returns all the reservations made on a machine
+func (s Store) GetReservationsByMachine(mac string) (reservations []reservation.ReservationModel, _ error) {
+	res := s.Where("machine_mac = ?", mac).Order("start_time").Find(&reservations)
+	return reservations, res.Error
+}
+
+// UpdateReservation saves the changes made to a reservation, with its times in UTC
+func (s Store) UpdateReservation(r *reservation.ReservationModel) error {
+	r.Start = r.Start.UTC()
+	r.End = r.End.UTC()
+
+	return s.Save(r).Error
+}
+
+// AdvanceReservation changes the status of the reservation with a conditional update, so only one control
+// server acts on it, and changes the boot setups of its machine in the same transaction.
+func (s Store) AdvanceReservation(r *reservation.ReservationModel, status reservation.ReservationStatus,
+	setup *images.BootSetup, clear bool) (bool, error) {
+	advanced := false
+	err := s.Transaction(func(tx *gorm.DB) error {
+		res := tx.Model(&reservation.ReservationModel{}).
+			Where("id = ? AND status = ?", r.ID, r.Status).
+			Update("status", status)
+
+		if res.Error != nil || res.RowsAffected == 0 {
+			return res.Error
+		}
+
+		if clear {
+			err := tx.Unscoped().Where("machine_mac = ?", r.MachineMAC).Delete(&images.BootSetup{}).Error
+			if err != nil {
+				return err
+			}
+		}
+
+		if setup != nil {
+			if err := tx.Save(setup).Error; err != nil {
+				return err
+			}
+		}
+
+		advanced = true
+		return nil
+	})
+
+	if err != nil {
+		return false, err
+	}
+
+	if advanced {
+		r.Status = status
+	}
+
+	return advanced, nil
+}
+
+// GetDueReservations finds the reservations which should be started or ended at the given time.
+func (s Store) GetDueReservations(now time.Time) (reservations []reservation.ReservationModel, _ error) {
+	now = now.UTC()
+	res := s.Where("status = ? AND start_time <= ?", reservation.Scheduled, now).
+		Or("status = ? AND end_time <= ?", reservation.Active, now).
+		Order("start_time").
+		Find(&reservations)
+	return reservations, res.Error
+}
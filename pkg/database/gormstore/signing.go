@@ -0,0 +1,44 @@
+// Copyright (c) 2020-2022 TU Delft & Valentijn van de Beek <v.d.vandebeek@student.tudelft.nl> All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package gormstore
+
+import (
+	"github.com/baas-project/baas/pkg/model/images"
+	"github.com/baas-project/baas/pkg/model/user"
+)
+
+// CreateSigningKey stores a new signing key
+func (s Store) CreateSigningKey(key *user.SigningKeyModel) error {
+	return s.Create(key).Error
+}
+
+// GetSigningKey gets the signing key with the given UUID
+func (s Store) GetSigningKey(uuid string) (*user.SigningKeyModel, error) {
+	key := user.SigningKeyModel{}
+	res := s.Where("uuid = ?", uuid).First(&key)
+	return &key, res.Error
+}
+
+// GetSigningKeysByUsername gets all the signing keys of a user
+func (s Store) GetSigningKeysByUsername(username string) (keys []user.SigningKeyModel, _ error) {
+	res := s.Where("username = ?", username).Order("created_at").Find(&keys)
+	return keys, res.Error
+}
+
+// DeleteSigningKey removes a signing key
+func (s Store) DeleteSigningKey(key *user.SigningKeyModel) error {
+	return s.Unscoped().Delete(key).Error
+}
+
+// AddVersionSignature stores the signature of a version
+func (s Store) AddVersionSignature(signature *images.VersionSignature) error {
+	return s.Create(signature).Error
+}
+
+// GetVersionSignatures gets all the signatures of a version
+func (s Store) GetVersionSignatures(versionID uint) (signatures []images.VersionSignature, _ error) {
+	res := s.Where("version_id = ?", versionID).Order("created_at").Find(&signatures)
+	return signatures, res.Error
+}
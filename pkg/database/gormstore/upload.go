@@ -0,0 +1,30 @@
+// Copyright (c) 2020-2022 TU Delft & Valentijn van de Beek <v.d.vandebeek@student.tudelft.nl> All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package gormstore
+
+import "github.com/baas-project/baas/pkg/model/images"
+
+// CreateUpload stores a new upload
+func (s Store) CreateUpload(upload *images.UploadModel) error {
+	return s.Create(upload).Error
+}
+
+// GetUpload gets the upload with the given UUID
+func (s Store) GetUpload(uuid string) (*images.UploadModel, error) {
+	upload := images.UploadModel{}
+	res := s.Where("uuid = ?", uuid).First(&upload)
+	return &upload, res.Error
+}
+
+// GetUploads gets every upload which is still in progress
+func (s Store) GetUploads() (uploads []images.UploadModel, _ error) {
+	res := s.Order("created_at").Find(&uploads)
+	return uploads, res.Error
+}
+
+// DeleteUpload removes an upload once it is committed or aborted
+func (s Store) DeleteUpload(upload *images.UploadModel) error {
+	return s.Unscoped().Delete(upload).Error
+}
@@ -0,0 +1,86 @@
+// Copyright (c) 2020-2022 TU Delft & Valentijn van de Beek <v.d.vandebeek@student.tudelft.nl> All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package gormstore
+
+import (
+	"time"
+
+	"github.com/baas-project/baas/pkg/model/images"
+	"github.com/baas-project/baas/pkg/model/user"
+	"github.com/pkg/errors"
+)
+
+// GetUserByUsername gets the first user with the associated username from the database.
+func (s Store) GetUserByUsername(name string) (*user.UserModel, error) {
+	userModel := user.UserModel{}
+	res := s.Where("username = ?", name).First(&userModel)
+	return &userModel, res.Error
+}
+
+// GetUserByID gets the user with the specified id from the database.
+func (s Store) GetUserByID(id uint) (*user.UserModel, error) {
+	userModel := user.UserModel{}
+	res := s.Where("id = ?", id).First(&userModel)
+	return &userModel, errors.Wrap(res.Error, "find user by id")
+}
+
+// GetUsers gets all the users out of the database.
+func (s Store) GetUsers() (users []user.UserModel, _ error) {
+	res := s.Find(&users)
+	return users, res.Error
+}
+
+// CreateUser creates a new user
+func (s Store) CreateUser(user *user.UserModel) error {
+	return s.Save(user).Error
+}
+
+// RemoveUser deletes a user from the database
+func (s Store) RemoveUser(user *user.UserModel) error {
+	return s.Delete(user).Error
+}
+
+// ModifyUser modifies a user
+func (s Store) ModifyUser(user *user.UserModel) error {
+	return s.Updates(user).Error
+}
+
+// SetUserRetention sets the retention policy which applies to the images of the user without their own
+func (s Store) SetUserRetention(username string, policy images.RetentionPolicy) error {
+	return s.Model(&user.UserModel{}).
+		Where("username = ?", username).
+		Updates(map[string]interface{}{
+			"retention_keep_last": policy.KeepLast,
+			"retention_keep_days": policy.KeepDays,
+		}).Error
+}
+
+// CreateAccessToken stores a new personal access token
+func (s Store) CreateAccessToken(token *user.AccessTokenModel) error {
+	return s.Create(token).Error
+}
+
+// GetAccessTokensByUsername gets all the personal access tokens of a user
+func (s Store) GetAccessTokensByUsername(username string) (tokens []user.AccessTokenModel, _ error) {
+	res := s.Where("username = ?", username).Order("created_at").Find(&tokens)
+	return tokens, res.Error
+}
+
+// GetAccessTokenByHash gets the personal access token with the given hash
+func (s Store) GetAccessTokenByHash(hash string) (*user.AccessTokenModel, error) {
+	token := user.AccessTokenModel{}
+	res := s.Where("token_hash = ?", hash).First(&token)
+	return &token, res.Error
+}
+
+// DeleteAccessToken revokes a personal access token
+func (s Store) DeleteAccessToken(token *user.AccessTokenModel) error {
+	return s.Unscoped().Delete(token).Error
+}
+
+// TouchAccessToken updates the last time a personal access token was used
+func (s Store) TouchAccessToken(token *user.AccessTokenModel, now time.Time) error {
+	return s.Model(token).Update("last_used", now).Error
+}
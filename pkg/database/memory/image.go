@@ -0,0 +1,358 @@
+// Copyright (c) 2020-2022 TU Delft & Valentijn van de Beek <v.d.vandebeek@student.tudelft.nl> All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package memory
+
+import (
+	"sort"
+
+	"github.com/baas-project/baas/pkg/model/images"
+	"github.com/baas-project/baas/pkg/util"
+	"gorm.io/gorm"
+)
+
+// withVersions returns a copy of the image with its versions filled in, the caller has to hold the lock
+func (s *Store) withVersions(image images.ImageModel) images.ImageModel {
+	image.Versions = nil
+	for _, version := range s.versions {
+		if version.ImageModelUUID == image.UUID {
+			image.Versions = append(image.Versions, version)
+		}
+	}
+
+	return image
+}
+
+// addVersion stores a version of an image, the caller has to hold the lock
+func (s *Store) addVersion(version images.Version) {
+	version.Model = s.newModel()
+	s.versions = append(s.versions, version)
+}
+
+// filterImages returns the images matching the filter sorted by name, the caller has to hold the lock
+func (s *Store) filterImages(filter func(image images.ImageModel) bool) []images.ImageModel {
+	var found []images.ImageModel
+	for _, image := range s.images {
+		if filter(image) {
+			found = append(found, s.withVersions(image))
+		}
+	}
+
+	sort.Slice(found, func(i, j int) bool {
+		return found[i].Name < found[j].Name
+	})
+
+	return found
+}
+
+// CreateImage creates the image entity and adds the first version to it.
+func (s *Store) CreateImage(image *images.ImageModel) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	image.Versions = append(image.Versions, images.Version{Version: 0, ImageModelUUID: image.UUID})
+	for _, version := range image.Versions {
+		version.ImageModelUUID = image.UUID
+		s.addVersion(version)
+	}
+
+	s.images[image.UUID] = *image
+}
+
+// GetImageByUUID fetches the image with the versions using their UUID as a key
+func (s *Store) GetImageByUUID(uuid images.ImageUUID) (*images.ImageModel, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	if image, ok := s.images[uuid]; ok {
+		image = s.withVersions(image)
+		return &image, nil
+	}
+
+	// Machine images can be requested as normal images as well
+	if image, ok := s.machineImages[uuid]; ok {
+		found := s.withVersions(image.ImageModel)
+		return &found, nil
+	}
+
+	return &images.ImageModel{}, gorm.ErrRecordNotFound
+}
+
+// GetImagesByUsername fetches all the images associated to a user.
+func (s *Store) GetImagesByUsername(username string) ([]images.ImageModel, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	return s.filterImages(func(image images.ImageModel) bool {
+		return image.Username == username
+	}), nil
+}
+
+// GetImagesByNameAndUsername gets all the images associated with a user which have the same human-readable name.
+func (s *Store) GetImagesByNameAndUsername(name string, username string) ([]images.ImageModel, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	return s.filterImages(func(image images.ImageModel) bool {
+		return image.Name == name && image.Username == username
+	}), nil
+}
+
+// CreateNewImageVersion creates a new version in the database
+func (s *Store) CreateNewImageVersion(version images.Version) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.addVersion(version)
+}
+
+// CreateNextImageVersion stores the version which follows the latest version of the image
+func (s *Store) CreateNextImageVersion(uuid images.ImageUUID) (*images.Version, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	version := images.Version{Version: 1, ImageModelUUID: uuid}
+	for _, v := range s.versions {
+		if v.ImageModelUUID == uuid && v.Version >= version.Version {
+			version.Version = v.Version + 1
+		}
+	}
+
+	s.addVersion(version)
+	version = s.versions[len(s.versions)-1]
+	return &version, nil
+}
+
+// GetVersionByID gets the version associated with a specific ID
+func (s *Store) GetVersionByID(versionID uint64) (*images.Version, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	for _, version := range s.versions {
+		if uint64(version.ID) == versionID {
+			return &version, nil
+		}
+	}
+
+	return &images.Version{}, gorm.ErrRecordNotFound
+}
+
+// GetImages returns every image with its versions, ordered from old to new
+func (s *Store) GetImages() ([]images.ImageModel, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	return s.filterImages(func(image images.ImageModel) bool {
+		return true
+	}), nil
+}
+
+// DeleteVersion removes a version of an image together with its signatures
+func (s *Store) DeleteVersion(version *images.Version) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for i, v := range s.versions {
+		if v.ID == version.ID {
+			s.versions = append(s.versions[:i], s.versions[i+1:]...)
+			break
+		}
+	}
+
+	signatures := s.signatures[:0]
+	for _, signature := range s.signatures {
+		if signature.VersionID != version.ID {
+			signatures = append(signatures, signature)
+		}
+	}
+
+	s.signatures = signatures
+	return nil
+}
+
+// GetPinnedVersions returns the ids of the versions which are part of an image setup
+func (s *Store) GetPinnedVersions() ([]uint64, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	seen := make(map[uint64]bool)
+	var pinned []uint64
+	for _, setup := range s.setups {
+		for _, frozen := range setup.Images {
+			if !seen[frozen.VersionID] {
+				seen[frozen.VersionID] = true
+				pinned = append(pinned, frozen.VersionID)
+			}
+		}
+	}
+
+	return pinned, nil
+}
+
+// SetVersionDigest stores the digest, the size, the compression and the type of a version
+func (s *Store) SetVersionDigest(version images.Version) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for i, v := range s.versions {
+		if v.ImageModelUUID == version.ImageModelUUID && v.Version == version.Version {
+			s.versions[i].Digest = version.Digest
+			s.versions[i].Size = version.Size
+			s.versions[i].Compression = version.Compression
+			s.versions[i].Type = version.Type
+			return nil
+		}
+	}
+
+	return gorm.ErrRecordNotFound
+}
+
+// SetImageRetention sets the retention policy of an image
+func (s *Store) SetImageRetention(uuid images.ImageUUID, policy images.RetentionPolicy) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if image, ok := s.images[uuid]; ok {
+		image.Retention = policy
+		s.images[uuid] = image
+	}
+
+	return nil
+}
+
+// SetImageCompression sets the compression strategy of an image
+func (s *Store) SetImageCompression(uuid images.ImageUUID, strategy images.DiskCompressionStrategy) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if image, ok := s.images[uuid]; ok {
+		image.DiskCompressionStrategy = strategy
+		s.images[uuid] = image
+	}
+
+	return nil
+}
+
+// SetImageFileType sets the type of disk image of an image
+func (s *Store) SetImageFileType(uuid images.ImageUUID, diskType images.DiskType) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if image, ok := s.images[uuid]; ok {
+		image.ImageFileType = diskType
+		s.images[uuid] = image
+	}
+
+	return nil
+}
+
+// DeleteImage removes an image from the database
+func (s *Store) DeleteImage(image *images.ImageModel) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	delete(s.images, image.UUID)
+	delete(s.machineImages, image.UUID)
+
+	// The versions and the references from image setups are removed with the image
+	versions := s.versions[:0]
+	for _, version := range s.versions {
+		if version.ImageModelUUID != image.UUID {
+			versions = append(versions, version)
+		}
+	}
+
+	s.versions = versions
+
+	for uuid, setup := range s.setups {
+		setup.Images = removeFrozen(setup.Images, image.UUID)
+		s.setups[uuid] = setup
+	}
+
+	return nil
+}
+
+// UpdateImage only changes the fields which are set, like the GORM Updates of the other stores
+func (s *Store) UpdateImage(image *images.ImageModel) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	stored, ok := s.images[image.UUID]
+	if !ok {
+		return nil
+	}
+
+	if image.Name != "" {
+		stored.Name = image.Name
+	}
+
+	if image.Username != "" {
+		stored.Username = image.Username
+	}
+
+	if image.DiskCompressionStrategy != "" {
+		stored.DiskCompressionStrategy = image.DiskCompressionStrategy
+	}
+
+	if image.ImageFileType != 0 {
+		stored.ImageFileType = image.ImageFileType
+	}
+
+	if image.Type != "" {
+		stored.Type = image.Type
+	}
+
+	if image.Checksum != "" {
+		stored.Checksum = image.Checksum
+	}
+
+	if image.Filesystem != "" {
+		stored.Filesystem = image.Filesystem
+	}
+
+	s.images[image.UUID] = stored
+	return nil
+}
+
+// CreateMachineImage creates the machine image entity with its versions
+func (s *Store) CreateMachineImage(image *images.MachineImageModel) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, version := range image.Versions {
+		version.ImageModelUUID = image.UUID
+		s.addVersion(version)
+	}
+
+	s.machineImages[image.UUID] = *image
+}
+
+// GetMachineImageByMac fetches the image with the versions using mac address of their machine as a key
+func (s *Store) GetMachineImageByMac(mac util.MacAddress) (*images.MachineImageModel, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	for _, image := range s.machineImages {
+		if image.MachineMAC == mac.Address {
+			image.ImageModel = s.withVersions(image.ImageModel)
+			return &image, nil
+		}
+	}
+
+	return &images.MachineImageModel{}, gorm.ErrRecordNotFound
+}
+
+// GetMachineImageByUUID gets the machine image associated with a UUID
+func (s *Store) GetMachineImageByUUID(uuid images.ImageUUID) (*images.MachineImageModel, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	image, ok := s.machineImages[uuid]
+	if !ok {
+		return &images.MachineImageModel{}, gorm.ErrRecordNotFound
+	}
+
+	image.ImageModel = s.withVersions(image.ImageModel)
+	return &image, nil
+}
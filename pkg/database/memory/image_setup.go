@@ -0,0 +1,181 @@
+// Copyright (c) 2020-2022 TU Delft & Valentijn van de Beek <v.d.vandebeek@student.tudelft.nl> All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package memory
+
+import (
+	"sort"
+
+	"github.com/baas-project/baas/pkg/model/images"
+	"github.com/pkg/errors"
+	"gorm.io/gorm"
+)
+
+// removeFrozen returns a copy of the frozen images without those of the given image
+func removeFrozen(frozen []images.ImageFrozen, uuid images.ImageUUID) []images.ImageFrozen {
+	var kept []images.ImageFrozen
+	for _, image := range frozen {
+		if image.UUIDImage != uuid {
+			kept = append(kept, image)
+		}
+	}
+
+	return kept
+}
+
+// withImages returns a copy of the setup with the current metadata of its images, the caller has to hold the lock
+func (s *Store) withImages(setup images.ImageSetup) images.ImageSetup {
+	frozen := make([]images.ImageFrozen, 0, len(setup.Images))
+	for _, image := range setup.Images {
+		if stored, ok := s.images[image.UUIDImage]; ok {
+			image.Image = stored
+		}
+
+		frozen = append(frozen, image)
+	}
+
+	setup.Images = frozen
+	return setup
+}
+
+// setupsOf returns the image setups of the user sorted by name, the caller has to hold the lock
+func (s *Store) setupsOf(username string) *[]images.ImageSetup {
+	setups := []images.ImageSetup{}
+	for _, setup := range s.setups {
+		if setup.Username == username {
+			setups = append(setups, s.withImages(setup))
+		}
+	}
+
+	sort.Slice(setups, func(i, j int) bool {
+		return setups[i].Name < setups[j].Name
+	})
+
+	return &setups
+}
+
+// CreateImageSetup creates a collection of images in history.
+func (s *Store) CreateImageSetup(username string, setup *images.ImageSetup) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.users[username]; !ok {
+		return errors.Wrap(gorm.ErrRecordNotFound, "get user by name")
+	}
+
+	if _, ok := s.setups[setup.UUID]; ok {
+		return errors.Errorf("image setup %s already exists", setup.UUID)
+	}
+
+	if setup.SignaturePolicy == "" {
+		setup.SignaturePolicy = images.SignaturePolicyNone
+	}
+
+	setup.Model = s.newModel()
+	s.setups[setup.UUID] = *setup
+	return nil
+}
+
+// AddImageToImageSetup adds an image pegged to a particular version to the setup.
+func (s *Store) AddImageToImageSetup(setup *images.ImageSetup, image *images.ImageModel, version images.Version,
+	update bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	setup.AddImage(image, version, update)
+
+	frozen := &setup.Images[len(setup.Images)-1]
+	frozen.Model = s.newModel()
+	frozen.UUIDImage = image.UUID
+	frozen.VersionID = uint64(version.ID)
+	frozen.ImageSetupUUID = setup.UUID
+
+	stored, ok := s.setups[setup.UUID]
+	if !ok {
+		return
+	}
+
+	stored.Images = append(append([]images.ImageFrozen{}, stored.Images...), *frozen)
+	s.setups[setup.UUID] = stored
+}
+
+// FindImageSetupsByUsername finds all ImageSetups associated with a particular user.
+func (s *Store) FindImageSetupsByUsername(username string) (*[]images.ImageSetup, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	return s.setupsOf(username), nil
+}
+
+// GetImageSetup gets an image setup associated with a particular UUID.
+func (s *Store) GetImageSetup(uuid string) (images.ImageSetup, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	setup, ok := s.setups[images.ImageUUID(uuid)]
+	if !ok {
+		return images.ImageSetup{}, gorm.ErrRecordNotFound
+	}
+
+	return s.withImages(setup), nil
+}
+
+// GetImageSetups finds the image setups associated with a user
+func (s *Store) GetImageSetups(username string) (*[]images.ImageSetup, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	return s.setupsOf(username), nil
+}
+
+// DeleteImageSetup deletes an image setup
+func (s *Store) DeleteImageSetup(setup *images.ImageSetup) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	delete(s.setups, setup.UUID)
+	return nil
+}
+
+// ModifyImageSetup only changes the fields which are set, like the GORM Updates of the other stores
+func (s *Store) ModifyImageSetup(setup *images.ImageSetup) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	stored, ok := s.setups[setup.UUID]
+	if !ok {
+		return nil
+	}
+
+	if setup.Name != "" {
+		stored.Name = setup.Name
+	}
+
+	if setup.Username != "" {
+		stored.Username = setup.Username
+	}
+
+	if setup.SignaturePolicy != "" {
+		stored.SignaturePolicy = setup.SignaturePolicy
+	}
+
+	s.setups[setup.UUID] = stored
+	return nil
+}
+
+// RemoveImageFromImageSetup removes a particular image from the image setup
+func (s *Store) RemoveImageFromImageSetup(setup *images.ImageSetup, image *images.ImageModel, _ images.Version,
+	_ bool) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	stored, ok := s.setups[setup.UUID]
+	if !ok {
+		return gorm.ErrRecordNotFound
+	}
+
+	stored.Images = removeFrozen(stored.Images, image.UUID)
+	s.setups[setup.UUID] = stored
+	return nil
+}
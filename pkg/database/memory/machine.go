@@ -0,0 +1,325 @@
+// Copyright (c) 2020-2022 TU Delft & Valentijn van de Beek <v.d.vandebeek@student.tudelft.nl> All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package memory
+
+import (
+	"sort"
+	"time"
+
+	"github.com/baas-project/baas/pkg/model/images"
+	"github.com/baas-project/baas/pkg/model/machine"
+	"github.com/baas-project/baas/pkg/util"
+	"github.com/pkg/errors"
+	"gorm.io/gorm"
+)
+
+// GetMachineByMac gets any machine with the associated MAC addresses from the database
+func (s *Store) GetMachineByMac(mac util.MacAddress) (*machine.MachineModel, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	m, ok := s.machines[mac.Address]
+	if !ok {
+		return &machine.MachineModel{}, gorm.ErrRecordNotFound
+	}
+
+	m.Labels = m.Labels.Copy()
+	return &m, nil
+}
+
+// GetMachines returns all the machines
+func (s *Store) GetMachines() ([]machine.MachineModel, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	machines := make([]machine.MachineModel, 0, len(s.machines))
+	for _, m := range s.machines {
+		m.Labels = m.Labels.Copy()
+		machines = append(machines, m)
+	}
+
+	return machines, nil
+}
+
+// UpdateMachine updates the information about the machine or creates a machine where one does not yet exist.
+func (s *Store) UpdateMachine(m *machine.MachineModel) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	stored, ok := s.machines[m.MacAddress.Address]
+	if !ok {
+		stored = *m
+		stored.Labels = m.Labels.Copy()
+		s.machines[m.MacAddress.Address] = stored
+		return nil
+	}
+
+	stored.Architecture = m.Architecture
+	stored.Managed = m.Managed
+	stored.Name = m.Name
+	s.machines[m.MacAddress.Address] = stored
+
+	return nil
+}
+
+// CreateMachine creates the machine in the database
+func (s *Store) CreateMachine(m *machine.MachineModel) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.machines[m.MacAddress.Address]; ok {
+		return errors.Errorf("machine %s already exists", m.MacAddress.Address)
+	}
+
+	stored := *m
+	stored.Labels = m.Labels.Copy()
+	s.machines[m.MacAddress.Address] = stored
+	return nil
+}
+
+// DeleteMachine removes a machine with its statuses, inventory and power controller from the database
+func (s *Store) DeleteMachine(m *machine.MachineModel) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	delete(s.machines, m.MacAddress.Address)
+
+	// The machine image and boot setups belong to the machine
+	for uuid, image := range s.machineImages {
+		if image.MachineMAC == m.MacAddress.Address {
+			delete(s.machineImages, uuid)
+		}
+	}
+
+	bootSetups := s.bootSetups[:0]
+	for _, setup := range s.bootSetups {
+		if setup.MachineMAC != m.MacAddress.Address {
+			bootSetups = append(bootSetups, setup)
+		}
+	}
+
+	s.bootSetups = bootSetups
+
+	statuses := s.statuses[:0]
+	for _, status := range s.statuses {
+		if status.MachineMAC != m.MacAddress.Address {
+			statuses = append(statuses, status)
+		}
+	}
+
+	s.statuses = statuses
+	delete(s.inventories, m.MacAddress.Address)
+	delete(s.powers, m.MacAddress.Address)
+	return nil
+}
+
+// SetMachineToken stores the hash of the credential issued to a machine
+func (s *Store) SetMachineToken(mac util.MacAddress, tokenHash string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if m, ok := s.machines[mac.Address]; ok {
+		m.TokenHash = tokenHash
+		s.machines[mac.Address] = m
+	}
+
+	return nil
+}
+
+// SetMachineLabels replaces the labels of a machine
+func (s *Store) SetMachineLabels(mac util.MacAddress, labels machine.Labels) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if m, ok := s.machines[mac.Address]; ok {
+		m.Labels = labels.Copy()
+		s.machines[mac.Address] = m
+	}
+
+	return nil
+}
+
+// SetMachineBootSetup records which image setup was handed to the machine
+func (s *Store) SetMachineBootSetup(mac util.MacAddress, setup images.ImageUUID) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if m, ok := s.machines[mac.Address]; ok {
+		m.CurrentSetupUUID = string(setup)
+		s.machines[mac.Address] = m
+	}
+
+	return nil
+}
+
+// AddMachineStatus stores a status which the management OS of a machine reported
+func (s *Store) AddMachineStatus(status *machine.StatusModel) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	status.Model = s.newModel()
+	s.statuses = append(s.statuses, *status)
+	return nil
+}
+
+// GetMachineStatuses returns the last statuses of a machine, oldest first. All of them are returned if limit is 0.
+func (s *Store) GetMachineStatuses(mac string, limit int) ([]machine.StatusModel, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	var statuses []machine.StatusModel
+	for _, status := range s.statuses {
+		if status.MachineMAC == mac {
+			statuses = append(statuses, status)
+		}
+	}
+
+	if limit > 0 && len(statuses) > limit {
+		statuses = statuses[len(statuses)-limit:]
+	}
+
+	return statuses, nil
+}
+
+// SetMachineInventory stores the hardware of a machine, replacing the inventory it had
+func (s *Store) SetMachineInventory(inventory *machine.InventoryModel) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if stored, ok := s.inventories[inventory.MachineMAC]; ok {
+		inventory.Model = stored.Model
+		inventory.UpdatedAt = time.Now()
+	} else {
+		inventory.Model = s.newModel()
+	}
+
+	s.inventories[inventory.MachineMAC] = copyInventory(*inventory)
+	return nil
+}
+
+// GetMachineInventory returns the hardware of a machine
+func (s *Store) GetMachineInventory(mac string) (*machine.InventoryModel, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	inventory, ok := s.inventories[mac]
+	if !ok {
+		return &machine.InventoryModel{}, gorm.ErrRecordNotFound
+	}
+
+	inventory = copyInventory(inventory)
+	return &inventory, nil
+}
+
+// GetMachineInventories returns the inventory of every machine which has one
+func (s *Store) GetMachineInventories() ([]machine.InventoryModel, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	inventories := make([]machine.InventoryModel, 0, len(s.inventories))
+	for _, inventory := range s.inventories {
+		inventories = append(inventories, copyInventory(inventory))
+	}
+
+	sort.Slice(inventories, func(i, j int) bool { return inventories[i].ID < inventories[j].ID })
+	return inventories, nil
+}
+
+// SetMachinePower stores how the power of a machine is controlled, replacing what it had
+func (s *Store) SetMachinePower(power *machine.PowerModel) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if stored, ok := s.powers[power.MachineMAC]; ok {
+		power.Model = stored.Model
+		power.UpdatedAt = time.Now()
+	} else {
+		power.Model = s.newModel()
+	}
+
+	s.powers[power.MachineMAC] = *power
+	return nil
+}
+
+// GetMachinePower returns how the power of a machine is controlled
+func (s *Store) GetMachinePower(mac string) (*machine.PowerModel, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	power, ok := s.powers[mac]
+	if !ok {
+		return &machine.PowerModel{}, gorm.ErrRecordNotFound
+	}
+
+	return &power, nil
+}
+
+// DeleteMachinePower forgets how the power of a machine is controlled
+func (s *Store) DeleteMachinePower(mac string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	delete(s.powers, mac)
+	return nil
+}
+
+// copyInventory copies the disks and network interfaces, so the stored inventory does not share them
+func copyInventory(inventory machine.InventoryModel) machine.InventoryModel {
+	inventory.Disks = append(machine.Disks(nil), inventory.Disks...)
+	inventory.NICs = append(machine.NICs(nil), inventory.NICs...)
+	return inventory
+}
+
+// AddBootSetupToMachine adds a configuration for booting to the specified machine
+func (s *Store) AddBootSetupToMachine(bootSetup *images.BootSetup) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	bootSetup.Model = s.newModel()
+	s.bootSetups = append(s.bootSetups, *bootSetup)
+	return nil
+}
+
+// GetNextBootSetup takes the oldest boot setup of the machine off its queue
+func (s *Store) GetNextBootSetup(machineMAC string) (*images.BootSetup, error) {
+	setup, err := s.PeekBootSetup(machineMAC)
+	if err != nil {
+		return nil, err
+	}
+
+	return setup, s.DeleteBootSetup(setup)
+}
+
+// PeekBootSetup fetches the oldest boot setup of the machine, which stays in the queue
+func (s *Store) PeekBootSetup(machineMAC string) (*images.BootSetup, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	// The boot setups are appended in order of creation, so the first match is the oldest
+	for _, setup := range s.bootSetups {
+		if setup.MachineMAC == machineMAC {
+			return &setup, nil
+		}
+	}
+
+	return nil, gorm.ErrRecordNotFound
+}
+
+// DeleteBootSetup removes the boot setup from the queue of the machine
+func (s *Store) DeleteBootSetup(bootSetup *images.BootSetup) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	// Like the SQL stores, every entry of the setup in the queue of the machine goes
+	kept := s.bootSetups[:0]
+	for _, setup := range s.bootSetups {
+		if setup.MachineMAC != bootSetup.MachineMAC || setup.SetupUUID != bootSetup.SetupUUID {
+			kept = append(kept, setup)
+		}
+	}
+
+	s.bootSetups = kept
+	return nil
+}
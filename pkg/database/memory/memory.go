@@ -0,0 +1,67 @@
+// Copyright (c) 2020-2022 TU Delft & Valentijn van de Beek <v.d.vandebeek@student.tudelft.nl> All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package memory defines an implementation for the store which keeps everything in memory.
+// Nothing survives a restart, so it is meant for tests and demonstrations.
+package memory
+
+import (
+	"sync"
+	"time"
+
+	"github.com/baas-project/baas/pkg/database"
+	"github.com/baas-project/baas/pkg/model/images"
+	"github.com/baas-project/baas/pkg/model/machine"
+	"github.com/baas-project/baas/pkg/model/reservation"
+	"github.com/baas-project/baas/pkg/model/user"
+	"gorm.io/gorm"
+)
+
+// Store is the database structure. The models are copied whenever they go in or out,
+// so callers can never change the stored values without going through the store.
+type Store struct {
+	mu     sync.RWMutex
+	nextID uint
+
+	machines      map[string]machine.MachineModel
+	machineImages map[images.ImageUUID]images.MachineImageModel
+	bootSetups    []images.BootSetup
+	statuses      []machine.StatusModel
+	inventories   map[string]machine.InventoryModel
+	powers        map[string]machine.PowerModel
+
+	users  map[string]user.UserModel
+	tokens []user.AccessTokenModel
+	keys   []user.SigningKeyModel
+
+	images   map[images.ImageUUID]images.ImageModel
+	versions []images.Version
+	setups   map[images.ImageUUID]images.ImageSetup
+	uploads  []images.UploadModel
+
+	signatures []images.VersionSignature
+
+	reservations []reservation.ReservationModel
+}
+
+// NewStore creates an empty store
+func NewStore() database.Store {
+	return &Store{
+		machines:      make(map[string]machine.MachineModel),
+		machineImages: make(map[images.ImageUUID]images.MachineImageModel),
+		inventories:   make(map[string]machine.InventoryModel),
+		powers:        make(map[string]machine.PowerModel),
+		users:         make(map[string]user.UserModel),
+		images:        make(map[images.ImageUUID]images.ImageModel),
+		setups:        make(map[images.ImageUUID]images.ImageSetup),
+	}
+}
+
+// newModel fills in the fields GORM would set when the row is created, the caller has to hold the lock
+func (s *Store) newModel() gorm.Model {
+	s.nextID++
+	now := time.Now()
+
+	return gorm.Model{ID: s.nextID, CreatedAt: now, UpdatedAt: now}
+}
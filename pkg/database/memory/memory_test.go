@@ -0,0 +1,44 @@
+// Copyright (c) 2020-2022 TU Delft & Valentijn van de Beek <v.d.vandebeek@student.tudelft.nl> All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package memory
+
+import (
+	"sync"
+	"testing"
+
+	"github.com/baas-project/baas/pkg/database"
+	"github.com/baas-project/baas/pkg/database/storetest"
+	"github.com/baas-project/baas/pkg/model/user"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestStore(t *testing.T) {
+	storetest.Run(t, func(t *testing.T) database.Store {
+		return NewStore()
+	})
+}
+
+func TestStore_Concurrent(t *testing.T) {
+	store := NewStore()
+
+	var wg sync.WaitGroup
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+
+			name := string(rune('a' + i%26))
+			_ = store.CreateUser(&user.UserModel{Username: name, Role: user.User})
+			_, _ = store.GetUsers()
+			_, _ = store.GetUserByUsername(name)
+		}(i)
+	}
+
+	wg.Wait()
+
+	users, err := store.GetUsers()
+	assert.NoError(t, err)
+	assert.Len(t, users, 26)
+}
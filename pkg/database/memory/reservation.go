@@ -0,0 +1,164 @@
+// Copyright (c) 2020-2022 TU Delft & Valentijn van de Beek <v.d.vandebeek@student.tudelft.nl> All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package memory
+
+import (
+	"sort"
+	"time"
+
+	"github.com/baas-project/baas/pkg/database"
+	"github.com/baas-project/baas/pkg/model/images"
+	"github.com/baas-project/baas/pkg/model/reservation"
+	"gorm.io/gorm"
+)
+
+// filterReservations returns the matching reservations ordered by their start, the caller has to hold the lock
+func (s *Store) filterReservations(filter func(r reservation.ReservationModel) bool) []reservation.ReservationModel {
+	var found []reservation.ReservationModel
+	for _, r := range s.reservations {
+		if filter(r) {
+			found = append(found, r)
+		}
+	}
+
+	sort.SliceStable(found, func(i, j int) bool {
+		return found[i].Start.Before(found[j].Start)
+	})
+
+	return found
+}
+
+// CreateReservation stores the reservation unless it overlaps with another reservation on the same machine.
+func (s *Store) CreateReservation(r *reservation.ReservationModel) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, other := range s.reservations {
+		if other.MachineMAC == r.MachineMAC && other.Blocking() && other.Overlaps(r.Start, r.End) {
+			return database.ErrReservationConflict
+		}
+	}
+
+	r.Model = s.newModel()
+	s.reservations = append(s.reservations, *r)
+	return nil
+}
+
+// GetReservationByUUID fetches a reservation using its UUID as key
+func (s *Store) GetReservationByUUID(uuid string) (*reservation.ReservationModel, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	for _, r := range s.reservations {
+		if r.UUID == uuid {
+			return &r, nil
+		}
+	}
+
+	return &reservation.ReservationModel{}, gorm.ErrRecordNotFound
+}
+
+// GetReservations returns every reservation ordered by their start time
+func (s *Store) GetReservations() ([]reservation.ReservationModel, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	return s.filterReservations(func(r reservation.ReservationModel) bool {
+		return true
+	}), nil
+}
+
+// GetReservationsByUsername returns all the reservations made by a user
+func (s *Store) GetReservationsByUsername(username string) ([]reservation.ReservationModel, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	return s.filterReservations(func(r reservation.ReservationModel) bool {
+		return r.Username == username
+	}), nil
+}
+
+// GetReservationsByMachine returns all the reservations made on a machine
+func (s *Store) GetReservationsByMachine(mac string) ([]reservation.ReservationModel, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	return s.filterReservations(func(r reservation.ReservationModel) bool {
+		return r.MachineMAC == mac
+	}), nil
+}
+
+// UpdateReservation saves the changes made to a reservation
+func (s *Store) UpdateReservation(r *reservation.ReservationModel) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for i := range s.reservations {
+		if s.reservations[i].ID == r.ID {
+			r.UpdatedAt = time.Now()
+			s.reservations[i] = *r
+			return nil
+		}
+	}
+
+	// Saving a reservation which does not exist yet creates it, like GORM does
+	r.Model = s.newModel()
+	s.reservations = append(s.reservations, *r)
+	return nil
+}
+
+// AdvanceReservation changes the status of the reservation if it still has the one it was read with, and the
+// boot setups of its machine while holding the same lock
+func (s *Store) AdvanceReservation(r *reservation.ReservationModel, status reservation.ReservationStatus,
+	setup *images.BootSetup, clear bool) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for i := range s.reservations {
+		stored := &s.reservations[i]
+		if stored.ID != r.ID {
+			continue
+		}
+
+		if stored.Status != r.Status {
+			return false, nil
+		}
+
+		stored.Status = status
+		stored.UpdatedAt = time.Now()
+		r.Status = status
+
+		if clear {
+			kept := s.bootSetups[:0]
+			for _, queued := range s.bootSetups {
+				if queued.MachineMAC != r.MachineMAC {
+					kept = append(kept, queued)
+				}
+			}
+
+			s.bootSetups = kept
+		}
+
+		if setup != nil {
+			setup.Model = s.newModel()
+			s.bootSetups = append(s.bootSetups, *setup)
+		}
+
+		return true, nil
+	}
+
+	return false, nil
+}
+
+// GetDueReservations finds the reservations which should be started or ended at the given time.
+func (s *Store) GetDueReservations(now time.Time) ([]reservation.ReservationModel, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	return s.filterReservations(func(r reservation.ReservationModel) bool {
+		return (r.Status == reservation.Scheduled && !r.Start.After(now)) ||
+			(r.Status == reservation.Active && !r.End.After(now))
+	}), nil
+}
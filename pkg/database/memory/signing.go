@@ -0,0 +1,97 @@
+// Copyright (c) 2020-2022 TU Delft & Valentijn van de Beek <v.d.vandebeek@student.tudelft.nl> All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package memory
+
+import (
+	"github.com/baas-project/baas/pkg/model/images"
+	"github.com/baas-project/baas/pkg/model/user"
+	"github.com/pkg/errors"
+	"gorm.io/gorm"
+)
+
+// CreateSigningKey stores a new signing key
+func (s *Store) CreateSigningKey(key *user.SigningKeyModel) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, k := range s.keys {
+		if k.UUID == key.UUID {
+			return errors.New("signing key already exists")
+		}
+	}
+
+	key.Model = s.newModel()
+	s.keys = append(s.keys, *key)
+	return nil
+}
+
+// GetSigningKey gets the signing key with the given UUID
+func (s *Store) GetSigningKey(uuid string) (*user.SigningKeyModel, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	for _, key := range s.keys {
+		if key.UUID == uuid {
+			return &key, nil
+		}
+	}
+
+	return &user.SigningKeyModel{}, gorm.ErrRecordNotFound
+}
+
+// GetSigningKeysByUsername gets all the signing keys of a user
+func (s *Store) GetSigningKeysByUsername(username string) ([]user.SigningKeyModel, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	var keys []user.SigningKeyModel
+	for _, key := range s.keys {
+		if key.Username == username {
+			keys = append(keys, key)
+		}
+	}
+
+	return keys, nil
+}
+
+// DeleteSigningKey removes a signing key
+func (s *Store) DeleteSigningKey(key *user.SigningKeyModel) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for i, k := range s.keys {
+		if k.ID == key.ID {
+			s.keys = append(s.keys[:i], s.keys[i+1:]...)
+			break
+		}
+	}
+
+	return nil
+}
+
+// AddVersionSignature stores the signature of a version
+func (s *Store) AddVersionSignature(signature *images.VersionSignature) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	signature.Model = s.newModel()
+	s.signatures = append(s.signatures, *signature)
+	return nil
+}
+
+// GetVersionSignatures gets all the signatures of a version
+func (s *Store) GetVersionSignatures(versionID uint) ([]images.VersionSignature, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	var signatures []images.VersionSignature
+	for _, signature := range s.signatures {
+		if signature.VersionID == versionID {
+			signatures = append(signatures, signature)
+		}
+	}
+
+	return signatures, nil
+}
@@ -0,0 +1,64 @@
+// Copyright (c) 2020-2022 TU Delft & Valentijn van de Beek <v.d.vandebeek@student.tudelft.nl> All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package memory
+
+import (
+	"github.com/baas-project/baas/pkg/model/images"
+	"github.com/pkg/errors"
+	"gorm.io/gorm"
+)
+
+// CreateUpload stores a new upload
+func (s *Store) CreateUpload(upload *images.UploadModel) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, u := range s.uploads {
+		if u.UUID == upload.UUID {
+			return errors.New("upload already exists")
+		}
+	}
+
+	upload.Model = s.newModel()
+	s.uploads = append(s.uploads, *upload)
+	return nil
+}
+
+// GetUpload gets the upload with the given UUID
+func (s *Store) GetUpload(uuid string) (*images.UploadModel, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	for _, upload := range s.uploads {
+		if upload.UUID == uuid {
+			return &upload, nil
+		}
+	}
+
+	return &images.UploadModel{}, gorm.ErrRecordNotFound
+}
+
+// GetUploads gets every upload which is still in progress
+func (s *Store) GetUploads() ([]images.UploadModel, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	return append([]images.UploadModel(nil), s.uploads...), nil
+}
+
+// DeleteUpload removes an upload once it is committed or aborted
+func (s *Store) DeleteUpload(upload *images.UploadModel) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for i, u := range s.uploads {
+		if u.ID == upload.ID {
+			s.uploads = append(s.uploads[:i], s.uploads[i+1:]...)
+			break
+		}
+	}
+
+	return nil
+}
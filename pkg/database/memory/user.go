@@ -0,0 +1,197 @@
+// Copyright (c) 2020-2022 TU Delft & Valentijn van de Beek <v.d.vandebeek@student.tudelft.nl> All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package memory
+
+import (
+	"sort"
+	"time"
+
+	"github.com/baas-project/baas/pkg/model/images"
+	"github.com/baas-project/baas/pkg/model/user"
+	"github.com/pkg/errors"
+	"gorm.io/gorm"
+)
+
+// GetUserByUsername gets the first user with the associated username from the database.
+func (s *Store) GetUserByUsername(name string) (*user.UserModel, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	u, ok := s.users[name]
+	if !ok {
+		return &user.UserModel{}, gorm.ErrRecordNotFound
+	}
+
+	return &u, nil
+}
+
+// GetUserByID cannot find anything, users are identified by their username and have no id
+func (s *Store) GetUserByID(id uint) (*user.UserModel, error) {
+	return &user.UserModel{}, errors.Wrap(gorm.ErrRecordNotFound, "find user by id")
+}
+
+// GetUsers gets all the users out of the database.
+func (s *Store) GetUsers() ([]user.UserModel, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	users := make([]user.UserModel, 0, len(s.users))
+	for _, u := range s.users {
+		users = append(users, u)
+	}
+
+	sort.Slice(users, func(i, j int) bool {
+		return users[i].Username < users[j].Username
+	})
+
+	return users, nil
+}
+
+// CreateUser creates a new user
+func (s *Store) CreateUser(u *user.UserModel) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	stored := *u
+	stored.Images = nil
+	stored.Setups = nil
+	stored.Tokens = nil
+	s.users[u.Username] = stored
+
+	return nil
+}
+
+// RemoveUser deletes a user from the database
+func (s *Store) RemoveUser(u *user.UserModel) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	delete(s.users, u.Username)
+
+	tokens := s.tokens[:0]
+	for _, token := range s.tokens {
+		if token.Username != u.Username {
+			tokens = append(tokens, token)
+		}
+	}
+
+	s.tokens = tokens
+	return nil
+}
+
+// ModifyUser only changes the fields which are set, like the GORM Updates of the other stores
+func (s *Store) ModifyUser(u *user.UserModel) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	stored, ok := s.users[u.Username]
+	if !ok {
+		return nil
+	}
+
+	if u.Name != "" {
+		stored.Name = u.Name
+	}
+
+	if u.Email != "" {
+		stored.Email = u.Email
+	}
+
+	if u.Role != "" {
+		stored.Role = u.Role
+	}
+
+	s.users[u.Username] = stored
+	return nil
+}
+
+// SetUserRetention sets the retention policy which applies to the images of the user without their own
+func (s *Store) SetUserRetention(username string, policy images.RetentionPolicy) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if u, ok := s.users[username]; ok {
+		u.Retention = policy
+		s.users[username] = u
+	}
+
+	return nil
+}
+
+// CreateAccessToken stores a new personal access token
+func (s *Store) CreateAccessToken(token *user.AccessTokenModel) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, t := range s.tokens {
+		if t.UUID == token.UUID || t.TokenHash == token.TokenHash {
+			return errors.New("access token already exists")
+		}
+	}
+
+	token.Model = s.newModel()
+	s.tokens = append(s.tokens, *token)
+	return nil
+}
+
+// GetAccessTokensByUsername gets all the personal access tokens of a user
+func (s *Store) GetAccessTokensByUsername(username string) ([]user.AccessTokenModel, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	var tokens []user.AccessTokenModel
+	for _, token := range s.tokens {
+		if token.Username == username {
+			tokens = append(tokens, token)
+		}
+	}
+
+	return tokens, nil
+}
+
+// GetAccessTokenByHash gets the personal access token with the given hash
+func (s *Store) GetAccessTokenByHash(hash string) (*user.AccessTokenModel, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	for _, token := range s.tokens {
+		if token.TokenHash == hash {
+			return &token, nil
+		}
+	}
+
+	return &user.AccessTokenModel{}, gorm.ErrRecordNotFound
+}
+
+// DeleteAccessToken revokes a personal access token
+func (s *Store) DeleteAccessToken(token *user.AccessTokenModel) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for i, t := range s.tokens {
+		if t.ID == token.ID {
+			s.tokens = append(s.tokens[:i], s.tokens[i+1:]...)
+			break
+		}
+	}
+
+	return nil
+}
+
+// TouchAccessToken updates the last time a personal access token was used
+func (s *Store) TouchAccessToken(token *user.AccessTokenModel, now time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for i := range s.tokens {
+		if s.tokens[i].ID == token.ID {
+			used := now
+			s.tokens[i].LastUsed = &used
+		}
+	}
+
+	token.LastUsed = &now
+	return nil
+}
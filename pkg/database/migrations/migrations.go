@@ -0,0 +1,178 @@
+// Copyright (c) 2020-2022 TU Delft & Valentijn van de Beek <v.d.vandebeek@student.tudelft.nl> All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package migrations keeps track of the version of the database schema and moves it between versions.
+// Every change to the models which are stored in the database needs a new migration in schema.go,
+// the applied migrations are recorded in the schema_version table.
+package migrations
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+	"gorm.io/gorm"
+)
+
+// ErrSchemaTooNew is returned when the database was migrated by a newer version of BAAS than this one
+var ErrSchemaTooNew = errors.New("the database schema is newer than this version of BAAS")
+
+// LatestTarget is the target of Up which applies every migration this binary has
+const LatestTarget = -1
+
+// Migration moves the schema from the previous version to Version and back.
+type Migration struct {
+	Version     int
+	Description string
+
+	// Up applies the migration and Down reverts it, both run inside a transaction.
+	Up   func(tx *gorm.DB) error
+	Down func(tx *gorm.DB) error
+}
+
+// SchemaVersion records a migration which has been applied to the database.
+type SchemaVersion struct {
+	Version     int `gorm:"primaryKey;autoIncrement:false"`
+	Description string
+	AppliedAt   time.Time
+}
+
+// TableName overrides the table name GORM would derive from the struct
+func (SchemaVersion) TableName() string {
+	return "schema_version"
+}
+
+// Latest returns the version of the schema which this binary expects
+func Latest() int {
+	return all[len(all)-1].Version
+}
+
+// Current returns the version of the schema in the database, 0 if no migration has been applied
+func Current(db *gorm.DB) (int, error) {
+	if err := db.AutoMigrate(&SchemaVersion{}); err != nil {
+		return 0, errors.Wrap(err, "create schema_version table")
+	}
+
+	var versions []SchemaVersion
+	if err := db.Order("version desc").Limit(1).Find(&versions).Error; err != nil {
+		return 0, errors.Wrap(err, "get schema version")
+	}
+
+	if len(versions) == 0 {
+		return 0, nil
+	}
+
+	return versions[0].Version, nil
+}
+
+// Status lists every migration known to this binary and whether it has been applied to the database
+func Status(db *gorm.DB) ([]string, error) {
+	current, err := Current(db)
+	if err != nil {
+		return nil, err
+	}
+
+	lines := make([]string, 0, len(all))
+	for _, m := range all {
+		state := "pending"
+		if m.Version <= current {
+			state = "applied"
+		}
+
+		lines = append(lines, fmt.Sprintf("%4d  %-8s %s", m.Version, state, m.Description))
+	}
+
+	return lines, nil
+}
+
+// Check refuses databases which were migrated by a newer version of BAAS
+func Check(db *gorm.DB) error {
+	current, err := Current(db)
+	if err != nil {
+		return err
+	}
+
+	if current > Latest() {
+		return errors.Wrapf(ErrSchemaTooNew, "database is at version %d, this binary supports up to %d", current, Latest())
+	}
+
+	return nil
+}
+
+// Up applies all migrations up to and including the target version, or all of them for LatestTarget
+func Up(db *gorm.DB, target int) error {
+	if err := Check(db); err != nil {
+		return err
+	}
+
+	if target == LatestTarget {
+		target = Latest()
+	}
+
+	if target < 0 || target > Latest() {
+		return errors.Errorf("cannot migrate to version %d, the versions go up to %d", target, Latest())
+	}
+
+	current, err := Current(db)
+	if err != nil {
+		return err
+	}
+
+	for _, m := range all {
+		if m.Version <= current || m.Version > target {
+			continue
+		}
+
+		m := m
+		log.Infof("Applying database migration %d: %s", m.Version, m.Description)
+		err = db.Transaction(func(tx *gorm.DB) error {
+			if err := m.Up(tx); err != nil {
+				return err
+			}
+
+			return tx.Create(&SchemaVersion{Version: m.Version, Description: m.Description, AppliedAt: time.Now()}).Error
+		})
+
+		if err != nil {
+			return errors.Wrapf(err, "migration %d", m.Version)
+		}
+	}
+
+	return nil
+}
+
+// Down reverts all migrations after the target version, a target of 0 removes the entire schema
+func Down(db *gorm.DB, target int) error {
+	if err := Check(db); err != nil {
+		return err
+	}
+
+	current, err := Current(db)
+	if err != nil {
+		return err
+	}
+
+	for i := len(all) - 1; i >= 0; i-- {
+		m := all[i]
+		if m.Version > current || m.Version <= target {
+			continue
+		}
+
+		log.Infof("Reverting database migration %d: %s", m.Version, m.Description)
+		err = db.Transaction(func(tx *gorm.DB) error {
+			if err := m.Down(tx); err != nil {
+				return err
+			}
+
+			return tx.Delete(&SchemaVersion{}, m.Version).Error
+		})
+
+		if err != nil {
+			return errors.Wrapf(err, "revert migration %d", m.Version)
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,267 @@
+// Copyright (c) 2020-2022 TU Delft & Valentijn van de Beek <v.d.vandebeek@student.tudelft.nl> All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package migrations
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/baas-project/baas/pkg/model/images"
+	"github.com/baas-project/baas/pkg/model/machine"
+	"github.com/baas-project/baas/pkg/model/reservation"
+	"github.com/baas-project/baas/pkg/model/user"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+	"gorm.io/driver/sqlite"
+	"gorm.io/gorm"
+)
+
+func openTestDB(t *testing.T) *gorm.DB {
+	db, err := gorm.Open(sqlite.Open(filepath.Join(t.TempDir(), "store.db")), &gorm.Config{})
+	assert.NoError(t, err)
+
+	return db
+}
+
+func TestMigrations_UpDown(t *testing.T) {
+	db := openTestDB(t)
+
+	current, err := Current(db)
+	assert.NoError(t, err)
+	assert.Equal(t, 0, current)
+
+	err = Up(db, LatestTarget)
+	assert.NoError(t, err)
+
+	current, err = Current(db)
+	assert.NoError(t, err)
+	assert.Equal(t, Latest(), current)
+	assert.True(t, db.Migrator().HasTable(&machine.MachineModel{}))
+
+	// Applying the migrations again does nothing
+	err = Up(db, LatestTarget)
+	assert.NoError(t, err)
+
+	lines, err := Status(db)
+	assert.NoError(t, err)
+	assert.Len(t, lines, len(all))
+	assert.Contains(t, lines[0], "applied")
+
+	err = Down(db, 0)
+	assert.NoError(t, err)
+
+	current, err = Current(db)
+	assert.NoError(t, err)
+	assert.Equal(t, 0, current)
+	assert.False(t, db.Migrator().HasTable(&machine.MachineModel{}))
+}
+
+// preMigrationMachine is the table of the machines as it was before the migrations existed, without credentials
+type preMigrationMachine struct {
+	Name         string `gorm:"unique"`
+	Architecture string
+	Managed      bool
+	MacAddress   macAddressV1 `gorm:"embedded;unique;primaryKey"`
+	ImageUUID    string
+}
+
+func (preMigrationMachine) TableName() string {
+	return "machine_models"
+}
+
+// createPreMigrationDatabase creates the tables of a database from before the migrations, which has no version
+func createPreMigrationDatabase(t *testing.T, db *gorm.DB) {
+	err := db.Migrator().CreateTable(&preMigrationMachine{})
+	assert.NoError(t, err)
+
+	err = initialSchema(db)
+	assert.NoError(t, err)
+}
+
+// liveModels are all models which are stored in the database
+var liveModels = []interface{}{
+	&machine.MachineModel{},
+	&machine.StatusModel{},
+	&machine.InventoryModel{},
+	&machine.PowerModel{},
+	&images.ImageModel{},
+	&images.MachineImageModel{},
+	&images.Version{},
+	&images.VersionSignature{},
+	&images.ImageFrozen{},
+	&images.ImageSetup{},
+	&images.BootSetup{},
+	&images.UploadModel{},
+	&reservation.ReservationModel{},
+	&user.UserModel{},
+	&user.AccessTokenModel{},
+	&user.SigningKeyModel{},
+}
+
+// assertSchemaMatchesModels checks that the tables have exactly the columns of the models, a model which changed
+// without a migration fails here
+func assertSchemaMatchesModels(t *testing.T, db *gorm.DB) {
+	for _, model := range liveModels {
+		stmt := &gorm.Statement{DB: db}
+		assert.NoError(t, stmt.Parse(model))
+
+		var expected []string
+		for _, field := range stmt.Schema.Fields {
+			if field.DBName != "" {
+				expected = append(expected, field.DBName)
+			}
+		}
+
+		columns, err := db.Migrator().ColumnTypes(model)
+		assert.NoError(t, err)
+
+		var actual []string
+		for _, c := range columns {
+			actual = append(actual, c.Name())
+		}
+
+		assert.ElementsMatch(t, expected, actual, "columns of %s", stmt.Schema.Table)
+	}
+}
+
+func TestMigrations_ExistingDatabase(t *testing.T) {
+	db := openTestDB(t)
+
+	// Databases created before the migrations existed have the tables but no version
+	createPreMigrationDatabase(t, db)
+
+	err := db.Create(&preMigrationMachine{MacAddress: macAddressV1{Address: "abc"}, Name: "kept"}).Error
+	assert.NoError(t, err)
+
+	err = Up(db, LatestTarget)
+	assert.NoError(t, err)
+
+	var m machine.MachineModel
+	err = db.Where("address = ?", "abc").First(&m).Error
+	assert.NoError(t, err)
+	assert.Equal(t, "kept", m.Name)
+
+	// The credentials of the machines were added just before the migrations, migration 12 adds them
+	assert.True(t, db.Migrator().HasColumn(&machine.MachineModel{}, "token_hash"))
+	assert.True(t, db.Migrator().HasColumn(&machine.MachineModel{}, "current_setup_uuid"))
+
+	err = db.Model(&m).Update("token_hash", "hash").Error
+	assert.NoError(t, err)
+
+	assertSchemaMatchesModels(t, db)
+}
+
+func TestMigrations_MatchModels(t *testing.T) {
+	db := openTestDB(t)
+
+	err := Up(db, LatestTarget)
+	assert.NoError(t, err)
+	assertSchemaMatchesModels(t, db)
+
+	// Reverting a migration and applying it again gives the same schema
+	err = Down(db, 1)
+	assert.NoError(t, err)
+
+	err = Up(db, LatestTarget)
+	assert.NoError(t, err)
+	assertSchemaMatchesModels(t, db)
+}
+
+func TestMigrations_Target(t *testing.T) {
+	db := openTestDB(t)
+
+	// Version 0 is the empty schema, so nothing is applied
+	err := Up(db, 0)
+	assert.NoError(t, err)
+
+	current, err := Current(db)
+	assert.NoError(t, err)
+	assert.Equal(t, 0, current)
+
+	for _, target := range []int{-2, Latest() + 1, 99} {
+		err = Up(db, target)
+		assert.Error(t, err, target)
+	}
+
+	current, err = Current(db)
+	assert.NoError(t, err)
+	assert.Equal(t, 0, current)
+}
+
+func TestMigrations_TooNew(t *testing.T) {
+	db := openTestDB(t)
+
+	err := Up(db, LatestTarget)
+	assert.NoError(t, err)
+
+	err = db.Create(&SchemaVersion{Version: Latest() + 1, Description: "from the future", AppliedAt: time.Now()}).Error
+	assert.NoError(t, err)
+
+	err = Check(db)
+	assert.Equal(t, ErrSchemaTooNew, errors.Cause(err))
+
+	err = Up(db, LatestTarget)
+	assert.Equal(t, ErrSchemaTooNew, errors.Cause(err))
+
+	err = Down(db, 0)
+	assert.Equal(t, ErrSchemaTooNew, errors.Cause(err))
+}
+
+func TestMigrations_Retention(t *testing.T) {
+	db := openTestDB(t)
+
+	err := Up(db, LatestTarget)
+	assert.NoError(t, err)
+
+	err = Down(db, 1)
+	assert.NoError(t, err)
+	assert.False(t, db.Migrator().HasColumn(&images.ImageModel{}, "retention_keep_last"))
+	assert.True(t, db.Migrator().HasTable(&images.ImageModel{}))
+
+	err = Up(db, 2)
+	assert.NoError(t, err)
+	assert.True(t, db.Migrator().HasColumn(&images.ImageModel{}, "retention_keep_last"))
+	assert.True(t, db.Migrator().HasColumn(&user.UserModel{}, "retention_keep_days"))
+}
+
+func TestMigrations_UniqueVersions(t *testing.T) {
+	db := openTestDB(t)
+
+	err := Up(db, 12)
+	assert.NoError(t, err)
+
+	// Two uploads at the same time gave both versions the same number
+	first := versionV1{Version: 1, ImageModelUUID: "fedora"}
+	assert.NoError(t, db.Create(&first).Error)
+
+	second := versionV1{Version: 1, ImageModelUUID: "fedora"}
+	assert.NoError(t, db.Create(&second).Error)
+
+	frozen := imageFrozenV1{UUIDImage: "fedora", VersionID: uint64(first.ID)}
+	assert.NoError(t, db.Omit("Image", "Version").Create(&frozen).Error)
+
+	err = Up(db, LatestTarget)
+	assert.NoError(t, err)
+
+	var versions []versionV1
+	assert.NoError(t, db.Find(&versions).Error)
+	assert.Len(t, versions, 1)
+	assert.Equal(t, second.ID, versions[0].ID)
+
+	assert.NoError(t, db.First(&frozen, frozen.ID).Error)
+	assert.Equal(t, uint64(second.ID), frozen.VersionID)
+
+	assert.True(t, db.Migrator().HasIndex(&images.Version{}, versionIndex))
+	assert.Error(t, db.Create(&versionV1{Version: 1, ImageModelUUID: "fedora"}).Error)
+
+	err = Down(db, 13)
+	assert.NoError(t, err)
+	assert.True(t, db.Migrator().HasIndex(&images.Version{}, versionIndex))
+
+	err = Down(db, 12)
+	assert.NoError(t, err)
+	assert.False(t, db.Migrator().HasIndex(&images.Version{}, versionIndex))
+}
@@ -0,0 +1,346 @@
+// Copyright (c) 2020-2022 TU Delft & Valentijn van de Beek <v.d.vandebeek@student.tudelft.nl> All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package migrations
+
+import (
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// The migrations create tables and columns from the copies of the models below rather than from the models
+// themselves, so a migration keeps doing what it did when it was released when the models change later on.
+// Every copy is named after the migration which introduced it and is never changed afterwards.
+
+// Version 1: the initial schema
+
+type macAddressV1 struct {
+	Address string `gorm:"not null;unique;primaryKey;"`
+}
+
+type machineV1 struct {
+	Name             string `gorm:"unique"`
+	Architecture     string
+	Managed          bool
+	MacAddress       macAddressV1 `gorm:"embedded;unique;primaryKey"`
+	ImageUUID        string
+	CurrentSetupUUID string
+	TokenHash        string
+}
+
+func (machineV1) TableName() string {
+	return "machine_models"
+}
+
+type versionV1 struct {
+	gorm.Model
+	Version        uint64 `gorm:"not null;default:0"`
+	ImageModelUUID string `gorm:"not null;"`
+}
+
+func (versionV1) TableName() string {
+	return "versions"
+}
+
+type imageV1 struct {
+	Name                    string      `gorm:"not null"`
+	Versions                []versionV1 `gorm:"foreignKey:ImageModelUUID;not null;references:UUID;constraint:OnDelete:CASCADE,OnUpdate:CASCADE;"`
+	UUID                    string      `gorm:"uniqueIndex;primaryKey;unique"`
+	Username                string      `gorm:"foreignKey:Username;constraint:OnDelete:CASCADE,OnUpdate:CASCADE"`
+	DiskCompressionStrategy string      `gorm:"not null;"`
+	ImageFileType           int         `gorm:"not null;"`
+	Type                    string      `gorm:"not null;"`
+	Checksum                string
+	ImagePath               string `gorm:"not null"`
+	Filesystem              string
+}
+
+func (imageV1) TableName() string {
+	return "image_models"
+}
+
+// machineImageV1 has the fields of imageV1, which are written out because an embedded struct with a table name
+// of its own is not flattened
+type machineImageV1 struct {
+	Name                    string      `gorm:"not null"`
+	Versions                []versionV1 `gorm:"foreignKey:ImageModelUUID;not null;references:UUID;constraint:OnDelete:CASCADE,OnUpdate:CASCADE;"`
+	UUID                    string      `gorm:"uniqueIndex;primaryKey;unique"`
+	Username                string      `gorm:"foreignKey:Username;constraint:OnDelete:CASCADE,OnUpdate:CASCADE"`
+	DiskCompressionStrategy string      `gorm:"not null;"`
+	ImageFileType           int         `gorm:"not null;"`
+	Type                    string      `gorm:"not null;"`
+	Checksum                string
+	ImagePath               string `gorm:"not null"`
+	Filesystem              string
+
+	Machine    machineV1 `gorm:"foreignKey:MachineMAC;references:Address;not null;constraint:OnDelete:CASCADE,OnUpdate:CASCADE;"`
+	MachineMAC string    `gorm:"not null;primaryKey"`
+	Size       uint
+}
+
+func (machineImageV1) TableName() string {
+	return "machine_image_models"
+}
+
+type imageFrozenV1 struct {
+	gorm.Model
+	Image          imageV1   `gorm:"foreignKey:UUIDImage;references:UUID;constraint:OnDelete:CASCADE,OnUpdate:CASCADE;"`
+	UUIDImage      string    `gorm:"not null;"`
+	Version        versionV1 `gorm:"foreignKey:VersionID;references:ID;constraint:OnDelete:CASCADE,OnUpdate:CASCADE;"`
+	VersionID      uint64    `gorm:"not null"`
+	ImageSetupUUID string
+	Update         bool `gorm:"not null;default:false"`
+}
+
+func (imageFrozenV1) TableName() string {
+	return "image_frozens"
+}
+
+type imageSetupV1 struct {
+	gorm.Model
+	Name     string          `gorm:"not null"`
+	Images   []imageFrozenV1 `gorm:"foreignKey:ImageSetupUUID;references:UUID;constraint:OnDelete:CASCADE,OnUpdate:CASCADE;"`
+	Username string          `gorm:"foreignKey:Username;not null;"`
+	UUID     string          `gorm:"uniqueIndex;primaryKey;unique;not null;"`
+}
+
+func (imageSetupV1) TableName() string {
+	return "image_setups"
+}
+
+type bootSetupV1 struct {
+	gorm.Model
+	Machine    machineV1    `gorm:"foreignKey:MachineMAC;references:Address;not null;constraint:OnDelete:CASCADE,OnUpdate:CASCADE;"`
+	MachineMAC string       `gorm:"not null;primaryKey"`
+	Setup      imageSetupV1 `gorm:"foreignKey:SetupUUID;references:UUID;constraint:OnUpdate:CASCADE,OnDelete:CASCADE;"`
+	SetupUUID  string       `gorm:"not null;primaryKey"`
+	Update     bool         `gorm:"not null;"`
+}
+
+func (bootSetupV1) TableName() string {
+	return "boot_setups"
+}
+
+type reservationV1 struct {
+	gorm.Model
+	UUID       string    `gorm:"uniqueIndex;not null"`
+	Username   string    `gorm:"not null;index"`
+	MachineMAC string    `gorm:"not null;index"`
+	SetupUUID  string    `gorm:"not null"`
+	Update     bool      `gorm:"not null;default:false"`
+	Start      time.Time `gorm:"column:start_time;not null;index"`
+	End        time.Time `gorm:"column:end_time;not null;index"`
+	Status     string    `gorm:"not null;index"`
+}
+
+func (reservationV1) TableName() string {
+	return "reservation_models"
+}
+
+type accessTokenV1 struct {
+	gorm.Model
+	UUID      string `gorm:"uniqueIndex;not null"`
+	Username  string `gorm:"not null;index"`
+	Name      string
+	Role      string    `gorm:"not null"`
+	TokenHash string    `gorm:"uniqueIndex;not null"`
+	ExpiresAt time.Time `gorm:"not null"`
+	LastUsed  *time.Time
+}
+
+func (accessTokenV1) TableName() string {
+	return "access_token_models"
+}
+
+type userV1 struct {
+	Username string          `gorm:"unique;not null;primaryKey"`
+	Name     string          `gorm:"not null"`
+	Email    string          `gorm:"unique;not null"`
+	Role     string          `gorm:"not null;"`
+	Images   []imageV1       `gorm:"foreignKey:Username;constraint:OnUpdate:CASCADE,OnDelete:CASCADE"`
+	Setups   []imageSetupV1  `gorm:"foreignKey:Username;constraint:OnUpdate:CASCADE,OnDelete:CASCADE"`
+	Tokens   []accessTokenV1 `gorm:"foreignKey:Username;constraint:OnUpdate:CASCADE,OnDelete:CASCADE"`
+}
+
+func (userV1) TableName() string {
+	return "user_models"
+}
+
+// Version 2: retention policies, added to image_models, machine_image_models and user_models
+
+type retentionPolicyV2 struct {
+	KeepLast uint `gorm:"not null;default:0"`
+	KeepDays uint `gorm:"not null;default:0"`
+}
+
+type retentionV2 struct {
+	Retention retentionPolicyV2 `gorm:"embedded;embeddedPrefix:retention_"`
+}
+
+// Version 3: resumable uploads
+
+type uploadV3 struct {
+	gorm.Model
+	UUID           string `gorm:"uniqueIndex;not null"`
+	ImageModelUUID string `gorm:"not null"`
+	NewVersion     bool   `gorm:"not null;default:false"`
+	Size           int64  `gorm:"not null;default:0"`
+	Digest         string
+}
+
+func (uploadV3) TableName() string {
+	return "upload_models"
+}
+
+// Version 4: digests, added to versions
+
+type digestV4 struct {
+	Digest string
+	Size   int64
+}
+
+// Version 5: signed versions, the policy is added to image_setups
+
+type signingKeyV5 struct {
+	gorm.Model
+	UUID       string `gorm:"uniqueIndex;not null"`
+	Username   string `gorm:"not null;index"`
+	Name       string
+	PublicKey  []byte `gorm:"not null"`
+	PrivateKey []byte
+	Managed    bool
+}
+
+func (signingKeyV5) TableName() string {
+	return "signing_key_models"
+}
+
+type versionSignatureV5 struct {
+	gorm.Model
+	VersionID uint   `gorm:"not null;index"`
+	KeyUUID   string `gorm:"not null"`
+	Signature []byte `gorm:"not null"`
+}
+
+func (versionSignatureV5) TableName() string {
+	return "version_signatures"
+}
+
+type signaturePolicyV5 struct {
+	SignaturePolicy string `gorm:"not null;default:none"`
+}
+
+// Version 6: block map uploads, added to upload_models
+
+type blockMapV6 struct {
+	BlockMap bool `gorm:"not null;default:false"`
+}
+
+// Version 7: NBD boots, added to boot_setups
+
+type nbdV7 struct {
+	NBD bool `gorm:"not null;default:false"`
+}
+
+// Version 8: provisioning status
+
+type statusV8 struct {
+	gorm.Model
+	MachineMAC string `gorm:"not null;index"`
+	Phase      string `gorm:"not null"`
+	SetupUUID  string
+	Image      string
+	Version    uint64
+	Completed  int
+	Total      int
+	Attempt    int
+	Error      string
+	Time       time.Time `gorm:"not null"`
+}
+
+func (statusV8) TableName() string {
+	return "status_models"
+}
+
+// Version 9: hardware inventory
+
+type inventoryV9 struct {
+	gorm.Model
+	MachineMAC   string `gorm:"not null;uniqueIndex"`
+	CPUModel     string
+	CPUCores     int
+	CPUThreads   int
+	Memory       uint64
+	Disks        string `gorm:"type:text"`
+	NICs         string `gorm:"type:text"`
+	Firmware     string
+	Architecture string
+	Approved     bool
+	Time         time.Time `gorm:"not null"`
+}
+
+func (inventoryV9) TableName() string {
+	return "inventory_models"
+}
+
+// Version 10: placement, added to machine_models, inventory_models and reservation_models
+
+type labelsV10 struct {
+	Labels string `gorm:"type:text"`
+}
+
+type gpusV10 struct {
+	GPUs int `gorm:"column:gpus"`
+}
+
+type constraintsV10 struct {
+	Constraints string
+}
+
+// Version 11: power control, the power cycle is added to boot_setups
+
+type powerV11 struct {
+	gorm.Model
+	MachineMAC string `gorm:"not null;uniqueIndex"`
+	Driver     string `gorm:"not null"`
+	Address    string `gorm:"not null"`
+	Username   string
+	Password   string
+	SystemID   string
+	Insecure   bool
+}
+
+func (powerV11) TableName() string {
+	return "power_models"
+}
+
+type powerCycleV11 struct {
+	PowerCycle bool `gorm:"not null;default:false"`
+}
+
+// Version 12: the credentials of machines, added to machine_models of databases from before the migrations
+
+type machineCredentialsV12 struct {
+	CurrentSetupUUID string
+	TokenHash        string
+}
+
+// Version 13: every version number is used once per image
+
+type versionIndexV13 struct {
+	Version        uint64 `gorm:"uniqueIndex:idx_versions_image_version,priority:2"`
+	ImageModelUUID string `gorm:"uniqueIndex:idx_versions_image_version,priority:1"`
+}
+
+func (versionIndexV13) TableName() string {
+	return "versions"
+}
+
+// Version 14: the compression and the type of the file of a version, added to versions
+
+type versionContentsV14 struct {
+	Compression string
+	Type        int
+}
@@ -0,0 +1,326 @@
+// Copyright (c) 2020-2022 TU Delft & Valentijn van de Beek <v.d.vandebeek@student.tudelft.nl> All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package migrations
+
+import (
+	"gorm.io/gorm"
+)
+
+// all contains every migration in the order in which they are applied. Migrations are never changed
+// once they are released, a change to a model is a new migration at the end of the list. The tables
+// and columns are created from the frozen copies of the models in models.go, never from the models.
+//
+// Databases created before version 12 were set up from the models of the release which created them,
+// so they may already have columns of later migrations. Those migrations have to skip what already exists.
+var all = []Migration{
+	{
+		Version:     1,
+		Description: "initial schema",
+		Up:          initialSchema,
+		Down:        dropInitialSchema,
+	},
+	{
+		Version:     2,
+		Description: "retention policies for images and users",
+		Up:          addColumns(retentionColumns...),
+		Down:        dropColumns(retentionColumns...),
+	},
+	{
+		Version:     3,
+		Description: "resumable uploads",
+		Up:          createTables(&uploadV3{}),
+		Down:        dropTables(&uploadV3{}),
+	},
+	{
+		Version:     4,
+		Description: "version digests",
+		Up:          addColumns(digestColumns...),
+		Down:        dropColumns(digestColumns...),
+	},
+	{
+		Version:     5,
+		Description: "signed versions",
+		Up: func(tx *gorm.DB) error {
+			if err := createTables(&signingKeyV5{}, &versionSignatureV5{})(tx); err != nil {
+				return err
+			}
+
+			return addColumns(signaturePolicyColumn)(tx)
+		},
+		Down: func(tx *gorm.DB) error {
+			if err := dropColumns(signaturePolicyColumn)(tx); err != nil {
+				return err
+			}
+
+			return dropTables(&signingKeyV5{}, &versionSignatureV5{})(tx)
+		},
+	},
+	{
+		Version:     6,
+		Description: "block map uploads",
+		Up:          addColumns(blockMapColumn),
+		Down:        dropColumns(blockMapColumn),
+	},
+	{
+		Version:     7,
+		Description: "network block device boots",
+		Up:          addColumns(nbdColumn),
+		Down:        dropColumns(nbdColumn),
+	},
+	{
+		Version:     8,
+		Description: "provisioning status of machines",
+		Up:          createTables(&statusV8{}),
+		Down:        dropTables(&statusV8{}),
+	},
+	{
+		Version:     9,
+		Description: "hardware inventory of machines",
+		Up:          createTables(&inventoryV9{}),
+		Down:        dropTables(&inventoryV9{}),
+	},
+	{
+		Version:     10,
+		Description: "machine labels and placement constraints",
+		Up:          addColumns(placementColumns...),
+		Down:        dropColumns(placementColumns...),
+	},
+	{
+		Version:     11,
+		Description: "power control of machines",
+		Up: func(tx *gorm.DB) error {
+			if err := createTables(&powerV11{})(tx); err != nil {
+				return err
+			}
+
+			return addColumns(powerCycleColumn)(tx)
+		},
+		Down: func(tx *gorm.DB) error {
+			if err := dropColumns(powerCycleColumn)(tx); err != nil {
+				return err
+			}
+
+			return dropTables(&powerV11{})(tx)
+		},
+	},
+	{
+		Version:     12,
+		Description: "machine credentials of databases from before the migrations",
+		Up:          addColumns(machineCredentialColumns...),
+		// The columns are part of the initial schema of every other database, so they are kept
+		Down: func(tx *gorm.DB) error {
+			return nil
+		},
+	},
+	{
+		Version:     13,
+		Description: "unique version numbers",
+		Up:          uniqueVersions,
+		Down: func(tx *gorm.DB) error {
+			return tx.Migrator().DropIndex(&versionIndexV13{}, versionIndex)
+		},
+	},
+	{
+		Version:     14,
+		Description: "compression and type of versions",
+		Up:          addColumns(versionContentsColumns...),
+		Down: func(tx *gorm.DB) error {
+			if err := dropColumns(versionContentsColumns...)(tx); err != nil {
+				return err
+			}
+
+			// SQLite drops a column by copying the table, which leaves the unique index of migration 13 behind
+			if tx.Migrator().HasIndex(&versionIndexV13{}, versionIndex) {
+				return nil
+			}
+
+			return tx.Migrator().CreateIndex(&versionIndexV13{}, versionIndex)
+		},
+	},
+}
+
+// column is a column of a table, defined by the field of a frozen model with the same name
+type column struct {
+	table string
+	model interface{}
+	name  string
+}
+
+var retentionColumns = []column{
+	{"image_models", &retentionV2{}, "retention_keep_last"},
+	{"image_models", &retentionV2{}, "retention_keep_days"},
+	{"machine_image_models", &retentionV2{}, "retention_keep_last"},
+	{"machine_image_models", &retentionV2{}, "retention_keep_days"},
+	{"user_models", &retentionV2{}, "retention_keep_last"},
+	{"user_models", &retentionV2{}, "retention_keep_days"},
+}
+
+var digestColumns = []column{
+	{"versions", &digestV4{}, "digest"},
+	{"versions", &digestV4{}, "size"},
+}
+
+var signaturePolicyColumn = column{"image_setups", &signaturePolicyV5{}, "signature_policy"}
+
+var blockMapColumn = column{"upload_models", &blockMapV6{}, "block_map"}
+
+var nbdColumn = column{"boot_setups", &nbdV7{}, "nbd"}
+
+var placementColumns = []column{
+	{"machine_models", &labelsV10{}, "labels"},
+	{"inventory_models", &gpusV10{}, "gpus"},
+	{"reservation_models", &constraintsV10{}, "constraints"},
+}
+
+var powerCycleColumn = column{"boot_setups", &powerCycleV11{}, "power_cycle"}
+
+var machineCredentialColumns = []column{
+	{"machine_models", &machineCredentialsV12{}, "current_setup_uuid"},
+	{"machine_models", &machineCredentialsV12{}, "token_hash"},
+}
+
+var versionContentsColumns = []column{
+	{"versions", &versionContentsV14{}, "compression"},
+	{"versions", &versionContentsV14{}, "type"},
+}
+
+// addColumns adds the columns if they do not exist yet
+func addColumns(columns ...column) func(tx *gorm.DB) error {
+	return func(tx *gorm.DB) error {
+		for _, c := range columns {
+			migrator := tx.Table(c.table).Migrator()
+			if migrator.HasColumn(c.model, c.name) {
+				continue
+			}
+
+			if err := migrator.AddColumn(c.model, c.name); err != nil {
+				return err
+			}
+		}
+
+		return nil
+	}
+}
+
+// dropColumns removes the columns if they exist
+func dropColumns(columns ...column) func(tx *gorm.DB) error {
+	return func(tx *gorm.DB) error {
+		for _, c := range columns {
+			migrator := tx.Table(c.table).Migrator()
+			if !migrator.HasColumn(c.model, c.name) {
+				continue
+			}
+
+			if err := migrator.DropColumn(c.model, c.name); err != nil {
+				return err
+			}
+		}
+
+		return nil
+	}
+}
+
+// createTables creates the tables of the models, if they do not exist yet
+func createTables(models ...interface{}) func(tx *gorm.DB) error {
+	return func(tx *gorm.DB) error {
+		for _, model := range models {
+			if tx.Migrator().HasTable(model) {
+				continue
+			}
+
+			if err := tx.Migrator().CreateTable(model); err != nil {
+				return err
+			}
+		}
+
+		return nil
+	}
+}
+
+// dropTables removes the tables of the models
+func dropTables(models ...interface{}) func(tx *gorm.DB) error {
+	return func(tx *gorm.DB) error {
+		return tx.Migrator().DropTable(models...)
+	}
+}
+
+// versionIndex is the unique index on the image and the number of the versions
+const versionIndex = "idx_versions_image_version"
+
+// uniqueVersions creates the unique index on the versions. Two uploads at the same time could give two versions
+// the same number before, the last one overwrote the file of both. Only the last one of those is kept, the image
+// setups which use the others get it instead and their signatures are dropped as they were for another file.
+func uniqueVersions(tx *gorm.DB) error {
+	var duplicates []struct {
+		ID   uint
+		Keep uint
+	}
+
+	err := tx.Raw(`SELECT v.id AS id, (SELECT MAX(w.id) FROM versions w
+		WHERE w.image_model_uuid = v.image_model_uuid AND w.version = v.version) AS keep FROM versions v`).
+		Scan(&duplicates).Error
+	if err != nil {
+		return err
+	}
+
+	for _, d := range duplicates {
+		if d.ID == d.Keep {
+			continue
+		}
+
+		if err = tx.Exec("UPDATE image_frozens SET version_id = ? WHERE version_id = ?", d.Keep, d.ID).Error; err != nil {
+			return err
+		}
+
+		if err = tx.Exec("DELETE FROM version_signatures WHERE version_id = ?", d.ID).Error; err != nil {
+			return err
+		}
+
+		if err = tx.Exec("DELETE FROM versions WHERE id = ?", d.ID).Error; err != nil {
+			return err
+		}
+	}
+
+	if tx.Migrator().HasIndex(&versionIndexV13{}, versionIndex) {
+		return nil
+	}
+
+	return tx.Migrator().CreateIndex(&versionIndexV13{}, versionIndex)
+}
+
+// initialModels are the models of the initial schema, in the order in which they can be dropped
+var initialModels = []interface{}{
+	&machineImageV1{},
+	&bootSetupV1{},
+	&imageFrozenV1{},
+	&versionV1{},
+	&imageSetupV1{},
+	&imageV1{},
+	&reservationV1{},
+	&accessTokenV1{},
+	&userV1{},
+	&machineV1{},
+}
+
+// initialSchema creates the tables which BAAS used to create on startup. Databases created by those
+// versions already have them, the existing tables are left alone which makes those databases version 1.
+// Migration 12 adds the columns which were added to those tables just before the migrations existed.
+func initialSchema(tx *gorm.DB) error {
+	for i := len(initialModels) - 1; i >= 0; i-- {
+		if tx.Migrator().HasTable(initialModels[i]) {
+			continue
+		}
+
+		if err := tx.Migrator().CreateTable(initialModels[i]); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func dropInitialSchema(tx *gorm.DB) error {
+	return tx.Migrator().DropTable(initialModels...)
+}
@@ -0,0 +1,44 @@
+// Copyright (c) 2020-2022 TU Delft & Valentijn van de Beek <v.d.vandebeek@student.tudelft.nl> All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package postgres
+
+import (
+	"os"
+	"testing"
+
+	"github.com/baas-project/baas/pkg/database"
+	"github.com/baas-project/baas/pkg/database/storetest"
+	"github.com/stretchr/testify/assert"
+	"gorm.io/driver/postgres"
+	"gorm.io/gorm"
+)
+
+// dsnVariable names the environment variable with the database to test against.
+// Everything in this database is removed by the tests.
+const dsnVariable = "BAAS_TEST_POSTGRES_DSN"
+
+func TestStore(t *testing.T) {
+	dsn := os.Getenv(dsnVariable)
+	if dsn == "" {
+		t.Skipf("%s is not set", dsnVariable)
+	}
+
+	storetest.Run(t, func(t *testing.T) database.Store {
+		// Start every test with an empty database
+		db, err := gorm.Open(postgres.Open(dsn), &gorm.Config{})
+		assert.NoError(t, err)
+
+		err = db.Exec("DROP SCHEMA public CASCADE; CREATE SCHEMA public;").Error
+		assert.NoError(t, err)
+
+		if sqlDB, err := db.DB(); err == nil {
+			_ = sqlDB.Close()
+		}
+
+		store, err := NewPostgresStore(dsn)
+		assert.NoError(t, err)
+		return store
+	})
+}
@@ -0,0 +1,51 @@
+// Copyright (c) 2020-2022 TU Delft & Valentijn van de Beek <v.d.vandebeek@student.tudelft.nl> All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package postgres
+
+import (
+	"github.com/baas-project/baas/pkg/database"
+	"github.com/baas-project/baas/pkg/model/machine"
+	"github.com/baas-project/baas/pkg/model/reservation"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// blockingStatuses are the statuses of reservations which still claim their machine
+var blockingStatuses = []reservation.ReservationStatus{reservation.Scheduled, reservation.Active}
+
+// CreateReservation stores the reservation unless it overlaps with another reservation on the same machine.
+// The machine is locked while checking, otherwise two control servers could book the same slot at the same time.
+// The times are stored in UTC like the other stores do.
+func (s Store) CreateReservation(r *reservation.ReservationModel) error {
+	r.Start = r.Start.UTC()
+	r.End = r.End.UTC()
+
+	return s.Transaction(func(tx *gorm.DB) error {
+		err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).
+			Where("address = ?", r.MachineMAC).
+			First(&machine.MachineModel{}).Error
+
+		if err != nil {
+			return err
+		}
+
+		var conflicts int64
+		err = tx.Model(&reservation.ReservationModel{}).
+			Where("machine_mac = ?", r.MachineMAC).
+			Where("status IN ?", blockingStatuses).
+			Where("start_time < ? AND end_time > ?", r.End, r.Start).
+			Count(&conflicts).Error
+
+		if err != nil {
+			return err
+		}
+
+		if conflicts > 0 {
+			return database.ErrReservationConflict
+		}
+
+		return tx.Create(r).Error
+	})
+}
@@ -7,9 +7,8 @@ package sqlite
 
 import (
 	"github.com/baas-project/baas/pkg/database"
-	"github.com/baas-project/baas/pkg/model/images"
-	"github.com/baas-project/baas/pkg/model/machine"
-	"github.com/baas-project/baas/pkg/model/user"
+	"github.com/baas-project/baas/pkg/database/gormstore"
+	"github.com/baas-project/baas/pkg/database/migrations"
 	"github.com/pkg/errors"
 	"gorm.io/driver/sqlite"
 	"gorm.io/gorm"
@@ -19,41 +18,49 @@ import (
 // InMemoryPath is the path inside the memory pointing to the database
 const InMemoryPath = "file::memory:"
 
-// Store is the database structure
+// Store is the database structure, the queries are shared with the other SQL databases
 type Store struct {
-	*gorm.DB
+	gormstore.Store
 }
 
 // NewSqliteStore creates the database storage using the given string as the database file.
+// Pending migrations are applied, a database which is newer than this binary is refused.
 func NewSqliteStore(dbpath string) (database.Store, error) {
+	db, err := OpenDB(dbpath)
+	if err != nil {
+		return nil, err
+	}
+
+	if err = migrations.Up(db, migrations.LatestTarget); err != nil {
+		return nil, err
+	}
+
+	return Store{
+		gormstore.Store{DB: db},
+	}, nil
+}
+
+// OpenDB opens the database file without touching the schema.
+func OpenDB(dbpath string) (*gorm.DB, error) {
 	db, err := gorm.Open(sqlite.Open(dbpath), &gorm.Config{
 		Logger: logger.Default.LogMode(logger.Info),
 	})
 
-	if res := db.Exec("PRAGMA foreign_keys=ON", nil); res.Error != nil {
-		return nil, res.Error
+	if err != nil {
+		return nil, errors.Wrap(err, "open db")
 	}
 
+	// SQLite has a single writer anyway, and every connection to an in-memory database opens another database
+	sqlDB, err := db.DB()
 	if err != nil {
 		return nil, errors.Wrap(err, "open db")
 	}
 
-	err = db.AutoMigrate(
-		&images.BootSetup{},
-		&images.ImageSetup{},
-		&images.ImageModel{},
-		&images.MachineImageModel{},
-		&machine.MachineModel{},
-		&user.UserModel{},
-		&images.Version{},
-		&images.ImageFrozen{},
-	)
+	sqlDB.SetMaxOpenConns(1)
 
-	if err != nil {
-		return nil, errors.Wrap(err, "migrate")
+	if res := db.Exec("PRAGMA foreign_keys=ON", nil); res.Error != nil {
+		return nil, res.Error
 	}
 
-	return Store{
-		db,
-	}, nil
+	return db, nil
 }
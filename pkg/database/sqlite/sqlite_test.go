@@ -7,6 +7,8 @@ package sqlite
 import (
 	"testing"
 
+	"github.com/baas-project/baas/pkg/database"
+	"github.com/baas-project/baas/pkg/database/storetest"
 	"github.com/baas-project/baas/pkg/model/images"
 
 	"github.com/stretchr/testify/assert"
@@ -49,3 +51,11 @@ func TestNewSqliteStore(t *testing.T) {
 	assert.Equal(t, string(imr.UUID), "yeet")
 	assert.Equal(t, len(imr.Versions), 0)
 }
+
+func TestStore(t *testing.T) {
+	storetest.Run(t, func(t *testing.T) database.Store {
+		store, err := NewSqliteStore(InMemoryPath)
+		assert.NoError(t, err)
+		return store
+	})
+}
@@ -6,12 +6,19 @@
 package database
 
 import (
+	"time"
+
 	"github.com/baas-project/baas/pkg/model/images"
 	"github.com/baas-project/baas/pkg/model/machine"
+	"github.com/baas-project/baas/pkg/model/reservation"
 	"github.com/baas-project/baas/pkg/model/user"
 	"github.com/baas-project/baas/pkg/util"
+	"github.com/pkg/errors"
 )
 
+// ErrReservationConflict is returned when a reservation overlaps with another reservation on the same machine
+var ErrReservationConflict = errors.New("reservation conflicts with an existing reservation")
+
 // Store defines the functions which should be exported by any concrete database implementation
 type Store interface {
 
@@ -28,8 +35,32 @@ type Store interface {
 	UpdateMachine(machine *machine.MachineModel) error
 	AddBootSetupToMachine(bootSetup *images.BootSetup) error
 	GetNextBootSetup(machineMAC string) (*images.BootSetup, error)
+	// PeekBootSetup returns the oldest boot setup of the machine without removing it from the queue
+	PeekBootSetup(machineMAC string) (*images.BootSetup, error)
+	// DeleteBootSetup removes the boot setup from the queue of its machine
+	DeleteBootSetup(bootSetup *images.BootSetup) error
 	DeleteMachine(machine *machine.MachineModel) error
 
+	// SetMachineToken stores the hash of the credential issued to a machine
+	SetMachineToken(mac util.MacAddress, tokenHash string) error
+	// SetMachineLabels replaces the labels of a machine
+	SetMachineLabels(mac util.MacAddress, labels machine.Labels) error
+	// SetMachineBootSetup records which image setup was handed to the machine
+	SetMachineBootSetup(mac util.MacAddress, setup images.ImageUUID) error
+	// AddMachineStatus stores a status which the management OS of a machine reported
+	AddMachineStatus(status *machine.StatusModel) error
+	// GetMachineStatuses returns the last statuses of a machine, oldest first. All of them are returned if limit is 0.
+	GetMachineStatuses(mac string, limit int) ([]machine.StatusModel, error)
+	// SetMachineInventory stores the hardware of a machine, replacing the inventory it had
+	SetMachineInventory(inventory *machine.InventoryModel) error
+	GetMachineInventory(mac string) (*machine.InventoryModel, error)
+	// GetMachineInventories returns the inventory of every machine which has one
+	GetMachineInventories() ([]machine.InventoryModel, error)
+	// SetMachinePower stores how the power of a machine is controlled, replacing what it had
+	SetMachinePower(power *machine.PowerModel) error
+	GetMachinePower(mac string) (*machine.PowerModel, error)
+	DeleteMachinePower(mac string) error
+
 	GetUserByUsername(name string) (*user.UserModel, error)
 	GetUserByID(id uint) (*user.UserModel, error)
 	GetUsers() ([]user.UserModel, error)
@@ -37,6 +68,20 @@ type Store interface {
 	RemoveUser(user *user.UserModel) error
 	ModifyUser(user *user.UserModel) error
 
+	CreateAccessToken(token *user.AccessTokenModel) error
+	GetAccessTokensByUsername(username string) ([]user.AccessTokenModel, error)
+	// GetAccessTokenByHash finds the token which hashes to the given value, used to authenticate requests
+	GetAccessTokenByHash(hash string) (*user.AccessTokenModel, error)
+	DeleteAccessToken(token *user.AccessTokenModel) error
+	// TouchAccessToken records that the token was used at the given time
+	TouchAccessToken(token *user.AccessTokenModel, now time.Time) error
+
+	CreateSigningKey(key *user.SigningKeyModel) error
+	GetSigningKey(uuid string) (*user.SigningKeyModel, error)
+	GetSigningKeysByUsername(username string) ([]user.SigningKeyModel, error)
+	// DeleteSigningKey removes a key, the signatures made with it no longer count
+	DeleteSigningKey(key *user.SigningKeyModel) error
+
 	GetImageByUUID(uuid images.ImageUUID) (*images.ImageModel, error)
 	GetImagesByUsername(username string) ([]images.ImageModel, error)
 	GetImagesByNameAndUsername(name string, username string) ([]images.ImageModel, error)
@@ -44,8 +89,36 @@ type Store interface {
 	DeleteImage(image *images.ImageModel) error
 	UpdateImage(image *images.ImageModel) error
 	CreateNewImageVersion(version images.Version)
+	// CreateNextImageVersion stores the version which follows the latest version of the image and returns it. The
+	// number is reserved once it returns, so the file of the version can be written without another request
+	// picking the same number.
+	CreateNextImageVersion(uuid images.ImageUUID) (*images.Version, error)
 	GetVersionByID(versionID uint64) (*images.Version, error)
 
+	// GetImages returns every image with its versions, machine images are not included
+	GetImages() ([]images.ImageModel, error)
+	// DeleteVersion removes a version of an image and its signatures, its files have to be removed separately
+	DeleteVersion(version *images.Version) error
+	// GetPinnedVersions returns the ids of the versions which are part of an image setup
+	GetPinnedVersions() ([]uint64, error)
+	// SetVersionDigest stores the digest, size, compression and type of an existing version, found by its image
+	// and number
+	SetVersionDigest(version images.Version) error
+	SetImageRetention(uuid images.ImageUUID, policy images.RetentionPolicy) error
+	// SetImageCompression changes how the versions of an image are compressed, leaving the rest of the image as it is
+	SetImageCompression(uuid images.ImageUUID, strategy images.DiskCompressionStrategy) error
+	// SetImageFileType changes the type of disk image the latest version of an image is stored as
+	SetImageFileType(uuid images.ImageUUID, diskType images.DiskType) error
+	SetUserRetention(username string, policy images.RetentionPolicy) error
+	AddVersionSignature(signature *images.VersionSignature) error
+	GetVersionSignatures(versionID uint) ([]images.VersionSignature, error)
+
+	CreateUpload(upload *images.UploadModel) error
+	GetUpload(uuid string) (*images.UploadModel, error)
+	// GetUploads returns the uploads which have not been committed or aborted yet
+	GetUploads() ([]images.UploadModel, error)
+	DeleteUpload(upload *images.UploadModel) error
+
 	// You could use weird Go polymorphisms here, but I guess I will just copy and paste code
 	CreateMachineImage(image *images.MachineImageModel)
 	CreateImageSetup(username string, image *images.ImageSetup) error
@@ -58,4 +131,22 @@ type Store interface {
 	ModifyImageSetup(imageSetup *images.ImageSetup) error
 	DeleteImageSetup(imageSetup *images.ImageSetup) error
 	RemoveImageFromImageSetup(setup *images.ImageSetup, image *images.ImageModel, version images.Version, update bool) error
+
+	// CreateReservation stores a reservation, returning ErrReservationConflict if the machine is already booked.
+	CreateReservation(reservation *reservation.ReservationModel) error
+	GetReservationByUUID(uuid string) (*reservation.ReservationModel, error)
+	GetReservations() ([]reservation.ReservationModel, error)
+	GetReservationsByUsername(username string) ([]reservation.ReservationModel, error)
+	GetReservationsByMachine(mac string) ([]reservation.ReservationModel, error)
+	UpdateReservation(reservation *reservation.ReservationModel) error
+
+	// AdvanceReservation gives the reservation the status if it still has the status it was read with. In the
+	// same transaction the boot setups queued on its machine are removed when clear is set, and then the setup
+	// is queued unless it is nil. It returns false and changes nothing when someone else advanced it first.
+	AdvanceReservation(reservation *reservation.ReservationModel, status reservation.ReservationStatus,
+		setup *images.BootSetup, clear bool) (bool, error)
+
+	// GetDueReservations returns the scheduled reservations whose slot has started and the
+	// active reservations whose slot has ended at the given time.
+	GetDueReservations(now time.Time) ([]reservation.ReservationModel, error)
 }
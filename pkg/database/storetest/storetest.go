@@ -0,0 +1,771 @@
+// Copyright (c) 2020-2022 TU Delft & Valentijn van de Beek <v.d.vandebeek@student.tudelft.nl> All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package storetest contains a conformance test suite which every implementation of database.Store should pass.
+// A backend runs it from its own tests:
+//
+//     func TestStore(t *testing.T) {
+//         storetest.Run(t, func(t *testing.T) database.Store { ... })
+//     }
+package storetest
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/baas-project/baas/pkg/database"
+	"github.com/baas-project/baas/pkg/model/images"
+	"github.com/baas-project/baas/pkg/model/machine"
+	"github.com/baas-project/baas/pkg/model/reservation"
+	"github.com/baas-project/baas/pkg/model/user"
+	"github.com/baas-project/baas/pkg/util"
+	"github.com/stretchr/testify/assert"
+)
+
+// NewStore creates an empty store, it is called once for every test in the suite.
+type NewStore func(t *testing.T) database.Store
+
+// Run runs the conformance tests against the stores created by newStore
+func Run(t *testing.T, newStore NewStore) {
+	tests := map[string]func(t *testing.T, store database.Store){
+		"Users":        testUsers,
+		"Machines":     testMachines,
+		"BootSetups":   testBootSetups,
+		"Images":       testImages,
+		"Versions":     testVersions,
+		"ImageSetups":  testImageSetups,
+		"Reservations": testReservations,
+		"AccessTokens": testAccessTokens,
+		"Retention":    testRetention,
+		"Uploads":      testUploads,
+		"Signatures":   testSignatures,
+		"Statuses":     testStatuses,
+		"Inventories":  testInventories,
+		"Power":        testPower,
+	}
+
+	for name, test := range tests {
+		test := test
+		t.Run(name, func(t *testing.T) {
+			test(t, newStore(t))
+		})
+	}
+}
+
+func createUser(t *testing.T, store database.Store, username string, role user.UserRole) {
+	err := store.CreateUser(&user.UserModel{
+		Username: username,
+		Name:     username,
+		Email:    username + "@example.com",
+		Role:     role,
+	})
+	assert.NoError(t, err)
+}
+
+func createMachine(t *testing.T, store database.Store, mac string) {
+	err := store.UpdateMachine(&machine.MachineModel{
+		MacAddress:   util.MacAddress{Address: mac},
+		Name:         mac,
+		Architecture: machine.X86_64,
+	})
+	assert.NoError(t, err)
+}
+
+func testUsers(t *testing.T, store database.Store) {
+	createUser(t, store, "alice", user.Admin)
+	createUser(t, store, "bob", user.User)
+
+	alice, err := store.GetUserByUsername("alice")
+	assert.NoError(t, err)
+	assert.Equal(t, user.UserRole(user.Admin), alice.Role)
+
+	users, err := store.GetUsers()
+	assert.NoError(t, err)
+	assert.Len(t, users, 2)
+
+	err = store.ModifyUser(&user.UserModel{Username: "bob", Name: "Bob"})
+	assert.NoError(t, err)
+
+	bob, err := store.GetUserByUsername("bob")
+	assert.NoError(t, err)
+	assert.Equal(t, "Bob", bob.Name)
+	assert.Equal(t, user.User, bob.Role)
+
+	err = store.RemoveUser(bob)
+	assert.NoError(t, err)
+
+	_, err = store.GetUserByUsername("bob")
+	assert.Error(t, err)
+}
+
+func testMachines(t *testing.T, store database.Store) {
+	createMachine(t, store, "00:11:22:33:44:55")
+	createMachine(t, store, "66:77:88:99:aa:bb")
+
+	mac := util.MacAddress{Address: "00:11:22:33:44:55"}
+
+	// Updating a machine which exists changes it instead of creating another one
+	err := store.UpdateMachine(&machine.MachineModel{MacAddress: mac, Name: "renamed", Managed: true})
+	assert.NoError(t, err)
+
+	machines, err := store.GetMachines()
+	assert.NoError(t, err)
+	assert.Len(t, machines, 2)
+
+	m, err := store.GetMachineByMac(mac)
+	assert.NoError(t, err)
+	assert.Equal(t, "renamed", m.Name)
+	assert.True(t, m.Managed)
+
+	err = store.SetMachineToken(mac, "hash")
+	assert.NoError(t, err)
+
+	err = store.SetMachineBootSetup(mac, "setup")
+	assert.NoError(t, err)
+
+	m, err = store.GetMachineByMac(mac)
+	assert.NoError(t, err)
+	assert.Equal(t, "hash", m.TokenHash)
+	assert.Equal(t, "setup", m.CurrentSetupUUID)
+	assert.Empty(t, m.Labels)
+
+	labels := machine.Labels{"numa": "2", "rack": "b4"}
+	err = store.SetMachineLabels(mac, labels)
+	assert.NoError(t, err)
+	labels["rack"] = "changed"
+
+	// Updating the other fields leaves the labels alone
+	err = store.UpdateMachine(&machine.MachineModel{MacAddress: mac, Name: "renamed", Managed: true})
+	assert.NoError(t, err)
+
+	m, err = store.GetMachineByMac(mac)
+	assert.NoError(t, err)
+	assert.Equal(t, machine.Labels{"numa": "2", "rack": "b4"}, m.Labels)
+
+	err = store.DeleteMachine(m)
+	assert.NoError(t, err)
+
+	_, err = store.GetMachineByMac(mac)
+	assert.Error(t, err)
+}
+
+func testBootSetups(t *testing.T, store database.Store) {
+	createUser(t, store, "alice", user.User)
+	createMachine(t, store, "abc")
+
+	_, err := store.GetNextBootSetup("abc")
+	assert.Error(t, err)
+
+	for _, uuid := range []images.ImageUUID{"first", "second"} {
+		err = store.CreateImageSetup("alice", &images.ImageSetup{Name: string(uuid), Username: "alice", UUID: uuid})
+		assert.NoError(t, err)
+
+		err = store.AddBootSetupToMachine(&images.BootSetup{MachineMAC: "abc", SetupUUID: uuid})
+		assert.NoError(t, err)
+	}
+
+	// Peeking leaves the boot setup in the queue
+	for i := 0; i < 2; i++ {
+		setup, err := store.PeekBootSetup("abc")
+		assert.NoError(t, err)
+		assert.Equal(t, images.ImageUUID("first"), setup.SetupUUID)
+	}
+
+	// The boot setups form a queue
+	for _, uuid := range []images.ImageUUID{"first", "second"} {
+		setup, err := store.GetNextBootSetup("abc")
+		assert.NoError(t, err)
+		assert.Equal(t, uuid, setup.SetupUUID)
+	}
+
+	_, err = store.GetNextBootSetup("abc")
+	assert.Error(t, err)
+}
+
+func testImages(t *testing.T, store database.Store) {
+	createUser(t, store, "alice", user.User)
+
+	store.CreateImage(&images.ImageModel{Name: "Fedora", UUID: "fedora", Username: "alice"})
+	store.CreateImage(&images.ImageModel{Name: "Arch", UUID: "arch", Username: "alice"})
+
+	image, err := store.GetImageByUUID("fedora")
+	assert.NoError(t, err)
+	assert.Equal(t, "Fedora", image.Name)
+	assert.Len(t, image.Versions, 1)
+
+	store.CreateNewImageVersion(images.Version{Version: 1, ImageModelUUID: "fedora"})
+
+	image, err = store.GetImageByUUID("fedora")
+	assert.NoError(t, err)
+	assert.Len(t, image.Versions, 2)
+
+	version, err := store.GetVersionByID(uint64(image.Versions[1].ID))
+	assert.NoError(t, err)
+	assert.Equal(t, uint64(1), version.Version)
+	assert.Empty(t, version.Digest)
+
+	err = store.SetVersionDigest(images.Version{Version: 1, ImageModelUUID: "fedora", Digest: "b94d27b9", Size: 11,
+		Compression: images.DiskCompressionStrategyGZip, Type: images.DiskTypeQCow2})
+	assert.NoError(t, err)
+
+	version, err = store.GetVersionByID(uint64(image.Versions[1].ID))
+	assert.NoError(t, err)
+	assert.Equal(t, "b94d27b9", version.Digest)
+	assert.Equal(t, int64(11), version.Size)
+	assert.Equal(t, images.DiskCompressionStrategy(images.DiskCompressionStrategyGZip), version.Compression)
+	assert.Equal(t, images.DiskTypeQCow2, version.Type)
+
+	userImages, err := store.GetImagesByUsername("alice")
+	assert.NoError(t, err)
+	assert.Len(t, userImages, 2)
+
+	userImages, err = store.GetImagesByNameAndUsername("Arch", "alice")
+	assert.NoError(t, err)
+	assert.Len(t, userImages, 1)
+
+	image.Name = "Fedora Research"
+	err = store.UpdateImage(image)
+	assert.NoError(t, err)
+
+	image, err = store.GetImageByUUID("fedora")
+	assert.NoError(t, err)
+	assert.Equal(t, "Fedora Research", image.Name)
+
+	err = store.DeleteImage(image)
+	assert.NoError(t, err)
+
+	_, err = store.GetImageByUUID("fedora")
+	assert.Error(t, err)
+}
+
+func testVersions(t *testing.T, store database.Store) {
+	createUser(t, store, "alice", user.User)
+	store.CreateImage(&images.ImageModel{Name: "Fedora", UUID: "fedora", Username: "alice"})
+
+	version, err := store.CreateNextImageVersion("fedora")
+	assert.NoError(t, err)
+	assert.Equal(t, uint64(1), version.Version)
+	assert.NotZero(t, version.ID)
+
+	// Requests at the same time never get the same number
+	const requests = 8
+	numbers := make(chan uint64, requests)
+
+	var wg sync.WaitGroup
+	for i := 0; i < requests; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			version, err := store.CreateNextImageVersion("fedora")
+			if assert.NoError(t, err) {
+				numbers <- version.Version
+			}
+		}()
+	}
+
+	wg.Wait()
+	close(numbers)
+
+	seen := make(map[uint64]bool)
+	for number := range numbers {
+		assert.False(t, seen[number], "version %d is handed out twice", number)
+		seen[number] = true
+	}
+
+	image, err := store.GetImageByUUID("fedora")
+	assert.NoError(t, err)
+	assert.Len(t, image.Versions, requests+2)
+
+	// Every image counts its own versions
+	store.CreateImage(&images.ImageModel{Name: "Arch", UUID: "arch", Username: "alice"})
+	version, err = store.CreateNextImageVersion("arch")
+	assert.NoError(t, err)
+	assert.Equal(t, uint64(1), version.Version)
+}
+
+func testImageSetups(t *testing.T, store database.Store) {
+	createUser(t, store, "alice", user.User)
+
+	err := store.CreateImageSetup("nobody", &images.ImageSetup{Name: "setup", Username: "nobody", UUID: "orphan"})
+	assert.Error(t, err)
+
+	err = store.CreateImageSetup("alice", &images.ImageSetup{Name: "setup", Username: "alice", UUID: "setup"})
+	assert.NoError(t, err)
+
+	store.CreateImage(&images.ImageModel{Name: "Fedora", UUID: "fedora", Username: "alice"})
+	image, err := store.GetImageByUUID("fedora")
+	assert.NoError(t, err)
+
+	setup, err := store.GetImageSetup("setup")
+	assert.NoError(t, err)
+
+	store.AddImageToImageSetup(&setup, image, image.Versions[0], true)
+
+	setup, err = store.GetImageSetup("setup")
+	assert.NoError(t, err)
+	assert.Len(t, setup.Images, 1)
+	assert.Equal(t, images.ImageUUID("fedora"), setup.Images[0].UUIDImage)
+	assert.True(t, setup.Images[0].Update)
+
+	setups, err := store.GetImageSetups("alice")
+	assert.NoError(t, err)
+	assert.Len(t, *setups, 1)
+	assert.Equal(t, images.SignaturePolicyNone, (*setups)[0].SignaturePolicy)
+
+	err = store.ModifyImageSetup(&images.ImageSetup{UUID: "setup", SignaturePolicy: images.SignaturePolicyOwner})
+	assert.NoError(t, err)
+
+	setup, err = store.GetImageSetup("setup")
+	assert.NoError(t, err)
+	assert.Equal(t, images.SignaturePolicyOwner, setup.SignaturePolicy)
+	assert.Equal(t, "setup", setup.Name)
+
+	err = store.RemoveImageFromImageSetup(&setup, image, image.Versions[0], true)
+	assert.NoError(t, err)
+
+	setup, err = store.GetImageSetup("setup")
+	assert.NoError(t, err)
+	assert.Len(t, setup.Images, 0)
+}
+
+func testReservations(t *testing.T, store database.Store) {
+	createUser(t, store, "alice", user.User)
+	createMachine(t, store, "abc")
+
+	start := time.Now().Add(time.Hour).Truncate(time.Second)
+	first := reservation.ReservationModel{
+		UUID:       "first",
+		Username:   "alice",
+		MachineMAC: "abc",
+		SetupUUID:  "setup",
+		Start:      start,
+		End:        start.Add(2 * time.Hour),
+		Status:     reservation.Scheduled,
+	}
+
+	err := store.CreateReservation(&first)
+	assert.NoError(t, err)
+
+	overlapping := first
+	overlapping.ID = 0
+	overlapping.UUID = "overlapping"
+	overlapping.Start = start.Add(time.Hour)
+	overlapping.End = start.Add(3 * time.Hour)
+
+	err = store.CreateReservation(&overlapping)
+	assert.Equal(t, database.ErrReservationConflict, err)
+
+	// Once the first reservation is cancelled the slot is free again
+	first.Status = reservation.Cancelled
+	err = store.UpdateReservation(&first)
+	assert.NoError(t, err)
+
+	err = store.CreateReservation(&overlapping)
+	assert.NoError(t, err)
+
+	stored, err := store.GetReservationByUUID("overlapping")
+	assert.NoError(t, err)
+	assert.True(t, overlapping.Start.Equal(stored.Start))
+
+	reservations, err := store.GetReservations()
+	assert.NoError(t, err)
+	assert.Len(t, reservations, 2)
+
+	reservations, err = store.GetReservationsByUsername("alice")
+	assert.NoError(t, err)
+	assert.Len(t, reservations, 2)
+
+	reservations, err = store.GetReservationsByMachine("abc")
+	assert.NoError(t, err)
+	assert.Len(t, reservations, 2)
+
+	due, err := store.GetDueReservations(start)
+	assert.NoError(t, err)
+	assert.Len(t, due, 0)
+
+	due, err = store.GetDueReservations(start.Add(time.Hour))
+	assert.NoError(t, err)
+	assert.Len(t, due, 1)
+	assert.Equal(t, "overlapping", due[0].UUID)
+
+	// Times in other zones are compared as the moments they are
+	zone := time.FixedZone("UTC-10", -10*60*60)
+	later := overlapping
+	later.ID = 0
+	later.UUID = "later"
+	later.Start = start.Add(2 * time.Hour).In(zone)
+	later.End = start.Add(4 * time.Hour).In(zone)
+
+	err = store.CreateReservation(&later)
+	assert.Equal(t, database.ErrReservationConflict, err)
+
+	due, err = store.GetDueReservations(start.Add(time.Hour).In(zone))
+	assert.NoError(t, err)
+	assert.Len(t, due, 1)
+
+	// Only the first one to advance a reservation from the status it was read with queues its setup
+	err = store.CreateImageSetup("alice", &images.ImageSetup{Name: "setup", Username: "alice", UUID: "setup"})
+	assert.NoError(t, err)
+
+	stale := overlapping
+	advanced, err := store.AdvanceReservation(&overlapping, reservation.Active,
+		&images.BootSetup{MachineMAC: "abc", SetupUUID: "setup"}, false)
+	assert.NoError(t, err)
+	assert.True(t, advanced)
+	assert.Equal(t, reservation.Active, overlapping.Status)
+
+	advanced, err = store.AdvanceReservation(&stale, reservation.Active,
+		&images.BootSetup{MachineMAC: "abc", SetupUUID: "setup"}, false)
+	assert.NoError(t, err)
+	assert.False(t, advanced)
+	assert.Equal(t, reservation.Scheduled, stale.Status)
+
+	_, err = store.GetNextBootSetup("abc")
+	assert.NoError(t, err)
+	_, err = store.PeekBootSetup("abc")
+	assert.Error(t, err)
+
+	stored, err = store.GetReservationByUUID("overlapping")
+	assert.NoError(t, err)
+	assert.Equal(t, reservation.Active, stored.Status)
+
+	// Clearing removes what is still queued on the machine
+	assert.NoError(t, store.AddBootSetupToMachine(&images.BootSetup{MachineMAC: "abc", SetupUUID: "setup"}))
+
+	advanced, err = store.AdvanceReservation(&overlapping, reservation.Finished, nil, true)
+	assert.NoError(t, err)
+	assert.True(t, advanced)
+
+	_, err = store.PeekBootSetup("abc")
+	assert.Error(t, err)
+}
+
+func testAccessTokens(t *testing.T, store database.Store) {
+	createUser(t, store, "alice", user.User)
+
+	token := user.AccessTokenModel{
+		UUID:      "token",
+		Username:  "alice",
+		Role:      user.User,
+		TokenHash: "hash",
+		ExpiresAt: time.Now().Add(time.Hour),
+	}
+
+	err := store.CreateAccessToken(&token)
+	assert.NoError(t, err)
+
+	found, err := store.GetAccessTokenByHash("hash")
+	assert.NoError(t, err)
+	assert.Equal(t, "token", found.UUID)
+	assert.Nil(t, found.LastUsed)
+
+	err = store.TouchAccessToken(found, time.Now())
+	assert.NoError(t, err)
+
+	tokens, err := store.GetAccessTokensByUsername("alice")
+	assert.NoError(t, err)
+	assert.Len(t, tokens, 1)
+	assert.NotNil(t, tokens[0].LastUsed)
+
+	err = store.DeleteAccessToken(&tokens[0])
+	assert.NoError(t, err)
+
+	_, err = store.GetAccessTokenByHash("hash")
+	assert.Error(t, err)
+}
+
+func testRetention(t *testing.T, store database.Store) {
+	createUser(t, store, "alice", user.User)
+
+	store.CreateImage(&images.ImageModel{Name: "Fedora", UUID: "fedora", Username: "alice"})
+	store.CreateNewImageVersion(images.Version{Version: 1, ImageModelUUID: "fedora"})
+	store.CreateNewImageVersion(images.Version{Version: 2, ImageModelUUID: "fedora"})
+
+	all, err := store.GetImages()
+	assert.NoError(t, err)
+	assert.Len(t, all, 1)
+	assert.Len(t, all[0].Versions, 3)
+
+	err = store.CreateImageSetup("alice", &images.ImageSetup{Name: "setup", Username: "alice", UUID: "setup"})
+	assert.NoError(t, err)
+
+	setup, err := store.GetImageSetup("setup")
+	assert.NoError(t, err)
+	store.AddImageToImageSetup(&setup, &all[0], all[0].Versions[1], false)
+
+	pinned, err := store.GetPinnedVersions()
+	assert.NoError(t, err)
+	assert.Equal(t, []uint64{uint64(all[0].Versions[1].ID)}, pinned)
+
+	err = store.DeleteVersion(&all[0].Versions[0])
+	assert.NoError(t, err)
+
+	image, err := store.GetImageByUUID("fedora")
+	assert.NoError(t, err)
+	assert.Len(t, image.Versions, 2)
+
+	policy := images.RetentionPolicy{KeepLast: 3, KeepDays: 7}
+	err = store.SetImageRetention("fedora", policy)
+	assert.NoError(t, err)
+
+	err = store.SetUserRetention("alice", images.RetentionPolicy{KeepLast: 1})
+	assert.NoError(t, err)
+
+	image, err = store.GetImageByUUID("fedora")
+	assert.NoError(t, err)
+	assert.Equal(t, policy, image.Retention)
+
+	alice, err := store.GetUserByUsername("alice")
+	assert.NoError(t, err)
+	assert.Equal(t, uint(1), alice.Retention.KeepLast)
+
+	// Policies can be switched off again
+	err = store.SetImageRetention("fedora", images.RetentionPolicy{})
+	assert.NoError(t, err)
+
+	image, err = store.GetImageByUUID("fedora")
+	assert.NoError(t, err)
+	assert.False(t, image.Retention.IsSet())
+
+	err = store.SetImageCompression("fedora", images.DiskCompressionStrategyZSTD)
+	assert.NoError(t, err)
+
+	image, err = store.GetImageByUUID("fedora")
+	assert.NoError(t, err)
+	assert.Equal(t, images.DiskCompressionStrategy(images.DiskCompressionStrategyZSTD), image.DiskCompressionStrategy)
+	assert.Len(t, image.Versions, 2)
+
+	// Raw is the zero value, it has to be set like any other type
+	for _, diskType := range []images.DiskType{images.DiskTypeQCow2, images.DiskTypeRaw} {
+		err = store.SetImageFileType("fedora", diskType)
+		assert.NoError(t, err)
+
+		image, err = store.GetImageByUUID("fedora")
+		assert.NoError(t, err)
+		assert.Equal(t, diskType, image.ImageFileType)
+		assert.Equal(t, images.DiskCompressionStrategy(images.DiskCompressionStrategyZSTD), image.DiskCompressionStrategy)
+	}
+}
+
+func testUploads(t *testing.T, store database.Store) {
+	createUser(t, store, "alice", user.User)
+	store.CreateImage(&images.ImageModel{Name: "Fedora", UUID: "fedora", Username: "alice"})
+
+	_, err := store.GetUpload("upload")
+	assert.Error(t, err)
+
+	err = store.CreateUpload(&images.UploadModel{UUID: "upload", ImageModelUUID: "fedora", NewVersion: true, Size: 42})
+	assert.NoError(t, err)
+
+	upload, err := store.GetUpload("upload")
+	assert.NoError(t, err)
+	assert.Equal(t, images.ImageUUID("fedora"), upload.ImageModelUUID)
+	assert.True(t, upload.NewVersion)
+	assert.Equal(t, int64(42), upload.Size)
+	assert.False(t, upload.CreatedAt.IsZero())
+
+	uploads, err := store.GetUploads()
+	assert.NoError(t, err)
+	assert.Len(t, uploads, 1)
+
+	err = store.DeleteUpload(upload)
+	assert.NoError(t, err)
+
+	_, err = store.GetUpload("upload")
+	assert.Error(t, err)
+
+	uploads, err = store.GetUploads()
+	assert.NoError(t, err)
+	assert.Len(t, uploads, 0)
+}
+
+func testSignatures(t *testing.T, store database.Store) {
+	createUser(t, store, "alice", user.User)
+	store.CreateImage(&images.ImageModel{Name: "Fedora", UUID: "fedora", Username: "alice"})
+	store.CreateNewImageVersion(images.Version{Version: 1, ImageModelUUID: "fedora"})
+
+	err := store.CreateSigningKey(&user.SigningKeyModel{UUID: "key", Username: "alice", PublicKey: []byte("public")})
+	assert.NoError(t, err)
+
+	key, err := store.GetSigningKey("key")
+	assert.NoError(t, err)
+	assert.Equal(t, "alice", key.Username)
+	assert.Equal(t, []byte("public"), key.PublicKey)
+
+	keys, err := store.GetSigningKeysByUsername("alice")
+	assert.NoError(t, err)
+	assert.Len(t, keys, 1)
+
+	image, err := store.GetImageByUUID("fedora")
+	assert.NoError(t, err)
+
+	for _, version := range image.Versions {
+		err = store.AddVersionSignature(&images.VersionSignature{VersionID: version.ID, KeyUUID: "key",
+			Signature: []byte("signature")})
+		assert.NoError(t, err)
+	}
+
+	signatures, err := store.GetVersionSignatures(image.Versions[1].ID)
+	assert.NoError(t, err)
+	assert.Len(t, signatures, 1)
+	assert.Equal(t, "key", signatures[0].KeyUUID)
+	assert.Equal(t, []byte("signature"), signatures[0].Signature)
+
+	// The signatures go together with their version
+	err = store.DeleteVersion(&image.Versions[0])
+	assert.NoError(t, err)
+
+	signatures, err = store.GetVersionSignatures(image.Versions[0].ID)
+	assert.NoError(t, err)
+	assert.Len(t, signatures, 0)
+
+	signatures, err = store.GetVersionSignatures(image.Versions[1].ID)
+	assert.NoError(t, err)
+	assert.Len(t, signatures, 1)
+
+	err = store.DeleteSigningKey(key)
+	assert.NoError(t, err)
+
+	_, err = store.GetSigningKey("key")
+	assert.Error(t, err)
+}
+
+func testStatuses(t *testing.T, store database.Store) {
+	createMachine(t, store, "abc")
+	createMachine(t, store, "cba")
+
+	statuses, err := store.GetMachineStatuses("abc", 0)
+	assert.NoError(t, err)
+	assert.Empty(t, statuses)
+
+	phases := []machine.ProvisioningPhase{machine.PhaseInitializing, machine.PhaseRequesting, machine.PhaseWriting}
+	for _, phase := range phases {
+		err = store.AddMachineStatus(&machine.StatusModel{MachineMAC: "abc", Phase: phase, Time: time.Now()})
+		assert.NoError(t, err)
+	}
+
+	err = store.AddMachineStatus(&machine.StatusModel{MachineMAC: "cba", Phase: machine.PhaseFailed, Time: time.Now()})
+	assert.NoError(t, err)
+
+	statuses, err = store.GetMachineStatuses("abc", 0)
+	assert.NoError(t, err)
+	assert.Len(t, statuses, 3)
+	for i, status := range statuses {
+		assert.Equal(t, phases[i], status.Phase)
+	}
+
+	// The limit keeps the latest statuses
+	statuses, err = store.GetMachineStatuses("abc", 2)
+	assert.NoError(t, err)
+	assert.Len(t, statuses, 2)
+	assert.Equal(t, machine.PhaseRequesting, statuses[0].Phase)
+	assert.Equal(t, machine.PhaseWriting, statuses[1].Phase)
+
+	// The statuses belong to the machine
+	m, err := store.GetMachineByMac(util.MacAddress{Address: "abc"})
+	assert.NoError(t, err)
+	assert.NoError(t, store.DeleteMachine(m))
+
+	statuses, err = store.GetMachineStatuses("abc", 0)
+	assert.NoError(t, err)
+	assert.Empty(t, statuses)
+
+	statuses, err = store.GetMachineStatuses("cba", 0)
+	assert.NoError(t, err)
+	assert.Len(t, statuses, 1)
+}
+
+func testInventories(t *testing.T, store database.Store) {
+	createMachine(t, store, "abc")
+	createMachine(t, store, "cba")
+
+	_, err := store.GetMachineInventory("abc")
+	assert.Error(t, err)
+
+	inventory := machine.InventoryModel{
+		MachineMAC: "abc",
+		CPUModel:   "AMD EPYC 7302P 16-Core Processor",
+		CPUCores:   16,
+		CPUThreads: 32,
+		Memory:     64 << 30,
+		Disks:      machine.Disks{{Name: "nvme0n1", Model: "Samsung SSD 970", Size: 500 << 30}},
+		NICs:       machine.NICs{{Name: "eno1", MacAddress: "abc", Driver: "igb", Speed: 1000}},
+		Firmware:   machine.UEFI,
+		Time:       time.Now(),
+	}
+	assert.NoError(t, store.SetMachineInventory(&inventory))
+	assert.NoError(t, store.SetMachineInventory(&machine.InventoryModel{MachineMAC: "cba", Time: time.Now()}))
+
+	stored, err := store.GetMachineInventory("abc")
+	assert.NoError(t, err)
+	assert.Equal(t, inventory.CPUModel, stored.CPUModel)
+	assert.Equal(t, 16, stored.CPUCores)
+	assert.Equal(t, uint64(64<<30), stored.Memory)
+	assert.Equal(t, inventory.Disks, stored.Disks)
+	assert.Equal(t, inventory.NICs, stored.NICs)
+	assert.Equal(t, machine.UEFI, stored.Firmware)
+	assert.False(t, stored.Approved)
+
+	// A machine has one inventory, a new one replaces it
+	inventory.Memory = 128 << 30
+	inventory.Approved = true
+	assert.NoError(t, store.SetMachineInventory(&inventory))
+
+	stored, err = store.GetMachineInventory("abc")
+	assert.NoError(t, err)
+	assert.Equal(t, uint64(128<<30), stored.Memory)
+	assert.True(t, stored.Approved)
+
+	inventories, err := store.GetMachineInventories()
+	assert.NoError(t, err)
+	assert.Len(t, inventories, 2)
+
+	// The inventory belongs to the machine
+	m, err := store.GetMachineByMac(util.MacAddress{Address: "abc"})
+	assert.NoError(t, err)
+	assert.NoError(t, store.DeleteMachine(m))
+
+	_, err = store.GetMachineInventory("abc")
+	assert.Error(t, err)
+
+	inventories, err = store.GetMachineInventories()
+	assert.NoError(t, err)
+	assert.Len(t, inventories, 1)
+}
+
+func testPower(t *testing.T, store database.Store) {
+	createMachine(t, store, "abc")
+
+	_, err := store.GetMachinePower("abc")
+	assert.Error(t, err)
+
+	power := machine.PowerModel{MachineMAC: "abc", Driver: "ipmi", Address: "10.0.0.2", Username: "admin"}
+	assert.NoError(t, store.SetMachinePower(&power))
+
+	// A machine has one power controller, setting another replaces it
+	power = machine.PowerModel{MachineMAC: "abc", Driver: "redfish", Address: "bmc.example.com", SystemID: "1"}
+	assert.NoError(t, store.SetMachinePower(&power))
+
+	stored, err := store.GetMachinePower("abc")
+	assert.NoError(t, err)
+	assert.Equal(t, "redfish", stored.Driver)
+	assert.Equal(t, "bmc.example.com", stored.Address)
+	assert.Equal(t, "1", stored.SystemID)
+	assert.Empty(t, stored.Username)
+
+	assert.NoError(t, store.DeleteMachinePower("abc"))
+	_, err = store.GetMachinePower("abc")
+	assert.Error(t, err)
+
+	// The power controller belongs to the machine
+	assert.NoError(t, store.SetMachinePower(&power))
+	m, err := store.GetMachineByMac(util.MacAddress{Address: "abc"})
+	assert.NoError(t, err)
+	assert.NoError(t, store.DeleteMachine(m))
+
+	_, err = store.GetMachinePower("abc")
+	assert.Error(t, err)
+}
@@ -0,0 +1,316 @@
+// Copyright (c) 2020-2022 TU Delft & Valentijn van de Beek <v.d.vandebeek@student.tudelft.nl> All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package diskimage reads and writes the formats disk images are stored in. Raw images hold every byte of the
+// disk, qcow2 and sparse images leave out the parts of the disk which are zero. Images are read from the start
+// to the end as a series of extents, so they can be expanded while they are downloaded.
+package diskimage
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+
+	"github.com/baas-project/baas/pkg/model/images"
+	"github.com/pkg/errors"
+)
+
+var (
+	// ErrNotStreamable is returned when a qcow2 image cannot be read from the start to the end, because its
+	// tables come after the data they describe. It can still be read with OpenQCow2 and written out again.
+	ErrNotStreamable = errors.New("the layout of the qcow2 image cannot be read as a stream")
+	// ErrUnsupported is returned for images which use a feature this package does not implement
+	ErrUnsupported = errors.New("unsupported disk image feature")
+)
+
+// Extent is a part of the disk which holds data, the parts of the disk between extents are zero
+type Extent struct {
+	Offset int64
+	Data   []byte
+}
+
+// Image is a disk image which is read from the start to the end
+type Image interface {
+	// Next returns the next extent, the extents are in order and do not overlap. After the last extent it
+	// returns io.EOF. The data is only valid until the next call.
+	Next() (Extent, error)
+	// Size is the size of the disk in bytes. For raw images it is only known after Next returned io.EOF.
+	Size() int64
+}
+
+// magics is how the images of every type but raw start
+var magics = map[images.DiskType][]byte{
+	images.DiskTypeQCow2:  qcow2Magic,
+	images.DiskTypeSparse: sparseMagic,
+}
+
+// Detect recognises the type of the image by its first bytes, images which are not recognised are raw. The
+// returned reader still yields the whole image.
+func Detect(r io.Reader) (images.DiskType, io.Reader, error) {
+	buffered := bufio.NewReader(r)
+
+	head, err := buffered.Peek(4)
+	if err != nil && err != io.EOF {
+		return images.DiskTypeRaw, nil, errors.Wrap(err, "read the start of the image")
+	}
+
+	for diskType, magic := range magics {
+		if bytes.HasPrefix(head, magic) {
+			return diskType, buffered, nil
+		}
+	}
+
+	return images.DiskTypeRaw, buffered, nil
+}
+
+// Open detects the type of the image and reads it
+func Open(r io.Reader) (images.DiskType, Image, error) {
+	diskType, r, err := Detect(r)
+	if err != nil {
+		return diskType, nil, err
+	}
+
+	var image Image
+	switch diskType {
+	case images.DiskTypeQCow2:
+		image, err = NewQCow2Reader(r)
+	case images.DiskTypeSparse:
+		image, err = NewSparseReader(r)
+	default:
+		image = NewRawReader(r)
+	}
+
+	return diskType, image, err
+}
+
+// zeroImage is a disk which only holds zeros
+type zeroImage struct {
+	size int64
+}
+
+// Zero returns an empty disk of the given size
+func Zero(size int64) Image {
+	return &zeroImage{size: size}
+}
+
+func (z *zeroImage) Next() (Extent, error) {
+	return Extent{}, io.EOF
+}
+
+func (z *zeroImage) Size() int64 {
+	return z.size
+}
+
+// expandReader returns every byte of the disk, the zeros between the extents are filled in
+type expandReader struct {
+	image  Image
+	offset int64
+	extent Extent
+	done   bool
+}
+
+// NewReader returns the contents of the disk as they end up on a partition
+func NewReader(image Image) io.Reader {
+	return &expandReader{image: image}
+}
+
+func (e *expandReader) Read(p []byte) (int, error) {
+	for len(e.extent.Data) == 0 && e.extent.Offset <= e.offset && !e.done {
+		extent, err := e.image.Next()
+		if err == io.EOF {
+			e.done = true
+			break
+		} else if err != nil {
+			return 0, err
+		}
+
+		if extent.Offset < e.offset {
+			return 0, errors.Errorf("extent at %d overlaps the data before %d", extent.Offset, e.offset)
+		}
+
+		e.extent = extent
+	}
+
+	end := e.extent.Offset
+	if e.done {
+		end = e.image.Size()
+	}
+
+	if e.offset >= end && len(e.extent.Data) == 0 {
+		return 0, io.EOF
+	}
+
+	var n int
+	if e.offset < end {
+		// Zeros up to the next extent
+		n = len(p)
+		if int64(n) > end-e.offset {
+			n = int(end - e.offset)
+		}
+
+		for i := range p[:n] {
+			p[i] = 0
+		}
+	} else {
+		n = copy(p, e.extent.Data)
+		e.extent.Data = e.extent.Data[n:]
+		e.extent.Offset += int64(n)
+	}
+
+	e.offset += int64(n)
+	return n, nil
+}
+
+// Digest computes the hex encoded SHA-256 and the size of the contents of the disk in the image, whatever its
+// type. This is the digest of the partition the image is written to.
+func Digest(r io.Reader) (string, int64, images.DiskType, error) {
+	diskType, image, err := Open(r)
+	if err != nil {
+		return "", 0, diskType, err
+	}
+
+	h := sha256.New()
+	size, err := io.Copy(h, NewReader(image))
+	if err != nil {
+		return "", 0, diskType, errors.Wrap(err, "read image")
+	}
+
+	return hex.EncodeToString(h.Sum(nil)), size, diskType, nil
+}
+
+// Write writes the disk as an image of the given type. Qcow2 and sparse images list the parts of the disk
+// before the data, so the disk is read twice: open has to return a new reader of the same disk every time.
+func Write(w io.Writer, diskType images.DiskType, open func() (Image, error)) error {
+	switch diskType {
+	case images.DiskTypeRaw:
+		image, err := open()
+		if err != nil {
+			return err
+		}
+
+		_, err = io.Copy(w, NewReader(image))
+		return errors.Wrap(err, "write raw image")
+	case images.DiskTypeQCow2:
+		return WriteQCow2(w, open)
+	case images.DiskTypeSparse:
+		return WriteSparse(w, open)
+	default:
+		return errors.Errorf("unknown disk type %d", diskType)
+	}
+}
+
+// run is a series of consecutive blocks which hold data
+type run struct {
+	start int64
+	count int64
+}
+
+// layout is the first pass over a disk: its size and which blocks of the given size hold data
+type layout struct {
+	size int64
+	runs []run
+}
+
+// blocks returns how many blocks hold data
+func (l *layout) blocks() int64 {
+	var blocks int64
+	for _, r := range l.runs {
+		blocks += r.count
+	}
+
+	return blocks
+}
+
+// scan reads the image and returns which blocks have data, in order
+func scan(image Image, blockSize int64) (*layout, error) {
+	l := &layout{}
+
+	for {
+		extent, err := image.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, err
+		}
+
+		if len(extent.Data) == 0 {
+			continue
+		}
+
+		first := extent.Offset / blockSize
+		last := (extent.Offset + int64(len(extent.Data)) - 1) / blockSize
+
+		// Extents which share a block or follow each other extend the last run
+		if n := len(l.runs); n > 0 && l.runs[n-1].start+l.runs[n-1].count >= first {
+			if end := last + 1; end > l.runs[n-1].start+l.runs[n-1].count {
+				l.runs[n-1].count = end - l.runs[n-1].start
+			}
+
+			continue
+		}
+
+		l.runs = append(l.runs, run{start: first, count: last - first + 1})
+	}
+
+	l.size = image.Size()
+	return l, nil
+}
+
+// blockReader turns the extents of an image into whole blocks, a block is filled with zeros where no
+// extent covers it
+type blockReader struct {
+	image     Image
+	blockSize int64
+	extent    Extent
+	done      bool
+}
+
+// block returns the contents of the block, the blocks have to be requested in order
+func (b *blockReader) block(index int64, buf []byte) error {
+	start := index * b.blockSize
+	end := start + b.blockSize
+
+	for i := range buf {
+		buf[i] = 0
+	}
+
+	for !b.done {
+		if len(b.extent.Data) == 0 {
+			extent, err := b.image.Next()
+			if err == io.EOF {
+				b.done = true
+				break
+			} else if err != nil {
+				return err
+			}
+
+			b.extent = extent
+			continue
+		}
+
+		if b.extent.Offset >= end {
+			break
+		}
+
+		// Data before the block belongs to blocks which were not requested, it is skipped
+		if b.extent.Offset < start {
+			skip := start - b.extent.Offset
+			if skip >= int64(len(b.extent.Data)) {
+				b.extent.Data = nil
+				continue
+			}
+
+			b.extent.Data = b.extent.Data[skip:]
+			b.extent.Offset = start
+		}
+
+		n := copy(buf[b.extent.Offset-start:], b.extent.Data)
+		b.extent.Data = b.extent.Data[n:]
+		b.extent.Offset += int64(n)
+	}
+
+	return nil
+}
@@ -0,0 +1,364 @@
+// Copyright (c) 2020-2022 TU Delft & Valentijn van de Beek <v.d.vandebeek@student.tudelft.nl> All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package diskimage
+
+import (
+	"bytes"
+	"compress/flate"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"io"
+	"io/ioutil"
+	"testing"
+
+	"github.com/baas-project/baas/pkg/model/images"
+	"github.com/stretchr/testify/assert"
+)
+
+// testDisk creates a disk of the given size which is zero apart from a few places
+func testDisk(size int) []byte {
+	disk := make([]byte, size)
+	for _, offset := range []int{0, 100, 70000, 70001, 300000, size - 1} {
+		if offset >= 0 && offset < size {
+			disk[offset] = byte(offset%251) + 1
+		}
+	}
+
+	if size > 200000 {
+		copy(disk[200000:], bytes.Repeat([]byte("baas"), 5000))
+	}
+
+	return disk
+}
+
+// expand reads the whole disk in the image
+func expand(t *testing.T, image Image) []byte {
+	data, err := ioutil.ReadAll(NewReader(image))
+	assert.NoError(t, err)
+	return data
+}
+
+// rawOpener opens the disk as a raw image every time
+func rawOpener(disk []byte) func() (Image, error) {
+	return func() (Image, error) {
+		return NewRawReader(bytes.NewReader(disk)), nil
+	}
+}
+
+func TestRawReader(t *testing.T) {
+	disk := testDisk(1000000)
+
+	// Only the blocks with data are returned
+	image := NewRawReader(bytes.NewReader(disk))
+	var extents int
+	for {
+		extent, err := image.Next()
+		if err == io.EOF {
+			break
+		}
+
+		assert.NoError(t, err)
+		assert.False(t, isZero(extent.Data))
+		extents++
+	}
+
+	assert.Equal(t, int64(len(disk)), image.Size())
+	assert.Less(t, extents, len(disk)/rawBlockSize)
+
+	assert.Equal(t, disk, expand(t, NewRawReader(bytes.NewReader(disk))))
+	assert.Equal(t, []byte{}, expand(t, NewRawReader(bytes.NewReader(nil))))
+}
+
+func TestQCow2(t *testing.T) {
+	// The size does not have to be a whole number of clusters
+	for _, size := range []int{0, 1000, 1000000, 10 * 1024 * 1024} {
+		disk := testDisk(size)
+
+		var image bytes.Buffer
+		assert.NoError(t, Write(&image, images.DiskTypeQCow2, rawOpener(disk)))
+
+		// The zeros are left out
+		if size == 10*1024*1024 {
+			assert.Less(t, image.Len(), 1024*1024)
+		}
+
+		diskType, stream, err := Open(bytes.NewReader(image.Bytes()))
+		assert.NoError(t, err)
+		assert.Equal(t, images.DiskTypeQCow2, diskType)
+		assert.Equal(t, int64(size), stream.Size())
+		assert.Equal(t, disk, expand(t, stream), size)
+
+		file, err := OpenQCow2(bytes.NewReader(image.Bytes()))
+		assert.NoError(t, err)
+		assert.Equal(t, disk, expand(t, file), size)
+	}
+}
+
+// qcow2Header512 creates the header of a version 3 image with clusters of 512 bytes
+func qcow2Header512(size uint64, l1Offset uint64) []byte {
+	header := make([]byte, 512)
+	copy(header, qcow2Magic)
+	binary.BigEndian.PutUint32(header[4:], 3)
+	binary.BigEndian.PutUint32(header[20:], 9)
+	binary.BigEndian.PutUint64(header[24:], size)
+	binary.BigEndian.PutUint32(header[36:], 1)
+	binary.BigEndian.PutUint64(header[40:], l1Offset)
+	binary.BigEndian.PutUint32(header[100:], qcow2HeaderV3)
+	return header
+}
+
+func TestQCow2NotStreamable(t *testing.T) {
+	// The data comes before the tables pointing to it
+	image := qcow2Header512(1024, 1024)
+	image = append(image, bytes.Repeat([]byte("a"), 512)...)
+
+	l1 := make([]byte, 512)
+	binary.BigEndian.PutUint64(l1, 1536)
+	image = append(image, l1...)
+
+	l2 := make([]byte, 512)
+	binary.BigEndian.PutUint64(l2[8:], 512|qcow2Copied)
+	image = append(image, l2...)
+
+	stream, err := NewQCow2Reader(bytes.NewReader(image))
+	assert.NoError(t, err)
+
+	_, err = stream.Next()
+	assert.Equal(t, ErrNotStreamable, err)
+
+	// With random access it can be read, and written out in a layout which can be streamed
+	file, err := OpenQCow2(bytes.NewReader(image))
+	assert.NoError(t, err)
+
+	expected := append(make([]byte, 512), bytes.Repeat([]byte("a"), 512)...)
+	assert.Equal(t, expected, expand(t, file))
+
+	var converted bytes.Buffer
+	err = WriteQCow2(&converted, func() (Image, error) {
+		return OpenQCow2(bytes.NewReader(image))
+	})
+	assert.NoError(t, err)
+
+	stream, err = NewQCow2Reader(&converted)
+	assert.NoError(t, err)
+	assert.Equal(t, expected, expand(t, stream))
+}
+
+// deflate compresses the cluster like qemu does
+func deflate(t *testing.T, data []byte) []byte {
+	var buf bytes.Buffer
+	w, err := flate.NewWriter(&buf, flate.BestCompression)
+	assert.NoError(t, err)
+	_, err = w.Write(data)
+	assert.NoError(t, err)
+	assert.NoError(t, w.Close())
+	return buf.Bytes()
+}
+
+func TestQCow2Compressed(t *testing.T) {
+	// Two compressed clusters packed into the same sector
+	first := deflate(t, bytes.Repeat([]byte("b"), 512))
+	second := deflate(t, bytes.Repeat([]byte("c"), 512))
+
+	image := qcow2Header512(1024, 512)
+
+	l1 := make([]byte, 512)
+	binary.BigEndian.PutUint64(l1, 1024)
+	image = append(image, l1...)
+
+	// With clusters of 512 bytes the offset has 61 bits and the number of extra sectors one bit
+	l2 := make([]byte, 512)
+	binary.BigEndian.PutUint64(l2, qcow2Compressed|uint64(1536+100))
+	binary.BigEndian.PutUint64(l2[8:], qcow2Compressed|uint64(1536+100+len(first)))
+	image = append(image, l2...)
+
+	data := make([]byte, 512)
+	copy(data[100:], first)
+	copy(data[100+len(first):], second)
+	image = append(image, data...)
+
+	expected := append(bytes.Repeat([]byte("b"), 512), bytes.Repeat([]byte("c"), 512)...)
+
+	stream, err := NewQCow2Reader(bytes.NewReader(image))
+	assert.NoError(t, err)
+	assert.Equal(t, expected, expand(t, stream))
+
+	file, err := OpenQCow2(bytes.NewReader(image))
+	assert.NoError(t, err)
+	assert.Equal(t, expected, expand(t, file))
+}
+
+func TestQCow2Unsupported(t *testing.T) {
+	image := qcow2Header512(1024, 512)
+	binary.BigEndian.PutUint64(image[8:], 4096)
+
+	_, err := NewQCow2Reader(bytes.NewReader(image))
+	assert.Error(t, err)
+
+	image = qcow2Header512(1024, 512)
+	binary.BigEndian.PutUint64(image[72:], 1<<2)
+
+	_, err = NewQCow2Reader(bytes.NewReader(image))
+	assert.Error(t, err)
+
+	// An L1 table larger than the size needs, one entry describes 32 KiB
+	image = qcow2Header512(1024, 512)
+	binary.BigEndian.PutUint32(image[36:], 2)
+
+	_, err = NewQCow2Reader(bytes.NewReader(image))
+	assert.Error(t, err)
+
+	_, err = OpenQCow2(bytes.NewReader(image))
+	assert.Error(t, err)
+}
+
+func TestQCow2HugeL1Table(t *testing.T) {
+	// Just a header, with a size for which the largest L1 table would fit
+	image := qcow2Header512(1<<62, 512)[:qcow2HeaderV3]
+	binary.BigEndian.PutUint32(image[36:], 0xffffffff)
+
+	_, _, _, err := Digest(bytes.NewReader(image))
+	assert.Error(t, err)
+
+	_, err = NewQCow2Reader(bytes.NewReader(image))
+	assert.Error(t, err)
+
+	_, err = OpenQCow2(bytes.NewReader(image))
+	assert.Error(t, err)
+
+	// Both limits hold on their own
+	binary.BigEndian.PutUint64(image[24:], 1<<30)
+	_, err = NewQCow2Reader(bytes.NewReader(image))
+	assert.Error(t, err)
+
+	binary.BigEndian.PutUint64(image[24:], 1<<62)
+	binary.BigEndian.PutUint32(image[36:], 1)
+	_, err = NewQCow2Reader(bytes.NewReader(image))
+	assert.Error(t, err)
+}
+
+func TestQCow2LargeL1Table(t *testing.T) {
+	// An L1 table of three clusters which only points to an L2 table in its last entry
+	entries := 3 * 64
+	l1Offset := 512
+	l2Offset := l1Offset + entries*8
+	size := uint64(entries) * 64 * 512
+
+	image := qcow2Header512(size, uint64(l1Offset))
+	binary.BigEndian.PutUint32(image[36:], uint32(entries))
+
+	l1 := make([]byte, entries*8)
+	binary.BigEndian.PutUint64(l1[(entries-1)*8:], uint64(l2Offset))
+	image = append(image, l1...)
+
+	l2 := make([]byte, 512)
+	binary.BigEndian.PutUint64(l2, uint64(l2Offset+512)|qcow2Copied)
+	image = append(image, l2...)
+	image = append(image, bytes.Repeat([]byte("d"), 512)...)
+
+	expected := make([]byte, size)
+	copy(expected[size-64*512:], bytes.Repeat([]byte("d"), 512))
+
+	stream, err := NewQCow2Reader(bytes.NewReader(image))
+	assert.NoError(t, err)
+	assert.Equal(t, expected, expand(t, stream))
+
+	file, err := OpenQCow2(bytes.NewReader(image))
+	assert.NoError(t, err)
+	assert.Equal(t, expected, expand(t, file))
+}
+
+func TestSparse(t *testing.T) {
+	for _, size := range []int{0, 1024, 1000448, 10 * 1024 * 1024} {
+		disk := testDisk(size)
+
+		var image bytes.Buffer
+		assert.NoError(t, Write(&image, images.DiskTypeSparse, rawOpener(disk)))
+
+		if size == 10*1024*1024 {
+			assert.Less(t, image.Len(), 1024*1024)
+		}
+
+		diskType, sparse, err := Open(bytes.NewReader(image.Bytes()))
+		assert.NoError(t, err)
+		assert.Equal(t, images.DiskTypeSparse, diskType)
+		assert.Equal(t, disk, expand(t, sparse), size)
+	}
+
+	// Only whole sectors fit in a sparse image
+	err := WriteSparse(ioutil.Discard, rawOpener(make([]byte, 1000)))
+	assert.Error(t, err)
+}
+
+func TestSparseChunks(t *testing.T) {
+	chunk := func(kind uint16, blocks uint32, payload []byte) []byte {
+		header := make([]byte, sparseChunkHeaderSize)
+		binary.LittleEndian.PutUint16(header, kind)
+		binary.LittleEndian.PutUint32(header[4:], blocks)
+		binary.LittleEndian.PutUint32(header[8:], uint32(sparseChunkHeaderSize+len(payload)))
+		return append(header, payload...)
+	}
+
+	image := make([]byte, sparseHeaderSize)
+	copy(image, sparseMagic)
+	binary.LittleEndian.PutUint16(image[4:], 1)
+	binary.LittleEndian.PutUint16(image[8:], sparseHeaderSize)
+	binary.LittleEndian.PutUint16(image[10:], sparseChunkHeaderSize)
+	binary.LittleEndian.PutUint32(image[12:], 512)
+	binary.LittleEndian.PutUint32(image[16:], 4)
+	binary.LittleEndian.PutUint32(image[20:], 4)
+
+	image = append(image, chunk(sparseRaw, 1, bytes.Repeat([]byte("x"), 512))...)
+	image = append(image, chunk(sparseFill, 1, []byte{1, 2, 3, 4})...)
+	image = append(image, chunk(sparseDontCare, 1, nil)...)
+	image = append(image, chunk(sparseCRC32, 0, []byte{0, 0, 0, 0})...)
+
+	expected := bytes.Repeat([]byte("x"), 512)
+	expected = append(expected, bytes.Repeat([]byte{1, 2, 3, 4}, 128)...)
+	expected = append(expected, make([]byte, 1024)...)
+
+	sparse, err := NewSparseReader(bytes.NewReader(image))
+	assert.NoError(t, err)
+	assert.Equal(t, expected, expand(t, sparse))
+}
+
+func TestConvert(t *testing.T) {
+	disk := testDisk(1000448)
+	hash := sha256.Sum256(disk)
+
+	// Every type can be converted into every other type without changing the disk
+	var qcow2, sparse, raw bytes.Buffer
+	assert.NoError(t, Write(&qcow2, images.DiskTypeQCow2, rawOpener(disk)))
+
+	assert.NoError(t, Write(&sparse, images.DiskTypeSparse, func() (Image, error) {
+		return NewQCow2Reader(bytes.NewReader(qcow2.Bytes()))
+	}))
+
+	assert.NoError(t, Write(&raw, images.DiskTypeRaw, func() (Image, error) {
+		return NewSparseReader(bytes.NewReader(sparse.Bytes()))
+	}))
+
+	assert.Equal(t, disk, raw.Bytes())
+
+	for _, image := range [][]byte{disk, qcow2.Bytes(), sparse.Bytes()} {
+		digest, size, _, err := Digest(bytes.NewReader(image))
+		assert.NoError(t, err)
+		assert.Equal(t, hex.EncodeToString(hash[:]), digest)
+		assert.Equal(t, int64(len(disk)), size)
+	}
+}
+
+func TestDetect(t *testing.T) {
+	for _, data := range [][]byte{nil, []byte("Q"), []byte("hello world")} {
+		diskType, r, err := Detect(bytes.NewReader(data))
+		assert.NoError(t, err)
+		assert.Equal(t, images.DiskTypeRaw, diskType)
+
+		read, err := ioutil.ReadAll(r)
+		assert.NoError(t, err)
+		assert.Equal(t, len(data), len(read))
+	}
+}
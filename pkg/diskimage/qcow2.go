@@ -0,0 +1,644 @@
+// Copyright (c) 2020-2022 TU Delft & Valentijn van de Beek <v.d.vandebeek@student.tudelft.nl> All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package diskimage
+
+import (
+	"bufio"
+	"bytes"
+	"compress/flate"
+	"container/heap"
+	"encoding/binary"
+	"io"
+	"io/ioutil"
+
+	"github.com/pkg/errors"
+)
+
+// The qcow2 format is described in docs/interop/qcow2.txt of qemu. Backing files, encryption, external data
+// files and extended L2 entries are not supported, neither are compressed clusters which do not use deflate.
+var qcow2Magic = []byte{'Q', 'F', 'I', 0xfb}
+
+const (
+	// qcow2HeaderV2 and qcow2HeaderV3 are the sizes of the headers of version 2 and 3
+	qcow2HeaderV2 = 72
+	qcow2HeaderV3 = 104
+
+	// qcow2OffsetMask selects the offset of an L2 table in an L1 entry, or of a cluster in an L2 entry
+	qcow2OffsetMask = 0x00fffffffffffe00
+	// qcow2Copied is set on entries which point to a cluster which is only used once
+	qcow2Copied = 1 << 63
+	// qcow2Compressed is set on L2 entries of compressed clusters
+	qcow2Compressed = 1 << 62
+	// qcow2Zero is set on L2 entries of clusters which read as zeros, only in version 3
+	qcow2Zero = 1
+
+	// qcow2Dirty is the only incompatible feature which can be ignored, it only concerns the refcounts
+	qcow2Dirty = 1
+
+	// qcow2ClusterBits is the cluster size of the images which are written, 64 KiB like qemu uses
+	qcow2ClusterBits = 16
+	// qcow2RefcountOrder gives the written images 16 bit refcounts
+	qcow2RefcountOrder = 4
+
+	// qcow2MaxL1Size is the largest L1 table in bytes, the limit qemu has as well
+	qcow2MaxL1Size = 32 * 1024 * 1024
+	// qcow2MaxSize is the largest disk which is read, far more than any disk of a machine holds
+	qcow2MaxSize = 64 << 40
+)
+
+// qcow2Header holds the fields of the header which are needed to read the image
+type qcow2Header struct {
+	version     uint32
+	clusterBits uint32
+	size        int64
+	l1Size      int64
+	l1Offset    int64
+}
+
+func (h *qcow2Header) clusterSize() int64 {
+	return 1 << h.clusterBits
+}
+
+// l2Entries is how many clusters an L2 table describes
+func (h *qcow2Header) l2Entries() int64 {
+	return h.clusterSize() / 8
+}
+
+// parseQCow2Header reads the header, buf holds the header of version 2 and if it is version 3 also the rest
+func parseQCow2Header(buf []byte) (*qcow2Header, error) {
+	if !bytes.HasPrefix(buf, qcow2Magic) {
+		return nil, errors.New("not a qcow2 image")
+	}
+
+	h := &qcow2Header{
+		version:     binary.BigEndian.Uint32(buf[4:]),
+		clusterBits: binary.BigEndian.Uint32(buf[20:]),
+		size:        int64(binary.BigEndian.Uint64(buf[24:])),
+		l1Size:      int64(binary.BigEndian.Uint32(buf[36:])),
+		l1Offset:    int64(binary.BigEndian.Uint64(buf[40:])),
+	}
+
+	switch {
+	case h.version != 2 && h.version != 3:
+		return nil, errors.Wrapf(ErrUnsupported, "qcow2 version %d", h.version)
+	case binary.BigEndian.Uint64(buf[8:]) != 0:
+		return nil, errors.Wrap(ErrUnsupported, "qcow2 backing file")
+	case binary.BigEndian.Uint32(buf[32:]) != 0:
+		return nil, errors.Wrap(ErrUnsupported, "qcow2 encryption")
+	case h.clusterBits < 9 || h.clusterBits > 21:
+		return nil, errors.Errorf("invalid qcow2 cluster size 2^%d", h.clusterBits)
+	case h.size < 0 || h.size > qcow2MaxSize:
+		return nil, errors.Errorf("invalid qcow2 size %d", h.size)
+	case h.l1Size*8 > qcow2MaxL1Size:
+		return nil, errors.Errorf("qcow2 L1 table of %d entries is too large", h.l1Size)
+	}
+
+	if h.version == 3 {
+		if len(buf) < qcow2HeaderV3 {
+			return nil, errors.New("qcow2 header is too short")
+		}
+
+		if features := binary.BigEndian.Uint64(buf[72:]); features&^qcow2Dirty != 0 {
+			return nil, errors.Wrapf(ErrUnsupported, "qcow2 incompatible features %#x", features)
+		}
+	}
+
+	// The L1 table is read into memory, so like qemu it may not be larger than the size of the image needs.
+	// The clusters are rounded up after dividing, rounding up the size itself overflows for huge sizes.
+	clusters := h.size / h.clusterSize()
+	if h.size%h.clusterSize() != 0 {
+		clusters++
+	}
+
+	if h.l1Size > divide(clusters, h.l2Entries()) {
+		return nil, errors.Errorf("invalid qcow2 L1 table of %d entries for %d bytes", h.l1Size, h.size)
+	}
+
+	return h, nil
+}
+
+// cluster decodes an L2 entry into where the cluster is stored. Clusters which read as zeros are not allocated.
+func (h *qcow2Header) cluster(entry uint64) (offset int64, length int64, compressed bool, allocated bool) {
+	if entry&qcow2Compressed != 0 {
+		shift := 62 - (h.clusterBits - 8)
+		offset = int64(entry & (1<<shift - 1))
+		sectors := int64(entry>>shift&(1<<(h.clusterBits-8)-1)) + 1
+		return offset, sectors*512 - offset&511, true, true
+	}
+
+	if h.version == 3 && entry&qcow2Zero != 0 {
+		return 0, 0, false, false
+	}
+
+	offset = int64(entry & qcow2OffsetMask)
+	return offset, h.clusterSize(), false, offset != 0
+}
+
+// inflate decompresses a compressed cluster
+func (h *qcow2Header) inflate(data []byte) ([]byte, error) {
+	cluster := make([]byte, h.clusterSize())
+	if _, err := io.ReadFull(flate.NewReader(bytes.NewReader(data)), cluster); err != nil {
+		return nil, errors.Wrap(err, "decompress qcow2 cluster")
+	}
+
+	return cluster, nil
+}
+
+// extent cuts off the part of the last cluster which is beyond the end of the disk
+func (h *qcow2Header) extent(guest int64, data []byte) Extent {
+	if end := guest + int64(len(data)); end > h.size {
+		data = data[:h.size-guest]
+	}
+
+	return Extent{Offset: guest, Data: data}
+}
+
+// roleKind is what a part of a qcow2 image holds
+type roleKind int
+
+const (
+	l1Role roleKind = iota
+	l2Role
+	dataRole
+	compressedRole
+)
+
+// role is a part of the image which still has to be read, guest is the place on the disk of the data it holds
+type role struct {
+	kind   roleKind
+	offset int64
+	length int64
+	guest  int64
+}
+
+// roleHeap orders the roles by where they are in the image
+type roleHeap []role
+
+func (r roleHeap) Len() int            { return len(r) }
+func (r roleHeap) Less(i, j int) bool  { return r[i].offset < r[j].offset }
+func (r roleHeap) Swap(i, j int)       { r[i], r[j] = r[j], r[i] }
+func (r *roleHeap) Push(x interface{}) { *r = append(*r, x.(role)) }
+
+func (r *roleHeap) Pop() interface{} {
+	old := *r
+	last := old[len(old)-1]
+	*r = old[:len(old)-1]
+	return last
+}
+
+// QCow2Reader reads a qcow2 image from the start to the end. This works as long as every table comes before
+// the tables and the clusters it points to and the clusters are stored in the order they have on the disk,
+// which is how qemu-img convert and WriteQCow2 lay out images. Other images give ErrNotStreamable.
+type QCow2Reader struct {
+	r      io.Reader
+	header *qcow2Header
+
+	// pos is how far the image has been read, tail holds the last sector before it because compressed
+	// clusters are packed and may start in the sector where the one before ends
+	pos  int64
+	tail []byte
+
+	pending roleHeap
+	next    int64
+	buf     []byte
+}
+
+// NewQCow2Reader reads the header of the qcow2 image
+func NewQCow2Reader(r io.Reader) (*QCow2Reader, error) {
+	buf := make([]byte, qcow2HeaderV3)
+	if _, err := io.ReadFull(r, buf[:qcow2HeaderV2]); err != nil {
+		return nil, errors.Wrap(err, "read qcow2 header")
+	}
+
+	pos := int64(qcow2HeaderV2)
+	if binary.BigEndian.Uint32(buf[4:]) == 3 {
+		if _, err := io.ReadFull(r, buf[qcow2HeaderV2:]); err != nil {
+			return nil, errors.Wrap(err, "read qcow2 header")
+		}
+
+		pos = qcow2HeaderV3
+	}
+
+	header, err := parseQCow2Header(buf[:pos])
+	if err != nil {
+		return nil, err
+	}
+
+	// The L1 table is read a cluster at a time, the guest of a piece is that of its first entry
+	q := &QCow2Reader{r: r, header: header, pos: pos, buf: make([]byte, header.clusterSize())}
+	for start := int64(0); start < header.l1Size; start += header.l2Entries() {
+		entries := header.l1Size - start
+		if entries > header.l2Entries() {
+			entries = header.l2Entries()
+		}
+
+		q.push(role{kind: l1Role, offset: header.l1Offset + start*8, length: entries * 8,
+			guest: start * header.l2Entries() * header.clusterSize()})
+	}
+
+	return q, nil
+}
+
+// Size returns the size of the disk
+func (q *QCow2Reader) Size() int64 {
+	return q.header.size
+}
+
+func (q *QCow2Reader) push(r role) {
+	heap.Push(&q.pending, r)
+}
+
+// Next returns the next cluster which holds data
+func (q *QCow2Reader) Next() (Extent, error) {
+	cs := q.header.clusterSize()
+
+	for q.pending.Len() > 0 {
+		r := heap.Pop(&q.pending).(role)
+
+		var buf []byte
+		if r.kind == dataRole {
+			buf = q.buf
+		}
+
+		data, err := q.read(r.offset, r.length, buf, r.kind == compressedRole)
+		if err != nil {
+			return Extent{}, err
+		}
+
+		switch r.kind {
+		case l1Role:
+			for i := int64(0); i < int64(len(data))/8; i++ {
+				if table := int64(binary.BigEndian.Uint64(data[i*8:]) & qcow2OffsetMask); table != 0 {
+					guest := r.guest + i*q.header.l2Entries()*cs
+					q.push(role{kind: l2Role, offset: table, length: cs, guest: guest})
+				}
+			}
+		case l2Role:
+			for i := int64(0); i < q.header.l2Entries(); i++ {
+				guest := r.guest + i*cs
+				if guest >= q.header.size {
+					break
+				}
+
+				offset, length, compressed, allocated := q.header.cluster(binary.BigEndian.Uint64(data[i*8:]))
+				if !allocated {
+					continue
+				}
+
+				kind := dataRole
+				if compressed {
+					kind = compressedRole
+				}
+
+				q.push(role{kind: kind, offset: offset, length: length, guest: guest})
+			}
+		default:
+			// A cluster before this one on the disk comes after it in the image
+			if r.guest < q.next {
+				return Extent{}, ErrNotStreamable
+			}
+
+			if r.kind == compressedRole {
+				if data, err = q.header.inflate(data); err != nil {
+					return Extent{}, err
+				}
+			}
+
+			q.next = r.guest + cs
+			return q.header.extent(r.guest, data), nil
+		}
+	}
+
+	return Extent{}, io.EOF
+}
+
+// read returns the part of the image at the offset, which cannot be before what has been read already.
+// Compressed clusters may be cut off by the end of the image, their length is rounded up to a sector.
+func (q *QCow2Reader) read(offset int64, length int64, buf []byte, short bool) ([]byte, error) {
+	if offset < q.pos-int64(len(q.tail)) {
+		return nil, ErrNotStreamable
+	}
+
+	if offset > q.pos {
+		if _, err := io.CopyN(ioutil.Discard, q.r, offset-q.pos); err != nil {
+			return nil, errors.Wrapf(err, "qcow2 image ends before %d", offset)
+		}
+
+		q.pos = offset
+		q.tail = nil
+	}
+
+	if buf == nil {
+		buf = make([]byte, length)
+	}
+
+	data := buf[:length]
+	n := copy(data, q.tail[int64(len(q.tail))-(q.pos-offset):])
+
+	m, err := io.ReadFull(q.r, data[n:])
+	q.pos += int64(m)
+
+	read := data[:n+m]
+	if len(read) > 512 {
+		read = read[len(read)-512:]
+	}
+
+	q.tail = append(q.tail[:0:0], read...)
+
+	if err != nil && !(short && n+m > 0 && (err == io.ErrUnexpectedEOF || err == io.EOF)) {
+		return nil, errors.Wrapf(err, "qcow2 image ends before %d", offset+length)
+	}
+
+	return data[:n+m], nil
+}
+
+// qcow2File reads a qcow2 image which can be read anywhere, whatever its layout
+type qcow2File struct {
+	r      io.ReaderAt
+	header *qcow2Header
+
+	l1      []byte
+	l1Start int64
+	l1Index int64
+	l2      []byte
+	l2Index int64
+	buf     []byte
+}
+
+// OpenQCow2 reads the qcow2 image by looking up its clusters in the tables
+func OpenQCow2(r io.ReaderAt) (Image, error) {
+	buf := make([]byte, qcow2HeaderV3)
+	n, err := r.ReadAt(buf, 0)
+	if n < qcow2HeaderV2 {
+		return nil, errors.Wrap(err, "read qcow2 header")
+	}
+
+	header, err := parseQCow2Header(buf[:n])
+	if err != nil {
+		return nil, err
+	}
+
+	q := &qcow2File{r: r, header: header, l1Index: -1, buf: make([]byte, header.clusterSize())}
+	if header.l1Size > 0 {
+		if _, err = q.l1Entry(0); err != nil {
+			return nil, err
+		}
+	}
+
+	return q, nil
+}
+
+// l1Entry returns an entry of the L1 table, which is read a cluster at a time
+func (q *qcow2File) l1Entry(index int64) (uint64, error) {
+	if q.l1 == nil || index < q.l1Start || index >= q.l1Start+int64(len(q.l1))/8 {
+		q.l1Start = index - index%q.header.l2Entries()
+
+		entries := q.header.l1Size - q.l1Start
+		if entries > q.header.l2Entries() {
+			entries = q.header.l2Entries()
+		}
+
+		q.l1 = make([]byte, entries*8)
+		if _, err := q.r.ReadAt(q.l1, q.header.l1Offset+q.l1Start*8); err != nil {
+			q.l1 = nil
+			return 0, errors.Wrap(err, "read qcow2 L1 table")
+		}
+	}
+
+	return binary.BigEndian.Uint64(q.l1[(index-q.l1Start)*8:]), nil
+}
+
+func (q *qcow2File) Size() int64 {
+	return q.header.size
+}
+
+func (q *qcow2File) Next() (Extent, error) {
+	cs := q.header.clusterSize()
+
+	for {
+		if q.l2 == nil || q.l2Index >= q.header.l2Entries() {
+			q.l1Index++
+			q.l2 = nil
+
+			if q.l1Index >= q.header.l1Size {
+				return Extent{}, io.EOF
+			}
+
+			entry, err := q.l1Entry(q.l1Index)
+			if err != nil {
+				return Extent{}, err
+			}
+
+			table := int64(entry & qcow2OffsetMask)
+			if table == 0 {
+				continue
+			}
+
+			q.l2 = make([]byte, cs)
+			if _, err := q.r.ReadAt(q.l2, table); err != nil {
+				return Extent{}, errors.Wrap(err, "read qcow2 L2 table")
+			}
+
+			q.l2Index = 0
+		}
+
+		guest := (q.l1Index*q.header.l2Entries() + q.l2Index) * cs
+		entry := binary.BigEndian.Uint64(q.l2[q.l2Index*8:])
+		q.l2Index++
+
+		if guest >= q.header.size {
+			return Extent{}, io.EOF
+		}
+
+		offset, length, compressed, allocated := q.header.cluster(entry)
+		if !allocated {
+			continue
+		}
+
+		if !compressed {
+			n, err := q.r.ReadAt(q.buf, offset)
+			if err != nil && err != io.EOF {
+				return Extent{}, errors.Wrap(err, "read qcow2 cluster")
+			}
+
+			// The last cluster may be cut off by the end of the file, the rest of it is zero
+			for i := range q.buf[n:] {
+				q.buf[n+i] = 0
+			}
+
+			return q.header.extent(guest, q.buf), nil
+		}
+
+		data := make([]byte, length)
+		n, err := q.r.ReadAt(data, offset)
+		if n == 0 {
+			return Extent{}, errors.Wrap(err, "read qcow2 cluster")
+		}
+
+		data, err = q.header.inflate(data[:n])
+		if err != nil {
+			return Extent{}, err
+		}
+
+		return q.header.extent(guest, data), nil
+	}
+}
+
+// WriteQCow2 writes the disk as a qcow2 image of version 3 which QCow2Reader can read as a stream. The tables
+// come first and are followed by the clusters which hold data in the order they have on the disk, clusters
+// which only hold zeros are left out.
+func WriteQCow2(w io.Writer, open func() (Image, error)) error {
+	cs := int64(1) << qcow2ClusterBits
+	l2Entries := cs / 8
+
+	image, err := open()
+	if err != nil {
+		return err
+	}
+
+	l, err := scan(image, cs)
+	if err != nil {
+		return errors.Wrap(err, "scan disk")
+	}
+
+	l1Size := divide(divide(l.size, cs), l2Entries)
+
+	// The L2 tables which describe clusters with data
+	var tables []int64
+	for _, r := range l.runs {
+		for table := r.start / l2Entries; table <= (r.start+r.count-1)/l2Entries; table++ {
+			if len(tables) == 0 || tables[len(tables)-1] != table {
+				tables = append(tables, table)
+			}
+		}
+	}
+
+	// The refcount blocks also count themselves, so their number is found by trying until it fits
+	data := l.blocks()
+	l1Clusters := divide(l1Size*8, cs)
+
+	var refBlocks, refTable, total int64
+	for {
+		total = 1 + refTable + refBlocks + l1Clusters + int64(len(tables)) + data
+		blocks := divide(total, cs/2)
+		table := divide(blocks*8, cs)
+
+		if blocks == refBlocks && table == refTable {
+			break
+		}
+
+		refBlocks, refTable = blocks, table
+	}
+
+	refTableOffset := cs
+	refBlocksOffset := refTableOffset + refTable*cs
+	l1Offset := refBlocksOffset + refBlocks*cs
+	l2Offset := l1Offset + l1Clusters*cs
+	dataOffset := l2Offset + int64(len(tables))*cs
+
+	out := bufio.NewWriterSize(w, int(cs))
+
+	header := make([]byte, cs)
+	copy(header, qcow2Magic)
+	binary.BigEndian.PutUint32(header[4:], 3)
+	binary.BigEndian.PutUint32(header[20:], qcow2ClusterBits)
+	binary.BigEndian.PutUint64(header[24:], uint64(l.size))
+	binary.BigEndian.PutUint32(header[36:], uint32(l1Size))
+	binary.BigEndian.PutUint64(header[40:], uint64(l1Offset))
+	binary.BigEndian.PutUint64(header[48:], uint64(refTableOffset))
+	binary.BigEndian.PutUint32(header[56:], uint32(refTable))
+	binary.BigEndian.PutUint32(header[96:], qcow2RefcountOrder)
+	binary.BigEndian.PutUint32(header[100:], qcow2HeaderV3)
+
+	tableBuf := make([]byte, refTable*cs)
+	for i := int64(0); i < refBlocks; i++ {
+		binary.BigEndian.PutUint64(tableBuf[i*8:], uint64(refBlocksOffset+i*cs))
+	}
+
+	// Every cluster of the image is used once
+	refcounts := make([]byte, refBlocks*cs)
+	for i := int64(0); i < total; i++ {
+		binary.BigEndian.PutUint16(refcounts[i*2:], 1)
+	}
+
+	l1 := make([]byte, l1Clusters*cs)
+	for i, table := range tables {
+		binary.BigEndian.PutUint64(l1[table*8:], uint64(l2Offset+int64(i)*cs)|qcow2Copied)
+	}
+
+	for _, part := range [][]byte{header, tableBuf, refcounts, l1} {
+		if _, err = out.Write(part); err != nil {
+			return errors.Wrap(err, "write qcow2 tables")
+		}
+	}
+
+	if err = writeL2Tables(out, l, l2Entries, dataOffset, cs); err != nil {
+		return err
+	}
+
+	image, err = open()
+	if err != nil {
+		return err
+	}
+
+	blocks := &blockReader{image: image, blockSize: cs}
+	buf := make([]byte, cs)
+
+	for _, r := range l.runs {
+		for cluster := r.start; cluster < r.start+r.count; cluster++ {
+			if err = blocks.block(cluster, buf); err != nil {
+				return errors.Wrap(err, "read disk")
+			}
+
+			if _, err = out.Write(buf); err != nil {
+				return errors.Wrap(err, "write qcow2 cluster")
+			}
+		}
+	}
+
+	return errors.Wrap(out.Flush(), "write qcow2 image")
+}
+
+// writeL2Tables writes the L2 tables, the clusters with data are stored one after the other from dataOffset
+func writeL2Tables(w io.Writer, l *layout, l2Entries int64, dataOffset int64, cs int64) error {
+	table := make([]byte, cs)
+	current := int64(-1)
+	offset := dataOffset
+
+	flush := func() error {
+		if current < 0 {
+			return nil
+		}
+
+		_, err := w.Write(table)
+		for i := range table {
+			table[i] = 0
+		}
+
+		return errors.Wrap(err, "write qcow2 L2 table")
+	}
+
+	for _, r := range l.runs {
+		for cluster := r.start; cluster < r.start+r.count; cluster++ {
+			if cluster/l2Entries != current {
+				if err := flush(); err != nil {
+					return err
+				}
+
+				current = cluster / l2Entries
+			}
+
+			binary.BigEndian.PutUint64(table[cluster%l2Entries*8:], uint64(offset)|qcow2Copied)
+			offset += cs
+		}
+	}
+
+	return flush()
+}
+
+// divide divides and rounds up
+func divide(a int64, b int64) int64 {
+	return (a + b - 1) / b
+}
@@ -0,0 +1,61 @@
+// Copyright (c) 2020-2022 TU Delft & Valentijn van de Beek <v.d.vandebeek@student.tudelft.nl> All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package diskimage
+
+import (
+	"io"
+
+	"github.com/pkg/errors"
+)
+
+// rawBlockSize is the size of the parts a raw image is cut into, parts which are all zeros are left out
+const rawBlockSize = 64 * 1024
+
+// RawReader reads a raw image, leaving out the blocks which only hold zeros
+type RawReader struct {
+	r      io.Reader
+	buf    []byte
+	offset int64
+}
+
+// NewRawReader reads the raw image from r
+func NewRawReader(r io.Reader) *RawReader {
+	return &RawReader{r: r, buf: make([]byte, rawBlockSize)}
+}
+
+// Next returns the next block which holds data
+func (r *RawReader) Next() (Extent, error) {
+	for {
+		n, err := io.ReadFull(r.r, r.buf)
+		if err == io.EOF {
+			return Extent{}, io.EOF
+		} else if err != nil && err != io.ErrUnexpectedEOF {
+			return Extent{}, errors.Wrap(err, "read raw image")
+		}
+
+		offset := r.offset
+		r.offset += int64(n)
+
+		if !isZero(r.buf[:n]) {
+			return Extent{Offset: offset, Data: r.buf[:n]}, nil
+		}
+	}
+}
+
+// Size returns how much has been read, which is the size of the disk once everything has been read
+func (r *RawReader) Size() int64 {
+	return r.offset
+}
+
+// isZero reports whether every byte is zero
+func isZero(data []byte) bool {
+	for _, b := range data {
+		if b != 0 {
+			return false
+		}
+	}
+
+	return true
+}
@@ -0,0 +1,338 @@
+// Copyright (c) 2020-2022 TU Delft & Valentijn van de Beek <v.d.vandebeek@student.tudelft.nl> All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package diskimage
+
+import (
+	"bufio"
+	"encoding/binary"
+	"io"
+	"io/ioutil"
+	"math"
+
+	"github.com/pkg/errors"
+)
+
+// Sparse images use the format of Android (libsparse, img2simg), which is written and read as a stream. The
+// disk is a series of chunks which hold data, repeat a value or are left out.
+var sparseMagic = []byte{0x3a, 0xff, 0x26, 0xed}
+
+const (
+	sparseHeaderSize      = 28
+	sparseChunkHeaderSize = 12
+
+	sparseRaw      = 0xcac1
+	sparseFill     = 0xcac2
+	sparseDontCare = 0xcac3
+	sparseCRC32    = 0xcac4
+
+	// sparsePiece is the most data of a chunk which is returned as a single extent
+	sparsePiece = 1024 * 1024
+	// sparseMaxRaw is the most data put in a single chunk, the size of a chunk has to fit in 32 bits
+	sparseMaxRaw = 64 * 1024 * 1024
+)
+
+// SparseReader reads a sparse image. Blocks which are left out read as zeros.
+type SparseReader struct {
+	r         io.Reader
+	blockSize int64
+	blocks    int64
+	chunks    uint32
+
+	// chunk is the number of chunks which have been read, the rest of the current chunk is at offset
+	chunk     uint32
+	kind      uint16
+	offset    int64
+	remaining int64
+	fill      []byte
+	buf       []byte
+}
+
+// NewSparseReader reads the header of the sparse image
+func NewSparseReader(r io.Reader) (*SparseReader, error) {
+	header := make([]byte, sparseHeaderSize)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return nil, errors.Wrap(err, "read sparse header")
+	}
+
+	if major := binary.LittleEndian.Uint16(header[4:]); major != 1 {
+		return nil, errors.Wrapf(ErrUnsupported, "sparse image version %d", major)
+	}
+
+	fileHeader := int64(binary.LittleEndian.Uint16(header[8:]))
+	chunkHeader := binary.LittleEndian.Uint16(header[10:])
+
+	s := &SparseReader{
+		r:         r,
+		blockSize: int64(binary.LittleEndian.Uint32(header[12:])),
+		blocks:    int64(binary.LittleEndian.Uint32(header[16:])),
+		chunks:    binary.LittleEndian.Uint32(header[20:]),
+		buf:       make([]byte, sparsePiece),
+	}
+
+	if fileHeader < sparseHeaderSize || chunkHeader != sparseChunkHeaderSize || s.blockSize == 0 ||
+		s.blockSize%4 != 0 {
+		return nil, errors.New("invalid sparse header")
+	}
+
+	if _, err := io.CopyN(ioutil.Discard, r, fileHeader-sparseHeaderSize); err != nil {
+		return nil, errors.Wrap(err, "read sparse header")
+	}
+
+	return s, nil
+}
+
+// Size returns the size of the disk
+func (s *SparseReader) Size() int64 {
+	return s.blocks * s.blockSize
+}
+
+// Next returns the next part of a chunk which holds data, chunks are cut into extents of at most a MiB
+func (s *SparseReader) Next() (Extent, error) {
+	for s.remaining == 0 {
+		if s.chunk == s.chunks {
+			return Extent{}, io.EOF
+		}
+
+		if err := s.nextChunk(); err != nil {
+			return Extent{}, err
+		}
+	}
+
+	n := s.remaining
+	if n > sparsePiece {
+		n = sparsePiece
+	}
+
+	data := s.buf[:n]
+	if s.kind == sparseRaw {
+		if _, err := io.ReadFull(s.r, data); err != nil {
+			return Extent{}, errors.Wrap(err, "read sparse chunk")
+		}
+	} else {
+		for i := range data {
+			data[i] = s.fill[i%4]
+		}
+	}
+
+	extent := Extent{Offset: s.offset, Data: data}
+	s.offset += n
+	s.remaining -= n
+
+	return extent, nil
+}
+
+// nextChunk reads the header of the next chunk, chunks without data are skipped right away
+func (s *SparseReader) nextChunk() error {
+	header := make([]byte, sparseChunkHeaderSize)
+	if _, err := io.ReadFull(s.r, header); err != nil {
+		return errors.Wrap(err, "read sparse chunk header")
+	}
+
+	s.chunk++
+	s.kind = binary.LittleEndian.Uint16(header)
+	size := int64(binary.LittleEndian.Uint32(header[4:])) * s.blockSize
+	total := int64(binary.LittleEndian.Uint32(header[8:]))
+
+	if s.offset+size > s.Size() {
+		return errors.New("sparse chunk beyond the end of the disk")
+	}
+
+	var payload int64
+	switch s.kind {
+	case sparseRaw:
+		payload = size
+		s.remaining = size
+	case sparseFill:
+		payload = 4
+		s.fill = make([]byte, 4)
+		if _, err := io.ReadFull(s.r, s.fill); err != nil {
+			return errors.Wrap(err, "read sparse chunk")
+		}
+
+		// A fill with zeros is left out like the chunks without data
+		if !isZero(s.fill) {
+			s.remaining = size
+		} else {
+			s.offset += size
+		}
+	case sparseDontCare:
+		s.offset += size
+	case sparseCRC32:
+		payload = 4
+		if _, err := io.CopyN(ioutil.Discard, s.r, 4); err != nil {
+			return errors.Wrap(err, "read sparse chunk")
+		}
+	default:
+		return errors.Wrapf(ErrUnsupported, "sparse chunk type %#x", s.kind)
+	}
+
+	if total != sparseChunkHeaderSize+payload {
+		return errors.Errorf("sparse chunk has size %d instead of %d", total, sparseChunkHeaderSize+payload)
+	}
+
+	return nil
+}
+
+// sparseBlockSize picks the block size for a disk, it has to be a whole number of blocks
+func sparseBlockSize(size int64) (int64, error) {
+	for _, blockSize := range []int64{4096, 512} {
+		if size%blockSize == 0 {
+			if size/blockSize > math.MaxUint32 {
+				return 0, errors.New("the disk is too large for a sparse image")
+			}
+
+			return blockSize, nil
+		}
+	}
+
+	return 0, errors.Errorf("a sparse image cannot hold %d bytes, which is not a multiple of 512", size)
+}
+
+// sparseChunks calls chunk for every chunk of the image: the blocks with data become raw chunks and the blocks
+// in between are left out
+func sparseChunks(l *layout, blockSize int64, chunk func(kind uint16, start int64, count int64) error) error {
+	maxRaw := int64(sparseMaxRaw) / blockSize
+	end := l.size / blockSize
+	next := int64(0)
+
+	split := func(kind uint16, start int64, count int64, max int64) error {
+		for count > 0 {
+			n := count
+			if n > max {
+				n = max
+			}
+
+			if err := chunk(kind, start, n); err != nil {
+				return err
+			}
+
+			start += n
+			count -= n
+		}
+
+		return nil
+	}
+
+	for _, r := range l.runs {
+		if err := split(sparseDontCare, next, r.start-next, math.MaxUint32); err != nil {
+			return err
+		}
+
+		if err := split(sparseRaw, r.start, r.count, maxRaw); err != nil {
+			return err
+		}
+
+		next = r.start + r.count
+	}
+
+	return split(sparseDontCare, next, end-next, math.MaxUint32)
+}
+
+// WriteSparse writes the disk as a sparse image, the blocks which only hold zeros are left out
+func WriteSparse(w io.Writer, open func() (Image, error)) error {
+	image, err := open()
+	if err != nil {
+		return err
+	}
+
+	// The size is only known for sure after the first pass, so the disk is scanned with the smallest block size
+	l, err := scan(image, 512)
+	if err != nil {
+		return errors.Wrap(err, "scan disk")
+	}
+
+	blockSize, err := sparseBlockSize(l.size)
+	if err != nil {
+		return err
+	}
+
+	l = rescale(l, blockSize)
+
+	var chunks uint32
+	_ = sparseChunks(l, blockSize, func(uint16, int64, int64) error {
+		chunks++
+		return nil
+	})
+
+	out := bufio.NewWriter(w)
+
+	header := make([]byte, sparseHeaderSize)
+	copy(header, sparseMagic)
+	binary.LittleEndian.PutUint16(header[4:], 1)
+	binary.LittleEndian.PutUint16(header[8:], sparseHeaderSize)
+	binary.LittleEndian.PutUint16(header[10:], sparseChunkHeaderSize)
+	binary.LittleEndian.PutUint32(header[12:], uint32(blockSize))
+	binary.LittleEndian.PutUint32(header[16:], uint32(l.size/blockSize))
+	binary.LittleEndian.PutUint32(header[20:], chunks)
+
+	if _, err = out.Write(header); err != nil {
+		return errors.Wrap(err, "write sparse header")
+	}
+
+	image, err = open()
+	if err != nil {
+		return err
+	}
+
+	blocks := &blockReader{image: image, blockSize: blockSize}
+	buf := make([]byte, blockSize)
+
+	err = sparseChunks(l, blockSize, func(kind uint16, start int64, count int64) error {
+		chunk := make([]byte, sparseChunkHeaderSize)
+		binary.LittleEndian.PutUint16(chunk, kind)
+		binary.LittleEndian.PutUint32(chunk[4:], uint32(count))
+		binary.LittleEndian.PutUint32(chunk[8:], sparseChunkHeaderSize)
+
+		if kind == sparseRaw {
+			binary.LittleEndian.PutUint32(chunk[8:], uint32(sparseChunkHeaderSize+count*blockSize))
+		}
+
+		if _, err := out.Write(chunk); err != nil {
+			return errors.Wrap(err, "write sparse chunk")
+		}
+
+		if kind != sparseRaw {
+			return nil
+		}
+
+		for block := start; block < start+count; block++ {
+			if err := blocks.block(block, buf); err != nil {
+				return errors.Wrap(err, "read disk")
+			}
+
+			if _, err := out.Write(buf); err != nil {
+				return errors.Wrap(err, "write sparse chunk")
+			}
+		}
+
+		return nil
+	})
+
+	if err != nil {
+		return err
+	}
+
+	return errors.Wrap(out.Flush(), "write sparse image")
+}
+
+// rescale turns the runs of blocks of 512 bytes into runs of larger blocks
+func rescale(l *layout, blockSize int64) *layout {
+	factor := blockSize / 512
+	scaled := &layout{size: l.size}
+
+	for _, r := range l.runs {
+		first := r.start / factor
+		last := (r.start + r.count - 1) / factor
+
+		if n := len(scaled.runs); n > 0 && scaled.runs[n-1].start+scaled.runs[n-1].count >= first {
+			scaled.runs[n-1].count = last + 1 - scaled.runs[n-1].start
+			continue
+		}
+
+		scaled.runs = append(scaled.runs, run{start: first, count: last - first + 1})
+	}
+
+	return scaled
+}
@@ -18,6 +18,9 @@ import (
 type Hook struct {
 	url    string
 	origin string
+
+	// header contains additional headers sent along with every log message, such as credentials
+	header http.Header
 }
 
 type logMessage struct {
@@ -45,14 +48,18 @@ func (h Hook) Fire(entry *log.Entry) error {
 
 	client := &http.Client{}
 	req, err := http.NewRequest("POST", h.url, bytes.NewReader(res))
-	req.Header.Set("Content-Type", "application/json")
-	req.Header.Set("type", "log")
-	req.Header.Set("Origin", "http://localhost:9090")
-
 	if err != nil {
 		return errors.Wrap(err, "cannot create request")
 	}
 
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Origin", "http://localhost:9090")
+	for key, values := range h.header {
+		for _, value := range values {
+			req.Header.Add(key, value)
+		}
+	}
+
 	resp, err := client.Do(req)
 	if err != nil {
 		return errors.Wrap(err, "sending log")
@@ -72,9 +79,11 @@ func (h Hook) Fire(entry *log.Entry) error {
 }
 
 // NewLogHook Creates a new http log hook, to be given to logrus.
-func NewLogHook(url, origin string) *Hook {
+// The given header is added to every request, it may be nil.
+func NewLogHook(url, origin string, header http.Header) *Hook {
 	return &Hook{
 		url,
 		origin,
+		header,
 	}
 }
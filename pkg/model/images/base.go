@@ -8,22 +8,12 @@ package images
 import (
 	"bytes"
 	"encoding/json"
-	"fmt"
-	"io"
-	"os"
-	"os/exec"
+	"strings"
 
-	"github.com/codingsince1985/checksum"
-	log "github.com/sirupsen/logrus"
+	"github.com/pkg/errors"
 	"gorm.io/gorm"
 )
 
-// FilePathFmt is the format string to create the path the image should be written to
-const FilePathFmt = "/%s/%d.img"
-
-// imageFileSize is the size of the standard image that is created in MiB.
-const imageFileSize = 512 // size in MiB
-
 // DiskType describes the type of disk image, this can also describe the filesystem contained within
 type DiskType int
 
@@ -32,6 +22,8 @@ const (
 	DiskTypeRaw DiskType = iota
 	// DiskTypeQCow2 defines an image of the QCow type used by qemu
 	DiskTypeQCow2
+	// DiskTypeSparse defines an image in the sparse format of Android, which leaves out the empty blocks
+	DiskTypeSparse
 )
 
 // String returns a string associated with a DiskType
@@ -40,13 +32,25 @@ func (s DiskType) String() string {
 }
 
 var toString = map[DiskType]string{
-	DiskTypeRaw:   "raw",
-	DiskTypeQCow2: "qcow2",
+	DiskTypeRaw:    "raw",
+	DiskTypeQCow2:  "qcow2",
+	DiskTypeSparse: "sparse",
 }
 
 var toID = map[string]DiskType{
-	"raw":   DiskTypeRaw,
-	"qcow2": DiskTypeQCow2,
+	"raw":    DiskTypeRaw,
+	"qcow2":  DiskTypeQCow2,
+	"sparse": DiskTypeSparse,
+}
+
+// ParseDiskType returns the DiskType with the given name, unlike unmarshalling it fails for unknown names
+func ParseDiskType(name string) (DiskType, error) {
+	diskType, ok := toID[strings.ToLower(name)]
+	if !ok {
+		return DiskTypeRaw, errors.Errorf("unknown disk type %q", name)
+	}
+
+	return diskType, nil
 }
 
 // DiskCompressionStrategy is how the disk is compressed
@@ -59,6 +63,10 @@ const (
 	DiskCompressionStrategyZSTD = "zstd"
 	// DiskCompressionStrategyGZip uses the standard GZip compression algorithm for disks.
 	DiskCompressionStrategyGZip = "gzip"
+	// DiskCompressionStrategyXZ compresses disk images with xz, which is slow but compresses well.
+	DiskCompressionStrategyXZ = "xz"
+	// DiskCompressionStrategyLZ4 compresses disk images with lz4, which is fast but compresses less.
+	DiskCompressionStrategyLZ4 = "lz4"
 )
 
 const (
@@ -97,22 +105,20 @@ type ImageUUID string
 // Version stores the version of an ImageModel using an UNIX timestamp
 type Version struct {
 	gorm.Model     `json:"-"`
-	Version        uint64    `gorm:"not null;default:0"`
-	ImageModelUUID ImageUUID `gorm:"not null;"`
+	Version        uint64    `gorm:"not null;default:0;uniqueIndex:idx_versions_image_version,priority:2"`
+	ImageModelUUID ImageUUID `gorm:"not null;uniqueIndex:idx_versions_image_version,priority:1"`
+
+	// Digest is the hex encoded SHA-256 of the decompressed version and Size its length in bytes, the management
+	// OS checks the disk it has written against them. Both are empty if the digest could not be computed.
+	Digest string
+	Size   int64
+
+	// Compression and Type are what the file of the version holds, detected along with the digest. They may
+	// differ from the image, whose compression and type are only those new versions are made with.
+	Compression DiskCompressionStrategy
+	Type        DiskType
 }
 
-/* Disk Layout on control_server
-/disks
-	/abc  <-- First image UUID
-		/1.img
-		/2.img
-		/3.img
-		/4.img
-	/cdf  <-- Second image UUID
-		/1.img
-		/2.img
-*/
-
 // ImageModel defines the database structure for storing the metadata about images
 type ImageModel struct {
 	// You will see quite a few of these around. They suppress the default values that the ORM creates when it gets
@@ -144,10 +150,13 @@ type ImageModel struct {
 	// Checksum for this image as alternative for versioning
 	Checksum string
 
-	// ImagePath is where the system has stored this image
+	// ImagePath is no longer used, the control server keeps the files in its storage backend
 	ImagePath string `json:"-" gorm:"not null"`
 
 	Filesystem FilesystemType
+
+	// Retention decides which old versions are removed, it overrides the policy of the user
+	Retention RetentionPolicy `gorm:"embedded;embeddedPrefix:retention_"`
 }
 
 const (
@@ -156,134 +165,3 @@ const (
 	// SizeGigabyte are the bytes equivalent to one gigabyte
 	SizeGigabyte = 1024 * 1024 * 1024
 )
-
-// CreateImageFile creates the actual image on disk with a given size.
-func (image *ImageModel) CreateImageFile(imageSize uint, baseSize uint) error {
-	f, err := os.OpenFile(fmt.Sprintf(image.ImagePath+FilePathFmt, image.UUID, 0),
-		os.O_WRONLY|os.O_CREATE, 0644)
-
-	if err != nil {
-		return err
-	}
-
-	// Create an image of a specified size in GiB
-	size := int64(imageSize * baseSize)
-
-	_, err = f.Seek(size-1, 0)
-	if err != nil {
-		return err
-	}
-
-	_, err = f.Write([]byte{0})
-	if err != nil {
-		return err
-	}
-
-	err = f.Close()
-	if err != nil {
-		return err
-	}
-
-	return nil
-}
-
-// OpenImageFile opens an image file so it can be read by the system
-func (image *ImageModel) OpenImageFile(version uint64) (*os.File, error) {
-	fmt.Println(fmt.Sprintf(image.ImagePath+FilePathFmt, image.UUID, version))
-	fmt.Println(os.Getenv("PWD"))
-	f, err := os.Open(fmt.Sprintf(image.ImagePath+FilePathFmt, image.UUID, version))
-	if err != nil {
-		return nil, err
-	}
-
-	return f, nil
-}
-
-// GenerateChecksum generates the checksum of the image
-func (image *ImageModel) GenerateChecksum() error {
-	// Create the actual image together with the first empty version which a user may or may not use.
-	f, err := image.OpenImageFile(0)
-
-	if err != nil {
-		log.Errorf("failed to open the image file: %v", err)
-		return err
-	}
-
-	chk, err := checksum.CRCReader(f)
-	if err != nil {
-		log.Errorf("Can't generate the checksum: %v", err)
-		return err
-	}
-
-	image.Checksum = chk
-	return nil
-}
-
-// FormatImage formats the image to the filesystem defined in the metadata.
-// Warning: this will delete all the currently existing data of the image.
-func (image *ImageModel) FormatImage() {
-	var version uint64
-
-	fmt.Println(version)
-
-	if image.Checksum == "" {
-		version = image.Versions[len(image.Versions)-1].Version
-	} else if image.Checksum == "DEADBEEF" {
-		version = 0
-	}
-
-	path := fmt.Sprintf("%s/%s/%d.img", image.ImagePath, image.UUID, version)
-	var cmd *exec.Cmd
-	switch image.Filesystem {
-	case FileSystemTypeEXT4:
-		cmd = exec.Command("mkfs.ext4", path)
-	case FileSystemTypeFAT32:
-		cmd = exec.Command("mkfs.fat", "-F", "32", path)
-	default:
-		return
-	}
-
-	err := cmd.Run()
-	if err != nil {
-		log.Fatalf("Creating ext4 partition failed: %v", err)
-		return
-	}
-}
-
-// UpdateImage updates the image
-func (image *ImageModel) UpdateImage(r *io.Reader) {
-
-}
-
-// AfterDelete removes the image directory
-func (image *ImageModel) AfterDelete(tx *gorm.DB) (ret error) {
-	// Remove the directory which includes all the image files
-	err := os.RemoveAll(image.ImagePath)
-	if err != nil {
-		log.Errorf("failed to delete image: %v", err)
-		return
-	}
-
-	return
-}
-
-// BeforeCreate adds the image path and creates the first version of the image.
-func (image *ImageModel) BeforeCreate(tx *gorm.DB) (ret error) {
-	path := os.Getenv("BAAS_DISK_PATH")
-	image.ImagePath = path
-	// Create the actual image together with the first empty version which a user may or may not use.
-	err := os.Mkdir(image.ImagePath+"/"+string(image.UUID), os.ModePerm)
-
-	if err != nil {
-		log.Errorf("cannot create image directory: %s", err)
-		return
-	}
-
-	err = image.CreateImageFile(imageFileSize, SizeMegabyte)
-	if err != nil {
-		log.Errorf("image creation failed: %v", err)
-		return
-	}
-
-	return
-}
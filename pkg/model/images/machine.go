@@ -5,15 +5,10 @@
 package images
 
 import (
-	"fmt"
-	"os"
-
 	model "github.com/baas-project/baas/pkg/model/machine"
 
 	"github.com/baas-project/baas/pkg/util"
 	"github.com/google/uuid"
-	log "github.com/sirupsen/logrus"
-	"gorm.io/gorm"
 )
 
 // FilesystemType is the type of filesystem that is used by the image
@@ -38,7 +33,6 @@ func CreateMachineImageModel(mac util.MacAddress) (*MachineImageModel, error) {
 		UUID:                    ImageUUID(uuid.New().String()),
 		Username:                "System",
 		Checksum:                "DEADBEEF",
-		ImagePath:               os.Getenv("BAAS_DISK_PATH"),
 		Filesystem:              FileSystemTypeEXT4,
 	}
 
@@ -49,27 +43,3 @@ func CreateMachineImageModel(mac util.MacAddress) (*MachineImageModel, error) {
 
 	return &machineImage, nil
 }
-
-// BeforeCreate creates the machine image model directory and image file.
-func (machineImage *MachineImageModel) BeforeCreate(tx *gorm.DB) (ret error) {
-	path := os.Getenv("BAAS_DISK_PATH")
-	machineImage.ImageModel.ImagePath = path
-
-	// Create the actual image together with the first empty version which a user may or may not use.
-	err := os.Mkdir(fmt.Sprintf(path+"/%s", machineImage.UUID), os.ModePerm)
-	if err != nil {
-		log.Errorf("cannot create image directory: %v", err)
-		return
-	}
-
-	machineImage.ImageModel.CreateImageFile(machineImage.Size, SizeMegabyte)
-	machineImage.ImageModel.GenerateChecksum()
-	machineImage.ImageModel.FormatImage()
-	return
-}
-
-// AfterDelete removes all the data associated with the machine.
-func (machineImage *MachineImageModel) AfterDelete(tx *gorm.DB) (ret error) {
-	machineImage.ImageModel.AfterDelete(tx)
-	return
-}
@@ -0,0 +1,35 @@
+// Copyright (c) 2020-2022 TU Delft & Valentijn van de Beek <v.d.vandebeek@student.tudelft.nl> All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package images
+
+import "time"
+
+// RetentionPolicy decides which old versions of an image are kept. A version is kept when any rule keeps it,
+// when no rule is set every version is kept. The latest version and versions used by an image setup are never removed.
+type RetentionPolicy struct {
+	// KeepLast keeps the given amount of newest versions, 0 disables the rule
+	KeepLast uint `gorm:"not null;default:0"`
+	// KeepDays keeps the versions created in the given amount of days, 0 disables the rule
+	KeepDays uint `gorm:"not null;default:0"`
+}
+
+// IsSet tells whether the policy has any rules
+func (p RetentionPolicy) IsSet() bool {
+	return p.KeepLast > 0 || p.KeepDays > 0
+}
+
+// Keeps tells whether the policy keeps the version, given its position among the versions from newest
+// to oldest starting at 0.
+func (p RetentionPolicy) Keeps(position int, created time.Time, now time.Time) bool {
+	if !p.IsSet() {
+		return true
+	}
+
+	if position < int(p.KeepLast) {
+		return true
+	}
+
+	return p.KeepDays > 0 && created.After(now.Add(-time.Duration(p.KeepDays)*24*time.Hour))
+}
@@ -20,6 +20,10 @@ type ImageFrozen struct {
 	// ImageSetup     ImageSetup `json:"-" gorm:"foreignKey:UUID;referencesImageSetupUUID;constraint:OnDelete:CASCADE,OnUpdate:CASCADE"`
 	ImageSetupUUID ImageUUID `json:"-"`
 	Update         bool      `gorm:"not null;default:false"`
+
+	// Export is the name under which the control server serves the disk over NBD when the setup is booted that
+	// way, the image is then not written to the disk of the machine.
+	Export string `gorm:"-" json:",omitempty"`
 }
 
 // ImageSetup defines a collection of Images
@@ -29,6 +33,9 @@ type ImageSetup struct {
 	Images     []ImageFrozen `gorm:"foreignKey:ImageSetupUUID;references:UUID;constraint:OnDelete:CASCADE,OnUpdate:CASCADE;"`
 	Username   string        `gorm:"foreignKey:Username;not null;"`
 	UUID       ImageUUID     `gorm:"uniqueIndex;primaryKey;unique;not null;"`
+
+	// SignaturePolicy decides whose signatures the versions need before a machine may boot the setup
+	SignaturePolicy SignaturePolicy `gorm:"not null;default:none"`
 }
 
 // BootSetup stores what the next boot for the machine should look like.
@@ -46,6 +53,14 @@ type BootSetup struct {
 
 	// Should the image changes be uploaded to the server?
 	Update bool `gorm:"not null;"`
+
+	// NBD boots the machine from the disks on the control server over the network instead of flashing them, the
+	// writes of the machine go to an overlay which is only kept when it is committed as a new version.
+	NBD bool `gorm:"not null;default:false"`
+
+	// PowerCycle restarts the machine from the network through its power controller once the setup is queued, so
+	// it picks up the setup without anyone rebooting it
+	PowerCycle bool `gorm:"not null;default:false"`
 }
 
 // CreateImageSetup creates an ImageSetup of a specified name.
@@ -0,0 +1,52 @@
+// Copyright (c) 2020-2022 TU Delft & Valentijn van de Beek <v.d.vandebeek@student.tudelft.nl> All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package images
+
+import (
+	"fmt"
+
+	"gorm.io/gorm"
+)
+
+// SignaturePolicy decides whose signatures the versions in an image setup need before it is booted
+type SignaturePolicy string
+
+const (
+	// SignaturePolicyNone boots the image setup without checking the signatures
+	SignaturePolicyNone SignaturePolicy = "none"
+	// SignaturePolicyOwner requires that every version is signed by the owner of its image
+	SignaturePolicyOwner SignaturePolicy = "owner"
+	// SignaturePolicyModerator requires that every version is signed by a moderator or an administrator
+	SignaturePolicyModerator SignaturePolicy = "moderator"
+)
+
+// Valid checks whether the policy is known, the empty policy is the same as SignaturePolicyNone
+func (policy SignaturePolicy) Valid() bool {
+	switch policy {
+	case "", SignaturePolicyNone, SignaturePolicyOwner, SignaturePolicyModerator:
+		return true
+	default:
+		return false
+	}
+}
+
+// VersionSignature is the signature of a version of an image, it signs the SignedMessage of the version
+type VersionSignature struct {
+	gorm.Model `json:"-"`
+
+	VersionID uint `gorm:"not null;index" json:"-"`
+
+	// KeyUUID is the signing key with which the signature was made
+	KeyUUID string `gorm:"not null"`
+
+	Signature []byte `gorm:"not null"`
+}
+
+// SignedMessage is what is signed for a version. It contains the digest of the version, so only versions
+// which have a digest can be signed.
+func SignedMessage(version *Version) []byte {
+	return []byte(fmt.Sprintf("baas-version\n%s\n%d\n%s\n", version.ImageModelUUID, version.Version,
+		version.Digest))
+}
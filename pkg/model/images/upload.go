@@ -0,0 +1,34 @@
+// Copyright (c) 2020-2022 TU Delft & Valentijn van de Beek <v.d.vandebeek@student.tudelft.nl> All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package images
+
+import "gorm.io/gorm"
+
+// UploadModel is an upload of a version of an image which is sent in parts. The parts are collected in a
+// staging area and only become a version of the image when the upload is committed.
+type UploadModel struct {
+	gorm.Model `json:"-"`
+
+	// UUID identifies the upload in the URI
+	UUID string `gorm:"uniqueIndex;not null"`
+
+	// ImageModelUUID is the image the upload becomes a version of
+	ImageModelUUID ImageUUID `gorm:"not null"`
+
+	// NewVersion creates a new version on commit, otherwise the latest version is replaced
+	NewVersion bool `gorm:"not null;default:false"`
+
+	// Size is the size of the file in bytes if it is known beforehand, 0 otherwise
+	Size int64 `gorm:"not null;default:0"`
+
+	// Digest is the hex encoded SHA-256 of the file, it may also be given when the upload is committed
+	Digest string
+
+	// BlockMap uploads hold a block map, which is rebuilt into the whole disk when the upload is committed
+	BlockMap bool `gorm:"not null;default:false"`
+
+	// Offset is the amount of bytes received so far, it is kept by the staging area rather than the database
+	Offset int64 `gorm:"-"`
+}
@@ -0,0 +1,119 @@
+// Copyright (c) 2020-2022 TU Delft & Valentijn van de Beek <v.d.vandebeek@student.tudelft.nl> All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package machine
+
+import (
+	"database/sql/driver"
+	"encoding/json"
+	"time"
+
+	"github.com/pkg/errors"
+	"gorm.io/gorm"
+)
+
+// FirmwareType is the firmware a machine booted the management OS with
+type FirmwareType string
+
+const (
+	// UEFI firmware, the machine boots from an EFI system partition
+	UEFI FirmwareType = "uefi"
+	// BIOS is legacy firmware, the machine boots from the master boot record
+	BIOS FirmwareType = "bios"
+)
+
+// Disk is a block device of a machine
+type Disk struct {
+	// Name is the name of the device in /dev, like sda or nvme0n1
+	Name  string
+	Model string `json:",omitempty"`
+	// Size is the size of the disk in bytes
+	Size       uint64
+	Rotational bool
+}
+
+// NIC is a network interface of a machine
+type NIC struct {
+	Name       string
+	MacAddress string
+	Driver     string `json:",omitempty"`
+	// Speed is the link speed in Mbit/s, 0 when the link is down or the speed is not known
+	Speed int `json:",omitempty"`
+}
+
+// Disks is stored as JSON in a single column
+type Disks []Disk
+
+// NICs is stored as JSON in a single column
+type NICs []NIC
+
+// Value converts the disks into JSON for the database
+func (d Disks) Value() (driver.Value, error) {
+	return jsonValue(d)
+}
+
+// Scan reads the disks from their JSON in the database
+func (d *Disks) Scan(v interface{}) error {
+	return scanJSON(v, d)
+}
+
+// Value converts the network interfaces into JSON for the database
+func (n NICs) Value() (driver.Value, error) {
+	return jsonValue(n)
+}
+
+// Scan reads the network interfaces from their JSON in the database
+func (n *NICs) Scan(v interface{}) error {
+	return scanJSON(v, n)
+}
+
+func jsonValue(v interface{}) (driver.Value, error) {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+
+	return string(data), nil
+}
+
+func scanJSON(v interface{}, dest interface{}) error {
+	switch data := v.(type) {
+	case nil:
+		return nil
+	case string:
+		return json.Unmarshal([]byte(data), dest)
+	case []byte:
+		return json.Unmarshal(data, dest)
+	default:
+		return errors.Errorf("cannot scan %T as JSON", v)
+	}
+}
+
+// InventoryModel is the hardware the management OS found when it booted a machine in discovery mode. A machine
+// which registered itself stays unmanaged until an admin approves it.
+type InventoryModel struct {
+	gorm.Model `json:"-"`
+
+	MachineMAC string `gorm:"not null;uniqueIndex" json:"-"`
+
+	CPUModel string
+	// CPUCores is the number of physical cores, CPUThreads the number of logical processors
+	CPUCores   int
+	CPUThreads int
+	// Memory is the amount of RAM in bytes
+	Memory uint64
+
+	Disks        Disks `gorm:"type:text"`
+	NICs         NICs  `gorm:"type:text"`
+	Firmware     FirmwareType
+	Architecture SystemArchitecture
+
+	// GPUs is the number of display controllers on the PCI bus
+	GPUs int `gorm:"column:gpus"`
+
+	// Approved is set once an admin accepted the machine, from then on it is managed by BAAS
+	Approved bool
+	// Time is when the control server received the inventory
+	Time time.Time `gorm:"not null"`
+}
@@ -6,6 +6,8 @@
 package machine
 
 import (
+	"database/sql/driver"
+
 	"github.com/baas-project/baas/pkg/util"
 )
 
@@ -40,4 +42,40 @@ type MachineModel struct {
 	// MacAddress is the mac address associated with this machine
 	MacAddress util.MacAddress `gorm:"embedded;unique;primaryKey"`
 	ImageUUID  string
+
+	// CurrentSetupUUID is the image setup which was last handed to the machine
+	CurrentSetupUUID string
+
+	// TokenHash is the hash of the credential the management OS uses to authenticate itself
+	TokenHash string `json:"-"`
+
+	// Labels are set by admins to describe what the machine offers, reservations can ask for them
+	Labels Labels `gorm:"type:text"`
+}
+
+// Labels are arbitrary key/value pairs, stored as JSON in a single column
+type Labels map[string]string
+
+// Value converts the labels into JSON for the database
+func (l Labels) Value() (driver.Value, error) {
+	return jsonValue(l)
+}
+
+// Scan reads the labels from their JSON in the database
+func (l *Labels) Scan(v interface{}) error {
+	return scanJSON(v, l)
+}
+
+// Copy returns labels which do not share their map with these
+func (l Labels) Copy() Labels {
+	if l == nil {
+		return nil
+	}
+
+	labels := make(Labels, len(l))
+	for key, value := range l {
+		labels[key] = value
+	}
+
+	return labels
 }
@@ -0,0 +1,31 @@
+// Copyright (c) 2020-2022 TU Delft & Valentijn van de Beek <v.d.vandebeek@student.tudelft.nl> All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package machine
+
+import (
+	"gorm.io/gorm"
+)
+
+// PowerModel tells the control server how to reach the baseboard management controller of a machine, so it can
+// switch the machine on and off without anyone at the machine
+type PowerModel struct {
+	gorm.Model `json:"-"`
+
+	MachineMAC string `gorm:"not null;uniqueIndex" json:"-"`
+
+	// Driver is the protocol the controller speaks, ipmi or redfish
+	Driver string `gorm:"not null"`
+	// Address is the host of the controller, with a port when it does not listen on the default one
+	Address string `gorm:"not null"`
+
+	Username string
+	// Password is never sent back by the control server
+	Password string `json:",omitempty"`
+
+	// SystemID picks the system of a Redfish controller which manages more than one, the first one is used otherwise
+	SystemID string `json:",omitempty"`
+	// Insecure skips the verification of the certificate of a Redfish controller, which is often self-signed
+	Insecure bool
+}
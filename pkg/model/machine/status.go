@@ -0,0 +1,72 @@
+// Copyright (c) 2020-2022 TU Delft & Valentijn van de Beek <v.d.vandebeek@student.tudelft.nl> All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package machine
+
+import (
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// ProvisioningPhase is a step the management OS goes through while it provisions its machine
+type ProvisioningPhase string
+
+const (
+	// PhaseInitializing reads the partitions and the last setup from the disk
+	PhaseInitializing ProvisioningPhase = "initializing"
+	// PhaseUploading uploads the images of the last setup which are marked for update
+	PhaseUploading ProvisioningPhase = "uploading"
+	// PhaseRequesting asks the control server for the setup to boot
+	PhaseRequesting ProvisioningPhase = "requesting"
+	// PhaseWriting lays out the partitions and writes the images of the setup to them
+	PhaseWriting ProvisioningPhase = "writing"
+	// PhaseFinishing stores the setup and the partitions on the disk for the next boot
+	PhaseFinishing ProvisioningPhase = "finishing"
+	// PhaseDone is reported once the setup is on the disk, right before the machine boots it
+	PhaseDone ProvisioningPhase = "done"
+	// PhaseFailed is reported when a phase failed for good, the machine does not boot the setup
+	PhaseFailed ProvisioningPhase = "failed"
+)
+
+// Valid checks whether the phase is one of the known phases
+func (phase ProvisioningPhase) Valid() bool {
+	switch phase {
+	case PhaseInitializing, PhaseUploading, PhaseRequesting, PhaseWriting, PhaseFinishing, PhaseDone, PhaseFailed:
+		return true
+	default:
+		return false
+	}
+}
+
+// StatusModel is a status the management OS of a machine reported, one is stored for every transition
+type StatusModel struct {
+	gorm.Model `json:"-"`
+
+	MachineMAC string            `gorm:"not null;index" json:"-"`
+	Phase      ProvisioningPhase `gorm:"not null"`
+
+	// SetupUUID is the image setup which is being provisioned, it is empty before the machine got one
+	SetupUUID string `json:",omitempty"`
+
+	// Image and Version are the image the phase is working on. Completed is the number of images of the phase
+	// which are done out of Total.
+	Image     string `json:",omitempty"`
+	Version   uint64 `json:",omitempty"`
+	Completed int    `json:",omitempty"`
+	Total     int    `json:",omitempty"`
+
+	// Attempt counts the tries of the phase, starting at 1
+	Attempt int    `json:",omitempty"`
+	Error   string `json:",omitempty"`
+
+	// Time is when the control server received the status
+	Time time.Time `gorm:"not null"`
+}
+
+// MachineStatus is the latest status of a machine with the statuses which came before it, oldest first
+type MachineStatus struct {
+	Latest  *StatusModel
+	History []StatusModel
+}
@@ -0,0 +1,70 @@
+// Copyright (c) 2020-2022 TU Delft & Valentijn van de Beek <v.d.vandebeek@student.tudelft.nl> All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package reservation defines the database entities used to schedule machine time slots
+package reservation
+
+import (
+	"time"
+
+	"github.com/baas-project/baas/pkg/model/images"
+	"gorm.io/gorm"
+)
+
+// ReservationStatus describes at which point in its lifetime a reservation is.
+// nolint: golint
+type ReservationStatus string
+
+const (
+	// Scheduled reservations are waiting for their slot to start
+	Scheduled ReservationStatus = "scheduled"
+	// Active reservations have their setup enqueued on the machine
+	Active ReservationStatus = "active"
+	// Finished reservations have ended and the machine has been given back
+	Finished ReservationStatus = "finished"
+	// Cancelled reservations were withdrawn before they ended
+	Cancelled ReservationStatus = "cancelled"
+)
+
+// ReservationModel books a machine for a user during a time window.
+// During this window the setup of the user is booted on the machine.
+// nolint: golint
+type ReservationModel struct {
+	gorm.Model `json:"-"`
+
+	// UUID is the unique identifier of the reservation
+	UUID string `gorm:"uniqueIndex;not null"`
+
+	// Username is the user who booked the machine
+	Username string `gorm:"not null;index"`
+
+	// MachineMAC is the machine which is booked. When it is left out a free machine which satisfies the
+	// constraints is picked.
+	MachineMAC string `gorm:"not null;index"`
+
+	// Constraints the machine had to satisfy, like "arch=x86_64, mem>=64G, label:numa=2"
+	Constraints string `json:",omitempty"`
+
+	// SetupUUID is the image setup which is booted when the slot starts
+	SetupUUID images.ImageUUID `gorm:"not null"`
+
+	// Update indicates whether the changes made during the slot should be uploaded
+	Update bool `gorm:"not null;default:false"`
+
+	// Start and End define the time window [Start, End) of the reservation
+	Start time.Time `gorm:"column:start_time;not null;index"`
+	End   time.Time `gorm:"column:end_time;not null;index"`
+
+	Status ReservationStatus `gorm:"not null;index"`
+}
+
+// Overlaps checks whether the reservation intersects with the window [start, end)
+func (r *ReservationModel) Overlaps(start time.Time, end time.Time) bool {
+	return r.Start.Before(end) && start.Before(r.End)
+}
+
+// Blocking returns whether this reservation still occupies its machine
+func (r *ReservationModel) Blocking() bool {
+	return r.Status == Scheduled || r.Status == Active
+}
@@ -0,0 +1,79 @@
+// Copyright (c) 2020-2022 TU Delft & Valentijn van de Beek <v.d.vandebeek@student.tudelft.nl> All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package user
+
+import (
+	"bytes"
+	"crypto/ed25519"
+
+	"github.com/pkg/errors"
+	"gorm.io/gorm"
+)
+
+// minisignAlgorithm starts minisign keys and legacy minisign signatures, it is followed by an 8 byte key ID
+var minisignAlgorithm = []byte("Ed")
+
+// minisignKeyIDSize is the size of the key ID in minisign keys and signatures
+const minisignKeyIDSize = 8
+
+// SigningKeyModel is an ed25519 key with which a user signs versions of images. The control server keeps the
+// private key of the keys it generates, users may also register the public key of a key they keep themselves.
+type SigningKeyModel struct {
+	gorm.Model `json:"-"`
+
+	// UUID identifies the key in signatures
+	UUID string `gorm:"uniqueIndex;not null"`
+
+	// Username is the user who signs with this key
+	Username string `gorm:"not null;index"`
+
+	// Name is a description given by the user
+	Name string
+
+	PublicKey  []byte `gorm:"not null"`
+	PrivateKey []byte `json:"-"`
+
+	// Managed indicates that the control server has the private key and signs with it
+	Managed bool
+}
+
+// ParsePublicKey accepts a raw ed25519 public key or one in the format of minisign
+func ParsePublicKey(key []byte) (ed25519.PublicKey, error) {
+	if len(key) == len(minisignAlgorithm)+minisignKeyIDSize+ed25519.PublicKeySize &&
+		bytes.HasPrefix(key, minisignAlgorithm) {
+		key = key[len(minisignAlgorithm)+minisignKeyIDSize:]
+	}
+
+	if len(key) != ed25519.PublicKeySize {
+		return nil, errors.New("not an ed25519 public key")
+	}
+
+	return ed25519.PublicKey(key), nil
+}
+
+// ParseSignature accepts a raw ed25519 signature or a legacy minisign signature, minisign signs the
+// BLAKE2b hash of the message by default which is not supported.
+func ParseSignature(signature []byte) ([]byte, error) {
+	if len(signature) == len(minisignAlgorithm)+minisignKeyIDSize+ed25519.SignatureSize &&
+		bytes.HasPrefix(signature, minisignAlgorithm) {
+		signature = signature[len(minisignAlgorithm)+minisignKeyIDSize:]
+	}
+
+	if len(signature) != ed25519.SignatureSize {
+		return nil, errors.New("not an ed25519 signature, minisign signatures have to be made with -l")
+	}
+
+	return signature, nil
+}
+
+// Verify checks that the signature of the message was made with this key
+func (key *SigningKeyModel) Verify(message []byte, signature []byte) bool {
+	public, err := ParsePublicKey(key.PublicKey)
+	if err != nil {
+		return false
+	}
+
+	return ed25519.Verify(public, message, signature)
+}
@@ -0,0 +1,54 @@
+// Copyright (c) 2020-2022 TU Delft & Valentijn van de Beek <v.d.vandebeek@student.tudelft.nl> All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package user
+
+import (
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// roleLevels orders the roles from the least to the most privileged
+var roleLevels = map[UserRole]int{
+	User:      0,
+	Moderator: 1,
+	Admin:     2,
+}
+
+// Includes checks whether this role grants at least the permissions of the other role
+func (role UserRole) Includes(other UserRole) bool {
+	level, ok := roleLevels[role]
+	otherLevel, otherOk := roleLevels[other]
+
+	return ok && otherOk && level >= otherLevel
+}
+
+// AccessTokenModel is a personal access token which lets scripts use the API on behalf of a user.
+// The token itself is only shown once when it is created, the database only stores its hash.
+// nolint: golint
+type AccessTokenModel struct {
+	gorm.Model `json:"-"`
+
+	// UUID identifies the token so it can be revoked
+	UUID string `gorm:"uniqueIndex;not null"`
+
+	// Username is the user on whose behalf the token acts
+	Username string `gorm:"not null;index"`
+
+	// Name is a description given by the user, such as the pipeline which uses it
+	Name string
+
+	// Role is the role of the requests made with the token, it can never exceed the role of the user
+	Role UserRole `gorm:"not null"`
+
+	TokenHash string    `gorm:"uniqueIndex;not null" json:"-"`
+	ExpiresAt time.Time `gorm:"not null"`
+	LastUsed  *time.Time
+}
+
+// Expired checks whether the token can no longer be used at the given time
+func (token *AccessTokenModel) Expired(now time.Time) bool {
+	return !now.Before(token.ExpiresAt)
+}
@@ -32,4 +32,8 @@ type UserModel struct {
 	Role     UserRole             `gorm:"not null;"`
 	Images   []images2.ImageModel `json:"-" gorm:"foreignKey:Username;constraint:OnUpdate:CASCADE,OnDelete:CASCADE"`
 	Setups   []images2.ImageSetup `json:"-" gorm:"foreignKey:Username;constraint:OnUpdate:CASCADE,OnDelete:CASCADE"`
+	Tokens   []AccessTokenModel   `json:"-" gorm:"foreignKey:Username;constraint:OnUpdate:CASCADE,OnDelete:CASCADE"`
+
+	// Retention is the policy for the images of the user which do not have their own
+	Retention images2.RetentionPolicy `gorm:"embedded;embeddedPrefix:retention_"`
 }
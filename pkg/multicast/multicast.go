@@ -0,0 +1,160 @@
+// Copyright (c) 2020-2022 TU Delft & Valentijn van de Beek <v.d.vandebeek@student.tudelft.nl> All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package multicast sends an image file to many machines at once over UDP. The sender sends every packet of
+// the file once to a multicast (or broadcast) group. Receivers ask the sender for the packets they missed with
+// negative acknowledgements (NACKs), which are sent to the group again, so a packet lost by several receivers is
+// only repeated once. A receiver which joins late asks for everything it missed in the same way, so it catches
+// up while the others finish.
+//
+// Every packet starts with a header of the magic, the type of the packet and the session it belongs to:
+//
+//	data: header | sequence number (8) | payload
+//	nack: header | ranges of missing packets, each a first sequence number (8) and a count (4)
+//	join, done: header
+//
+// Data packets go from the sender to the group, the other packets go from a receiver to the sender.
+package multicast
+
+import (
+	"bytes"
+	"encoding/binary"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	// PacketSize is the size of the largest packet, it fits in the MTU of an ethernet network
+	PacketSize = 1400
+	// PayloadSize is the part of the file which is sent in a data packet
+	PayloadSize = PacketSize - dataHeaderSize
+
+	headerSize     = 4 + 1 + 4
+	dataHeaderSize = headerSize + 8
+	rangeSize      = 8 + 4
+	maxRanges      = (PacketSize - headerSize) / rangeSize
+)
+
+var magic = []byte("BMC1")
+
+type packetType uint8
+
+const (
+	typeData packetType = iota + 1
+	typeNack
+	typeJoin
+	typeDone
+)
+
+var (
+	// ErrStalled is returned by a receiver when the sender stopped sending the packets it needs
+	ErrStalled = errors.New("the multicast transfer stalled")
+	// ErrDigestMismatch is returned by a receiver when the file it received does not have the digest of the session
+	ErrDigestMismatch = errors.New("the file received over multicast does not match its digest")
+)
+
+const (
+	// DefaultRate is the amount of bytes per second a sender sends, a network dropping most packets is slower
+	DefaultRate = 40 * 1024 * 1024
+	// DefaultTimeout is how long a sender waits for receivers which stopped sending anything, and how long a
+	// receiver waits for packets before it gives up
+	DefaultTimeout = 30 * time.Second
+)
+
+// Packets returns the amount of data packets a file of the given size is sent in
+func Packets(size int64) uint64 {
+	return uint64((size + PayloadSize - 1) / PayloadSize)
+}
+
+// packetRange is a series of packets, identified by their sequence numbers
+type packetRange struct {
+	first uint64
+	count uint32
+}
+
+// packet is a decoded packet of any type
+type packet struct {
+	kind    packetType
+	session uint32
+
+	seq     uint64
+	payload []byte
+	ranges  []packetRange
+}
+
+// header writes the header of a packet of the kind into buf and returns the rest of buf
+func header(buf []byte, kind packetType, session uint32) []byte {
+	copy(buf, magic)
+	buf[4] = byte(kind)
+	binary.BigEndian.PutUint32(buf[5:], session)
+	return buf[headerSize:]
+}
+
+// encodeData creates a data packet in buf, which has to hold PacketSize bytes
+func encodeData(buf []byte, session uint32, seq uint64, payload []byte) []byte {
+	rest := header(buf, typeData, session)
+	binary.BigEndian.PutUint64(rest, seq)
+	n := copy(rest[8:], payload)
+	return buf[:dataHeaderSize+n]
+}
+
+// encodeNack creates a NACK for at most maxRanges of the ranges
+func encodeNack(session uint32, ranges []packetRange) []byte {
+	if len(ranges) > maxRanges {
+		ranges = ranges[:maxRanges]
+	}
+
+	buf := make([]byte, headerSize+len(ranges)*rangeSize)
+	rest := header(buf, typeNack, session)
+	for i, r := range ranges {
+		binary.BigEndian.PutUint64(rest[i*rangeSize:], r.first)
+		binary.BigEndian.PutUint32(rest[i*rangeSize+8:], r.count)
+	}
+
+	return buf
+}
+
+// encodeControl creates a packet without contents, a join or a done
+func encodeControl(kind packetType, session uint32) []byte {
+	buf := make([]byte, headerSize)
+	header(buf, kind, session)
+	return buf
+}
+
+// decode reads a packet, the payload of a data packet points into buf
+func decode(buf []byte) (*packet, error) {
+	if len(buf) < headerSize || !bytes.Equal(buf[:4], magic) {
+		return nil, errors.New("not a multicast packet")
+	}
+
+	p := &packet{kind: packetType(buf[4]), session: binary.BigEndian.Uint32(buf[5:])}
+	rest := buf[headerSize:]
+
+	switch p.kind {
+	case typeData:
+		if len(rest) < 8 {
+			return nil, errors.New("short data packet")
+		}
+
+		p.seq = binary.BigEndian.Uint64(rest)
+		p.payload = rest[8:]
+	case typeNack:
+		if len(rest)%rangeSize != 0 {
+			return nil, errors.New("invalid nack packet")
+		}
+
+		for i := 0; i < len(rest); i += rangeSize {
+			p.ranges = append(p.ranges, packetRange{
+				first: binary.BigEndian.Uint64(rest[i:]),
+				count: binary.BigEndian.Uint32(rest[i+8:]),
+			})
+		}
+	case typeJoin, typeDone:
+	default:
+		return nil, errors.Errorf("unknown packet type %d", p.kind)
+	}
+
+	return p, nil
+}
@@ -0,0 +1,325 @@
+// Copyright (c) 2020-2022 TU Delft & Valentijn van de Beek <v.d.vandebeek@student.tudelft.nl> All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package multicast
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"io/ioutil"
+	"math/rand"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+)
+
+// memAddr is an address on a memNetwork
+type memAddr string
+
+func (a memAddr) Network() string { return "mem" }
+func (a memAddr) String() string  { return string(a) }
+
+// memNetwork delivers packets between connections in memory, a packet sent to a group reaches every connection
+// which joined it. Every delivery is dropped with the given chance.
+type memNetwork struct {
+	mutex sync.Mutex
+	conns map[string][]*memConn
+	loss  float64
+	rand  *rand.Rand
+}
+
+func newMemNetwork(loss float64) *memNetwork {
+	return &memNetwork{conns: make(map[string][]*memConn), loss: loss, rand: rand.New(rand.NewSource(1))}
+}
+
+// listen creates a connection with the address, which also receives the packets sent to the groups
+func (n *memNetwork) listen(addr string, groups ...string) *memConn {
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+
+	c := &memConn{network: n, addr: memAddr(addr), packets: make(chan memPacket, 65536)}
+	for _, to := range append(groups, addr) {
+		n.conns[to] = append(n.conns[to], c)
+	}
+
+	return c
+}
+
+type memPacket struct {
+	from memAddr
+	data []byte
+}
+
+type memConn struct {
+	network *memNetwork
+	addr    memAddr
+	packets chan memPacket
+
+	mutex    sync.Mutex
+	deadline time.Time
+}
+
+type timeoutError struct{}
+
+func (timeoutError) Error() string   { return "i/o timeout" }
+func (timeoutError) Timeout() bool   { return true }
+func (timeoutError) Temporary() bool { return true }
+
+func (c *memConn) ReadFrom(p []byte) (int, net.Addr, error) {
+	c.mutex.Lock()
+	deadline := c.deadline
+	c.mutex.Unlock()
+
+	timer := time.NewTimer(time.Until(deadline))
+	defer timer.Stop()
+
+	select {
+	case packet := <-c.packets:
+		return copy(p, packet.data), packet.from, nil
+	case <-timer.C:
+		return 0, nil, timeoutError{}
+	}
+}
+
+func (c *memConn) WriteTo(p []byte, addr net.Addr) (int, error) {
+	c.network.mutex.Lock()
+	defer c.network.mutex.Unlock()
+
+	for _, to := range c.network.conns[addr.String()] {
+		if c.network.rand.Float64() < c.network.loss {
+			continue
+		}
+
+		// A full buffer drops the packet, like a socket does
+		select {
+		case to.packets <- memPacket{from: c.addr, data: append([]byte(nil), p...)}:
+		default:
+		}
+	}
+
+	return len(p), nil
+}
+
+func (c *memConn) SetReadDeadline(t time.Time) error {
+	c.mutex.Lock()
+	c.deadline = t
+	c.mutex.Unlock()
+	return nil
+}
+
+func (c *memConn) Close() error                       { return nil }
+func (c *memConn) LocalAddr() net.Addr                { return c.addr }
+func (c *memConn) SetDeadline(t time.Time) error      { return c.SetReadDeadline(t) }
+func (c *memConn) SetWriteDeadline(_ time.Time) error { return nil }
+
+// testFile creates a file which does not compress, so every packet is different
+func testFile(size int) ([]byte, string) {
+	data := make([]byte, size)
+	rand.New(rand.NewSource(int64(size))).Read(data)
+
+	hash := sha256.Sum256(data)
+	return data, hex.EncodeToString(hash[:])
+}
+
+// receive reads the whole file from the session and returns what was read
+func receive(t *testing.T, conn net.PacketConn, sender net.Addr, size int64, digest string) ([]byte, error) {
+	r, err := NewReceiver(conn, sender, 7, size, digest)
+	assert.NoError(t, err)
+
+	return ioutil.ReadAll(r)
+}
+
+func TestTransfer(t *testing.T) {
+	network := newMemNetwork(0.05)
+	file, digest := testFile(1024*1024 + 100)
+
+	sender := NewSender(network.listen("sender"), memAddr("group"), 7, bytes.NewReader(file), int64(len(file)))
+	sender.Rate = 5 * 1024 * 1024
+
+	finished := make(chan error)
+	go func() {
+		finished <- sender.Run()
+	}()
+
+	var wait sync.WaitGroup
+	received := make([][]byte, 4)
+
+	for i := range received {
+		wait.Add(1)
+		conn := network.listen(string(rune('a'+i)), "group")
+
+		go func(i int) {
+			defer wait.Done()
+
+			// The last receiver joins when the sender is halfway, it catches up with the packets it asks for
+			if i == len(received)-1 {
+				time.Sleep(100 * time.Millisecond)
+			}
+
+			data, err := receive(t, conn, memAddr("sender"), int64(len(file)), digest)
+			assert.NoError(t, err)
+			received[i] = data
+		}(i)
+	}
+
+	wait.Wait()
+	assert.NoError(t, <-finished)
+
+	for _, data := range received {
+		assert.True(t, bytes.Equal(file, data))
+	}
+
+	joined, done := sender.Receivers()
+	assert.Equal(t, 4, joined)
+	assert.Equal(t, 4, done)
+	assert.False(t, sender.Touch())
+}
+
+func TestTransferEmpty(t *testing.T) {
+	network := newMemNetwork(0)
+	_, digest := testFile(0)
+
+	sender := NewSender(network.listen("sender"), memAddr("group"), 7, bytes.NewReader(nil), 0)
+	go func() {
+		_ = sender.Run()
+	}()
+
+	defer sender.Close()
+
+	data, err := receive(t, network.listen("a", "group"), memAddr("sender"), 0, digest)
+	assert.NoError(t, err)
+	assert.Empty(t, data)
+}
+
+func TestTransferDigestMismatch(t *testing.T) {
+	network := newMemNetwork(0)
+	file, _ := testFile(10000)
+	_, digest := testFile(10001)
+
+	sender := NewSender(network.listen("sender"), memAddr("group"), 7, bytes.NewReader(file), int64(len(file)))
+	go func() {
+		_ = sender.Run()
+	}()
+
+	defer sender.Close()
+
+	_, err := receive(t, network.listen("a", "group"), memAddr("sender"), int64(len(file)), digest)
+	assert.Equal(t, ErrDigestMismatch, errors.Cause(err))
+}
+
+func TestTransferStalled(t *testing.T) {
+	network := newMemNetwork(0)
+	_, digest := testFile(10000)
+
+	// Nobody is sending
+	r, err := NewReceiver(network.listen("a", "group"), memAddr("sender"), 7, 10000, digest)
+	assert.NoError(t, err)
+
+	r.Timeout = 300 * time.Millisecond
+	_, err = ioutil.ReadAll(r)
+	assert.Equal(t, ErrStalled, errors.Cause(err))
+}
+
+func TestPacketEncoding(t *testing.T) {
+	buf := make([]byte, PacketSize)
+	p, err := decode(encodeData(buf, 3, 42, []byte("hello")))
+	assert.NoError(t, err)
+	assert.Equal(t, typeData, p.kind)
+	assert.Equal(t, uint32(3), p.session)
+	assert.Equal(t, uint64(42), p.seq)
+	assert.Equal(t, []byte("hello"), p.payload)
+
+	ranges := make([]packetRange, maxRanges+10)
+	for i := range ranges {
+		ranges[i] = packetRange{first: uint64(i * 10), count: 5}
+	}
+
+	nack := encodeNack(3, ranges)
+	assert.LessOrEqual(t, len(nack), PacketSize)
+
+	p, err = decode(nack)
+	assert.NoError(t, err)
+	assert.Equal(t, ranges[:maxRanges], p.ranges)
+
+	_, err = decode([]byte("hello world"))
+	assert.Error(t, err)
+}
+
+// multicastInterface finds an interface which can send multicast packets to itself
+func multicastInterface() *net.Interface {
+	interfaces, err := net.Interfaces()
+	if err != nil {
+		return nil
+	}
+
+	for i := range interfaces {
+		if interfaces[i].Flags&net.FlagUp != 0 && interfaces[i].Flags&net.FlagMulticast != 0 {
+			return &interfaces[i]
+		}
+	}
+
+	return nil
+}
+
+func TestTransferUDP(t *testing.T) {
+	ifi := multicastInterface()
+	if ifi == nil {
+		t.Skip("no interface which supports multicast")
+	}
+
+	conn, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4zero})
+	assert.NoError(t, err)
+	defer conn.Close()
+
+	group := &net.UDPAddr{IP: net.IPv4(239, 255, 66, 1), Port: 40000 + rand.Intn(10000)}
+	var receivers []*net.UDPConn
+	for i := 0; i < 2; i++ {
+		r, err := net.ListenMulticastUDP("udp4", ifi, group)
+		if err != nil {
+			t.Skipf("cannot join multicast group: %v", err)
+		}
+
+		defer r.Close()
+		receivers = append(receivers, r)
+	}
+
+	// Not every network lets multicast packets through, in which case there is nothing to test
+	_, _ = conn.WriteTo([]byte("probe"), group)
+	_ = receivers[0].SetReadDeadline(time.Now().Add(time.Second))
+	if _, _, err = receivers[0].ReadFrom(make([]byte, 16)); err != nil {
+		t.Skipf("multicast packets do not arrive: %v", err)
+	}
+
+	_, _, _ = receivers[1].ReadFrom(make([]byte, 16))
+
+	file, digest := testFile(512 * 1024)
+	sender := NewSender(conn, group, 7, bytes.NewReader(file), int64(len(file)))
+
+	finished := make(chan error)
+	go func() {
+		finished <- sender.Run()
+	}()
+
+	control := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: conn.LocalAddr().(*net.UDPAddr).Port}
+
+	var wait sync.WaitGroup
+	for _, r := range receivers {
+		wait.Add(1)
+		go func(r *net.UDPConn) {
+			defer wait.Done()
+
+			data, err := receive(t, r, control, int64(len(file)), digest)
+			assert.NoError(t, err)
+			assert.True(t, bytes.Equal(file, data))
+		}(r)
+	}
+
+	wait.Wait()
+	assert.NoError(t, <-finished)
+}
@@ -0,0 +1,194 @@
+// Copyright (c) 2020-2022 TU Delft & Valentijn van de Beek <v.d.vandebeek@student.tudelft.nl> All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package multicast
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"hash"
+	"io"
+	"net"
+	"time"
+
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// window is how many packets past the next one a receiver keeps, packets further ahead are dropped and asked
+	// for again later. This bounds the memory of a receiver to a few MiB.
+	window = 4096
+	// nackInterval is how long a receiver waits before it asks for missing packets (again)
+	nackInterval = 100 * time.Millisecond
+)
+
+// Receiver reads a file from a group in order, so it can be written to a disk while it arrives. Missing packets
+// are asked for from the sender, the file is checked against its digest at the end.
+type Receiver struct {
+	// Timeout is how long the receiver waits for a packet it needs before it gives up
+	Timeout time.Duration
+
+	conn    net.PacketConn
+	sender  net.Addr
+	session uint32
+	total   uint64
+	digest  []byte
+	hash    hash.Hash
+
+	next    uint64
+	packets map[uint64][]byte
+	highest uint64
+	pending []byte
+
+	progress time.Time
+	useful   time.Time
+	nacked   time.Time
+	buf      []byte
+}
+
+// NewReceiver joins the session of the sender. Conn receives the packets sent to the group, the digest is the
+// hex encoded SHA-256 of the file.
+func NewReceiver(conn net.PacketConn, sender net.Addr, session uint32, size int64, digest string) (*Receiver, error) {
+	raw, err := hex.DecodeString(digest)
+	if err != nil || len(raw) != sha256.Size {
+		return nil, errors.Errorf("invalid digest %q", digest)
+	}
+
+	r := &Receiver{
+		Timeout:  DefaultTimeout,
+		conn:     conn,
+		sender:   sender,
+		session:  session,
+		total:    Packets(size),
+		digest:   raw,
+		hash:     sha256.New(),
+		packets:  make(map[uint64][]byte),
+		progress: time.Now(),
+		useful:   time.Now(),
+		buf:      make([]byte, PacketSize),
+	}
+
+	if _, err = conn.WriteTo(encodeControl(typeJoin, session), sender); err != nil {
+		return nil, errors.Wrap(err, "join multicast session")
+	}
+
+	return r, nil
+}
+
+func (r *Receiver) Read(p []byte) (int, error) {
+	for len(r.pending) == 0 {
+		if data, ok := r.packets[r.next]; ok {
+			delete(r.packets, r.next)
+			r.hash.Write(data)
+			r.pending = data
+			r.next++
+			r.progress = time.Now()
+			break
+		}
+
+		if r.next == r.total {
+			return 0, r.finish()
+		}
+
+		if time.Since(r.progress) > r.Timeout {
+			return 0, errors.Wrapf(ErrStalled, "no packet %d of %d within %v", r.next, r.total, r.Timeout)
+		}
+
+		if err := r.receive(); err != nil {
+			return 0, err
+		}
+	}
+
+	n := copy(p, r.pending)
+	r.pending = r.pending[n:]
+	return n, nil
+}
+
+// receive waits for a packet in the window and asks for the missing ones when they are late
+func (r *Receiver) receive() error {
+	if time.Since(r.nacked) > nackInterval {
+		r.nack()
+	}
+
+	_ = r.conn.SetReadDeadline(time.Now().Add(nackInterval))
+	n, _, err := r.conn.ReadFrom(r.buf)
+	if ne, ok := err.(net.Error); ok && ne.Timeout() {
+		return nil
+	} else if err != nil {
+		return errors.Wrap(err, "receive multicast packet")
+	}
+
+	p, err := decode(r.buf[:n])
+	if err != nil || p.kind != typeData || p.session != r.session {
+		return nil
+	}
+
+	if p.seq < r.next || p.seq >= r.next+window || p.seq >= r.total {
+		return nil
+	}
+
+	if _, ok := r.packets[p.seq]; !ok {
+		r.packets[p.seq] = append([]byte(nil), p.payload...)
+		r.useful = time.Now()
+
+		if p.seq > r.highest {
+			r.highest = p.seq
+		}
+	}
+
+	return nil
+}
+
+// nack asks for the packets which are missing. Those before the highest packet received were lost, when no
+// packet arrived for a while the rest of the window is asked for as well: the receiver joined late or the end of
+// the file was lost.
+func (r *Receiver) nack() {
+	end := r.highest
+	if time.Since(r.useful) > nackInterval || end < r.next {
+		end = r.next + window - 1
+	}
+
+	if end >= r.total {
+		end = r.total - 1
+	}
+
+	var ranges []packetRange
+	for seq := r.next; seq <= end && len(ranges) < maxRanges; seq++ {
+		if _, ok := r.packets[seq]; ok {
+			continue
+		}
+
+		if n := len(ranges); n > 0 && ranges[n-1].first+uint64(ranges[n-1].count) == seq {
+			ranges[n-1].count++
+		} else {
+			ranges = append(ranges, packetRange{first: seq, count: 1})
+		}
+	}
+
+	r.nacked = time.Now()
+	if len(ranges) == 0 {
+		return
+	}
+
+	if _, err := r.conn.WriteTo(encodeNack(r.session, ranges), r.sender); err != nil {
+		log.Warnf("Cannot ask for the missing packets of multicast session %d: %v", r.session, err)
+	}
+}
+
+// finish checks the digest and tells the sender the receiver is done
+func (r *Receiver) finish() error {
+	// The sender keeps going for a while when this gets lost, so it is sent a few times
+	for i := 0; i < 3; i++ {
+		_, _ = r.conn.WriteTo(encodeControl(typeDone, r.session), r.sender)
+	}
+
+	if sum := r.hash.Sum(nil); !bytes.Equal(sum, r.digest) {
+		return errors.Wrapf(ErrDigestMismatch, "got %s, expected %s", hex.EncodeToString(sum),
+			hex.EncodeToString(r.digest))
+	}
+
+	return io.EOF
+}
@@ -0,0 +1,279 @@
+// Copyright (c) 2020-2022 TU Delft & Valentijn van de Beek <v.d.vandebeek@student.tudelft.nl> All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package multicast
+
+import (
+	"io"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+)
+
+// doneLinger is how long a sender whose receivers are all done waits for others which are still joining
+const doneLinger = 2 * time.Second
+
+// Sender sends a file to a group. It sends every packet once and then repeats the packets receivers ask for,
+// until every receiver is done or none of them was heard from for Timeout.
+type Sender struct {
+	// Rate is the amount of bytes sent per second, 0 sends as fast as possible
+	Rate int64
+	// Timeout is how long the sender keeps going without hearing from receivers which are not done
+	Timeout time.Duration
+
+	conn    net.PacketConn
+	group   net.Addr
+	session uint32
+	file    io.ReaderAt
+	size    int64
+	total   uint64
+
+	mutex     sync.Mutex
+	wake      chan struct{}
+	cursor    uint64
+	queue     []uint64
+	queued    map[uint64]bool
+	receivers map[string]bool
+	active    time.Time
+	closed    bool
+}
+
+// NewSender creates a sender of the file of the given size. The packets are sent from conn to the group,
+// the receivers send their requests to conn as well.
+func NewSender(conn net.PacketConn, group net.Addr, session uint32, file io.ReaderAt, size int64) *Sender {
+	return &Sender{
+		Rate:      DefaultRate,
+		Timeout:   DefaultTimeout,
+		conn:      conn,
+		group:     group,
+		session:   session,
+		file:      file,
+		size:      size,
+		total:     Packets(size),
+		wake:      make(chan struct{}, 1),
+		queued:    make(map[uint64]bool),
+		receivers: make(map[string]bool),
+		active:    time.Now(),
+	}
+}
+
+// Touch keeps the sender going for another Timeout, a machine which is told about the session may not have
+// joined yet. It returns false when the sender already finished, a new session is needed then.
+func (s *Sender) Touch() bool {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if s.closed {
+		return false
+	}
+
+	s.active = time.Now()
+	return true
+}
+
+// Close stops the sender
+func (s *Sender) Close() {
+	s.mutex.Lock()
+	s.closed = true
+	s.mutex.Unlock()
+
+	s.signal()
+}
+
+// Receivers returns how many receivers joined and how many of them are done
+func (s *Sender) Receivers() (joined int, done int) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	for _, finished := range s.receivers {
+		joined++
+		if finished {
+			done++
+		}
+	}
+
+	return joined, done
+}
+
+func (s *Sender) signal() {
+	select {
+	case s.wake <- struct{}{}:
+	default:
+	}
+}
+
+// Run sends the file and answers the receivers until the transfer is finished
+func (s *Sender) Run() error {
+	listening := make(chan struct{})
+	go func() {
+		defer close(listening)
+		s.listen()
+	}()
+
+	defer func() {
+		s.Close()
+		<-listening
+	}()
+
+	buf := make([]byte, PacketSize)
+	payload := make([]byte, PayloadSize)
+	start := time.Now()
+	var sent int64
+
+	for {
+		seq, ok, err := s.next()
+		if err != nil || !ok {
+			return err
+		}
+
+		n, err := s.file.ReadAt(payload[:s.payloadSize(seq)], int64(seq)*PayloadSize)
+		if err != nil && err != io.EOF {
+			return errors.Wrapf(err, "read packet %d", seq)
+		}
+
+		if _, err = s.conn.WriteTo(encodeData(buf, s.session, seq, payload[:n]), s.group); err != nil {
+			log.Warnf("Cannot send packet %d of multicast session %d: %v", seq, s.session, err)
+		}
+
+		// The packets are spread out over time, sending them all at once only fills the buffers of the switches
+		sent += int64(n)
+		if s.Rate > 0 {
+			ahead := time.Duration(sent*int64(time.Second)/s.Rate) - time.Since(start)
+			if ahead > time.Millisecond {
+				time.Sleep(ahead)
+			}
+		}
+	}
+}
+
+// payloadSize returns the size of the payload of the packet, only the last one can be shorter
+func (s *Sender) payloadSize(seq uint64) int {
+	if rest := s.size - int64(seq)*PayloadSize; rest < PayloadSize {
+		return int(rest)
+	}
+
+	return PayloadSize
+}
+
+// next picks the packet to send: the packets which were asked for come first, then the rest of the file. It
+// waits for requests once the whole file has been sent, until the transfer is finished.
+func (s *Sender) next() (uint64, bool, error) {
+	for {
+		s.mutex.Lock()
+		if s.closed {
+			s.mutex.Unlock()
+			return 0, false, nil
+		}
+
+		if len(s.queue) > 0 {
+			seq := s.queue[0]
+			s.queue = s.queue[1:]
+			delete(s.queued, seq)
+			s.mutex.Unlock()
+			return seq, true, nil
+		}
+
+		if s.cursor < s.total {
+			seq := s.cursor
+			s.cursor++
+			s.mutex.Unlock()
+			return seq, true, nil
+		}
+
+		if s.finished() {
+			s.closed = true
+			s.mutex.Unlock()
+			return 0, false, nil
+		}
+
+		s.mutex.Unlock()
+
+		select {
+		case <-s.wake:
+		case <-time.After(100 * time.Millisecond):
+		}
+	}
+}
+
+// finished reports whether every receiver is done, or whether the ones which are not stopped responding
+func (s *Sender) finished() bool {
+	idle := time.Since(s.active)
+
+	done := len(s.receivers) > 0
+	for _, finished := range s.receivers {
+		done = done && finished
+	}
+
+	if done {
+		return idle > doneLinger
+	}
+
+	return idle > s.Timeout
+}
+
+// listen handles the packets of the receivers until the sender is closed
+func (s *Sender) listen() {
+	buf := make([]byte, PacketSize)
+
+	for {
+		s.mutex.Lock()
+		closed := s.closed
+		s.mutex.Unlock()
+
+		if closed {
+			return
+		}
+
+		_ = s.conn.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+		n, addr, err := s.conn.ReadFrom(buf)
+		if err != nil {
+			if ne, ok := err.(net.Error); ok && ne.Timeout() {
+				continue
+			}
+
+			log.Warnf("Cannot read from the receivers of multicast session %d: %v", s.session, err)
+			return
+		}
+
+		// The sender may hear its own packets when the group is a broadcast address
+		p, err := decode(buf[:n])
+		if err != nil || p.session != s.session || p.kind == typeData {
+			continue
+		}
+
+		s.handle(addr, p)
+	}
+}
+
+// handle processes the packet of a receiver, any packet counts as a sign of life
+func (s *Sender) handle(addr net.Addr, p *packet) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.active = time.Now()
+	if _, ok := s.receivers[addr.String()]; !ok {
+		log.Debugf("Receiver %s joined multicast session %d", addr, s.session)
+		s.receivers[addr.String()] = false
+	}
+
+	switch p.kind {
+	case typeDone:
+		s.receivers[addr.String()] = true
+	case typeNack:
+		// Packets which were not sent yet are still coming, they are not sent twice
+		for _, r := range p.ranges {
+			for seq := r.first; seq < r.first+uint64(r.count) && seq < s.cursor; seq++ {
+				if !s.queued[seq] {
+					s.queued[seq] = true
+					s.queue = append(s.queue, seq)
+				}
+			}
+		}
+
+		s.signal()
+	}
+}
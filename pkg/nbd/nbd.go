@@ -0,0 +1,399 @@
+// Copyright (c) 2020-2022 TU Delft & Valentijn van de Beek <v.d.vandebeek@student.tudelft.nl> All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package nbd serves block devices over the network block device (NBD) protocol, so a machine can use a disk
+// which stays on the control server. Only the fixed newstyle handshake is supported, which is what nbd-client
+// and the kernel use. The protocol is described in
+// https://github.com/NetworkBlockDevice/nbd/blob/master/doc/proto.md
+package nbd
+
+import (
+	"encoding/binary"
+	"io"
+	"net"
+	"sync"
+
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+)
+
+// Device is what an export serves, reads and writes are always within Size
+type Device interface {
+	io.ReaderAt
+	io.WriterAt
+	Size() int64
+	Sync() error
+}
+
+// Export is a device which is served under a name
+type Export struct {
+	Device   Device
+	ReadOnly bool
+}
+
+// Lookup finds the export with the name, it returns false when there is none
+type Lookup func(name string) (*Export, bool)
+
+const (
+	magic          = 0x4e42444d41474943 // NBDMAGIC
+	optionMagic    = 0x49484156454f5054 // IHAVEOPT
+	replyMagic     = 0x3e889045565a9
+	requestMagic   = 0x25609513
+	simpleReply    = 0x67446698
+	maxNameLength  = 4096
+	maxRequestSize = 32 * 1024 * 1024
+
+	flagFixedNewstyle = 1 << 0
+	flagNoZeroes      = 1 << 1
+
+	optExportName = 1
+	optAbort      = 2
+	optList       = 3
+	optInfo       = 6
+	optGo         = 7
+
+	repAck        = 1
+	repInfo       = 3
+	repErrUnsup   = 1<<31 + 1
+	repErrInvalid = 1<<31 + 3
+	repErrUnknown = 1<<31 + 6
+
+	infoExport = 0
+
+	transHasFlags    = 1 << 0
+	transReadOnly    = 1 << 1
+	transSendFlush   = 1 << 2
+	transSendFUA     = 1 << 3
+	transSendTrim    = 1 << 5
+	transWriteZeroes = 1 << 6
+
+	cmdRead        = 0
+	cmdWrite       = 1
+	cmdDisc        = 2
+	cmdFlush       = 3
+	cmdTrim        = 4
+	cmdWriteZeroes = 6
+
+	cmdFlagFUA = 1 << 0
+
+	errPerm  = 1
+	errIO    = 5
+	errInval = 22
+	errNoSpc = 28
+)
+
+// Server serves the exports it looks up to the clients which connect to it
+type Server struct {
+	lookup Lookup
+
+	mutex sync.Mutex
+	conns map[net.Conn]bool
+}
+
+// NewServer creates a server of the exports found by lookup
+func NewServer(lookup Lookup) *Server {
+	return &Server{lookup: lookup, conns: make(map[net.Conn]bool)}
+}
+
+// Serve accepts connections until the listener is closed
+func (s *Server) Serve(l net.Listener) error {
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			return err
+		}
+
+		go s.ServeConn(conn)
+	}
+}
+
+// ServeConn negotiates an export with the client and serves it until the client disconnects
+func (s *Server) ServeConn(conn net.Conn) {
+	s.mutex.Lock()
+	s.conns[conn] = true
+	s.mutex.Unlock()
+
+	defer func() {
+		s.mutex.Lock()
+		delete(s.conns, conn)
+		s.mutex.Unlock()
+		_ = conn.Close()
+	}()
+
+	export, err := s.negotiate(conn)
+	if err != nil {
+		log.Debugf("NBD negotiation with %s failed: %v", conn.RemoteAddr(), err)
+		return
+	}
+
+	if export == nil {
+		return
+	}
+
+	if err = transmit(conn, export); err != nil && err != io.EOF {
+		log.Warnf("NBD connection with %s failed: %v", conn.RemoteAddr(), err)
+	}
+}
+
+// Close disconnects every client
+func (s *Server) Close() {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	for conn := range s.conns {
+		_ = conn.Close()
+	}
+}
+
+// negotiate runs the handshake and the option haggling, it returns nil when the client left without an export
+func (s *Server) negotiate(conn net.Conn) (*Export, error) {
+	var hello [18]byte
+	binary.BigEndian.PutUint64(hello[0:], magic)
+	binary.BigEndian.PutUint64(hello[8:], optionMagic)
+	binary.BigEndian.PutUint16(hello[16:], flagFixedNewstyle|flagNoZeroes)
+	if _, err := conn.Write(hello[:]); err != nil {
+		return nil, err
+	}
+
+	var clientFlags uint32
+	if err := binary.Read(conn, binary.BigEndian, &clientFlags); err != nil {
+		return nil, err
+	}
+
+	if clientFlags&flagFixedNewstyle == 0 {
+		return nil, errors.New("the client does not support the fixed newstyle handshake")
+	}
+
+	noZeroes := clientFlags&flagNoZeroes != 0
+
+	for {
+		var header struct {
+			Magic  uint64
+			Option uint32
+			Length uint32
+		}
+
+		if err := binary.Read(conn, binary.BigEndian, &header); err != nil {
+			return nil, err
+		}
+
+		if header.Magic != optionMagic {
+			return nil, errors.New("invalid option magic")
+		}
+
+		if header.Length > maxNameLength+6 {
+			return nil, errors.New("option too large")
+		}
+
+		data := make([]byte, header.Length)
+		if _, err := io.ReadFull(conn, data); err != nil {
+			return nil, err
+		}
+
+		switch header.Option {
+		case optExportName:
+			export, ok := s.lookup(string(data))
+			if !ok {
+				// There is no way to refuse this option other than hanging up
+				return nil, errors.Errorf("unknown export requested")
+			}
+
+			reply := make([]byte, 10, 10+124)
+			binary.BigEndian.PutUint64(reply[0:], uint64(export.Device.Size()))
+			binary.BigEndian.PutUint16(reply[8:], transmissionFlags(export))
+			if !noZeroes {
+				reply = append(reply, make([]byte, 124)...)
+			}
+
+			_, err := conn.Write(reply)
+			return export, err
+		case optAbort:
+			return nil, writeOptionReply(conn, header.Option, repAck, nil)
+		case optList:
+			// The names of the exports are what gives access to them, they are not listed
+			if err := writeOptionReply(conn, header.Option, repAck, nil); err != nil {
+				return nil, err
+			}
+		case optInfo, optGo:
+			export, err := s.info(conn, header.Option, data)
+			if err != nil || (export != nil && header.Option == optGo) {
+				return export, err
+			}
+		default:
+			if err := writeOptionReply(conn, header.Option, repErrUnsup, nil); err != nil {
+				return nil, err
+			}
+		}
+	}
+}
+
+// info answers NBD_OPT_INFO and NBD_OPT_GO, it returns the export when it exists
+func (s *Server) info(conn net.Conn, option uint32, data []byte) (*Export, error) {
+	if len(data) < 6 {
+		return nil, writeOptionReply(conn, option, repErrInvalid, nil)
+	}
+
+	length := binary.BigEndian.Uint32(data)
+	if uint64(len(data)) < 4+uint64(length)+2 {
+		return nil, writeOptionReply(conn, option, repErrInvalid, nil)
+	}
+
+	export, ok := s.lookup(string(data[4 : 4+length]))
+	if !ok {
+		return nil, writeOptionReply(conn, option, repErrUnknown, nil)
+	}
+
+	info := make([]byte, 12)
+	binary.BigEndian.PutUint16(info[0:], infoExport)
+	binary.BigEndian.PutUint64(info[2:], uint64(export.Device.Size()))
+	binary.BigEndian.PutUint16(info[10:], transmissionFlags(export))
+
+	if err := writeOptionReply(conn, option, repInfo, info); err != nil {
+		return nil, err
+	}
+
+	return export, writeOptionReply(conn, option, repAck, nil)
+}
+
+func writeOptionReply(w io.Writer, option uint32, kind uint32, data []byte) error {
+	reply := make([]byte, 20+len(data))
+	binary.BigEndian.PutUint64(reply[0:], replyMagic)
+	binary.BigEndian.PutUint32(reply[8:], option)
+	binary.BigEndian.PutUint32(reply[12:], kind)
+	binary.BigEndian.PutUint32(reply[16:], uint32(len(data)))
+	copy(reply[20:], data)
+
+	_, err := w.Write(reply)
+	return err
+}
+
+func transmissionFlags(export *Export) uint16 {
+	flags := uint16(transHasFlags | transSendFlush | transSendFUA | transSendTrim | transWriteZeroes)
+	if export.ReadOnly {
+		flags |= transReadOnly
+	}
+
+	return flags
+}
+
+// transmit handles the requests of the client one at a time, which the protocol allows
+func transmit(conn net.Conn, export *Export) error {
+	var buf []byte
+
+	for {
+		var request struct {
+			Magic  uint32
+			Flags  uint16
+			Type   uint16
+			Handle uint64
+			Offset uint64
+			Length uint32
+		}
+
+		if err := binary.Read(conn, binary.BigEndian, &request); err != nil {
+			return err
+		}
+
+		if request.Magic != requestMagic {
+			return errors.New("invalid request magic")
+		}
+
+		if request.Length > maxRequestSize {
+			return errors.Errorf("request of %d bytes is too large", request.Length)
+		}
+
+		if uint32(cap(buf)) < request.Length {
+			buf = make([]byte, request.Length)
+		}
+
+		data := buf[:request.Length]
+		inRange := request.Offset+uint64(request.Length) <= uint64(export.Device.Size())
+
+		var code uint32
+		switch request.Type {
+		case cmdRead:
+			switch {
+			case !inRange:
+				code = errInval
+			default:
+				if _, err := export.Device.ReadAt(data, int64(request.Offset)); err != nil && err != io.EOF {
+					log.Warnf("NBD read at %d failed: %v", request.Offset, err)
+					code = errIO
+				}
+			}
+
+			if code != 0 {
+				data = nil
+			}
+
+			if err := writeReply(conn, code, request.Handle, data); err != nil {
+				return err
+			}
+
+			continue
+		case cmdWrite:
+			if _, err := io.ReadFull(conn, data); err != nil {
+				return err
+			}
+
+			code = write(export, request.Offset, data, inRange, request.Flags)
+		case cmdWriteZeroes:
+			for i := range data {
+				data[i] = 0
+			}
+
+			code = write(export, request.Offset, data, inRange, request.Flags)
+		case cmdTrim:
+			// Trimming is only a hint, the blocks keep what they hold
+			if export.ReadOnly {
+				code = errPerm
+			}
+		case cmdFlush:
+			if err := export.Device.Sync(); err != nil {
+				code = errIO
+			}
+		case cmdDisc:
+			return io.EOF
+		default:
+			code = errInval
+		}
+
+		if err := writeReply(conn, code, request.Handle, nil); err != nil {
+			return err
+		}
+	}
+}
+
+// write writes the data of a request to the device and returns the error code of the reply
+func write(export *Export, offset uint64, data []byte, inRange bool, flags uint16) uint32 {
+	switch {
+	case export.ReadOnly:
+		return errPerm
+	case !inRange:
+		return errNoSpc
+	}
+
+	if _, err := export.Device.WriteAt(data, int64(offset)); err != nil {
+		log.Warnf("NBD write at %d failed: %v", offset, err)
+		return errIO
+	}
+
+	if flags&cmdFlagFUA != 0 {
+		if err := export.Device.Sync(); err != nil {
+			return errIO
+		}
+	}
+
+	return 0
+}
+
+func writeReply(w io.Writer, code uint32, handle uint64, data []byte) error {
+	reply := make([]byte, 16, 16+len(data))
+	binary.BigEndian.PutUint32(reply[0:], simpleReply)
+	binary.BigEndian.PutUint32(reply[4:], code)
+	binary.BigEndian.PutUint64(reply[8:], handle)
+
+	_, err := w.Write(append(reply, data...))
+	return err
+}
@@ -0,0 +1,191 @@
+// Copyright (c) 2020-2022 TU Delft & Valentijn van de Beek <v.d.vandebeek@student.tudelft.nl> All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package nbd
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"net"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// client is just enough of an NBD client to test the server with
+type client struct {
+	conn   net.Conn
+	handle uint64
+}
+
+func dial(t *testing.T, server *Server, name string) (*client, uint64, uint16, bool) {
+	ours, theirs := net.Pipe()
+	go server.ServeConn(theirs)
+
+	var hello [18]byte
+	_, err := io.ReadFull(ours, hello[:])
+	assert.NoError(t, err)
+	assert.Equal(t, uint64(magic), binary.BigEndian.Uint64(hello[0:]))
+	assert.Equal(t, uint64(optionMagic), binary.BigEndian.Uint64(hello[8:]))
+
+	assert.NoError(t, binary.Write(ours, binary.BigEndian, uint32(flagFixedNewstyle|flagNoZeroes)))
+
+	data := make([]byte, 4+len(name)+2)
+	binary.BigEndian.PutUint32(data, uint32(len(name)))
+	copy(data[4:], name)
+	assert.NoError(t, binary.Write(ours, binary.BigEndian, struct {
+		Magic  uint64
+		Option uint32
+		Length uint32
+	}{optionMagic, optGo, uint32(len(data))}))
+	_, err = ours.Write(data)
+	assert.NoError(t, err)
+
+	var size uint64
+	var flags uint16
+	for {
+		var reply struct {
+			Magic  uint64
+			Option uint32
+			Kind   uint32
+			Length uint32
+		}
+
+		assert.NoError(t, binary.Read(ours, binary.BigEndian, &reply))
+		assert.Equal(t, uint64(replyMagic), reply.Magic)
+
+		payload := make([]byte, reply.Length)
+		_, err = io.ReadFull(ours, payload)
+		assert.NoError(t, err)
+
+		switch reply.Kind {
+		case repInfo:
+			size = binary.BigEndian.Uint64(payload[2:])
+			flags = binary.BigEndian.Uint16(payload[10:])
+		case repAck:
+			return &client{conn: ours}, size, flags, true
+		default:
+			_ = ours.Close()
+			return nil, 0, 0, false
+		}
+	}
+}
+
+func (c *client) request(t *testing.T, kind uint16, offset uint64, length uint32, data []byte) (uint32, []byte) {
+	c.handle++
+
+	request := make([]byte, 28, 28+len(data))
+	binary.BigEndian.PutUint32(request[0:], requestMagic)
+	binary.BigEndian.PutUint16(request[6:], kind)
+	binary.BigEndian.PutUint64(request[8:], c.handle)
+	binary.BigEndian.PutUint64(request[16:], offset)
+	binary.BigEndian.PutUint32(request[24:], length)
+	_, err := c.conn.Write(append(request, data...))
+	assert.NoError(t, err)
+
+	var reply struct {
+		Magic  uint32
+		Error  uint32
+		Handle uint64
+	}
+
+	assert.NoError(t, binary.Read(c.conn, binary.BigEndian, &reply))
+	assert.Equal(t, uint32(simpleReply), reply.Magic)
+	assert.Equal(t, c.handle, reply.Handle)
+
+	if kind != cmdRead || reply.Error != 0 {
+		return reply.Error, nil
+	}
+
+	result := make([]byte, length)
+	_, err = io.ReadFull(c.conn, result)
+	assert.NoError(t, err)
+	return 0, result
+}
+
+func newOverlay(t *testing.T, base []byte) *Overlay {
+	file, err := ioutil.TempFile("", "overlay")
+	assert.NoError(t, err)
+	t.Cleanup(func() { _ = os.Remove(file.Name()) })
+
+	overlay, err := NewOverlay(bytes.NewReader(base), int64(len(base)), file)
+	assert.NoError(t, err)
+	t.Cleanup(func() { _ = overlay.Close() })
+	return overlay
+}
+
+func TestServer(t *testing.T) {
+	base := make([]byte, 10*OverlayBlockSize+123)
+	rand.New(rand.NewSource(1)).Read(base)
+	original := append([]byte(nil), base...)
+
+	overlay := newOverlay(t, base)
+	exports := map[string]*Export{
+		"rw": {Device: overlay},
+		"ro": {Device: overlay, ReadOnly: true},
+	}
+
+	server := NewServer(func(name string) (*Export, bool) {
+		export, ok := exports[name]
+		return export, ok
+	})
+
+	_, _, _, ok := dial(t, server, "unknown")
+	assert.False(t, ok)
+
+	c, size, flags, ok := dial(t, server, "rw")
+	assert.True(t, ok)
+	assert.Equal(t, uint64(len(base)), size)
+	assert.Zero(t, flags&transReadOnly)
+
+	code, data := c.request(t, cmdRead, 100, 5000, nil)
+	assert.Zero(t, code)
+	assert.Equal(t, base[100:5100], data)
+
+	// A write across a block boundary which covers neither block fully
+	written := bytes.Repeat([]byte{0xab}, 3000)
+	code, _ = c.request(t, cmdWrite, 3000, uint32(len(written)), written)
+	assert.Zero(t, code)
+
+	code, _ = c.request(t, cmdWriteZeroes, uint64(len(base)-50), 50, nil)
+	assert.Zero(t, code)
+
+	expected := append([]byte(nil), base...)
+	copy(expected[3000:], written)
+	copy(expected[len(base)-50:], make([]byte, 50))
+
+	code, data = c.request(t, cmdRead, 0, uint32(len(base)), nil)
+	assert.Zero(t, code)
+	assert.Equal(t, expected, data)
+	assert.Equal(t, int64(3*OverlayBlockSize), overlay.Written())
+
+	// The base is never written to
+	assert.Equal(t, original, base)
+
+	code, _ = c.request(t, cmdRead, uint64(len(base)-10), 20, nil)
+	assert.Equal(t, uint32(errInval), code)
+	code, _ = c.request(t, cmdWrite, uint64(len(base)-10), 20, make([]byte, 20))
+	assert.Equal(t, uint32(errNoSpc), code)
+	code, _ = c.request(t, cmdFlush, 0, 0, nil)
+	assert.Zero(t, code)
+
+	ro, _, flags, ok := dial(t, server, "ro")
+	assert.True(t, ok)
+	assert.NotZero(t, flags&transReadOnly)
+
+	code, _ = ro.request(t, cmdWrite, 0, 4, []byte{1, 2, 3, 4})
+	assert.Equal(t, uint32(errPerm), code)
+
+	code, data = ro.request(t, cmdRead, 3000, 10, nil)
+	assert.Zero(t, code)
+	assert.Equal(t, written[:10], data)
+
+	server.Close()
+	_, err := c.conn.Read(make([]byte, 1))
+	assert.Error(t, err)
+}
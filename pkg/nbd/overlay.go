@@ -0,0 +1,168 @@
+// Copyright (c) 2020-2022 TU Delft & Valentijn van de Beek <v.d.vandebeek@student.tudelft.nl> All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package nbd
+
+import (
+	"io"
+	"os"
+	"sync"
+
+	"github.com/pkg/errors"
+)
+
+// OverlayBlockSize is the granularity at which the overlay tracks the blocks which were written
+const OverlayBlockSize = 4096
+
+// Overlay is a copy-on-write device over a base disk which is never written to. Written blocks are kept in a
+// sparse file of the same size as the base, partial writes of a block first copy the rest of it from the base.
+type Overlay struct {
+	base io.ReaderAt
+	size int64
+	file *os.File
+
+	mutex sync.RWMutex
+	dirty []uint64
+	count int
+}
+
+// NewOverlay creates an overlay of size bytes over base, which keeps the blocks written to it in file
+func NewOverlay(base io.ReaderAt, size int64, file *os.File) (*Overlay, error) {
+	if err := file.Truncate(size); err != nil {
+		return nil, errors.Wrap(err, "size overlay file")
+	}
+
+	blocks := (size + OverlayBlockSize - 1) / OverlayBlockSize
+	return &Overlay{base: base, size: size, file: file, dirty: make([]uint64, (blocks+63)/64)}, nil
+}
+
+func (o *Overlay) isDirty(block int64) bool {
+	return o.dirty[block/64]&(1<<uint(block%64)) != 0
+}
+
+func (o *Overlay) setDirty(block int64) {
+	if !o.isDirty(block) {
+		o.dirty[block/64] |= 1 << uint(block%64)
+		o.count++
+	}
+}
+
+// blockLength is the length of a block, which is only shorter than the block size at the end of the disk
+func (o *Overlay) blockLength(block int64) int64 {
+	if end := (block + 1) * OverlayBlockSize; end > o.size {
+		return o.size - block*OverlayBlockSize
+	}
+
+	return OverlayBlockSize
+}
+
+// ReadAt reads the written blocks from the overlay and the other blocks from the base
+func (o *Overlay) ReadAt(p []byte, off int64) (int, error) {
+	if off < 0 || off >= o.size {
+		return 0, io.EOF
+	}
+
+	o.mutex.RLock()
+	defer o.mutex.RUnlock()
+
+	n := 0
+	for n < len(p) && off < o.size {
+		block := off / OverlayBlockSize
+		start := off - block*OverlayBlockSize
+		length := o.blockLength(block) - start
+		if length > int64(len(p)-n) {
+			length = int64(len(p) - n)
+		}
+
+		var source io.ReaderAt = o.base
+		if o.isDirty(block) {
+			source = o.file
+		}
+
+		if _, err := source.ReadAt(p[n:n+int(length)], off); err != nil {
+			return n, errors.Wrapf(err, "read block %d", block)
+		}
+
+		n += int(length)
+		off += length
+	}
+
+	if n < len(p) {
+		return n, io.EOF
+	}
+
+	return n, nil
+}
+
+// WriteAt writes to the overlay, the base is left untouched
+func (o *Overlay) WriteAt(p []byte, off int64) (int, error) {
+	if off < 0 || off+int64(len(p)) > o.size {
+		return 0, errors.New("write outside of the disk")
+	}
+
+	o.mutex.Lock()
+	defer o.mutex.Unlock()
+
+	var buf []byte
+	n := 0
+	for n < len(p) {
+		block := off / OverlayBlockSize
+		start := off - block*OverlayBlockSize
+		blockLength := o.blockLength(block)
+		length := blockLength - start
+		if length > int64(len(p)-n) {
+			length = int64(len(p) - n)
+		}
+
+		data := p[n : n+int(length)]
+		at := off
+		if !o.isDirty(block) && length < blockLength {
+			// The block is only partly written, so the rest of it comes from the base
+			if buf == nil {
+				buf = make([]byte, OverlayBlockSize)
+			}
+
+			at = block * OverlayBlockSize
+			if _, err := o.base.ReadAt(buf[:blockLength], at); err != nil && err != io.EOF {
+				return n, errors.Wrapf(err, "read block %d from the base", block)
+			}
+
+			copy(buf[start:], data)
+			data = buf[:blockLength]
+		}
+
+		if _, err := o.file.WriteAt(data, at); err != nil {
+			return n, errors.Wrapf(err, "write block %d", block)
+		}
+
+		o.setDirty(block)
+		n += int(length)
+		off += length
+	}
+
+	return n, nil
+}
+
+// Size is the size of the disk
+func (o *Overlay) Size() int64 {
+	return o.size
+}
+
+// Sync writes the overlay file to stable storage
+func (o *Overlay) Sync() error {
+	return o.file.Sync()
+}
+
+// Written is the number of bytes of the blocks which were written to
+func (o *Overlay) Written() int64 {
+	o.mutex.RLock()
+	defer o.mutex.RUnlock()
+
+	return int64(o.count) * OverlayBlockSize
+}
+
+// Close closes the overlay file, the base is closed by whomever opened it
+func (o *Overlay) Close() error {
+	return o.file.Close()
+}
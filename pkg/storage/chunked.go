@@ -0,0 +1,646 @@
+// Copyright (c) 2020-2022 TU Delft & Valentijn van de Beek <v.d.vandebeek@student.tudelft.nl> All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package storage
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"hash"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/baas-project/baas/pkg/model/images"
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+)
+
+// DefaultChunkSize is the size of the pieces the image files are cut in.
+// Disks change in whole blocks, so successive versions share most of their chunks.
+const DefaultChunkSize = 4 * 1024 * 1024
+
+/* Chunked layout on control_server
+/disks
+	/.chunks
+		/3f/3f2a...  <-- Chunk named after the SHA-256 of its contents
+	/.manifests
+		/abc         <-- Image UUID
+			/1.img   <-- List of the chunks making up the file
+	/cdf
+		/1.img       <-- File written before the chunked storage was used
+*/
+
+// Manifest describes a file as the list of chunks it consists of, only the last chunk may be shorter.
+type Manifest struct {
+	Size      int64
+	ChunkSize int64
+	Chunks    []string
+	// Digest is the SHA-256 of the whole file, manifests written before it was recorded lack it
+	Digest string `json:",omitempty"`
+}
+
+// GCResult reports what a garbage collection found and removed
+type GCResult struct {
+	// Chunks is the amount of chunks which were stored before the collection
+	Chunks int
+	// References is the amount of times any chunk is used by a manifest
+	References int
+	// Removed is the amount of chunks which were no longer referenced and have been deleted
+	Removed int
+	// Freed is the amount of bytes the removed chunks took up
+	Freed int64
+}
+
+// Chunked stores image files as manifests of content-addressed chunks, identical chunks are only stored once.
+// Files in the plain Disk layout in the same directory can still be read, they are replaced when written.
+type Chunked struct {
+	root      string
+	chunkSize int64
+	legacy    *Disk
+
+	// Uploads are staged as plain files, they are cut in chunks when they are committed
+	*diskStaging
+
+	// pending counts the chunks used by writes which have not stored their manifest yet,
+	// the garbage collector must not remove these.
+	mu      sync.Mutex
+	pending map[string]int
+}
+
+// NewChunked creates a chunked backend storing the files in the given directory
+func NewChunked(root string) *Chunked {
+	legacy := NewDisk(root)
+	return &Chunked{
+		root:      root,
+		chunkSize: DefaultChunkSize,
+		legacy:    legacy,
+		pending:   make(map[string]int),
+
+		diskStaging: legacy.diskStaging,
+	}
+}
+
+func (c *Chunked) chunkPath(hash string) string {
+	return filepath.Join(c.root, ".chunks", hash[:2], hash)
+}
+
+func (c *Chunked) manifestPath(uuid images.ImageUUID, name string) string {
+	return filepath.Join(c.root, ".manifests", string(uuid), filepath.Base(name))
+}
+
+// retain marks chunks as used by a write in progress
+func (c *Chunked) retain(hash string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.pending[hash]++
+}
+
+// release undoes retain once the manifest is stored or the write is aborted
+func (c *Chunked) release(hashes []string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for _, hash := range hashes {
+		c.pending[hash]--
+		if c.pending[hash] <= 0 {
+			delete(c.pending, hash)
+		}
+	}
+}
+
+// storeChunk writes the chunk unless a chunk with the same contents already exists
+func (c *Chunked) storeChunk(data []byte) (string, error) {
+	sum := sha256.Sum256(data)
+	hash := hex.EncodeToString(sum[:])
+	c.retain(hash)
+
+	// A chunk which is used again counts as new, so an aborted write which reused it is covered by the grace
+	// period of GC just like the chunks it wrote
+	path := c.chunkPath(hash)
+	now := time.Now()
+	if err := os.Chtimes(path, now, now); err == nil {
+		return hash, nil
+	}
+
+	if err := writeAtomic(path, data); err != nil {
+		c.release([]string{hash})
+		return "", errors.Wrap(err, "store chunk")
+	}
+
+	return hash, nil
+}
+
+// writeAtomic writes the data to a temporary file and moves it in place, so readers never see half a file
+func writeAtomic(path string, data []byte) error {
+	if err := os.MkdirAll(filepath.Dir(path), os.ModePerm); err != nil {
+		return err
+	}
+
+	f, err := ioutil.TempFile(filepath.Dir(path), ".tmp-")
+	if err != nil {
+		return err
+	}
+
+	if _, err = f.Write(data); err != nil {
+		_ = f.Close()
+		_ = os.Remove(f.Name())
+		return err
+	}
+
+	if err = f.Close(); err != nil {
+		_ = os.Remove(f.Name())
+		return err
+	}
+
+	return os.Rename(f.Name(), path)
+}
+
+func (c *Chunked) readManifest(uuid images.ImageUUID, name string) (*Manifest, error) {
+	data, err := ioutil.ReadFile(c.manifestPath(uuid, name))
+	if os.IsNotExist(err) {
+		return nil, ErrNotFound
+	} else if err != nil {
+		return nil, err
+	}
+
+	var manifest Manifest
+	if err = json.Unmarshal(data, &manifest); err != nil {
+		return nil, errors.Wrap(err, "decode manifest")
+	}
+
+	return &manifest, nil
+}
+
+// commit stores the manifest and removes the plain file it replaces. The manifest is written under the lock,
+// so the garbage collector sees either the old or the new manifest and Digest does not overwrite it.
+func (c *Chunked) commit(uuid images.ImageUUID, name string, manifest *Manifest) error {
+	data, err := json.Marshal(manifest)
+	if err != nil {
+		return err
+	}
+
+	c.mu.Lock()
+	err = writeAtomic(c.manifestPath(uuid, name), data)
+	c.mu.Unlock()
+
+	if err != nil {
+		return errors.Wrap(err, "store manifest")
+	}
+
+	if err = c.legacy.Remove(uuid, name); err != nil {
+		log.Warnf("Cannot remove the plain image file %s/%s: %v", uuid, name, err)
+	}
+
+	return nil
+}
+
+// Create stores an empty file, the zero chunk is stored once however large the file is
+func (c *Chunked) Create(uuid images.ImageUUID, name string, size int64) error {
+	w, err := c.Write(uuid, name)
+	if err != nil {
+		return err
+	}
+
+	zeroes := make([]byte, c.chunkSize)
+	for written := int64(0); written < size; written += c.chunkSize {
+		n := c.chunkSize
+		if size-written < n {
+			n = size - written
+		}
+
+		if _, err = w.Write(zeroes[:n]); err != nil {
+			_ = w.Abort()
+			return err
+		}
+	}
+
+	return w.Close()
+}
+
+// Open returns a reader which reads the chunks as they are needed
+func (c *Chunked) Open(uuid images.ImageUUID, name string) (File, error) {
+	manifest, err := c.readManifest(uuid, name)
+	if err == ErrNotFound {
+		return c.legacy.Open(uuid, name)
+	} else if err != nil {
+		return nil, err
+	}
+
+	return &chunkedFile{store: c, manifest: manifest, current: -1}, nil
+}
+
+// Write returns a writer which cuts the data in chunks, the manifest is stored when it is closed
+func (c *Chunked) Write(uuid images.ImageUUID, name string) (Writer, error) {
+	return &chunkedWriter{
+		store:    c,
+		uuid:     uuid,
+		name:     name,
+		buffer:   make([]byte, 0, c.chunkSize),
+		manifest: Manifest{ChunkSize: c.chunkSize},
+		hash:     sha256.New(),
+	}, nil
+}
+
+// Digest returns the digest recorded in the manifest, it is computed and recorded for older manifests
+func (c *Chunked) Digest(uuid images.ImageUUID, name string) (string, error) {
+	manifest, err := c.readManifest(uuid, name)
+	if err == ErrNotFound {
+		return c.legacy.Digest(uuid, name)
+	} else if err != nil {
+		return "", err
+	}
+
+	if manifest.Digest != "" {
+		return manifest.Digest, nil
+	}
+
+	f := &chunkedFile{store: c, manifest: manifest, current: -1}
+	defer f.Close()
+
+	sum, err := digest(f)
+	if err != nil {
+		return "", err
+	}
+
+	if err = c.recordDigest(uuid, name, manifest, sum); err != nil {
+		log.Warnf("Cannot record the digest of %s/%s: %v", uuid, name, err)
+	}
+
+	return sum, nil
+}
+
+// recordDigest adds the digest to the manifest it was computed from. A commit may have replaced the
+// manifest in the meantime, the new manifest is left alone.
+func (c *Chunked) recordDigest(uuid images.ImageUUID, name string, computed *Manifest, sum string) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	manifest, err := c.readManifest(uuid, name)
+	if err != nil {
+		return err
+	}
+
+	if manifest.Digest != "" || !sameChunks(manifest, computed) {
+		return nil
+	}
+
+	manifest.Digest = sum
+	data, err := json.Marshal(manifest)
+	if err != nil {
+		return err
+	}
+
+	return writeAtomic(c.manifestPath(uuid, name), data)
+}
+
+// sameChunks reports whether the manifests describe the same file
+func sameChunks(a *Manifest, b *Manifest) bool {
+	if a.Size != b.Size || a.ChunkSize != b.ChunkSize || len(a.Chunks) != len(b.Chunks) {
+		return false
+	}
+
+	for i := range a.Chunks {
+		if a.Chunks[i] != b.Chunks[i] {
+			return false
+		}
+	}
+
+	return true
+}
+
+// Commit cuts the upload in chunks while checking its digest
+func (c *Chunked) Commit(upload string, uuid images.ImageUUID, name string, digest string) error {
+	return c.commitTo(c, upload, uuid, name, digest)
+}
+
+// Format writes the file to a scratch file, formats that and stores the result as a new file
+func (c *Chunked) Format(uuid images.ImageUUID, name string, filesystem images.FilesystemType) error {
+	switch filesystem {
+	case images.FileSystemTypeEXT4, images.FileSystemTypeFAT32:
+	default:
+		_, err := c.readManifest(uuid, name)
+		return err
+	}
+
+	scratch, err := ioutil.TempDir("", "baas-format-")
+	if err != nil {
+		return err
+	}
+
+	defer os.RemoveAll(scratch)
+
+	disk := NewDisk(scratch)
+	if err = copyFile(c, disk, uuid, name); err != nil {
+		return err
+	}
+
+	if err = disk.Format(uuid, name, filesystem); err != nil {
+		return err
+	}
+
+	return copyFile(disk, c, uuid, name)
+}
+
+// copyFile copies a file from one backend to another
+func copyFile(from ImageFiles, to ImageFiles, uuid images.ImageUUID, name string) error {
+	src, err := from.Open(uuid, name)
+	if err != nil {
+		return err
+	}
+
+	defer src.Close()
+
+	dest, err := to.Write(uuid, name)
+	if err != nil {
+		return err
+	}
+
+	if _, err = io.Copy(dest, src); err != nil {
+		_ = dest.Abort()
+		return err
+	}
+
+	return dest.Close()
+}
+
+// Remove removes the manifest of the file, the chunks are removed by the garbage collector
+func (c *Chunked) Remove(uuid images.ImageUUID, name string) error {
+	if err := os.Remove(c.manifestPath(uuid, name)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	return c.legacy.Remove(uuid, name)
+}
+
+// Delete removes the manifests of the image, the chunks are removed by the garbage collector
+func (c *Chunked) Delete(uuid images.ImageUUID) error {
+	if err := os.RemoveAll(filepath.Join(c.root, ".manifests", string(uuid))); err != nil {
+		return err
+	}
+
+	return c.legacy.Delete(uuid)
+}
+
+// GC removes the chunks which no manifest refers to. Chunks younger than the grace period are kept,
+// they may belong to a write of another process which has not stored its manifest yet. The lock is only
+// held while the references are counted, so writes go on while the chunks are swept. A write which uses
+// a chunk during the sweep marks it as pending and refreshes its time, which keeps it.
+func (c *Chunked) GC(grace time.Duration) (GCResult, error) {
+	result, references, err := c.countReferences()
+	if err != nil {
+		return result, errors.Wrap(err, "count chunk references")
+	}
+
+	cutoff := time.Now().Add(-grace)
+	err = filepath.Walk(filepath.Join(c.root, ".chunks"), func(path string, info os.FileInfo, err error) error {
+		if os.IsNotExist(err) {
+			return nil
+		} else if err != nil || info.IsDir() {
+			return err
+		}
+
+		hash := info.Name()
+		result.Chunks++
+
+		if references[hash] > 0 || info.ModTime().After(cutoff) {
+			return nil
+		}
+
+		removed, err := c.removeChunk(path, hash, cutoff)
+		if err != nil || !removed {
+			return err
+		}
+
+		result.Removed++
+		result.Freed += info.Size()
+		return nil
+	})
+
+	return result, errors.Wrap(err, "remove unreferenced chunks")
+}
+
+// countReferences counts how often the manifests use each chunk
+func (c *Chunked) countReferences() (GCResult, map[string]int, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	var result GCResult
+	references := make(map[string]int)
+
+	err := filepath.Walk(filepath.Join(c.root, ".manifests"), func(path string, info os.FileInfo, err error) error {
+		if os.IsNotExist(err) {
+			return nil
+		} else if err != nil || info.IsDir() {
+			return err
+		}
+
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			return err
+		}
+
+		var manifest Manifest
+		if err = json.Unmarshal(data, &manifest); err != nil {
+			return errors.Wrapf(err, "decode manifest %s", path)
+		}
+
+		for _, hash := range manifest.Chunks {
+			references[hash]++
+			result.References++
+		}
+
+		return nil
+	})
+
+	return result, references, err
+}
+
+// removeChunk removes the chunk unless a write started using it since it was found
+func (c *Chunked) removeChunk(path string, hash string, cutoff time.Time) (bool, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.pending[hash] > 0 {
+		return false, nil
+	}
+
+	info, err := os.Stat(path)
+	if os.IsNotExist(err) {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+
+	if info.ModTime().After(cutoff) {
+		return false, nil
+	}
+
+	return true, os.Remove(path)
+}
+
+// RunGC collects the garbage at every interval, it does not return
+func (c *Chunked) RunGC(interval time.Duration, grace time.Duration) {
+	log.Infof("Starting the chunk garbage collector, collecting every %v", interval)
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		result, err := c.GC(grace)
+		if err != nil {
+			log.Errorf("Chunk garbage collector: %v", err)
+			continue
+		}
+
+		log.Infof("Chunk garbage collector removed %d of %d chunks, freeing %d bytes",
+			result.Removed, result.Chunks, result.Freed)
+	}
+}
+
+// chunkedWriter collects the data until a chunk is full and then stores it
+type chunkedWriter struct {
+	store    *Chunked
+	uuid     images.ImageUUID
+	name     string
+	buffer   []byte
+	manifest Manifest
+	hash     hash.Hash
+}
+
+func (w *chunkedWriter) flush() error {
+	if len(w.buffer) == 0 {
+		return nil
+	}
+
+	hash, err := w.store.storeChunk(w.buffer)
+	if err != nil {
+		return err
+	}
+
+	w.manifest.Chunks = append(w.manifest.Chunks, hash)
+	w.manifest.Size += int64(len(w.buffer))
+	w.buffer = w.buffer[:0]
+	return nil
+}
+
+func (w *chunkedWriter) Write(p []byte) (int, error) {
+	written := 0
+	for len(p) > 0 {
+		n := int(w.store.chunkSize) - len(w.buffer)
+		if n > len(p) {
+			n = len(p)
+		}
+
+		w.buffer = append(w.buffer, p[:n]...)
+		w.hash.Write(p[:n])
+		p = p[n:]
+		written += n
+
+		if int64(len(w.buffer)) == w.store.chunkSize {
+			if err := w.flush(); err != nil {
+				return written, err
+			}
+		}
+	}
+
+	return written, nil
+}
+
+func (w *chunkedWriter) Close() error {
+	defer w.store.release(w.manifest.Chunks)
+
+	if err := w.flush(); err != nil {
+		return err
+	}
+
+	w.manifest.Digest = hex.EncodeToString(w.hash.Sum(nil))
+	return w.store.commit(w.uuid, w.name, &w.manifest)
+}
+
+func (w *chunkedWriter) Abort() error {
+	w.store.release(w.manifest.Chunks)
+	w.manifest.Chunks = nil
+	return nil
+}
+
+// chunkedFile reads a file from its chunks, only one chunk is open at a time
+type chunkedFile struct {
+	store    *Chunked
+	manifest *Manifest
+	offset   int64
+
+	current int
+	chunk   *os.File
+}
+
+func (f *chunkedFile) Read(p []byte) (int, error) {
+	if f.offset >= f.manifest.Size {
+		return 0, io.EOF
+	}
+
+	index := int(f.offset / f.manifest.ChunkSize)
+	if index != f.current {
+		if f.chunk != nil {
+			_ = f.chunk.Close()
+		}
+
+		chunk, err := os.Open(f.store.chunkPath(f.manifest.Chunks[index]))
+		if err != nil {
+			f.chunk = nil
+			f.current = -1
+			return 0, errors.Wrapf(err, "open chunk %d", index)
+		}
+
+		f.chunk = chunk
+		f.current = index
+	}
+
+	inner := f.offset % f.manifest.ChunkSize
+	if left := f.manifest.ChunkSize - inner; int64(len(p)) > left {
+		p = p[:left]
+	}
+
+	n, err := f.chunk.ReadAt(p, inner)
+	f.offset += int64(n)
+
+	// Reaching the end of a chunk is not the end of the file
+	if err == io.EOF && n > 0 {
+		err = nil
+	}
+
+	return n, err
+}
+
+func (f *chunkedFile) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += f.offset
+	case io.SeekEnd:
+		offset += f.manifest.Size
+	default:
+		return 0, errors.New("invalid whence")
+	}
+
+	if offset < 0 {
+		return 0, errors.New("negative position")
+	}
+
+	f.offset = offset
+	return offset, nil
+}
+
+func (f *chunkedFile) Close() error {
+	if f.chunk == nil {
+		return nil
+	}
+
+	return f.chunk.Close()
+}
@@ -0,0 +1,213 @@
+// Copyright (c) 2020-2022 TU Delft & Valentijn van de Beek <v.d.vandebeek@student.tudelft.nl> All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package storage
+
+import (
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+
+	"github.com/baas-project/baas/pkg/model/images"
+	"github.com/google/uuid"
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+)
+
+/* Disk Layout on control_server
+/disks
+	/abc  <-- First image UUID
+		/1.img
+		/2.img
+		/3.img
+		/4.img
+	/cdf  <-- Second image UUID
+		/1.img
+		/1.img.sha256  <-- Digest of 1.img, computed when it is first needed
+		/2.img
+*/
+
+// digestSuffix is appended to the name of a file to get the name of the file holding its digest
+const digestSuffix = ".sha256"
+
+// Disk stores the image files in a directory on the local filesystem
+type Disk struct {
+	root string
+	*diskStaging
+}
+
+// NewDisk creates a backend storing the files in the given directory
+func NewDisk(root string) *Disk {
+	return &Disk{root: root, diskStaging: newDiskStaging(root)}
+}
+
+func (d *Disk) path(uuid images.ImageUUID, name string) string {
+	return filepath.Join(d.root, string(uuid), filepath.Base(name))
+}
+
+// Create makes a sparse file, so the empty image does not actually take up space
+func (d *Disk) Create(uuid images.ImageUUID, name string, size int64) error {
+	if err := os.MkdirAll(filepath.Join(d.root, string(uuid)), os.ModePerm); err != nil {
+		return errors.Wrap(err, "create image directory")
+	}
+
+	f, err := os.OpenFile(d.path(uuid, name), os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return errors.Wrap(err, "create image file")
+	}
+
+	if err = f.Truncate(size); err != nil {
+		_ = f.Close()
+		return errors.Wrap(err, "resize image file")
+	}
+
+	return f.Close()
+}
+
+// Open opens the file for reading
+func (d *Disk) Open(uuid images.ImageUUID, name string) (File, error) {
+	f, err := os.Open(d.path(uuid, name))
+	if os.IsNotExist(err) {
+		return nil, ErrNotFound
+	}
+
+	return f, err
+}
+
+// diskWriter writes to a temporary file which is moved over the real one when it is closed
+type diskWriter struct {
+	*os.File
+	dest string
+}
+
+func (w *diskWriter) Close() error {
+	if err := w.File.Close(); err != nil {
+		_ = os.Remove(w.Name())
+		return err
+	}
+
+	return os.Rename(w.Name(), w.dest)
+}
+
+func (w *diskWriter) Abort() error {
+	_ = w.File.Close()
+	return os.Remove(w.Name())
+}
+
+// Write writes to a temporary file first, so a failed upload does not destroy the previous contents
+func (d *Disk) Write(id images.ImageUUID, name string) (Writer, error) {
+	if err := os.MkdirAll(filepath.Join(d.root, string(id)), os.ModePerm); err != nil {
+		return nil, errors.Wrap(err, "create image directory")
+	}
+
+	dest := d.path(id, name)
+	f, err := os.OpenFile(dest+"."+uuid.New().String()+".tmp", os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return nil, errors.Wrap(err, "create image file")
+	}
+
+	return &diskWriter{File: f, dest: dest}, nil
+}
+
+// Digest returns the digest stored next to the file. It is computed and stored when it is missing or older
+// than the file, so files changed outside of BAAS or by Format are hashed again.
+func (d *Disk) Digest(uuid images.ImageUUID, name string) (string, error) {
+	path := d.path(uuid, name)
+	info, err := os.Stat(path)
+	if os.IsNotExist(err) {
+		return "", ErrNotFound
+	} else if err != nil {
+		return "", err
+	}
+
+	sidecar := path + digestSuffix
+	if cached, err := os.Stat(sidecar); err == nil && !cached.ModTime().Before(info.ModTime()) {
+		data, err := ioutil.ReadFile(sidecar)
+		if err == nil && len(data) == 64 {
+			return string(data), nil
+		}
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+
+	defer f.Close()
+
+	sum, err := digest(f)
+	if err != nil {
+		return "", err
+	}
+
+	// Failing to cache the digest only means it is computed again next time
+	if err = writeAtomic(sidecar, []byte(sum)); err != nil {
+		log.Warnf("Cannot store the digest of %s/%s: %v", uuid, name, err)
+	}
+
+	return sum, nil
+}
+
+// Commit checks the digest of the upload and moves it in place, it is not copied
+func (d *Disk) Commit(upload string, uuid images.ImageUUID, name string, digest string) error {
+	defer d.lock(upload)()
+
+	if err := d.verify(upload, digest); err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(filepath.Join(d.root, string(uuid)), os.ModePerm); err != nil {
+		return errors.Wrap(err, "create image directory")
+	}
+
+	path := d.path(uuid, name)
+	if err := os.Rename(d.file(upload), path); err != nil {
+		return errors.Wrap(err, "move staged upload")
+	}
+
+	// The digest is already known, so it does not have to be computed again on the first download
+	if err := writeAtomic(path+digestSuffix, []byte(digest)); err != nil {
+		log.Warnf("Cannot store the digest of %s/%s: %v", uuid, name, err)
+	}
+
+	return d.discard(upload)
+}
+
+// Format runs mkfs on the file, filesystems which BAAS cannot create are left alone
+func (d *Disk) Format(uuid images.ImageUUID, name string, filesystem images.FilesystemType) error {
+	path := d.path(uuid, name)
+	if _, err := os.Stat(path); os.IsNotExist(err) {
+		return ErrNotFound
+	}
+
+	var cmd *exec.Cmd
+	switch filesystem {
+	case images.FileSystemTypeEXT4:
+		cmd = exec.Command("mkfs.ext4", "-q", "-F", path)
+	case images.FileSystemTypeFAT32:
+		cmd = exec.Command("mkfs.fat", "-F", "32", path)
+	default:
+		return nil
+	}
+
+	out, err := cmd.CombinedOutput()
+	return errors.Wrapf(err, "format image file: %s", out)
+}
+
+// Remove removes the file and its digest
+func (d *Disk) Remove(uuid images.ImageUUID, name string) error {
+	for _, path := range []string{d.path(uuid, name), d.path(uuid, name) + digestSuffix} {
+		if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Delete removes the directory of the image
+func (d *Disk) Delete(uuid images.ImageUUID) error {
+	return os.RemoveAll(filepath.Join(d.root, string(uuid)))
+}
@@ -0,0 +1,218 @@
+// Copyright (c) 2020-2022 TU Delft & Valentijn van de Beek <v.d.vandebeek@student.tudelft.nl> All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package storage
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"sync"
+
+	"github.com/baas-project/baas/pkg/model/images"
+)
+
+// Memory keeps the image files in memory, it is meant for tests and demonstrations
+type Memory struct {
+	mu     sync.RWMutex
+	files  map[images.ImageUUID]map[string]memoryFile
+	staged map[string][]byte
+}
+
+// memoryFile is sparse, everything after data up to size reads as zeroes.
+// Empty images are large, so they should not actually be allocated.
+type memoryFile struct {
+	data []byte
+	size int64
+}
+
+// ReadAt implements io.ReaderAt
+func (f memoryFile) ReadAt(p []byte, off int64) (int, error) {
+	if off >= f.size {
+		return 0, io.EOF
+	}
+
+	if max := f.size - off; int64(len(p)) > max {
+		p = p[:max]
+	}
+
+	n := 0
+	if off < int64(len(f.data)) {
+		n = copy(p, f.data[off:])
+	}
+
+	for i := n; i < len(p); i++ {
+		p[i] = 0
+	}
+
+	if off+int64(len(p)) == f.size {
+		return len(p), io.EOF
+	}
+
+	return len(p), nil
+}
+
+// NewMemory creates an empty in-memory backend
+func NewMemory() *Memory {
+	return &Memory{
+		files:  make(map[images.ImageUUID]map[string]memoryFile),
+		staged: make(map[string][]byte),
+	}
+}
+
+func (m *Memory) put(uuid images.ImageUUID, name string, file memoryFile) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.files[uuid] == nil {
+		m.files[uuid] = make(map[string]memoryFile)
+	}
+
+	m.files[uuid][name] = file
+}
+
+func (m *Memory) get(uuid images.ImageUUID, name string) (memoryFile, bool) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	file, ok := m.files[uuid][name]
+	return file, ok
+}
+
+// Create stores an empty file without allocating its contents
+func (m *Memory) Create(uuid images.ImageUUID, name string, size int64) error {
+	m.put(uuid, name, memoryFile{size: size})
+	return nil
+}
+
+// Open returns a reader over the contents the file had when it was opened
+func (m *Memory) Open(uuid images.ImageUUID, name string) (File, error) {
+	file, ok := m.get(uuid, name)
+	if !ok {
+		return nil, ErrNotFound
+	}
+
+	return nopCloser{io.NewSectionReader(file, 0, file.size)}, nil
+}
+
+type nopCloser struct {
+	io.ReadSeeker
+}
+
+func (nopCloser) Close() error {
+	return nil
+}
+
+// memoryWriter buffers the written data until it is closed
+type memoryWriter struct {
+	bytes.Buffer
+	store *Memory
+	uuid  images.ImageUUID
+	name  string
+}
+
+func (w *memoryWriter) Close() error {
+	data, _ := ioutil.ReadAll(&w.Buffer)
+	w.store.put(w.uuid, w.name, memoryFile{data: data, size: int64(len(data))})
+	return nil
+}
+
+func (w *memoryWriter) Abort() error {
+	w.Reset()
+	return nil
+}
+
+// Write returns a writer which stores the file when it is closed
+func (m *Memory) Write(uuid images.ImageUUID, name string) (Writer, error) {
+	return &memoryWriter{store: m, uuid: uuid, name: name}, nil
+}
+
+// Digest hashes the contents of the file
+func (m *Memory) Digest(uuid images.ImageUUID, name string) (string, error) {
+	file, ok := m.get(uuid, name)
+	if !ok {
+		return "", ErrNotFound
+	}
+
+	return digest(io.NewSectionReader(file, 0, file.size))
+}
+
+// Format only checks whether the file exists, there is no filesystem to create in memory
+func (m *Memory) Format(uuid images.ImageUUID, name string, _ images.FilesystemType) error {
+	if _, ok := m.get(uuid, name); !ok {
+		return ErrNotFound
+	}
+
+	return nil
+}
+
+// Remove removes the file
+func (m *Memory) Remove(uuid images.ImageUUID, name string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	delete(m.files[uuid], name)
+	return nil
+}
+
+// Delete removes every file of the image
+func (m *Memory) Delete(uuid images.ImageUUID) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	delete(m.files, uuid)
+	return nil
+}
+
+// Append reads all data before storing it, appends to the same upload do not interleave
+func (m *Memory) Append(upload string, offset int64, r io.Reader) (int64, error) {
+	data, err := ioutil.ReadAll(r)
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	size := int64(len(m.staged[upload]))
+	if size != offset {
+		return size, ErrOffsetMismatch
+	}
+
+	m.staged[upload] = append(m.staged[upload], data...)
+	return size + int64(len(data)), err
+}
+
+// Staged returns the size of the upload
+func (m *Memory) Staged(upload string) (int64, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	return int64(len(m.staged[upload])), nil
+}
+
+// Commit checks the digest and stores the upload as the file
+func (m *Memory) Commit(upload string, uuid images.ImageUUID, name string, expected string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	data := m.staged[upload]
+	if sum, _ := digest(bytes.NewReader(data)); sum != expected {
+		return ErrDigestMismatch
+	}
+
+	if m.files[uuid] == nil {
+		m.files[uuid] = make(map[string]memoryFile)
+	}
+
+	m.files[uuid][name] = memoryFile{data: data, size: int64(len(data))}
+	delete(m.staged, upload)
+	return nil
+}
+
+// Discard removes the upload
+func (m *Memory) Discard(upload string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	delete(m.staged, upload)
+	return nil
+}
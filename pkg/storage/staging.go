@@ -0,0 +1,167 @@
+// Copyright (c) 2020-2022 TU Delft & Valentijn van de Beek <v.d.vandebeek@student.tudelft.nl> All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package storage
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"github.com/baas-project/baas/pkg/model/images"
+	"github.com/pkg/errors"
+)
+
+/* Staging layout on control_server
+/disks
+	/.uploads
+		/5e0a...  <-- Data received so far for the upload with this id
+*/
+
+// diskStaging keeps the uploads as files in a directory, it is shared by the Disk and Chunked backends
+type diskStaging struct {
+	root string
+
+	// locks serialises the appends to the same upload
+	mu    sync.Mutex
+	locks map[string]*sync.Mutex
+}
+
+func newDiskStaging(root string) *diskStaging {
+	return &diskStaging{root: filepath.Join(root, ".uploads"), locks: make(map[string]*sync.Mutex)}
+}
+
+func (s *diskStaging) file(upload string) string {
+	return filepath.Join(s.root, filepath.Base(upload))
+}
+
+// lock locks the upload and returns the function to unlock it again
+func (s *diskStaging) lock(upload string) func() {
+	s.mu.Lock()
+	l, ok := s.locks[upload]
+	if !ok {
+		l = &sync.Mutex{}
+		s.locks[upload] = l
+	}
+	s.mu.Unlock()
+
+	l.Lock()
+	return l.Unlock
+}
+
+func (s *diskStaging) Append(upload string, offset int64, r io.Reader) (int64, error) {
+	defer s.lock(upload)()
+
+	if err := os.MkdirAll(s.root, os.ModePerm); err != nil {
+		return 0, errors.Wrap(err, "create staging directory")
+	}
+
+	f, err := os.OpenFile(s.file(upload), os.O_WRONLY|os.O_CREATE, 0644)
+	if err != nil {
+		return 0, errors.Wrap(err, "open staged upload")
+	}
+
+	defer f.Close()
+
+	size, err := f.Seek(0, io.SeekEnd)
+	if err != nil {
+		return 0, err
+	}
+
+	if size != offset {
+		return size, ErrOffsetMismatch
+	}
+
+	n, err := io.Copy(f, r)
+	return size + n, err
+}
+
+func (s *diskStaging) Staged(upload string) (int64, error) {
+	info, err := os.Stat(s.file(upload))
+	if os.IsNotExist(err) {
+		return 0, nil
+	} else if err != nil {
+		return 0, err
+	}
+
+	return info.Size(), nil
+}
+
+// verify checks the digest of the staged upload
+func (s *diskStaging) verify(upload string, expected string) error {
+	f, err := os.Open(s.file(upload))
+	if err != nil {
+		return errors.Wrap(err, "open staged upload")
+	}
+
+	defer f.Close()
+
+	sum, err := digest(f)
+	if err != nil {
+		return err
+	}
+
+	if sum != expected {
+		return ErrDigestMismatch
+	}
+
+	return nil
+}
+
+// commitTo copies the staged upload to the backend while checking its digest, the file is only stored
+// when the digest matches
+func (s *diskStaging) commitTo(files ImageFiles, upload string, uuid images.ImageUUID, name string,
+	expected string) error {
+	defer s.lock(upload)()
+
+	src, err := os.Open(s.file(upload))
+	if err != nil {
+		return errors.Wrap(err, "open staged upload")
+	}
+
+	defer src.Close()
+
+	dest, err := files.Write(uuid, name)
+	if err != nil {
+		return err
+	}
+
+	hash := sha256.New()
+	if _, err = io.Copy(dest, io.TeeReader(src, hash)); err != nil {
+		_ = dest.Abort()
+		return err
+	}
+
+	if hex.EncodeToString(hash.Sum(nil)) != expected {
+		_ = dest.Abort()
+		return ErrDigestMismatch
+	}
+
+	if err = dest.Close(); err != nil {
+		return err
+	}
+
+	return s.discard(upload)
+}
+
+func (s *diskStaging) Discard(upload string) error {
+	defer s.lock(upload)()
+	return s.discard(upload)
+}
+
+// discard removes the upload, the caller has to hold the lock of the upload
+func (s *diskStaging) discard(upload string) error {
+	s.mu.Lock()
+	delete(s.locks, upload)
+	s.mu.Unlock()
+
+	if err := os.Remove(s.file(upload)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	return nil
+}
@@ -0,0 +1,105 @@
+// Copyright (c) 2020-2022 TU Delft & Valentijn van de Beek <v.d.vandebeek@student.tudelft.nl> All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package storage stores the files which belong to images, such as the disk image of every version.
+// The database only holds the metadata, so the control server uses an ImageFiles backend next to its store.
+package storage
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+
+	"github.com/baas-project/baas/pkg/model/images"
+	"github.com/pkg/errors"
+)
+
+var (
+	// ErrNotFound is returned when an image does not have the requested file
+	ErrNotFound = errors.New("image file not found")
+	// ErrOffsetMismatch is returned when data is appended to a staged upload at another offset than its end
+	ErrOffsetMismatch = errors.New("offset does not match the size of the upload")
+	// ErrDigestMismatch is returned when a staged upload does not have the expected digest
+	ErrDigestMismatch = errors.New("digest does not match the uploaded data")
+)
+
+// File is an opened image file, it can be seeked so only part of the file has to be sent
+type File interface {
+	io.ReadSeeker
+	io.Closer
+}
+
+// Writer replaces the contents of a file. Close stores the written data, Abort throws it away
+// which keeps the previous contents in place.
+type Writer interface {
+	io.WriteCloser
+	Abort() error
+}
+
+// ImageFiles defines the functions which should be exported by any backend storing image files.
+// Files are identified by the image they belong to and a name within that image.
+type ImageFiles interface {
+	// Create makes an empty file of the given size in bytes, overwriting an existing file
+	Create(uuid images.ImageUUID, name string, size int64) error
+
+	// Open returns the contents of the file, or ErrNotFound if it does not exist
+	Open(uuid images.ImageUUID, name string) (File, error)
+
+	// Write returns a writer which replaces the contents of the file.
+	// The new contents only become visible once the writer is closed.
+	Write(uuid images.ImageUUID, name string) (Writer, error)
+
+	// Digest returns the hex encoded SHA-256 of the contents of the file, or ErrNotFound if it does not exist
+	Digest(uuid images.ImageUUID, name string) (string, error)
+
+	// Format creates the filesystem on the file, erasing everything on it
+	Format(uuid images.ImageUUID, name string, filesystem images.FilesystemType) error
+
+	// Remove removes a single file of the image, removing a file which does not exist is not an error
+	Remove(uuid images.ImageUUID, name string) error
+
+	// Delete removes every file of the image
+	Delete(uuid images.ImageUUID) error
+
+	Staging
+}
+
+// Staging collects uploads which are sent in parts, an upload only becomes a file once it is committed.
+// Uploads are identified by an id which is unique across all images.
+type Staging interface {
+	// Append adds the data to the upload, which has to be exactly offset bytes long. It returns the new size,
+	// which includes the data received before an error. ErrOffsetMismatch is returned if the offset is wrong.
+	Append(upload string, offset int64, r io.Reader) (int64, error)
+
+	// Staged returns the size of the upload, an upload which has not received any data is empty
+	Staged(upload string) (int64, error)
+
+	// Commit checks the hex encoded SHA-256 of the upload and moves it into the image as the named file,
+	// replacing it atomically. ErrDigestMismatch is returned and the upload is kept if the digest differs.
+	Commit(upload string, uuid images.ImageUUID, name string, digest string) error
+
+	// Discard removes the upload, discarding an upload which does not exist is not an error
+	Discard(upload string) error
+}
+
+// VersionFile is the name of the disk image of a version of an image
+func VersionFile(version uint64) string {
+	return fmt.Sprintf("%d.img", version)
+}
+
+// DockerfileFile is the name of the Dockerfile a version of an image was built from
+func DockerfileFile(version uint64) string {
+	return fmt.Sprintf("Dockerfile-%d", version)
+}
+
+// digest computes the hex encoded SHA-256 of everything the reader returns
+func digest(r io.Reader) (string, error) {
+	hash := sha256.New()
+	if _, err := io.Copy(hash, r); err != nil {
+		return "", errors.Wrap(err, "compute digest")
+	}
+
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
@@ -0,0 +1,325 @@
+// Copyright (c) 2020-2022 TU Delft & Valentijn van de Beek <v.d.vandebeek@student.tudelft.nl> All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package storage
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/baas-project/baas/pkg/model/images"
+	"github.com/stretchr/testify/assert"
+)
+
+// helloWorldDigest is the SHA-256 of "hello world"
+const helloWorldDigest = "b94d27b9934d3e08a52e52d7da7dabfac484efe37a5380ee9088f7ace2efcde9"
+
+func testImageFiles(t *testing.T, files ImageFiles) {
+	_, err := files.Open("abc", VersionFile(0))
+	assert.Equal(t, ErrNotFound, err)
+
+	err = files.Create("abc", VersionFile(0), 1024)
+	assert.NoError(t, err)
+
+	f, err := files.Open("abc", VersionFile(0))
+	assert.NoError(t, err)
+	data, err := ioutil.ReadAll(f)
+	assert.NoError(t, err)
+	assert.Equal(t, make([]byte, 1024), data)
+	assert.NoError(t, f.Close())
+
+	w, err := files.Write("abc", VersionFile(1))
+	assert.NoError(t, err)
+	_, err = w.Write([]byte("hello world"))
+	assert.NoError(t, err)
+
+	// An aborted write leaves nothing behind
+	aborted, err := files.Write("abc", VersionFile(1))
+	assert.NoError(t, err)
+	_, err = aborted.Write([]byte("partial"))
+	assert.NoError(t, err)
+	assert.NoError(t, aborted.Abort())
+
+	// Nothing is visible until the writer is closed
+	_, err = files.Open("abc", VersionFile(1))
+	assert.Equal(t, ErrNotFound, err)
+	assert.NoError(t, w.Close())
+
+	f, err = files.Open("abc", VersionFile(1))
+	assert.NoError(t, err)
+	_, err = f.Seek(6, 0)
+	assert.NoError(t, err)
+	data, err = ioutil.ReadAll(f)
+	assert.NoError(t, err)
+	assert.Equal(t, "world", string(data))
+	assert.NoError(t, f.Close())
+
+	sum, err := files.Digest("abc", VersionFile(1))
+	assert.NoError(t, err)
+	assert.Equal(t, helloWorldDigest, sum)
+
+	_, err = files.Digest("abc", VersionFile(2))
+	assert.Equal(t, ErrNotFound, err)
+
+	err = files.Format("abc", VersionFile(1), "unknown")
+	assert.NoError(t, err)
+
+	err = files.Remove("abc", VersionFile(0))
+	assert.NoError(t, err)
+
+	_, err = files.Open("abc", VersionFile(0))
+	assert.Equal(t, ErrNotFound, err)
+
+	err = files.Remove("abc", VersionFile(0))
+	assert.NoError(t, err)
+
+	err = files.Delete("abc")
+	assert.NoError(t, err)
+
+	_, err = files.Open("abc", VersionFile(1))
+	assert.Equal(t, ErrNotFound, err)
+}
+
+func testStaging(t *testing.T, files ImageFiles) {
+	size, err := files.Staged("upload")
+	assert.NoError(t, err)
+	assert.Equal(t, int64(0), size)
+
+	size, err = files.Append("upload", 0, strings.NewReader("hello "))
+	assert.NoError(t, err)
+	assert.Equal(t, int64(6), size)
+
+	// Data sent again after a lost response is refused
+	size, err = files.Append("upload", 0, strings.NewReader("hello "))
+	assert.Equal(t, ErrOffsetMismatch, err)
+	assert.Equal(t, int64(6), size)
+
+	size, err = files.Append("upload", 6, strings.NewReader("world"))
+	assert.NoError(t, err)
+	assert.Equal(t, int64(11), size)
+
+	// Nothing is stored when the digest does not match
+	err = files.Commit("upload", "abc", VersionFile(3), "0000")
+	assert.Equal(t, ErrDigestMismatch, err)
+	_, err = files.Open("abc", VersionFile(3))
+	assert.Equal(t, ErrNotFound, err)
+
+	err = files.Commit("upload", "abc", VersionFile(3), helloWorldDigest)
+	assert.NoError(t, err)
+
+	f, err := files.Open("abc", VersionFile(3))
+	assert.NoError(t, err)
+	data, err := ioutil.ReadAll(f)
+	assert.NoError(t, err)
+	assert.Equal(t, "hello world", string(data))
+	assert.NoError(t, f.Close())
+
+	sum, err := files.Digest("abc", VersionFile(3))
+	assert.NoError(t, err)
+	assert.Equal(t, helloWorldDigest, sum)
+
+	// The upload is gone once it is committed
+	size, err = files.Staged("upload")
+	assert.NoError(t, err)
+	assert.Equal(t, int64(0), size)
+
+	_, err = files.Append("discarded", 0, strings.NewReader("data"))
+	assert.NoError(t, err)
+	assert.NoError(t, files.Discard("discarded"))
+	size, err = files.Staged("discarded")
+	assert.NoError(t, err)
+	assert.Equal(t, int64(0), size)
+}
+
+func TestDisk(t *testing.T) {
+	testImageFiles(t, NewDisk(t.TempDir()))
+	testStaging(t, NewDisk(t.TempDir()))
+}
+
+func TestMemory(t *testing.T) {
+	testImageFiles(t, NewMemory())
+	testStaging(t, NewMemory())
+}
+
+func TestChunked(t *testing.T) {
+	testImageFiles(t, NewChunked(t.TempDir()))
+	testStaging(t, NewChunked(t.TempDir()))
+}
+
+func writeFile(t *testing.T, files ImageFiles, uuid images.ImageUUID, name string, data []byte) {
+	w, err := files.Write(uuid, name)
+	assert.NoError(t, err)
+	_, err = w.Write(data)
+	assert.NoError(t, err)
+	assert.NoError(t, w.Close())
+}
+
+func TestChunked_Deduplication(t *testing.T) {
+	c := NewChunked(t.TempDir())
+	c.chunkSize = 4
+
+	writeFile(t, c, "abc", VersionFile(1), []byte("aaaabbbbcccc"))
+	writeFile(t, c, "abc", VersionFile(2), []byte("aaaaddddcccc"))
+	writeFile(t, c, "def", VersionFile(1), []byte("ccccaa"))
+
+	// aaaa, bbbb, cccc, dddd and the short aa
+	result, err := c.GC(0)
+	assert.NoError(t, err)
+	assert.Equal(t, 5, result.Chunks)
+	assert.Equal(t, 8, result.References)
+	assert.Equal(t, 0, result.Removed)
+
+	// Reads and seeks cross the chunk boundaries
+	f, err := c.Open("abc", VersionFile(2))
+	assert.NoError(t, err)
+	_, err = f.Seek(3, io.SeekStart)
+	assert.NoError(t, err)
+	data, err := ioutil.ReadAll(f)
+	assert.NoError(t, err)
+	assert.Equal(t, "addddcccc", string(data))
+	assert.NoError(t, f.Close())
+
+	// Only the chunks which are no longer used by any image are collected
+	assert.NoError(t, c.Delete("abc"))
+	result, err = c.GC(0)
+	assert.NoError(t, err)
+	assert.Equal(t, 3, result.Removed)
+	assert.Equal(t, int64(12), result.Freed)
+
+	f, err = c.Open("def", VersionFile(1))
+	assert.NoError(t, err)
+	data, err = ioutil.ReadAll(f)
+	assert.NoError(t, err)
+	assert.Equal(t, "ccccaa", string(data))
+	assert.NoError(t, f.Close())
+}
+
+func TestChunked_GCKeepsPendingChunks(t *testing.T) {
+	c := NewChunked(t.TempDir())
+	c.chunkSize = 4
+
+	w, err := c.Write("abc", VersionFile(1))
+	assert.NoError(t, err)
+	_, err = w.Write([]byte("aaaabbbb"))
+	assert.NoError(t, err)
+
+	result, err := c.GC(0)
+	assert.NoError(t, err)
+	assert.Equal(t, 0, result.Removed)
+
+	// Unless they are young, aborted chunks can be collected
+	assert.NoError(t, w.Abort())
+	result, err = c.GC(time.Hour)
+	assert.NoError(t, err)
+	assert.Equal(t, 0, result.Removed)
+
+	result, err = c.GC(0)
+	assert.NoError(t, err)
+	assert.Equal(t, 2, result.Removed)
+}
+
+func TestChunked_GCKeepsReusedChunks(t *testing.T) {
+	c := NewChunked(t.TempDir())
+	c.chunkSize = 4
+
+	writeFile(t, c, "abc", VersionFile(1), []byte("aaaa"))
+	assert.NoError(t, c.Delete("abc"))
+
+	sum := sha256.Sum256([]byte("aaaa"))
+	old := time.Now().Add(-2 * time.Hour)
+	assert.NoError(t, os.Chtimes(c.chunkPath(hex.EncodeToString(sum[:])), old, old))
+
+	// The old chunk is reused by an aborted write, which makes it as young as a chunk it wrote
+	w, err := c.Write("abc", VersionFile(2))
+	assert.NoError(t, err)
+	_, err = w.Write([]byte("aaaa"))
+	assert.NoError(t, err)
+	assert.NoError(t, w.Abort())
+
+	result, err := c.GC(time.Hour)
+	assert.NoError(t, err)
+	assert.Equal(t, 0, result.Removed)
+
+	result, err = c.GC(0)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, result.Removed)
+}
+
+func TestChunked_LegacyManifestDigest(t *testing.T) {
+	c := NewChunked(t.TempDir())
+	c.chunkSize = 4
+
+	// Manifests written before the digest was recorded lack it
+	writeFile(t, c, "abc", VersionFile(1), []byte("hello world"))
+	legacy, err := c.readManifest("abc", VersionFile(1))
+	assert.NoError(t, err)
+	legacy.Digest = ""
+	assert.NoError(t, c.commit("abc", VersionFile(1), legacy))
+
+	sum, err := c.Digest("abc", VersionFile(1))
+	assert.NoError(t, err)
+	assert.Equal(t, helloWorldDigest, sum)
+
+	manifest, err := c.readManifest("abc", VersionFile(1))
+	assert.NoError(t, err)
+	assert.Equal(t, helloWorldDigest, manifest.Digest)
+
+	// A manifest committed while the digest was computed is not overwritten
+	legacy.Digest = ""
+	assert.NoError(t, c.commit("abc", VersionFile(1), legacy))
+	writeFile(t, c, "abc", VersionFile(1), []byte("other"))
+	assert.NoError(t, c.recordDigest("abc", VersionFile(1), legacy, helloWorldDigest))
+
+	f, err := c.Open("abc", VersionFile(1))
+	assert.NoError(t, err)
+	data, err := ioutil.ReadAll(f)
+	assert.NoError(t, err)
+	assert.Equal(t, "other", string(data))
+	assert.NoError(t, f.Close())
+
+	manifest, err = c.readManifest("abc", VersionFile(1))
+	assert.NoError(t, err)
+	assert.NotEqual(t, helloWorldDigest, manifest.Digest)
+}
+
+func TestChunked_PlainFiles(t *testing.T) {
+	root := t.TempDir()
+	writeFile(t, NewDisk(root), "abc", VersionFile(0), []byte("plain"))
+
+	// Files written before the chunked storage was used can still be read
+	c := NewChunked(root)
+	f, err := c.Open("abc", VersionFile(0))
+	assert.NoError(t, err)
+	data, err := ioutil.ReadAll(f)
+	assert.NoError(t, err)
+	assert.Equal(t, "plain", string(data))
+	assert.NoError(t, f.Close())
+
+	sum, err := c.Digest("abc", VersionFile(0))
+	assert.NoError(t, err)
+	assert.Equal(t, "a116c9ed46d6207734a43317d30fd88f52ac8634c37d904bbf4e41d865f90475", sum)
+
+	// And are replaced by chunks when they are written
+	writeFile(t, c, "abc", VersionFile(0), []byte("chunked"))
+	_, err = os.Stat(filepath.Join(root, "abc", VersionFile(0)))
+	assert.True(t, os.IsNotExist(err))
+
+	f, err = c.Open("abc", VersionFile(0))
+	assert.NoError(t, err)
+	data, err = ioutil.ReadAll(f)
+	assert.NoError(t, err)
+	assert.Equal(t, "chunked", string(data))
+	assert.NoError(t, f.Close())
+
+	sum, err = c.Digest("abc", VersionFile(0))
+	assert.NoError(t, err)
+	assert.Equal(t, "59fdd34a0b323f6044e147b843d8ca246a9414d2c7a06c8e95a7e04c3cdaf395", sum)
+}
@@ -0,0 +1,136 @@
+// Copyright (c) 2020-2022 TU Delft & Valentijn van de Beek <v.d.vandebeek@student.tudelft.nl> All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package util
+
+import (
+	"io"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// DefaultProgressInterval is the time between two reports of a ProgressReporter which does not set its own
+const DefaultProgressInterval = 2 * time.Second
+
+// Progress is how far a transfer is
+type Progress struct {
+	// Done is the number of bytes which were transferred and Total the number there are, 0 if it is unknown
+	Done  int64
+	Total int64
+
+	// Throughput is the average number of bytes per second since the transfer started
+	Throughput float64
+	// ETA is the time the rest of the transfer is expected to take, 0 if the total is unknown
+	ETA time.Duration
+
+	Finished bool
+}
+
+// ProgressReporter is a struct which contains a reader which records the progress made
+// Idea and basic implementation taken from:
+// https://stackoverflow.com/questions/26050380/go-tracking-post-request-progress
+type ProgressReporter struct {
+	R     io.Reader
+	Total int64
+
+	// Report is called with the progress at most once every Interval and when the reader is done, the progress
+	// is logged when it is nil
+	Report   func(Progress)
+	Interval time.Duration
+
+	mu       sync.Mutex
+	done     int64
+	start    time.Time
+	last     time.Time
+	finished bool
+}
+
+// Read defines a function which keeps track of the amount of data
+// being sent over a reader
+func (pr *ProgressReporter) Read(p []byte) (int, error) {
+	n, err := pr.R.Read(p)
+	pr.Add(int64(n))
+
+	if err == io.EOF {
+		pr.Finish()
+	}
+
+	return n, err
+}
+
+// Add records that n more bytes were transferred, it is used when the bytes do not go through the reader
+func (pr *ProgressReporter) Add(n int64) {
+	pr.mu.Lock()
+	now := time.Now()
+	if pr.start.IsZero() {
+		pr.start = now
+		pr.last = now
+	}
+
+	pr.done += n
+
+	interval := pr.Interval
+	if interval == 0 {
+		interval = DefaultProgressInterval
+	}
+
+	due := !pr.finished && now.Sub(pr.last) >= interval
+	if due {
+		pr.last = now
+	}
+	pr.mu.Unlock()
+
+	if due {
+		pr.report(pr.Progress())
+	}
+}
+
+// Finish reports the progress for the last time, later calls do nothing
+func (pr *ProgressReporter) Finish() {
+	pr.mu.Lock()
+	finished := pr.finished
+	pr.finished = true
+	pr.mu.Unlock()
+
+	if !finished {
+		pr.report(pr.Progress())
+	}
+}
+
+// Progress returns how far the transfer is now
+func (pr *ProgressReporter) Progress() Progress {
+	pr.mu.Lock()
+	defer pr.mu.Unlock()
+
+	progress := Progress{Done: pr.done, Total: pr.Total, Finished: pr.finished}
+	if pr.start.IsZero() {
+		return progress
+	}
+
+	elapsed := time.Since(pr.start).Seconds()
+	if elapsed > 0 {
+		progress.Throughput = float64(pr.done) / elapsed
+	}
+
+	if pr.Total > pr.done && progress.Throughput > 0 {
+		progress.ETA = time.Duration(float64(pr.Total-pr.done) / progress.Throughput * float64(time.Second))
+	}
+
+	return progress
+}
+
+func (pr *ProgressReporter) report(progress Progress) {
+	if pr.Report != nil {
+		pr.Report(progress)
+		return
+	}
+
+	log.Infof("sent %d of %d bytes (%.0f B/s, %s left)", progress.Done, progress.Total, progress.Throughput,
+		progress.ETA.Round(time.Second))
+	if progress.Finished {
+		log.Info("DONE")
+	}
+}
@@ -0,0 +1,73 @@
+// Copyright (c) 2020-2022 TU Delft & Valentijn van de Beek <v.d.vandebeek@student.tudelft.nl> All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package util
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestProgressReporter(t *testing.T) {
+	var reports []Progress
+	reporter := &ProgressReporter{
+		R:        bytes.NewReader(make([]byte, 10_000)),
+		Total:    10_000,
+		Interval: time.Nanosecond,
+		Report: func(progress Progress) {
+			reports = append(reports, progress)
+		},
+	}
+
+	// Every byte is counted, however the reads are split up
+	buf := make([]byte, 3_000)
+	for {
+		_, err := reporter.Read(buf)
+		if err == io.EOF {
+			break
+		}
+		assert.NoError(t, err)
+	}
+
+	assert.NotEmpty(t, reports)
+	last := reports[len(reports)-1]
+	assert.True(t, last.Finished)
+	assert.Equal(t, int64(10_000), last.Done)
+	assert.Equal(t, int64(10_000), last.Total)
+	assert.Zero(t, last.ETA)
+
+	for _, progress := range reports[:len(reports)-1] {
+		assert.False(t, progress.Finished)
+		assert.True(t, progress.Done <= progress.Total)
+	}
+
+	// The end is only reported once
+	reporter.Finish()
+	assert.Equal(t, last, reports[len(reports)-1])
+}
+
+func TestProgressReporterInterval(t *testing.T) {
+	reports := 0
+	reporter := &ProgressReporter{
+		R:        bytes.NewReader(make([]byte, 1024*1024)),
+		Interval: time.Hour,
+		Report: func(Progress) {
+			reports++
+		},
+	}
+
+	_, err := io.CopyBuffer(ioutil.Discard, reporter, make([]byte, 1024))
+	assert.NoError(t, err)
+
+	// Nothing is reported before the interval passed, except for the end
+	assert.Equal(t, 1, reports)
+	progress := reporter.Progress()
+	assert.Equal(t, int64(1024*1024), progress.Done)
+	assert.True(t, progress.Throughput > 0)
+}